@@ -0,0 +1,430 @@
+// Package api описывает запросы и ответы HTTP API веб-сервера (cmd/web).
+// Типы используются и сервером, и клиентом (пакет client), поэтому формат не может разойтись.
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// PathPrefix — префикс путей HTTP API, например PathPrefix + "/status/<jobID>". Прежние пути без префикса
+// (/upload, /status/, /cancel/, /api/results/, /api/jobs, /export/vat/) остаются устаревшими псевдонимами:
+// сервер отвечает на них так же, добавляя заголовки DeprecationHeader и Link на новый путь.
+const PathPrefix = "/api/v1"
+
+// OpenAPIPath — адрес описания API в формате OpenAPI 3 (см. OpenAPI).
+const OpenAPIPath = PathPrefix + "/openapi.json"
+
+// DeprecationHeader отмечает ответ на устаревший путь API.
+const DeprecationHeader = "Deprecation"
+
+// CorrelationIDHeader передает внешний идентификатор для трассировки задания между системами.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// TotalCountHeader в ответе GET /api/v1/jobs содержит число заданий, подходящих под фильтр, без учета страниц.
+const TotalCountHeader = "X-Total-Count"
+
+// PreferHeader со значением PreferRespondAsync просит /api/v1/extract не ждать обработки, а создать задание
+// и ответить 202 с заголовком Location на его статус (RFC 7240). Примененное предпочтение повторяется
+// в заголовке PreferenceAppliedHeader.
+const (
+	PreferHeader            = "Prefer"
+	PreferenceAppliedHeader = "Preference-Applied"
+	PreferRespondAsync      = "respond-async"
+)
+
+// Параметры GET /api/v1/jobs.
+const (
+	ParamStatus = "status" // Фильтр по статусу; можно указать несколько раз
+	ParamTag    = "tag"    // Фильтр по метке; задание должно иметь все указанные метки
+	ParamPage   = "page"   // Номер страницы с 1
+	ParamLimit  = "limit"  // Заданий на странице: по умолчанию DefaultJobsLimit, не больше MaxJobsLimit
+)
+
+// ParamDirection — фильтр GET /api/v1/results/<jobID> по направлению инвойса
+// (invoice.DirectionIncoming или invoice.DirectionOutgoing).
+const ParamDirection = "direction"
+
+// Параметры GET /api/v1/results/<jobID> (см. ResultQuery). Статус результата задается ParamStatus
+// (ResultStatusOK или ResultStatusError), страница — ParamPage и ParamLimit, как у списка заданий.
+const (
+	ParamCounterparty = "counterparty" // Часть наименования контрагента (без учета регистра) или его VAT целиком
+	ParamDateFrom     = "date_from"    // Дата инвойса не раньше, YYYY-MM-DD
+	ParamDateTo       = "date_to"      // Дата инвойса не позже, YYYY-MM-DD
+	ParamMinAmount    = "min_amount"   // Итоговая сумма инвойса не меньше
+	ParamMaxAmount    = "max_amount"   // Итоговая сумма инвойса не больше
+	ParamSort         = "sort"         // SortDate, SortAmount или SortFile; без сортировки — порядок отчета
+	ParamOrder        = "order"        // OrderAsc (по умолчанию) или OrderDesc
+)
+
+// Статусы результата для фильтра ParamStatus в GET /api/v1/results/<jobID>.
+const (
+	ResultStatusOK    = "ok"    // Инвойс извлечен
+	ResultStatusError = "error" // Файл не обработан
+)
+
+// Сортировка результатов GET /api/v1/results/<jobID>.
+const (
+	SortDate   = "date"
+	SortAmount = "amount"
+	SortFile   = "file"
+	OrderAsc   = "asc"
+	OrderDesc  = "desc"
+)
+
+// Размер страницы GET /api/v1/jobs. Без page и limit возвращаются все задания.
+const (
+	DefaultJobsLimit = 50
+	MaxJobsLimit     = 500
+)
+
+// Поля формы загрузки (POST /api/v1/upload).
+const (
+	FieldZipFile         = "zipfile"          // Zip-архив с инвойсами
+	FieldInspectionToken = "inspection_token" // Токен архива, сохраненного /api/v1/inspect (вместо zipfile)
+	FieldLanguage        = "lang"             // Язык сообщений журнала задания
+	FieldCorrelationID   = "correlation_id"   // Альтернатива заголовку CorrelationIDHeader
+	FieldTags            = "tags"             // Метки задания через запятую
+	FieldNote            = "note"             // Заметка к заданию
+	FieldCallbackURL     = "callback_url"     // Адрес вебхука о завершении задания (http или https, не во внутренней сети сервера — см. webhook_allowed_hosts)
+	FieldPDFPassword     = "pdf_password"     // Пароль защищенных PDF архива; пробуется раньше pdf_passwords конфигурации
+	FieldCSVReport       = "csv_report"       // true или false: собирать ли CSV-отчет задания вместо csv_report конфигурации
+	FieldCompany         = "company"          // Псевдоним своей компании из companies конфигурации
+	FieldCompanyName     = "company_name"     // Данные своей компании вместо данных из конфигурации (несовместимы с company)
+	FieldCompanyVAT      = "company_vat"
+	FieldCompanyCountry  = "company_country"
+	FieldCompanyAddress  = "company_address"
+	FieldCompanyIBAN     = "company_iban"
+	FieldCompanySWIFT    = "company_swift"
+)
+
+// WebhookSignatureHeader содержит подпись тела вебхука: "sha256=" и HMAC-SHA256 тела в hex
+// с ключом webhook_secret из конфигурации сервера. Без ключа заголовок не передается.
+const WebhookSignatureHeader = "X-Invpa-Signature"
+
+// WebhookPayload — тело POST-запроса вебхука, когда задание получает статус StatusCompleted или StatusError.
+type WebhookPayload struct {
+	JobID          string              `json:"job_id"`
+	CorrelationID  string              `json:"correlation_id"`
+	Status         string              `json:"status"`
+	Error          string              `json:"error,omitempty"`
+	TotalFiles     int                 `json:"total_files"`
+	ProcessedFiles int                 `json:"processed_files"`
+	Summary        *invoice.RunSummary `json:"summary,omitempty"`          // Итоги обработки завершенного задания
+	DownloadURL    string              `json:"download_url,omitempty"`     // Excel-отчет
+	DownloadURLCSV string              `json:"download_url_csv,omitempty"` // CSV-отчет
+	Tags           []string            `json:"tags,omitempty"`
+	Results        []Result            `json:"results,omitempty"` // Результаты по инвойсам, только при webhook_include_results
+	// Reprocessed — файлы, которые сервер только что обработал повторно (auto_reprocess). Вебхук с этим полем
+	// приходит после уже доставленного вебхука о завершении задания, итоги и отчеты в нем обновлены.
+	Reprocessed []string `json:"reprocessed,omitempty"`
+}
+
+// Ограничения меток и заметки задания; при превышении сервер отвечает 400.
+const (
+	MaxTags       = 20   // Меток у одного задания
+	MaxTagLength  = 40   // Символов в метке
+	MaxNoteLength = 2000 // Символов в заметке
+)
+
+// Статусы задания (JobStatus.Status).
+const (
+	StatusProcessing = "Processing"
+	StatusCompleted  = "Completed"
+	StatusCancelled  = "Cancelled" // Результаты доступны, если ResultPath не пуст
+	StatusError      = "Error"
+)
+
+// UploadResponse — ответ на создание задания.
+type UploadResponse struct {
+	JobID         string `json:"job_id"`
+	CorrelationID string `json:"correlation_id"`
+}
+
+// ErrorResponse — тело любого ответа с ошибкой: {"error": {"code": "...", "message": "..."}}.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody — ошибка ответа: стабильный код для программ и текст для людей.
+type ErrorBody struct {
+	Code    string `json:"code"`    // См. константы ErrorCode*
+	Message string `json:"message"` // Текст ошибки; может меняться между версиями
+}
+
+// Коды ошибок (ErrorBody.Code). Код следует из HTTP-статуса ответа (см. ErrorCodeForStatus).
+const (
+	ErrorCodeBadRequest           = "bad_request"
+	ErrorCodeUnauthorized         = "unauthorized"
+	ErrorCodeNotFound             = "not_found"
+	ErrorCodeMethodNotAllowed     = "method_not_allowed"
+	ErrorCodeNotAcceptable        = "not_acceptable"
+	ErrorCodeConflict             = "conflict"
+	ErrorCodeTooLarge             = "payload_too_large"
+	ErrorCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrorCodeUnprocessable        = "unprocessable"
+	ErrorCodeInternal             = "internal"
+	ErrorCodeUnavailable          = "unavailable"
+	ErrorCodeTimeout              = "timeout"
+)
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            ErrorCodeBadRequest,
+	http.StatusUnauthorized:          ErrorCodeUnauthorized,
+	http.StatusNotFound:              ErrorCodeNotFound,
+	http.StatusMethodNotAllowed:      ErrorCodeMethodNotAllowed,
+	http.StatusNotAcceptable:         ErrorCodeNotAcceptable,
+	http.StatusConflict:              ErrorCodeConflict,
+	http.StatusRequestEntityTooLarge: ErrorCodeTooLarge,
+	http.StatusUnsupportedMediaType:  ErrorCodeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   ErrorCodeUnprocessable,
+	http.StatusServiceUnavailable:    ErrorCodeUnavailable,
+	http.StatusGatewayTimeout:        ErrorCodeTimeout,
+}
+
+// ErrorCodeForStatus возвращает код ошибки для HTTP-статуса; неизвестные статусы 4xx — ErrorCodeBadRequest,
+// остальные — ErrorCodeInternal.
+func ErrorCodeForStatus(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= 400 && status < 500 {
+		return ErrorCodeBadRequest
+	}
+	return ErrorCodeInternal
+}
+
+// CancelResponse — ответ POST /api/v1/cancel/<jobID>.
+type CancelResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"` // StatusCancelled
+}
+
+// ReadyResponse — ответ GET /readyz: готов ли сервер принимать задания с текущим config.json.
+type ReadyResponse struct {
+	Ready    bool     `json:"ready"`
+	Problems []string `json:"problems,omitempty"` // Проблемы конфигурации (см. invoice.Config.Validate)
+}
+
+// LogEntry — строка журнала задания: стабильный идентификатор сообщения, уровень и текст на языке задания.
+type LogEntry struct {
+	ID    string
+	Level string // LogLevelDebug, LogLevelInfo, LogLevelWarn или LogLevelError; пусто — LogLevelInfo
+	Text  string
+}
+
+// Уровни записей журнала задания от подробных к важным.
+const (
+	LogLevelDebug = "DEBUG" // Подробности: параллелизм, время по этапам
+	LogLevelInfo  = "INFO"  // Ход обработки
+	LogLevelWarn  = "WARN"  // Проблемы, не прерывающие задание
+	LogLevelError = "ERROR" // Ошибки файлов и задания
+)
+
+// ParamLevel — минимальный уровень записей журнала в GET /api/v1/status/<jobID>.
+const ParamLevel = "level"
+
+var logLevels = []string{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError}
+
+// ParseLogLevel разбирает уровень журнала без учета регистра; "WARNING" — синоним WARN.
+func ParseLogLevel(value string) (string, error) {
+	level := strings.ToUpper(strings.TrimSpace(value))
+	if level == "WARNING" {
+		level = LogLevelWarn
+	}
+	if !slices.Contains(logLevels, level) {
+		return "", fmt.Errorf("unknown log level %q (expected one of %s)", value, strings.Join(logLevels, ", "))
+	}
+	return level, nil
+}
+
+// logLevelRank возвращает порядковый номер уровня; пустой или неизвестный уровень считается INFO.
+func logLevelRank(level string) int {
+	if rank := slices.Index(logLevels, level); rank >= 0 {
+		return rank
+	}
+	return slices.Index(logLevels, LogLevelInfo)
+}
+
+// FilterLog возвращает записи журнала с уровнем не ниже minLevel, сохраняя их порядок.
+// Записи ERROR возвращаются при любом minLevel.
+func FilterLog(entries []LogEntry, minLevel string) []LogEntry {
+	minRank := min(logLevelRank(minLevel), logLevelRank(LogLevelError))
+	filtered := make([]LogEntry, 0, len(entries))
+	for _, entry := range entries {
+		if logLevelRank(entry.Level) >= minRank {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// JobStatus — состояние задания (GET /api/v1/status/<jobID>).
+type JobStatus struct {
+	ID               string
+	CorrelationID    string     // Внешний идентификатор трассировки; генерируется, если клиент его не передал
+	Status           string     // См. константы Status*
+	Language         string     // Язык сообщений: из формы загрузки или Accept-Language
+	Company          string     // Псевдоним своей компании из поля company формы загрузки (пусто — my_company или данные из формы)
+	Log              []LogEntry // Журнал со стабильными идентификаторами сообщений и текстом на языке Language
+	Error            string
+	ErrorID          string // Идентификатор сообщения Error
+	ResultPath       string
+	DownloadURL      string // Excel-отчет
+	DownloadURLCSV   string // Zip-архив с invoices.csv и counterparties.csv; пусто, если CSV-отчет не запрошен (см. FieldCSVReport)
+	DownloadURLTrace string // Трасса обработки в JSON (только при "trace" в config.json)
+	TotalFiles       int
+	ProcessedFiles   int
+	FileUsage        map[string]invoice.Usage // Использование OpenAI по исходным файлам
+	FileErrors       map[string]string        // Коды ошибок (invoice.ErrorCode*) по исходным файлам, которые не удалось обработать
+	MatchingUsage    invoice.Usage            // Использование OpenAI при сопоставлении контрагентов
+	Usage            invoice.Usage            // Суммарное использование OpenAI заданием
+	EstimatedCost    float64                  // Оценка стоимости задания в долларах
+	Summary          *invoice.RunSummary      // Итоги обработки, заполняются после генерации отчета
+	Tags             []string                 // Метки для группировки заданий ("Q2 close", "needs re-review")
+	Note             string                   // Произвольная заметка
+	ReportStale      bool                     // Результаты исправлены после создания отчетов; отчеты обновляет POST /api/v1/results/<jobID>/regenerate
+}
+
+// Finished сообщает, что результаты задания доступны.
+func (s JobStatus) Finished() bool {
+	return s.Status == StatusCompleted || (s.Status == StatusCancelled && s.ResultPath != "")
+}
+
+// Done сообщает, что задание больше не изменится.
+func (s JobStatus) Done() bool {
+	return s.Status == StatusCompleted || s.Status == StatusCancelled || s.Status == StatusError
+}
+
+// Result — invoice.Result со стабильным идентификатором для ссылок на результат.
+type Result struct {
+	ID        string // Не меняется при пересборке отчета и правках
+	SourceURL string // Ссылка на сохраненный исходный файл (только при retain_sources в config.json)
+	invoice.Result
+}
+
+// JobResultData — данные таблиц результатов (GET /api/v1/results/<jobID>).
+type JobResultData struct {
+	AllResults           []Result
+	UniqueCounterparties []invoice.UniqueCounterparty
+	ConfidenceThreshold  float64 // Значения с уверенностью ниже порога (Invoice.Confidences) следует выделять
+	Total                int     // Результатов, подходящих под фильтр, на всех страницах
+	JobTotal             int     // Всех результатов задания без фильтра
+}
+
+// ResultQuery — фильтр, сортировка и страница GET /api/v1/results/<jobID>. Пустые поля не ограничивают
+// результаты; фильтры по контрагенту, дате, сумме и направлению оставляют только инвойсы, без строк ошибок.
+// Нулевые Page и Limit — все результаты.
+type ResultQuery struct {
+	Direction    string
+	Counterparty string
+	Status       string // ResultStatusOK или ResultStatusError
+	DateFrom     string // YYYY-MM-DD
+	DateTo       string
+	MinAmount    *float64
+	MaxAmount    *float64
+	Sort         string // SortDate, SortAmount или SortFile
+	Order        string // OrderAsc или OrderDesc
+	Page         int
+	Limit        int
+}
+
+// Values возвращает параметры запроса GET /api/v1/results/<jobID>.
+func (q ResultQuery) Values() url.Values {
+	values := url.Values{}
+	for param, value := range map[string]string{
+		ParamDirection:    q.Direction,
+		ParamCounterparty: q.Counterparty,
+		ParamStatus:       q.Status,
+		ParamDateFrom:     q.DateFrom,
+		ParamDateTo:       q.DateTo,
+		ParamSort:         q.Sort,
+		ParamOrder:        q.Order,
+	} {
+		if value != "" {
+			values.Set(param, value)
+		}
+	}
+	if q.MinAmount != nil {
+		values.Set(ParamMinAmount, strconv.FormatFloat(*q.MinAmount, 'f', -1, 64))
+	}
+	if q.MaxAmount != nil {
+		values.Set(ParamMaxAmount, strconv.FormatFloat(*q.MaxAmount, 'f', -1, 64))
+	}
+	if q.Page > 0 {
+		values.Set(ParamPage, strconv.Itoa(q.Page))
+	}
+	if q.Limit > 0 {
+		values.Set(ParamLimit, strconv.Itoa(q.Limit))
+	}
+	return values
+}
+
+// JobLabels — метки и заметка задания: тело и ответ PUT /api/v1/jobs/<jobID>/labels.
+// Метки и заметка заменяются целиком; пустой список удаляет все метки.
+type JobLabels struct {
+	Tags []string `json:"tags"`
+	Note string   `json:"note"`
+}
+
+// JobSummary — задание в списке GET /api/v1/jobs, от новых к старым.
+type JobSummary struct {
+	ID             string    `json:"id"`
+	CorrelationID  string    `json:"correlation_id"`
+	Status         string    `json:"status"`
+	Created        time.Time `json:"created"`
+	TotalFiles     int       `json:"total_files"`
+	ProcessedFiles int       `json:"processed_files"`
+	DownloadURL    string    `json:"download_url,omitempty"`     // Excel-отчет, когда результаты доступны
+	DownloadURLCSV string    `json:"download_url_csv,omitempty"` // CSV-отчет, когда результаты доступны
+	Tags           []string  `json:"tags,omitempty"`
+	Note           string    `json:"note,omitempty"`
+}
+
+// JobQuery — фильтр и страница GET /api/v1/jobs. Нулевые Page и Limit — все задания.
+type JobQuery struct {
+	Status []string
+	Tags   []string
+	Page   int
+	Limit  int
+}
+
+// JobPage — страница списка заданий.
+type JobPage struct {
+	Jobs  []JobSummary
+	Total int // Заданий, подходящих под фильтр, на всех страницах
+}
+
+// MergeRequest — тело POST /api/v1/results/<jobID>/merge.
+type MergeRequest struct {
+	KeepID  uint64 `json:"keep_id"`  // Остающийся контрагент
+	MergeID uint64 `json:"merge_id"` // Дубликат, который объединяется с KeepID и удаляется
+}
+
+// InspectedFile описывает файл проверенного архива.
+type InspectedFile struct {
+	Path      string `json:"path"`
+	Type      string `json:"type"` // Расширение в нижнем регистре без точки
+	Supported bool   `json:"supported"`
+	Pages     int    `json:"pages,omitempty"` // 0, если число страниц неизвестно (см. Error)
+	Error     string `json:"error,omitempty"`
+}
+
+// InspectionResult — ответ POST /api/v1/inspect: состав архива и оценка стоимости обработки.
+type InspectionResult struct {
+	Files          []InspectedFile `json:"files"`
+	Counts         map[string]int  `json:"counts"` // Поддерживаемые файлы по типам
+	Unsupported    int             `json:"unsupported"`
+	Pages          int             `json:"pages"`
+	EstimatedUsage invoice.Usage   `json:"estimated_usage"`
+	EstimatedCost  float64         `json:"estimated_cost"`  // В долларах, без учета кэша результатов
+	Token          string          `json:"token,omitempty"` // Передается в /api/v1/upload как inspection_token
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]string{
+		"debug": LogLevelDebug, " Info ": LogLevelInfo, "WARN": LogLevelWarn, "warning": LogLevelWarn, "error": LogLevelError,
+	}
+	for value, want := range tests {
+		if got, err := ParseLogLevel(value); err != nil || got != want {
+			t.Errorf("ParseLogLevel(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "trace", "fatal", "warn ing"} {
+		if got, err := ParseLogLevel(value); err == nil {
+			t.Errorf("ParseLogLevel(%q) = %q, want an error", value, got)
+		}
+	}
+}
+
+func TestFilterLog(t *testing.T) {
+	entries := []LogEntry{
+		{ID: "concurrency", Level: LogLevelDebug},
+		{ID: "unzipping", Level: LogLevelInfo},
+		{ID: "legacy"}, // Записи без уровня из старых заданий считаются INFO
+		{ID: "error.file", Level: LogLevelError},
+		{ID: "skipped", Level: LogLevelWarn},
+		{ID: "error.job", Level: LogLevelError},
+	}
+	tests := map[string][]string{
+		LogLevelDebug: {"concurrency", "unzipping", "legacy", "error.file", "skipped", "error.job"},
+		LogLevelInfo:  {"unzipping", "legacy", "error.file", "skipped", "error.job"},
+		LogLevelWarn:  {"error.file", "skipped", "error.job"},
+		LogLevelError: {"error.file", "error.job"},
+		"":            {"unzipping", "legacy", "error.file", "skipped", "error.job"},
+	}
+	for level, want := range tests {
+		var got []string
+		for _, entry := range FilterLog(entries, level) {
+			got = append(got, entry.ID)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("FilterLog(%q) = %v, want %v", level, got, want)
+		}
+	}
+}
+
+// TestFilterLogKeepsErrors проверяет, что записи ERROR не отбрасываются ни при каком уровне фильтра,
+// включая неизвестные значения, которые не прошли бы ParseLogLevel.
+func TestFilterLogKeepsErrors(t *testing.T) {
+	entries := []LogEntry{{ID: "a", Level: LogLevelError}, {ID: "b", Level: LogLevelDebug}, {ID: "c", Level: LogLevelError}}
+	for _, level := range append(slices.Clone(logLevels), "", "FATAL", "CRITICAL", "error") {
+		errors := 0
+		for _, entry := range FilterLog(entries, level) {
+			if entry.Level == LogLevelError {
+				errors++
+			}
+		}
+		if errors != 2 {
+			t.Errorf("FilterLog(%q) kept %d of 2 ERROR entries", level, errors)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// OpenAPIDocument — описание HTTP API в формате OpenAPI 3.0 (GET OpenAPIPath).
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"` // Путь -> метод в нижнем регистре -> операция
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo — название и версия API.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenAPIOperation — операция пути: запрос и ответы.
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"` // HTTP-статус или "default"
+}
+
+// OpenAPIParameter — параметр пути, запроса или заголовок.
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"` // path, query или header
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIRequestBody — тело запроса по типам содержимого.
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse — ответ операции.
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Headers     map[string]OpenAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIHeader — заголовок ответа.
+type OpenAPIHeader struct {
+	Description string         `json:"description,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIMediaType — схема содержимого одного типа.
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIComponents — именованные схемы, на которые ссылаются операции.
+type OpenAPIComponents struct {
+	Schemas map[string]*OpenAPISchema `json:"schemas"`
+}
+
+// OpenAPISchema — схема значения (подмножество JSON Schema, используемое OpenAPI 3.0).
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+// schemaRefPrefix — начало ссылки на схему из OpenAPIComponents.
+const schemaRefPrefix = "#/components/schemas/"
+
+var (
+	timeType     = reflect.TypeFor[time.Time]()
+	durationType = reflect.TypeFor[time.Duration]()
+)
+
+// schemaBuilder строит схемы по типам Go по правилам encoding/json и собирает именованные структуры
+// в компоненты, чтобы схема описывала ровно то, что сервер кодирует в ответ.
+type schemaBuilder struct {
+	schemas map[string]*OpenAPISchema
+}
+
+// of возвращает схему типа значения v.
+func (b *schemaBuilder) of(v any) *OpenAPISchema {
+	return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) *OpenAPISchema {
+	switch t {
+	case timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &OpenAPISchema{Type: "integer", Format: "int64", Description: "Nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenAPISchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &OpenAPISchema{Type: "string", Format: "byte"}
+		}
+		return &OpenAPISchema{Type: "array", Items: b.schema(t.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.schemas[name]; !ok {
+			b.schemas[name] = &OpenAPISchema{} // Заглушка для рекурсивных типов
+			b.schemas[name] = b.object(t)
+		}
+		return &OpenAPISchema{Ref: schemaRefPrefix + name}
+	}
+	return &OpenAPISchema{} // interface{}: любое значение
+}
+
+// object строит схему структуры. Поля встроенных структур без тега поднимаются на уровень структуры,
+// поля самой структуры имеют приоритет, как в encoding/json.
+func (b *schemaBuilder) object(t reflect.Type) *OpenAPISchema {
+	schema := &OpenAPISchema{Type: "object", Properties: make(map[string]*OpenAPISchema)}
+	var embedded []reflect.Type
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				embedded = append(embedded, fieldType)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = b.schema(field.Type)
+	}
+	for _, fieldType := range embedded {
+		for name, property := range b.object(fieldType).Properties {
+			if _, ok := schema.Properties[name]; !ok {
+				schema.Properties[name] = property
+			}
+		}
+	}
+	return schema
+}
+
+// schemaName — имя компонента: пакет и тип, например "api.JobStatus".
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+	return pkg + "." + t.Name()
+}
+
+// OpenAPI возвращает описание HTTP API. Схемы тел строятся по типам пакета api и invoice, которыми
+// пользуются сервер и клиент, а список операций ведется вместе с обработчиками cmd/web.
+// Устаревшие пути без PathPrefix в описание не входят.
+func OpenAPI() OpenAPIDocument {
+	b := &schemaBuilder{schemas: make(map[string]*OpenAPISchema)}
+	errorResponse := &OpenAPIResponse{Description: "Error", Content: jsonContent(b.of(ErrorResponse{}))}
+	stringSchema := &OpenAPISchema{Type: "string"}
+	integerSchema := &OpenAPISchema{Type: "integer"}
+	numberSchema := &OpenAPISchema{Type: "number", Format: "double"}
+	dateSchema := &OpenAPISchema{Type: "string", Format: "date"}
+
+	jobID := OpenAPIParameter{Name: "jobID", In: "path", Required: true, Schema: stringSchema}
+	query := func(name, description string, schema *OpenAPISchema, values ...string) OpenAPIParameter {
+		if len(values) > 0 {
+			schema = &OpenAPISchema{Type: schema.Type, Enum: values}
+		}
+		return OpenAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+	}
+	ok := func(description string, content map[string]OpenAPIMediaType) map[string]*OpenAPIResponse {
+		return map[string]*OpenAPIResponse{
+			"200":     {Description: description, Content: content},
+			"default": errorResponse,
+		}
+	}
+	okJSON := func(description string, v any) map[string]*OpenAPIResponse {
+		return ok(description, jsonContent(b.of(v)))
+	}
+	file := func(contentType string) map[string]OpenAPIMediaType {
+		return map[string]OpenAPIMediaType{contentType: {Schema: &OpenAPISchema{Type: "string", Format: "binary"}}}
+	}
+	jsonBody := func(v any) *OpenAPIRequestBody {
+		return &OpenAPIRequestBody{Required: true, Content: jsonContent(b.of(v))}
+	}
+	multipartBody := func(properties map[string]*OpenAPISchema) *OpenAPIRequestBody {
+		return &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+			"multipart/form-data": {Schema: &OpenAPISchema{Type: "object", Properties: properties}},
+		}}
+	}
+	binary := &OpenAPISchema{Type: "string", Format: "binary"}
+
+	upload := map[string]*OpenAPISchema{FieldZipFile: binary}
+	for _, field := range []string{
+		FieldInspectionToken, FieldLanguage, FieldCorrelationID, FieldTags, FieldNote, FieldCallbackURL, FieldPDFPassword, FieldCompany,
+		FieldCompanyName, FieldCompanyVAT, FieldCompanyCountry, FieldCompanyAddress, FieldCompanyIBAN, FieldCompanySWIFT,
+	} {
+		upload[field] = stringSchema
+	}
+	upload[FieldCSVReport] = &OpenAPISchema{Type: "boolean"}
+	resultParams := []OpenAPIParameter{
+		jobID,
+		query(ParamDirection, "Invoice direction", stringSchema, invoice.DirectionIncoming, invoice.DirectionOutgoing),
+		query(ParamCounterparty, "Part of the counterparty name (case-insensitive) or its full VAT", stringSchema),
+		query(ParamStatus, "Result status", stringSchema, ResultStatusOK, ResultStatusError),
+		query(ParamDateFrom, "Invoice date from, inclusive", dateSchema),
+		query(ParamDateTo, "Invoice date to, inclusive", dateSchema),
+		query(ParamMinAmount, "Minimum total amount", numberSchema),
+		query(ParamMaxAmount, "Maximum total amount", numberSchema),
+		query(ParamSort, "Sort key; without it the report order is kept", stringSchema, SortDate, SortAmount, SortFile),
+		query(ParamOrder, "Sort order", stringSchema, OrderAsc, OrderDesc),
+		query(ParamPage, "Page number from 1", integerSchema),
+		query(ParamLimit, "Results per page", integerSchema),
+	}
+	jobList := okJSON("Jobs, newest first", []JobSummary{})
+	extract := okJSON("Extracted invoices", []invoice.Invoice{})
+	extract["202"] = &OpenAPIResponse{
+		Description: "Job created; poll the status at Location and read the results from /results/{jobID}",
+		Content:     jsonContent(b.of(UploadResponse{})),
+		Headers: map[string]OpenAPIHeader{
+			"Location":              {Description: "Status of the job", Schema: stringSchema},
+			PreferenceAppliedHeader: {Description: PreferRespondAsync + " when the job was requested with Prefer", Schema: stringSchema},
+		},
+	}
+	jobList["200"].Headers = map[string]OpenAPIHeader{
+		TotalCountHeader: {Description: "Jobs matching the filter on all pages", Schema: integerSchema},
+	}
+
+	paths := map[string]map[string]*OpenAPIOperation{
+		"/upload": {http.MethodPost: {
+			OperationID: "upload", Summary: "Create a job from an archive of invoices",
+			RequestBody: multipartBody(upload),
+			Responses:   okJSON("Job created", UploadResponse{}),
+		}},
+		"/inspect": {http.MethodPost: {
+			OperationID: "inspect", Summary: "List the files of an archive and estimate the processing cost",
+			RequestBody: multipartBody(map[string]*OpenAPISchema{FieldZipFile: binary, FieldPDFPassword: stringSchema, "keep": {Type: "boolean"}}),
+			Responses:   okJSON("Archive contents", InspectionResult{}),
+		}},
+		"/extract": {http.MethodPost: {
+			OperationID: "extract", Summary: "Extract the invoices of a single file, or create a job if it would take long",
+			Parameters: []OpenAPIParameter{{Name: PreferHeader, In: "header", Schema: stringSchema,
+				Description: PreferRespondAsync + " to create a job instead of waiting (ignored with extract_response sync)"}},
+			RequestBody: multipartBody(map[string]*OpenAPISchema{"file": binary, FieldPDFPassword: stringSchema}),
+			Responses:   extract,
+		}},
+		"/status/{jobID}": {http.MethodGet: {
+			OperationID: "getStatus", Summary: "Get the job status",
+			Parameters: []OpenAPIParameter{jobID, query(ParamLevel, "Minimum log level", stringSchema,
+				LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError)},
+			Responses: okJSON("Job status", JobStatus{}),
+		}},
+		"/cancel/{jobID}": {http.MethodPost: {
+			OperationID: "cancelJob", Summary: "Cancel a running job",
+			Parameters: []OpenAPIParameter{jobID},
+			Responses:  okJSON("Job cancelled", CancelResponse{}),
+		}},
+		"/jobs": {http.MethodGet: {
+			OperationID: "listJobs", Summary: "List jobs",
+			Parameters: []OpenAPIParameter{
+				query(ParamStatus, "Job status; can be repeated", stringSchema, StatusProcessing, StatusCompleted, StatusCancelled, StatusError),
+				query(ParamTag, "Job tag; can be repeated", stringSchema),
+				query(ParamPage, "Page number from 1", integerSchema),
+				query(ParamLimit, "Jobs per page", integerSchema),
+			},
+			Responses: jobList,
+		}},
+		"/jobs/{jobID}": {http.MethodDelete: {
+			OperationID: "deleteJob", Summary: "Delete a job with its reports and source files",
+			Parameters: []OpenAPIParameter{jobID},
+			Responses:  map[string]*OpenAPIResponse{"204": {Description: "Job deleted"}, "default": errorResponse},
+		}},
+		"/jobs/{jobID}/labels": {http.MethodPut: {
+			OperationID: "setJobLabels", Summary: "Replace the tags and the note of a job",
+			Parameters:  []OpenAPIParameter{jobID},
+			RequestBody: jsonBody(JobLabels{}),
+			Responses:   okJSON("Job labels", JobLabels{}),
+		}},
+		"/jobs/{jobID}/tags/{tag}": {http.MethodDelete: {
+			OperationID: "removeJobTag", Summary: "Remove a tag of a job",
+			Parameters: []OpenAPIParameter{jobID, {Name: "tag", In: "path", Required: true, Schema: stringSchema}},
+			Responses:  okJSON("Job labels", JobLabels{}),
+		}},
+		"/results/{jobID}": {http.MethodGet: {
+			OperationID: "getResults", Summary: "Get the results of a finished job",
+			Parameters: resultParams,
+			Responses:  okJSON("Job results", JobResultData{}),
+		}},
+		"/results/{jobID}/item/{id}": {http.MethodGet: {
+			OperationID: "getResult", Summary: "Get one result by its stable ID",
+			Parameters: []OpenAPIParameter{jobID, {Name: "id", In: "path", Required: true, Schema: stringSchema}},
+			Responses:  okJSON("Result", Result{}),
+		}},
+		"/results/{jobID}/{index}": {http.MethodPatch: {
+			OperationID: "editResult", Summary: "Correct the invoice of a result with a partial invoice",
+			Parameters:  []OpenAPIParameter{jobID, {Name: "index", In: "path", Required: true, Description: "Index in AllResults from 0", Schema: integerSchema}},
+			RequestBody: jsonBody(invoice.Invoice{}),
+			Responses:   okJSON("Corrected result", Result{}),
+		}},
+		"/results/{jobID}/regenerate": {http.MethodPost: {
+			OperationID: "regenerateReports", Summary: "Rebuild the reports from the corrected results",
+			Parameters: []OpenAPIParameter{jobID},
+			Responses:  okJSON("Job status", JobStatus{}),
+		}},
+		"/results/{jobID}/merge": {http.MethodPost: {
+			OperationID: "mergeCounterparties", Summary: "Merge two counterparties of a completed job",
+			Parameters:  []OpenAPIParameter{jobID},
+			RequestBody: jsonBody(MergeRequest{}),
+			Responses:   okJSON("Job results after the merge", JobResultData{}),
+		}},
+		"/results/{jobID}/export": {http.MethodGet: {
+			OperationID: "exportResults", Summary: "Export the invoices as JSON Lines, one invoice.ExportRecord per line",
+			Parameters: []OpenAPIParameter{jobID, query("format", "Export format", stringSchema, "jsonl")},
+			Responses:  ok("JSON Lines", file("application/x-ndjson")),
+		}},
+		"/results/{jobID}/json.zip": {http.MethodGet: {
+			OperationID: "downloadInvoiceJSON", Summary: "Download a zip archive with one JSON file per invoice",
+			Parameters: []OpenAPIParameter{jobID},
+			Responses:  ok("Zip archive", file("application/zip")),
+		}},
+		"/results/{jobID}/1c": {http.MethodGet: {
+			OperationID: "downloadOneC", Summary: "Download a 1C exchange file",
+			Parameters: []OpenAPIParameter{jobID, query("format", "Exchange format instead of onec_format", stringSchema, "client_bank", "commerceml")},
+			Responses:  ok("Exchange file", file("application/octet-stream")),
+		}},
+		"/export/vat/{jobID}": {http.MethodGet: {
+			OperationID: "exportVAT", Summary: "Get the VAT summary of a finished job",
+			Parameters: []OpenAPIParameter{
+				jobID,
+				query("from", "Invoice date from, inclusive", dateSchema),
+				query("to", "Invoice date to, inclusive", dateSchema),
+				query("format", "Response format", stringSchema, "csv", "json"),
+			},
+			Responses: ok("VAT summary", map[string]OpenAPIMediaType{
+				"text/csv":         {Schema: stringSchema},
+				"application/json": {Schema: b.of(invoice.VATSummary{})},
+			}),
+		}},
+		"/openapi.json": {http.MethodGet: {
+			OperationID: "getOpenAPI", Summary: "Get this description",
+			Responses: ok("OpenAPI document", jsonContent(&OpenAPISchema{Type: "object"})),
+		}},
+	}
+
+	doc := OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:   "invpa",
+			Version: strings.TrimPrefix(PathPrefix, "/api/"),
+			Description: "Invoice processing API. Every error response has the body " +
+				`{"error": {"code": "...", "message": "..."}}.`,
+		},
+		Paths:      make(map[string]map[string]*OpenAPIOperation, len(paths)),
+		Components: OpenAPIComponents{Schemas: b.schemas},
+	}
+	for path, operations := range paths {
+		methods := make(map[string]*OpenAPIOperation, len(operations))
+		for method, operation := range operations {
+			methods[strings.ToLower(method)] = operation
+		}
+		doc.Paths[PathPrefix+path] = methods
+	}
+	return doc
+}
+
+// jsonContent — содержимое application/json со схемой schema.
+func jsonContent(schema *OpenAPISchema) map[string]OpenAPIMediaType {
+	return map[string]OpenAPIMediaType{"application/json": {Schema: schema}}
+}
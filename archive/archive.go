@@ -0,0 +1,291 @@
+// Package archive распаковывает загруженные архивы с инвойсами.
+//
+// Формат определяется по сигнатуре файла, а если она не распознана — по расширению.
+// Поддерживаются zip, tar, tar.gz, 7z и rar (RAR 1.5–4 и RAR5). Зашифрованные архивы 7z и rar
+// возвращают ErrEncrypted, многотомные rar — ErrUnsupportedFormat. Для всех форматов действуют
+// одни защиты: записи не могут выйти за пределы директории распаковки, а суммарный размер
+// и число файлов ограничены. Имена записей приводятся к допустимым во всех ОС (см. SafeName),
+// а совпавшие после этого имена получают суффикс, чтобы файлы не перезаписывали друг друга.
+// Имена записей zip без флага UTF-8 (архивы проводника Windows) перекодируются из CP866 или CP1251.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format — формат архива.
+type Format string
+
+const (
+	Unknown  Format = ""
+	Zip      Format = "zip"
+	Tar      Format = "tar"
+	TarGz    Format = "tar.gz"
+	SevenZip Format = "7z"
+	Rar      Format = "rar"
+)
+
+const (
+	// DefaultMaxSize — ограничение суммарного размера распакованных файлов по умолчанию (1 ГБ).
+	DefaultMaxSize = 1 << 30
+	// DefaultMaxFiles — ограничение числа файлов в архиве по умолчанию.
+	DefaultMaxFiles = 10000
+)
+
+// Ошибки, которые можно проверить через errors.Is.
+var (
+	ErrUnsupportedFormat = errors.New("unsupported archive format")
+	ErrUnsafePath        = errors.New("archive entry points outside the destination directory")
+	ErrTooLarge          = errors.New("archive exceeds the size limit")
+	ErrTooManyFiles      = errors.New("archive exceeds the file count limit")
+	ErrEncrypted         = errors.New("encrypted archives are not supported")
+)
+
+// Options задает ограничения распаковки.
+type Options struct {
+	MaxSize  int64 // Суммарный размер распакованных файлов в байтах; 0 — DefaultMaxSize
+	MaxFiles int   // Число файлов; 0 — DefaultMaxFiles
+}
+
+// signatures — сигнатуры форматов в начале файла.
+var signatures = []struct {
+	magic  []byte
+	format Format
+}{
+	{[]byte("PK\x03\x04"), Zip},
+	{[]byte("PK\x05\x06"), Zip}, // Пустой zip
+	{[]byte("\x1f\x8b"), TarGz},
+	{[]byte("7z\xbc\xaf\x27\x1c"), SevenZip},
+	{[]byte("Rar!\x1a\x07"), Rar},
+}
+
+// Detect определяет формат архива по сигнатуре, а если она не распознана — по расширению.
+func Detect(path string) (Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Unknown, err
+	}
+	defer file.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Unknown, err
+	}
+	if format := Sniff(header[:n]); format != Unknown {
+		return format, nil
+	}
+	return formatByExtension(path), nil
+}
+
+// Sniff определяет формат архива только по сигнатуре в начале файла header, без учета расширения.
+// Для распознавания tar нужны первые 262 байта.
+func Sniff(header []byte) Format {
+	for _, sig := range signatures {
+		if bytes.HasPrefix(header, sig.magic) {
+			return sig.format
+		}
+	}
+	// Сигнатура tar (ustar) находится со смещением 257
+	if len(header) >= 262 && string(header[257:262]) == "ustar" {
+		return Tar
+	}
+	return Unknown
+}
+
+func formatByExtension(path string) Format {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return TarGz
+	case strings.HasSuffix(name, ".tar"):
+		return Tar
+	case strings.HasSuffix(name, ".zip"):
+		return Zip
+	case strings.HasSuffix(name, ".7z"):
+		return SevenZip
+	case strings.HasSuffix(name, ".rar"):
+		return Rar
+	}
+	return Unknown
+}
+
+// Extract распаковывает архив path в директорию dest.
+func Extract(path, dest string, opts Options) error {
+	format, err := Detect(path)
+	if err != nil {
+		return err
+	}
+	x := &extractor{dest: dest, maxSize: opts.MaxSize, maxFiles: opts.MaxFiles}
+	if x.maxSize <= 0 {
+		x.maxSize = DefaultMaxSize
+	}
+	if x.maxFiles <= 0 {
+		x.maxFiles = DefaultMaxFiles
+	}
+	switch format {
+	case Zip:
+		return x.zip(path)
+	case Tar, TarGz:
+		return x.tar(path, format == TarGz)
+	case SevenZip:
+		return x.sevenZip(path)
+	case Rar:
+		return x.rar(path)
+	}
+	return fmt.Errorf("%w: %s is not a zip, tar, tar.gz, 7z or rar archive", ErrUnsupportedFormat, filepath.Base(path))
+}
+
+// extractor записывает файлы архива, проверяя пути и ограничения.
+type extractor struct {
+	dest     string
+	maxSize  int64
+	maxFiles int
+	written  int64
+	files    int
+	used     map[string]bool // Имена записанных файлов (SafeName, в нижнем регистре)
+}
+
+// target возвращает путь записи name внутри dest или ErrUnsafePath. Имя приводится к SafeName.
+func (x *extractor) target(name string) (string, error) {
+	safe, err := x.safeName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(x.dest, filepath.FromSlash(safe)), nil
+}
+
+// safeName возвращает SafeName(name) или ErrUnsafePath, если запись выходит за пределы dest.
+func (x *extractor) safeName(name string) (string, error) {
+	safe := SafeName(name)
+	if safe == "" || !filepath.IsLocal(filepath.FromSlash(safe)) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	return safe, nil
+}
+
+// dir создает директорию архива.
+func (x *extractor) dir(name string) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+// file записывает файл архива из r, учитывая ограничения размера и числа файлов. Файл, имя которого
+// после SafeName совпадает с уже записанным (a?.pdf и a*.pdf, Invoice.pdf и invoice.pdf), получает
+// суффикс " (2)", чтобы не перезаписать его.
+func (x *extractor) file(name string, mode os.FileMode, r io.Reader) error {
+	safe, err := x.safeName(name)
+	if err != nil {
+		return err
+	}
+	if x.used == nil {
+		x.used = make(map[string]bool)
+	}
+	path := filepath.Join(x.dest, filepath.FromSlash(uniqueName(safe, x.used)))
+	if x.files++; x.files > x.maxFiles {
+		return fmt.Errorf("%w of %d files", ErrTooManyFiles, x.maxFiles)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	// Размер в заголовке записи может быть подделан, поэтому считаем фактически записанные байты
+	n, err := io.Copy(out, io.LimitReader(r, x.maxSize-x.written+1))
+	x.written += n
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && x.written > x.maxSize {
+		err = fmt.Errorf("%w of %d bytes", ErrTooLarge, x.maxSize)
+	}
+	return err
+}
+
+func (x *extractor) zip(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			if err := x.dir(zipName(f)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue // Символические ссылки не распаковываются
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = x.file(zipName(f), f.Mode(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipName возвращает имя записи zip в UTF-8. Архивы проводника Windows не ставят флаг UTF-8 и хранят
+// имена в кодировке локали, которые без перекодирования превращаются в "Ñ÷åò.pdf".
+func zipName(f *zip.File) string {
+	if f.NonUTF8 {
+		return decodeLegacyName(f.Name)
+	}
+	return f.Name
+}
+
+func (x *extractor) tar(path string, gzipped bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if gzipped {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(header.Name)
+		case tar.TypeReg:
+			err = x.file(header.Name, header.FileInfo().Mode(), tr)
+		}
+		// Ссылки и специальные файлы не распаковываются
+		if err != nil {
+			return err
+		}
+	}
+}
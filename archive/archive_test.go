@@ -0,0 +1,379 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// entry — файл тестового архива.
+type entry struct {
+	name    string
+	content string
+}
+
+var sampleEntries = []entry{
+	{"a.pdf", "%PDF-1.4 invoice one\n"},
+	{"sub/b.pdf", "%PDF-1.4 invoice two\n"},
+}
+
+func buildZip(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func buildTar(t *testing.T, entries []entry, gzipped bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+// buildRar собирает архив RAR 4 без сжатия (метод "store"): блок архива, блоки файлов и блок конца.
+// archiveFlags задает флаги блока архива, например 0x0080 — зашифрованные заголовки.
+func buildRar(entries []entry, archiveFlags uint16) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("Rar!\x1a\x07\x00")
+	block := func(kind byte, flags uint16, body []byte) {
+		header := make([]byte, 7, 7+len(body))
+		header[2] = kind
+		binary.LittleEndian.PutUint16(header[3:], flags)
+		binary.LittleEndian.PutUint16(header[5:], uint16(7+len(body)))
+		header = append(header, body...)
+		binary.LittleEndian.PutUint16(header, uint16(crc32.ChecksumIEEE(header[2:])))
+		buf.Write(header)
+	}
+	block(0x73, archiveFlags, make([]byte, 6))
+	for _, e := range entries {
+		body := make([]byte, 25, 25+len(e.name))
+		binary.LittleEndian.PutUint32(body[0:], uint32(len(e.content)))                // Упакованный размер
+		binary.LittleEndian.PutUint32(body[4:], uint32(len(e.content)))                // Распакованный размер
+		body[8] = 2                                                                    // Win32
+		binary.LittleEndian.PutUint32(body[9:], crc32.ChecksumIEEE([]byte(e.content))) // CRC32 файла
+		body[17], body[18] = 20, 0x30                                                  // Версия распаковки, метод "store"
+		binary.LittleEndian.PutUint16(body[19:], uint16(len(e.name)))                  // Длина имени
+		binary.LittleEndian.PutUint32(body[21:], 0x20)                                 // FILE_ATTRIBUTE_ARCHIVE
+		body = append(body, strings.ReplaceAll(e.name, "/", `\`)...)
+		block(0x74, 0x8000, body)
+		buf.WriteString(e.content)
+	}
+	block(0x7b, 0x4000, nil)
+	return buf.Bytes()
+}
+
+// sevenZipEntries — содержимое архивов testdata/*.7z (созданы bsdtar с разными методами сжатия).
+func sevenZipEntries() []entry {
+	var b strings.Builder
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&b, "line %d of the second invoice\n", i)
+	}
+	return []entry{
+		{"a.pdf", "%PDF-1.4 invoice one\n"},
+		{"sub/b.txt", b.String()},
+		{"empty.pdf", ""},
+		{"счет.pdf", "%PDF-1.4 счет\n"},
+	}
+}
+
+// writeArchive сохраняет архив во временную директорию теста.
+func writeArchive(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkExtracted проверяет, что в dest ровно файлы want с нужным содержимым.
+func checkExtracted(t *testing.T, dest string, want []entry) {
+	t.Helper()
+	got := make(map[string]string)
+	filepath.WalkDir(dest, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dest, path)
+		got[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if len(got) != len(want) {
+		t.Errorf("extracted %d files, want %d: %v", len(got), len(want), got)
+	}
+	for _, e := range want {
+		content, ok := got[e.name]
+		if !ok {
+			t.Errorf("%s was not extracted", e.name)
+			continue
+		}
+		if content != e.content {
+			t.Errorf("%s = %q, want %q", e.name, content, e.content)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		data func(t *testing.T) []byte
+		want []entry
+	}{
+		{"invoices.zip", func(t *testing.T) []byte { return buildZip(t, sampleEntries) }, sampleEntries},
+		{"invoices.tar", func(t *testing.T) []byte { return buildTar(t, sampleEntries, false) }, sampleEntries},
+		{"invoices.tar.gz", func(t *testing.T) []byte { return buildTar(t, sampleEntries, true) }, sampleEntries},
+		{"invoices.rar", func(t *testing.T) []byte { return buildRar(sampleEntries, 0) }, sampleEntries},
+		{"store.7z", func(t *testing.T) []byte { return readFixture(t, "store.7z") }, sevenZipEntries()},
+		{"lzma1.7z", func(t *testing.T) []byte { return readFixture(t, "lzma1.7z") }, sevenZipEntries()},
+		{"lzma2.7z", func(t *testing.T) []byte { return readFixture(t, "lzma2.7z") }, sevenZipEntries()},
+		{"deflate.7z", func(t *testing.T) []byte { return readFixture(t, "deflate.7z") }, sevenZipEntries()},
+		{"bzip2.7z", func(t *testing.T) []byte { return readFixture(t, "bzip2.7z") }, sevenZipEntries()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeArchive(t, tt.name, tt.data(t))
+			dest := t.TempDir()
+			if err := Extract(path, dest, Options{}); err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			checkExtracted(t, dest, tt.want)
+		})
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	corrupt := readFixture(t, "lzma2.7z")
+	corrupt = append([]byte(nil), corrupt...)
+	corrupt[40] ^= 0xff // Упакованные данные идут сразу за начальным заголовком из 32 байт
+	unsafe := []entry{{"../evil.pdf", "x"}}
+
+	tests := []struct {
+		name string
+		data []byte
+		opts Options
+		want error // nil — любая ошибка, кроме ErrEncrypted
+	}{
+		{"unsafe.zip", buildZip(t, unsafe), Options{}, ErrUnsafePath},
+		{"unsafe.rar", buildRar(unsafe, 0), Options{}, ErrUnsafePath},
+		{"many.zip", buildZip(t, sampleEntries), Options{MaxFiles: 1}, ErrTooManyFiles},
+		{"large.tar", buildTar(t, sampleEntries, false), Options{MaxSize: 30}, ErrTooLarge},
+		{"large.7z", readFixture(t, "lzma2.7z"), Options{MaxSize: 1000}, ErrTooLarge},
+		{"encrypted.rar", buildRar(sampleEntries, 0x0080), Options{}, ErrEncrypted},
+		{"ppmd.7z", readFixture(t, "ppmd.7z"), Options{}, nil},
+		{"corrupt.7z", corrupt, Options{}, nil},
+		{"invoice.pdf", []byte("%PDF-1.4"), Options{}, ErrUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Extract(writeArchive(t, tt.name, tt.data), t.TempDir(), tt.opts)
+			if tt.want == nil {
+				if err == nil || errors.Is(err, ErrEncrypted) {
+					t.Errorf("Extract error = %v, want a read error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Extract error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractUnsafePathStaysInside(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	Extract(writeArchive(t, "unsafe.rar", buildRar([]entry{{`..\evil.pdf`, "x"}}, 0)), dest, Options{})
+	if _, err := os.Stat(filepath.Join(root, "evil.pdf")); !os.IsNotExist(err) {
+		t.Errorf("an entry was written outside the destination directory")
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   Format
+	}{
+		{"zip", buildZip(t, sampleEntries), Zip},
+		{"tar", buildTar(t, sampleEntries, false), Tar},
+		{"tar.gz", buildTar(t, sampleEntries, true), TarGz},
+		{"rar", buildRar(sampleEntries, 0), Rar},
+		{"7z", readFixture(t, "lzma2.7z"), SevenZip},
+		{"pdf", []byte("%PDF-1.4"), Unknown},
+		{"empty", nil, Unknown},
+	}
+	for _, tt := range tests {
+		if got := Sniff(tt.header); got != tt.want {
+			t.Errorf("Sniff(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectByExtension(t *testing.T) {
+	tests := map[string]Format{
+		"a.zip": Zip, "a.tar": Tar, "a.tgz": TarGz, "A.TAR.GZ": TarGz, "a.7z": SevenZip, "a.rar": Rar, "a.pdf": Unknown,
+	}
+	for name, want := range tests {
+		got, err := Detect(writeArchive(t, name, []byte("not an archive")))
+		if err != nil || got != want {
+			t.Errorf("Detect(%s) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	tests := map[string]string{
+		"invoice.pdf":            "invoice.pdf",
+		"Счета/Март/счет №7.pdf": "Счета/Март/счет №7.pdf",
+		"🧾 receipt 😀.pdf":        "🧾 receipt 😀.pdf",
+		`Invoices\2024\a.pdf`:    "Invoices/2024/a.pdf",
+		"/abs//dir/./b.pdf":      "abs/dir/b.pdf",
+		"../evil.pdf":            "../evil.pdf", // Выход за пределы директории обнаруживает распаковка
+		`a<b>c:d"e|f?g*h.pdf`:    "a_b_c_d_e_f_g_h.pdf",
+		"tab\there.pdf":          "tab_here.pdf",
+		"trailing. /file.pdf. ":  "trailing/file.pdf",
+		"CON.pdf":                "_CON.pdf",
+		"dir/com1":               "dir/_com1",
+		"console.pdf":            "console.pdf",
+		"...":                    "_",
+		"bad\xff\xfeutf8.pdf":    "bad_utf8.pdf",
+		"счет\xe2\x84.pdf":       "счет_.pdf", // Обрезанный многобайтовый символ
+	}
+	for name, want := range tests {
+		if got := SafeName(name); got != want {
+			t.Errorf("SafeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	used := make(map[string]bool)
+	names := []struct{ name, want string }{
+		{"a.pdf", "a.pdf"},
+		{"A.PDF", "A (2).PDF"}, // Регистр не различается, как в Windows и macOS
+		{"a.pdf", "a (3).pdf"},
+		{"a (2).pdf", "a (2) (2).pdf"},
+		{"Счет.pdf", "Счет.pdf"},
+		{"счет.pdf", "счет (2).pdf"},
+		{"🧾.pdf", "🧾.pdf"},
+		{"🧾.pdf", "🧾 (2).pdf"},
+		{"dir/readme", "dir/readme"},
+		{"dir/readme", "dir/readme (2)"},
+		{"other/readme", "other/readme"},
+	}
+	for _, n := range names {
+		if got := uniqueName(n.name, used); got != n.want {
+			t.Errorf("uniqueName(%q) = %q, want %q", n.name, got, n.want)
+		}
+	}
+}
+
+// TestExtractCollidingNames распаковывает записи, имена которых совпадают после SafeName или
+// отличаются только регистром: ни одна не перезаписывает другую.
+func TestExtractCollidingNames(t *testing.T) {
+	entries := []entry{
+		{"a?b.pdf", "one"},
+		{"a*b.pdf", "two"},
+		{`dir\Счет.pdf`, "three"},
+		{"dir/СЧЕТ.pdf", "four"},
+	}
+	dest := t.TempDir()
+	if err := Extract(writeArchive(t, "names.zip", buildZip(t, entries)), dest, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	checkExtracted(t, dest, []entry{
+		{"a_b.pdf", "one"},
+		{"a_b (2).pdf", "two"},
+		{"dir/Счет.pdf", "three"},
+		{"dir/СЧЕТ (2).pdf", "four"},
+	})
+}
+
+// TestExtractLegacyNames распаковывает zip проводника Windows: имена в CP866 или CP1251 без флага UTF-8.
+func TestExtractLegacyNames(t *testing.T) {
+	tests := map[string][]entry{
+		"cp866.zip": {
+			{"Счета/Счет №15.pdf", "%PDF-1.4 cp866 one\n"},
+			{"Акт сверки.pdf", "%PDF-1.4 cp866 two\n"},
+		},
+		"cp1251.zip": {
+			{"Счёт-фактура.pdf", "%PDF-1.4 cp1251 one\n"},
+			{"Март/Оплата.pdf", "%PDF-1.4 cp1251 two\n"},
+		},
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			dest := t.TempDir()
+			if err := Extract(filepath.Join("testdata", name), dest, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			checkExtracted(t, dest, want)
+		})
+	}
+}
+
+func TestDecodeLegacyName(t *testing.T) {
+	tests := map[string]string{
+		"invoice.pdf":                               "invoice.pdf",
+		"Счет.pdf":                                  "Счет.pdf", // Уже UTF-8
+		"\x91\xe7\xa5\xe2 \xfc7.pdf":                "Счет №7.pdf",
+		"\xd1\xf7\xe5\xf2 \xb97.pdf":                "Счет №7.pdf",
+		"\x80\xaa\xe2/\xaf\xae\xab\xad\xeb\xa9.pdf": "Акт/полный.pdf",
+		"\xc0\xea\xf2/\xef\xee\xeb\xed\xfb\xe9.pdf": "Акт/полный.pdf",
+	}
+	for name, want := range tests {
+		if got := decodeLegacyName(name); got != want {
+			t.Errorf("decodeLegacyName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
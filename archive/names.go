@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// windowsReserved — имена устройств Windows, недопустимые как имена файлов с любым расширением.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SafeName приводит путь записи архива к виду, допустимому в Windows, macOS и Linux и в ячейках Excel:
+// обратная косая черта считается разделителем (архивы из Windows), символы <>:"|?*, управляющие символы
+// и некорректный UTF-8 (имена в устаревших кодировках) заменяются на "_", точки и пробелы в конце частей
+// пути убираются, а к зарезервированным именам Windows (CON, NUL, COM1...) добавляется "_".
+// Части "." убираются, а ".." сохраняются, чтобы выход за пределы директории по-прежнему обнаруживался.
+// Возвращает путь с разделителями "/".
+func SafeName(name string) string {
+	name = strings.ToValidUTF8(strings.ReplaceAll(name, `\`, "/"), "_")
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if part != ".." {
+			part = safePart(part)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// legacyCharsets — кодировки имен в zip без флага UTF-8 в порядке предпочтения: проводник Windows
+// пишет имена в OEM-кодировке (CP866 для русской локали), часть архиваторов — в ANSI (CP1251).
+var legacyCharsets = []*charmap.Charmap{charmap.CodePage866, charmap.Windows1251}
+
+// decodeLegacyName перекодирует в UTF-8 имя записи zip, сохраненное в однобайтовой кодировке Windows.
+// Обе кодировки дают корректный UTF-8 для любых байтов, поэтому выбирается та, в которой больше
+// кириллических букв: в CP866 байты кириллицы CP1251 становятся псевдографикой, и наоборот.
+// Имя, которое уже является корректным UTF-8, возвращается как есть.
+func decodeLegacyName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	best, bestScore := name, -1
+	for _, charset := range legacyCharsets {
+		decoded, err := charset.NewDecoder().String(name)
+		if err != nil {
+			continue
+		}
+		score := 0
+		for _, r := range decoded {
+			if unicode.Is(unicode.Cyrillic, r) && unicode.IsLetter(r) {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = decoded, score
+		}
+	}
+	return best
+}
+
+func safePart(part string) string {
+	part = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, part)
+	part = strings.TrimRight(part, ". ")
+	if part == "" {
+		return "_"
+	}
+	base, _, _ := strings.Cut(part, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		part = "_" + part
+	}
+	return part
+}
+
+// uniqueName возвращает name или, если такое имя уже занято (без учета регистра, как в Windows и macOS),
+// name с суффиксом " (2)", " (3)"... перед расширением. Занятое имя запоминается в used.
+func uniqueName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+// maxRarDictionary — наибольший словарь RAR, который выделяется при распаковке. WinRAR по умолчанию
+// использует 32 МБ (RAR5) и меньше; архив с огромным заявленным словарем не должен занимать память сервера.
+const maxRarDictionary = 256 << 20
+
+// rar распаковывает архив RAR (форматы RAR 1.5–4 и RAR5). Многотомные архивы не поддерживаются:
+// загружается один файл, а следующие тома рядом с ним не ищутся.
+func (x *extractor) rar(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := rardecode.NewReader(file, rardecode.MaxDictionarySize(maxRarDictionary))
+	if err != nil {
+		return rarError(err)
+	}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return rarError(err)
+		}
+		switch {
+		case header.IsDir:
+			err = x.dir(header.Name)
+		case header.Mode().IsRegular():
+			err = x.file(header.Name, header.Mode(), r)
+		}
+		// Ссылки не распаковываются
+		if err != nil {
+			return rarError(err)
+		}
+	}
+}
+
+// rarError приводит ошибки rardecode, которые важны пользователю, к ошибкам пакета.
+func rarError(err error) error {
+	switch {
+	case errors.Is(err, rardecode.ErrArchiveEncrypted), errors.Is(err, rardecode.ErrArchivedFileEncrypted):
+		return fmt.Errorf("%w: rar", ErrEncrypted)
+	case errors.Is(err, rardecode.ErrMultiVolume):
+		return fmt.Errorf("%w: multi-volume rar archives", ErrUnsupportedFormat)
+	}
+	return err
+}
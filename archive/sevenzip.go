@@ -0,0 +1,54 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bodgit/sevenzip"
+)
+
+// sevenZip распаковывает архив 7z через github.com/bodgit/sevenzip. Архивы с паролем возвращают
+// ErrEncrypted; методы сжатия, которых нет в библиотеке (например, PPMd), — ее ошибку чтения.
+func (x *extractor) sevenZip(path string) error {
+	r, err := sevenzip.OpenReader(path)
+	if err != nil {
+		return sevenZipError(err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			if err := x.dir(f.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue // Символические ссылки не распаковываются
+		}
+		if err := x.sevenZipFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) sevenZipFile(f *sevenzip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return sevenZipError(err)
+	}
+	defer rc.Close()
+	if err := x.file(f.Name, f.Mode(), rc); err != nil {
+		return sevenZipError(err)
+	}
+	return nil
+}
+
+// sevenZipError приводит ошибку чтения зашифрованного архива к ErrEncrypted.
+func sevenZipError(err error) error {
+	var readErr *sevenzip.ReadError
+	if errors.As(err, &readErr) && readErr.Encrypted {
+		return fmt.Errorf("%w: 7z", ErrEncrypted)
+	}
+	return err
+}
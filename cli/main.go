@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/veryevilzed/invpa/invoice"
 )
 
 // Config определяет структуру файла конфигурации.
 type Config struct {
-	OpenAIAPIKey       string               `json:"openai_api_key"`
-	MyCompany          invoice.Counterparty `json:"my_company"`
-	PopplerPathWindows string               `json:"poppler_path_windows,omitempty"`
+	OpenAIAPIKey       string                        `json:"openai_api_key"`
+	BaseURL            string                        `json:"base_url,omitempty"`
+	APIType            string                        `json:"api_type,omitempty"`
+	APIVersion         string                        `json:"api_version,omitempty"`
+	Deployment         string                        `json:"deployment,omitempty"`
+	Model              string                        `json:"model,omitempty"`
+	MyCompany          invoice.Counterparty          `json:"my_company"`
+	PopplerPathWindows string                        `json:"poppler_path_windows,omitempty"`
+	ModelPrices        map[string]invoice.ModelPrice `json:"model_prices,omitempty"`
+	RoundingPolicy     string                        `json:"rounding_policy,omitempty"`
 }
 
 func main() {
@@ -28,13 +37,45 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	roundingPolicy, err := invoice.ParseRoundingPolicy(config.RoundingPolicy)
+	if err != nil {
+		log.Fatalf("Invalid rounding_policy in config: %v", err)
+	}
 
 	// 3. Вызов анализатора
 	fmt.Printf("Analyzing file: %s\n", filePath)
-	invoices, err := invoice.ProcessFile(filePath, config.OpenAIAPIKey, config.PopplerPathWindows, config.MyCompany)
+	start := time.Now()
+	clientConfig := invoice.ClientConfig{
+		APIKey:     config.OpenAIAPIKey,
+		BaseURL:    config.BaseURL,
+		APIType:    config.APIType,
+		APIVersion: config.APIVersion,
+		Deployment: config.Deployment,
+	}
+	client, err := invoice.NewClient(clientConfig)
+	if err != nil {
+		log.Fatalf("Invalid OpenAI settings in config: %v", err)
+	}
+	model := config.Model
+	if model == "" {
+		model = invoice.DefaultModel
+	}
+	processor := invoice.NewProcessor(client,
+		invoice.WithPageRenderer(invoice.PopplerRenderer(config.PopplerPathWindows)),
+		invoice.WithMyCompany(config.MyCompany),
+		invoice.WithModel(model),
+	)
+	invoices, usage, err := processor.ProcessFile(context.Background(), filePath)
 	if err != nil {
 		log.Fatalf("Failed to process invoice: %v", err)
 	}
+	for i := range invoices {
+		invoice.NormalizeAmounts(&invoices[i], roundingPolicy)
+	}
+	summary := invoice.NewRunSummary(1, invoice.FileResults(filePath, invoices, usage, nil), invoice.Deduplication{}, config.ModelPrices, time.Since(start))
+	for _, line := range summary.Lines() {
+		fmt.Println(line)
+	}
 
 	// 4. Вывод результата
 	if len(invoices) == 0 {
@@ -0,0 +1,518 @@
+// Package client — Go-клиент HTTP API веб-сервера invpa (cmd/web): создание задания загрузкой
+// zip-архива, ожидание завершения, получение результатов и скачивание отчета.
+//
+// Типы запросов и ответов общие с сервером (пакет api).
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+const (
+	// DefaultRetries — число повторов запроса после ошибки сети или ответа 5xx.
+	DefaultRetries = 3
+	// DefaultMinBackoff и DefaultMaxBackoff ограничивают паузы между повторами и опросами статуса.
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// ErrJobFailed возвращается WaitForCompletion, если задание завершилось с ошибкой.
+var ErrJobFailed = errors.New("job failed")
+
+// Error — ответ сервера с кодом ошибки.
+type Error struct {
+	StatusCode int
+	Code       string // Код ошибки (api.ErrorCode*); для ответов без JSON-ошибки — по StatusCode
+	Message    string // Текст ошибки из ответа сервера
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invpa server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Client — клиент API. Безопасен для одновременного использования.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option настраивает Client.
+type Option func(*Client)
+
+// WithHTTPClient задает HTTP-клиента (по умолчанию http.DefaultClient).
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		if httpClient != nil {
+			c.httpClient = httpClient
+		}
+	}
+}
+
+// WithToken задает токен, передаваемый в заголовке "Authorization: Bearer <token>"
+// (например, для сервера за авторизующим прокси).
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithRetries задает число повторов после ошибки сети или ответа 5xx (0 — без повторов).
+func WithRetries(retries int) Option {
+	return func(c *Client) {
+		c.retries = max(retries, 0)
+	}
+}
+
+// WithBackoff задает границы пауз между повторами запросов и опросами статуса.
+// Пауза удваивается после каждой попытки.
+func WithBackoff(low, high time.Duration) Option {
+	return func(c *Client) {
+		if low > 0 {
+			c.minBackoff = low
+		}
+		c.maxBackoff = max(high, c.minBackoff)
+	}
+}
+
+// New создает клиента сервера с адресом baseURL (например, http://localhost:8080).
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    DefaultRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// JobOptions — необязательные параметры задания.
+type JobOptions struct {
+	FileName      string               // Имя архива (по умолчанию invoices.zip)
+	Language      string               // Язык сообщений журнала (en, ru)
+	CorrelationID string               // Внешний идентификатор трассировки; пусто — генерирует сервер
+	Company       string               // Псевдоним своей компании из companies конфигурации сервера
+	MyCompany     invoice.Counterparty // Данные своей компании вместо данных из конфигурации сервера (несовместимы с Company)
+	Tags          []string             // Метки задания (см. ограничения api.MaxTags и api.MaxTagLength)
+	Note          string               // Заметка к заданию
+	CallbackURL   string               // Вебхук о завершении задания (см. api.WebhookPayload)
+	PDFPassword   string               // Пароль защищенных PDF архива; сервер пробует его раньше pdf_passwords своей конфигурации
+	CSVReport     bool                 // Собрать CSV-отчет (JobStatus.DownloadURLCSV), даже если csv_report в конфигурации сервера выключен
+}
+
+// CreateJob загружает zip-архив и запускает обработку. Запрос не повторяется:
+// архив читается из zip один раз, а повторная загрузка создала бы второе задание.
+func (c *Client) CreateJob(ctx context.Context, zip io.Reader, opts JobOptions) (api.UploadResponse, error) {
+	var upload api.UploadResponse
+	fileName := opts.FileName
+	if fileName == "" {
+		fileName = "invoices.zip"
+	}
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		writer.CloseWithError(writeJobForm(form, zip, fileName, opts))
+	}()
+	defer body.Close()
+
+	req, err := c.newRequest(ctx, http.MethodPost, api.PathPrefix+"/upload", body)
+	if err != nil {
+		return upload, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if opts.CorrelationID != "" {
+		req.Header.Set(api.CorrelationIDHeader, opts.CorrelationID)
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return upload, err
+	}
+	return upload, decode(resp, &upload)
+}
+
+// writeJobForm пишет поля формы загрузки и архив.
+func writeJobForm(form *multipart.Writer, zip io.Reader, fileName string, opts JobOptions) error {
+	csvReport := ""
+	if opts.CSVReport {
+		csvReport = "true"
+	}
+	fields := []struct{ name, value string }{
+		{api.FieldLanguage, opts.Language},
+		{api.FieldTags, strings.Join(opts.Tags, ",")},
+		{api.FieldNote, opts.Note},
+		{api.FieldCallbackURL, opts.CallbackURL},
+		{api.FieldPDFPassword, opts.PDFPassword},
+		{api.FieldCSVReport, csvReport},
+		{api.FieldCompany, opts.Company},
+		{api.FieldCompanyName, opts.MyCompany.Name},
+		{api.FieldCompanyVAT, opts.MyCompany.VAT},
+		{api.FieldCompanyCountry, opts.MyCompany.Country},
+		{api.FieldCompanyAddress, opts.MyCompany.Address},
+		{api.FieldCompanyIBAN, opts.MyCompany.IBAN},
+		{api.FieldCompanySWIFT, opts.MyCompany.SWIFT},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		if err := form.WriteField(field.name, field.value); err != nil {
+			return err
+		}
+	}
+	part, err := form.CreateFormFile(api.FieldZipFile, fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, zip); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// Status возвращает текущее состояние задания.
+func (c *Client) Status(ctx context.Context, jobID string) (api.JobStatus, error) {
+	var status api.JobStatus
+	return status, c.getJSON(ctx, api.PathPrefix+"/status/"+url.PathEscape(jobID), &status)
+}
+
+// StatusAtLevel аналогичен Status, но возвращает только записи журнала с уровнем не ниже level
+// (api.LogLevelDebug, api.LogLevelInfo, api.LogLevelWarn или api.LogLevelError); ошибки возвращаются всегда.
+func (c *Client) StatusAtLevel(ctx context.Context, jobID, level string) (api.JobStatus, error) {
+	var status api.JobStatus
+	query := url.Values{api.ParamLevel: {level}}
+	return status, c.getJSON(ctx, api.PathPrefix+"/status/"+url.PathEscape(jobID)+"?"+query.Encode(), &status)
+}
+
+// WaitForCompletion опрашивает статус задания, увеличивая паузу между опросами, пока задание
+// не завершится или не будет отменен ctx. Для задания, завершившегося с ошибкой, возвращается
+// его статус и ошибка, оборачивающая ErrJobFailed.
+func (c *Client) WaitForCompletion(ctx context.Context, jobID string) (api.JobStatus, error) {
+	backoff := c.minBackoff
+	for {
+		status, err := c.Status(ctx, jobID)
+		if err != nil {
+			return status, err
+		}
+		if status.Status == api.StatusError {
+			return status, fmt.Errorf("%w: [%s] %s", ErrJobFailed, status.ErrorID, status.Error)
+		}
+		if status.Done() {
+			return status, nil
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return status, err
+		}
+		backoff = min(backoff*2, c.maxBackoff)
+	}
+}
+
+// Results возвращает результаты завершенного задания.
+func (c *Client) Results(ctx context.Context, jobID string) (api.JobResultData, error) {
+	var data api.JobResultData
+	return data, c.getJSON(ctx, api.PathPrefix+"/results/"+url.PathEscape(jobID), &data)
+}
+
+// ResultsByDirection возвращает инвойсы завершенного задания с направлением direction
+// (invoice.DirectionIncoming или invoice.DirectionOutgoing), без строк ошибок.
+func (c *Client) ResultsByDirection(ctx context.Context, jobID, direction string) (api.JobResultData, error) {
+	var data api.JobResultData
+	query := url.Values{api.ParamDirection: {direction}}
+	return data, c.getJSON(ctx, api.PathPrefix+"/results/"+url.PathEscape(jobID)+"?"+query.Encode(), &data)
+}
+
+// QueryResults возвращает результаты завершенного задания, подходящие под фильтр query, в заданном
+// порядке; Total содержит число подходящих результатов на всех страницах, JobTotal — всех результатов задания.
+func (c *Client) QueryResults(ctx context.Context, jobID string, query api.ResultQuery) (api.JobResultData, error) {
+	var data api.JobResultData
+	path := api.PathPrefix + "/results/" + url.PathEscape(jobID)
+	if encoded := query.Values().Encode(); encoded != "" {
+		path += "?" + encoded
+	}
+	return data, c.getJSON(ctx, path, &data)
+}
+
+// DownloadReport записывает Excel-отчет завершенного задания в w.
+func (c *Client) DownloadReport(ctx context.Context, jobID string, w io.Writer) error {
+	status, err := c.Status(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if !status.Finished() || status.DownloadURL == "" {
+		return fmt.Errorf("report of job %s is not available in status %q", jobID, status.Status)
+	}
+	resp, err := c.do(ctx, http.MethodGet, status.DownloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download report: %w", err)
+	}
+	return nil
+}
+
+// ExportResults копирует в w инвойсы завершенного задания в формате JSON Lines: по одной записи
+// invoice.ExportRecord на строку.
+func (c *Client) ExportResults(ctx context.Context, jobID string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, api.PathPrefix+"/results/"+url.PathEscape(jobID)+"/export?format=jsonl")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download export: %w", err)
+	}
+	return nil
+}
+
+// DownloadInvoiceJSON копирует в w zip-архив завершенного задания с отдельным JSON-файлом
+// (invoice.ExportRecord) на каждый инвойс и списком файлов с ошибками в errors.json.
+func (c *Client) DownloadInvoiceJSON(ctx context.Context, jobID string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, api.PathPrefix+"/results/"+url.PathEscape(jobID)+"/json.zip")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download JSON archive: %w", err)
+	}
+	return nil
+}
+
+// DownloadOneC копирует в w файл обмена с 1С завершенного задания. format — client_bank или commerceml;
+// пустая строка — onec_format из config.json сервера.
+func (c *Client) DownloadOneC(ctx context.Context, jobID, format string, w io.Writer) error {
+	path := api.PathPrefix + "/results/" + url.PathEscape(jobID) + "/1c"
+	if format != "" {
+		path += "?format=" + url.QueryEscape(format)
+	}
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download 1C exchange file: %w", err)
+	}
+	return nil
+}
+
+// DeleteJob удаляет завершенное задание вместе с отчетами. Выполняющееся задание не удаляется.
+func (c *Client) DeleteJob(ctx context.Context, jobID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, api.PathPrefix+"/jobs/"+url.PathEscape(jobID))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ListJobs возвращает задания сервера, начиная с новых. Если заданы tags, возвращаются только
+// задания со всеми этими метками.
+func (c *Client) ListJobs(ctx context.Context, tags ...string) ([]api.JobSummary, error) {
+	path := api.PathPrefix + "/jobs"
+	if len(tags) > 0 {
+		path += "?" + url.Values{"tag": tags}.Encode()
+	}
+	var list []api.JobSummary
+	return list, c.getJSON(ctx, path, &list)
+}
+
+// QueryJobs возвращает задания сервера, подходящие под фильтр query, начиная с новых, и их общее число.
+// Если в query заданы Page или Limit, возвращается только эта страница.
+func (c *Client) QueryJobs(ctx context.Context, query api.JobQuery) (api.JobPage, error) {
+	var page api.JobPage
+	values := url.Values{api.ParamStatus: query.Status, api.ParamTag: query.Tags}
+	if query.Page > 0 {
+		values.Set(api.ParamPage, strconv.Itoa(query.Page))
+	}
+	if query.Limit > 0 {
+		values.Set(api.ParamLimit, strconv.Itoa(query.Limit))
+	}
+	path := api.PathPrefix + "/jobs"
+	if encoded := values.Encode(); encoded != "" {
+		path += "?" + encoded
+	}
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return page, err
+	}
+	if err := decode(resp, &page.Jobs); err != nil {
+		return page, err
+	}
+	page.Total, err = strconv.Atoi(resp.Header.Get(api.TotalCountHeader))
+	if err != nil {
+		page.Total = len(page.Jobs) // Сервер без пагинации
+	}
+	return page, nil
+}
+
+// SetLabels заменяет метки и заметку задания и возвращает их в том виде, в котором их сохранил сервер.
+func (c *Client) SetLabels(ctx context.Context, jobID string, labels api.JobLabels) (api.JobLabels, error) {
+	var saved api.JobLabels
+	body, err := json.Marshal(labels)
+	if err != nil {
+		return saved, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPut, api.PathPrefix+"/jobs/"+url.PathEscape(jobID)+"/labels", bytes.NewReader(body))
+	if err != nil {
+		return saved, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(req)
+	if err != nil {
+		return saved, err
+	}
+	return saved, decode(resp, &saved)
+}
+
+// RemoveTag удаляет метку задания и возвращает оставшиеся метки и заметку.
+func (c *Client) RemoveTag(ctx context.Context, jobID, tag string) (api.JobLabels, error) {
+	var saved api.JobLabels
+	resp, err := c.do(ctx, http.MethodDelete, api.PathPrefix+"/jobs/"+url.PathEscape(jobID)+"/tags/"+url.PathEscape(tag))
+	if err != nil {
+		return saved, err
+	}
+	return saved, decode(resp, &saved)
+}
+
+// EditResult исправляет инвойс результата с порядковым номером index в AllResults (с 0). patch — частичный
+// инвойс: map или структура, в JSON которой есть только изменяемые поля, например
+// map[string]any{"number": "INV-7", "counterparty": map[string]any{"vat": "DE123456789"}}.
+// Возвращает результат с пересчитанными предупреждениями; отчеты задания устаревают до RegenerateReports.
+func (c *Client) EditResult(ctx context.Context, jobID string, index int, patch any) (api.Result, error) {
+	var result api.Result
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return result, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPatch, api.PathPrefix+"/results/"+url.PathEscape(jobID)+"/"+strconv.Itoa(index), bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(req)
+	if err != nil {
+		return result, err
+	}
+	return result, decode(resp, &result)
+}
+
+// RegenerateReports пересобирает отчеты задания по исправленным результатам и возвращает состояние задания.
+func (c *Client) RegenerateReports(ctx context.Context, jobID string) (api.JobStatus, error) {
+	var status api.JobStatus
+	resp, err := c.do(ctx, http.MethodPost, api.PathPrefix+"/results/"+url.PathEscape(jobID)+"/regenerate")
+	if err != nil {
+		return status, err
+	}
+	return status, decode(resp, &status)
+}
+
+// getJSON выполняет GET-запрос и декодирует ответ в v.
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	return decode(resp, v)
+}
+
+// do выполняет запрос без тела, повторяя его после ошибки сети или ответа 5xx.
+// Возвращает только успешные ответы; тело ответа закрывает вызывающий.
+func (c *Client) do(ctx context.Context, method, path string) (*http.Response, error) {
+	backoff := c.minBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.send(req)
+		if err == nil || ctx.Err() != nil || attempt >= c.retries || !retryable(err) {
+			return resp, err
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff = min(backoff*2, c.maxBackoff)
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// send выполняет запрос и превращает ответы с кодом ошибки в *Error.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var errResp api.ErrorResponse
+	if json.Unmarshal(data, &errResp) != nil || errResp.Error.Message == "" {
+		errResp.Error = api.ErrorBody{Code: api.ErrorCodeForStatus(resp.StatusCode), Message: strings.TrimSpace(string(data))}
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Code: errResp.Error.Code, Message: errResp.Error.Message}
+}
+
+// retryable сообщает, что запрос стоит повторить: ошибка сети или ответ 5xx.
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+func decode(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode invpa server response: %w", err)
+	}
+	return nil
+}
+
+// sleep ждет d или отмены ctx.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
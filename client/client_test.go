@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+)
+
+// newTestClient запускает сервер с handler и возвращает клиента с короткими паузами между повторами.
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	opts = append([]Option{WithBackoff(time.Millisecond, 4*time.Millisecond)}, opts...)
+	return New(server.URL+"/", opts...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestToken(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			writeJSON(w, http.StatusUnauthorized, api.ErrorResponse{Error: api.ErrorBody{Code: api.ErrorCodeUnauthorized, Message: "Invalid token"}})
+			return
+		}
+		if r.URL.Path != api.PathPrefix+"/status/job 1" {
+			t.Errorf("request path %q", r.URL.Path)
+		}
+		writeJSON(w, http.StatusOK, api.JobStatus{ID: "job 1", Status: api.StatusCompleted})
+	}, WithToken("secret"))
+
+	status, err := c.Status(context.Background(), "job 1")
+	if err != nil || status.Status != api.StatusCompleted {
+		t.Errorf("Status = %+v, %v", status, err)
+	}
+}
+
+// TestUnauthorizedIsNotRetried проверяет, что ответ 401 возвращается как *Error с кодом сервера без повторов.
+func TestUnauthorizedIsNotRetried(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		writeJSON(w, http.StatusUnauthorized, api.ErrorResponse{Error: api.ErrorBody{Code: api.ErrorCodeUnauthorized, Message: "Invalid token"}})
+	}, WithToken("wrong"))
+
+	_, err := c.Status(context.Background(), "job-1")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != api.ErrorCodeUnauthorized || apiErr.Message != "Invalid token" {
+		t.Errorf("Status = %v, want *Error 401 unauthorized", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, api.JobStatus{ID: "job-1", Status: api.StatusProcessing})
+	})
+
+	status, err := c.Status(context.Background(), "job-1")
+	if err != nil || status.Status != api.StatusProcessing {
+		t.Errorf("Status = %+v, %v", status, err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d requests, want two failures and a success", n)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+	}, WithRetries(2))
+
+	_, err := c.Status(context.Background(), "job-1")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "upstream unavailable" {
+		t.Errorf("Status = %v, want *Error 503 with the plain text body", err)
+	}
+	if apiErr != nil && apiErr.Code != api.ErrorCodeForStatus(http.StatusServiceUnavailable) {
+		t.Errorf("Code = %q, want the code of the status", apiErr.Code)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d requests, want the first one and 2 retries", n)
+	}
+}
+
+// TestCreateJobIsNotRetried проверяет, что загрузка архива не повторяется после 5xx: повтор создал бы второе задание.
+func TestCreateJobIsNotRetried(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		file, header, err := r.FormFile(api.FieldZipFile)
+		if err != nil {
+			t.Errorf("upload without the archive: %v", err)
+			return
+		}
+		defer file.Close()
+		if data, _ := io.ReadAll(file); header.Filename != "march.zip" || string(data) != "PK" || r.FormValue(api.FieldTags) != "march,q1" {
+			t.Errorf("upload %s %q, tags %q", header.Filename, data, r.FormValue(api.FieldTags))
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	})
+
+	_, err := c.CreateJob(context.Background(), strings.NewReader("PK"), JobOptions{FileName: "march.zip", Tags: []string{"march", "q1"}})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("CreateJob = %v, want *Error 500", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d uploads, want 1", n)
+	}
+}
+
+func TestContextCancellationStopsRetries(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+	}, WithBackoff(time.Hour, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := c.Status(ctx, "job-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Status = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Status returned after %s, the backoff was not interrupted", elapsed)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
+
+func TestContextCancellationAbortsRequest(t *testing.T) {
+	release := make(chan struct{})
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := c.Results(ctx, "job-1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Results = %v, want context.Canceled", err)
+	}
+}
+
+func TestWaitForCompletion(t *testing.T) {
+	var polls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		status := api.JobStatus{ID: "job-1", Status: api.StatusProcessing}
+		if polls.Add(1) == 3 {
+			status.Status, status.ErrorID, status.Error = api.StatusError, "E42", "OpenAI key rejected"
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	status, err := c.WaitForCompletion(context.Background(), "job-1")
+	if !errors.Is(err, ErrJobFailed) || status.Status != api.StatusError {
+		t.Errorf("WaitForCompletion = %q, %v, want ErrJobFailed", status.Status, err)
+	}
+	if n := polls.Load(); n != 3 {
+		t.Errorf("%d polls, want 3", n)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// archiveFiles сохраняет исходные файлы и результаты запуска в архив.
+// Архив может быть на медленном сетевом хранилище, поэтому ошибки только логируются.
+func archiveFiles(archivePath, jobID, dir string, fileResults []invoice.FileResult) {
+	archive, err := invoice.OpenArchive(archivePath)
+	if err != nil {
+		log.Printf("WARN: Could not open archive: %v", err)
+		return
+	}
+	archived := 0
+	for _, fr := range fileResults {
+		name := invoice.SourceName(dir, fr.Path)
+		if err := archive.Store(jobID, name, fr); err != nil {
+			log.Printf("WARN: Could not archive %s: %v", name, err)
+			continue
+		}
+		archived++
+	}
+	fmt.Printf("Archived %d of %d files to '%s' (job %s)\n", archived, len(fileResults), archivePath, jobID)
+}
+
+// runArchiveCommand выполняет подкоманду "archive": поиск в архиве по номеру инвойса или контрагенту.
+//
+//	reporter archive find -number INV-123
+//	reporter archive find -counterparty acme
+func runArchiveCommand(args []string) {
+	if len(args) == 0 || args[0] != "find" {
+		log.Fatalf("Usage: %s archive find [-number N] [-counterparty NAME] [-config config.json]", os.Args[0])
+	}
+	fs := flag.NewFlagSet("archive find", flag.ExitOnError)
+	numberFlag := fs.String("number", "", "Invoice number to look up")
+	counterpartyFlag := fs.String("counterparty", "", "Part of the counterparty name or VAT to look up")
+	configFlag := fs.String("config", "config.json", "Path to the config file")
+	fs.Parse(args[1:])
+	if *numberFlag == "" && *counterpartyFlag == "" {
+		log.Fatalf("FATAL: Specify -number or -counterparty")
+	}
+
+	config, err := report.LoadConfig(*configFlag)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load %s: %v", *configFlag, err)
+	}
+	if config.ArchivePath == "" {
+		log.Fatalf("FATAL: 'archive_path' is not set in %s.", *configFlag)
+	}
+	archive, err := invoice.OpenArchive(config.ArchivePath)
+	if err != nil {
+		log.Fatalf("FATAL: Could not open archive: %v", err)
+	}
+	query := invoice.ArchiveQuery{Number: *numberFlag, Counterparty: *counterpartyFlag}
+	records, err := archive.Find(query)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	if len(records) == 0 {
+		fmt.Println("Nothing found.")
+		return
+	}
+	for _, record := range records {
+		fmt.Printf("%s  job %s  %s\n", record.ArchivedAt.Format("2006-01-02 15:04"), record.Job, record.File)
+		if path := archive.ObjectPath(record); fileExists(path) {
+			fmt.Printf("    %s\n", path)
+		}
+		for _, inv := range record.Invoices {
+			fmt.Printf("    %s  %s  %.2f %s  %s %s\n", inv.Number, inv.Date, inv.TotalAmount, inv.Currency, inv.Counterparty, inv.VAT)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
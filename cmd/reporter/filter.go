@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// reportFilter — фильтры строк отчета, применяемые после извлечения: период по дате инвойса (-from/-to)
+// и контрагенты (-counterparty). Исключенные инвойсы попадают на лист "Filtered out", а строки ошибок
+// не фильтруются.
+type reportFilter struct {
+	from, to       time.Time
+	counterparties []string // Подстроки наименования, алиаса или VAT без учета регистра; подходит любая
+}
+
+// reportRows — строки отчета после фильтров.
+type reportRows struct {
+	all      []invoice.Result  // Все результаты: для листа "Usage"
+	kept     []invoice.Result  // Строки основных листов и сводки по НДС
+	filtered []report.Filtered // Строки листа "Filtered out"
+}
+
+func (f reportFilter) active() bool {
+	return !f.from.IsZero() || !f.to.IsZero() || len(f.counterparties) > 0
+}
+
+// apply делит результаты на строки основных листов и исключенные фильтром.
+func (f reportFilter) apply(results []invoice.Result) reportRows {
+	rows := reportRows{all: results}
+	for _, res := range results {
+		if reason := f.exclusion(res); reason != "" {
+			rows.filtered = append(rows.filtered, report.Filtered{Result: res, Reason: reason})
+			continue
+		}
+		rows.kept = append(rows.kept, res)
+	}
+	return rows
+}
+
+// exclusion возвращает причину, по которой фильтр исключает результат, или пустую строку.
+// Сначала проверяется период, затем контрагент.
+func (f reportFilter) exclusion(res invoice.Result) string {
+	if res.Invoice == nil {
+		return ""
+	}
+	if !f.from.IsZero() || !f.to.IsZero() {
+		date, err := invoice.ParseInvoiceDate(res.Invoice.Date)
+		switch {
+		case err != nil:
+			return "no valid date"
+		case !f.from.IsZero() && date.Before(f.from):
+			return "date before " + f.from.Format("2006-01-02")
+		case !f.to.IsZero() && date.After(f.to):
+			return "date after " + f.to.Format("2006-01-02")
+		}
+	}
+	if len(f.counterparties) > 0 && !f.matchesCounterparty(res.Invoice.Counterparty) {
+		return "other counterparty"
+	}
+	return ""
+}
+
+func (f reportFilter) matchesCounterparty(cp invoice.Counterparty) bool {
+	values := append([]string{cp.Name, cp.VAT}, cp.Aliases...)
+	for _, needle := range f.counterparties {
+		needle = strings.ToLower(strings.TrimSpace(needle))
+		for _, value := range values {
+			if needle != "" && strings.Contains(strings.ToLower(value), needle) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keptCounterparties оставляет уникальных контрагентов, у которых есть инвойсы среди строк основных листов.
+func (f reportFilter) keptCounterparties(counterparties []invoice.UniqueCounterparty, kept []invoice.Result) []invoice.UniqueCounterparty {
+	if !f.active() {
+		return counterparties
+	}
+	var result []invoice.UniqueCounterparty
+	for _, ucp := range counterparties {
+		for _, res := range kept {
+			if res.Invoice != nil && sameCounterparty(res.Invoice.Counterparty, ucp.Counterparty) {
+				result = append(result, ucp)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// sameCounterparty сравнивает контрагентов по ID, а без базы контрагентов (ID не присвоены) — по наименованию.
+func sameCounterparty(a, b invoice.Counterparty) bool {
+	if a.ID != 0 || b.ID != 0 {
+		return a.ID == b.ID
+	}
+	return strings.EqualFold(a.Name, b.Name)
+}
+
+// modTimeRange — предварительный фильтр файлов по времени изменения (-mtime-from/-mtime-to), включая
+// обе границы целиком. Нулевые границы открыты.
+type modTimeRange struct {
+	from, to time.Time // Начала дней в местном времени
+}
+
+func (r modTimeRange) contains(t time.Time) bool {
+	return (r.from.IsZero() || !t.Before(r.from)) && (r.to.IsZero() || t.Before(r.to.AddDate(0, 0, 1)))
+}
+
+// filterFiles оставляет файлы, время изменения которых попадает в диапазон. Файлы, которые не удалось
+// проверить, остаются: их ошибку покажет обработка.
+func (r modTimeRange) filterFiles(files []string) []string {
+	if r.from.IsZero() && r.to.IsZero() {
+		return files
+	}
+	var kept []string
+	for _, path := range files {
+		if modified, err := modTime(path); err != nil || r.contains(modified) {
+			kept = append(kept, path)
+		}
+	}
+	return kept
+}
+
+// parseLocalDateFlag разбирает дату из флага командной строки в местном времени. Пустая строка — открытая граница.
+func parseLocalDateFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// modTime возвращает время изменения файла.
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+func day(value string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestReportFilterApply(t *testing.T) {
+	acme := invoice.Counterparty{Name: "ACME GmbH", VAT: "DE123456789", Aliases: []string{"Acme Corp"}}
+	globex := invoice.Counterparty{Name: "Globex Ltd", VAT: "GB987654321"}
+	result := func(date string, cp invoice.Counterparty) invoice.Result {
+		return invoice.Result{SourceFile: date + ".pdf", Invoice: &invoice.Invoice{Date: date, Counterparty: cp}}
+	}
+	errorRow := invoice.Result{SourceFile: "broken.pdf", ErrorMessage: "could not render pages"}
+
+	tests := []struct {
+		name   string
+		filter reportFilter
+		res    invoice.Result
+		want   string // Причина исключения; пусто — строка остается
+	}{
+		{"no filter", reportFilter{}, result("2024-03-01", acme), ""},
+		{"from is inclusive", reportFilter{from: day("2024-03-01")}, result("2024-03-01", acme), ""},
+		{"before from", reportFilter{from: day("2024-03-01")}, result("2024-02-29", acme), "date before 2024-03-01"},
+		{"to is inclusive", reportFilter{to: day("2024-03-31")}, result("2024-03-31", acme), ""},
+		{"after to", reportFilter{to: day("2024-03-31")}, result("2024-04-01", acme), "date after 2024-03-31"},
+		{"no valid date", reportFilter{from: day("2024-03-01")}, result("", acme), "no valid date"},
+		{"counterparty by name", reportFilter{counterparties: []string{" acme "}}, result("2024-03-01", acme), ""},
+		{"counterparty by VAT", reportFilter{counterparties: []string{"de1234"}}, result("2024-03-01", acme), ""},
+		{"counterparty by alias", reportFilter{counterparties: []string{"corp"}}, result("2024-03-01", acme), ""},
+		{"any counterparty matches", reportFilter{counterparties: []string{"initech", "globex"}}, result("2024-03-01", globex), ""},
+		{"other counterparty", reportFilter{counterparties: []string{"acme"}}, result("2024-03-01", globex), "other counterparty"},
+		{"empty counterparty filter", reportFilter{counterparties: []string{" "}}, result("2024-03-01", acme), "other counterparty"},
+		{"date before counterparty", reportFilter{from: day("2024-03-01"), counterparties: []string{"acme"}}, result("2024-02-01", globex), "date before 2024-03-01"},
+		{"date and counterparty match", reportFilter{from: day("2024-03-01"), to: day("2024-03-31"), counterparties: []string{"acme"}}, result("2024-03-15", acme), ""},
+		{"error rows are kept", reportFilter{from: day("2024-03-01"), counterparties: []string{"acme"}}, errorRow, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := tt.filter.apply([]invoice.Result{tt.res})
+			if len(rows.all) != 1 || len(rows.kept)+len(rows.filtered) != 1 {
+				t.Fatalf("apply returned %d all, %d kept, %d filtered", len(rows.all), len(rows.kept), len(rows.filtered))
+			}
+			got := ""
+			if len(rows.filtered) == 1 {
+				got = rows.filtered[0].Reason
+			}
+			if got != tt.want {
+				t.Errorf("exclusion %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestModTimeRangeFilterFiles проверяет, что -mtime-from/-mtime-to включают дни границ целиком, а файлы,
+// которые не удалось проверить, остаются.
+func TestModTimeRangeFilterFiles(t *testing.T) {
+	dir := t.TempDir()
+	modified := map[string]time.Time{
+		"february.pdf":  day("2024-02-29").Add(23 * time.Hour),
+		"first-day.pdf": day("2024-03-01"),
+		"last-day.pdf":  day("2024-03-31").Add(23*time.Hour + 59*time.Minute),
+		"april.pdf":     day("2024-04-01"),
+	}
+	var files []string
+	for name, mtime := range modified {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	missing := filepath.Join(dir, "missing.pdf")
+	files = append(files, missing)
+
+	tests := []struct {
+		name string
+		r    modTimeRange
+		want []string
+	}{
+		{"open", modTimeRange{}, []string{"april.pdf", "february.pdf", "first-day.pdf", "last-day.pdf", "missing.pdf"}},
+		{"march", modTimeRange{from: day("2024-03-01"), to: day("2024-03-31")}, []string{"first-day.pdf", "last-day.pdf", "missing.pdf"}},
+		{"from only", modTimeRange{from: day("2024-03-31")}, []string{"april.pdf", "last-day.pdf", "missing.pdf"}},
+		{"to only", modTimeRange{to: day("2024-02-29")}, []string{"february.pdf", "missing.pdf"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, path := range tt.r.filterFiles(files) {
+			got = append(got, filepath.Base(path))
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+	"github.com/xuri/excelize/v2"
+)
+
+// stringList — флаг, который можно указать несколько раз.
+type stringList []string
+
+func (l *stringList) String() string         { return strings.Join(*l, ", ") }
+func (l *stringList) Set(value string) error { *l = append(*l, value); return nil }
+
+// importStats — итоги импорта одного файла.
+type importStats struct {
+	counterpartiesAdded, counterpartiesUpdated int
+	invoicesAdded, invoicesDuplicate           int
+	skipped                                    []string // Пропущенные и некорректные строки
+}
+
+// runImportCommand выполняет подкоманду "import": загружает контрагентов и инвойсы из старых
+// отчетов __RESULT.xlsx в базу контрагентов (counterparties_db) и индекс архива (archive_path).
+//
+//	reporter import -xlsx __RESULT_2024-01.xlsx [-xlsx __RESULT_2024-02.xlsx ...]
+func runImportCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var files stringList
+	fs.Var(&files, "xlsx", "Excel report to import (can be repeated)")
+	configFlag := fs.String("config", "config.json", "Path to the config file")
+	fs.Parse(args)
+	files = append(files, fs.Args()...)
+	if len(files) == 0 {
+		log.Fatalf("Usage: %s import -xlsx __RESULT.xlsx [-xlsx ...] [-config config.json]", os.Args[0])
+	}
+
+	config, err := report.LoadConfig(*configFlag)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load %s: %v", *configFlag, err)
+	}
+	store := config.CounterpartyStore()
+	if store == nil {
+		log.Fatalf("FATAL: 'counterparties_db' is not set in %s.", *configFlag)
+	}
+	registry, err := invoice.LoadCounterpartyRegistry(store)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load counterparties db: %v", err)
+	}
+	var archive *invoice.Archive
+	if config.ArchivePath != "" {
+		if archive, err = invoice.OpenArchive(config.ArchivePath); err != nil {
+			log.Fatalf("FATAL: Could not open archive: %v", err)
+		}
+	} else {
+		fmt.Println("'archive_path' is not set: invoices are validated but not stored.")
+	}
+
+	for _, path := range files {
+		stats, err := importReport(path, registry, archive)
+		if err != nil {
+			log.Printf("WARN: Could not import %s: %v", path, err)
+			continue
+		}
+		fmt.Printf("%s: %d counterparties added, %d updated; %d invoices added, %d already imported; %d rows skipped\n",
+			path, stats.counterpartiesAdded, stats.counterpartiesUpdated, stats.invoicesAdded, stats.invoicesDuplicate, len(stats.skipped))
+		for _, reason := range stats.skipped {
+			fmt.Printf("- %s\n", reason)
+		}
+	}
+
+	if err := store.Save(registry.Counterparties); err != nil {
+		log.Fatalf("FATAL: Could not save counterparties db: %v", err)
+	}
+}
+
+// importReport импортирует листы "Counterparties" и "Invoices" одного отчета.
+func importReport(path string, registry *invoice.CounterpartyRegistry, archive *invoice.Archive) (importStats, error) {
+	var stats importStats
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	// 1. Контрагенты: ID из отчета сохраняются
+	cpRows, err := sheetRecords(f, "Counterparties")
+	if err != nil {
+		return stats, err
+	}
+	for _, row := range cpRows {
+		cp, err := counterpartyRecord(row)
+		if err != nil {
+			stats.skipped = append(stats.skipped, fmt.Sprintf("Counterparties row %d: %v", row.line, err))
+			continue
+		}
+		if registry.Import(cp) {
+			stats.counterpartiesAdded++
+		} else {
+			stats.counterpartiesUpdated++
+		}
+	}
+
+	// 2. Инвойсы: строки с ошибками обработки пропускаются
+	invRows, err := sheetRecords(f, "Invoices")
+	if err != nil {
+		return stats, err
+	}
+	jobID := "import:" + filepath.Base(path)
+	var records []invoice.ArchiveRecord
+	for _, row := range invRows {
+		reason := ""
+		if status := row.get("status"); status != "" && status != "OK" {
+			reason = "not a processed invoice (" + status + ")"
+		}
+		number := row.get("invoice number")
+		if reason == "" && number == "" {
+			reason = "empty invoice number"
+		}
+		date, err := invoice.ParseDate(row.get("date"))
+		if reason == "" && err != nil {
+			reason = err.Error()
+		}
+		total, err := invoice.ParseAmount(row.get("total amount"))
+		if reason == "" && err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			stats.skipped = append(stats.skipped, fmt.Sprintf("Invoices row %d: %s", row.line, reason))
+			continue
+		}
+
+		inv := invoice.ArchivedInvoice{
+			Number:       number,
+			Date:         date,
+			TotalAmount:  total,
+			Currency:     row.get("currency"),
+			Counterparty: row.get("counterparty name"),
+			VAT:          row.get("counterparty vat"),
+		}
+		id, _ := strconv.ParseUint(row.get("counterparty id"), 10, 64)
+		if cp, ok := registry.Lookup(id, inv.Counterparty); ok {
+			inv.CounterpartyID, inv.Counterparty = cp.ID, cp.Name
+			if inv.VAT == "" {
+				inv.VAT = cp.VAT
+			}
+		}
+		file := row.get("source file")
+		records = append(records, invoice.ArchiveRecord{
+			Hash:       invoice.ImportHash(file, number, date),
+			File:       file,
+			Job:        jobID,
+			ArchivedAt: time.Now().UTC(),
+			Invoices:   []invoice.ArchivedInvoice{inv},
+		})
+	}
+	if archive != nil {
+		added, err := archive.Import(records)
+		if err != nil {
+			return stats, err
+		}
+		stats.invoicesAdded, stats.invoicesDuplicate = added, len(records)-added
+	}
+	return stats, nil
+}
+
+// counterpartyRecord возвращает контрагента строки листа "Counterparties"; ID из отчета сохраняется.
+func counterpartyRecord(row sheetRecord) (invoice.Counterparty, error) {
+	cp := invoice.Counterparty{
+		Name:               row.get("name"),
+		VAT:                row.get("vat"),
+		TaxCode2:           row.get("tax code 2"),
+		RegistrationNumber: row.get("registration number"),
+		Country:            row.get("country"),
+		CountryCode:        row.get("country code"),
+		Address:            row.get("address"),
+		IBAN:               row.get("iban"),
+		SWIFT:              row.get("swift"),
+		DefaultCurrency:    row.get("default currency"),
+		Phone:              row.get("phone"),
+		Email:              row.get("email"),
+		Website:            row.get("website"),
+	}
+	for _, alias := range strings.Split(row.get("aliases"), ";") {
+		cp.AddAlias(alias)
+	}
+	cp.NormalizeBankAccounts()
+	cp.NormalizeCountry()
+	if cp.Name == "" {
+		return cp, errors.New("empty name")
+	}
+	if value := row.get("id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return cp, fmt.Errorf("invalid ID %q", value)
+		}
+		cp.ID = id
+	}
+	return cp, nil
+}
+
+// sheetRecord — строка листа с доступом к значениям по названию колонки.
+type sheetRecord struct {
+	line   int
+	values []string
+	index  map[string]int
+}
+
+func (r sheetRecord) get(column string) string {
+	i, ok := r.index[column]
+	if !ok || i >= len(r.values) {
+		return ""
+	}
+	return strings.TrimSpace(r.values[i])
+}
+
+// sheetRecords читает лист, сопоставляя колонки по заголовкам первой строки (без учета регистра),
+// поэтому подходят и старые отчеты с другим набором или порядком колонок. Пустые строки пропускаются.
+func sheetRecords(f *excelize.File, sheet string) ([]sheetRecord, error) {
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("sheet %q: %w", sheet, err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	index := make(map[string]int, len(rows[0]))
+	for i, header := range rows[0] {
+		index[strings.ToLower(strings.TrimSpace(header))] = i
+	}
+	var records []sheetRecord
+	for i, values := range rows[1:] {
+		if strings.TrimSpace(strings.Join(values, "")) == "" {
+			continue
+		}
+		records = append(records, sheetRecord{line: i + 2, values: values, index: index})
+	}
+	return records, nil
+}
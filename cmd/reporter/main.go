@@ -1,59 +1,288 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/onec"
+	"github.com/veryevilzed/invpa/report"
 
-	"github.com/sashabaranov/go-openai"
 	"github.com/schollz/progressbar/v3"
-	"github.com/xuri/excelize/v2"
 )
 
-// Result структура для хранения результата обработки одного файла
-type Result struct {
-	SourceFile   string
-	Invoice      *invoice.Invoice
-	ErrorMessage string
-}
-
-// UniqueCounterparty структура для хранения уникального контрагента
-type UniqueCounterparty struct {
-	SourceFile   string // Файл, где контрагент был впервые обнаружен
-	Counterparty invoice.Counterparty
-}
+// defaultWorkers — число одновременно обрабатываемых файлов, если его не задают ни -workers, ни concurrency в конфиге.
+const defaultWorkers = 4
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		runArchiveCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImportCommand(os.Args[2:])
+		return
+	}
+
+	fromFlag := flag.String("from", "", "Start of the report period (YYYY-MM-DD): earlier invoices go to the 'Filtered out' sheet and are left out of the VAT summary")
+	toFlag := flag.String("to", "", "End of the report period (YYYY-MM-DD), inclusive")
+	mtimeFromFlag := flag.String("mtime-from", "", "Only process files modified on or after this date (YYYY-MM-DD), before any OpenAI request")
+	mtimeToFlag := flag.String("mtime-to", "", "Only process files modified on or before this date (YYYY-MM-DD)")
+	var counterpartyFilters []string
+	flag.Func("counterparty", "Only report invoices whose counterparty name, alias or VAT contains this text (case-insensitive); can be repeated", func(value string) error {
+		counterpartyFilters = append(counterpartyFilters, value)
+		return nil
+	})
+	formatFlag := flag.String("format", "xlsx", "Report formats, comma-separated: xlsx, csv, jsonl (__INVOICES.jsonl, one JSON object per invoice), 1c (__1C.txt or __1C.xml, see 'onec_format' in the config) or both (xlsx and csv)")
+	dirFlag := flag.String("dir", ".", "Directory with invoice files")
+	outFlag := flag.String("out", "__RESULT.xlsx", "Path of the Excel report; CSV files are written next to it")
+	configFlag := flag.String("config", "config.json", "Path to the config file")
+	companyFlag := flag.String("company", "", "Alias of the own company from 'companies' in the config (default: 'my_company')")
+	recursiveFlag := flag.Bool("recursive", false, "Include invoice files from subdirectories")
+	noCacheFlag := flag.Bool("no-cache", false, "Ignore the result cache even if it is enabled in the config")
+	verboseFlag := flag.Bool("verbose", false, "Add debug columns (pages the key fields were read from) to the invoices report")
+	watchFlag := flag.Bool("watch", false, "Keep running and add new invoice files in -dir to the report as they appear")
+	traceFlag := flag.Bool("trace", false, "Record the time of every processing phase per file, print a phase summary and save __TRACE.json")
+	workersFlag := flag.Int("workers", 0, "Number of files processed at the same time (0: 'concurrency' from the config, or 4 if it is not set)")
+	rateFlag := flag.Int("rate", 0, "Maximum OpenAI requests per minute shared by all workers and counterparty matching (0: 'requests_per_minute' from the config, unlimited if it is not set)")
+	resumeFlag := flag.Bool("resume", false, "If the -out report already exists, skip the files it lists as processed, process only new and failed files and add them to the report")
+	watchIntervalFlag := flag.Duration("watch-interval", 5*time.Second, "How long -watch waits for new files in -dir to stop changing (the polling interval if file system notifications are unavailable)")
+	debugLogFlag := flag.Bool("v", false, "Log every processing step of each file (debug level); unlike -verbose, the report is unchanged")
+	quietFlag := flag.Bool("q", false, "Log only processing warnings and errors")
+	flag.Parse()
+
+	switch {
+	case *debugLogFlag && *quietFlag:
+		log.Fatalf("FATAL: -v and -q cannot be used together")
+	case *debugLogFlag:
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	case *quietFlag:
+		slog.SetLogLoggerLevel(slog.LevelWarn)
+	}
+
+	var writeXLSX, writeCSV, writeJSONL, writeOneC bool
+	for _, format := range strings.Split(*formatFlag, ",") {
+		switch strings.ToLower(strings.TrimSpace(format)) {
+		case "xlsx":
+			writeXLSX = true
+		case "csv":
+			writeCSV = true
+		case "jsonl":
+			writeJSONL = true
+		case "1c":
+			writeOneC = true
+		case "both":
+			writeXLSX, writeCSV = true, true
+		default:
+			log.Fatalf("FATAL: Invalid -format %q (expected xlsx, csv, jsonl, 1c or both)", *formatFlag)
+		}
+	}
+
+	switch {
+	case *resumeFlag && *watchFlag:
+		log.Fatalf("FATAL: -resume and -watch cannot be used together")
+	case *resumeFlag && !writeXLSX:
+		log.Fatalf("FATAL: -resume reads the Excel report; add xlsx to -format")
+	}
+
+	from, err := parseDateFlag(*fromFlag)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid -from date: %v", err)
+	}
+	to, err := parseDateFlag(*toFlag)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid -to date: %v", err)
+	}
+	var mtime modTimeRange
+	if mtime.from, err = parseLocalDateFlag(*mtimeFromFlag); err != nil {
+		log.Fatalf("FATAL: Invalid -mtime-from date: %v", err)
+	}
+	if mtime.to, err = parseLocalDateFlag(*mtimeToFlag); err != nil {
+		log.Fatalf("FATAL: Invalid -mtime-to date: %v", err)
+	}
+
+	// Проверяем пути до любых обращений к OpenAI
+	if info, err := os.Stat(*dirFlag); err != nil || !info.IsDir() {
+		log.Fatalf("FATAL: Invoice directory %q does not exist or is not a directory.", *dirFlag)
+	}
+	outDir := filepath.Dir(*outFlag)
+	if info, err := os.Stat(outDir); err != nil || !info.IsDir() {
+		log.Fatalf("FATAL: Output directory %q does not exist.", outDir)
+	}
+
 	// 1. Загрузка конфигурации
-	config, err := loadConfig("config.json")
+	config, err := report.LoadConfig(*configFlag)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load %s. Make sure it exists and is configured. Error: %v", *configFlag, err)
+	}
+	// Все ошибки конфигурации сообщаются сразу, до сканирования файлов
+	if err := config.Validate(); err != nil {
+		log.Fatalf("FATAL: Invalid %s:\n%v", *configFlag, err)
+	}
+	if !config.NetworkAllowed() {
+		fmt.Println("Network access is disabled by configuration: files are extracted and matched locally.")
+	}
+	client, err := invoice.NewClient(config.ClientConfig())
+	if err != nil {
+		log.Fatalf("FATAL: Invalid OpenAI settings in config.json: %v", err)
+	}
+	roundingPolicy, err := invoice.ParseRoundingPolicy(config.RoundingPolicy)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'rounding_policy' in config.json: %v", err)
+	}
+	csvDelimiter, err := invoice.ParseCSVDelimiter(config.CSVDelimiter)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'csv_delimiter' in config.json: %v", err)
+	}
+	oneCFormat, err := onec.ParseFormat(config.OneCFormat)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'onec_format' in config.json: %v", err)
+	}
+	pageSelection, err := invoice.ParsePageSelection(config.PageSelection)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'page_selection' in config.json: %v", err)
+	}
+	extractionMode, err := invoice.ParseExtractionMode(config.ExtractionMode)
 	if err != nil {
-		log.Fatalf("FATAL: Could not load config.json. Make sure it exists and is configured. Error: %v", err)
+		log.Fatalf("FATAL: Invalid 'extraction_mode' in config.json: %v", err)
 	}
-	if config.OpenAPIKey == "" {
-		log.Fatalf("FATAL: 'openai_api_key' is not set in config.json.")
+	// Выбранная компания заменяет my_company для всего запуска, включая сводку по НДС
+	if config.MyCompany, err = config.Company(*companyFlag); err != nil {
+		log.Fatalf("FATAL: Invalid -company: %v", err)
 	}
 
 	// 2. Сканирование файлов в текущей директории
-	files, err := findInvoiceFiles(".")
+	files, err := report.FindInvoiceFiles(*dirFlag, report.FindOptions{Recursive: *recursiveFlag})
 	if err != nil {
 		log.Fatalf("FATAL: Error scanning for files: %v", err)
 	}
+	if found := len(files); !*watchFlag {
+		files = mtime.filterFiles(files)
+		if skipped := found - len(files); skipped > 0 {
+			fmt.Printf("Skipped %d files modified outside -mtime-from/-mtime-to.\n", skipped)
+		}
+	}
+
+	// Режим -resume: файлы, обработанные в существующем отчете, пропускаются
+	var previous *previousReport
+	resumeSkipped := 0
+	if *resumeFlag {
+		if previous, err = loadPreviousReport(*outFlag); err != nil {
+			log.Fatalf("FATAL: Could not read %s for -resume: %v", *outFlag, err)
+		}
+	}
+	if previous != nil {
+		pending := previous.pending(*dirFlag, files)
+		resumeSkipped = len(files) - len(pending)
+		files = pending
+		fmt.Printf("Resuming %s: %d files are already in the report.\n", *outFlag, resumeSkipped)
+		if len(files) == 0 {
+			fmt.Println("No new or failed files to process; the report is up to date.")
+			return
+		}
+	}
 
-	if len(files) == 0 {
-		fmt.Println("No invoice files (.pdf, .png, .jpg, .jpeg) found in the current directory.")
+	if len(files) == 0 && !*watchFlag {
+		fmt.Printf("No invoice files (%s) found in %q.\n", strings.Join(invoice.SupportedExtensions, ", "), *dirFlag)
 		return
 	}
 
-	fmt.Printf("Found %d files to process. Starting analysis...\n", len(files))
+	if !*watchFlag {
+		fmt.Printf("Found %d files to process. Starting analysis...\n", len(files))
+	}
+	start := time.Now()
 
-	// 3. Настройка OpenAI клиента и прогресс-бара
-	client := openai.NewClient(config.OpenAPIKey)
+	// 3. Настройка процессора и прогресс-бара
+	tracing := (*traceFlag || config.Trace) && !*watchFlag
+	workers := *workersFlag
+	if workers <= 0 {
+		workers = config.Concurrency
+	}
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	requestsPerMinute := *rateFlag
+	if requestsPerMinute <= 0 {
+		requestsPerMinute = config.RequestsPerMinute
+	}
+	renderOptions, err := config.RenderOptions()
+	if err != nil {
+		log.Fatalf("FATAL: Invalid PDF settings in config.json: %v", err)
+	}
+	promptTemplates, err := config.PromptTemplates()
+	if err != nil {
+		log.Fatalf("FATAL: Invalid prompt templates in config.json: %v", err)
+	}
+	aliasOverrides, err := config.AliasOverrides()
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'counterparty_aliases' in config.json: %v", err)
+	}
+	requestTimeout, err := config.RequestTimeoutLimit()
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'request_timeout' in config.json: %v", err)
+	}
+	fileTimeout, err := config.FileTimeoutLimit()
+	if err != nil {
+		log.Fatalf("FATAL: Invalid 'file_timeout' in config.json: %v", err)
+	}
+	var cache *invoice.ResultCache
+	if config.ResultCache && !*noCacheFlag {
+		cache, err = invoice.NewResultCache(config.ResultCachePath)
+		if err != nil {
+			log.Fatalf("FATAL: Could not open result cache: %v", err)
+		}
+	}
+	options := []invoice.Option{
+		invoice.WithPageRenderer(invoice.PDFRenderer(renderOptions)),
+		invoice.WithMyCompany(config.MyCompany),
+		invoice.WithRoundingPolicy(roundingPolicy),
+		invoice.WithThumbnails(config.ThumbnailSize),
+		invoice.WithPageSelection(pageSelection),
+		invoice.WithMaxAllPages(config.MaxAllPagesLimit()),
+		invoice.WithCache(cache),
+		invoice.WithDuplexRotation(config.DuplexRotation),
+		invoice.WithTextExtractor(invoice.PDFTextExtractor(renderOptions)),
+		invoice.WithExtractionMode(extractionMode),
+		invoice.WithCategories(config.Categories),
+		invoice.WithPromptTemplates(promptTemplates),
+		invoice.WithAliasOverrides(aliasOverrides),
+		invoice.WithRequestTimeout(requestTimeout),
+		invoice.WithFileTimeout(fileTimeout),
+		invoice.WithAttachmentExtractor(invoice.PDFAttachmentExtractor(renderOptions)),
+		invoice.WithDegradedMode(config.DegradedMode, config.DegradedAfter),
+		invoice.WithCurrencyAutoCorrect(config.CurrencyAutoCorrect),
+		invoice.WithConcurrency(workers),
+		invoice.WithRateLimiter(invoice.NewRequestLimiter(requestsPerMinute, config.ConcurrentRequests)),
+		invoice.WithJSONRepair(config.RepairAttempts()),
+		invoice.WithModel(config.ModelName()),
+		invoice.WithTracing(tracing),
+	}
+	if config.AdaptiveConcurrency {
+		low, high := config.ConcurrencyBounds()
+		if *workersFlag > 0 {
+			high = max(*workersFlag, low)
+		}
+		options = append(options, invoice.WithAdaptiveConcurrency(low, high))
+	}
+	processor := invoice.NewProcessor(client, options...)
+	reports := reportOptions{
+		out: *outFlag, outDir: outDir, filter: reportFilter{from: from, to: to, counterparties: counterpartyFilters}, roundingPolicy: roundingPolicy, csvDelimiter: csvDelimiter,
+		writeXLSX: writeXLSX, writeCSV: writeCSV, writeJSONL: writeJSONL, writeOneC: writeOneC, oneCFormat: oneCFormat, verbose: *verboseFlag, config: config,
+	}
+	if *watchFlag {
+		runWatch(processor, reports, *dirFlag, *recursiveFlag, mtime, *watchIntervalFlag)
+		return
+	}
 	bar := progressbar.NewOptions(len(files),
 		progressbar.OptionSetDescription("Processing invoices"),
 		progressbar.OptionSetTheme(progressbar.Theme{
@@ -66,178 +295,299 @@ func main() {
 	)
 
 	// 4. Параллельная обработка файлов
-	resultsChan := make(chan Result, len(files))
-	var wg sync.WaitGroup
-
-	for _, file := range files {
-		wg.Add(1)
-		go func(f string) {
-			defer wg.Done()
-			defer bar.Add(1)
-
-			invoices, err := invoice.ProcessFile(f, config.OpenAPIKey, config.PopplerPathWindows, config.MyCompany)
-			if err != nil {
-				resultsChan <- Result{SourceFile: f, ErrorMessage: err.Error()}
-				return
-			}
-			// Если в одном файле несколько инвойсов, берем первый (для упрощения отчета)
-			if len(invoices) > 0 {
-				resultsChan <- Result{SourceFile: f, Invoice: &invoices[0]}
-			} else {
-				resultsChan <- Result{SourceFile: f, ErrorMessage: "No invoices found in file"}
-			}
-		}(file)
-	}
-
-	wg.Wait()
-	close(resultsChan)
+	var allResults []invoice.Result
+	var fileResults []invoice.FileResult
+	var fileTraces []*invoice.Trace
+	for fr := range processor.ProcessBatch(context.Background(), files) {
+		fileResults = append(fileResults, fr)
+		if fr.Trace != nil {
+			fileTraces = append(fileTraces, fr.Trace)
+		}
+		name := invoice.SourceName(*dirFlag, fr.Path)
+		allResults = append(allResults, fr.Results(name)...)
+		bar.Add(1)
+	}
 	fmt.Println("\nAnalysis complete. Deduplicating counterparties and generating report...")
 
-	// 5. Сбор и обработка результатов
-	var allResults []Result
-	var uniqueCounterparties []UniqueCounterparty
-	var existingForSearch []invoice.Counterparty
-	var successfulCount, errorCount int
-
-	for res := range resultsChan {
-		allResults = append(allResults, res)
-		if res.ErrorMessage != "" {
-			errorCount++
-			continue // Пропускаем дедупликацию для ошибочных результатов
+	// 5. Дедупликация контрагентов с учетом базы из прошлых запусков (если указана в конфиге)
+	store := config.CounterpartyStore()
+	registry, err := invoice.LoadCounterpartyRegistry(store)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load counterparties db: %v", err)
+	}
+	if previous != nil {
+		previous.importCounterparties(registry)
+	}
+	var batchTrace *invoice.Trace // Сопоставление и запись отчетов; nil, если трассировка выключена
+	if tracing {
+		batchTrace = &invoice.Trace{}
+	}
+	dedup := processor.Deduplicate(invoice.WithTrace(context.Background(), batchTrace), allResults, registry)
+	for _, warning := range dedup.Warnings {
+		log.Printf("WARN: %s", warning)
+	}
+
+	// Сохраняем пополненную базу контрагентов
+	if store != nil {
+		if err := store.Save(registry.Counterparties); err != nil {
+			log.Printf("WARN: Could not save counterparties db: %v", err)
 		}
-		successfulCount++
+	}
+
+	// 6–7. Сводка по НДС и генерация отчетов
+	reportStarted := time.Now()
+	filesScanned := len(files)
+	timings := invoice.SummarizeFileTimings(allResults) // Только файлы этого запуска, без строк прошлого отчета
+	if previous != nil {
+		allResults, dedup, filesScanned = previous.merge(allResults, dedup)
+	}
+	runSummary, vatSummary, filteredOut, err := writeReports(reports, allResults, dedup, filesScanned, time.Since(start))
+	batchTrace.Record(invoice.PhaseReport, reportStarted, err)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	printReportSummary(reports, runSummary, vatSummary, filteredOut)
+	if previous != nil {
+		fmt.Printf("\nResume: skipped %d files already in the report, processed %d files.\n", resumeSkipped, len(files))
+	}
+	if n, wait := processor.Throttled(); n > 0 {
+		fmt.Printf("\n%d OpenAI requests waited for the rate limit (requests_per_minute, max_concurrent_requests), %v in total.\n", n, wait.Round(time.Second))
+	}
+	printTimingSummary(timings, dedup.MatchingDuration)
+	if tracing {
+		writeTrace(filepath.Join(outDir, "__TRACE.json"), fileTraces, batchTrace)
+	}
+
+	// 8. Архивирование исходных файлов и результатов: ошибки не влияют на готовые отчеты
+	if config.ArchivePath != "" {
+		archiveFiles(config.ArchivePath, start.UTC().Format("20060102T150405Z"), *dirFlag, fileResults)
+	}
+}
 
-		// Логика дедупликации только для успешных результатов
-		matched, err := invoice.FindCounterparty(client, existingForSearch, res.Invoice.Counterparty)
+// printTimingSummary печатает сводку времени обработки файлов. Сопоставление контрагентов — один запрос
+// на весь пакет, поэтому его время выводится отдельно, а не делится по файлам.
+func printTimingSummary(timings invoice.FileTimings, matching time.Duration) {
+	if len(timings.Files) == 0 {
+		return
+	}
+	fmt.Printf("\nProcessing time per file (%d files): %s.\n", len(timings.Files), timings.Line())
+	for _, f := range timings.Slowest(3) {
+		fmt.Printf("  %s\n", f)
+	}
+	if matching > 0 {
+		fmt.Printf("Counterparty matching: %v.\n", matching.Round(100*time.Millisecond))
+	}
+}
+
+// reportOptions — настройки генерации отчетов.
+type reportOptions struct {
+	out, outDir         string // Путь к Excel-отчету и директория остальных файлов
+	filter              reportFilter
+	roundingPolicy      invoice.RoundingPolicy
+	csvDelimiter        rune
+	writeXLSX, writeCSV bool
+	writeJSONL          bool
+	writeOneC           bool // Файл обмена с 1С (oneCFormat)
+	oneCFormat          onec.Format
+	verbose             bool
+	config              *invoice.Config
+}
+
+// writeReports формирует сводку по НДС и записывает отчеты (Excel, CSV, JSON Lines и/или файл обмена с 1С) и __VAT_SUMMARY.csv.
+// Итоги запуска считаются по всем результатам, а листы инвойсов и контрагентов и сводка по НДС — по строкам,
+// прошедшим фильтры. Возвращает также число инвойсов, исключенных фильтрами.
+func writeReports(o reportOptions, allResults []invoice.Result, dedup invoice.Deduplication, filesScanned int, wallTime time.Duration) (invoice.RunSummary, invoice.VATSummary, int, error) {
+	runSummary := invoice.NewRunSummary(filesScanned, allResults, dedup, o.config.ModelPrices, wallTime)
+	rows := o.filter.apply(allResults)
+	counterparties := o.filter.keptCounterparties(dedup.UniqueCounterparties, rows.kept)
+
+	var okInvoices []invoice.Invoice
+	for _, res := range rows.kept {
+		if res.Invoice != nil && !res.IsDuplicate() {
+			okInvoices = append(okInvoices, *res.Invoice)
+		}
+	}
+	vatSummary := invoice.SummarizeVAT(okInvoices, o.config.MyCompany, o.filter.from, o.filter.to, o.roundingPolicy)
+
+	if o.writeXLSX {
+		warnings, err := generateExcelReport(o.out, rows, counterparties, vatSummary, dedup.MatchingUsage, runSummary, o.config, o.verbose)
 		if err != nil {
-			log.Printf("WARN: Could not match counterparty for %s: %v", res.SourceFile, err)
-			// ID будет 0 (zero-value), что означает "новый"
-			uniqueCounterparties = append(uniqueCounterparties, UniqueCounterparty{
-				SourceFile:   res.SourceFile,
-				Counterparty: res.Invoice.Counterparty,
-			})
-			existingForSearch = append(existingForSearch, res.Invoice.Counterparty)
-		} else if matched != nil {
-			// Нашли совпадение, используем его ID и обновленные данные
-			res.Invoice.Counterparty = *matched
-		} else {
-			// ID будет 0 (zero-value), что означает "новый"
-			uniqueCounterparties = append(uniqueCounterparties, UniqueCounterparty{
-				SourceFile:   res.SourceFile,
-				Counterparty: res.Invoice.Counterparty,
-			})
-			existingForSearch = append(existingForSearch, res.Invoice.Counterparty)
+			return runSummary, vatSummary, len(rows.filtered), fmt.Errorf("Failed to generate Excel report: %v", err)
+		}
+		for _, warning := range warnings {
+			log.Printf("WARN: %s", warning)
+		}
+	}
+	if o.writeCSV {
+		if err := generateCSVReport(o.outDir, rows, counterparties, o.csvDelimiter, o.verbose); err != nil {
+			return runSummary, vatSummary, len(rows.filtered), fmt.Errorf("Failed to generate CSV report: %v", err)
 		}
 	}
+	if o.writeJSONL {
+		if err := writeJSONLFile(filepath.Join(o.outDir, "__INVOICES.jsonl"), rows.kept); err != nil {
+			return runSummary, vatSummary, len(rows.filtered), fmt.Errorf("Failed to write JSON Lines export: %v", err)
+		}
+	}
+	if o.writeOneC {
+		if err := writeOneCFile(o.oneCPath(), rows.kept, o.oneCFormat, o.config.MyCompany); err != nil {
+			return runSummary, vatSummary, len(rows.filtered), fmt.Errorf("Failed to write 1C exchange file: %v", err)
+		}
+	}
+	if err := writeVATSummaryCSV(filepath.Join(o.outDir, "__VAT_SUMMARY.csv"), vatSummary); err != nil {
+		return runSummary, vatSummary, len(rows.filtered), fmt.Errorf("Failed to write VAT summary CSV: %v", err)
+	}
+	return runSummary, vatSummary, len(rows.filtered), nil
+}
+
+// oneCPath возвращает путь файла обмена с 1С: __1C.txt или __1C.xml в зависимости от формата.
+func (o reportOptions) oneCPath() string {
+	return filepath.Join(o.outDir, "__1C"+o.oneCFormat.Extension())
+}
 
-	// 6. Генерация Excel файла
-	err = generateExcelReport(allResults, uniqueCounterparties)
+// printReportSummary выводит пути отчетов и итог обработки.
+func printReportSummary(o reportOptions, runSummary invoice.RunSummary, vatSummary invoice.VATSummary, filteredOut int) {
+	var reports []string
+	if o.writeXLSX {
+		reports = append(reports, fmt.Sprintf("'%s'", o.out))
+	}
+	if o.writeCSV {
+		reports = append(reports, fmt.Sprintf("'%s'", filepath.Join(o.outDir, "__INVOICES.csv")), fmt.Sprintf("'%s'", filepath.Join(o.outDir, "__COUNTERPARTIES.csv")))
+	}
+	if o.writeJSONL {
+		reports = append(reports, fmt.Sprintf("'%s'", filepath.Join(o.outDir, "__INVOICES.jsonl")))
+	}
+	if o.writeOneC {
+		reports = append(reports, fmt.Sprintf("'%s'", o.oneCPath()))
+	}
+	fmt.Printf("\nSuccessfully generated report %s with:\n", strings.Join(reports, ", "))
+	for _, line := range runSummary.Lines() {
+		fmt.Printf("- %s\n", line)
+	}
+	if filteredOut > 0 {
+		fmt.Printf("- Filtered out: %d invoices (see 'Filtered out' sheet)\n", filteredOut)
+	}
+	if len(vatSummary.Unclassified) > 0 {
+		fmt.Printf("- WARNING: %d VAT summary buckets without tax breakdown (see 'VAT Summary' sheet)\n", len(vatSummary.Unclassified))
+	}
+	fmt.Printf("VAT summary written to '%s'\n", filepath.Join(o.outDir, "__VAT_SUMMARY.csv"))
+}
+
+// writeTrace выводит время по этапам обработки и сохраняет трассы файлов и этапов пакета в path.
+func writeTrace(path string, files []*invoice.Trace, batch *invoice.Trace) {
+	trace := struct {
+		Phases  []invoice.PhaseStats `json:"phases"`
+		Files   []*invoice.Trace     `json:"files"`
+		Batch   *invoice.Trace       `json:"batch"`
+		Retries int                  `json:"retries"`
+	}{Files: files, Batch: batch}
+	for _, file := range files {
+		trace.Retries += file.Retries
+	}
+	trace.Phases = invoice.SummarizeTraces(append(slices.Clone(files), batch))
+
+	fmt.Printf("\nTiming by phase (%d files, %d retries after rate limiting):\n", len(files), trace.Retries)
+	for _, line := range invoice.TraceTable(trace.Phases) {
+		fmt.Println(line)
+	}
+	data, err := json.MarshalIndent(trace, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0o644)
+	}
 	if err != nil {
-		log.Fatalf("FATAL: Failed to generate Excel report: %v", err)
+		log.Printf("WARN: Could not save trace: %v", err)
+		return
 	}
+	fmt.Printf("Trace written to '%s'\n", path)
+}
 
-	fmt.Printf("\nSuccessfully generated report '__RESULT.xlsx' with:\n")
-	fmt.Printf("- %d successfully processed invoices\n", successfulCount)
-	fmt.Printf("- %d unique counterparties found\n", len(uniqueCounterparties))
-	fmt.Printf("- %d files with errors\n", errorCount)
+// parseDateFlag разбирает дату из флага командной строки. Пустая строка — открытая граница.
+func parseDateFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", value)
 }
 
-func loadConfig(path string) (*invoice.Config, error) {
-	file, err := os.Open(path)
+func writeVATSummaryCSV(path string, summary invoice.VATSummary) error {
+	file, err := os.Create(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
+	return invoice.WriteVATSummaryCSV(file, summary)
+}
 
-	var config invoice.Config
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	return &config, err
+// generateExcelReport создает Excel-отчет по пути path. Возвращает предупреждения о миниатюрах, которые не удалось встроить.
+func generateExcelReport(path string, rows reportRows, counterparties []invoice.UniqueCounterparty, vatSummary invoice.VATSummary, matchingUsage invoice.Usage, runSummary invoice.RunSummary, config *invoice.Config, verbose bool) ([]string, error) {
+	data := report.Data{
+		Results:        rows.kept,
+		All:            rows.all,
+		Filtered:       rows.filtered,
+		Counterparties: counterparties,
+		VATSummary:     vatSummary,
+		MatchingUsage:  matchingUsage,
+		Summary:        runSummary,
+	}
+	return report.SaveExcel(path, data, config, report.Options{Verbose: verbose})
 }
 
-func findInvoiceFiles(root string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+// generateCSVReport записывает листы "Invoices" и "Counterparties" в __INVOICES.csv и __COUNTERPARTIES.csv в директории dir.
+func generateCSVReport(dir string, rows reportRows, counterparties []invoice.UniqueCounterparty, delimiter rune, verbose bool) error {
+	if err := writeCSVFile(filepath.Join(dir, "__INVOICES.csv"), delimiter, report.InvoiceColumns(verbose), report.InvoiceRows(rows.kept, verbose)); err != nil {
+		return err
+	}
+	if len(rows.filtered) > 0 {
+		if err := writeCSVFile(filepath.Join(dir, "__FILTERED_OUT.csv"), delimiter, report.FilteredColumns(verbose), report.FilteredRows(rows.filtered, verbose)); err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			ext := strings.ToLower(filepath.Ext(path))
-			if ext == ".pdf" || ext == ".png" || ext == ".jpg" || ext == ".jpeg" {
-				// Игнорируем вложенные директории, кроме текущей
-				if filepath.Dir(path) == "." {
-					files = append(files, path)
-				}
-			}
-		}
-		return nil
-	})
-	return files, err
+	}
+	return writeCSVFile(filepath.Join(dir, "__COUNTERPARTIES.csv"), delimiter, report.CounterpartyHeaders, report.CounterpartyRows(counterparties))
 }
 
-func generateExcelReport(allResults []Result, counterparties []UniqueCounterparty) error {
-	f := excelize.NewFile()
-	defer f.Close()
-
-	// --- Лист "Invoices" ---
-	f.NewSheet("Invoices")
-	f.DeleteSheet("Sheet1") // Удаляем лист по умолчанию
-	headers := []string{
-		"Source File", "Status", "Counterparty ID", "Counterparty Name", "Counterparty VAT", "Counterparty Country",
-		"Invoice Number", "Date", "Total Amount", "Tax Amount", "Purpose",
-	}
-	for i, h := range headers {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue("Invoices", cell, h)
-	}
-	for i, res := range allResults {
-		row := i + 2
-		f.SetCellValue("Invoices", fmt.Sprintf("A%d", row), res.SourceFile)
-
-		if res.ErrorMessage != "" {
-			f.SetCellValue("Invoices", fmt.Sprintf("B%d", row), res.ErrorMessage)
-			// Устанавливаем красный цвет для ячейки со статусом ошибки
-			style, _ := f.NewStyle(&excelize.Style{
-				Font: &excelize.Font{Color: "9A0511"},
-			})
-			f.SetCellStyle("Invoices", fmt.Sprintf("B%d", row), fmt.Sprintf("B%d", row), style)
-		} else {
-			f.SetCellValue("Invoices", fmt.Sprintf("B%d", row), "OK")
-			cp := res.Invoice.Counterparty
-			f.SetCellValue("Invoices", fmt.Sprintf("C%d", row), cp.ID)
-			f.SetCellValue("Invoices", fmt.Sprintf("D%d", row), cp.Name)
-			f.SetCellValue("Invoices", fmt.Sprintf("E%d", row), cp.VAT)
-			f.SetCellValue("Invoices", fmt.Sprintf("F%d", row), cp.Country)
-			f.SetCellValue("Invoices", fmt.Sprintf("G%d", row), res.Invoice.Number)
-			f.SetCellValue("Invoices", fmt.Sprintf("H%d", row), res.Invoice.Date)
-			f.SetCellValue("Invoices", fmt.Sprintf("I%d", row), res.Invoice.TotalAmount)
-			f.SetCellValue("Invoices", fmt.Sprintf("J%d", row), res.Invoice.TaxAmount)
-			f.SetCellValue("Invoices", fmt.Sprintf("K%d", row), res.Invoice.Purpose)
-		}
+// writeJSONLFile записывает инвойсы результатов в path в формате JSON Lines (invoice.WriteJSONL).
+func writeJSONLFile(path string, results []invoice.Result) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := invoice.WriteJSONL(writer, results); err != nil {
+		file.Close()
+		return err
 	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
 
-	// --- Лист "Counterparties" ---
-	f.NewSheet("Counterparties")
-	cpHeaders := []string{"Source File", "ID", "Name", "VAT", "Country", "Address", "IBAN", "SWIFT", "Phone", "Email", "Website"}
-	for i, h := range cpHeaders {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue("Counterparties", cell, h)
-	}
-	for i, ucp := range counterparties {
-		row := i + 2
-		cp := ucp.Counterparty
-		f.SetCellValue("Counterparties", fmt.Sprintf("A%d", row), ucp.SourceFile)
-		f.SetCellValue("Counterparties", fmt.Sprintf("B%d", row), cp.ID)
-		f.SetCellValue("Counterparties", fmt.Sprintf("C%d", row), cp.Name)
-		f.SetCellValue("Counterparties", fmt.Sprintf("D%d", row), cp.VAT)
-		f.SetCellValue("Counterparties", fmt.Sprintf("E%d", row), cp.Country)
-		f.SetCellValue("Counterparties", fmt.Sprintf("F%d", row), cp.Address)
-		f.SetCellValue("Counterparties", fmt.Sprintf("G%d", row), cp.IBAN)
-		f.SetCellValue("Counterparties", fmt.Sprintf("H%d", row), cp.SWIFT)
-		f.SetCellValue("Counterparties", fmt.Sprintf("I%d", row), cp.Phone)
-		f.SetCellValue("Counterparties", fmt.Sprintf("J%d", row), cp.Email)
-		f.SetCellValue("Counterparties", fmt.Sprintf("K%d", row), cp.Website)
-	}
-
-	return f.SaveAs("__RESULT.xlsx")
+// writeOneCFile записывает инвойсы результатов в файл обмена с 1С path (onec.Write).
+func writeOneCFile(path string, results []invoice.Result, format onec.Format, myCompany invoice.Counterparty) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := onec.Write(writer, results, onec.Options{Format: format, MyCompany: myCompany}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func writeCSVFile(path string, delimiter rune, header []string, rows [][]any) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := invoice.WriteCSVTable(file, delimiter, header, rows); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
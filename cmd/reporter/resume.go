@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/xuri/excelize/v2"
+)
+
+// previousReport — строки существующего отчета для режима -resume.
+type previousReport struct {
+	results        []invoice.Result             // Инвойсы обработанных файлов (OK и повторы) в порядке отчета
+	failed         []invoice.Result             // Строки файлов, которые не удалось обработать
+	counterparties []invoice.UniqueCounterparty // Лист "Counterparties"
+	done           map[string]bool              // Source File обработанных файлов: они не обрабатываются повторно
+}
+
+// loadPreviousReport читает листы "Invoices", "Filtered out" и "Counterparties" отчета path. Если отчета
+// еще нет, возвращает nil без ошибки.
+//
+// Отчет хранит не все поля инвойса, поэтому восстановленные строки упрощены: в разбивке налога нет баз,
+// предупреждения пересчитываются, а расход токенов прошлых запусков не переносится (время обработки
+// файлов переносится из колонки "Duration (ms)"). В отчетах без колонки "Type" тип документа считается
+// инвойсом (TypePaymentOrder).
+func loadPreviousReport(path string) (*previousReport, error) {
+	f, err := excelize.OpenFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	previous := &previousReport{done: make(map[string]bool)}
+	cpRows, err := sheetRecords(f, "Counterparties")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range cpRows {
+		cp, err := counterpartyRecord(row)
+		if err != nil {
+			return nil, fmt.Errorf("Counterparties row %d: %w", row.line, err)
+		}
+		previous.counterparties = append(previous.counterparties, invoice.UniqueCounterparty{
+			SourceFile:   row.get("source file"),
+			Counterparty: cp,
+			AliasRule:    row.get("resolved via alias"),
+		})
+	}
+
+	invRows, err := sheetRecords(f, "Invoices")
+	if err != nil {
+		return nil, err
+	}
+	// Отфильтрованные -from/-to/-counterparty инвойсы тоже обработаны; листа нет, если фильтры не исключили ни одного
+	if index, _ := f.GetSheetIndex("Filtered out"); index >= 0 {
+		filtered, err := sheetRecords(f, "Filtered out")
+		if err != nil {
+			return nil, err
+		}
+		invRows = append(invRows, filtered...)
+	}
+	for _, row := range invRows {
+		res, err := previous.result(row)
+		if err != nil {
+			return nil, fmt.Errorf("Invoices row %d: %w", row.line, err)
+		}
+		if res.ErrorMessage != "" {
+			previous.failed = append(previous.failed, res)
+			continue
+		}
+		previous.results = append(previous.results, res)
+		previous.done[res.SourceFile] = true
+	}
+	return previous, nil
+}
+
+// result восстанавливает результат по строке листа инвойсов. Строка с другим статусом, чем "OK",
+// "Duplicate of ..." или "Skipped: ...", — файл с ошибкой: статус содержит ее текст.
+func (p *previousReport) result(row sheetRecord) (invoice.Result, error) {
+	res := invoice.Result{SourceFile: row.get("source file")}
+	status := row.get("status")
+	fmt.Sscanf(row.get("invoice in file"), "%d of %d", &res.InvoiceIndex, &res.InvoiceCount)
+	res.DurationMS, _ = strconv.ParseInt(row.get("duration (ms)"), 10, 64)
+	if reason, ok := strings.CutPrefix(status, "Skipped: "); ok {
+		res.Skipped = reason
+		return res, nil
+	}
+	if status != "OK" && !strings.HasPrefix(status, "Duplicate of ") {
+		res.ErrorMessage = status
+		return res, nil
+	}
+
+	inv := &invoice.Invoice{
+		Type:              invoice.TypePaymentOrder,
+		Number:            row.get("invoice number"),
+		Currency:          row.get("currency"),
+		Purpose:           row.get("purpose"),
+		Category:          row.get("category"),
+		OrderReference:    row.get("order reference"),
+		ContractReference: row.get("contract reference"),
+	}
+	setExtraction(inv, row.get("extraction"))
+	if docType, ok := invoice.ParseType(row.get("type")); ok {
+		inv.Type = docType
+	}
+	inv.Direction, _ = invoice.ParseDirection(row.get("direction"))
+	if value := row.get("date"); value != "" {
+		date, err := invoice.ParseDate(value)
+		if err != nil {
+			date = value // Невалидная дата остается как есть, ее отметит Validate
+		}
+		inv.Date = date
+	}
+	var err error
+	if inv.TotalAmount, err = parseOptionalAmount(row.get("total amount")); err != nil {
+		return res, err
+	}
+	if inv.TaxAmount, err = parseOptionalAmount(row.get("tax amount")); err != nil {
+		return res, err
+	}
+	if inv.TaxBreakdown, err = parseTaxBreakdown(row.get("tax breakdown")); err != nil {
+		return res, err
+	}
+
+	id, _ := strconv.ParseUint(row.get("counterparty id"), 10, 64)
+	inv.Counterparty = p.counterparty(id, row.get("counterparty name"))
+	if inv.Counterparty.Name == "" {
+		inv.Counterparty = invoice.Counterparty{ID: id, Name: row.get("counterparty name"), VAT: row.get("counterparty vat"), Country: row.get("counterparty country")}
+	}
+
+	if status != "OK" {
+		res.DuplicateOf = strings.TrimPrefix(status, "Duplicate of ")
+	}
+	res.Invoice = inv
+	res.Warnings = inv.Validate()
+	return res, nil
+}
+
+// counterparty ищет контрагента листа "Counterparties" по ID, а без ID — по наименованию.
+func (p *previousReport) counterparty(id uint64, name string) invoice.Counterparty {
+	for _, ucp := range p.counterparties {
+		if (id != 0 && ucp.Counterparty.ID == id) || (id == 0 && ucp.Counterparty.MatchesName(name)) {
+			return ucp.Counterparty
+		}
+	}
+	return invoice.Counterparty{}
+}
+
+// pending оставляет из files те, которых нет среди обработанных файлов отчета.
+func (p *previousReport) pending(dir string, files []string) []string {
+	var pending []string
+	for _, path := range files {
+		if !p.done[invoice.SourceName(dir, path)] {
+			pending = append(pending, path)
+		}
+	}
+	return pending
+}
+
+// importCounterparties добавляет контрагентов отчета в реестр, чтобы контрагенты новых файлов
+// сопоставлялись и с ними, а не только с базой контрагентов.
+func (p *previousReport) importCounterparties(registry *invoice.CounterpartyRegistry) {
+	for _, ucp := range p.counterparties {
+		registry.Import(ucp.Counterparty)
+	}
+}
+
+// merge объединяет строки отчета с результатами и дедупликацией новых файлов. Прежние строки идут
+// первыми; строки ошибок сохраняются только для файлов, которые не обрабатывались повторно.
+// Повторы инвойсов пересчитываются по всем строкам: новый файл может повторять инвойс из отчета.
+// Возвращает также число файлов в объединенном отчете.
+func (p *previousReport) merge(results []invoice.Result, dedup invoice.Deduplication) ([]invoice.Result, invoice.Deduplication, int) {
+	reprocessed := make(map[string]bool, len(results))
+	for _, res := range results {
+		reprocessed[res.SourceFile] = true
+	}
+	merged := append([]invoice.Result(nil), p.results...)
+	for _, res := range p.failed {
+		if !reprocessed[res.SourceFile] {
+			merged = append(merged, res)
+		}
+	}
+	merged = append(merged, results...)
+
+	mergedDedup := invoice.Deduplication{UniqueCounterparties: append([]invoice.UniqueCounterparty(nil), p.counterparties...)}
+	mergeDeduplication(&mergedDedup, dedup)
+	mergedDedup.Warnings = dedup.Warnings
+	mergedDedup.Successful, mergedDedup.Failed = 0, 0
+	files := 0
+	for _, res := range merged {
+		switch {
+		case res.ErrorMessage != "":
+			mergedDedup.Failed++
+			files++
+			continue
+		case !res.IsSkipped():
+			mergedDedup.Successful++
+		}
+		if res.InvoiceIndex <= 1 {
+			files++
+		}
+	}
+	mergedDedup.Duplicates = invoice.MarkDuplicates(merged)
+	return merged, mergedDedup, files
+}
+
+// parseOptionalAmount разбирает сумму ячейки; пустая ячейка — 0.
+func parseOptionalAmount(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return invoice.ParseAmount(value)
+}
+
+// parseTaxBreakdown разбирает колонку "Tax Breakdown" (Invoice.FormatTaxBreakdown): "20%: 100.00; 10%: 5.50".
+func parseTaxBreakdown(value string) ([]invoice.TaxLine, error) {
+	var lines []invoice.TaxLine
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		rate, amount, ok := strings.Cut(part, "%:")
+		if !ok {
+			return nil, fmt.Errorf("unrecognized tax breakdown %q", value)
+		}
+		var line invoice.TaxLine
+		var err error
+		if line.Rate, err = strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil {
+			return nil, fmt.Errorf("unrecognized tax breakdown %q", value)
+		}
+		if line.Amount, err = invoice.ParseAmount(amount); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// setExtraction восстанавливает Extraction и SourceMethod инвойса по колонке "Extraction" (Invoice.ExtractionSource).
+func setExtraction(inv *invoice.Invoice, source string) {
+	if method, ok := strings.CutSuffix(source, " + payment QR"); ok {
+		inv.SourceMethod = invoice.SourceMethodQR
+		source = method
+	}
+	switch source {
+	case "local (degraded)":
+		inv.Extraction = invoice.ExtractionLocal
+	case "embedded XML":
+		inv.Extraction = invoice.ExtractionEmbeddedXML
+	case "OpenAI (text layer)":
+		inv.Extraction = invoice.ExtractionText
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// fileStamp описывает состояние файла: по нему определяется, что файл дописан и что он уже обработан.
+type fileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{Size: info.Size(), ModTime: info.ModTime().UTC()}
+}
+
+// watchedFile — обработанный файл и его строки отчета.
+type watchedFile struct {
+	Path    string           `json:"path"`
+	Stamp   fileStamp        `json:"stamp"`
+	Results []invoice.Result `json:"results"`
+}
+
+// watchState — состояние режима -watch, сохраняемое рядом с отчетом, чтобы после перезапуска
+// не обрабатывать уже попавшие в отчет файлы.
+type watchState struct {
+	Files  []watchedFile         `json:"files"`
+	Dedup  invoice.Deduplication `json:"dedup"`
+	known  map[string]fileStamp
+	loaded string // Путь файла состояния
+}
+
+// watchStatePath возвращает путь файла состояния для отчета out.
+func watchStatePath(out string) string {
+	return out + ".watch.json"
+}
+
+// loadWatchState читает состояние; если файла нет, возвращает пустое состояние.
+func loadWatchState(path string) (*watchState, error) {
+	state := &watchState{loaded: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("corrupted watch state %s: %w", path, err)
+		}
+	}
+	state.known = make(map[string]fileStamp, len(state.Files))
+	for _, file := range state.Files {
+		state.known[file.Path] = file.Stamp
+	}
+	return state, nil
+}
+
+// save атомарно записывает состояние.
+func (s *watchState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.loaded + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.loaded)
+}
+
+// processed сообщает, что файл с тем же путем, размером и временем изменения уже есть в отчете.
+func (s *watchState) processed(path string, stamp fileStamp) bool {
+	known, ok := s.known[path]
+	return ok && known.Size == stamp.Size && known.ModTime.Equal(stamp.ModTime)
+}
+
+// add запоминает обработанный файл; строки измененного файла заменяют прежние.
+func (s *watchState) add(file watchedFile) {
+	s.known[file.Path] = file.Stamp
+	for i := range s.Files {
+		if s.Files[i].Path == file.Path {
+			s.Files[i] = file
+			return
+		}
+	}
+	s.Files = append(s.Files, file)
+}
+
+// results возвращает строки отчета всех обработанных файлов.
+func (s *watchState) results() []invoice.Result {
+	var results []invoice.Result
+	for _, file := range s.Files {
+		results = append(results, file.Results...)
+	}
+	return results
+}
+
+// addDedup добавляет итог дедупликации очередной порции файлов (см. mergeDeduplication).
+func (s *watchState) addDedup(dedup invoice.Deduplication) {
+	mergeDeduplication(&s.Dedup, dedup)
+}
+
+// mergeDeduplication добавляет к dst итог дедупликации очередной порции файлов. Контрагент, уже попавший
+// в отчет (тот же ID или наименование), повторно не добавляется.
+func mergeDeduplication(dst *invoice.Deduplication, dedup invoice.Deduplication) {
+	dst.MatchingUsage.Add(dedup.MatchingUsage)
+	dst.MatchingDuration += dedup.MatchingDuration
+	dst.Successful += dedup.Successful
+	dst.Failed += dedup.Failed
+	dst.NewCounterparties += dedup.NewCounterparties
+	dst.MatchedCounterparties += dedup.MatchedCounterparties
+	for _, ucp := range dedup.UniqueCounterparties {
+		duplicate := false
+		for i, listed := range dst.UniqueCounterparties {
+			if (ucp.Counterparty.ID != 0 && listed.Counterparty.ID == ucp.Counterparty.ID) || listed.Counterparty.MatchesName(ucp.Counterparty.Name) {
+				dst.UniqueCounterparties[i].Counterparty = ucp.Counterparty // Данные реестра свежее
+				if listed.AliasRule == "" {
+					dst.UniqueCounterparties[i].AliasRule = ucp.AliasRule
+				}
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			dst.UniqueCounterparties = append(dst.UniqueCounterparties, ucp)
+		}
+	}
+}
+
+// runWatch работает до SIGINT/SIGTERM: ищет в dir новые файлы инвойсов, обрабатывает файлы, размер и время
+// изменения которых не менялись между двумя проверками (файл дописан), и перезаписывает отчет со всеми
+// накопленными строками. Обработанные файлы запоминаются в <out>.watch.json. Перед выходом отчет
+// записывается еще раз.
+//
+// Изменения в dir отслеживаются через уведомления файловой системы (fsnotify): проверка выполняется через
+// interval после последнего события и повторяется, пока новые файлы дописываются. Если уведомления
+// недоступны (например, на сетевых дисках или при исчерпании лимита inotify), dir проверяется каждые interval.
+func runWatch(processor *invoice.Processor, reports reportOptions, dir string, recursive bool, mtime modTimeRange, interval time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+	config := reports.config
+
+	state, err := loadWatchState(watchStatePath(reports.out))
+	if err != nil {
+		log.Fatalf("FATAL: Could not load watch state: %v", err)
+	}
+	store := config.CounterpartyStore()
+	registry, err := invoice.LoadCounterpartyRegistry(store)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load counterparties db: %v", err)
+	}
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	var poll <-chan time.Time
+	watcher, err := watchDir(dir, recursive)
+	if err != nil {
+		log.Printf("WARN: File system notifications are unavailable (%v), checking %q every %v", err, dir, interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	} else {
+		defer watcher.Close()
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+	fmt.Printf("Watching %q for new invoice files (%d already in the report). Press Ctrl+C to stop.\n", dir, len(state.Files))
+
+	pending := make(map[string]fileStamp) // Новые файлы, которые еще могут дописываться
+	check := time.NewTimer(0)             // Первая проверка — сразу после запуска
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("\nStopping watch mode, writing the final report...")
+			runSummary, vatSummary, filteredOut, err := writeReports(reports, state.results(), state.Dedup, len(state.Files), time.Since(start))
+			if err != nil {
+				log.Fatalf("FATAL: %v", err)
+			}
+			printReportSummary(reports, runSummary, vatSummary, filteredOut)
+			return
+		case event := <-events:
+			if recursive && event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addWatchTree(watcher, event.Name); err != nil {
+						log.Printf("WARN: Could not watch %q: %v", event.Name, err)
+					}
+				}
+			}
+			check.Reset(interval) // Файл может еще дописываться: проверка после паузы в событиях
+			continue
+		case err := <-watchErrors:
+			// Переполнение очереди событий: часть изменений могла быть пропущена
+			log.Printf("WARN: File system notification error: %v", err)
+			check.Reset(interval)
+			continue
+		case <-poll:
+		case <-check.C:
+		}
+
+		ready := readyFiles(dir, recursive, mtime, state, pending)
+		retry := false // Часть файлов не обработана из-за недоступности OpenAI
+		if len(ready) > 0 {
+			processWatchedFiles(ctx, processor, config, dir, ready, state, registry)
+			if err := state.save(); err != nil {
+				log.Printf("WARN: Could not save watch state: %v", err)
+			}
+			if _, _, _, err := writeReports(reports, state.results(), state.Dedup, len(state.Files), time.Since(start)); err != nil {
+				log.Printf("ERROR: %v", err)
+			} else {
+				fmt.Printf("Report updated: %d files, %d invoices.\n", len(state.Files), state.Dedup.Successful)
+			}
+			for path, stamp := range ready {
+				retry = retry || !state.processed(path, stamp)
+			}
+		}
+		if watcher != nil && (len(pending) > 0 || retry) {
+			// Повторная проверка подтвердит, что новые файлы дописаны, и повторит отложенные
+			check.Reset(interval)
+		}
+	}
+}
+
+// watchDir подписывается на уведомления об изменениях в dir (и в поддиректориях, если recursive).
+func watchDir(dir string, recursive bool) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if recursive {
+		err = addWatchTree(watcher, dir)
+	} else {
+		err = watcher.Add(dir)
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// addWatchTree подписывает watcher на dir и все его поддиректории: fsnotify не следит за ними сам.
+func addWatchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil // Недоступная поддиректория не мешает следить за остальными
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return watcher.Add(path)
+	})
+}
+
+// readyFiles возвращает новые файлы, которые не изменились с прошлой проверки. Остальные новые
+// файлы запоминаются в pending до следующей проверки. Файлы, измененные вне mtime, пропускаются.
+func readyFiles(dir string, recursive bool, mtime modTimeRange, state *watchState, pending map[string]fileStamp) map[string]fileStamp {
+	files, err := report.FindInvoiceFiles(dir, report.FindOptions{Recursive: recursive})
+	if err != nil {
+		log.Printf("WARN: Error scanning for files: %v", err)
+		return nil
+	}
+	ready := make(map[string]fileStamp)
+	seen := make(map[string]bool, len(files))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // Файл удален между поиском и проверкой
+		}
+		if !mtime.contains(info.ModTime()) {
+			continue
+		}
+		seen[path] = true
+		stamp := stampOf(info)
+		if state.processed(path, stamp) {
+			continue
+		}
+		if previous, ok := pending[path]; ok && previous == stamp {
+			ready[path] = stamp
+			delete(pending, path)
+			continue
+		}
+		pending[path] = stamp
+	}
+	for path := range pending {
+		if !seen[path] {
+			delete(pending, path)
+		}
+	}
+	return ready
+}
+
+// processWatchedFiles обрабатывает готовые файлы, сопоставляет их контрагентов с реестром и добавляет
+// результат в state. Файлы, обработка которых прервана остановкой или недоступностью OpenAI, не запоминаются
+// и будут обработаны повторно.
+func processWatchedFiles(ctx context.Context, processor *invoice.Processor, config *invoice.Config, dir string, ready map[string]fileStamp, state *watchState, registry *invoice.CounterpartyRegistry) {
+	paths := make([]string, 0, len(ready))
+	for path := range ready {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	fmt.Printf("Processing %d new files...\n", len(paths))
+	var batch []invoice.Result
+	var files []watchedFile
+	for fr := range processor.ProcessBatch(ctx, paths) {
+		if ctx.Err() != nil && fr.Err != nil {
+			continue
+		}
+		name := invoice.SourceName(dir, fr.Path)
+		if invoice.IsUnavailableError(fr.Err) || invoice.IsRateLimitError(fr.Err) {
+			fmt.Printf("- %s: %v (will retry)\n", name, fr.Err)
+			continue
+		}
+		if fr.Err != nil {
+			fmt.Printf("- %s: %v (%v)\n", name, fr.Err, fr.Duration.Round(time.Millisecond))
+		} else {
+			fmt.Printf("- %s: %d invoices (%v)\n", name, len(fr.Invoices), fr.Duration.Round(time.Millisecond))
+		}
+		// Строки файла и пакета ссылаются на одни инвойсы, поэтому дедупликация обновит и те, и другие
+		results := fr.Results(name)
+		batch = append(batch, results...)
+		files = append(files, watchedFile{Path: fr.Path, Stamp: ready[fr.Path], Results: results})
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	dedup := processor.Deduplicate(context.Background(), batch, registry)
+	for _, warning := range dedup.Warnings {
+		log.Printf("WARN: %s", warning)
+	}
+	if store := config.CounterpartyStore(); store != nil {
+		if err := store.Save(registry.Counterparties); err != nil {
+			log.Printf("WARN: Could not save counterparties db: %v", err)
+		}
+	}
+	state.addDedup(dedup)
+	for _, file := range files {
+		state.add(file)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatchDirRecursive проверяет, что watchDir сообщает о файлах во вложенных директориях.
+func TestWatchDirRecursive(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "2024", "03")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := watchDir(dir, true)
+	if err != nil {
+		t.Skipf("file system notifications are unavailable: %v", err)
+	}
+	defer watcher.Close()
+
+	path := filepath.Join(sub, "invoice.pdf")
+	if err := os.WriteFile(path, []byte("%PDF-1.4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Name == path {
+				return
+			}
+		case err := <-watcher.Errors:
+			t.Fatalf("watcher error: %v", err)
+		case <-timeout:
+			t.Fatalf("no event for %s", path)
+		}
+	}
+}
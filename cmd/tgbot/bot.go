@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veryevilzed/invpa/archive"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// pollTimeout — время ожидания сообщений в одном запросе getUpdates.
+const pollTimeout = 50 * time.Second
+
+// helpText — ответ на /start, /help и сообщения, которые бот не умеет обрабатывать.
+var helpText = "Send me an invoice or a receipt and I will read it: a photo, or a file (" +
+	strings.Join(invoice.SupportedExtensions, ", ") + ").\n" +
+	"Photos are compressed by Telegram, so send a small print or a long receipt as a file for better results.\n" +
+	"I reply with the counterparty, number, date, total and purpose, and attach the extracted data as JSON."
+
+// bot обрабатывает сообщения разрешенных пользователей: каждый присланный файл извлекается
+// отдельно, а результат дописывается в общие с reporter и web хранилища.
+type bot struct {
+	api       *botClient
+	processor *invoice.Processor
+	config    *invoice.Config
+	allowed   map[int64]bool
+	mu        sync.Mutex // Сериализует запись в базу контрагентов, telegram_store и архив
+	wg        sync.WaitGroup
+}
+
+func newBot(api *botClient, processor *invoice.Processor, config *invoice.Config) *bot {
+	allowed := make(map[int64]bool, len(config.TelegramUsers))
+	for _, id := range config.TelegramUsers {
+		allowed[id] = true
+	}
+	return &bot{api: api, processor: processor, config: config, allowed: allowed}
+}
+
+// run получает сообщения до отмены ctx. Каждое сообщение обрабатывается в своей горутине;
+// после отмены run дожидается ответов на уже принятые файлы.
+func (b *bot) run(ctx context.Context) {
+	// Принятые файлы дообрабатываются и после остановки, чтобы пользователь получил ответ
+	work := context.WithoutCancel(ctx)
+	var offset int64
+	for ctx.Err() == nil {
+		updates, err := b.api.getUpdates(ctx, offset, pollTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			wait := 5 * time.Second
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				if apiErr.RetryAfter > 0 {
+					wait = apiErr.RetryAfter
+				}
+				if apiErr.Code == 409 {
+					log.Printf("WARN: Another instance of the bot or a webhook is receiving updates: %v", err)
+				}
+			}
+			log.Printf("WARN: Could not get updates: %v (retrying in %v)", err, wait)
+			sleep(ctx, wait)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil {
+				continue
+			}
+			b.wg.Add(1)
+			go func(msg *message) {
+				defer b.wg.Done()
+				b.handle(work, msg)
+			}(u.Message)
+		}
+	}
+	b.wg.Wait()
+}
+
+// sleep ждет d или отмены ctx.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// incoming — файл инвойса из сообщения.
+type incoming struct {
+	fileID string
+	name   string // Имя файла с поддерживаемым расширением
+	size   int64  // 0, если Telegram не сообщил размер
+}
+
+// incomingFile извлекает из сообщения файл инвойса. Если файла нет или его тип не поддерживается,
+// возвращает ответ для пользователя.
+func incomingFile(msg *message) (incoming, string) {
+	switch {
+	case len(msg.Photo) > 0:
+		photo := msg.Photo[len(msg.Photo)-1] // Самый большой размер
+		return incoming{fileID: photo.FileID, name: fmt.Sprintf("photo_%d.jpg", msg.MessageID), size: photo.FileSize}, ""
+	case msg.Document != nil:
+		doc := msg.Document
+		name := documentName(doc, msg.MessageID)
+		if name == "" {
+			kind := doc.MimeType
+			if ext := filepath.Ext(doc.FileName); ext != "" {
+				kind = ext
+			}
+			return incoming{}, fmt.Sprintf("I can't read %s files. Send a photo or a file of one of these types: %s.", kind, strings.Join(invoice.SupportedExtensions, ", "))
+		}
+		return incoming{fileID: doc.FileID, name: name, size: doc.FileSize}, ""
+	case strings.HasPrefix(msg.Text, "/start"), strings.HasPrefix(msg.Text, "/help"):
+		return incoming{}, helpText
+	case msg.Text != "":
+		return incoming{}, "I only read invoices, not text messages.\n\n" + helpText
+	}
+	return incoming{}, "I can't read this kind of message.\n\n" + helpText
+}
+
+// documentName возвращает безопасное имя документа с поддерживаемым расширением. Расширение
+// берется из имени файла, а если его нет — из MIME-типа. Пустая строка — тип не поддерживается.
+func documentName(doc *document, messageID int64) string {
+	name := filepath.Base(archive.SafeName(doc.FileName))
+	if name == "." || name == "/" || name == "" {
+		name = fmt.Sprintf("document_%d", messageID)
+	}
+	if invoice.IsSupportedFile(name) {
+		return name
+	}
+	if filepath.Ext(name) != "" {
+		return ""
+	}
+	for _, ext := range invoice.SupportedExtensions {
+		if contentType := invoice.ContentType(ext); contentType != "" && strings.EqualFold(contentType, doc.MimeType) {
+			return name + ext
+		}
+	}
+	return ""
+}
+
+// handle отвечает на одно сообщение.
+func (b *bot) handle(ctx context.Context, msg *message) {
+	if msg.From == nil {
+		return // Сообщения каналов и анонимных администраторов
+	}
+	if !b.allowed[msg.From.ID] {
+		log.Printf("Rejected message from Telegram user %d (@%s): not in telegram_allowed_users", msg.From.ID, msg.From.Username)
+		b.reply(ctx, msg, fmt.Sprintf("Sorry, you are not allowed to use this bot. Ask the administrator to add your Telegram user ID %d to telegram_allowed_users.", msg.From.ID))
+		return
+	}
+	in, answer := incomingFile(msg)
+	if answer != "" {
+		b.reply(ctx, msg, answer)
+		return
+	}
+	if in.size > maxDownloadBytes {
+		b.reply(ctx, msg, fmt.Sprintf("%s is too large: bots can only download files up to %d MB.", in.name, maxDownloadBytes>>20))
+		return
+	}
+
+	jobID := fmt.Sprintf("telegram-%d-%d", msg.Chat.ID, msg.MessageID)
+	log.Printf("%s: processing %s from user %d", jobID, in.name, msg.From.ID)
+	results, err := b.process(ctx, jobID, in)
+	if err != nil {
+		log.Printf("ERROR: %s: %v", jobID, err)
+		b.reply(ctx, msg, fmt.Sprintf("Could not process %s: %v. Please send it again.", in.name, err))
+		return
+	}
+	b.reply(ctx, msg, formatResults(in.name, results))
+	if data := exportJSON(results); data != nil {
+		name := strings.TrimSuffix(in.name, filepath.Ext(in.name)) + ".json"
+		if err := b.api.sendDocument(ctx, msg.Chat.ID, msg.MessageID, name, data); err != nil {
+			log.Printf("WARN: %s: could not send JSON: %v", jobID, err)
+		}
+	}
+}
+
+// reply отвечает на сообщение; ошибки отправки только логируются.
+func (b *bot) reply(ctx context.Context, msg *message, text string) {
+	if err := b.api.sendMessage(ctx, msg.Chat.ID, msg.MessageID, text); err != nil {
+		log.Printf("WARN: Could not reply to chat %d: %v", msg.Chat.ID, err)
+	}
+}
+
+// process скачивает файл, извлекает инвойсы и записывает результат в хранилища. Ошибка возвращается,
+// только если файл не удалось получить; ошибки извлечения входят в результаты.
+func (b *bot) process(ctx context.Context, jobID string, in incoming) ([]invoice.Result, error) {
+	data, err := b.api.download(ctx, in.fileID)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	if len(data) > maxDownloadBytes {
+		return nil, fmt.Errorf("file is larger than %d MB", maxDownloadBytes>>20)
+	}
+	dir, err := os.MkdirTemp("", "invpa-tgbot-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, in.name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+
+	invoices, usage, err := b.processor.ProcessFile(ctx, path)
+	fr := invoice.FileResult{Path: path, Invoices: invoices, Usage: usage, Err: err}
+	// Имя с идентификатором сообщения различает одноименные файлы разных пользователей в общих хранилищах
+	return b.store(ctx, jobID, jobID+"/"+in.name, fr), nil
+}
+
+// store сопоставляет контрагентов файла с базой (counterparties_db), сохраняет пополненную базу,
+// дописывает инвойсы в telegram_store и архивирует файл (archive_path). База перечитывается
+// для каждого файла: ее пополняют и другие инструменты. Ошибки хранилищ только логируются.
+func (b *bot) store(ctx context.Context, jobID, name string, fr invoice.FileResult) []invoice.Result {
+	results := fr.Results(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	store := b.config.CounterpartyStore()
+	if registry, err := invoice.LoadCounterpartyRegistry(store); err != nil {
+		log.Printf("WARN: %s: could not load counterparties db, counterparties are not matched: %v", jobID, err)
+	} else {
+		dedup := b.processor.Deduplicate(ctx, results, registry)
+		for _, warning := range dedup.Warnings {
+			log.Printf("WARN: %s: %s", jobID, warning)
+		}
+		if store != nil {
+			if err := store.Save(registry.Counterparties); err != nil {
+				log.Printf("WARN: %s: could not save counterparties db: %v", jobID, err)
+			}
+		}
+	}
+	if err := appendJSONL(b.config.TelegramStorePath(), results); err != nil {
+		log.Printf("WARN: %s: could not append to %s: %v", jobID, b.config.TelegramStorePath(), err)
+	}
+	if b.config.ArchivePath != "" {
+		if arch, err := invoice.OpenArchive(b.config.ArchivePath); err != nil {
+			log.Printf("WARN: %s: could not open archive: %v", jobID, err)
+		} else if err := arch.Store(jobID, name, fr); err != nil {
+			log.Printf("WARN: %s: could not archive %s: %v", jobID, name, err)
+		}
+	}
+	return results
+}
+
+// appendJSONL дописывает инвойсы результатов в path в формате JSON Lines (invoice.WriteJSONL),
+// том же, что reporter -format jsonl.
+func appendJSONL(path string, results []invoice.Result) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := invoice.WriteJSONL(file, results); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// formatResults возвращает ответ с кратким содержанием инвойсов файла или ошибкой обработки.
+func formatResults(name string, results []invoice.Result) string {
+	var sb strings.Builder
+	for i, res := range results {
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+		if res.ErrorMessage != "" {
+			fmt.Fprintf(&sb, "Could not read an invoice from %s: %s", name, res.ErrorMessage)
+			if action := invoice.ErrorAction(res.ErrorCode); action != "" {
+				fmt.Fprintf(&sb, "\n%s", action)
+			}
+			continue
+		}
+		if res.IsSkipped() {
+			fmt.Fprintf(&sb, "Document %d of %d in %s skipped: %s", res.InvoiceIndex, res.InvoiceCount, name, res.Skipped)
+			continue
+		}
+		inv := res.Invoice
+		if res.InvoiceCount > 1 {
+			fmt.Fprintf(&sb, "Invoice %d of %d in %s\n", res.InvoiceIndex, res.InvoiceCount, name)
+		} else {
+			fmt.Fprintf(&sb, "Invoice in %s\n", name)
+		}
+		counterparty := inv.Counterparty.Name
+		if inv.Counterparty.VAT != "" {
+			counterparty += " (VAT " + inv.Counterparty.VAT + ")"
+		}
+		fmt.Fprintf(&sb, "Counterparty: %s\n", counterparty)
+		fmt.Fprintf(&sb, "Number: %s\n", inv.Number)
+		fmt.Fprintf(&sb, "Date: %s\n", inv.Date)
+		fmt.Fprintf(&sb, "Total: %.2f %s", inv.TotalAmount, inv.Currency)
+		if inv.TaxAmount != 0 {
+			fmt.Fprintf(&sb, " (tax %.2f)", inv.TaxAmount)
+		}
+		fmt.Fprintf(&sb, "\nPurpose: %s", inv.Purpose)
+		if res.IsDuplicate() {
+			fmt.Fprintf(&sb, "\nDuplicate of %s", res.DuplicateOf)
+		}
+		if len(res.Warnings) > 0 {
+			fmt.Fprintf(&sb, "\nPlease check: %s", invoice.FormatIssues(res.Warnings))
+		}
+	}
+	return sb.String()
+}
+
+// exportJSON возвращает инвойсы результатов в виде JSON-массива записей invoice.ExportRecord
+// или nil, если инвойсов нет.
+func exportJSON(results []invoice.Result) []byte {
+	var records []invoice.ExportRecord
+	for _, res := range results {
+		if record, ok := invoice.NewExportRecord(res); ok {
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+func main() {
+	configFlag := flag.String("config", "config.json", "Path to the config file")
+	flag.Parse()
+
+	config, err := report.LoadConfig(*configFlag)
+	if err != nil {
+		log.Fatalf("FATAL: Could not load %s. Make sure it exists and is configured. Error: %v", *configFlag, err)
+	}
+	if err := errors.Join(config.Validate(), config.ValidateTelegram()); err != nil {
+		log.Fatalf("FATAL: Invalid %s:\n%v", *configFlag, err)
+	}
+	processor, err := newProcessor(config)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	api := newBotClient(config.TelegramToken)
+	checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	username, err := api.getMe(checkCtx)
+	cancel()
+	if err != nil {
+		log.Fatalf("FATAL: Could not connect to Telegram, check 'telegram_bot_token': %v", err)
+	}
+	fmt.Printf("Bot @%s is running for %d users, invoices are appended to '%s'. Press Ctrl+C to stop.\n", username, len(config.TelegramUsers), config.TelegramStorePath())
+	newBot(api, processor, config).run(ctx)
+	fmt.Println("Bot stopped.")
+}
+
+// newProcessor создает процессор с настройками config.json. Бот обрабатывает по одному файлу
+// на сообщение, поэтому параллелизм ограничивают только лимиты запросов к OpenAI.
+func newProcessor(config *invoice.Config) (*invoice.Processor, error) {
+	client, err := invoice.NewClient(config.ClientConfig())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OpenAI settings in config.json: %v", err)
+	}
+	roundingPolicy, err := invoice.ParseRoundingPolicy(config.RoundingPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'rounding_policy' in config.json: %v", err)
+	}
+	pageSelection, err := invoice.ParsePageSelection(config.PageSelection)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'page_selection' in config.json: %v", err)
+	}
+	extractionMode, err := invoice.ParseExtractionMode(config.ExtractionMode)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'extraction_mode' in config.json: %v", err)
+	}
+	renderOptions, err := config.RenderOptions()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PDF settings in config.json: %v", err)
+	}
+	promptTemplates, err := config.PromptTemplates()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid prompt templates in config.json: %v", err)
+	}
+	aliasOverrides, err := config.AliasOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'counterparty_aliases' in config.json: %v", err)
+	}
+	requestTimeout, err := config.RequestTimeoutLimit()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'request_timeout' in config.json: %v", err)
+	}
+	fileTimeout, err := config.FileTimeoutLimit()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'file_timeout' in config.json: %v", err)
+	}
+	var cache *invoice.ResultCache
+	if config.ResultCache {
+		if cache, err = invoice.NewResultCache(config.ResultCachePath); err != nil {
+			return nil, fmt.Errorf("Could not open result cache: %v", err)
+		}
+	}
+	options := []invoice.Option{
+		invoice.WithPageRenderer(invoice.PDFRenderer(renderOptions)),
+		invoice.WithMyCompany(config.MyCompany),
+		invoice.WithRoundingPolicy(roundingPolicy),
+		invoice.WithPageSelection(pageSelection),
+		invoice.WithMaxAllPages(config.MaxAllPagesLimit()),
+		invoice.WithCache(cache),
+		invoice.WithDuplexRotation(config.DuplexRotation),
+		invoice.WithTextExtractor(invoice.PDFTextExtractor(renderOptions)),
+		invoice.WithExtractionMode(extractionMode),
+		invoice.WithCategories(config.Categories),
+		invoice.WithPromptTemplates(promptTemplates),
+		invoice.WithAliasOverrides(aliasOverrides),
+		invoice.WithRequestTimeout(requestTimeout),
+		invoice.WithFileTimeout(fileTimeout),
+		invoice.WithAttachmentExtractor(invoice.PDFAttachmentExtractor(renderOptions)),
+		invoice.WithDegradedMode(config.DegradedMode, config.DegradedAfter),
+		invoice.WithCurrencyAutoCorrect(config.CurrencyAutoCorrect),
+		invoice.WithRateLimiter(invoice.NewRequestLimiter(config.RequestsPerMinute, config.ConcurrentRequests)),
+		invoice.WithJSONRepair(config.RepairAttempts()),
+		invoice.WithModel(config.ModelName()),
+	}
+	return invoice.NewProcessor(client, options...), nil
+}
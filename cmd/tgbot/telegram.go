@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// telegramAPI — адрес Bot API. Используются только long polling и методы, нужные боту,
+// поэтому отдельная библиотека не требуется.
+const telegramAPI = "https://api.telegram.org"
+
+// maxDownloadBytes — лимит Bot API на скачивание файлов ботом (getFile).
+const maxDownloadBytes = 20 << 20
+
+// botClient — клиент Telegram Bot API.
+type botClient struct {
+	token   string
+	baseURL string
+	http    *http.Client
+}
+
+func newBotClient(token string) *botClient {
+	return &botClient{token: token, baseURL: telegramAPI, http: &http.Client{}}
+}
+
+// update — входящее обновление; бот запрашивает только сообщения.
+type update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+type message struct {
+	MessageID int64       `json:"message_id"`
+	From      *user       `json:"from"`
+	Chat      chat        `json:"chat"`
+	Text      string      `json:"text"`
+	Caption   string      `json:"caption"`
+	Photo     []photoSize `json:"photo"` // Размеры одной фотографии от меньшего к большему
+	Document  *document   `json:"document"`
+}
+
+type user struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type chat struct {
+	ID int64 `json:"id"`
+}
+
+type photoSize struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size"`
+}
+
+type document struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+}
+
+type file struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size"`
+	FilePath string `json:"file_path"`
+}
+
+// apiResponse — конверт ответа Bot API.
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// apiError — ошибка, которую вернул Bot API.
+type apiError struct {
+	Method      string
+	Code        int
+	Description string
+	RetryAfter  time.Duration // Для 429: через сколько можно повторить запрос
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("telegram %s: %d %s", e.Method, e.Code, e.Description)
+}
+
+// call вызывает метод Bot API с JSON-телом params и разбирает результат в result.
+func (c *botClient) call(ctx context.Context, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.methodURL(method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, method, result)
+}
+
+// do выполняет запрос к Bot API и разбирает результат в result.
+func (c *botClient) do(req *http.Request, method string, result any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("telegram %s: %w", method, withoutURL(err))
+	}
+	defer resp.Body.Close()
+	var envelope apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: invalid response (HTTP %d): %w", method, resp.StatusCode, err)
+	}
+	if !envelope.OK {
+		return &apiError{
+			Method:      method,
+			Code:        envelope.ErrorCode,
+			Description: envelope.Description,
+			RetryAfter:  time.Duration(envelope.Parameters.RetryAfter) * time.Second,
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// withoutURL убирает из ошибки транспорта адрес запроса, содержащий токен бота.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+func (c *botClient) methodURL(method string) string {
+	return c.baseURL + "/bot" + c.token + "/" + method
+}
+
+// getMe возвращает имя пользователя бота; при неверном токене Bot API отвечает 401.
+func (c *botClient) getMe(ctx context.Context) (string, error) {
+	var me user
+	err := c.call(ctx, "getMe", struct{}{}, &me)
+	return me.Username, err
+}
+
+// getUpdates ждет новые сообщения до timeout (long polling) и возвращает обновления начиная с offset.
+func (c *botClient) getUpdates(ctx context.Context, offset int64, timeout time.Duration) ([]update, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout+10*time.Second)
+	defer cancel()
+	params := map[string]any{
+		"offset":          offset,
+		"timeout":         int(timeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}
+	var updates []update
+	err := c.call(ctx, "getUpdates", params, &updates)
+	return updates, err
+}
+
+// download скачивает файл по file_id. Файлы больше maxDownloadBytes Bot API не отдает.
+func (c *botClient) download(ctx context.Context, fileID string) ([]byte, error) {
+	var f file
+	if err := c.call(ctx, "getFile", map[string]string{"file_id": fileID}, &f); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/file/bot"+c.token+"/"+f.FilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("telegram download: %w", withoutURL(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("telegram download: HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDownloadBytes+1))
+}
+
+// sendMessage отправляет текст в чат ответом на сообщение replyTo (0 — без ответа).
+func (c *botClient) sendMessage(ctx context.Context, chatID, replyTo int64, text string) error {
+	params := map[string]any{"chat_id": chatID, "text": text}
+	if replyTo != 0 {
+		params["reply_to_message_id"] = replyTo
+		params["allow_sending_without_reply"] = true
+	}
+	return c.call(ctx, "sendMessage", params, nil)
+}
+
+// sendDocument отправляет файл name с содержимым data в чат ответом на сообщение replyTo.
+func (c *botClient) sendDocument(ctx context.Context, chatID, replyTo int64, name string, data []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	if replyTo != 0 {
+		w.WriteField("reply_to_message_id", strconv.FormatInt(replyTo, 10))
+		w.WriteField("allow_sending_without_reply", "true")
+	}
+	part, err := w.CreateFormFile("document", name)
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.methodURL("sendDocument"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return c.do(req, "sendDocument", nil)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/veryevilzed/invpa/api"
+)
+
+// deprecatedPaths maps the API paths served before the /api/v1 prefix to their current paths.
+var deprecatedPaths = []struct{ old, current string }{
+	{"/upload", api.PathPrefix + "/upload"},
+	{"/status/", api.PathPrefix + "/status/"},
+	{"/cancel/", api.PathPrefix + "/cancel/"},
+	{"/api/results/", api.PathPrefix + "/results/"},
+	{"/export/vat/", api.PathPrefix + "/export/vat/"},
+	{"/api/jobs", api.PathPrefix + "/jobs"},
+	{"/api/jobs/", api.PathPrefix + "/jobs/"},
+}
+
+// apiRoute is a pattern of the JSON API and its handler.
+type apiRoute struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// apiRoutes lists the patterns of the JSON API. Patterns ending in a slash take the rest of the path
+// (job IDs and sub-resources), which their handlers parse.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{api.PathPrefix + "/upload", handleUpload},
+		{api.PathPrefix + "/status/", handleStatus},
+		{api.PathPrefix + "/cancel/", handleCancel},
+		{api.PathPrefix + "/results/", handleJobResultData},
+		{api.PathPrefix + "/export/vat/", handleVATExport},
+		{api.PathPrefix + "/extract", handleExtract},
+		{api.PathPrefix + "/inspect", handleInspect},
+		{api.PathPrefix + "/jobs", handleJobs},
+		{api.PathPrefix + "/jobs/", handleJobs},
+		{api.OpenAPIPath, handleOpenAPI},
+	}
+}
+
+// registerAPI registers the JSON API under api.PathPrefix and the deprecated aliases of its old paths.
+func registerAPI(mux *http.ServeMux) {
+	for _, route := range apiRoutes() {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	for _, alias := range deprecatedPaths {
+		mux.HandleFunc(alias.old, deprecatedAlias(mux, alias.old, alias.current))
+	}
+}
+
+// deprecatedAlias serves an old API path by the handler of its current path. The response carries the
+// Deprecation header and a Link to the current path, so clients can find out that they should move.
+func deprecatedAlias(mux *http.ServeMux, old, current string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := current + strings.TrimPrefix(r.URL.Path, old)
+		w.Header().Set(api.DeprecationHeader, "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+		forwarded := r.Clone(r.Context())
+		forwarded.URL.Path, forwarded.URL.RawPath = path, ""
+		mux.ServeHTTP(w, forwarded)
+	}
+}
+
+// negotiateJSON answers 406 unless the Accept header of the request allows a JSON response.
+// A request without Accept takes anything.
+func negotiateJSON(w http.ResponseWriter, r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	jsonError(w, fmt.Sprintf("Cannot respond with %q, the API responds with application/json", accept), http.StatusNotAcceptable)
+	return false
+}
+
+// requireJSONBody answers 415 if the request body is declared as something other than JSON.
+// A body without Content-Type is read as JSON, as before.
+func requireJSONBody(w http.ResponseWriter, r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/json" {
+		return true
+	}
+	jsonError(w, fmt.Sprintf("Unsupported Content-Type %q, expected application/json", contentType), http.StatusUnsupportedMediaType)
+	return false
+}
+
+// openAPIDocument is built once: it depends only on the API types.
+var openAPIDocument = sync.OnceValues(func() ([]byte, error) {
+	return json.Marshal(api.OpenAPI())
+})
+
+// handleOpenAPI serves the OpenAPI 3 description of the API (GET /api/v1/openapi.json).
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !negotiateJSON(w, r) {
+		return
+	}
+	doc, err := openAPIDocument()
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/veryevilzed/invpa/api"
+)
+
+// openAPIPathParams holds a value for every path parameter of the OpenAPI document that exists in the
+// job added by addCompletedJob, so that a 404 can only come from a missing route.
+var openAPIPathParams = map[string]string{"jobID": "job-1", "id": "r1", "index": "0", "tag": "march"}
+
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// documentedPath substitutes the path parameters of an OpenAPI path.
+func documentedPath(t *testing.T, path string) string {
+	return pathParam.ReplaceAllStringFunc(path, func(param string) string {
+		value, ok := openAPIPathParams[strings.Trim(param, "{}")]
+		if !ok {
+			t.Fatalf("no test value for the parameter %s of %s", param, path)
+		}
+		return value
+	})
+}
+
+// TestOpenAPIMatchesRoutes fails when a documented path is not served by registerAPI or a registered
+// route is not documented.
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAPI(mux)
+
+	served := make(map[string]bool)
+	for path := range api.OpenAPI().Paths {
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, documentedPath(t, path), nil))
+		if !slices.ContainsFunc(apiRoutes(), func(route apiRoute) bool { return route.pattern == pattern }) {
+			t.Errorf("documented path %s is served by %q, not by an API route", path, pattern)
+		}
+		served[pattern] = true
+	}
+	for _, route := range apiRoutes() {
+		if !served[route.pattern] {
+			t.Errorf("route %s is not in the OpenAPI document", route.pattern)
+		}
+	}
+	for _, alias := range deprecatedPaths {
+		if !served[alias.current] {
+			t.Errorf("deprecated path %s points to %s, which is not in the OpenAPI document", alias.old, alias.current)
+		}
+	}
+}
+
+// TestOpenAPIOperationsAreHandled sends every documented operation to the server and fails when a handler
+// does not know its path or method; the same request through a deprecated alias must get the same answer.
+func TestOpenAPIOperationsAreHandled(t *testing.T) {
+	for path, methods := range api.OpenAPI().Paths {
+		for method := range methods {
+			method = strings.ToUpper(method)
+			t.Run(method+" "+path, func(t *testing.T) {
+				target := documentedPath(t, path)
+				code := serveDocumented(t, method, target).Code
+				if code == http.StatusNotFound || code == http.StatusMethodNotAllowed {
+					t.Fatalf("%s %s responded %d", method, target, code)
+				}
+
+				for _, alias := range deprecatedPaths {
+					rest, ok := strings.CutPrefix(target, alias.current)
+					if !ok || (rest != "" && !strings.HasSuffix(alias.current, "/")) {
+						continue
+					}
+					old := alias.old + rest
+					w := serveDocumented(t, method, old)
+					if w.Code != code || w.Header().Get(api.DeprecationHeader) != "true" {
+						t.Errorf("%s %s responded %d, Deprecation %q, want %d as %s and the Deprecation header",
+							method, old, w.Code, w.Header().Get(api.DeprecationHeader), code, target)
+					}
+				}
+			})
+		}
+	}
+}
+
+// serveDocumented serves a request against a fresh completed job, so operations that change
+// or delete the job do not affect each other.
+func serveDocumented(t *testing.T, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	useTestDir(t, `{}`)
+	addCompletedJob(t, "job-1", testResults(2))
+	jobs.Update("job-1", func(job *Job) { job.Tags = []string{"march"} })
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
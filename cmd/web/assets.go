@@ -0,0 +1,67 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The templates and static files are embedded, so the server does not depend on the source tree
+// and runs from any working directory. config.json, temp/ and public/ stay relative to the working directory.
+//
+//go:embed templates/*.html static
+var embeddedAssets embed.FS
+
+var (
+	// assetsFS holds the templates/ and static/ directories of the UI.
+	assetsFS fs.FS = embeddedAssets
+	// reloadAssets re-parses the templates on every page, so edits in the -assets directory show up without a restart.
+	reloadAssets bool
+	templates    *template.Template
+)
+
+// loadAssets parses the templates. With dir set the templates and static files are read from that directory
+// (normally cmd/web of the source tree) instead of the embedded copies.
+func loadAssets(dir string) error {
+	if dir != "" {
+		for _, sub := range []string{"templates", "static"} {
+			if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+				return fmt.Errorf("%s has no %s directory", dir, sub)
+			}
+		}
+		assetsFS, reloadAssets = os.DirFS(dir), true
+	}
+	var err error
+	templates, err = parseTemplates()
+	return err
+}
+
+func parseTemplates() (*template.Template, error) {
+	return template.ParseFS(assetsFS, "templates/*.html")
+}
+
+// executeTemplate renders the named page template.
+func executeTemplate(w io.Writer, name string, data any) error {
+	t := templates
+	if reloadAssets {
+		var err error
+		if t, err = parseTemplates(); err != nil {
+			return err
+		}
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// staticHandler serves /static/ from the static directory of the assets.
+func staticHandler() (http.Handler, error) {
+	root, err := fs.Sub(assetsFS, "static")
+	if err != nil {
+		return nil, err
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(root))), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// authRealm is the realm of the basic auth challenge.
+const authRealm = "invpa"
+
+// authConfig holds the optional credentials protecting the server. Without any of them
+// every request is allowed, as before authentication existed.
+type authConfig struct {
+	username, password string // HTTP basic auth
+	apiKey             string // Bearer token or X-API-Key header
+}
+
+// loadAuthConfig reads the credentials from config.json; the INVPA_WEB_USERNAME, INVPA_WEB_PASSWORD and
+// INVPA_WEB_API_KEY environment variables take precedence.
+func loadAuthConfig(config *invoice.Config) (authConfig, error) {
+	auth := authConfig{username: config.WebUsername, password: config.WebPassword, apiKey: config.WebAPIKey}
+	for _, env := range []struct {
+		name  string
+		value *string
+	}{
+		{"INVPA_WEB_USERNAME", &auth.username},
+		{"INVPA_WEB_PASSWORD", &auth.password},
+		{"INVPA_WEB_API_KEY", &auth.apiKey},
+	} {
+		if value := os.Getenv(env.name); value != "" {
+			*env.value = value
+		}
+	}
+	if (auth.username == "") != (auth.password == "") {
+		return auth, errors.New("web_username and web_password must be set together")
+	}
+	return auth, nil
+}
+
+func (a authConfig) enabled() bool {
+	return a.username != "" || a.apiKey != ""
+}
+
+// authorized reports whether the request carries valid credentials: the API key as a bearer token or
+// in X-API-Key, or basic auth with the configured user. When only an API key is configured, basic auth
+// with the API key as password is accepted too, so the browser pages keep working.
+func (a authConfig) authorized(r *http.Request) bool {
+	if a.apiKey != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, a.apiKey) {
+			return true
+		}
+		if secureEqual(r.Header.Get("X-API-Key"), a.apiKey) {
+			return true
+		}
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if a.username != "" {
+		// Both are compared to not reveal which one is wrong through timing
+		userOK := secureEqual(username, a.username)
+		return secureEqual(password, a.password) && userOK
+	}
+	return secureEqual(password, a.apiKey)
+}
+
+func secureEqual(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// isAPIPath reports whether unauthorized requests to path get a JSON error rather than a login prompt.
+func isAPIPath(path string) bool {
+	for _, prefix := range []string{"/upload", "/status/", "/cancel/", "/export/", "/api/", "/public/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAuth protects every route except /static/ and the /readyz probe when authentication is configured.
+func (a authConfig) requireAuth(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/readyz" || a.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isAPIPath(r.URL.Path) {
+			jsonError(w, "Unauthorized: provide the API key as a bearer token or in X-API-Key, or use basic auth", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
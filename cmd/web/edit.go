@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// maxEditSize limits the body of a result edit
+const maxEditSize = 1 << 20
+
+// reportLocks holds the report lock of each job, see lockReports
+var reportLocks sync.Map // job ID -> *reportLock
+
+// reportLock serializes the changes of one job that rewrite its results or reports: edits, merges,
+// label changes and regeneration. It remembers how long the last holder took, to tell a client
+// that finds it held when to retry.
+type reportLock struct {
+	mu      sync.Mutex
+	started atomic.Int64 // Unix nanoseconds when the current holder took the lock
+	last    atomic.Int64 // Duration of the last holder
+}
+
+// lockReports takes the report lock of the job without waiting. When another request holds it,
+// lockReports responds 409 with a Retry-After estimate and returns ok false; otherwise the caller
+// must call unlock.
+func lockReports(w http.ResponseWriter, jobID string) (unlock func(), ok bool) {
+	unlock, retry, ok := tryLockReports(jobID)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		jsonError(w, fmt.Sprintf("The reports of the job are being updated by another request, retry in %d s", retry), http.StatusConflict)
+		return nil, false
+	}
+	return unlock, true
+}
+
+// tryLockReports takes the report lock of the job without waiting. When the lock is held, it returns
+// ok false and the Retry-After estimate in seconds.
+func tryLockReports(jobID string) (unlock func(), retryAfter int, ok bool) {
+	value, _ := reportLocks.LoadOrStore(jobID, &reportLock{})
+	l := value.(*reportLock)
+	if !l.mu.TryLock() {
+		return nil, l.retryAfter(time.Now()), false
+	}
+	start := time.Now()
+	l.started.Store(start.UnixNano())
+	return func() {
+		l.last.Store(int64(time.Since(start)))
+		l.mu.Unlock()
+	}, 0, true
+}
+
+// retryAfter estimates in whole seconds, at least one, when the current holder releases the lock:
+// the duration of the last holder minus the time the current one has already taken.
+func (l *reportLock) retryAfter(now time.Time) int {
+	remaining := time.Duration(l.last.Load()) - now.Sub(time.Unix(0, l.started.Load()))
+	return max(1, int((remaining+time.Second-1)/time.Second))
+}
+
+// jobReports holds what is needed to rewrite the reports of a completed job.
+type jobReports struct {
+	correlationID  string
+	labels         api.JobLabels
+	myCompany      invoice.Counterparty
+	roundingPolicy invoice.RoundingPolicy
+	matchingUsage  invoice.Usage
+	summary        invoice.RunSummary
+	resultPath     string
+	csvPath        string // Empty when the job has no CSV report
+	baseURL        string // Scheme and host of the upload request, see publicBaseURL
+}
+
+// reports captures the report settings of the job. Call it on a snapshot from JobStore.Get.
+func (job *Job) reports() jobReports {
+	r := jobReports{
+		correlationID:  job.CorrelationID,
+		labels:         api.JobLabels{Tags: job.Tags, Note: job.Note},
+		myCompany:      job.MyCompany,
+		roundingPolicy: job.roundingPolicy,
+		matchingUsage:  job.MatchingUsage,
+		resultPath:     job.ResultPath,
+		baseURL:        job.baseURL,
+	}
+	if job.DownloadURLCSV != "" {
+		r.csvPath = filepath.Join("public", filepath.Base(job.DownloadURLCSV))
+	}
+	if job.Summary != nil {
+		r.summary = *job.Summary
+	}
+	return r
+}
+
+// regenerate rewrites the Excel report and, if the job has one, the CSV report from results and counterparties.
+func (r jobReports) regenerate(results []api.Result, counterparties []invoice.UniqueCounterparty) error {
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		return fmt.Errorf("Could not load config: %v", err)
+	}
+	vatSummary := invoice.SummarizeVAT(resultInvoices(results), r.myCompany, time.Time{}, time.Time{}, r.roundingPolicy)
+	if _, err := generateExcelReport(r.resultPath, r.correlationID, publicBaseURL(config, r.baseURL), r.labels, results, counterparties, vatSummary, r.matchingUsage, r.summary, config); err != nil {
+		return fmt.Errorf("Could not regenerate the Excel report: %v", err)
+	}
+	if r.csvPath == "" {
+		return nil
+	}
+	csvDelimiter, err := invoice.ParseCSVDelimiter(config.CSVDelimiter)
+	if err != nil {
+		return fmt.Errorf("Invalid 'csv_delimiter' in config.json: %v", err)
+	}
+	if err := generateCSVReport(r.csvPath, results, counterparties, csvDelimiter); err != nil {
+		return fmt.Errorf("Could not regenerate the CSV report: %v", err)
+	}
+	return nil
+}
+
+// handleEditResult applies a partial invoice to the result at index (PATCH /api/v1/results/<jobID>/<index>).
+// Only the fields present in the body change, nested counterparty fields included. The warnings of the
+// result are recomputed and the reports are marked stale until POST /api/v1/results/<jobID>/regenerate.
+func handleEditResult(w http.ResponseWriter, r *http.Request, jobID, indexValue string) {
+	index, err := strconv.Atoi(indexValue)
+	if err != nil || index < 0 {
+		jsonError(w, fmt.Sprintf("Invalid result index %q", indexValue), http.StatusBadRequest)
+		return
+	}
+	if !requireJSONBody(w, r) {
+		return
+	}
+	patch, err := io.ReadAll(io.LimitReader(r.Body, maxEditSize+1))
+	if err != nil || len(patch) > maxEditSize {
+		jsonError(w, "Could not read the request body", http.StatusBadRequest)
+		return
+	}
+
+	// Serialized with merges, label changes and regeneration, which rewrite the same results and reports
+	unlock, ok := lockReports(w, jobID)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+	if job.Status != api.StatusCompleted {
+		jsonError(w, fmt.Sprintf("Results cannot be edited in status %q", job.Status), http.StatusConflict)
+		return
+	}
+	results := job.AllResults
+
+	if index >= len(results) {
+		jsonError(w, "Result not found", http.StatusNotFound)
+		return
+	}
+	if results[index].Invoice == nil {
+		jsonError(w, "The result has no invoice to edit", http.StatusConflict)
+		return
+	}
+	edited, err := applyInvoicePatch(*results[index].Invoice, patch)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if edited.Direction != "" {
+		if edited.Direction, ok = invoice.ParseDirection(edited.Direction); !ok {
+			jsonError(w, fmt.Sprintf("Invalid direction, expected %q or %q", invoice.DirectionIncoming, invoice.DirectionOutgoing), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Copy on write: readers encode the previous slice without holding the lock.
+	newResults := slices.Clone(results)
+	res := &newResults[index]
+	res.Invoice = &edited
+	res.Warnings = edited.Validate()
+	if issue := invoice.CheckCurrency(&edited, edited.Counterparty, false); issue != nil {
+		res.Warnings = append(res.Warnings, *issue)
+	}
+	markDuplicates(newResults)
+
+	jobs.Update(jobID, func(job *Job) {
+		job.AllResults = newResults
+		job.ReportStale = true
+		job.Log = append(job.Log, newLogEntry(job.Language, msgResultEdited, res.SourceFile, res.InvoiceIndex, r.RemoteAddr))
+	})
+	log.Printf("Job %s (correlation ID %s): [%s] %s", jobID, job.CorrelationID, msgResultEdited,
+		localize(defaultLanguage, msgResultEdited, res.SourceFile, res.InvoiceIndex, r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(*res)
+}
+
+// applyInvoicePatch returns a copy of inv with the JSON fields of patch applied. Unknown fields are rejected,
+// so that a misspelled field does not silently leave the value unchanged.
+func applyInvoicePatch(inv invoice.Invoice, patch []byte) (invoice.Invoice, error) {
+	// A JSON round trip makes a deep copy: decoding into inv directly would reuse its slices and maps,
+	// which are shared with readers of the job.
+	original, err := json.Marshal(inv)
+	if err != nil {
+		return inv, err
+	}
+	var edited invoice.Invoice
+	if err := json.Unmarshal(original, &edited); err != nil {
+		return inv, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&edited); err != nil {
+		return inv, fmt.Errorf("Invalid invoice fields: %v", err)
+	}
+	edited.Preview = inv.Preview
+	return edited, nil
+}
+
+// markDuplicates recomputes the duplicates of the job results after an edit.
+func markDuplicates(results []api.Result) {
+	plain := make([]invoice.Result, len(results))
+	for i, res := range results {
+		plain[i] = res.Result
+	}
+	invoice.MarkDuplicates(plain)
+	for i := range results {
+		results[i].DuplicateOf = plain[i].DuplicateOf
+	}
+}
+
+// handleRegenerateReports rebuilds the reports of a completed job from its current, possibly edited,
+// results (POST /api/v1/results/<jobID>/regenerate). The run summary is recomputed from the results.
+func handleRegenerateReports(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	unlock, ok := lockReports(w, jobID)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+	if job.Status != api.StatusCompleted {
+		jsonError(w, fmt.Sprintf("Reports cannot be regenerated in status %q", job.Status), http.StatusConflict)
+		return
+	}
+	results, counterparties := job.AllResults, job.UniqueCounterparties
+	reports := job.reports()
+
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Could not load config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	reports.summary = resummarize(reports.summary, results, reports.matchingUsage, config.ModelPrices)
+	if err := reports.regenerate(results, counterparties); err != nil {
+		log.Printf("Job %s (correlation ID %s): could not regenerate reports: %v", jobID, reports.correlationID, err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var status api.JobStatus
+	jobs.Update(jobID, func(job *Job) {
+		job.Summary = &reports.summary
+		job.ReportStale = false
+		job.Log = append(job.Log, newLogEntry(job.Language, msgReportsRegenerated, r.RemoteAddr))
+		status = job.snapshot().JobStatus
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// resummarize recomputes the run summary of edited results. The file counts, counterparty counts and
+// wall time of the original run are kept.
+func resummarize(summary invoice.RunSummary, results []api.Result, matchingUsage invoice.Usage, prices map[string]invoice.ModelPrice) invoice.RunSummary {
+	plain := make([]invoice.Result, len(results))
+	for i, res := range results {
+		plain[i] = res.Result
+	}
+	dedup := invoice.Deduplication{
+		MatchingUsage:         matchingUsage,
+		NewCounterparties:     summary.CounterpartiesNew,
+		MatchedCounterparties: summary.CounterpartiesMatched,
+		Warnings:              make([]string, summary.Warnings[invoice.WarningMatching]),
+	}
+	return invoice.NewRunSummary(summary.FilesScanned, plain, dedup, prices, summary.WallTime)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/xuri/excelize/v2"
+)
+
+// useTestDir runs the test in an empty working directory with config.json and the public and temp
+// directories the handlers write to, and gives it a job store of its own.
+func useTestDir(t *testing.T, config string) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("config.json", []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"public", "temp"} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := jobs
+	jobs = jobStore{NewMemoryJobStore()}
+	t.Cleanup(func() {
+		jobs = previous
+		reportLocks.Clear()
+	})
+}
+
+// testResults returns n successful results with distinct invoices of one counterparty.
+func testResults(n int) []api.Result {
+	results := make([]api.Result, n)
+	for i := range results {
+		inv := &invoice.Invoice{
+			Number:       fmt.Sprintf("INV-%d", i+1),
+			Date:         "2024-03-01",
+			Currency:     "EUR",
+			TotalAmount:  float64(100 + i),
+			Counterparty: invoice.Counterparty{ID: 1, Name: "ACME GmbH"},
+		}
+		results[i] = api.Result{ID: fmt.Sprintf("r%d", i+1), Result: invoice.Result{SourceFile: fmt.Sprintf("invoice-%d.pdf", i+1), InvoiceIndex: 1, Invoice: inv}}
+	}
+	return results
+}
+
+// addCompletedJob registers a completed job with results and reports under public/.
+func addCompletedJob(t *testing.T, id string, results []api.Result) {
+	t.Helper()
+	job := &Job{
+		JobStatus: api.JobStatus{
+			ID:             id,
+			Status:         api.StatusCompleted,
+			ResultPath:     filepath.Join("public", id+".xlsx"),
+			DownloadURL:    "/public/" + id + ".xlsx",
+			DownloadURLCSV: "/public/" + id + ".csv.zip",
+			Summary:        &invoice.RunSummary{FilesScanned: len(results)},
+		},
+		AllResults:           results,
+		UniqueCounterparties: []invoice.UniqueCounterparty{{Counterparty: invoice.Counterparty{ID: 1, Name: "ACME GmbH"}}},
+		created:              time.Now(),
+	}
+	if err := jobs.Create(job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func regenerateRequest(jobID string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, api.PathPrefix+"/results/"+jobID+"/regenerate", nil)
+	handleRegenerateReports(w, r, jobID)
+	return w
+}
+
+// TestRegenerateReportsConcurrently sends many regenerate requests at once: each one either rebuilds
+// the reports or is refused with 409 and Retry-After, and the Excel report stays readable.
+func TestRegenerateReportsConcurrently(t *testing.T) {
+	useTestDir(t, `{}`)
+	const jobID, invoices, requests = "job-1", 30, 20
+	addCompletedJob(t, jobID, testResults(invoices))
+
+	var wg sync.WaitGroup
+	codes := make([]int, requests)
+	retryAfter := make([]string, requests)
+	start := make(chan struct{})
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			w := regenerateRequest(jobID)
+			codes[i], retryAfter[i] = w.Code, w.Header().Get("Retry-After")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	succeeded := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusConflict:
+			if seconds, err := strconv.Atoi(retryAfter[i]); err != nil || seconds < 1 {
+				t.Errorf("409 response has Retry-After %q, want a positive number of seconds", retryAfter[i])
+			}
+		default:
+			t.Errorf("regenerate responded %d", code)
+		}
+	}
+	if succeeded == 0 {
+		t.Fatal("no regenerate request succeeded")
+	}
+	// The lock is released after the burst
+	if w := regenerateRequest(jobID); w.Code != http.StatusOK {
+		t.Fatalf("regenerate after the burst responded %d: %s", w.Code, w.Body)
+	}
+
+	f, err := excelize.OpenFile(filepath.Join("public", jobID+".xlsx"))
+	if err != nil {
+		t.Fatalf("the regenerated report cannot be opened: %v", err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows("Invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != invoices+1 {
+		t.Errorf("Invoices sheet has %d rows, want a header and %d invoices", len(rows), invoices)
+	}
+	if job, _ := jobs.Get(jobID); job.ReportStale || job.Summary == nil || job.Summary.FilesProcessed != invoices {
+		t.Errorf("job after regeneration: stale %v, summary %+v", job.ReportStale, job.Summary)
+	}
+}
+
+func TestRegenerateReportsWhileLockedRespondsRetryAfter(t *testing.T) {
+	useTestDir(t, `{}`)
+	addCompletedJob(t, "job-1", testResults(1))
+
+	unlock, ok := lockReports(httptest.NewRecorder(), "job-1")
+	if !ok {
+		t.Fatal("lockReports refused a free lock")
+	}
+	value, _ := reportLocks.Load("job-1")
+	value.(*reportLock).last.Store(int64(5 * time.Second))
+
+	w := regenerateRequest("job-1")
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("regenerate while locked: %d, Retry-After %q, want 409 and 5", w.Code, w.Header().Get("Retry-After"))
+	}
+	unlock()
+	if w := regenerateRequest("job-1"); w.Code != http.StatusOK {
+		t.Errorf("regenerate after unlock responded %d: %s", w.Code, w.Body)
+	}
+}
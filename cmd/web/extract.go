@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// defaultPageLatency is the assumed processing time of one page until a synchronous extraction has been measured
+const defaultPageLatency = 3 * time.Second
+
+// pageLatency is the rolling average processing time of one page of /api/v1/extract.
+var pageLatency = &latencyAverage{perPage: defaultPageLatency}
+
+// latencyAverage is an exponential moving average of the processing time per page.
+type latencyAverage struct {
+	mu      sync.Mutex
+	perPage time.Duration
+	samples int
+}
+
+// observe adds the processing time of a file of pages pages. The first measurement replaces the default.
+func (a *latencyAverage) observe(elapsed time.Duration, pages int) {
+	if pages <= 0 {
+		return
+	}
+	sample := elapsed / time.Duration(pages)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.samples == 0 {
+		a.perPage = sample
+	} else {
+		a.perPage += (sample - a.perPage) / 5
+	}
+	a.samples++
+}
+
+// estimate returns the expected processing time of a file of pages pages.
+func (a *latencyAverage) estimate(pages int) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.perPage * time.Duration(pages)
+}
+
+// preferAsync reports whether the request asks for an asynchronous response with Prefer: respond-async.
+func preferAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values(api.PreferHeader) {
+		for _, preference := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(token), api.PreferRespondAsync) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extractPages counts the pages of an uploaded file for the estimate: pdfinfo for a PDF, one page for
+// other files and for a PDF whose pages cannot be counted.
+func extractPages(ctx context.Context, name string, data []byte, config *invoice.Config) int {
+	if strings.ToLower(filepath.Ext(name)) != ".pdf" {
+		return 1
+	}
+	tmp, err := os.CreateTemp("", "invpa-extract-*.pdf")
+	if err != nil {
+		return 1
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 1
+	}
+	pages, err := pdfimg.PageCount(ctx, tmp.Name(), pdfimg.Options{PopplerPath: config.PopplerPath(), Passwords: config.PDFPasswords, Timeout: pageCountTimeout})
+	if err != nil || pages <= 0 {
+		return 1
+	}
+	return pages
+}
+
+// extractAsynchronously decides whether /api/v1/extract answers 202 with a job instead of processing inline:
+// always in the async mode, never in the sync mode, and in the auto mode when the client sends
+// Prefer: respond-async or the estimated processing time (pages × the rolling average per page)
+// exceeds extract_async_after.
+func extractAsynchronously(r *http.Request, mode string, threshold time.Duration, pages int) bool {
+	switch mode {
+	case invoice.ExtractResponseSync:
+		return false
+	case invoice.ExtractResponseAsync:
+		return true
+	}
+	return preferAsync(r) || pageLatency.estimate(pages) > threshold
+}
+
+// startExtractJob saves the uploaded file as a job of a single file and responds 202 with the job ID
+// and a Location header of its status. The results are then read from /api/v1/results/<jobID>.
+func startExtractJob(w http.ResponseWriter, r *http.Request, name string, data []byte) {
+	correlationID := strings.TrimSpace(r.Header.Get(api.CorrelationIDHeader))
+	if correlationID == "" {
+		correlationID = uuid.New().String()
+	}
+	if len(correlationID) > 128 {
+		jsonError(w, "Correlation ID must not exceed 128 characters", http.StatusBadRequest)
+		return
+	}
+	jobID := uuid.New().String()
+	jobDir := filepath.Join("temp", jobID)
+	if err := os.MkdirAll(jobDir, os.ModePerm); err != nil {
+		jsonError(w, "Could not create job directory", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(jobDir, filepath.Base(name)), data, 0o644); err != nil {
+		jsonError(w, "Could not save file content", http.StatusInternalServerError)
+		return
+	}
+
+	language := negotiateLanguage("", r.Header.Get("Accept-Language"))
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{JobStatus: api.JobStatus{ID: jobID, CorrelationID: correlationID, Status: api.StatusProcessing, Language: language, Log: []api.LogEntry{newLogEntry(language, msgUploaded)}}, created: time.Now(), cancel: cancel, baseURL: requestBaseURL(r), pdfPassword: r.FormValue(api.FieldPDFPassword)}
+	if err := jobs.Create(job); err != nil {
+		cancel()
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Job %s created from /extract (correlation ID %s)", jobID, correlationID)
+	startJob(ctx, cancel, jobID, invoice.Counterparty{}, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", api.PathPrefix+"/status/"+jobID)
+	w.Header().Set(api.CorrelationIDHeader, correlationID)
+	if preferAsync(r) {
+		w.Header().Set(api.PreferenceAppliedHeader, api.PreferRespondAsync)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(api.UploadResponse{JobID: jobID, CorrelationID: correlationID})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+)
+
+// extractRequest posts a small PNG to /api/v1/extract with the headers.
+func extractRequest(t *testing.T, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "receipt.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("\x89PNG\r\n\x1a\n"))
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, api.PathPrefix+"/extract", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handleExtract(w, r)
+	return w
+}
+
+// waitForJob waits until the job leaves the Processing status, so that it does not outlive the test directory.
+func waitForJob(t *testing.T, jobID string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := jobs.Get(jobID); ok && job.Status != api.StatusProcessing {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is still processing", jobID)
+}
+
+func TestExtractRespondsAsync(t *testing.T) {
+	// Without network the job ends quickly: images cannot be processed locally
+	const offline = `"allow_network": false, "degraded_mode": true`
+	for _, tc := range []struct {
+		name, config, prefer string
+		async, applied       bool
+	}{
+		{"async mode", `{` + offline + `, "extract_response": "async"}`, "", true, false},
+		{"prefer respond-async", `{` + offline + `}`, "respond-async, wait=10", true, true},
+		{"long estimate", `{` + offline + `, "extract_async_after": "1ms"}`, "", true, false},
+		{"sync mode ignores prefer", `{` + offline + `, "extract_response": "sync"}`, "respond-async", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestDir(t, tc.config)
+			w := extractRequest(t, map[string]string{api.PreferHeader: tc.prefer})
+			if !tc.async {
+				if w.Code == http.StatusAccepted {
+					t.Errorf("responded 202 in the sync mode")
+				}
+				return
+			}
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("responded %d: %s", w.Code, w.Body)
+			}
+			var created api.UploadResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.JobID == "" {
+				t.Fatalf("response %s: %v", w.Body, err)
+			}
+			waitForJob(t, created.JobID)
+			if location := w.Header().Get("Location"); location != api.PathPrefix+"/status/"+created.JobID {
+				t.Errorf("Location = %q", location)
+			}
+			if applied := w.Header().Get(api.PreferenceAppliedHeader) == api.PreferRespondAsync; applied != tc.applied {
+				t.Errorf("Preference-Applied = %q, want applied %v", w.Header().Get(api.PreferenceAppliedHeader), tc.applied)
+			}
+			if job, _ := jobs.Get(created.JobID); job.TotalFiles != 1 {
+				t.Errorf("job has %d files, want the uploaded file", job.TotalFiles)
+			}
+		})
+	}
+}
+
+func TestLatencyAverage(t *testing.T) {
+	a := &latencyAverage{perPage: defaultPageLatency}
+	if got := a.estimate(10); got != 10*defaultPageLatency {
+		t.Errorf("estimate before measurements = %v, want the default per page", got)
+	}
+	a.observe(4*time.Second, 2) // The first measurement replaces the default
+	a.observe(7*time.Second, 1)
+	if got := a.estimate(1); got != 3*time.Second {
+		t.Errorf("estimate per page = %v, want 2s moved a fifth of the way to 7s", got)
+	}
+}
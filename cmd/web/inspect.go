@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/archive"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/pdfimg"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// inspectionTTL is how long a kept inspection waits for /api/v1/upload before its files are removed
+const inspectionTTL = 15 * time.Minute
+
+// pageCountTimeout bounds pdfinfo for a single file of an inspected archive
+const pageCountTimeout = 10 * time.Second
+
+// Uploads kept by /api/v1/inspect (keep=true) until a job claims them or they expire
+var inspections = make(map[string]*inspection)
+var inspectionsMutex = &sync.Mutex{}
+
+// inspection is an inspected upload waiting to be processed.
+type inspection struct {
+	dir     string // temp/inspect-<token>, holds only the uploaded zip
+	zipName string
+	expires time.Time
+}
+
+// handleInspect unpacks an uploaded archive (field "zipfile"), counts its files and pages and estimates
+// the processing cost without calling OpenAI. With keep=true the upload is kept for inspectionTTL
+// and the returned token lets /api/v1/upload start the job without uploading the archive again.
+func handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !negotiateJSON(w, r) {
+		return
+	}
+	if !parseUploadForm(w, r) {
+		return
+	}
+	file, header, err := r.FormFile(api.FieldZipFile)
+	if err != nil {
+		jsonError(w, "Could not get uploaded file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if err := checkArchive(file); err != nil {
+		jsonError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	keep := false
+	if value := r.FormValue("keep"); value != "" {
+		if keep, err = strconv.ParseBool(value); err != nil {
+			jsonError(w, "Invalid 'keep', expected true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Could not load config.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	addPDFPassword(config, r.FormValue(api.FieldPDFPassword))
+	roundingPolicy, err := invoice.ParseRoundingPolicy(config.RoundingPolicy)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Invalid 'rounding_policy' in config.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	processor, err := newProcessor(config, config.MyCompany, roundingPolicy)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token := uuid.New().String()
+	dir := filepath.Join("temp", "inspect-"+token)
+	zipName := filepath.Base(header.Filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		jsonError(w, "Could not create inspection directory", http.StatusInternalServerError)
+		return
+	}
+	if err := saveUpload(filepath.Join(dir, zipName), file); err != nil {
+		os.RemoveAll(dir)
+		jsonError(w, "Could not save zip file", http.StatusInternalServerError)
+		return
+	}
+
+	pdfOptions := pdfimg.Options{PopplerPath: config.PopplerPath(), Passwords: config.PDFPasswords, Timeout: pageCountTimeout}
+	result, err := inspectArchive(r.Context(), dir, zipName, processor, pdfOptions, config.ModelPrices)
+	if err != nil || !keep {
+		os.RemoveAll(dir)
+	}
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Could not inspect the archive: %v", err), http.StatusBadRequest)
+		return
+	}
+	if keep {
+		expires := time.Now().Add(inspectionTTL)
+		inspectionsMutex.Lock()
+		inspections[token] = &inspection{dir: dir, zipName: zipName, expires: expires}
+		inspectionsMutex.Unlock()
+		result.Token, result.ExpiresAt = token, &expires
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// inspectArchive unpacks the zip next to it, builds the manifest and removes the unpacked files.
+func inspectArchive(ctx context.Context, dir, zipName string, processor *invoice.Processor, pdfOptions pdfimg.Options, prices map[string]invoice.ModelPrice) (api.InspectionResult, error) {
+	result := api.InspectionResult{Counts: make(map[string]int)}
+	extracted := filepath.Join(dir, "extracted")
+	defer os.RemoveAll(extracted)
+	if err := archive.Extract(filepath.Join(dir, zipName), extracted, archive.Options{}); err != nil {
+		return result, err
+	}
+
+	err := filepath.WalkDir(extracted, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Ignore dot-underscore files created by macOS, as the job scan does
+		if d.IsDir() || strings.HasPrefix(d.Name(), "._") {
+			return nil
+		}
+		rel, _ := filepath.Rel(extracted, path)
+		entry := api.InspectedFile{
+			Path:      filepath.ToSlash(rel),
+			Type:      strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."),
+			Supported: invoice.IsSupportedFile(path),
+		}
+		if !entry.Supported {
+			result.Unsupported++
+			result.Files = append(result.Files, entry)
+			return nil
+		}
+		result.Counts[entry.Type]++
+		entry.Pages = 1
+		if entry.Type == "pdf" {
+			pages, err := pdfimg.PageCount(ctx, path, pdfOptions)
+			if err != nil {
+				entry.Pages, entry.Error = 0, err.Error()
+			} else {
+				entry.Pages = pages
+			}
+		}
+		result.Pages += entry.Pages
+		// A file with an unknown page count is estimated as a single page
+		result.EstimatedUsage.Add(processor.EstimateUsage(max(entry.Pages, 1)))
+		result.Files = append(result.Files, entry)
+		return nil
+	})
+	result.EstimatedCost = result.EstimatedUsage.EstimateCost(prices)
+	return result, err
+}
+
+// claimInspection removes a kept inspection from the registry and returns it, unless it has expired.
+func claimInspection(token string) (*inspection, bool) {
+	inspectionsMutex.Lock()
+	insp, ok := inspections[token]
+	delete(inspections, token)
+	inspectionsMutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(insp.expires) {
+		os.RemoveAll(insp.dir)
+		return nil, false
+	}
+	return insp, true
+}
+
+// cleanupInspections removes leftovers of a previous run and then, every interval,
+// the kept inspections that no job claimed within inspectionTTL.
+func cleanupInspections(interval time.Duration) {
+	leftovers, _ := filepath.Glob(filepath.Join("temp", "inspect-*"))
+	for _, dir := range leftovers {
+		os.RemoveAll(dir)
+	}
+	for range time.Tick(interval) {
+		now := time.Now()
+		var expired []string
+		inspectionsMutex.Lock()
+		for token, insp := range inspections {
+			if now.After(insp.expires) {
+				delete(inspections, token)
+				expired = append(expired, insp.dir)
+			}
+		}
+		inspectionsMutex.Unlock()
+		for _, dir := range expired {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Could not remove expired inspection %s: %v", dir, err)
+			}
+		}
+	}
+}
+
+// saveUpload writes an uploaded file to path.
+func saveUpload(path string, file io.Reader) error {
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, file)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// processorLogger receives the progress records of every invoice processor: records go to the server
+// log at INFO and above, and records of a job (see invoice.WithJobID) also go to that job's log at any level.
+var processorLogger = slog.New(&jobLogHandler{next: slog.Default().Handler()})
+
+// jobLogHandler is the slog handler behind processorLogger.
+type jobLogHandler struct {
+	next  slog.Handler
+	attrs []slog.Attr // Attributes added by Logger.With, which carry job_id and file
+}
+
+func (h *jobLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true // The job log keeps every level; GET /status filters by level
+}
+
+func (h *jobLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var jobID, file string
+	var details []string
+	visit := func(attr slog.Attr) bool {
+		switch attr.Key {
+		case invoice.LogKeyJobID:
+			jobID = attr.Value.String()
+		case invoice.LogKeyFile:
+			file = attr.Value.String()
+		default:
+			details = append(details, attr.Key+"="+attr.Value.String())
+		}
+		return true
+	}
+	for _, attr := range h.attrs {
+		visit(attr)
+	}
+	r.Attrs(visit)
+	if jobID != "" {
+		text := r.Message
+		if file != "" {
+			text = file + ": " + text
+		}
+		if len(details) > 0 {
+			text += " (" + strings.Join(details, ", ") + ")"
+		}
+		jobs.addProcessorLog(jobID, logLevel(r.Level), text)
+	}
+	if h.next.Enabled(ctx, r.Level) {
+		return h.next.WithAttrs(h.attrs).Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *jobLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &jobLogHandler{next: h.next, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+// WithGroup is not used by the invoice package; groups only change the server log.
+func (h *jobLogHandler) WithGroup(name string) slog.Handler {
+	return &jobLogHandler{next: h.next.WithGroup(name), attrs: h.attrs}
+}
+
+// logLevel maps a slog level to a job log level.
+func logLevel(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return api.LogLevelError
+	case level >= slog.LevelWarn:
+		return api.LogLevelWarn
+	case level >= slog.LevelInfo:
+		return api.LogLevelInfo
+	}
+	return api.LogLevelDebug
+}
+
+// addProcessorLog appends a processor record to the job log. Records are in English, like the server log.
+func (s jobStore) addProcessorLog(jobID, level, text string) {
+	s.Update(jobID, func(job *Job) {
+		entry := newLogEntry(job.Language, msgProcessorLog, text)
+		entry.Level = level
+		if level == api.LogLevelError {
+			entry.Text = "[ERROR] " + entry.Text
+		}
+		job.Log = append(job.Log, entry)
+	})
+}
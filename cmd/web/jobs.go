@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/xuri/excelize/v2"
+)
+
+// jobTTL is how long finished jobs and their reports are kept
+var jobTTL = 7 * 24 * time.Hour
+
+// jobNotFound is the 404 message for unknown jobs, which includes deleted and expired ones.
+func jobNotFound() string {
+	return fmt.Sprintf("Job not found. Jobs and their reports are removed after %s or when deleted; please upload the archive again.", formatTTL(jobTTL))
+}
+
+func formatTTL(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// handleJobs routes /api/v1/jobs: the job list, job deletion and job labels.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !negotiateJSON(w, r) {
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, api.PathPrefix+"/jobs"), "/")
+	jobID, rest, _ := strings.Cut(path, "/")
+	switch {
+	case path == "":
+		handleListJobs(w, r)
+	case rest == "":
+		handleDeleteJob(w, r, jobID)
+	case rest == "labels":
+		handleSetLabels(w, r, jobID)
+	case strings.HasPrefix(rest, "tags/"):
+		tag, err := url.PathUnescape(strings.TrimPrefix(rest, "tags/"))
+		if err != nil {
+			jsonError(w, "Invalid tag", http.StatusBadRequest)
+			return
+		}
+		handleRemoveTag(w, r, jobID, tag)
+	default:
+		jsonError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleListJobs returns the jobs, newest first (GET /api/v1/jobs). Each ?status= parameter adds an allowed
+// status and each ?tag= parameter keeps only the jobs carrying that tag. With ?page= or ?limit= only that page
+// is returned; the X-Total-Count header always holds the number of matching jobs.
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	page, limit, err := parsePage(query.Get(api.ParamPage), query.Get(api.ParamLimit))
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	statuses, tags := query[api.ParamStatus], query[api.ParamTag]
+	list := []api.JobSummary{}
+	for _, job := range jobs.List() {
+		if !hasTags(job.Tags, tags) || (len(statuses) > 0 && !slices.ContainsFunc(statuses, func(s string) bool { return strings.EqualFold(s, job.Status) })) {
+			continue
+		}
+		summary := api.JobSummary{
+			ID:             job.ID,
+			CorrelationID:  job.CorrelationID,
+			Status:         job.Status,
+			Created:        job.created,
+			TotalFiles:     job.TotalFiles,
+			ProcessedFiles: job.ProcessedFiles,
+			Tags:           job.Tags,
+			Note:           job.Note,
+		}
+		if job.Finished() {
+			summary.DownloadURL, summary.DownloadURLCSV = job.DownloadURL, job.DownloadURLCSV
+		}
+		list = append(list, summary)
+	}
+	slices.SortFunc(list, func(a, b api.JobSummary) int {
+		if c := b.Created.Compare(a.Created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID) // Stable pages for jobs created at the same instant
+	})
+	w.Header().Set(api.TotalCountHeader, strconv.Itoa(len(list)))
+	if limit > 0 {
+		start := min((page-1)*limit, len(list))
+		list = list[start:min(start+limit, len(list))]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// parsePage parses the page and limit parameters of the job list. Without both it returns 0 (all jobs).
+func parsePage(pageValue, limitValue string) (page, limit int, err error) {
+	if pageValue == "" && limitValue == "" {
+		return 0, 0, nil
+	}
+	page, limit = 1, api.DefaultJobsLimit
+	if pageValue != "" {
+		if page, err = strconv.Atoi(pageValue); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("invalid page %q, expected a number from 1", pageValue)
+		}
+	}
+	if limitValue != "" {
+		if limit, err = strconv.Atoi(limitValue); err != nil || limit < 1 || limit > api.MaxJobsLimit {
+			return 0, 0, fmt.Errorf("invalid limit %q, expected a number from 1 to %d", limitValue, api.MaxJobsLimit)
+		}
+	}
+	return page, limit, nil
+}
+
+// handleJobsPage renders the job list page (GET /jobs), which loads the jobs from /api/v1/jobs.
+func handleJobsPage(w http.ResponseWriter, r *http.Request) {
+	if err := executeTemplate(w, "jobs.html", nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// hasTags reports whether tags contain every tag of filter (case-insensitive).
+func hasTags(tags, filter []string) bool {
+	for _, want := range filter {
+		if !slices.ContainsFunc(tags, func(tag string) bool { return strings.EqualFold(tag, strings.TrimSpace(want)) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleSetLabels replaces the tags and the note of a job (PUT /api/v1/jobs/<id>/labels).
+func handleSetLabels(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPut {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireJSONBody(w, r) {
+		return
+	}
+	var labels api.JobLabels
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&labels); err != nil {
+		jsonError(w, "Invalid request body, expected {\"tags\": [...], \"note\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	labels, err := validateLabels(labels.Tags, labels.Note)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updateLabels(w, r, jobID, func(api.JobLabels) api.JobLabels { return labels })
+}
+
+// handleRemoveTag removes one tag of a job (DELETE /api/v1/jobs/<id>/tags/<tag>).
+func handleRemoveTag(w http.ResponseWriter, r *http.Request, jobID, tag string) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	updateLabels(w, r, jobID, func(labels api.JobLabels) api.JobLabels {
+		labels.Tags = slices.DeleteFunc(slices.Clone(labels.Tags), func(t string) bool { return strings.EqualFold(t, tag) })
+		return labels
+	})
+}
+
+// updateLabels applies change to the job labels, rewrites them in the Summary sheet of a finished
+// job's report and responds with the new labels.
+func updateLabels(w http.ResponseWriter, r *http.Request, jobID string, change func(api.JobLabels) api.JobLabels) {
+	// Serialized with merges and regeneration, which rewrite the same report
+	unlock, ok := lockReports(w, jobID)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	var labels api.JobLabels
+	var correlationID, resultPath string
+	ok = jobs.Update(jobID, func(job *Job) {
+		correlationID = job.CorrelationID
+		labels = change(api.JobLabels{Tags: job.Tags, Note: job.Note})
+		if labels.Tags == nil {
+			labels.Tags = []string{}
+		}
+		// Replaced, not modified in place: snapshots of the job share the previous slice
+		job.Tags, job.Note = labels.Tags, labels.Note
+		if job.Finished() {
+			resultPath = job.ResultPath
+		}
+	})
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, correlationID)
+	log.Printf("Job %s (correlation ID %s) labels set by %s: tags %q", jobID, correlationID, r.RemoteAddr, labels.Tags)
+
+	if resultPath != "" {
+		if err := rewriteReportLabels(resultPath, labels); err != nil {
+			log.Printf("Job %s (correlation ID %s): could not update labels in the Excel report: %v", jobID, correlationID, err)
+			jsonError(w, "Labels saved, but the Excel report could not be updated", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
+
+// validateLabels trims and deduplicates the tags and checks them and the note against the api limits.
+func validateLabels(tags []string, note string) (api.JobLabels, error) {
+	labels := api.JobLabels{Tags: []string{}, Note: strings.TrimSpace(note)}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "" || hasTags(labels.Tags, []string{tag}):
+			continue
+		case utf8.RuneCountInString(tag) > api.MaxTagLength:
+			return labels, fmt.Errorf("tag %q exceeds %d characters", tag, api.MaxTagLength)
+		case strings.ContainsFunc(tag, func(r rune) bool { return r == ',' || unicode.IsControl(r) }):
+			return labels, fmt.Errorf("tag %q must not contain commas or control characters", tag)
+		}
+		labels.Tags = append(labels.Tags, tag)
+	}
+	if len(labels.Tags) > api.MaxTags {
+		return labels, fmt.Errorf("a job can have at most %d tags", api.MaxTags)
+	}
+	if utf8.RuneCountInString(labels.Note) > api.MaxNoteLength {
+		return labels, fmt.Errorf("note exceeds %d characters", api.MaxNoteLength)
+	}
+	return labels, nil
+}
+
+// labelRows returns the rows with the job tags and note, which follow the header of the "Summary" sheet.
+func labelRows(labels api.JobLabels) [][]any {
+	return [][]any{{"Tags", strings.Join(labels.Tags, ", ")}, {"Note", labels.Note}}
+}
+
+// rewriteReportLabels replaces the tags and note in the "Summary" sheet of an existing report.
+func rewriteReportLabels(path string, labels api.JobLabels) error {
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i, row := range labelRows(labels) {
+		cell := fmt.Sprintf("A%d", i+2)
+		if value, _ := f.GetCellValue("Summary", cell); value != row[0] {
+			return errors.New("the Summary sheet has no label rows")
+		}
+		if err := f.SetSheetRow("Summary", cell, &row); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := f.WriteTo(w)
+		return err
+	})
+}
+
+// handleDeleteJob removes a job together with its reports and source files (DELETE /api/v1/jobs/<id>).
+// A job that is still processing must be cancelled first.
+func handleDeleteJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+	if job.Status == api.StatusProcessing {
+		jsonError(w, "Job is still processing, cancel it first", http.StatusConflict)
+		return
+	}
+	// A finished job never returns to processing, so the check above still holds
+	if job, ok = jobs.Delete(jobID); !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	reportLocks.Delete(jobID)
+
+	removed := removeJobFiles(job)
+	log.Printf("Job %s (correlation ID %s) deleted by %s, removed %s", jobID, job.CorrelationID, r.RemoteAddr, strings.Join(removed, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireJobs removes, every interval, the jobs created more than jobTTL ago. Jobs that are still
+// processing are skipped until they finish.
+func expireJobs(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		expireSources(now)
+		cutoff := now.Add(-jobTTL)
+		for _, job := range jobs.List() {
+			if job.Status == api.StatusProcessing || !job.created.Before(cutoff) {
+				continue
+			}
+			if job, ok := jobs.Delete(job.ID); ok {
+				reportLocks.Delete(job.ID)
+				removed := removeJobFiles(job)
+				log.Printf("Job %s (correlation ID %s) expired after %s, removed %s", job.ID, job.CorrelationID, formatTTL(jobTTL), strings.Join(removed, ", "))
+			}
+		}
+	}
+}
+
+// removeJobFiles deletes the job's reports and any retained source files.
+// It returns what was removed, for the log.
+func removeJobFiles(job Job) []string {
+	paths := []string{filepath.Join("temp", job.ID), filepath.Join("public", "jobs", job.ID)}
+	if job.ResultPath != "" {
+		paths = append(paths, job.ResultPath)
+	}
+	if job.DownloadURLCSV != "" {
+		paths = append(paths, filepath.Join("public", filepath.Base(job.DownloadURLCSV)))
+	}
+	if job.DownloadURLTrace != "" {
+		paths = append(paths, filepath.Join("public", filepath.Base(job.DownloadURLTrace)))
+	}
+	removed := []string{"job entry"}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Job %s: could not remove %s: %v", job.ID, path, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+	return removed
+}
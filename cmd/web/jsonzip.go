@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/archive"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// jsonZipErrorsFile lists the files that failed in the per-invoice JSON archive.
+const jsonZipErrorsFile = "errors.json"
+
+// jsonZipError is one failed file in errors.json.
+type jsonZipError struct {
+	SourceFile string `json:"source_file"`
+	ErrorCode  string `json:"error_code"`
+	Error      string `json:"error"`
+}
+
+// handleJSONZip streams a zip archive with one JSON file per invoice of a completed job, named after
+// the source file (GET /api/v1/results/<jobID>/json.zip). Each file holds an invoice.ExportRecord with the
+// resolved counterparty ID and validation warnings; failed files are listed in errors.json. The archive
+// is written straight to the response, nothing is stored on disk.
+func handleJSONZip(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+	if job.Status != api.StatusCompleted {
+		jsonError(w, fmt.Sprintf("Results are not available in status %q", job.Status), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+"-invoices-json.zip"))
+	if err := writeJSONZip(w, job.AllResults); err != nil {
+		log.Printf("Failed to stream the JSON archive of job %s (correlation ID %s): %v", jobID, job.CorrelationID, err)
+	}
+}
+
+// writeJSONZip writes the per-invoice JSON files and errors.json to w.
+func writeJSONZip(w io.Writer, results []api.Result) error {
+	zw := zip.NewWriter(w)
+	used := map[string]bool{jsonZipErrorsFile: true}
+	failed := []jsonZipError{}
+	for _, res := range results {
+		if res.IsSkipped() {
+			continue // Documents that are not invoices are neither exported nor failed
+		}
+		record, ok := invoice.NewExportRecord(res.Result)
+		if !ok {
+			failed = append(failed, jsonZipError{SourceFile: res.SourceFile, ErrorCode: res.ErrorCode, Error: res.ErrorMessage})
+			continue
+		}
+		if err := writeZipJSON(zw, jsonZipName(res.Result, used), record); err != nil {
+			return err
+		}
+	}
+	if err := writeZipJSON(zw, jsonZipErrorsFile, failed); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// jsonZipName returns the archive name of an invoice: the source file without its extension, with the
+// invoice index for files holding several invoices and a numeric suffix if the name is already taken
+// (e.g. scan.pdf and scan.png).
+func jsonZipName(res invoice.Result, used map[string]bool) string {
+	base := archive.SafeName(strings.TrimSuffix(res.SourceFile, path.Ext(res.SourceFile)))
+	if base == "" {
+		base = "invoice"
+	}
+	if res.InvoiceCount > 1 {
+		base += "-" + strconv.Itoa(res.InvoiceIndex)
+	}
+	name := base + ".json"
+	for n := 2; used[name]; n++ {
+		name = base + "_" + strconv.Itoa(n) + ".json"
+	}
+	used[name] = true
+	return name
+}
+
+// writeZipJSON adds an indented JSON file to the archive.
+func writeZipJSON(zw *zip.Writer, name string, value any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
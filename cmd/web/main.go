@@ -2,73 +2,68 @@ package main
 
 import (
 	"archive/zip"
-	"embed"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
 	"io"
-	"io/fs"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sashabaranov/go-openai"
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/archive"
 	"github.com/veryevilzed/invpa/invoice"
-	"github.com/xuri/excelize/v2"
+	"github.com/veryevilzed/invpa/onec"
+	"github.com/veryevilzed/invpa/report"
 )
 
-// Global job store
-var jobs = make(map[string]*Job)
-var jobsMutex = &sync.Mutex{}
+// maxExtractSize limits the size of a file sent to /api/v1/extract
+const maxExtractSize = 20 << 20
 
-// Job holds all information about a processing task
-type Job struct {
-	ID                   string
-	Status               string // "Uploading", "Processing", "Completed", "Error"
-	Log                  []string
-	Error                string
-	ResultPath           string
-	DownloadURL          string
-	TotalFiles           int
-	ProcessedFiles       int
-	AllResults           []Result             `json:"-"` // Exclude from default status response
-	UniqueCounterparties []UniqueCounterparty `json:"-"` // Exclude from default status response
-}
+// extractTimeout bounds the processing time of a synchronous extraction
+var extractTimeout = 2 * time.Minute
 
-// JobResultData holds the data to be returned for the result tables
-type JobResultData struct {
-	AllResults           []Result
-	UniqueCounterparties []UniqueCounterparty
-}
+// counterpartiesDBMutex serializes access to the counterparties db file between jobs
+var counterpartiesDBMutex = &sync.Mutex{}
 
-// Structs for processing logic
-type Result struct {
-	SourceFile   string
-	Invoice      *invoice.Invoice
-	ErrorMessage string
-}
-
-type UniqueCounterparty struct {
-	SourceFile   string
-	Counterparty invoice.Counterparty
+// Job holds all information about a processing task. The embedded status is the /status response.
+type Job struct {
+	api.JobStatus
+	AllResults           []api.Result                 `json:"-"` // Exclude from default status response
+	UniqueCounterparties []invoice.UniqueCounterparty `json:"-"` // Exclude from default status response
+	MyCompany            invoice.Counterparty         `json:"-"` // Company the job was processed for, used by exports
+	roundingPolicy       invoice.RoundingPolicy       // Rounding policy the job was processed with, used by exports
+	confidenceThreshold  float64                      // Low-confidence threshold the job was processed with, used by the results table
+	created              time.Time                    // Upload time, jobs expire jobTTL after it
+	sourcesExpire        time.Time                    // Retained source files are removed after it (zero: together with the job)
+	retryable            map[string]int               // Files that failed because OpenAI was rate limited or unavailable -> automatic retries made
+	cancel               context.CancelFunc           // Cancels in-flight processing of the job
+	callbackURL          string                       // Webhook of the upload, overrides webhook_url of the config
+	baseURL              string                       // Scheme and host of the upload request, prefixes report links in the webhook
+	pdfPassword          string                       // PDF password of the upload form; never reported back
+	csvReport            *bool                        // csv_report of the upload form; nil: csv_report of the config
 }
 
-//go:embed templates/*.html
-var templatesFS embed.FS
-
-//go:embed static
-var staticFS embed.FS
-
-var templates *template.Template
-
 func main() {
 	port := flag.String("port", "8080", "Port for the web server")
+	flag.DurationVar(&extractTimeout, "extract-timeout", extractTimeout, "Timeout of a synchronous /api/v1/extract request")
+	flag.DurationVar(&jobTTL, "job-ttl", jobTTL, "How long finished jobs and their reports are kept")
+	reprocessInterval := flag.Duration("reprocess-interval", 5*time.Minute, "How often files that failed because OpenAI was rate limited or unavailable are retried (auto_reprocess in config.json)")
+	assetsDir := flag.String("assets", "", "Serve templates and static files from this directory (e.g. cmd/web) instead of the embedded copies, reloading templates on every request")
 	flag.Parse()
 
 	if err := os.MkdirAll("temp", os.ModePerm); err != nil {
@@ -78,33 +73,69 @@ func main() {
 		log.Fatalf("Could not create public directory: %v", err)
 	}
 
-	var err error
-	templates, err = template.ParseFS(templatesFS, "templates/*.html")
+	// Every job reads config.json, so a broken config is refused here rather than after an upload
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		log.Fatalf("Could not load config.json: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config.json:\n%v", err)
+	}
+	// Authentication is optional: without credentials every request is allowed
+	auth, err := loadAuthConfig(config)
 	if err != nil {
-		log.Fatalf("Error parsing templates: %v", err)
+		log.Fatalf("Invalid authentication settings: %v", err)
+	}
+	if _, err := onec.ParseFormat(config.OneCFormat); err != nil {
+		log.Fatalf("Invalid 'onec_format' in config.json: %v", err)
+	}
+	if config.WebhookURL != "" {
+		if err := validateCallbackURL(config.WebhookURL); err != nil {
+			log.Fatalf("Invalid 'webhook_url' in config.json: %v", err)
+		}
 	}
 
-	staticRoot, err := fs.Sub(staticFS, "static")
+	if err := loadAssets(*assetsDir); err != nil {
+		log.Fatalf("Error loading templates: %v", err)
+	}
+	static, err := staticHandler()
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticRoot))))
+	http.Handle("/static/", static)
 	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir("public"))))
 
 	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/upload", handleUpload)
 	http.HandleFunc("/result/", handleResultPage)
-	http.HandleFunc("/status/", handleStatus)
-	http.HandleFunc("/api/results/", handleJobResultData)
+	http.HandleFunc("/jobs", handleJobsPage)
+	registerAPI(http.DefaultServeMux)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/readyz", handleReadyz)
+	go cleanupInspections(time.Minute)
+	go expireJobs(time.Hour)
+	go reprocessFailed(*reprocessInterval)
 
+	if auth.enabled() {
+		fmt.Println("Authentication is enabled.")
+	}
 	fmt.Printf("Starting server on :%s\n", *port)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
+	if err := http.ListenAndServe(":"+*port, auth.requireAuth(http.DefaultServeMux)); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func handleIndex(w http.ResponseWriter, r *http.Request) {
-	err := templates.ExecuteTemplate(w, "index.html", nil)
+	// Company aliases from config.json are offered in the upload form; without a config the form has no selector.
+	// The CSV report checkbox starts from csv_report of the config.
+	var data struct {
+		Companies []string
+		CSVReport bool
+	}
+	if config, err := report.LoadConfig("config.json"); err == nil {
+		data.Companies = config.CompanyAliases()
+		data.CSVReport = config.CSVReport
+	}
+	err := executeTemplate(w, "index.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -112,31 +143,112 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	// Increase max memory for multipart form
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		jsonError(w, "Could not parse multipart form", http.StatusInternalServerError)
+	if !negotiateJSON(w, r) {
 		return
 	}
 
-	file, header, err := r.FormFile("zipfile")
-	if err != nil {
-		jsonError(w, "Could not get uploaded file", http.StatusBadRequest)
+	if !parseUploadForm(w, r) {
 		return
 	}
-	defer file.Close()
+
+	// The archive is either uploaded now or was kept by /api/v1/inspect
+	var kept *inspection
+	var file multipart.File
+	var zipName string
+	if token := r.FormValue(api.FieldInspectionToken); token != "" {
+		var ok bool
+		if kept, ok = claimInspection(token); !ok {
+			jsonError(w, "Inspection not found or expired, upload the archive again", http.StatusNotFound)
+			return
+		}
+		defer os.RemoveAll(kept.dir)
+		zipName = kept.zipName
+	} else {
+		var header *multipart.FileHeader
+		var err error
+		if file, header, err = r.FormFile(api.FieldZipFile); err != nil {
+			jsonError(w, "Could not get uploaded file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		if err := checkArchive(file); err != nil {
+			jsonError(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		zipName = filepath.Base(header.Filename)
+	}
 
 	// Get company details from form
 	myCompanyOverride := invoice.Counterparty{
-		Name:    r.FormValue("company_name"),
-		VAT:     r.FormValue("company_vat"),
-		Country: r.FormValue("company_country"),
-		Address: r.FormValue("company_address"),
-		IBAN:    r.FormValue("company_iban"),
-		SWIFT:   r.FormValue("company_swift"),
+		Name:    r.FormValue(api.FieldCompanyName),
+		VAT:     r.FormValue(api.FieldCompanyVAT),
+		Country: r.FormValue(api.FieldCompanyCountry),
+		Address: r.FormValue(api.FieldCompanyAddress),
+		IBAN:    r.FormValue(api.FieldCompanyIBAN),
+		SWIFT:   r.FormValue(api.FieldCompanySWIFT),
+	}
+	// Alternatively one of the companies defined in config.json is selected by its alias
+	companyAlias := strings.TrimSpace(r.FormValue(api.FieldCompany))
+	if companyAlias != "" {
+		if myCompanyOverride.Name != "" {
+			jsonError(w, "Specify either a company alias or company details, not both", http.StatusBadRequest)
+			return
+		}
+		config, err := report.LoadConfig("config.json")
+		if err != nil {
+			jsonError(w, fmt.Sprintf("Could not load config.json: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if _, err := config.Company(companyAlias); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	language := negotiateLanguage(r.FormValue(api.FieldLanguage), r.Header.Get("Accept-Language"))
+
+	correlationID := strings.TrimSpace(r.Header.Get(api.CorrelationIDHeader))
+	if correlationID == "" {
+		correlationID = strings.TrimSpace(r.FormValue(api.FieldCorrelationID))
+	}
+	if correlationID == "" {
+		correlationID = uuid.New().String()
+	}
+	if len(correlationID) > 128 {
+		jsonError(w, "Correlation ID must not exceed 128 characters", http.StatusBadRequest)
+		return
+	}
+
+	labels, err := validateLabels(strings.Split(r.FormValue(api.FieldTags), ","), r.FormValue(api.FieldNote))
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var csvReport *bool
+	if value := r.FormValue(api.FieldCSVReport); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			jsonError(w, fmt.Sprintf("Invalid '%s', expected true or false", api.FieldCSVReport), http.StatusBadRequest)
+			return
+		}
+		csvReport = &enabled
+	}
+
+	callbackURL := strings.TrimSpace(r.FormValue(api.FieldCallbackURL))
+	if callbackURL != "" {
+		config, err := report.LoadConfig("config.json")
+		if err != nil {
+			jsonError(w, fmt.Sprintf("Could not load config.json: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := validateUploadCallbackURL(callbackURL, config.WebhookAllowedHosts); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	jobID := uuid.New().String()
@@ -146,381 +258,1053 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	zipPath := filepath.Join(jobDir, header.Filename)
-	dst, err := os.Create(zipPath)
-	if err != nil {
-		jsonError(w, "Could not save zip file", http.StatusInternalServerError)
+	zipPath := filepath.Join(jobDir, zipName)
+	if kept != nil {
+		if err := os.Rename(filepath.Join(kept.dir, kept.zipName), zipPath); err != nil {
+			jsonError(w, "Could not move the inspected zip file", http.StatusInternalServerError)
+			return
+		}
+	} else if err := saveUpload(zipPath, file); err != nil {
+		jsonError(w, "Could not save zip file content", http.StatusInternalServerError)
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		jsonError(w, "Could not save zip file content", http.StatusInternalServerError)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{JobStatus: api.JobStatus{ID: jobID, CorrelationID: correlationID, Status: api.StatusProcessing, Language: language, Company: companyAlias, Log: []api.LogEntry{newLogEntry(language, msgUploaded)}, Tags: labels.Tags, Note: labels.Note}, created: time.Now(), cancel: cancel, callbackURL: callbackURL, baseURL: requestBaseURL(r), pdfPassword: r.FormValue(api.FieldPDFPassword), csvReport: csvReport}
+	if err := jobs.Create(job); err != nil {
+		cancel()
+		jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Job %s created (correlation ID %s, language %s)", jobID, correlationID, language)
 
-	jobsMutex.Lock()
-	jobs[jobID] = &Job{ID: jobID, Status: "Processing", Log: []string{"File uploaded successfully."}}
-	jobsMutex.Unlock()
-
-	go processInvoices(jobID, myCompanyOverride)
+	startJob(ctx, cancel, jobID, myCompanyOverride, companyAlias)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"job_id": jobID})
+	w.Header().Set(api.CorrelationIDHeader, correlationID)
+	json.NewEncoder(w).Encode(api.UploadResponse{JobID: jobID, CorrelationID: correlationID})
+}
+
+// startJob processes the files of a created job in the background. The webhook is posted when the job ends.
+func startJob(ctx context.Context, cancel context.CancelFunc, jobID string, myCompanyOverride invoice.Counterparty, companyAlias string) {
+	go func() {
+		defer cancel()
+		defer notifyWebhook(jobID, nil)
+		defer recoverJob(jobID)
+		processInvoices(ctx, jobID, myCompanyOverride, companyAlias)
+	}()
 }
 
 func handleResultPage(w http.ResponseWriter, r *http.Request) {
 	jobID := strings.TrimPrefix(r.URL.Path, "/result/")
-	jobsMutex.Lock()
-	_, ok := jobs[jobID]
-	jobsMutex.Unlock()
+	_, ok := jobs.Get(jobID)
 
 	if !ok {
-		http.Error(w, "Job not found", http.StatusNotFound)
+		http.Error(w, jobNotFound(), http.StatusNotFound)
 		return
 	}
 
-	err := templates.ExecuteTemplate(w, "result.html", map[string]string{"JobId": jobID})
+	err := executeTemplate(w, "result.html", map[string]string{"JobId": jobID})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
-	jobID := strings.TrimPrefix(r.URL.Path, "/status/")
-	jobsMutex.Lock()
-	job, ok := jobs[jobID]
-	jobsMutex.Unlock()
+	if !negotiateJSON(w, r) {
+		return
+	}
+	jobID := strings.TrimPrefix(r.URL.Path, api.PathPrefix+"/status/")
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+
+	// The job keeps the full log; ?level= only trims the response
+	status := job.JobStatus
+	if value := r.URL.Query().Get(api.ParamLevel); value != "" {
+		level, err := api.ParseLogLevel(value)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status.Log = api.FilterLog(status.Log, level)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
 
+// handleCancel stops a running job. Files processed so far are kept and a
+// partial report is still generated.
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !negotiateJSON(w, r) {
+		return
+	}
+	jobID := strings.TrimPrefix(r.URL.Path, api.PathPrefix+"/cancel/")
+	var correlationID, status string
+	ok := jobs.Update(jobID, func(job *Job) {
+		correlationID, status = job.CorrelationID, job.Status
+		if job.Status == api.StatusProcessing {
+			job.Status = api.StatusCancelled
+			job.Log = append(job.Log, newLogEntry(job.Language, msgCancelRequested))
+			job.cancel()
+		}
+	})
 	if !ok {
-		jsonError(w, "Job not found", http.StatusNotFound)
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, correlationID)
+	if status != api.StatusProcessing {
+		jsonError(w, fmt.Sprintf("Job cannot be cancelled in status %q", status), http.StatusConflict)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(job)
+	json.NewEncoder(w).Encode(api.CancelResponse{JobID: jobID, Status: api.StatusCancelled})
 }
 
-func handleJobResultData(w http.ResponseWriter, r *http.Request) {
-	jobID := strings.TrimPrefix(r.URL.Path, "/api/results/")
-	jobsMutex.Lock()
-	job, ok := jobs[jobID]
-	jobsMutex.Unlock()
+// isJobFinished reports whether the job results are available.
+func isJobFinished(job Job) bool {
+	return job.Finished()
+}
 
-	if !ok || job.Status != "Completed" {
+func handleJobResultData(w http.ResponseWriter, r *http.Request) {
+	jobID := strings.TrimPrefix(r.URL.Path, api.PathPrefix+"/results/")
+	// Downloads have their own content types; every other route responds with JSON
+	if jobID, ok := strings.CutSuffix(jobID, "/export"); ok {
+		handleResultsExport(w, r, jobID)
+		return
+	}
+	if jobID, ok := strings.CutSuffix(jobID, "/json.zip"); ok {
+		handleJSONZip(w, r, jobID)
+		return
+	}
+	if jobID, ok := strings.CutSuffix(jobID, "/1c"); ok {
+		handleOneCExport(w, r, jobID)
+		return
+	}
+	if !negotiateJSON(w, r) {
+		return
+	}
+	if jobID, ok := strings.CutSuffix(jobID, "/merge"); ok {
+		handleMergeCounterparties(w, r, jobID)
+		return
+	}
+	if jobID, ok := strings.CutSuffix(jobID, "/regenerate"); ok {
+		handleRegenerateReports(w, r, jobID)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		jobID, index, _ := strings.Cut(jobID, "/")
+		handleEditResult(w, r, jobID, index)
+		return
+	}
+	jobID, itemID, isItem := strings.Cut(jobID, "/item/")
+	job, ok := jobs.Get(jobID)
+	if !ok || !isJobFinished(job) {
 		jsonError(w, "Job not found or not completed", http.StatusNotFound)
 		return
 	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
 
-	data := JobResultData{
-		AllResults:           job.AllResults,
+	if isItem {
+		for _, res := range job.AllResults {
+			if res.ID == itemID {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+		}
+		jsonError(w, "Result not found", http.StatusNotFound)
+		return
+	}
+
+	filter, err := parseResultFilter(r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, total := filter.apply(job.AllResults)
+
+	data := api.JobResultData{
+		AllResults:           results,
 		UniqueCounterparties: job.UniqueCounterparties,
+		ConfidenceThreshold:  job.confidenceThreshold,
+		Total:                total,
+		JobTotal:             len(job.AllResults),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
 
-func addLog(jobID, message string) {
-	jobsMutex.Lock()
-	defer jobsMutex.Unlock()
-	if job, ok := jobs[jobID]; ok {
-		job.Log = append(job.Log, message)
+// handleMergeCounterparties merges two unique counterparties of a completed job that the matching
+// failed to recognize as the same company: results pointing at MergeID are rewritten to the merged
+// KeepID counterparty, the duplicate is dropped and the reports are regenerated.
+func handleMergeCounterparties(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	if !requireJSONBody(w, r) {
+		return
+	}
+	var req api.MergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body, expected {\"keep_id\": ..., \"merge_id\": ...}", http.StatusBadRequest)
+		return
+	}
+	if req.KeepID == 0 || req.MergeID == 0 || req.KeepID == req.MergeID {
+		jsonError(w, "'keep_id' and 'merge_id' must be two different non-zero counterparty IDs", http.StatusBadRequest)
+		return
+	}
+
+	unlock, ok := lockReports(w, jobID)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+	if job.Status != api.StatusCompleted {
+		jsonError(w, fmt.Sprintf("Counterparties cannot be merged in status %q", job.Status), http.StatusConflict)
+		return
+	}
+	correlationID, results, counterparties := job.CorrelationID, job.AllResults, job.UniqueCounterparties
+	reports := job.reports()
+
+	keep, drop := -1, -1
+	for i, ucp := range counterparties {
+		switch ucp.Counterparty.ID {
+		case req.KeepID:
+			keep = i
+		case req.MergeID:
+			drop = i
+		}
+	}
+	if keep < 0 || drop < 0 {
+		jsonError(w, "Counterparty not found in the job", http.StatusNotFound)
+		return
+	}
+	kept, merged := counterparties[keep].Counterparty, counterparties[drop].Counterparty
+	survivor := invoice.MergeCounterparties(kept, merged)
+
+	// Copy on write: readers encode the previous slices without holding the lock.
+	newCounterparties := make([]invoice.UniqueCounterparty, 0, len(counterparties)-1)
+	for i, ucp := range counterparties {
+		switch i {
+		case keep:
+			ucp.Counterparty = survivor
+		case drop:
+			continue
+		}
+		newCounterparties = append(newCounterparties, ucp)
+	}
+	newResults := slices.Clone(results)
+	for i, res := range newResults {
+		if res.Invoice == nil || (res.Invoice.Counterparty.ID != req.KeepID && res.Invoice.Counterparty.ID != req.MergeID) {
+			continue
+		}
+		inv := *res.Invoice
+		inv.Counterparty = survivor
+		newResults[i].Invoice = &inv
+	}
+
+	if err := reports.regenerate(newResults, newCounterparties); err != nil {
+		log.Printf("Job %s (correlation ID %s): could not regenerate reports after merge: %v", jobID, correlationID, err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jobs.Update(jobID, func(job *Job) {
+		job.AllResults = newResults
+		job.UniqueCounterparties = newCounterparties
+		job.Log = append(job.Log, newLogEntry(job.Language, msgCounterpartiesMerged, merged.Name, merged.ID, survivor.Name, survivor.ID, r.RemoteAddr))
+	})
+	log.Printf("Job %s (correlation ID %s): [%s] %s", jobID, correlationID, msgCounterpartiesMerged,
+		localize(defaultLanguage, msgCounterpartiesMerged, merged.Name, merged.ID, survivor.Name, survivor.ID, r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.JobResultData{AllResults: newResults, UniqueCounterparties: newCounterparties, ConfidenceThreshold: job.confidenceThreshold})
 }
 
-func incrementProcessedCount(jobID string) {
-	jobsMutex.Lock()
-	defer jobsMutex.Unlock()
-	if job, ok := jobs[jobID]; ok {
-		job.ProcessedFiles++
+// handleVATExport returns the VAT summary of a completed job as CSV (default) or JSON.
+// Optional query params: from, to (YYYY-MM-DD), format (csv|json).
+func handleVATExport(w http.ResponseWriter, r *http.Request) {
+	jobID := strings.TrimPrefix(r.URL.Path, api.PathPrefix+"/export/vat/")
+	job, ok := jobs.Get(jobID)
+	if !ok || !isJobFinished(job) {
+		jsonError(w, "Job not found or not completed", http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+
+	from, err := parseDateParam(r.URL.Query().Get("from"))
+	if err != nil {
+		jsonError(w, "Invalid 'from' date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateParam(r.URL.Query().Get("to"))
+	if err != nil {
+		jsonError(w, "Invalid 'to' date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	summary := invoice.SummarizeVAT(resultInvoices(job.AllResults), job.MyCompany, from, to, job.roundingPolicy)
+
+	if r.URL.Query().Get("format") == "json" {
+		if !negotiateJSON(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+"-vat-summary.csv"))
+	if err := invoice.WriteVATSummaryCSV(w, summary); err != nil {
+		log.Printf("Failed to write VAT summary for job %s (correlation ID %s): %v", jobID, job.CorrelationID, err)
 	}
 }
 
-func setJobError(jobID, errorMsg string) {
-	jobsMutex.Lock()
-	defer jobsMutex.Unlock()
-	if job, ok := jobs[jobID]; ok {
-		job.Status = "Error"
-		job.Error = errorMsg
-		job.Log = append(job.Log, fmt.Sprintf("[ERROR] %s", errorMsg))
+// handleResultsExport streams the invoices of a finished job as JSON Lines, one invoice.ExportRecord
+// per line (GET /api/v1/results/<jobID>/export?format=jsonl). Files that failed are left out.
+func handleResultsExport(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != "jsonl" {
+		jsonError(w, fmt.Sprintf("Unsupported export format %q, expected jsonl", format), http.StatusBadRequest)
+		return
+	}
+	job, ok := jobs.Get(jobID)
+	if !ok || !isJobFinished(job) {
+		jsonError(w, "Job not found or not completed", http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+
+	plain := make([]invoice.Result, len(job.AllResults))
+	for i, res := range job.AllResults {
+		plain[i] = res.Result
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+"-invoices.jsonl"))
+	if err := invoice.WriteJSONL(w, plain); err != nil {
+		log.Printf("Failed to export results of job %s (correlation ID %s): %v", jobID, job.CorrelationID, err)
 	}
 }
 
-func processInvoices(jobID string, myCompanyOverride invoice.Counterparty) {
+// handleExtract extracts invoices from a single uploaded file (field "file", the PDF password in the optional
+// field "pdf_password") and returns them as JSON. Counterparty matching is not performed. A file that would
+// take long is not processed inline: the response is 202 with a job (see extractAsynchronously).
+func handleExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !negotiateJSON(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxExtractSize)
+	if err := r.ParseMultipartForm(maxExtractSize); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonError(w, fmt.Sprintf("File exceeds the limit of %d MB", maxExtractSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		jsonError(w, "Could not parse multipart form", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		jsonError(w, "Could not get uploaded file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if !invoice.IsSupportedFile(header.Filename) {
+		jsonError(w, fmt.Sprintf("Unsupported file type %q (expected one of %s)", ext, strings.Join(invoice.SupportedExtensions, ", ")), http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		jsonError(w, "Could not read uploaded file", http.StatusBadRequest)
+		return
+	}
+
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Could not load config.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	mode, err := config.ExtractResponseMode()
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Invalid 'extract_response' in config.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	threshold, err := config.ExtractAsyncThreshold()
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Invalid 'extract_async_after' in config.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	pages := 0 // Pages are counted for the estimate of the auto mode only
+	if mode == invoice.ExtractResponseAuto {
+		pages = extractPages(r.Context(), header.Filename, data, config)
+	}
+	if extractAsynchronously(r, mode, threshold, pages) {
+		startExtractJob(w, r, header.Filename, data)
+		return
+	}
+
+	addPDFPassword(config, r.FormValue(api.FieldPDFPassword))
+	roundingPolicy, err := invoice.ParseRoundingPolicy(config.RoundingPolicy)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("Invalid 'rounding_policy' in config.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	processor, err := newProcessor(config, config.MyCompany, roundingPolicy)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), extractTimeout)
+	defer cancel()
+	started := time.Now()
+	// The file type comes from the extension of the uploaded name, as for files in archives
+	invoices, _, err := processor.ProcessBytes(ctx, data, invoice.ContentType(header.Filename))
+	if err != nil {
+		if errors.Is(err, invoice.ErrTimeout) {
+			jsonError(w, fmt.Sprintf("Extraction failed: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			jsonError(w, fmt.Sprintf("Extraction did not finish within %s", extractTimeout), http.StatusGatewayTimeout)
+			return
+		}
+		jsonError(w, fmt.Sprintf("Extraction failed: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	pageLatency.observe(time.Since(started), pages)
+	if invoices == nil {
+		invoices = []invoice.Invoice{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+// recoverJob turns a panic in a job goroutine into the job's Error status, so the job does not stay
+// "Processing" forever. It must be deferred directly in the goroutine.
+func recoverJob(jobID string) {
+	if r := recover(); r != nil {
+		log.Printf("Job %s panicked: %v\n%s", jobID, r, debug.Stack())
+		jobs.setJobError(jobID, errPanic, r)
+	}
+}
+
+func processInvoices(ctx context.Context, jobID string, myCompanyOverride invoice.Counterparty, companyAlias string) {
+	start := time.Now()
+	job, _ := jobs.Get(jobID)
+	correlationID, requestBase, pdfPassword, csvRequested := job.CorrelationID, job.baseURL, job.pdfPassword, job.csvReport
 	jobDir := filepath.Join("temp", jobID)
 	defer os.RemoveAll(jobDir)
 
-	addLog(jobID, "Unzipping uploaded file...")
 	zipPath := ""
 	dirEntries, err := os.ReadDir(jobDir)
 	if err != nil {
-		setJobError(jobID, fmt.Sprintf("Error reading job directory: %v", err))
+		jobs.setJobError(jobID, errReadJobDir, err)
 		return
 	}
+	// The uploaded archive is the only file in the job directory
 	for _, entry := range dirEntries {
-		if strings.HasSuffix(entry.Name(), ".zip") {
+		if entry.Type().IsRegular() {
 			zipPath = filepath.Join(jobDir, entry.Name())
 			break
 		}
 	}
 	if zipPath == "" {
-		setJobError(jobID, "No zip file found in job directory.")
+		jobs.setJobError(jobID, errNoZip)
 		return
 	}
-	if err := unzip(zipPath, jobDir); err != nil {
-		setJobError(jobID, fmt.Sprintf("Failed to unzip file: %v", err))
-		return
+	// A single invoice file of an asynchronous /api/v1/extract is processed as is
+	if !invoice.IsSupportedFile(zipPath) {
+		jobs.addLog(jobID, msgUnzipping)
+		if err := archive.Extract(zipPath, jobDir, archive.Options{}); err != nil {
+			jobs.setJobError(jobID, errUnzip, err)
+			return
+		}
 	}
 
-	addLog(jobID, "Scanning for invoice files...")
-	invoiceFiles, err := findInvoiceFiles(jobDir)
+	jobs.addLog(jobID, msgScanning)
+	invoiceFiles, err := report.FindInvoiceFiles(jobDir, report.FindOptions{Recursive: true, SkipAppleDouble: true})
 	if err != nil {
-		setJobError(jobID, fmt.Sprintf("Error scanning for files: %v", err))
+		jobs.setJobError(jobID, errScan, err)
 		return
 	}
 	if len(invoiceFiles) == 0 {
-		setJobError(jobID, "No invoice files (.pdf, .png, .jpg, .jpeg) found in the zip archive.")
+		jobs.setJobError(jobID, errNoInvoiceFiles)
 		return
 	}
 
-	jobsMutex.Lock()
-	jobs[jobID].TotalFiles = len(invoiceFiles)
-	jobsMutex.Unlock()
-	addLog(jobID, fmt.Sprintf("Found %d files to process. Starting analysis...", len(invoiceFiles)))
+	jobs.Update(jobID, func(job *Job) {
+		job.TotalFiles = len(invoiceFiles)
+	})
+	jobs.addLog(jobID, msgFilesFound, len(invoiceFiles))
 
 	// Determine which company data and API key to use
 	var myCompany invoice.Counterparty
-	var apiKey, popplerPath string
 
 	if myCompanyOverride.Name != "" {
-		addLog(jobID, "Using company data provided in the form.")
+		jobs.addLog(jobID, msgCompanyFromForm)
 		myCompany = myCompanyOverride
 	}
 
 	// Load config to get API key and fallback company data
-	config, err := loadConfig("config.json")
+	config, err := report.LoadConfig("config.json")
 	if err != nil {
-		setJobError(jobID, fmt.Sprintf("Could not load config.json: %v", err))
+		jobs.setJobError(jobID, errLoadConfig, err)
 		return
 	}
-	apiKey = config.OpenAPIKey
-	if runtime.GOOS == "windows" {
-		popplerPath = config.PopplerPathWindows
-	} else {
-		popplerPath = config.PopplerPathMac
-	}
-	if myCompanyOverride.Name == "" {
-		addLog(jobID, "Using company data from config.json.")
+	addPDFPassword(config, pdfPassword)
+	if myCompanyOverride.Name == "" && companyAlias != "" {
+		if myCompany, err = config.Company(companyAlias); err != nil {
+			jobs.setJobError(jobID, errCompany, err)
+			return
+		}
+		jobs.addLog(jobID, msgCompanyFromAlias, companyAlias)
+	} else if myCompanyOverride.Name == "" {
+		jobs.addLog(jobID, msgCompanyFromConfig)
 		myCompany = config.MyCompany
 	}
 
-	if apiKey == "" {
-		setJobError(jobID, "'openai_api_key' is not set in config.json.")
+	roundingPolicy, err := invoice.ParseRoundingPolicy(config.RoundingPolicy)
+	if err != nil {
+		jobs.setJobError(jobID, errRoundingPolicy, err)
 		return
 	}
-
-	client := openai.NewClient(apiKey)
-	resultsChan := make(chan Result, len(invoiceFiles))
-	var wg sync.WaitGroup
-
-	for _, file := range invoiceFiles {
-		wg.Add(1)
-		go func(f string) {
-			defer wg.Done()
-			addLog(jobID, fmt.Sprintf("Processing %s...", filepath.Base(f)))
-			invoices, err := invoice.ProcessFile(f, apiKey, popplerPath, myCompany)
-			incrementProcessedCount(jobID)
-			if err != nil {
-				resultsChan <- Result{SourceFile: filepath.Base(f), ErrorMessage: err.Error()}
-				return
-			}
-			if len(invoices) > 0 {
-				resultsChan <- Result{SourceFile: filepath.Base(f), Invoice: &invoices[0]}
-			} else {
-				resultsChan <- Result{SourceFile: filepath.Base(f), ErrorMessage: "No invoices found in file"}
-			}
-		}(file)
+	csvDelimiter, err := invoice.ParseCSVDelimiter(config.CSVDelimiter)
+	if err != nil {
+		jobs.setJobError(jobID, errCSVDelimiter, err)
+		return
+	}
+	sourceRetention, err := config.SourceRetentionPeriod()
+	if err != nil {
+		jobs.setJobError(jobID, errSourceRetention, err)
+		return
+	}
+	processor, err := newProcessor(config, myCompany, roundingPolicy)
+	if err != nil {
+		jobs.setJobError(jobID, errProcessor, err)
+		return
 	}
 
-	wg.Wait()
-	close(resultsChan)
-	addLog(jobID, "Analysis complete. Deduplicating counterparties and generating report...")
+	var processed []invoice.Result
+	var fileResults []invoice.FileResult
+	var fileTraces []*invoice.Trace
+	var batchTrace *invoice.Trace // Job-level phases; nil (a no-op) unless tracing is enabled
+	if config.Trace {
+		batchTrace = &invoice.Trace{}
+	}
+	concurrency := 0
+	degraded := processor.Degraded()
+	if degraded {
+		jobs.addLog(jobID, msgDegradedForced)
+	}
+	throttled := false
+	retryable := make(map[string]int)
+	for fr := range processor.ProcessBatch(invoice.WithJobID(ctx, jobID), invoiceFiles) {
+		fileResults = append(fileResults, fr)
+		if fr.Trace != nil {
+			fileTraces = append(fileTraces, fr.Trace)
+		}
+		name := invoice.SourceName(jobDir, fr.Path)
+		jobs.addUsage(jobID, name, fr.Usage, config.ModelPrices)
+		if fr.Concurrency > 0 && fr.Concurrency != concurrency {
+			concurrency = fr.Concurrency
+			metrics.setConcurrency(jobID, concurrency)
+			jobs.addLog(jobID, msgConcurrency, concurrency)
+		}
+		if ctx.Err() != nil && fr.Err != nil {
+			continue // job cancelled: the file was skipped or interrupted
+		}
+		if !degraded && processor.Degraded() {
+			degraded = true
+			jobs.addLog(jobID, msgDegradedSwitched)
+		}
+		if n, _ := processor.Throttled(); !throttled && n > 0 {
+			throttled = true
+			jobs.addLog(jobID, msgThrottled)
+		}
+		jobs.incrementProcessedCount(jobID)
+		switch {
+		case fr.Err == nil && len(fr.Invoices) > 0 && fr.Invoices[0].Extraction == invoice.ExtractionLocal:
+			jobs.addLog(jobID, msgFileLocal, name)
+		case fr.Err == nil && len(fr.Invoices) > 0 && fr.Usage.Requests == 0:
+			jobs.addLog(jobID, msgFileCached, name)
+		default:
+			jobs.addLog(jobID, msgFileProcessed, name)
+		}
+		if len(fr.Invoices) > 1 {
+			jobs.addLog(jobID, msgFileMultiInvoice, name, len(fr.Invoices))
+		}
+		processed = append(processed, fr.Results(name)...)
+		if retryableError(fr.Err) {
+			retryable[name] = 0
+		}
+	}
+	metrics.setConcurrency(jobID, 0)
+	jobs.addLog(jobID, msgAnalysisComplete)
 
-	var allResults []Result
-	var uniqueCounterparties []UniqueCounterparty
-	var existingForSearch []invoice.Counterparty
-	var successfulCount, errorCount int
+	// The counterparties db is shared between jobs, so load, deduplicate and save it under a lock.
+	counterpartiesDBMutex.Lock()
+	store := config.CounterpartyStore()
+	registry, err := invoice.LoadCounterpartyRegistry(store)
+	if err != nil {
+		counterpartiesDBMutex.Unlock()
+		jobs.setJobError(jobID, errLoadCounterparties, err)
+		return
+	}
+	dedup := processor.Deduplicate(invoice.WithTrace(context.Background(), batchTrace), processed, registry)
+	jobs.addUsage(jobID, "", dedup.MatchingUsage, config.ModelPrices)
+	if n, wait := processor.Throttled(); n > 0 {
+		jobs.addLog(jobID, msgThrottledTotal, n, wait.Round(time.Second))
+	}
+	if store != nil {
+		if err := store.Save(registry.Counterparties); err != nil {
+			jobs.addLog(jobID, msgSaveCounterparties, err)
+		}
+	}
+	counterpartiesDBMutex.Unlock()
 
-	for res := range resultsChan {
-		allResults = append(allResults, res)
-		if res.ErrorMessage != "" {
-			errorCount++
-			addLog(jobID, fmt.Sprintf("Error in %s: %s", res.SourceFile, res.ErrorMessage))
-			continue
+	// Keep the source files before the job directory is removed, so that suspicious rows can be checked
+	var sourceURLs map[string]string
+	if config.RetainSources {
+		var errs []error
+		sourceURLs, errs = retainSources(jobID, jobDir, invoiceFiles)
+		for _, err := range errs {
+			jobs.addLog(jobID, msgRetainSourcesFailed, err)
+		}
+		kept := jobTTL
+		if sourceRetention > 0 {
+			kept = sourceRetention
+			jobs.Update(jobID, func(job *Job) {
+				job.sourcesExpire = time.Now().Add(sourceRetention)
+			})
 		}
-		successfulCount++
+		jobs.addLog(jobID, msgSourcesRetained, len(sourceURLs), formatTTL(kept))
+	}
 
-		matched, err := invoice.FindCounterparty(client, existingForSearch, res.Invoice.Counterparty)
-		if err != nil {
-			addLog(jobID, fmt.Sprintf("WARN: Could not match counterparty for %s: %v", res.SourceFile, err))
-			// ID будет 0 (zero-value), что означает "новый"
-			uniqueCounterparties = append(uniqueCounterparties, UniqueCounterparty{SourceFile: res.SourceFile, Counterparty: res.Invoice.Counterparty})
-			existingForSearch = append(existingForSearch, res.Invoice.Counterparty)
-		} else if matched != nil {
-			res.Invoice.Counterparty = *matched
-		} else {
-			// ID будет 0 (zero-value), что означает "новый"
-			uniqueCounterparties = append(uniqueCounterparties, UniqueCounterparty{SourceFile: res.SourceFile, Counterparty: res.Invoice.Counterparty})
-			existingForSearch = append(existingForSearch, res.Invoice.Counterparty)
+	var allResults []api.Result
+	fileErrors := make(map[string]string)
+	for _, res := range processed {
+		if res.ErrorMessage != "" {
+			jobs.addLog(jobID, msgFileError, res.SourceFile, res.ErrorCode, res.ErrorMessage)
+			fileErrors[res.SourceFile] = res.ErrorCode
 		}
+		allResults = append(allResults, api.Result{ID: resultID(jobID, res.SourceFile, res.InvoiceIndex), SourceURL: sourceURLs[res.SourceFile], Result: res})
 	}
+	if len(fileErrors) > 0 {
+		jobs.Update(jobID, func(job *Job) {
+			job.FileErrors = fileErrors
+		})
+	}
+	for _, warning := range dedup.Warnings {
+		jobs.addLog(jobID, msgWarning, warning)
+	}
+	uniqueCounterparties := dedup.UniqueCounterparties
+	runSummary := invoice.NewRunSummary(len(invoiceFiles), processed, dedup, config.ModelPrices, time.Since(start))
 
 	resultFileName := fmt.Sprintf("%s.xlsx", jobID)
 	resultPath := filepath.Join("public", resultFileName)
-	err = generateExcelReport(resultPath, allResults, uniqueCounterparties)
+	vatSummary := invoice.SummarizeVAT(resultInvoices(allResults), myCompany, time.Time{}, time.Time{}, roundingPolicy)
+	job, _ = jobs.Get(jobID)
+	labels := api.JobLabels{Tags: job.Tags, Note: job.Note}
+	reportStarted := time.Now()
+	warnings, err := generateExcelReport(resultPath, correlationID, publicBaseURL(config, requestBase), labels, allResults, uniqueCounterparties, vatSummary, dedup.MatchingUsage, runSummary, config)
+	if err != nil {
+		jobs.setJobError(jobID, errExcelReport, err)
+		return
+	}
+	for _, warning := range warnings {
+		jobs.addLog(jobID, msgWarning, warning)
+	}
+	// The CSV report is built only when asked for: by the upload form or else by the config
+	csvReport := config.CSVReport
+	if csvRequested != nil {
+		csvReport = *csvRequested
+	}
+	csvFileName := ""
+	if csvReport {
+		csvFileName = fmt.Sprintf("%s_csv.zip", jobID)
+		err = generateCSVReport(filepath.Join("public", csvFileName), allResults, uniqueCounterparties, csvDelimiter)
+	}
+	batchTrace.Record(invoice.PhaseReport, reportStarted, err)
 	if err != nil {
-		setJobError(jobID, fmt.Sprintf("Failed to generate Excel report: %v", err))
+		jobs.setJobError(jobID, errCSVReport, err)
 		return
 	}
+	traceFileName := ""
+	var trace jobTrace
+	if config.Trace {
+		trace = newJobTrace(jobID, fileTraces, batchTrace)
+		metrics.observe(append(fileTraces, batchTrace))
+		traceFileName = fmt.Sprintf("%s_trace.json", jobID)
+		if err := writeJobTrace(filepath.Join("public", traceFileName), trace); err != nil {
+			jobs.addLog(jobID, msgWarning, fmt.Sprintf("Could not save the job trace: %v", err))
+			traceFileName = ""
+		}
+	}
 
-	jobsMutex.Lock()
-	if job, ok := jobs[jobID]; ok {
-		job.Status = "Completed"
+	jobs.Update(jobID, func(job *Job) {
+		if job.Status != api.StatusCancelled {
+			job.Status = api.StatusCompleted
+		}
 		job.ResultPath = resultPath
 		job.DownloadURL = "/public/" + resultFileName
+		if csvFileName != "" {
+			job.DownloadURLCSV = "/public/" + csvFileName
+		}
+		if traceFileName != "" {
+			job.DownloadURLTrace = "/public/" + traceFileName
+		}
 		job.AllResults = allResults
 		job.UniqueCounterparties = uniqueCounterparties
-		job.Log = append(job.Log, fmt.Sprintf("Successfully generated report with %d processed invoices.", successfulCount))
+		job.MyCompany = myCompany
+		job.roundingPolicy = roundingPolicy
+		job.confidenceThreshold = config.LowConfidenceThreshold()
+		if len(retryable) > 0 {
+			job.retryable = retryable
+		}
+		job.Summary = &runSummary
+		job.Log = append(job.Log, newLogEntry(job.Language, msgReportGenerated, dedup.Successful, dedup.Failed))
+		for _, line := range runSummary.Lines() {
+			job.Log = append(job.Log, newLogEntry(job.Language, msgSummary, line))
+		}
+		if timings := invoice.SummarizeFileTimings(processed); len(timings.Files) > 0 {
+			slowest := make([]string, 0, 3)
+			for _, f := range timings.Slowest(3) {
+				slowest = append(slowest, f.String())
+			}
+			job.Log = append(job.Log, newLogEntry(job.Language, msgSlowestFiles, timings.Line(), strings.Join(slowest, ", "), dedup.MatchingDuration.Round(100*time.Millisecond)))
+		}
+		if config.Trace {
+			job.Log = append(job.Log, newLogEntry(job.Language, msgTraceSummary, len(trace.Files), trace.Retries))
+			for _, line := range invoice.TraceTable(trace.Phases) {
+				job.Log = append(job.Log, newLogEntry(job.Language, msgTraceLine, line))
+			}
+		}
+	})
+	log.Printf("Job %s (correlation ID %s) finished: [%s] %s", jobID, correlationID, msgSummary, strings.Join(runSummary.Lines(), "; "))
+
+	if config.ArchivePath != "" {
+		archiveFiles(jobID, config.ArchivePath, jobDir, fileResults)
+	}
+}
+
+// archiveFiles stores the job's source files and results in the archive. It runs after the report
+// is ready and the archive may live on slow network storage, so failures are only logged.
+func archiveFiles(jobID, archivePath, jobDir string, fileResults []invoice.FileResult) {
+	archive, err := sharedArchive(archivePath)
+	if err != nil {
+		log.Printf("Job %s: could not open archive: %v", jobID, err)
+		jobs.addLog(jobID, msgArchiveFailed, err)
+		return
+	}
+	archived := 0
+	for _, fr := range fileResults {
+		name := invoice.SourceName(jobDir, fr.Path)
+		if err := archive.Store(jobID, name, fr); err != nil {
+			log.Printf("Job %s: could not archive %s: %v", jobID, name, err)
+			continue
+		}
+		archived++
+	}
+	jobs.addLog(jobID, msgArchived, archived, len(fileResults))
+}
+
+// The archives shared by all jobs, keyed by directory. Archive serializes index appends only within
+// one instance, so concurrent jobs must write through the same *invoice.Archive.
+var (
+	archiveMutex sync.Mutex
+	archives     = map[string]*invoice.Archive{}
+)
+
+// sharedArchive returns the process-wide archive for the directory, opening it on first use.
+func sharedArchive(dir string) (*invoice.Archive, error) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	if archive, ok := archives[dir]; ok {
+		return archive, nil
+	}
+	archive, err := invoice.OpenArchive(dir)
+	if err != nil {
+		return nil, err
 	}
-	jobsMutex.Unlock()
+	archives[dir] = archive
+	return archive, nil
 }
 
 // --- Helper Functions ---
 
+// The OpenAI client shared by all jobs and requests while the connection settings do not change.
+var (
+	clientMutex        sync.Mutex
+	cachedClient       *openai.Client
+	cachedClientConfig invoice.ClientConfig
+)
+
+// sharedClient returns the OpenAI client for the connection settings. config.json is read for every job,
+// so a new client is created only when the settings have changed since the previous call.
+func sharedClient(c invoice.ClientConfig) (*openai.Client, error) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	if cachedClient != nil && cachedClientConfig == c {
+		return cachedClient, nil
+	}
+	client, err := invoice.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	cachedClient, cachedClientConfig = client, c
+	return client, nil
+}
+
+var (
+	limiterMutex    sync.Mutex
+	cachedLimiter   *invoice.RateLimiter
+	cachedLimitRate int
+	cachedLimitConc int
+)
+
+// sharedLimiter returns the process-wide OpenAI request limiter, so that concurrent jobs share
+// requests_per_minute and max_concurrent_requests instead of each getting its own budget.
+// A new limiter is created only when the settings have changed; nil means no limit.
+func sharedLimiter(perMinute, maxConcurrent int) *invoice.RateLimiter {
+	limiterMutex.Lock()
+	defer limiterMutex.Unlock()
+	if perMinute != cachedLimitRate || maxConcurrent != cachedLimitConc {
+		cachedLimiter = invoice.NewRequestLimiter(perMinute, maxConcurrent)
+		cachedLimitRate, cachedLimitConc = perMinute, maxConcurrent
+	}
+	return cachedLimiter
+}
+
+// addPDFPassword puts the PDF password of an upload form in front of the pdf_passwords of the config.
+func addPDFPassword(config *invoice.Config, password string) {
+	if password != "" {
+		config.PDFPasswords = append([]string{password}, config.PDFPasswords...)
+	}
+}
+
+// newProcessor builds an invoice processor from the config.
+func newProcessor(config *invoice.Config, myCompany invoice.Counterparty, roundingPolicy invoice.RoundingPolicy) (*invoice.Processor, error) {
+	if err := config.ValidateNetwork(); err != nil {
+		return nil, fmt.Errorf("Invalid 'allow_network' in config.json: %v", err)
+	}
+	client, err := sharedClient(config.ClientConfig())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OpenAI settings in config.json: %v", err)
+	}
+	pageSelection, err := invoice.ParsePageSelection(config.PageSelection)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'page_selection' in config.json: %v", err)
+	}
+	extractionMode, err := invoice.ParseExtractionMode(config.ExtractionMode)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'extraction_mode' in config.json: %v", err)
+	}
+	if err := invoice.ValidateCategories(config.Categories); err != nil {
+		return nil, fmt.Errorf("Invalid 'categories' in config.json: %v", err)
+	}
+	renderOptions, err := config.RenderOptions()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PDF settings in config.json: %v", err)
+	}
+	promptTemplates, err := config.PromptTemplates()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid prompt templates in config.json: %v", err)
+	}
+	aliasOverrides, err := config.AliasOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'counterparty_aliases' in config.json: %v", err)
+	}
+	requestTimeout, err := config.RequestTimeoutLimit()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'request_timeout' in config.json: %v", err)
+	}
+	fileTimeout, err := config.FileTimeoutLimit()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'file_timeout' in config.json: %v", err)
+	}
+	var cache *invoice.ResultCache
+	if config.ResultCache {
+		if cache, err = invoice.NewResultCache(config.ResultCachePath); err != nil {
+			return nil, fmt.Errorf("Could not open result cache: %v", err)
+		}
+	}
+	options := []invoice.Option{
+		invoice.WithPageRenderer(invoice.PDFRenderer(renderOptions)),
+		invoice.WithMyCompany(myCompany),
+		invoice.WithRoundingPolicy(roundingPolicy),
+		invoice.WithThumbnails(config.ThumbnailSize),
+		invoice.WithPageSelection(pageSelection),
+		invoice.WithMaxAllPages(config.MaxAllPagesLimit()),
+		invoice.WithCache(cache),
+		invoice.WithDuplexRotation(config.DuplexRotation),
+		invoice.WithTextExtractor(invoice.PDFTextExtractor(renderOptions)),
+		invoice.WithExtractionMode(extractionMode),
+		invoice.WithCategories(config.Categories),
+		invoice.WithPromptTemplates(promptTemplates),
+		invoice.WithAliasOverrides(aliasOverrides),
+		invoice.WithRequestTimeout(requestTimeout),
+		invoice.WithFileTimeout(fileTimeout),
+		invoice.WithLogger(processorLogger),
+		invoice.WithAttachmentExtractor(invoice.PDFAttachmentExtractor(renderOptions)),
+		invoice.WithDegradedMode(config.DegradedMode, config.DegradedAfter),
+		invoice.WithCurrencyAutoCorrect(config.CurrencyAutoCorrect),
+		invoice.WithConcurrency(config.Concurrency),
+		invoice.WithJSONRepair(config.RepairAttempts()),
+		invoice.WithModel(config.ModelName()),
+		invoice.WithTracing(config.Trace),
+		invoice.WithRateLimiter(sharedLimiter(config.RequestsPerMinute, config.ConcurrentRequests)),
+	}
+	if config.AdaptiveConcurrency {
+		options = append(options, invoice.WithAdaptiveConcurrency(config.ConcurrencyBounds()))
+	}
+	return invoice.NewProcessor(client, options...), nil
+}
+
+// resultID derives a stable identifier for a result from the job, the source file
+// and the position of the invoice in the file, so it survives report regeneration and edits.
+func resultID(jobID, sourceFile string, invoiceIndex int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", jobID, sourceFile, invoiceIndex)))
+	return hex.EncodeToString(sum[:8])
+}
+
 func jsonError(w http.ResponseWriter, error string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": error})
+	json.NewEncoder(w).Encode(api.ErrorResponse{Error: api.ErrorBody{Code: api.ErrorCodeForStatus(code), Message: error}})
 }
 
-func unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
+func parseDateParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
 	}
-	defer r.Close()
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
-			continue
-		}
-		if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-			return err
-		}
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			outFile.Close()
-			return err
+	return time.Parse("2006-01-02", value)
+}
+
+// resultInvoices returns the successfully extracted invoices from a result set.
+func resultInvoices(results []api.Result) []invoice.Invoice {
+	var invoices []invoice.Invoice
+	for _, res := range results {
+		if res.Invoice != nil && !res.IsDuplicate() {
+			invoices = append(invoices, *res.Invoice)
 		}
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
-		if err != nil {
-			return err
+	}
+	return invoices
+}
+
+// generateExcelReport writes the job report. Source files of results with a SourceURL are linked from
+// the "Source File" cells through baseURL. It returns warnings about previews that could not be embedded.
+func generateExcelReport(path, correlationID, baseURL string, labels api.JobLabels, allResults []api.Result, counterparties []invoice.UniqueCounterparty, vatSummary invoice.VATSummary, matchingUsage invoice.Usage, runSummary invoice.RunSummary, config *invoice.Config) ([]string, error) {
+	results, links := reportResults(allResults, baseURL)
+	data := report.Data{
+		Results:        results,
+		Counterparties: counterparties,
+		VATSummary:     vatSummary,
+		MatchingUsage:  matchingUsage,
+		Summary:        runSummary,
+	}
+	opts := report.Options{SourceLinks: links, SummaryRows: labelRows(labels), CorrelationID: correlationID}
+	var warnings []string
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		var err error
+		warnings, err = report.WriteExcel(w, data, config, opts)
+		return err
+	})
+	return warnings, err
+}
+
+// reportResults returns the plain results for the report package and the absolute links
+// to the retained source files by source name.
+func reportResults(allResults []api.Result, baseURL string) ([]invoice.Result, map[string]string) {
+	results := make([]invoice.Result, len(allResults))
+	links := make(map[string]string)
+	for i, res := range allResults {
+		results[i] = res.Result
+		if res.SourceURL != "" {
+			links[res.SourceFile] = baseURL + res.SourceURL
 		}
 	}
-	return nil
+	return results, links
 }
 
-func findInvoiceFiles(root string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+// generateCSVReport writes a zip archive with invoices.csv and counterparties.csv,
+// using the same columns as the Excel report.
+func generateCSVReport(path string, allResults []api.Result, counterparties []invoice.UniqueCounterparty, delimiter rune) error {
+	results, _ := reportResults(allResults, "")
+	invoiceRows := report.InvoiceRows(results, false)
+	counterpartyRows := report.CounterpartyRows(counterparties)
+	return writeFileAtomic(path, func(file io.Writer) error {
+		return writeCSVZip(file, invoiceRows, counterpartyRows, delimiter)
+	})
+}
+
+func writeCSVZip(file io.Writer, invoiceRows, counterpartyRows [][]any, delimiter rune) error {
+	zw := zip.NewWriter(file)
+	tables := []struct {
+		name   string
+		header []string
+		rows   [][]any
+	}{
+		{"invoices.csv", report.InvoiceHeaders, invoiceRows},
+		{"counterparties.csv", report.CounterpartyHeaders, counterpartyRows},
+	}
+	for _, table := range tables {
+		w, err := zw.Create(table.name)
 		if err != nil {
 			return err
 		}
-		// Ignore dot-underscore files created by macOS
-		if !info.IsDir() && !strings.HasPrefix(info.Name(), "._") {
-			ext := strings.ToLower(filepath.Ext(path))
-			if ext == ".pdf" || ext == ".png" || ext == ".jpg" || ext == ".jpeg" {
-				files = append(files, path)
-			}
+		if err := invoice.WriteCSVTable(w, delimiter, table.header, table.rows); err != nil {
+			return err
 		}
-		return nil
-	})
-	return files, err
+	}
+	return zw.Close()
 }
 
-func loadConfig(path string) (*invoice.Config, error) {
-	file, err := os.Open(path)
+// writeFileAtomic writes a file through a temp file in the same directory and renames it into place,
+// so a download never observes a partially written report.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".report-*")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer file.Close()
-	var config invoice.Config
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	return &config, err
-}
-
-func generateExcelReport(path string, allResults []Result, counterparties []UniqueCounterparty) error {
-	f := excelize.NewFile()
-	defer f.Close()
-	f.NewSheet("Invoices")
-	f.DeleteSheet("Sheet1")
-	headers := []string{"Source File", "Status", "Counterparty ID", "Counterparty Name", "Counterparty VAT", "Counterparty Country", "Invoice Number", "Date", "Total Amount", "Tax Amount", "Currency", "Purpose"}
-	for i, h := range headers {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue("Invoices", cell, h)
+	defer os.Remove(tmp.Name())
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
-	for i, res := range allResults {
-		row := i + 2
-		f.SetCellValue("Invoices", fmt.Sprintf("A%d", row), res.SourceFile)
-		if res.ErrorMessage != "" {
-			f.SetCellValue("Invoices", fmt.Sprintf("B%d", row), res.ErrorMessage)
-			style, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "9A0511"}})
-			f.SetCellStyle("Invoices", fmt.Sprintf("B%d", row), fmt.Sprintf("B%d", row), style)
-		} else {
-			f.SetCellValue("Invoices", fmt.Sprintf("B%d", row), "OK")
-			cp := res.Invoice.Counterparty
-			f.SetCellValue("Invoices", fmt.Sprintf("C%d", row), cp.ID)
-			f.SetCellValue("Invoices", fmt.Sprintf("D%d", row), cp.Name)
-			f.SetCellValue("Invoices", fmt.Sprintf("E%d", row), cp.VAT)
-			f.SetCellValue("Invoices", fmt.Sprintf("F%d", row), cp.Country)
-			f.SetCellValue("Invoices", fmt.Sprintf("G%d", row), res.Invoice.Number)
-			f.SetCellValue("Invoices", fmt.Sprintf("H%d", row), res.Invoice.Date)
-			f.SetCellValue("Invoices", fmt.Sprintf("I%d", row), res.Invoice.TotalAmount)
-			f.SetCellValue("Invoices", fmt.Sprintf("J%d", row), res.Invoice.TaxAmount)
-			f.SetCellValue("Invoices", fmt.Sprintf("K%d", row), res.Invoice.Currency)
-			f.SetCellValue("Invoices", fmt.Sprintf("L%d", row), res.Invoice.Purpose)
-		}
-	}
-	f.NewSheet("Counterparties")
-	cpHeaders := []string{"Source File", "ID", "Name", "VAT", "Country", "Country Code", "Address", "IBAN", "SWIFT", "Phone", "Email", "Website"}
-	for i, h := range cpHeaders {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue("Counterparties", cell, h)
+	if err != nil {
+		return err
 	}
-	for i, ucp := range counterparties {
-		row := i + 2
-		cp := ucp.Counterparty
-		f.SetCellValue("Counterparties", fmt.Sprintf("A%d", row), ucp.SourceFile)
-		f.SetCellValue("Counterparties", fmt.Sprintf("B%d", row), cp.ID)
-		f.SetCellValue("Counterparties", fmt.Sprintf("C%d", row), cp.Name)
-		f.SetCellValue("Counterparties", fmt.Sprintf("D%d", row), cp.VAT)
-		f.SetCellValue("Counterparties", fmt.Sprintf("E%d", row), cp.Country)
-		f.SetCellValue("Counterparties", fmt.Sprintf("F%d", row), cp.CountryCode)
-		f.SetCellValue("Counterparties", fmt.Sprintf("G%d", row), cp.Address)
-		f.SetCellValue("Counterparties", fmt.Sprintf("H%d", row), cp.IBAN)
-		f.SetCellValue("Counterparties", fmt.Sprintf("I%d", row), cp.SWIFT)
-		f.SetCellValue("Counterparties", fmt.Sprintf("J%d", row), cp.Phone)
-		f.SetCellValue("Counterparties", fmt.Sprintf("K%d", row), cp.Email)
-		f.SetCellValue("Counterparties", fmt.Sprintf("L%d", row), cp.Website)
-	}
-	return f.SaveAs(path)
+	return os.Rename(tmp.Name(), path)
 }
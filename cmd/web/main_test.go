@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// TestRecoverJobSetsErrorStatus panics in a job goroutine: the job ends with the panic error
+// instead of staying Processing.
+func TestRecoverJobSetsErrorStatus(t *testing.T) {
+	useTestDir(t, `{}`)
+	if err := jobs.Create(&Job{JobStatus: api.JobStatus{ID: "job-1", Status: api.StatusProcessing}}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverJob("job-1")
+		var results []api.Result
+		_ = results[1] // A bug in the job code
+	}()
+	<-done
+
+	job, _ := jobs.Get("job-1")
+	if job.Status != api.StatusError || job.ErrorID != errPanic || !strings.Contains(job.Error, "index out of range") {
+		t.Errorf("job after a panic: status %q, error [%s] %s", job.Status, job.ErrorID, job.Error)
+	}
+}
+
+func TestStatusLogLevel(t *testing.T) {
+	useTestDir(t, `{}`)
+	addCompletedJob(t, "job-1", testResults(1))
+	jobs.addLog("job-1", msgConcurrency, 4)
+	jobs.addProcessorLog("job-1", api.LogLevelError, "invoice-1.pdf: could not render pages")
+	jobs.addProcessorLog("job-1", api.LogLevelWarn, "invoice-2.pdf: currency differs")
+
+	status := func(query string) (int, []api.LogEntry) {
+		w := httptest.NewRecorder()
+		handleStatus(w, httptest.NewRequest(http.MethodGet, api.PathPrefix+"/status/job-1"+query, nil))
+		var status api.JobStatus
+		json.NewDecoder(w.Body).Decode(&status)
+		return w.Code, status.Log
+	}
+
+	_, full := status("")
+	code, errorsOnly := status("?level=error")
+	if code != http.StatusOK || len(errorsOnly) != 1 || errorsOnly[0].Level != api.LogLevelError {
+		t.Errorf("?level=error: %d, log %+v, want the ERROR entry", code, errorsOnly)
+	}
+	if _, warnings := status("?level=Warning"); len(warnings) != 2 {
+		t.Errorf("?level=Warning returned %d entries, want the WARN and ERROR ones", len(warnings))
+	}
+	if _, again := status(""); len(again) != len(full) {
+		t.Errorf("filtering changed the stored log: %d entries, was %d", len(again), len(full))
+	}
+	if code, _ := status("?level=verbose"); code != http.StatusBadRequest {
+		t.Errorf("?level=verbose responded %d, want 400", code)
+	}
+}
+
+// TestArchiveFilesConcurrently archives many jobs at once into one directory: they all write through
+// the same shared archive, and every record ends up in the index.
+func TestArchiveFilesConcurrently(t *testing.T) {
+	useTestDir(t, `{}`)
+	archivePath := filepath.Join(t.TempDir(), "archive")
+	first, err := sharedArchive(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := sharedArchive(archivePath); second != first {
+		t.Fatal("sharedArchive opened the same directory twice")
+	}
+
+	const jobCount, filesPerJob = 8, 5
+	var wg sync.WaitGroup
+	for j := range jobCount {
+		jobID := fmt.Sprintf("job-%d", j)
+		if err := jobs.Create(&Job{JobStatus: api.JobStatus{ID: jobID, Status: api.StatusProcessing}}); err != nil {
+			t.Fatal(err)
+		}
+		jobDir := filepath.Join("temp", jobID)
+		if err := os.MkdirAll(jobDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		var fileResults []invoice.FileResult
+		for i := range filesPerJob {
+			path := filepath.Join(jobDir, fmt.Sprintf("invoice-%d.pdf", i))
+			if err := os.WriteFile(path, []byte(jobID+path), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			inv := invoice.Invoice{Type: invoice.TypePaymentOrder, Number: fmt.Sprintf("%s-%d", jobID, i), Counterparty: invoice.Counterparty{Name: "ACME GmbH"}}
+			fileResults = append(fileResults, invoice.FileResult{Path: path, Invoices: []invoice.Invoice{inv}})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			archiveFiles(jobID, archivePath, jobDir, fileResults)
+		}()
+	}
+	wg.Wait()
+
+	records, err := first.Find(invoice.ArchiveQuery{Counterparty: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != jobCount*filesPerJob {
+		t.Errorf("archive index has %d records, want %d", len(records), jobCount*filesPerJob)
+	}
+}
+
+// TestCSVReportIsOptional builds the CSV report only when csv_report asks for it, and regeneration
+// does not create one for a job without it.
+func TestCSVReportIsOptional(t *testing.T) {
+	// Without network the job ends quickly: images cannot be processed locally
+	const offline = `"allow_network": false, "degraded_mode": true, "extract_response": "async"`
+	for _, tc := range []struct {
+		name, config string
+		want         bool
+	}{
+		{"default", `{` + offline + `}`, false},
+		{"csv_report", `{` + offline + `, "csv_report": true}`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestDir(t, tc.config)
+			var created api.UploadResponse
+			if err := json.Unmarshal(extractRequest(t, nil).Body.Bytes(), &created); err != nil {
+				t.Fatal(err)
+			}
+			waitForJob(t, created.JobID)
+			job, _ := jobs.Get(created.JobID)
+			if job.Status != api.StatusCompleted {
+				t.Fatalf("job ended %s: %s", job.Status, job.Error)
+			}
+			if (job.DownloadURLCSV != "") != tc.want {
+				t.Fatalf("DownloadURLCSV = %q", job.DownloadURLCSV)
+			}
+			if w := regenerateRequest(created.JobID); w.Code != http.StatusOK {
+				t.Fatalf("regenerate responded %d: %s", w.Code, w.Body)
+			}
+			csvFiles, _ := filepath.Glob(filepath.Join("public", "*.zip"))
+			if (len(csvFiles) > 0) != tc.want {
+				t.Errorf("CSV reports in public: %v", csvFiles)
+			}
+		})
+	}
+}
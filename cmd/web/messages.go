@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/veryevilzed/invpa/api"
+)
+
+// defaultLanguage is used when neither the upload form nor Accept-Language names a supported language.
+const defaultLanguage = "en"
+
+// Stable IDs of user-facing job messages. API clients may key their own translations on them,
+// so an ID must never change meaning once released.
+const (
+	msgUploaded             = "job.uploaded"
+	msgCancelRequested      = "job.cancel_requested"
+	msgUnzipping            = "job.unzipping"
+	msgScanning             = "job.scanning"
+	msgFilesFound           = "job.files_found"
+	msgCompanyFromForm      = "job.company_from_form"
+	msgCompanyFromConfig    = "job.company_from_config"
+	msgCompanyFromAlias     = "job.company_from_alias"
+	msgFileProcessed        = "job.file_processed"
+	msgFileCached           = "job.file_cached"
+	msgFileMultiInvoice     = "job.file_multiple_invoices"
+	msgAnalysisComplete     = "job.analysis_complete"
+	msgFileError            = "job.file_error"
+	msgWarning              = "job.warning"
+	msgSaveCounterparties   = "job.save_counterparties_failed"
+	msgReportGenerated      = "job.report_generated"
+	msgSummary              = "job.summary"
+	msgConcurrency          = "job.concurrency"
+	msgArchived             = "job.archived"
+	msgArchiveFailed        = "job.archive_failed"
+	msgCounterpartiesMerged = "job.counterparties_merged"
+	msgDegradedForced       = "job.degraded_forced"
+	msgDegradedSwitched     = "job.degraded_switched"
+	msgThrottled            = "job.throttled"
+	msgThrottledTotal       = "job.throttled_total"
+	msgFileLocal            = "job.file_local"
+	msgTraceSummary         = "job.trace_summary"
+	msgTraceLine            = "job.trace_line"
+	msgSlowestFiles         = "job.slowest_files"
+	msgWebhookDelivered     = "job.webhook_delivered"
+	msgResultEdited         = "job.result_edited"
+	msgReportsRegenerated   = "job.reports_regenerated"
+	msgWebhookFailed        = "job.webhook_failed"
+	msgSourcesRetained      = "job.sources_retained"
+	msgRetainSourcesFailed  = "job.retain_sources_failed"
+	msgProcessorLog         = "job.processor_log"
+	msgAutoRetryStarted     = "job.auto_retry_started"
+	msgAutoRetried          = "job.auto_retried"
+	msgAutoRetryFailed      = "job.auto_retry_failed"
+
+	errReadJobDir         = "error.read_job_dir"
+	errNoZip              = "error.no_zip"
+	errUnzip              = "error.unzip"
+	errScan               = "error.scan"
+	errNoInvoiceFiles     = "error.no_invoice_files"
+	errLoadConfig         = "error.load_config"
+	errRoundingPolicy     = "error.rounding_policy"
+	errCSVDelimiter       = "error.csv_delimiter"
+	errSourceRetention    = "error.source_retention"
+	errProcessor          = "error.processor"
+	errCompany            = "error.company"
+	errLoadCounterparties = "error.load_counterparties"
+	errExcelReport        = "error.excel_report"
+	errCSVReport          = "error.csv_report"
+	errPanic              = "error.panic"
+)
+
+// messageLevels are the log levels of messages other than INFO. Messages with the "error." prefix are ERROR.
+var messageLevels = map[string]string{
+	msgFileError:           api.LogLevelError,
+	msgWarning:             api.LogLevelWarn,
+	msgSaveCounterparties:  api.LogLevelWarn,
+	msgArchiveFailed:       api.LogLevelWarn,
+	msgWebhookFailed:       api.LogLevelWarn,
+	msgRetainSourcesFailed: api.LogLevelWarn,
+	msgAutoRetryFailed:     api.LogLevelWarn,
+	msgDegradedForced:      api.LogLevelWarn,
+	msgDegradedSwitched:    api.LogLevelWarn,
+	msgThrottled:           api.LogLevelWarn,
+	msgFileLocal:           api.LogLevelWarn,
+	msgConcurrency:         api.LogLevelDebug,
+	msgTraceSummary:        api.LogLevelDebug,
+	msgTraceLine:           api.LogLevelDebug,
+}
+
+// messageLevel returns the log level of a message.
+func messageLevel(id string) string {
+	if strings.HasPrefix(id, "error.") {
+		return api.LogLevelError
+	}
+	if level, ok := messageLevels[id]; ok {
+		return level
+	}
+	return api.LogLevelInfo
+}
+
+// messageCatalog maps message IDs to fmt format strings per language.
+// Every message must have an English text: it is the fallback and the server log language.
+var messageCatalog = map[string]map[string]string{
+	msgUploaded: {
+		"en": "File uploaded successfully.",
+		"ru": "Файл успешно загружен.",
+	},
+	msgCancelRequested: {
+		"en": "Cancellation requested. Finishing with the files processed so far...",
+		"ru": "Запрошена отмена. Завершаем работу с уже обработанными файлами...",
+	},
+	msgUnzipping: {
+		"en": "Extracting uploaded archive...",
+		"ru": "Распаковка загруженного файла...",
+	},
+	msgScanning: {
+		"en": "Scanning for invoice files...",
+		"ru": "Поиск файлов инвойсов...",
+	},
+	msgFilesFound: {
+		"en": "Found %d files to process. Starting analysis...",
+		"ru": "Найдено файлов для обработки: %d. Начинаем анализ...",
+	},
+	msgCompanyFromForm: {
+		"en": "Using company data provided in the form.",
+		"ru": "Используются данные компании из формы.",
+	},
+	msgCompanyFromConfig: {
+		"en": "Using company data from config.json.",
+		"ru": "Используются данные компании из config.json.",
+	},
+	msgCompanyFromAlias: {
+		"en": "Using company %q from config.json.",
+		"ru": "Используются данные компании %q из config.json.",
+	},
+	msgFileProcessed: {
+		"en": "Processed %s.",
+		"ru": "Обработан %s.",
+	},
+	msgFileCached: {
+		"en": "Processed %s (cached result, no OpenAI calls).",
+		"ru": "Обработан %s (результат из кэша, без запросов к OpenAI).",
+	},
+	msgFileLocal: {
+		"en": "Processed %s (degraded extraction from the PDF text layer, no OpenAI calls; check the data).",
+		"ru": "Обработан %s (деградированное извлечение из текстового слоя PDF, без запросов к OpenAI; проверьте данные).",
+	},
+	msgDegradedForced: {
+		"en": "Degraded mode is enabled in config.json: files are extracted locally without OpenAI, results are partial.",
+		"ru": "В config.json включен деградированный режим: файлы обрабатываются локально, без OpenAI, данные неполные.",
+	},
+	msgDegradedSwitched: {
+		"en": "OpenAI is unavailable: switched to degraded mode, remaining files are extracted locally and results are partial.",
+		"ru": "OpenAI недоступен: включен деградированный режим, оставшиеся файлы обрабатываются локально, данные неполные.",
+	},
+	msgThrottled: {
+		"en": "OpenAI requests are being throttled by the shared rate limit (requests_per_minute, max_concurrent_requests): processing is slower because other jobs use the same budget.",
+		"ru": "Запросы к OpenAI придерживаются общим лимитом (requests_per_minute, max_concurrent_requests): обработка идет медленнее, так как этот лимит делят все задания.",
+	},
+	msgThrottledTotal: {
+		"en": "%d OpenAI requests waited for the shared rate limit, %v in total.",
+		"ru": "Запросов к OpenAI, ожидавших общего лимита: %d, суммарное ожидание %v.",
+	},
+	msgFileMultiInvoice: {
+		"en": "%s contains %d invoices.",
+		"ru": "%s содержит инвойсов: %d.",
+	},
+	msgAnalysisComplete: {
+		"en": "Analysis complete. Deduplicating counterparties and generating report...",
+		"ru": "Анализ завершен. Дедупликация контрагентов и формирование отчета...",
+	},
+	msgFileError: {
+		"en": "Error in %s (%s): %s",
+		"ru": "Ошибка в %s (%s): %s",
+	},
+	msgWarning: {
+		"en": "WARN: %s",
+		"ru": "ПРЕДУПРЕЖДЕНИЕ: %s",
+	},
+	msgSaveCounterparties: {
+		"en": "WARN: Could not save counterparties db: %v",
+		"ru": "ПРЕДУПРЕЖДЕНИЕ: не удалось сохранить базу контрагентов: %v",
+	},
+	msgReportGenerated: {
+		"en": "Successfully generated report with %d processed invoices (%d errors).",
+		"ru": "Отчет сформирован: обработано инвойсов — %d, ошибок — %d.",
+	},
+	msgSummary: {
+		"en": "%s",
+		"ru": "%s",
+	},
+	msgProcessorLog: {
+		"en": "%s",
+		"ru": "%s",
+	},
+	msgTraceSummary: {
+		"en": "Timing by phase (%d files, %d retries after rate limiting):",
+		"ru": "Время по этапам (файлов: %d, повторов после ограничения запросов: %d):",
+	},
+	msgTraceLine: {
+		"en": "%s",
+		"ru": "%s",
+	},
+	msgSlowestFiles: {
+		"en": "Processing time per file: %s. Slowest: %s. Counterparty matching: %v.",
+		"ru": "Время обработки файла: %s. Самые долгие: %s. Сопоставление контрагентов: %v.",
+	},
+	msgConcurrency: {
+		"en": "Effective concurrency: %d parallel files.",
+		"ru": "Текущий параллелизм: %d файлов одновременно.",
+	},
+	msgArchived: {
+		"en": "Archived %d of %d files.",
+		"ru": "В архив сохранено файлов: %d из %d.",
+	},
+	msgArchiveFailed: {
+		"en": "WARN: Could not open archive: %v",
+		"ru": "ПРЕДУПРЕЖДЕНИЕ: не удалось открыть архив: %v",
+	},
+	msgSourcesRetained: {
+		"en": "Kept %d source files for review (%s).",
+		"ru": "Исходные файлы сохранены для проверки: %d (%s).",
+	},
+	msgRetainSourcesFailed: {
+		"en": "WARN: Could not keep source file: %v",
+		"ru": "ПРЕДУПРЕЖДЕНИЕ: не удалось сохранить исходный файл: %v",
+	},
+	msgWebhookDelivered: {
+		"en": "Webhook delivered to %s (attempt %d).",
+		"ru": "Вебхук доставлен на %s (попытка %d).",
+	},
+	msgWebhookFailed: {
+		"en": "WARN: Webhook to %s failed after %d attempt(s): %v",
+		"ru": "ПРЕДУПРЕЖДЕНИЕ: вебхук на %s не доставлен (попыток: %d): %v",
+	},
+	msgAutoRetryStarted: {
+		"en": "Automatic retry %d of %s (auto_reprocess): the file failed because OpenAI was rate limited or unavailable.",
+		"ru": "Автоматический повтор %d файла %s (auto_reprocess): файл не обработан из-за лимитов или недоступности OpenAI.",
+	},
+	msgAutoRetried: {
+		"en": "Automatic retry %d of %s succeeded, invoices extracted: %d. Reports updated.",
+		"ru": "Автоматический повтор %d файла %s успешен: извлечено инвойсов: %d, отчеты обновлены.",
+	},
+	msgAutoRetryFailed: {
+		"en": "WARN: Automatic retry %d of %s failed: [%s] %v",
+		"ru": "ПРЕДУПРЕЖДЕНИЕ: автоматический повтор %d файла %s не удался: [%s] %v",
+	},
+	msgResultEdited: {
+		"en": "Invoice %[2]d of %[1]s edited by %[3]s. Reports are stale until regenerated.",
+		"ru": "Инвойс %[2]d файла %[1]s исправлен, автор: %[3]s. Отчеты устарели, пока их не пересоберут.",
+	},
+	msgReportsRegenerated: {
+		"en": "Reports regenerated from the edited results by %s.",
+		"ru": "Отчеты пересобраны по исправленным результатам, автор: %s.",
+	},
+	msgCounterpartiesMerged: {
+		"en": "Counterparty %q (ID %d) merged into %q (ID %d) by %s. Reports regenerated.",
+		"ru": "Контрагент %q (ID %d) объединен с %q (ID %d), автор: %s. Отчеты пересобраны.",
+	},
+
+	errReadJobDir: {
+		"en": "Error reading job directory: %v",
+		"ru": "Ошибка чтения директории задачи: %v",
+	},
+	errNoZip: {
+		"en": "No archive found in job directory.",
+		"ru": "В директории задачи не найден архив.",
+	},
+	errUnzip: {
+		"en": "Failed to extract the archive: %v",
+		"ru": "Не удалось распаковать файл: %v",
+	},
+	errScan: {
+		"en": "Error scanning for files: %v",
+		"ru": "Ошибка поиска файлов: %v",
+	},
+	errNoInvoiceFiles: {
+		"en": "No invoice files (.pdf, .png, .jpg, .jpeg, .heic, .heif, .webp, .tif, .tiff) found in the archive.",
+		"ru": "В архиве не найдено файлов инвойсов (.pdf, .png, .jpg, .jpeg, .heic, .heif, .webp, .tif, .tiff).",
+	},
+	errLoadConfig: {
+		"en": "Could not load config.json: %v",
+		"ru": "Не удалось загрузить config.json: %v",
+	},
+	errRoundingPolicy: {
+		"en": "Invalid 'rounding_policy' in config.json: %v",
+		"ru": "Неверное значение 'rounding_policy' в config.json: %v",
+	},
+	errCSVDelimiter: {
+		"en": "Invalid 'csv_delimiter' in config.json: %v",
+		"ru": "Неверное значение 'csv_delimiter' в config.json: %v",
+	},
+	errSourceRetention: {
+		"en": "Invalid 'source_retention' in config.json: %v",
+		"ru": "Неверное значение 'source_retention' в config.json: %v",
+	},
+	errProcessor: {
+		"en": "%v",
+		"ru": "Ошибка настройки обработки: %v",
+	},
+	errCompany: {
+		"en": "%v",
+		"ru": "Не удалось выбрать компанию: %v",
+	},
+	errLoadCounterparties: {
+		"en": "Could not load counterparties db: %v",
+		"ru": "Не удалось загрузить базу контрагентов: %v",
+	},
+	errExcelReport: {
+		"en": "Failed to generate Excel report: %v",
+		"ru": "Не удалось сформировать Excel-отчет: %v",
+	},
+	errCSVReport: {
+		"en": "Failed to generate CSV report: %v",
+		"ru": "Не удалось сформировать CSV-отчет: %v",
+	},
+	errPanic: {
+		"en": "Internal error while processing the job: %v",
+		"ru": "Внутренняя ошибка при обработке задачи: %v",
+	},
+}
+
+// localize renders a catalog message in lang, falling back to English.
+func localize(lang, id string, args ...any) string {
+	texts, ok := messageCatalog[id]
+	if !ok {
+		return fmt.Sprint(append([]any{id + ": "}, args...)...)
+	}
+	format, ok := texts[lang]
+	if !ok {
+		format = texts[defaultLanguage]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// newLogEntry builds a log entry localized for lang.
+func newLogEntry(lang, id string, args ...any) api.LogEntry {
+	return api.LogEntry{ID: id, Level: messageLevel(id), Text: localize(lang, id, args...)}
+}
+
+// negotiateLanguage picks the job language: an explicit form value wins,
+// then the supported Accept-Language entry with the highest weight.
+func negotiateLanguage(formValue, acceptLanguage string) string {
+	if lang := baseLanguage(formValue); isSupportedLanguage(lang) {
+		return lang
+	}
+	best, bestQ := "", -1.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if _, err := fmt.Sscanf(value, "%g", &q); err != nil {
+				continue
+			}
+		}
+		if lang := baseLanguage(tag); isSupportedLanguage(lang) && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	if best == "" || bestQ <= 0 {
+		return defaultLanguage
+	}
+	return best
+}
+
+// baseLanguage reduces a language tag such as "ru-RU" to its primary subtag.
+func baseLanguage(tag string) string {
+	tag, _, _ = strings.Cut(strings.TrimSpace(tag), "-")
+	return strings.ToLower(tag)
+}
+
+func isSupportedLanguage(lang string) bool {
+	return lang == "en" || lang == "ru"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/onec"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// handleOneCExport streams the invoices of a completed job as a 1C exchange file
+// (GET /api/v1/results/<jobID>/1c). The format is 'onec_format' from config.json unless the
+// format query param (client_bank|commerceml) overrides it.
+func handleOneCExport(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := jobs.Get(jobID)
+	if !ok {
+		jsonError(w, jobNotFound(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(api.CorrelationIDHeader, job.CorrelationID)
+	if job.Status != api.StatusCompleted {
+		jsonError(w, fmt.Sprintf("Results are not available in status %q", job.Status), http.StatusConflict)
+		return
+	}
+	results := make([]invoice.Result, len(job.AllResults))
+	for i, res := range job.AllResults {
+		results[i] = res.Result
+	}
+
+	requested := r.URL.Query().Get("format")
+	if requested == "" {
+		config, err := report.LoadConfig("config.json")
+		if err != nil {
+			jsonError(w, fmt.Sprintf("Could not load config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		requested = config.OneCFormat
+	}
+	format, err := onec.ParseFormat(requested)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+"-1c"+format.Extension()))
+	if err := onec.Write(w, results, onec.Options{Format: format, MyCompany: job.MyCompany}); err != nil {
+		log.Printf("Failed to write the 1C exchange file of job %s (correlation ID %s): %v", jobID, job.CorrelationID, err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// maxAutoRetries limits the automatic retries of one file; a file that still fails is left to the user.
+const maxAutoRetries = 3
+
+// reprocessSpend is the estimated OpenAI cost of the automatic retries of the current UTC day,
+// capped by reprocess_daily_budget.
+var reprocessSpend struct {
+	mu    sync.Mutex
+	day   string
+	spent float64
+}
+
+// spendAllowed reports whether the automatic retries of the day have not used up budget yet.
+func spendAllowed(now time.Time, budget float64) bool {
+	reprocessSpend.mu.Lock()
+	defer reprocessSpend.mu.Unlock()
+	if day := now.UTC().Format(time.DateOnly); reprocessSpend.day != day {
+		reprocessSpend.day, reprocessSpend.spent = day, 0
+	}
+	return reprocessSpend.spent < budget
+}
+
+// addSpend adds the cost of an automatic retry to the spend of the day.
+func addSpend(now time.Time, cost float64) {
+	reprocessSpend.mu.Lock()
+	defer reprocessSpend.mu.Unlock()
+	if day := now.UTC().Format(time.DateOnly); reprocessSpend.day != day {
+		reprocessSpend.day, reprocessSpend.spent = day, 0
+	}
+	reprocessSpend.spent += cost
+}
+
+// retryableError reports whether a file failed only because OpenAI was rate limited (HTTP 429)
+// or unavailable (HTTP 5xx, network errors), so that processing it again later can succeed.
+func retryableError(err error) bool {
+	return err != nil && (invoice.IsRateLimitError(err) || invoice.IsUnavailableError(err))
+}
+
+// retryCandidate is a file of a finished job to retry automatically.
+type retryCandidate struct {
+	jobID   string
+	name    string // Source name, see invoice.SourceName
+	attempt int    // Number of this automatic retry, from 1
+	created time.Time
+}
+
+// reprocessFailed retries, every interval, the files of recent jobs that failed because OpenAI was
+// rate limited or unavailable (auto_reprocess in config.json). The settings are read every round,
+// so turning auto_reprocess off stops the retries without a restart.
+func reprocessFailed(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		reprocessRound(context.Background(), now)
+	}
+}
+
+// reprocessRound retries the candidates one file at a time. Retries have the lowest priority: they share
+// the process-wide request limiter with the jobs and the round ends as soon as a job is processing,
+// the daily budget is spent or OpenAI fails again.
+func reprocessRound(ctx context.Context, now time.Time) {
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		log.Printf("Automatic retries: could not load config: %v", err)
+		return
+	}
+	if !config.AutoReprocess {
+		return
+	}
+	maxAge, err := config.ReprocessMaxAgeLimit()
+	if err != nil {
+		log.Printf("Automatic retries: invalid 'reprocess_max_age' in config.json: %v", err)
+		return
+	}
+	budget := config.ReprocessDailyBudget()
+	for _, c := range retryCandidates(now.Add(-maxAge)) {
+		if jobsProcessing() {
+			return
+		}
+		if !spendAllowed(time.Now(), budget) {
+			log.Printf("Automatic retries paused until tomorrow (UTC): the daily budget of $%.2f is spent", budget)
+			return
+		}
+		if !reprocessFile(ctx, config, c) {
+			return
+		}
+	}
+}
+
+// jobsProcessing reports whether any job is being processed.
+func jobsProcessing() bool {
+	return slices.ContainsFunc(jobs.List(), func(job Job) bool { return job.Status == api.StatusProcessing })
+}
+
+// retryCandidates returns the retryable files of the completed jobs created after cutoff, oldest job first.
+// Only files with a retained source can be retried (retain_sources).
+func retryCandidates(cutoff time.Time) []retryCandidate {
+	var candidates []retryCandidate
+	for _, job := range jobs.List() {
+		if job.Status != api.StatusCompleted || !job.created.After(cutoff) {
+			continue
+		}
+		for name, retries := range job.retryable {
+			if retries >= maxAutoRetries {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(sourcesDir(job.ID), filepath.FromSlash(name))); err != nil {
+				continue
+			}
+			candidates = append(candidates, retryCandidate{jobID: job.ID, name: name, attempt: retries + 1, created: job.created})
+		}
+	}
+	slices.SortFunc(candidates, func(a, b retryCandidate) int {
+		if c := a.created.Compare(b.created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	return candidates
+}
+
+// reprocessFile processes the retained source of the candidate again and, when it succeeds, replaces
+// the results of the file, regenerates the reports and posts the webhook. It returns false when OpenAI
+// is still rate limited or unavailable, so that the round stops.
+func reprocessFile(ctx context.Context, config *invoice.Config, c retryCandidate) bool {
+	job, ok := jobs.Get(c.jobID)
+	if !ok {
+		return true
+	}
+	jobConfig := *config
+	addPDFPassword(&jobConfig, job.pdfPassword)
+	processor, err := newProcessor(&jobConfig, job.MyCompany, job.roundingPolicy)
+	if err != nil {
+		log.Printf("Automatic retries: %v", err)
+		return false
+	}
+	jobs.addLog(c.jobID, msgAutoRetryStarted, c.attempt, c.name)
+	ctx = invoice.WithJobID(ctx, c.jobID)
+	path := filepath.Join(sourcesDir(c.jobID), filepath.FromSlash(c.name))
+	var fr invoice.FileResult
+	for fr = range processor.ProcessBatch(ctx, []string{path}) {
+	}
+	addSpend(time.Now(), fr.Usage.EstimateCost(config.ModelPrices))
+	jobs.addUsage(c.jobID, c.name, fr.Usage, config.ModelPrices)
+
+	if fr.Err != nil {
+		retryable := retryableError(fr.Err)
+		jobs.Update(c.jobID, func(job *Job) {
+			if retryable {
+				job.retryable[c.name] = c.attempt
+			} else {
+				delete(job.retryable, c.name)
+			}
+			job.Log = append(job.Log, newLogEntry(job.Language, msgAutoRetryFailed, c.attempt, c.name, invoice.ErrorCode(fr.Err), fr.Err))
+		})
+		log.Printf("Job %s: automatic retry %d of %s failed: %v", c.jobID, c.attempt, c.name, fr.Err)
+		return !retryable
+	}
+
+	// The counterparties db is shared between jobs, see processInvoices
+	results := fr.Results(c.name)
+	counterpartiesDBMutex.Lock()
+	store := config.CounterpartyStore()
+	registry, err := invoice.LoadCounterpartyRegistry(store)
+	if err != nil {
+		counterpartiesDBMutex.Unlock()
+		log.Printf("Job %s: automatic retry of %s: could not load counterparties: %v", c.jobID, c.name, err)
+		return false
+	}
+	dedup := processor.Deduplicate(ctx, results, registry)
+	if store != nil {
+		if err := store.Save(registry.Counterparties); err != nil {
+			jobs.addLog(c.jobID, msgSaveCounterparties, err)
+		}
+	}
+	counterpartiesDBMutex.Unlock()
+	addSpend(time.Now(), dedup.MatchingUsage.EstimateCost(config.ModelPrices))
+	jobs.addUsage(c.jobID, "", dedup.MatchingUsage, config.ModelPrices)
+
+	// Edits and regeneration of the job are short: wait for them instead of throwing the result away
+	var unlock func()
+	for {
+		var retry int
+		if unlock, retry, ok = tryLockReports(c.jobID); ok {
+			break
+		}
+		time.Sleep(time.Duration(retry) * time.Second)
+	}
+	if job, ok = jobs.Get(c.jobID); !ok || job.Status != api.StatusCompleted {
+		unlock()
+		return true
+	}
+	newResults := replaceFileResults(job.AllResults, c.jobID, c.name, results)
+	markDuplicates(newResults)
+	counterparties := mergeCounterparties(job.UniqueCounterparties, dedup.UniqueCounterparties)
+	reports := job.reports()
+	reports.summary = resummarize(reports.summary, newResults, reports.matchingUsage, config.ModelPrices)
+	regenerateErr := reports.regenerate(newResults, counterparties)
+
+	extracted := 0
+	for _, res := range results {
+		if res.Invoice != nil && res.ErrorMessage == "" {
+			extracted++
+		}
+	}
+	jobs.Update(c.jobID, func(job *Job) {
+		job.AllResults = newResults
+		job.UniqueCounterparties = counterparties
+		job.Summary = &reports.summary
+		delete(job.retryable, c.name)
+		delete(job.FileErrors, c.name)
+		for _, res := range results {
+			if res.ErrorMessage != "" && job.FileErrors != nil {
+				job.FileErrors[c.name] = res.ErrorCode
+			}
+		}
+		job.Log = append(job.Log, newLogEntry(job.Language, msgAutoRetried, c.attempt, c.name, extracted))
+		if regenerateErr != nil {
+			job.ReportStale = true
+			job.Log = append(job.Log, newLogEntry(job.Language, msgWarning, regenerateErr))
+		} else {
+			job.ReportStale = false
+		}
+	})
+	unlock()
+	log.Printf("Job %s (correlation ID %s): [%s] %s", c.jobID, job.CorrelationID, msgAutoRetried,
+		localize(defaultLanguage, msgAutoRetried, c.attempt, c.name, extracted))
+
+	notifyWebhook(c.jobID, []string{c.name})
+	return true
+}
+
+// replaceFileResults returns a copy of results in which the results of the file name are replaced by
+// replacement, in the place of the first of them.
+func replaceFileResults(results []api.Result, jobID, name string, replacement []invoice.Result) []api.Result {
+	retried := make([]api.Result, len(replacement))
+	for i, res := range replacement {
+		retried[i] = api.Result{ID: resultID(jobID, name, res.InvoiceIndex), SourceURL: sourceURL(jobID, name), Result: res}
+	}
+	newResults := make([]api.Result, 0, len(results)+len(retried))
+	for _, res := range results {
+		if res.SourceFile != name {
+			newResults = append(newResults, res)
+		} else if retried != nil {
+			newResults = append(newResults, retried...)
+			retried = nil
+		}
+	}
+	return append(newResults, retried...)
+}
+
+// mergeCounterparties adds the counterparties of retried files that the job does not list yet.
+func mergeCounterparties(existing, added []invoice.UniqueCounterparty) []invoice.UniqueCounterparty {
+	merged := slices.Clone(existing)
+	for _, uc := range added {
+		if !slices.ContainsFunc(merged, func(m invoice.UniqueCounterparty) bool {
+			if uc.Counterparty.ID != 0 {
+				return m.Counterparty.ID == uc.Counterparty.ID
+			}
+			return m.Counterparty.Name == uc.Counterparty.Name
+		}) {
+			merged = append(merged, uc)
+		}
+	}
+	return merged
+}
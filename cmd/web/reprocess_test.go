@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// fakeOpenAI answers chat completions with an invoice, or with 503 while unavailable is set.
+// It counts the requests it receives.
+type fakeOpenAI struct {
+	unavailable atomic.Bool
+	requests    atomic.Int32
+}
+
+func (f *fakeOpenAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	if f.unavailable.Load() {
+		http.Error(w, `{"error": {"message": "The server is overloaded"}}`, http.StatusServiceUnavailable)
+		return
+	}
+	var request openai.ChatCompletionRequest
+	json.NewDecoder(r.Body).Decode(&request)
+	content := `{"invoice_1": [0]}`
+	if request.ResponseFormat == nil || request.ResponseFormat.Type != openai.ChatCompletionResponseFormatTypeJSONObject {
+		inv, _ := json.Marshal(invoice.Invoice{Type: invoice.TypePaymentOrder, Number: "INV-9", Date: "2024-03-01", Currency: "EUR", TotalAmount: 100,
+			Counterparty: invoice.Counterparty{Name: "ACME GmbH"}})
+		content = string(inv)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+		Model:   request.Model,
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}}},
+		Usage:   openai.Usage{PromptTokens: 1000, CompletionTokens: 100},
+	})
+}
+
+// addRetryableJob registers a completed job whose scan.png failed because OpenAI was unavailable,
+// with the source retained.
+func addRetryableJob(t *testing.T, id string) {
+	t.Helper()
+	results := testResults(1)
+	failed := invoice.FileResults("scan.png", nil, invoice.Usage{}, fmt.Errorf("%w: status code 503", invoice.ErrOpenAIRequest))
+	results = append(results, api.Result{ID: resultID(id, "scan.png", 0), Result: failed[0]})
+	addCompletedJob(t, id, results)
+	jobs.Update(id, func(job *Job) {
+		job.retryable = map[string]int{"scan.png": 0}
+		job.FileErrors = map[string]string{"scan.png": invoice.ErrorCodeOpenAIRequest}
+	})
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(sourcesDir(id), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sourcesDir(id), "scan.png"), img.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reprocessConfig returns config.json for a fake OpenAI at baseURL with automatic retries turned on or off.
+func reprocessConfig(baseURL string, enabled bool, extra string) string {
+	return fmt.Sprintf(`{"openai_api_key": "test", "base_url": %q, "auto_reprocess": %t%s}`, baseURL, enabled, extra)
+}
+
+// resetSpendAfter clears the spend of automatic retries when the test ends.
+func resetSpendAfter(t *testing.T) {
+	t.Cleanup(func() {
+		reprocessSpend.mu.Lock()
+		reprocessSpend.day, reprocessSpend.spent = "", 0
+		reprocessSpend.mu.Unlock()
+	})
+}
+
+func logIDs(job Job) []string {
+	ids := make([]string, len(job.Log))
+	for i, entry := range job.Log {
+		ids[i] = entry.ID
+	}
+	return ids
+}
+
+// TestReprocessRetriesUnavailableFiles retries a file first while OpenAI is still unavailable and then
+// after it recovers: the results, reports and webhook are updated and every retry is in the job log.
+func TestReprocessRetriesUnavailableFiles(t *testing.T) {
+	fake := &fakeOpenAI{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	var payload api.WebhookPayload
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer hook.Close()
+	useTestDir(t, reprocessConfig(server.URL+"/v1", true, fmt.Sprintf(`, "webhook_url": %q`, hook.URL)))
+	resetSpendAfter(t)
+	addRetryableJob(t, "job-1")
+
+	fake.unavailable.Store(true)
+	reprocessRound(context.Background(), time.Now())
+	job, _ := jobs.Get("job-1")
+	if job.retryable["scan.png"] != 1 || !slices.Contains(logIDs(job), msgAutoRetryFailed) {
+		t.Fatalf("after a failed retry: retries %v, log %v", job.retryable, logIDs(job))
+	}
+
+	fake.unavailable.Store(false)
+	reprocessRound(context.Background(), time.Now())
+	job, _ = jobs.Get("job-1")
+	if len(job.retryable) != 0 || len(job.FileErrors) != 0 {
+		t.Errorf("after a successful retry: retries %v, file errors %v", job.retryable, job.FileErrors)
+	}
+	if ids := logIDs(job); !slices.Contains(ids, msgAutoRetryStarted) || !slices.Contains(ids, msgAutoRetried) {
+		t.Errorf("job log %v does not attribute the retries", ids)
+	}
+	i := slices.IndexFunc(job.AllResults, func(res api.Result) bool { return res.SourceFile == "scan.png" })
+	if len(job.AllResults) != 2 || i < 0 || job.AllResults[i].Invoice == nil || job.AllResults[i].Invoice.Number != "INV-9" {
+		t.Fatalf("results after the retry: %+v", job.AllResults)
+	}
+	if job.AllResults[i].SourceURL != sourceURL("job-1", "scan.png") || job.Summary.FilesFailed != 0 {
+		t.Errorf("retried result: source URL %q, summary %+v", job.AllResults[i].SourceURL, job.Summary)
+	}
+	if _, err := os.Stat(job.ResultPath); err != nil {
+		t.Errorf("the report was not regenerated: %v", err)
+	}
+	if payload.JobID != "job-1" || !slices.Equal(payload.Reprocessed, []string{"scan.png"}) {
+		t.Errorf("webhook payload: %+v", payload)
+	}
+
+	// Nothing is left to retry
+	requests := fake.requests.Load()
+	reprocessRound(context.Background(), time.Now())
+	if fake.requests.Load() != requests {
+		t.Error("a retried file was processed again")
+	}
+}
+
+// TestReprocessLimits checks that no retry is sent with auto_reprocess off, for jobs older than
+// reprocess_max_age, while a job is processing or when the daily budget is spent.
+func TestReprocessLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name, extra string
+		enabled     bool
+		prepare     func(t *testing.T)
+	}{
+		{name: "turned off"},
+		{name: "too old", enabled: true, extra: `, "reprocess_max_age": "1ms"`, prepare: func(t *testing.T) { time.Sleep(2 * time.Millisecond) }},
+		{name: "job processing", enabled: true, prepare: func(t *testing.T) {
+			if err := jobs.Create(&Job{JobStatus: api.JobStatus{ID: "job-2", Status: api.StatusProcessing}, created: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "budget spent", enabled: true, extra: `, "reprocess_daily_budget": 0.5`, prepare: func(t *testing.T) {
+			addSpend(time.Now(), 0.5)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeOpenAI{}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			useTestDir(t, reprocessConfig(server.URL+"/v1", tc.enabled, tc.extra))
+			resetSpendAfter(t)
+			addRetryableJob(t, "job-1")
+			if tc.prepare != nil {
+				tc.prepare(t)
+			}
+
+			reprocessRound(context.Background(), time.Now())
+			if n := fake.requests.Load(); n != 0 {
+				t.Errorf("%d requests sent to OpenAI", n)
+			}
+		})
+	}
+}
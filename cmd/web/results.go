@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// resultFilter holds the parsed filter, sort order and page of GET /api/v1/results/<jobID> (see api.ResultQuery).
+type resultFilter struct {
+	direction    string
+	counterparty string
+	status       string
+	dateFrom     string
+	dateTo       string
+	minAmount    *float64
+	maxAmount    *float64
+	sort         string
+	desc         bool
+	page, limit  int
+}
+
+// parseResultFilter parses the query parameters of GET /api/v1/results/<jobID>. The error names the
+// offending parameter.
+func parseResultFilter(query url.Values) (resultFilter, error) {
+	var f resultFilter
+	var err error
+	if value := query.Get(api.ParamDirection); value != "" {
+		var ok bool
+		if f.direction, ok = invoice.ParseDirection(value); !ok {
+			return f, fmt.Errorf("Invalid %q, expected %q or %q", api.ParamDirection, invoice.DirectionIncoming, invoice.DirectionOutgoing)
+		}
+	}
+	f.counterparty = strings.TrimSpace(query.Get(api.ParamCounterparty))
+	switch f.status = strings.ToLower(query.Get(api.ParamStatus)); f.status {
+	case "", api.ResultStatusOK, api.ResultStatusError:
+	default:
+		return f, fmt.Errorf("Invalid %q, expected %q or %q", api.ParamStatus, api.ResultStatusOK, api.ResultStatusError)
+	}
+	for _, date := range []struct {
+		param string
+		dst   *string
+	}{{api.ParamDateFrom, &f.dateFrom}, {api.ParamDateTo, &f.dateTo}} {
+		value := query.Get(date.param)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return f, fmt.Errorf("Invalid %q %q, expected a date as YYYY-MM-DD", date.param, value)
+		}
+		*date.dst = value
+	}
+	if f.dateFrom != "" && f.dateTo != "" && f.dateFrom > f.dateTo {
+		return f, fmt.Errorf("Invalid %q, %s is after %q %s", api.ParamDateFrom, f.dateFrom, api.ParamDateTo, f.dateTo)
+	}
+	for _, amount := range []struct {
+		param string
+		dst   **float64
+	}{{api.ParamMinAmount, &f.minAmount}, {api.ParamMaxAmount, &f.maxAmount}} {
+		value := query.Get(amount.param)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return f, fmt.Errorf("Invalid %q %q, expected a number", amount.param, value)
+		}
+		*amount.dst = &number
+	}
+	if f.minAmount != nil && f.maxAmount != nil && *f.minAmount > *f.maxAmount {
+		return f, fmt.Errorf("Invalid %q, %g is greater than %q %g", api.ParamMinAmount, *f.minAmount, api.ParamMaxAmount, *f.maxAmount)
+	}
+	switch f.sort = strings.ToLower(query.Get(api.ParamSort)); f.sort {
+	case "", api.SortDate, api.SortAmount, api.SortFile:
+	default:
+		return f, fmt.Errorf("Invalid %q, expected %q, %q or %q", api.ParamSort, api.SortDate, api.SortAmount, api.SortFile)
+	}
+	switch order := strings.ToLower(query.Get(api.ParamOrder)); order {
+	case "", api.OrderAsc:
+	case api.OrderDesc:
+		f.desc = true
+	default:
+		return f, fmt.Errorf("Invalid %q, expected %q or %q", api.ParamOrder, api.OrderAsc, api.OrderDesc)
+	}
+	if f.page, f.limit, err = parsePage(query.Get(api.ParamPage), query.Get(api.ParamLimit)); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// invoiceOnly reports whether the filter leaves out error rows: every filter on invoice data does.
+func (f resultFilter) invoiceOnly() bool {
+	return f.direction != "" || f.counterparty != "" || f.dateFrom != "" || f.dateTo != "" || f.minAmount != nil || f.maxAmount != nil
+}
+
+// matches reports whether the result passes the filter.
+func (f resultFilter) matches(res api.Result) bool {
+	if res.IsSkipped() {
+		return f.status == "" && !f.invoiceOnly() // Documents that are not invoices are neither OK nor errors
+	}
+	failed := res.ErrorMessage != "" || res.Invoice == nil
+	switch {
+	case f.status == api.ResultStatusOK && failed, f.status == api.ResultStatusError && !failed:
+		return false
+	case failed:
+		return !f.invoiceOnly()
+	}
+	inv := res.Invoice
+	if f.direction != "" && inv.Direction != f.direction {
+		return false
+	}
+	if f.counterparty != "" && !strings.Contains(strings.ToLower(inv.Counterparty.Name), strings.ToLower(f.counterparty)) && !inv.Counterparty.HasVAT(f.counterparty) {
+		return false
+	}
+	// Dates are YYYY-MM-DD, so they compare as strings; invoices without a date fail a date filter
+	if (f.dateFrom != "" || f.dateTo != "") && inv.Date == "" {
+		return false
+	}
+	if (f.dateFrom != "" && inv.Date < f.dateFrom) || (f.dateTo != "" && inv.Date > f.dateTo) {
+		return false
+	}
+	if (f.minAmount != nil && inv.TotalAmount < *f.minAmount) || (f.maxAmount != nil && inv.TotalAmount > *f.maxAmount) {
+		return false
+	}
+	return true
+}
+
+// apply returns the page of filtered and sorted results and the number of results passing the filter.
+func (f resultFilter) apply(results []api.Result) ([]api.Result, int) {
+	filtered := []api.Result{}
+	for _, res := range results {
+		if f.matches(res) {
+			filtered = append(filtered, res)
+		}
+	}
+	if f.sort != "" {
+		slices.SortStableFunc(filtered, f.compare)
+	}
+	total := len(filtered)
+	if f.limit > 0 {
+		start := min((f.page-1)*f.limit, total)
+		filtered = filtered[start:min(start+f.limit, total)]
+	}
+	return filtered, total
+}
+
+// compare orders results by the sort field. Rows without the field (error rows, invoices without a date)
+// go last in both orders.
+func (f resultFilter) compare(a, b api.Result) int {
+	if f.sort == api.SortFile {
+		return f.directed(strings.Compare(a.SourceFile, b.SourceFile))
+	}
+	key := func(res api.Result) (string, float64, bool) {
+		if res.Invoice == nil || (f.sort == api.SortDate && res.Invoice.Date == "") {
+			return "", 0, false
+		}
+		return res.Invoice.Date, res.Invoice.TotalAmount, true
+	}
+	dateA, amountA, okA := key(a)
+	dateB, amountB, okB := key(b)
+	switch {
+	case !okA || !okB:
+		return cmp.Compare(boolRank(okA), boolRank(okB))
+	case f.sort == api.SortDate:
+		return f.directed(strings.Compare(dateA, dateB))
+	}
+	return f.directed(cmp.Compare(amountA, amountB))
+}
+
+func (f resultFilter) directed(c int) int {
+	if f.desc {
+		return -c
+	}
+	return c
+}
+
+// boolRank sorts rows with a sort key (0) before rows without one (1).
+func boolRank(ok bool) int {
+	if ok {
+		return 0
+	}
+	return 1
+}
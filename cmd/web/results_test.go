@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/veryevilzed/invpa/api"
+)
+
+// addJobWithResultIDs registers a completed job whose results carry the IDs processInvoices assigns.
+func addJobWithResultIDs(t *testing.T, jobID string) []api.Result {
+	t.Helper()
+	results := testResults(3)
+	results[2].SourceFile, results[2].InvoiceIndex = results[1].SourceFile, 2 // Two invoices in one file
+	for i := range results {
+		results[i].ID = resultID(jobID, results[i].SourceFile, results[i].InvoiceIndex)
+	}
+	addCompletedJob(t, jobID, results)
+	return results
+}
+
+func getResultsItem(target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestResultIDIsStable(t *testing.T) {
+	id := resultID("job-1", "march/invoice.pdf", 1)
+	if again := resultID("job-1", "march/invoice.pdf", 1); again != id {
+		t.Errorf("resultID changed between calls: %s and %s", id, again)
+	}
+	for _, other := range []string{
+		resultID("job-2", "march/invoice.pdf", 1),
+		resultID("job-1", "march/other.pdf", 1),
+		resultID("job-1", "march/invoice.pdf", 2),
+	} {
+		if other == id {
+			t.Errorf("different results share the ID %s", id)
+		}
+	}
+}
+
+// TestResultIDsSurviveEditAndRegeneration edits a result and rebuilds the reports: the IDs of all
+// results stay the same and /item/{id} returns the edited invoice.
+func TestResultIDsSurviveEditAndRegeneration(t *testing.T) {
+	useTestDir(t, `{}`)
+	const jobID = "job-1"
+	results := addJobWithResultIDs(t, jobID)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPatch, api.PathPrefix+"/results/"+jobID+"/1", strings.NewReader(`{"number": "INV-EDITED"}`))
+	handleEditResult(w, r, jobID, "1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit responded %d: %s", w.Code, w.Body)
+	}
+	if w := regenerateRequest(jobID); w.Code != http.StatusOK {
+		t.Fatalf("regenerate responded %d: %s", w.Code, w.Body)
+	}
+
+	job, _ := jobs.Get(jobID)
+	for i, res := range job.AllResults {
+		if res.ID != results[i].ID {
+			t.Errorf("result %d changed its ID from %s to %s", i, results[i].ID, res.ID)
+		}
+	}
+
+	w = getResultsItem(api.PathPrefix + "/results/" + jobID + "/item/" + results[1].ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/item/%s responded %d: %s", results[1].ID, w.Code, w.Body)
+	}
+	var item api.Result
+	if err := json.NewDecoder(w.Body).Decode(&item); err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != results[1].ID || item.Invoice == nil || item.Invoice.Number != "INV-EDITED" {
+		t.Errorf("/item returned %s with invoice %+v, want the edited INV-EDITED", item.ID, item.Invoice)
+	}
+}
+
+func TestResultItemNotFound(t *testing.T) {
+	useTestDir(t, `{}`)
+	results := addJobWithResultIDs(t, "job-1")
+	if err := jobs.Create(&Job{JobStatus: api.JobStatus{ID: "job-2", Status: api.StatusProcessing}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{
+		"unknown result":    "/results/job-1/item/0123456789abcdef",
+		"unknown job":       "/results/job-3/item/" + results[0].ID,
+		"job not finished":  "/results/job-2/item/" + resultID("job-2", "invoice-1.pdf", 1),
+		"ID of another job": "/results/job-1/item/" + resultID("job-2", results[0].SourceFile, results[0].InvoiceIndex),
+	} {
+		if w := getResultsItem(api.PathPrefix + target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: %s responded %d, want 404", name, target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// sourcesDir returns the directory with the retained source files of a job. It lives under public,
+// so the files are served (and protected by authentication) like the reports.
+func sourcesDir(jobID string) string {
+	return filepath.Join("public", "jobs", jobID, "sources")
+}
+
+// sourceURL returns the link to a retained source file by its source name (see invoice.SourceName).
+func sourceURL(jobID, name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/public/jobs/" + url.PathEscape(jobID) + "/sources/" + strings.Join(segments, "/")
+}
+
+// retainSources keeps the processed files of the job in sourcesDir: the temp directory of the job is
+// removed when processing ends. Files are hard-linked (copied across file systems), so the archive step
+// still finds them in the job directory. It returns the links to the kept files by source name; files
+// that could not be kept are reported through errs and left out.
+func retainSources(jobID, jobDir string, files []string) (urls map[string]string, errs []error) {
+	urls = make(map[string]string, len(files))
+	root := sourcesDir(jobID)
+	for _, path := range files {
+		name := invoice.SourceName(jobDir, path)
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := linkOrCopy(path, target); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		urls[name] = sourceURL(jobID, name)
+	}
+	return urls, errs
+}
+
+// linkOrCopy hard-links src to dst, falling back to a copy when linking is not possible.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// expireSources removes the retained source files of jobs whose source_retention has passed
+// and drops the links to them. Sources without a retention period stay until the job expires.
+func expireSources(now time.Time) {
+	var expired []string
+	for _, job := range jobs.List() {
+		if job.sourcesExpire.IsZero() || job.sourcesExpire.After(now) {
+			continue
+		}
+		jobs.Update(job.ID, func(job *Job) {
+			job.sourcesExpire = time.Time{}
+			// Copy on write: snapshots of the job share the previous slice
+			results := slices.Clone(job.AllResults)
+			for i := range results {
+				results[i].SourceURL = ""
+			}
+			job.AllResults = results
+		})
+		expired = append(expired, job.ID)
+	}
+	for _, id := range expired {
+		if err := os.RemoveAll(sourcesDir(id)); err != nil {
+			log.Printf("Job %s: could not remove retained sources: %v", id, err)
+			continue
+		}
+		log.Printf("Job %s: retained sources expired and were removed", id)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// JobStore keeps the jobs of the server. Implementations must be safe for concurrent use: handlers read
+// jobs while processing goroutines update them.
+type JobStore interface {
+	// Create adds a new job. It fails if a job with the same ID already exists.
+	Create(job *Job) error
+	// Get returns a copy of the job that the caller can read without holding any lock.
+	Get(id string) (Job, bool)
+	// Update calls fn with the stored job, serialized with all other store calls, and reports whether
+	// the job exists. fn must not call the store.
+	Update(id string, fn func(job *Job)) bool
+	// List returns copies of all jobs in no particular order.
+	List() []Job
+	// Delete removes the job and returns its last state.
+	Delete(id string) (Job, bool)
+}
+
+// jobStore adds the job updates shared by the handlers and job processing to a JobStore.
+type jobStore struct {
+	JobStore
+}
+
+// jobs is the job store of the server. Tests can replace it with a fake store.
+var jobs = jobStore{NewMemoryJobStore()}
+
+// MemoryJobStore keeps jobs in memory; they are lost when the server restarts.
+type MemoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewMemoryJobStore returns an empty in-memory store.
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: make(map[string]*Job)}
+}
+
+func (s *MemoryJobStore) Create(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.ID]; ok {
+		return fmt.Errorf("job %s already exists", job.ID)
+	}
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *MemoryJobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+func (s *MemoryJobStore) Update(id string, fn func(job *Job)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if ok {
+		fn(job)
+	}
+	return ok
+}
+
+func (s *MemoryJobStore) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		list = append(list, job.snapshot())
+	}
+	return list
+}
+
+func (s *MemoryJobStore) Delete(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	delete(s.jobs, id)
+	return job.snapshot(), true
+}
+
+// snapshot copies the job. The log and the per-file maps grow in place and are cloned; results and
+// counterparties are replaced as a whole on every change (copy on write) and are shared.
+func (job *Job) snapshot() Job {
+	copied := *job
+	copied.Log = slices.Clone(job.Log)
+	copied.FileUsage = maps.Clone(job.FileUsage)
+	copied.FileErrors = maps.Clone(job.FileErrors)
+	copied.retryable = maps.Clone(job.retryable)
+	copied.Tags = slices.Clone(job.Tags)
+	return copied
+}
+
+// addLog appends a catalog message, localized for the job, to the job log.
+func (s jobStore) addLog(jobID, messageID string, args ...any) {
+	s.Update(jobID, func(job *Job) {
+		job.Log = append(job.Log, newLogEntry(job.Language, messageID, args...))
+	})
+}
+
+func (s jobStore) incrementProcessedCount(jobID string) {
+	s.Update(jobID, func(job *Job) {
+		job.ProcessedFiles++
+	})
+}
+
+// addUsage records OpenAI usage for a file (or for matching when file is empty)
+// and refreshes the job totals.
+func (s jobStore) addUsage(jobID, file string, usage invoice.Usage, prices map[string]invoice.ModelPrice) {
+	s.Update(jobID, func(job *Job) {
+		if file == "" {
+			job.MatchingUsage.Add(usage)
+		} else {
+			if job.FileUsage == nil {
+				job.FileUsage = make(map[string]invoice.Usage)
+			}
+			fileUsage := job.FileUsage[file]
+			fileUsage.Add(usage)
+			job.FileUsage[file] = fileUsage
+		}
+		job.Usage.Add(usage)
+		job.EstimatedCost = job.Usage.EstimateCost(prices)
+	})
+}
+
+// setJobError fails the job with a catalog message. The job sees it in its language,
+// the server log gets the English text with the message ID.
+func (s jobStore) setJobError(jobID, messageID string, args ...any) {
+	s.Update(jobID, func(job *Job) {
+		entry := newLogEntry(job.Language, messageID, args...)
+		job.Status = api.StatusError
+		job.Error = entry.Text
+		job.ErrorID = messageID
+		job.Log = append(job.Log, api.LogEntry{ID: messageID, Level: api.LogLevelError, Text: "[ERROR] " + entry.Text})
+		log.Printf("Job %s (correlation ID %s) failed: [%s] %s", jobID, job.CorrelationID, messageID, localize(defaultLanguage, messageID, args...))
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// maxMetricSamples bounds the durations kept per phase for the /metrics quantiles.
+const maxMetricSamples = 1000
+
+// metricQuantiles are the quantiles reported on /metrics.
+var metricQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// phaseMetrics aggregates the traces of all traced jobs since the server started.
+type phaseMetrics struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration // The last maxMetricSamples durations per phase
+	count   map[string]int64
+	sum     map[string]time.Duration
+	files   int64
+	retries int64
+	// Adaptive concurrency limit of each job that is processing files, whether traced or not
+	concurrency map[string]int
+}
+
+var metrics = &phaseMetrics{
+	samples:     make(map[string][]time.Duration),
+	count:       make(map[string]int64),
+	sum:         make(map[string]time.Duration),
+	concurrency: make(map[string]int),
+}
+
+// setConcurrency records the adaptive concurrency limit of a job; 0 removes the job when its files are done.
+func (m *phaseMetrics) setConcurrency(jobID string, limit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit <= 0 {
+		delete(m.concurrency, jobID)
+		return
+	}
+	m.concurrency[jobID] = limit
+}
+
+// observe adds the spans of traces to the aggregate. Traces without a path hold the job-level phases
+// (matching, report) and are not counted as files.
+func (m *phaseMetrics) observe(traces []*invoice.Trace) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, trace := range traces {
+		if trace == nil {
+			continue
+		}
+		if trace.Path != "" {
+			m.files++
+		}
+		m.retries += int64(trace.Retries)
+		for _, span := range trace.Spans {
+			samples := append(m.samples[span.Phase], span.Duration)
+			if len(samples) > maxMetricSamples {
+				samples = samples[len(samples)-maxMetricSamples:]
+			}
+			m.samples[span.Phase] = samples
+			m.count[span.Phase]++
+			m.sum[span.Phase] += span.Duration
+		}
+	}
+}
+
+// writeTo writes the aggregate in the Prometheus text exposition format.
+func (m *phaseMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintln(w, "# HELP invpa_phase_duration_seconds Duration of traced processing phases; quantiles cover the last", maxMetricSamples, "operations of a phase.")
+	fmt.Fprintln(w, "# TYPE invpa_phase_duration_seconds summary")
+	for _, phase := range invoice.TracePhases {
+		if m.count[phase] == 0 {
+			continue
+		}
+		sorted := slices.Sorted(slices.Values(m.samples[phase]))
+		for _, q := range metricQuantiles {
+			fmt.Fprintf(w, "invpa_phase_duration_seconds{phase=%q,quantile=\"%g\"} %g\n", phase, q, invoice.Percentile(sorted, q).Seconds())
+		}
+		fmt.Fprintf(w, "invpa_phase_duration_seconds_sum{phase=%q} %g\n", phase, m.sum[phase].Seconds())
+		fmt.Fprintf(w, "invpa_phase_duration_seconds_count{phase=%q} %d\n", phase, m.count[phase])
+	}
+	fmt.Fprintln(w, "# HELP invpa_traced_files_total Files processed by traced jobs.")
+	fmt.Fprintln(w, "# TYPE invpa_traced_files_total counter")
+	fmt.Fprintf(w, "invpa_traced_files_total %d\n", m.files)
+	fmt.Fprintln(w, "# HELP invpa_file_retries_total Retries of files after OpenAI rate limiting in traced jobs.")
+	fmt.Fprintln(w, "# TYPE invpa_file_retries_total counter")
+	fmt.Fprintf(w, "invpa_file_retries_total %d\n", m.retries)
+	effective := 0
+	for _, limit := range m.concurrency {
+		effective += limit
+	}
+	fmt.Fprintln(w, "# HELP invpa_effective_concurrency Files processed in parallel as allowed by adaptive concurrency, summed over the jobs processing files.")
+	fmt.Fprintln(w, "# TYPE invpa_effective_concurrency gauge")
+	fmt.Fprintf(w, "invpa_effective_concurrency %d\n", effective)
+}
+
+// handleMetrics serves the phase durations of traced jobs (GET /metrics). Jobs are traced
+// when "trace" is enabled in config.json.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeTo(w)
+}
+
+// handleReadyz reports whether jobs can be processed with the current config.json (GET /readyz).
+// Every job reads the config again, so a config broken after startup makes the server not ready:
+// the response is 503 with the problems found by invoice.Config.Validate.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response := api.ReadyResponse{Ready: true}
+	config, err := report.LoadConfig("config.json")
+	if err == nil {
+		err = config.Validate()
+	} else {
+		err = fmt.Errorf("Could not load config.json: %v", err)
+	}
+	if err != nil {
+		response.Ready = false
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, problem := range joined.Unwrap() {
+				response.Problems = append(response.Problems, problem.Error())
+			}
+		} else {
+			response.Problems = []string{err.Error()}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// jobTrace is the trace artifact of a job, saved next to its reports.
+type jobTrace struct {
+	Job     string               `json:"job"`
+	Phases  []invoice.PhaseStats `json:"phases"`
+	Files   []*invoice.Trace     `json:"files"`
+	Batch   *invoice.Trace       `json:"batch"` // Counterparty matching and report writing
+	Retries int                  `json:"retries"`
+}
+
+// newJobTrace summarizes the file traces and the job-level trace of a job.
+func newJobTrace(jobID string, files []*invoice.Trace, batch *invoice.Trace) jobTrace {
+	trace := jobTrace{Job: jobID, Files: files, Batch: batch}
+	for _, file := range files {
+		trace.Retries += file.Retries
+	}
+	trace.Phases = invoice.SummarizeTraces(append(slices.Clone(files), batch))
+	return trace
+}
+
+// writeJobTrace saves the trace artifact of a job as JSON.
+func writeJobTrace(path string, trace jobTrace) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(trace)
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsEffectiveConcurrency(t *testing.T) {
+	m := &phaseMetrics{concurrency: make(map[string]int)}
+	gauge := func() string {
+		var b strings.Builder
+		m.writeTo(&b)
+		for _, line := range strings.Split(b.String(), "\n") {
+			if strings.HasPrefix(line, "invpa_effective_concurrency ") {
+				return line
+			}
+		}
+		t.Fatalf("/metrics has no invpa_effective_concurrency sample:\n%s", b.String())
+		return ""
+	}
+
+	if got := gauge(); got != "invpa_effective_concurrency 0" {
+		t.Errorf("without jobs: %q", got)
+	}
+	m.setConcurrency("job-1", 4)
+	m.setConcurrency("job-2", 3)
+	m.setConcurrency("job-1", 2) // Halved after a 429
+	if got := gauge(); got != "invpa_effective_concurrency 5" {
+		t.Errorf("two jobs at 2 and 3: %q", got)
+	}
+	m.setConcurrency("job-2", 0)
+	if got := gauge(); got != "invpa_effective_concurrency 2" {
+		t.Errorf("after job-2 finished its files: %q", got)
+	}
+}
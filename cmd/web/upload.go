@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/veryevilzed/invpa/archive"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// uploadMemory is how much of a multipart upload is kept in memory; the rest is spooled to temporary files
+const uploadMemory = 8 << 20
+
+// parseUploadForm parses the multipart form of an archive upload, rejecting bodies larger than
+// upload_max_mb of the config with 413. On failure it writes the JSON error and returns false.
+func parseUploadForm(w http.ResponseWriter, r *http.Request) bool {
+	limit := int64(invoice.DefaultUploadMaxBytes)
+	if config, err := report.LoadConfig("config.json"); err == nil {
+		limit = config.UploadMaxBytes()
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseMultipartForm(uploadMemory); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonError(w, fmt.Sprintf("Upload exceeds the limit of %d MB", limit>>20), http.StatusRequestEntityTooLarge)
+			return false
+		}
+		jsonError(w, "Could not parse multipart form", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkArchive verifies by its signature that the uploaded file is an archive the server can unpack,
+// so that a renamed executable or document is rejected before it is written to disk.
+func checkArchive(file multipart.File) error {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if archive.Sniff(header[:n]) == archive.Unknown {
+		return errors.New("The uploaded file is not a zip, tar, tar.gz, 7z or rar archive")
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/veryevilzed/invpa/api"
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/veryevilzed/invpa/report"
+)
+
+// webhookRetries is how many times a failed webhook delivery is retried
+const webhookRetries = 3
+
+// webhookBackoff is the pause before the first retry; it doubles with every next retry
+var webhookBackoff = 2 * time.Second
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// callbackClient delivers to callback URLs of the upload form. Its dialer refuses internal addresses
+// (see publicAddress), so a client cannot make the server post to itself or to its private network,
+// even through a DNS name or a redirect. It does not use HTTP proxies: a proxy would resolve the target
+// itself, bypassing the check.
+var callbackClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// validateCallbackURL accepts absolute http and https URLs only.
+func validateCallbackURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid callback URL %q: expected an absolute http or https URL", value)
+	}
+	return nil
+}
+
+// validateUploadCallbackURL checks the callback URL of the upload form: besides validateCallbackURL,
+// it must not name a loopback, private or link-local address unless its host is in allowedHosts
+// (webhook_allowed_hosts of the config). Host names are checked again when the webhook is delivered.
+func validateUploadCallbackURL(value string, allowedHosts []string) error {
+	if err := validateCallbackURL(value); err != nil {
+		return err
+	}
+	u, _ := url.Parse(value)
+	host := strings.ToLower(u.Hostname())
+	if callbackHostAllowed(host, allowedHosts) {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("Invalid callback URL %q: %s is not a public address", value, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddress(ip) {
+		return fmt.Errorf("Invalid callback URL %q: %s is not a public address", value, host)
+	}
+	return nil
+}
+
+// callbackHostAllowed reports whether host is listed in allowedHosts (case-insensitive).
+func callbackHostAllowed(host string, allowedHosts []string) bool {
+	for _, allowed := range allowedHosts {
+		if strings.EqualFold(strings.TrimSpace(allowed), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddress reports whether ip may be reached by a webhook of the upload form: loopback, private,
+// link-local, multicast and unspecified addresses belong to the server's own network.
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// dialPublicOnly is the dialer control of callbackClient: it runs after name resolution, for every
+// connection including redirects, and refuses addresses that are not public.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(ip) {
+		return fmt.Errorf("callback address %s is not a public address; add the host to webhook_allowed_hosts to allow it", ip)
+	}
+	return nil
+}
+
+// requestBaseURL returns the scheme and the local address the request arrived on, which prefix
+// the report links of the job unless public_url is configured. The Host and X-Forwarded-* headers
+// are set by the client and are not trusted: behind a proxy or with a host name, set public_url.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return scheme + "://" + addr.String()
+	}
+	return ""
+}
+
+// publicBaseURL returns the base of absolute links to the server: public_url of the config or,
+// without it, requestBase, the scheme and host of the upload request.
+func publicBaseURL(config *invoice.Config, requestBase string) string {
+	if base := strings.TrimSuffix(config.PublicURL, "/"); base != "" {
+		return base
+	}
+	return requestBase
+}
+
+// notifyWebhook posts the job webhook (the callback URL of the upload or webhook_url of the config)
+// when the job has finished as Completed or Error. It must be deferred in the job goroutine before
+// recoverJob, so that a job failed by a panic is reported too. reprocessed names the files of a finished
+// job that were just retried automatically, see reprocessFailed.
+func notifyWebhook(jobID string, reprocessed []string) {
+	config, err := report.LoadConfig("config.json")
+	if err != nil {
+		config = &invoice.Config{}
+	}
+
+	job, ok := jobs.Get(jobID)
+	if !ok || (job.Status != api.StatusCompleted && job.Status != api.StatusError) {
+		return
+	}
+	callbackURL := job.callbackURL
+	if callbackURL == "" {
+		callbackURL = config.WebhookURL
+	}
+	baseURL := publicBaseURL(config, job.baseURL)
+	payload := api.WebhookPayload{
+		JobID:          job.ID,
+		CorrelationID:  job.CorrelationID,
+		Status:         job.Status,
+		Error:          job.Error,
+		TotalFiles:     job.TotalFiles,
+		ProcessedFiles: job.ProcessedFiles,
+		Summary:        job.Summary,
+		Tags:           job.Tags,
+		Reprocessed:    reprocessed,
+	}
+	if job.DownloadURL != "" {
+		payload.DownloadURL = baseURL + job.DownloadURL
+	}
+	if job.DownloadURLCSV != "" {
+		payload.DownloadURLCSV = baseURL + job.DownloadURLCSV
+	}
+	if config.WebhookResults {
+		payload.Results = job.AllResults
+	}
+
+	if callbackURL == "" {
+		return
+	}
+	target := callbackURL
+	if u, err := url.Parse(callbackURL); err == nil {
+		target = u.Redacted()
+	}
+	if !config.NetworkAllowed() {
+		jobs.addLog(jobID, msgWebhookFailed, target, 1, invoice.ErrNetworkDisabled)
+		return
+	}
+	if err := validateCallbackURL(callbackURL); err != nil {
+		jobs.addLog(jobID, msgWebhookFailed, target, 1, err)
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		jobs.addLog(jobID, msgWebhookFailed, target, 1, err)
+		return
+	}
+
+	// webhook_url of the config is trusted; a callback URL of the upload form must stay outside
+	// the server's network unless its host is allowed
+	client := webhookClient
+	if job.callbackURL != "" {
+		if u, err := url.Parse(callbackURL); err != nil || !callbackHostAllowed(u.Hostname(), config.WebhookAllowedHosts) {
+			client = callbackClient
+		}
+	}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, callbackURL, body, config.WebhookSecret)
+		if err == nil {
+			jobs.addLog(jobID, msgWebhookDelivered, target, attempt)
+			return
+		}
+		log.Printf("Job %s: webhook delivery to %s failed (attempt %d): %v", jobID, target, attempt, err)
+		if attempt > webhookRetries {
+			jobs.addLog(jobID, msgWebhookFailed, target, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhook sends one delivery attempt. Any response other than 2xx is a failure.
+func postWebhook(client *http.Client, callbackURL string, body []byte, secret string) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(api.WebhookSignatureHeader, signWebhook(body, secret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value: "sha256=" followed by the hex HMAC-SHA256 of the body.
+func signWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateUploadCallbackURL(t *testing.T) {
+	for _, tc := range []struct {
+		url     string
+		allowed []string
+		ok      bool
+	}{
+		{"https://hooks.example.com/invpa", nil, true},
+		{"http://93.184.216.34/hook", nil, true},
+		{"ftp://hooks.example.com/", nil, false},
+		{"http://localhost:8080/hook", nil, false},
+		{"http://127.0.0.1/hook", nil, false},
+		{"http://[::1]/hook", nil, false},
+		{"http://10.0.0.5/hook", nil, false},
+		{"http://192.168.1.10/hook", nil, false},
+		{"http://169.254.169.254/latest/meta-data/", nil, false},
+		{"http://[fe80::1]/hook", nil, false},
+		{"http://[::ffff:127.0.0.1]/hook", nil, false},
+		{"http://0.0.0.0/hook", nil, false},
+		{"http://10.0.0.5/hook", []string{"10.0.0.5"}, true},
+		{"http://LocalHost/hook", []string{"localhost"}, true},
+	} {
+		if err := validateUploadCallbackURL(tc.url, tc.allowed); (err == nil) != tc.ok {
+			t.Errorf("validateUploadCallbackURL(%q, %v) = %v, want ok %v", tc.url, tc.allowed, err, tc.ok)
+		}
+	}
+}
+
+// TestCallbackClientRefusesInternalAddresses delivers to a loopback server through a host name:
+// the callback client checks the resolved address, so the name does not get around the check.
+func TestCallbackClientRefusesInternalAddresses(t *testing.T) {
+	delivered := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { delivered = true }))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	callbackURL := "http://localhost:" + u.Port() + "/hook"
+
+	err := postWebhook(callbackClient, callbackURL, []byte(`{}`), "")
+	if err == nil || !strings.Contains(err.Error(), "not a public address") || delivered {
+		t.Errorf("delivery to %s: %v, delivered %v, want a refused connection", callbackURL, err, delivered)
+	}
+	if err := postWebhook(webhookClient, callbackURL, []byte(`{}`), ""); err != nil || !delivered {
+		t.Errorf("delivery with the trusted client: %v, delivered %v", err, delivered)
+	}
+}
+
+// TestRequestBaseURLIgnoresClientHeaders checks that links are built from the address the request
+// arrived on, not from the Host and X-Forwarded-Proto headers set by the client.
+func TestRequestBaseURLIgnoresClientHeaders(t *testing.T) {
+	var base string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { base = requestBaseURL(r) }))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Host = "attacker.example"
+	req.Header.Set("X-Forwarded-Proto", "javascript")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if base != server.URL {
+		t.Errorf("requestBaseURL = %q, want %q", base, server.URL)
+	}
+}
@@ -0,0 +1,41 @@
+package invoice
+
+import "strings"
+
+// MaxAliases ограничивает количество алиасов у одного контрагента.
+const MaxAliases = 10
+
+// normalizeName приводит наименование к виду для точного сравнения:
+// нижний регистр и одиночные пробелы.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// MatchesName проверяет, совпадает ли name с наименованием контрагента или одним из его алиасов
+// (без учета регистра и лишних пробелов).
+func (c Counterparty) MatchesName(name string) bool {
+	key := normalizeName(name)
+	if key == "" {
+		return false
+	}
+	if normalizeName(c.Name) == key {
+		return true
+	}
+	for _, alias := range c.Aliases {
+		if normalizeName(alias) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// AddAlias добавляет альтернативное наименование, если оно не совпадает с уже известными.
+// Возвращает false, если алиас не был добавлен (пустой, дубликат или достигнут лимит).
+func (c *Counterparty) AddAlias(alias string) bool {
+	alias = strings.TrimSpace(alias)
+	if alias == "" || c.MatchesName(alias) || len(c.Aliases) >= MaxAliases {
+		return false
+	}
+	c.Aliases = append(c.Aliases, alias)
+	return true
+}
@@ -0,0 +1,305 @@
+package invoice
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveIndexFile — имя индекса архива (JSONL: по записи ArchiveRecord на строку).
+const archiveIndexFile = "index.jsonl"
+
+// Archive — неизменяемое хранилище исходных файлов и результатов извлечения.
+// Файлы хранятся по SHA-256 содержимого (objects/<2 символа>/<хэш><расширение>), поэтому
+// один и тот же файл из разных заданий сохраняется один раз. Результаты каждого задания
+// записываются рядом (<хэш>.<задание>.json), а индекс связывает хэши с заданиями,
+// номерами инвойсов и контрагентами.
+//
+// Архив может находиться на медленном сетевом хранилище: записи выполняются через
+// временные файлы, а ошибки возвращаются вызывающему для логирования.
+type Archive struct {
+	dir string
+	mu  sync.Mutex // Сериализует дописывание индекса в рамках процесса
+}
+
+// ArchiveRecord — запись индекса архива об одном файле одного задания.
+type ArchiveRecord struct {
+	Hash       string            `json:"hash"`
+	File       string            `json:"file"` // Имя файла в задании
+	Job        string            `json:"job"`
+	ArchivedAt time.Time         `json:"archived_at"`
+	Error      string            `json:"error,omitempty"`
+	Invoices   []ArchivedInvoice `json:"invoices,omitempty"`
+}
+
+// ArchivedInvoice — краткие данные инвойса в индексе архива.
+type ArchivedInvoice struct {
+	Number         string  `json:"number"`
+	Date           string  `json:"date"`
+	TotalAmount    float64 `json:"total_amount"`
+	Currency       string  `json:"currency,omitempty"`
+	Counterparty   string  `json:"counterparty"`
+	CounterpartyID uint64  `json:"counterparty_id,omitempty"`
+	VAT            string  `json:"vat,omitempty"`
+}
+
+// ArchiveQuery — условия поиска в архиве. Пустые поля не ограничивают поиск.
+type ArchiveQuery struct {
+	Number       string // Номер инвойса (без учета регистра)
+	Counterparty string // Подстрока наименования или VAT контрагента (без учета регистра)
+}
+
+// archiveResult — содержимое файла результата рядом с исходным файлом.
+type archiveResult struct {
+	Job      string    `json:"job"`
+	File     string    `json:"file"`
+	Error    string    `json:"error,omitempty"`
+	Invoices []Invoice `json:"invoices"`
+}
+
+// OpenArchive открывает архив в директории dir, создавая ее при необходимости.
+func OpenArchive(dir string) (*Archive, error) {
+	if dir == "" {
+		return nil, errors.New("archive path is empty")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive dir: %w", err)
+	}
+	return &Archive{dir: dir}, nil
+}
+
+// Store архивирует исходный файл результата fr (name — имя файла в задании),
+// его результат и добавляет запись в индекс.
+func (a *Archive) Store(jobID, name string, fr FileResult) error {
+	hash, err := fileSHA256(fr.Path)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", name, err)
+	}
+	objectDir := filepath.Join(a.dir, "objects", hash[:2])
+	if err := os.MkdirAll(objectDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create archive object dir: %w", err)
+	}
+
+	// 1. Исходный файл: уже заархивированный не копируется повторно
+	objectPath := filepath.Join(objectDir, hash+strings.ToLower(filepath.Ext(fr.Path)))
+	if _, err := os.Stat(objectPath); errors.Is(err, os.ErrNotExist) {
+		if err := copyFileAtomic(fr.Path, objectPath); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", name, err)
+		}
+	}
+
+	// 2. Результат задания
+	result := archiveResult{Job: jobID, File: name, Invoices: fr.Invoices}
+	record := ArchiveRecord{Hash: hash, File: name, Job: jobID, ArchivedAt: time.Now().UTC()}
+	if fr.Err != nil {
+		result.Error = fr.Err.Error()
+		record.Error = result.Error
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	resultPath := filepath.Join(objectDir, fmt.Sprintf("%s.%s.json", hash, jobID))
+	if err := writeFileAtomic(resultPath, data); err != nil {
+		return fmt.Errorf("failed to write archived result of %s: %w", name, err)
+	}
+
+	// 3. Индекс: документы TypeNotInvoice не ищутся
+	for _, inv := range fr.Invoices {
+		if !inv.IsInvoice() {
+			continue
+		}
+		record.Invoices = append(record.Invoices, ArchivedInvoice{
+			Number:         inv.Number,
+			Date:           inv.Date,
+			TotalAmount:    inv.TotalAmount,
+			Currency:       inv.Currency,
+			Counterparty:   inv.Counterparty.Name,
+			CounterpartyID: inv.Counterparty.ID,
+			VAT:            inv.Counterparty.VAT,
+		})
+	}
+	return a.appendIndex([]ArchiveRecord{record})
+}
+
+// ImportHash вычисляет ключ записи, импортированной без исходного файла (например, из старого отчета):
+// SHA-256 имени файла, номера и даты инвойса.
+func ImportHash(file, number, date string) string {
+	sum := sha256.Sum256([]byte(file + "\x00" + number + "\x00" + date))
+	return hex.EncodeToString(sum[:])
+}
+
+// Import добавляет в индекс записи без исходных файлов. Записи с хэшем, который уже есть
+// в индексе, пропускаются, поэтому повторный импорт не создает дубликатов.
+// Возвращает число добавленных записей.
+func (a *Archive) Import(records []ArchiveRecord) (int, error) {
+	existing, err := a.records()
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]bool, len(existing))
+	for _, record := range existing {
+		known[record.Hash] = true
+	}
+	var added []ArchiveRecord
+	for _, record := range records {
+		if known[record.Hash] {
+			continue
+		}
+		known[record.Hash] = true
+		added = append(added, record)
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	return len(added), a.appendIndex(added)
+}
+
+// appendIndex дописывает записи в индекс.
+func (a *Archive) appendIndex(records []ArchiveRecord) error {
+	var data []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	index, err := os.OpenFile(filepath.Join(a.dir, archiveIndexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive index: %w", err)
+	}
+	_, err = index.Write(data)
+	if closeErr := index.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update archive index: %w", err)
+	}
+	return nil
+}
+
+// Find возвращает записи индекса, содержащие инвойс, подходящий под query.
+// Поврежденные строки индекса пропускаются.
+func (a *Archive) Find(query ArchiveQuery) ([]ArchiveRecord, error) {
+	all, err := a.records()
+	var records []ArchiveRecord
+	for _, record := range all {
+		for _, inv := range record.Invoices {
+			if query.matches(inv) {
+				records = append(records, record)
+				break
+			}
+		}
+	}
+	return records, err
+}
+
+// records читает все записи индекса, пропуская поврежденные строки.
+func (a *Archive) records() ([]ArchiveRecord, error) {
+	file, err := os.Open(filepath.Join(a.dir, archiveIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive index: %w", err)
+	}
+	defer file.Close()
+
+	var records []ArchiveRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var record ArchiveRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	return records, nil
+}
+
+// ObjectPath возвращает путь к заархивированному исходному файлу записи.
+// У записей, добавленных через Import, исходного файла нет.
+func (a *Archive) ObjectPath(record ArchiveRecord) string {
+	return filepath.Join(a.dir, "objects", record.Hash[:2], record.Hash+strings.ToLower(filepath.Ext(record.File)))
+}
+
+func (q ArchiveQuery) matches(inv ArchivedInvoice) bool {
+	if q.Number != "" && !strings.EqualFold(strings.TrimSpace(inv.Number), strings.TrimSpace(q.Number)) {
+		return false
+	}
+	if q.Counterparty != "" {
+		needle := strings.ToLower(strings.TrimSpace(q.Counterparty))
+		if !strings.Contains(strings.ToLower(inv.Counterparty), needle) && !strings.Contains(strings.ToLower(inv.VAT), needle) {
+			return false
+		}
+	}
+	return true
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// copyFileAtomic копирует файл через временный файл в директории назначения.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".object-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// writeFileAtomic записывает данные через временный файл в директории назначения.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".result-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,169 @@
+package invoice
+
+import "strings"
+
+// BankAccount представляет один банковский счет контрагента.
+type BankAccount struct {
+	Currency      string `json:"currency,omitempty"`       // 3-х буквенный код валюты счета
+	IBAN          string `json:"iban,omitempty"`           // IBAN
+	SWIFT         string `json:"swift,omitempty"`          // SWIFT/BIC банка
+	AccountNumber string `json:"account_number,omitempty"` // Номер счета, если IBAN нет (местные реквизиты)
+	BankName      string `json:"bank_name,omitempty"`      // Наименование банка
+}
+
+// normalizeAccount приводит IBAN или номер счета к виду для сравнения: верхний регистр без пробелов и дефисов.
+func normalizeAccount(number string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "", ".", "").Replace(number))
+}
+
+// identified сообщает, что у счета есть IBAN или номер.
+func (a BankAccount) identified() bool {
+	return a.IBAN != "" || a.AccountNumber != ""
+}
+
+// sameAs сообщает, что a и b описывают один счет: совпадает IBAN или номер счета.
+// Счет без IBAN и номера (например, только SWIFT из старых данных) совпадает со счетом того же банка.
+func (a BankAccount) sameAs(b BankAccount) bool {
+	switch {
+	case a.IBAN != "" && b.IBAN != "":
+		return normalizeAccount(a.IBAN) == normalizeAccount(b.IBAN)
+	case a.AccountNumber != "" && b.AccountNumber != "":
+		return normalizeAccount(a.AccountNumber) == normalizeAccount(b.AccountNumber) &&
+			(a.SWIFT == "" || b.SWIFT == "" || strings.EqualFold(a.SWIFT, b.SWIFT))
+	case a.identified() && b.identified():
+		return false
+	}
+	return a.SWIFT != "" && strings.EqualFold(a.SWIFT, b.SWIFT)
+}
+
+// fill дополняет пустые поля счета данными other.
+func (a *BankAccount) fill(other BankAccount) {
+	fillEmpty(&a.Currency, other.Currency)
+	fillEmpty(&a.IBAN, other.IBAN)
+	fillEmpty(&a.SWIFT, other.SWIFT)
+	fillEmpty(&a.AccountNumber, other.AccountNumber)
+	fillEmpty(&a.BankName, other.BankName)
+}
+
+func fillEmpty(dst *string, value string) {
+	if *dst == "" {
+		*dst = value
+	}
+}
+
+// String возвращает счет одной строкой, например "EUR DE89370400440532013000 (COBADEFFXXX, Commerzbank)".
+func (a BankAccount) String() string {
+	number := a.IBAN
+	if number == "" {
+		number = a.AccountNumber
+	}
+	s := strings.TrimSpace(a.Currency + " " + number)
+	var bank []string
+	for _, value := range []string{a.SWIFT, a.BankName} {
+		if value != "" {
+			bank = append(bank, value)
+		}
+	}
+	if len(bank) > 0 {
+		s = strings.TrimSpace(s + " (" + strings.Join(bank, ", ") + ")")
+	}
+	return s
+}
+
+// AddBankAccount добавляет счет или дополняет его данными уже известный счет (тот же IBAN или номер).
+// Устаревшие поля IBAN и SWIFT заполняются данными основного (первого) счета.
+// Возвращает false, если счет пустой или уже известен.
+func (c *Counterparty) AddBankAccount(account BankAccount) bool {
+	account = BankAccount{
+		Currency:      strings.ToUpper(strings.TrimSpace(account.Currency)),
+		IBAN:          strings.TrimSpace(account.IBAN),
+		SWIFT:         strings.TrimSpace(account.SWIFT),
+		AccountNumber: strings.TrimSpace(account.AccountNumber),
+		BankName:      strings.TrimSpace(account.BankName),
+	}
+	if !account.identified() && account.SWIFT == "" {
+		return false
+	}
+	added := true
+	for i := range c.BankAccounts {
+		if c.BankAccounts[i].sameAs(account) {
+			c.BankAccounts[i].fill(account)
+			added = false
+			break
+		}
+	}
+	if added {
+		c.BankAccounts = append(c.BankAccounts, account)
+	}
+	c.IBAN, c.SWIFT = c.BankAccounts[0].IBAN, c.BankAccounts[0].SWIFT
+	return added
+}
+
+// NormalizeBankAccounts согласует счета с устаревшими полями IBAN и SWIFT: счет из этих полей
+// (старая база, ручной ввод) становится основным, а поля заполняются данными основного счета.
+func (c *Counterparty) NormalizeBankAccounts() {
+	accounts := c.BankAccounts
+	c.BankAccounts = nil
+	c.AddBankAccount(BankAccount{IBAN: c.IBAN, SWIFT: c.SWIFT})
+	for _, account := range accounts {
+		c.AddBankAccount(account)
+	}
+}
+
+// setPrimaryAccount делает account основным (первым) счетом контрагента; остальные счета сохраняются.
+func (c *Counterparty) setPrimaryAccount(account BankAccount) {
+	accounts := c.Accounts()
+	c.BankAccounts, c.IBAN, c.SWIFT = nil, "", ""
+	c.AddBankAccount(account)
+	for _, other := range accounts {
+		c.AddBankAccount(other)
+	}
+}
+
+// Accounts возвращает счета контрагента с учетом устаревших полей IBAN и SWIFT, не изменяя его.
+func (c Counterparty) Accounts() []BankAccount {
+	c.NormalizeBankAccounts()
+	return c.BankAccounts
+}
+
+// AdditionalBankAccounts возвращает счета контрагента, кроме основного, одной строкой через "; ".
+func (c Counterparty) AdditionalBankAccounts() string {
+	accounts := c.Accounts()
+	if len(accounts) < 2 {
+		return ""
+	}
+	parts := make([]string, len(accounts)-1)
+	for i, account := range accounts[1:] {
+		parts[i] = account.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// accountNumbers возвращает IBAN или номера всех счетов контрагента.
+func accountNumbers(c Counterparty) []string {
+	var numbers []string
+	for _, account := range c.Accounts() {
+		if account.IBAN != "" {
+			numbers = append(numbers, account.IBAN)
+		} else if account.AccountNumber != "" {
+			numbers = append(numbers, account.AccountNumber)
+		}
+	}
+	return numbers
+}
+
+// SharesBankAccount сообщает, что у контрагентов есть общий счет с IBAN или номером.
+func (c Counterparty) SharesBankAccount(other Counterparty) bool {
+	otherAccounts := other.Accounts()
+	for _, account := range c.Accounts() {
+		if !account.identified() {
+			continue
+		}
+		for _, candidate := range otherAccounts {
+			if candidate.identified() && account.sameAs(candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package invoice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultCachePath — директория кэша результатов по умолчанию.
+const DefaultCachePath = "invpa-cache"
+
+// ResultCache хранит результаты извлечения в директории: по JSON-файлу на ключ.
+// Ключ включает SHA-256 содержимого файла и версию настроек анализа (модель, промпты,
+// выбор страниц, округление), поэтому при их изменении кэш автоматически не используется.
+type ResultCache struct {
+	dir string
+}
+
+// cacheEntry — содержимое файла кэша. Миниатюры хранятся отдельно, так как Invoice.Preview не сериализуется.
+type cacheEntry struct {
+	Invoices []Invoice `json:"invoices"`
+	Previews [][]byte  `json:"previews,omitempty"`
+}
+
+// NewResultCache создает кэш в директории dir (по умолчанию DefaultCachePath).
+func NewResultCache(dir string) (*ResultCache, error) {
+	if dir == "" {
+		dir = DefaultCachePath
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create result cache dir: %w", err)
+	}
+	return &ResultCache{dir: dir}, nil
+}
+
+// cacheKey вычисляет ключ кэша по содержимому файла и версии настроек.
+func cacheKey(content []byte, version string) string {
+	sum := sha256.New()
+	sum.Write([]byte(version))
+	sum.Write([]byte{0})
+	sum.Write(content)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func (c *ResultCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// get возвращает закэшированные инвойсы. Поврежденный файл кэша считается промахом.
+func (c *ResultCache) get(key string) ([]Invoice, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || len(entry.Invoices) == 0 {
+		return nil, false
+	}
+	for i := range entry.Invoices {
+		if i < len(entry.Previews) {
+			entry.Invoices[i].Preview = entry.Previews[i]
+		}
+	}
+	return entry.Invoices, true
+}
+
+// put сохраняет инвойсы в кэш. Запись выполняется через временный файл.
+func (c *ResultCache) put(key string, invoices []Invoice) error {
+	entry := cacheEntry{Invoices: invoices}
+	for i, inv := range invoices {
+		if len(inv.Preview) > 0 {
+			if entry.Previews == nil {
+				entry.Previews = make([][]byte, len(invoices))
+			}
+			entry.Previews[i] = inv.Preview
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(key), data)
+}
@@ -0,0 +1,178 @@
+package invoice
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// MaxMatchCandidates ограничивает число других кандидатов в объяснении сопоставления.
+const MaxMatchCandidates = 3
+
+// minCandidateScore — минимальное сходство наименований, при котором контрагент считается кандидатом.
+const minCandidateScore = 0.5
+
+// MatchCandidate — контрагент базы, похожий на контрагента инвойса.
+type MatchCandidate struct {
+	ID     uint64  `json:"id,omitempty"`
+	Name   string  `json:"name"`
+	Score  float64 `json:"score"`  // Сходство по локальной оценке, от 0 до 1
+	Reason string  `json:"reason"` // Почему контрагент подходит: "VAT equal", "name 0.82"...
+}
+
+func (c MatchCandidate) String() string {
+	return fmt.Sprintf("%s (%s)", c.Name, c.Reason)
+}
+
+// MatchExplanation объясняет сопоставление контрагента инвойса с базой: с кем он сопоставлен и почему
+// и какие еще контрагенты были похожи.
+type MatchExplanation struct {
+	Matched    *MatchCandidate  `json:"matched,omitempty"`    // Совпавший контрагент; nil — контрагент новый
+	Candidates []MatchCandidate `json:"candidates,omitempty"` // Другие кандидаты от лучших к худшим, не больше MaxMatchCandidates
+}
+
+// String возвращает объяснение в виде "matched to Acme GmbH (VAT equal); other candidates: Acme Trading (name 0.82)".
+func (e MatchExplanation) String() string {
+	text := "new counterparty"
+	if e.Matched != nil {
+		text = "matched to " + e.Matched.String()
+	}
+	if len(e.Candidates) == 0 {
+		return text
+	}
+	others := make([]string, len(e.Candidates))
+	for i, candidate := range e.Candidates {
+		others[i] = candidate.String()
+	}
+	return text + "; other candidates: " + strings.Join(others, ", ")
+}
+
+// MatchResult — результат сопоставления одного контрагента с объяснением (FindCounterpartyExplained).
+type MatchResult struct {
+	Index        int           // Индекс совпавшего контрагента в existing или -1
+	Counterparty *Counterparty // Совпавший контрагент, дополненный новыми данными; nil, если совпадения нет
+	Explanation  MatchExplanation
+	Usage        Usage
+}
+
+// explainMatch строит объяснение сопоставления cp с контрагентом existing[matched] (matched < 0 — совпадения нет).
+// reason — причина совпадения, названная моделью; если она пуста, используется локальная оценка.
+func explainMatch(existing []Counterparty, cp Counterparty, matched int, reason string) MatchExplanation {
+	var explanation MatchExplanation
+	if matched >= 0 && matched < len(existing) {
+		candidate := newMatchCandidate(existing[matched], cp)
+		if reason != "" {
+			candidate.Reason = reason
+		}
+		explanation.Matched = &candidate
+	}
+	type ranked struct {
+		index int
+		MatchCandidate
+	}
+	var candidates []ranked
+	for i, other := range existing {
+		if i == matched {
+			continue
+		}
+		if candidate := newMatchCandidate(other, cp); candidate.Score >= minCandidateScore {
+			candidates = append(candidates, ranked{i, candidate})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b ranked) int { return cmp.Compare(b.Score, a.Score) })
+	for _, candidate := range candidates[:min(len(candidates), MaxMatchCandidates)] {
+		explanation.Candidates = append(explanation.Candidates, candidate.MatchCandidate)
+	}
+	return explanation
+}
+
+// newMatchCandidate оценивает сходство cp с контрагентом базы existing: совпадение VAT, регистрационного номера, банковского счета
+// или наименования дает 1, иначе оценка — наибольшее сходство наименования cp с наименованием и алиасами.
+func newMatchCandidate(existing, cp Counterparty) MatchCandidate {
+	candidate := MatchCandidate{ID: existing.ID, Name: existing.Name, Score: 1}
+	switch {
+	case sameVAT(existing.VAT, cp.VAT):
+		candidate.Reason = "VAT equal"
+	case existing.SameRegistrationNumber(cp):
+		candidate.Reason = "registration number equal"
+	case existing.SharesBankAccount(cp):
+		candidate.Reason = "bank account equal"
+	case existing.MatchesName(cp.Name):
+		candidate.Reason = "name equal"
+	default:
+		score := nameSimilarity(existing.Name, cp.Name)
+		for _, alias := range existing.Aliases {
+			score = max(score, nameSimilarity(alias, cp.Name))
+		}
+		candidate.Score = math.Round(score*100) / 100
+		candidate.Reason = fmt.Sprintf("name %.2f", candidate.Score)
+	}
+	return candidate
+}
+
+// sameVAT сравнивает налоговые номера без учета регистра, пробелов и знаков препинания.
+func sameVAT(a, b string) bool {
+	a, b = simplifyIdentifier(a), simplifyIdentifier(b)
+	return a != "" && a == b
+}
+
+// HasVAT сообщает, что налоговый номер контрагента равен vat без учета регистра, пробелов и знаков препинания.
+func (c Counterparty) HasVAT(vat string) bool {
+	return sameVAT(c.VAT, vat)
+}
+
+// SameRegistrationNumber сообщает, что у контрагентов одинаковый регистрационный номер. Номера разных стран
+// могут совпасть случайно, поэтому при известных кодах стран они тоже должны совпадать.
+func (c Counterparty) SameRegistrationNumber(other Counterparty) bool {
+	if c.CountryCode != "" && other.CountryCode != "" && !sameCountry(c.CountryCode, other.CountryCode) {
+		return false
+	}
+	return sameVAT(c.RegistrationNumber, other.RegistrationNumber)
+}
+
+func simplifyIdentifier(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, value)
+}
+
+// nameSimilarity — коэффициент Дайса по парам соседних символов наименований без учета регистра
+// и знаков препинания: 1 для одинаковых наименований, 0 для не имеющих общих пар.
+func nameSimilarity(a, b string) float64 {
+	x, y := bigrams(a), bigrams(b)
+	if len(x) == 0 || len(y) == 0 {
+		return 0
+	}
+	counts := make(map[string]int, len(x))
+	for _, pair := range x {
+		counts[pair]++
+	}
+	common := 0
+	for _, pair := range y {
+		if counts[pair] > 0 {
+			counts[pair]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(x)+len(y))
+}
+
+func bigrams(name string) []string {
+	runes := []rune(normalizeName(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, name)))
+	pairs := make([]string, 0, len(runes))
+	for i := 0; i+1 < len(runes); i++ {
+		pairs = append(pairs, string(runes[i:i+2]))
+	}
+	return pairs
+}
@@ -0,0 +1,96 @@
+package invoice
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// CategoryOther — категория инвойса, которому не подошла ни одна из настроенных категорий.
+const CategoryOther = "other"
+
+// Category — категория расходов из config.json, которую модель выбирает для инвойса (Invoice.Category).
+type Category struct {
+	ID    string `json:"id"`    // Идентификатор для отчетов и выгрузок, например "telecom"
+	Label string `json:"label"` // Описание для модели, например "Связь и интернет"
+}
+
+// ValidateCategories проверяет категории из конфига: у каждой должен быть непустой уникальный id.
+func ValidateCategories(categories []Category) error {
+	seen := make(map[string]bool, len(categories))
+	for i, category := range categories {
+		id := strings.TrimSpace(category.ID)
+		if id == "" {
+			return fmt.Errorf("category %d has an empty id", i+1)
+		}
+		if seen[strings.ToLower(id)] {
+			return fmt.Errorf("duplicate category id %q", id)
+		}
+		seen[strings.ToLower(id)] = true
+	}
+	return nil
+}
+
+// categoryIDs возвращает идентификаторы категорий, которые может выбрать модель, с CategoryOther в конце.
+func categoryIDs(categories []Category) []string {
+	ids := make([]string, 0, len(categories)+1)
+	for _, category := range categories {
+		ids = append(ids, strings.TrimSpace(category.ID))
+	}
+	if !slices.ContainsFunc(ids, func(id string) bool { return strings.EqualFold(id, CategoryOther) }) {
+		ids = append(ids, CategoryOther)
+	}
+	return ids
+}
+
+// normalizeCategory приводит категорию, выбранную моделью, к идентификатору из categories без учета регистра;
+// модель может вернуть и описание категории. Неизвестная или пустая категория заменяется на CategoryOther.
+// Без настроенных категорий Category не заполняется.
+func (inv *Invoice) normalizeCategory(categories []Category) {
+	if len(categories) == 0 {
+		inv.Category = ""
+		return
+	}
+	value := strings.TrimSpace(inv.Category)
+	for _, category := range categories {
+		if strings.EqualFold(value, strings.TrimSpace(category.ID)) || strings.EqualFold(value, strings.TrimSpace(category.Label)) {
+			inv.Category = strings.TrimSpace(category.ID)
+			return
+		}
+	}
+	inv.Category = CategoryOther
+}
+
+// buildCategoryPrompt возвращает правило выбора категории для промпта детального анализа
+// или пустую строку, если категории не настроены.
+func buildCategoryPrompt(categories []Category) string {
+	if len(categories) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`    *   "category": The id of the expense category below that best fits what the invoice is for. Use "other" if none fits. Still fill "purpose" with the free-text summary.` + "\n")
+	for _, category := range categories {
+		fmt.Fprintf(&b, "        *   %s: %s\n", strings.TrimSpace(category.ID), category.Label)
+	}
+	return b.String()
+}
+
+// categorizedInvoiceSchema дополняет схему ответа детального анализа полем category с допустимыми
+// идентификаторами категорий.
+func categorizedInvoiceSchema(categories []Category) (*jsonschema.Definition, error) {
+	base, err := invoiceSchema()
+	if err != nil {
+		return nil, err
+	}
+	schema := *base
+	schema.Properties = make(map[string]jsonschema.Definition, len(base.Properties)+1)
+	for name, prop := range base.Properties {
+		schema.Properties[name] = prop
+	}
+	schema.Properties["category"] = jsonschema.Definition{Type: jsonschema.String, Enum: categoryIDs(categories)}
+	schema.Required = append(slices.Clone(base.Required), "category")
+	slices.Sort(schema.Required)
+	return &schema, nil
+}
@@ -0,0 +1,112 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Типы API (Config.APIType).
+const (
+	APITypeOpenAI = "openai" // OpenAI или совместимый сервис (по умолчанию)
+	APITypeAzure  = "azure"  // Azure OpenAI
+	// OpenAI-совместимый сервер с собственными моделями: Ollama, LM Studio, OpenRouter и т. п.
+	// Требует base_url, ключ API необязателен.
+	APITypeCompatible = "compatible"
+)
+
+// DefaultModel — модель, которую использует процессор, если в конфигурации не задана другая.
+const DefaultModel = openai.GPT4o
+
+// ChatClient — клиент чата, через который пакет обращается к модели. Ему удовлетворяет *openai.Client
+// (в том числе для Azure и OpenAI-совместимых серверов, см. NewClient); собственная реализация позволяет
+// подключить другой сервис или подставить записанные ответы в тестах.
+type ChatClient interface {
+	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+}
+
+// noClient сообщает, что клиента нет: nil или нулевой *openai.Client. Без клиента доступна
+// только локальная обработка.
+func noClient(client ChatClient) bool {
+	if client == nil {
+		return true
+	}
+	c, ok := client.(*openai.Client)
+	return ok && c == nil
+}
+
+// ClientConfig описывает подключение к OpenAI или Azure OpenAI.
+type ClientConfig struct {
+	APIKey     string
+	BaseURL    string // Базовый URL API; для Azure — endpoint ресурса (https://<resource>.openai.azure.com/)
+	APIType    string // openai (по умолчанию) или azure
+	APIVersion string // Версия API Azure (по умолчанию версия go-openai)
+	Deployment string // Имя развертывания модели в Azure
+	Offline    bool   // Сеть запрещена: клиент отклоняет все запросы с ErrNetworkDisabled (OfflineTransport)
+}
+
+// Validate проверяет настройки подключения. Без сети (Offline) настройки не нужны.
+func (c ClientConfig) Validate() error {
+	if c.Offline {
+		return nil
+	}
+	apiType := strings.ToLower(c.APIType)
+	if c.APIKey == "" && apiType != APITypeCompatible {
+		return errors.New("'openai_api_key' is not set")
+	}
+	switch apiType {
+	case "", APITypeOpenAI:
+		return nil
+	case APITypeAzure:
+		var missing []string
+		if c.BaseURL == "" {
+			missing = append(missing, "'base_url'")
+		}
+		if c.Deployment == "" {
+			missing = append(missing, "'deployment'")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("api_type 'azure' requires %s", strings.Join(missing, " and "))
+		}
+		return nil
+	case APITypeCompatible:
+		if c.BaseURL == "" {
+			return fmt.Errorf("api_type %q requires 'base_url'", APITypeCompatible)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown api_type %q (expected %q, %q or %q)", c.APIType, APITypeOpenAI, APITypeAzure, APITypeCompatible)
+	}
+}
+
+// NewClient создает клиента OpenAI по настройкам подключения.
+// Для Azure все запросы направляются в развертывание Deployment независимо от модели,
+// для OpenAI-совместимого сервера (compatible) — на BaseURL с моделью из Config.Model.
+// Клиент без сети (Offline) отклоняет каждый запрос, не открывая соединения.
+func NewClient(c ClientConfig) (*openai.Client, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var config openai.ClientConfig
+	if strings.ToLower(c.APIType) == APITypeAzure {
+		config = openai.DefaultAzureConfig(c.APIKey, c.BaseURL)
+		if c.APIVersion != "" {
+			config.APIVersion = c.APIVersion
+		}
+		deployment := c.Deployment
+		config.AzureModelMapperFunc = func(string) string { return deployment }
+	} else {
+		config = openai.DefaultConfig(c.APIKey)
+		if c.BaseURL != "" {
+			config.BaseURL = c.BaseURL
+		}
+	}
+	if c.Offline {
+		config.HTTPClient = &http.Client{Transport: OfflineTransport{}}
+	}
+	return openai.NewClientWithConfig(config), nil
+}
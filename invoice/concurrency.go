@@ -0,0 +1,154 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// DefaultMaxConcurrency — верхняя граница адаптивного параллелизма по умолчанию.
+	DefaultMaxConcurrency = 8
+	// maxRateLimitRetries ограничивает повторную обработку файла после ошибки 429 в адаптивном режиме.
+	maxRateLimitRetries = 3
+	// defaultRateLimitPause — пауза перед новыми запросами после 429, если OpenAI не сообщил время ожидания.
+	defaultRateLimitPause = 2 * time.Second
+)
+
+// retryAfterPattern находит время ожидания в сообщении OpenAI ("Please try again in 1.5s").
+var retryAfterPattern = regexp.MustCompile(`try again in ([0-9.]+)(ms|s)`)
+
+// IsRateLimitError сообщает, что ошибка вызвана превышением лимитов OpenAI (HTTP 429).
+func IsRateLimitError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// retryAfter извлекает рекомендованное время ожидания из ошибки 429.
+func retryAfter(err error) (time.Duration, bool) {
+	m := retryAfterPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	value, parseErr := strconv.ParseFloat(m[1], 64)
+	if parseErr != nil {
+		return 0, false
+	}
+	if m[2] == "ms" {
+		return time.Duration(value * float64(time.Millisecond)), true
+	}
+	return time.Duration(value * float64(time.Second)), true
+}
+
+// concurrencyController ограничивает число одновременно обрабатываемых файлов и подстраивает
+// лимит по принципу AIMD: лимит уменьшается вдвое при ошибке 429 и растет на единицу
+// после серии успешных файлов длиной в текущий лимит. Лимит не выходит за [low, high].
+type concurrencyController struct {
+	mu          sync.Mutex
+	limit       int
+	low, high   int
+	active      int
+	streak      int           // Успешные файлы с последнего изменения лимита
+	pausedUntil time.Time     // До этого момента новые файлы не запускаются (Retry-After)
+	changed     chan struct{} // Закрывается при освобождении слота или изменении лимита
+}
+
+func newConcurrencyController(start, low, high int) *concurrencyController {
+	low = max(low, 1)
+	high = max(high, low)
+	return &concurrencyController{
+		limit:   clamp(start, low, high),
+		low:     low,
+		high:    high,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire ждет свободного слота с учетом текущего лимита и паузы после 429.
+func (c *concurrencyController) acquire(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		wait := time.Until(c.pausedUntil)
+		if wait <= 0 && c.active < c.limit {
+			c.active++
+			c.mu.Unlock()
+			return nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return ctx.Err()
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// release освобождает слот и учитывает результат обработки файла.
+// Возвращает текущий лимит и признак того, что он изменился.
+func (c *concurrencyController) release(err error) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	previous := c.limit
+	switch {
+	case IsRateLimitError(err):
+		c.rateLimited(err)
+	case err == nil:
+		c.succeeded()
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return c.limit, c.limit != previous
+}
+
+func (c *concurrencyController) rateLimited(err error) {
+	c.limit = max(c.limit/2, c.low)
+	c.streak = 0
+	pause, ok := retryAfter(err)
+	if !ok {
+		pause = defaultRateLimitPause
+	}
+	if until := time.Now().Add(pause); until.After(c.pausedUntil) {
+		c.pausedUntil = until
+	}
+}
+
+func (c *concurrencyController) succeeded() {
+	c.streak++
+	if c.streak >= c.limit && c.limit < c.high {
+		c.limit++
+		c.streak = 0
+	}
+}
+
+func clamp(value, low, high int) int {
+	return min(max(value, low), high)
+}
@@ -0,0 +1,125 @@
+package invoice
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// rateLimitError возвращает ошибку 429 с рекомендованным временем ожидания, как ее сообщает OpenAI.
+func rateLimitError(retry string) error {
+	return &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "Rate limit reached. Please try again in " + retry + "."}
+}
+
+// TestConcurrencyControllerSequence прогоняет последовательность успехов и ошибок 429 и проверяет лимит
+// после каждого файла: AIMD уменьшает его вдвое при 429 и увеличивает на единицу после серии успехов
+// длиной в текущий лимит, не выходя за [low, high].
+func TestConcurrencyControllerSequence(t *testing.T) {
+	c := newConcurrencyController(4, 1, 6)
+	steps := []struct {
+		err  error
+		want int
+	}{
+		{nil, 4}, {nil, 4}, {nil, 4}, {nil, 5}, // 4 успеха при лимите 4
+		{rateLimitError("1ms"), 2},
+		{nil, 2}, {nil, 3},
+		{rateLimitError("1ms"), 1},
+		{rateLimitError("1ms"), 1}, // Не ниже low
+		{nil, 2},
+		{context.DeadlineExceeded, 2}, // Другие ошибки не меняют лимит
+		{nil, 2}, {nil, 3},
+		{nil, 3}, {nil, 3}, {nil, 4},
+		{nil, 4}, {nil, 4}, {nil, 4}, {nil, 5},
+		{nil, 5}, {nil, 5}, {nil, 5}, {nil, 5}, {nil, 6},
+		{nil, 6}, {nil, 6}, {nil, 6}, {nil, 6}, {nil, 6}, {nil, 6}, {nil, 6}, // Не выше high
+	}
+	for i, step := range steps {
+		if err := c.acquire(context.Background()); err != nil {
+			t.Fatalf("step %d: acquire: %v", i, err)
+		}
+		limit, _ := c.release(step.err)
+		if limit != step.want {
+			t.Fatalf("step %d (%v): limit %d, want %d", i, step.err, limit, step.want)
+		}
+	}
+}
+
+func TestConcurrencyControllerPausesAfterRateLimit(t *testing.T) {
+	c := newConcurrencyController(2, 1, 2)
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.release(rateLimitError("150ms"))
+
+	started := time.Now()
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(started); waited < 100*time.Millisecond {
+		t.Errorf("acquire after 429 waited %s, want the 150ms OpenAI asked for", waited)
+	}
+	c.release(nil)
+
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.release(rateLimitError("1m"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire during the pause = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestConcurrencyControllerBoundsActive запускает параллельные файлы со случайными ошибками 429
+// и проверяет, что одновременно обрабатывается не больше high файлов.
+func TestConcurrencyControllerBoundsActive(t *testing.T) {
+	const high = 3
+	c := newConcurrencyController(high, 1, high)
+	var active, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 60 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			n := active.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			active.Add(-1)
+			var err error
+			if i%7 == 0 {
+				err = rateLimitError("2ms")
+			}
+			c.release(err)
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > high {
+		t.Errorf("%d files processed at once, want at most %d", p, high)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{"1.5s": 1500 * time.Millisecond, "250ms": 250 * time.Millisecond}
+	for value, want := range tests {
+		if got, ok := retryAfter(rateLimitError(value)); !ok || got != want {
+			t.Errorf("retryAfter(%s) = %s, %v, want %s", value, got, ok, want)
+		}
+	}
+	if _, ok := retryAfter(rateLimitError("a moment")); ok {
+		t.Error("retryAfter parsed a message without a duration")
+	}
+	if IsRateLimitError(context.Canceled) || !IsRateLimitError(rateLimitError("1s")) {
+		t.Error("IsRateLimitError does not tell 429 from other errors")
+	}
+}
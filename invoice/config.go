@@ -0,0 +1,214 @@
+package invoice
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// Validate проверяет конфигурацию целиком и возвращает ошибку со списком всех найденных проблем
+// (errors.Join, по одной на строку), чтобы инструменты отказывали при запуске, а не после загрузки файлов.
+// Каждая проблема начинается с имени параметра config.json.
+func (c Config) Validate() error {
+	var problems []error
+	add := func(field string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("'%s': %w", field, err))
+		}
+	}
+
+	add("allow_network", c.ValidateNetwork())
+	add("openai_api_key", c.validateAPIKey())
+	if err := c.ClientConfig().Validate(); err != nil && c.OpenAPIKey != "" {
+		add("api_type", err) // Отсутствующий ключ уже учтен выше
+	}
+	add("model", c.validateModel())
+	add("my_company", c.validateCompanies())
+	add(c.popplerPathField(), validateDir(c.PopplerPath()))
+
+	_, err := ParseRoundingPolicy(c.RoundingPolicy)
+	add("rounding_policy", err)
+	_, err = ParseCSVDelimiter(c.CSVDelimiter)
+	add("csv_delimiter", err)
+	_, err = ParsePageSelection(c.PageSelection)
+	add("page_selection", err)
+	_, err = ParseExtractionMode(c.ExtractionMode)
+	add("extraction_mode", err)
+	_, err = pdfimg.ParseFormat(c.PDFImageFormat)
+	add("pdf_image_format", err)
+	add("pdf_dpi", c.validatePDFDPI())
+	add("categories", ValidateCategories(c.Categories))
+	_, err = c.AliasOverrides()
+	add("counterparty_aliases", err)
+	if _, err := c.PromptTemplates(); err != nil {
+		problems = append(problems, err) // Ошибка называет шаблон и его файл
+	}
+	_, err = c.SourceRetentionPeriod()
+	add("source_retention", err)
+	_, err = c.RequestTimeoutLimit()
+	add("request_timeout", err)
+	_, err = c.FileTimeoutLimit()
+	add("file_timeout", err)
+	_, err = c.ExtractResponseMode()
+	add("extract_response", err)
+	_, err = c.ExtractAsyncThreshold()
+	add("extract_async_after", err)
+	_, err = c.ReprocessMaxAgeLimit()
+	add("reprocess_max_age", err)
+	if c.ReprocessBudget < 0 {
+		add("reprocess_daily_budget", fmt.Errorf("must not be negative, got %g", c.ReprocessBudget))
+	}
+
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"thumbnail_size", c.ThumbnailSize},
+		{"thumbnails_max_mb", c.ThumbnailsMaxMB},
+		{"upload_max_mb", c.UploadMaxMB},
+		{"max_all_pages", c.MaxAllPages},
+		{"pdf_max_pages", c.PDFMaxPages},
+		{"concurrency", c.Concurrency},
+		{"min_concurrency", c.MinConcurrency},
+		{"max_concurrency", c.MaxConcurrency},
+		{"requests_per_minute", c.RequestsPerMinute},
+		{"max_concurrent_requests", c.ConcurrentRequests},
+		{"degraded_after_failures", c.DegradedAfter},
+	} {
+		if limit.value < 0 {
+			add(limit.field, fmt.Errorf("must not be negative, got %d", limit.value))
+		}
+	}
+	if c.MinConcurrency > 0 && c.MaxConcurrency > 0 && c.MinConcurrency > c.MaxConcurrency {
+		add("min_concurrency", fmt.Errorf("%d is greater than max_concurrency %d", c.MinConcurrency, c.MaxConcurrency))
+	}
+	if c.ConfidenceThreshold < 0 || c.ConfidenceThreshold > 1 {
+		add("confidence_threshold", fmt.Errorf("must be between 0 and 1, got %g", c.ConfidenceThreshold))
+	}
+	if c.JSONRepairAttempts < -1 {
+		add("json_repair_attempts", fmt.Errorf("must be -1 (no repair) or more, got %d", c.JSONRepairAttempts))
+	}
+	for model, price := range c.ModelPrices {
+		if price.PromptPerMillion < 0 || price.CompletionPerMillion < 0 {
+			add("model_prices", fmt.Errorf("prices of %q must not be negative", model))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// ValidateTelegram проверяет параметры Telegram-бота (cmd/tgbot) в дополнение к Validate. Бот без списка
+// пользователей не запускается: иначе любой, кто найдет бота, тратил бы ключ OpenAI и пополнял базу контрагентов.
+func (c Config) ValidateTelegram() error {
+	var problems []error
+	if strings.TrimSpace(c.TelegramToken) == "" {
+		problems = append(problems, errors.New("'telegram_bot_token': is not set, create a bot with @BotFather"))
+	}
+	if len(c.TelegramUsers) == 0 {
+		problems = append(problems, errors.New("'telegram_allowed_users': is empty, list the Telegram user IDs allowed to use the bot"))
+	}
+	for _, id := range c.TelegramUsers {
+		if id <= 0 {
+			problems = append(problems, fmt.Errorf("'telegram_allowed_users': %d is not a user ID", id))
+		}
+	}
+	if !c.NetworkAllowed() {
+		problems = append(problems, errors.New("'allow_network': the bot needs network access to reach Telegram"))
+	}
+	return errors.Join(problems...)
+}
+
+// PopplerPath возвращает директорию утилит poppler для текущей ОС: poppler_path_windows в Windows,
+// poppler_path_mac в остальных системах. Пустая строка — поиск в PATH.
+func (c Config) PopplerPath() string {
+	if runtime.GOOS == "windows" {
+		return c.PopplerPathWindows
+	}
+	return c.PopplerPathMac
+}
+
+// popplerPathField возвращает имя параметра, из которого берется PopplerPath.
+func (c Config) popplerPathField() string {
+	if runtime.GOOS == "windows" {
+		return "poppler_path_windows"
+	}
+	return "poppler_path_mac"
+}
+
+// validateAPIKey проверяет, что ключ OpenAI задан и не скопирован из примера. Без сети
+// и для OpenAI-совместимых серверов ключ не нужен.
+func (c Config) validateAPIKey() error {
+	if !c.NetworkAllowed() || strings.EqualFold(c.APIType, APITypeCompatible) {
+		return nil
+	}
+	key := strings.TrimSpace(c.OpenAPIKey)
+	if key == "" {
+		return errors.New("is not set")
+	}
+	// Заглушки из config.json.example и README: "sk-xxxx...", "sk-...", "YOUR_API_KEY"
+	if key == "sk-..." || strings.Contains(key, "xxxxxxxx") || strings.HasPrefix(strings.ToUpper(key), "YOUR") {
+		return errors.New("is still a placeholder, set your OpenAI API key")
+	}
+	return nil
+}
+
+// validateModel проверяет, что модель OpenAI известна: есть в ценах или поддерживает JSON Schema.
+// Модели Azure (развертывания) и OpenAI-совместимых серверов не проверяются.
+func (c Config) validateModel() error {
+	switch strings.ToLower(c.APIType) {
+	case APITypeAzure, APITypeCompatible:
+		return nil
+	}
+	model := c.ModelName()
+	if _, ok := c.ModelPrices[model]; ok {
+		return nil
+	}
+	if _, ok := DefaultModelPrices[model]; ok || supportsJSONSchema(model) {
+		return nil
+	}
+	return fmt.Errorf("unknown OpenAI model %q, expected e.g. %s or %s (add it to model_prices to use it anyway)", model, DefaultModel, "gpt-4o-mini")
+}
+
+// validateCompanies проверяет, что у своей компании есть наименование. my_company может быть пустой,
+// если свои юрлица заданы в companies.
+func (c Config) validateCompanies() error {
+	var problems []string
+	if strings.TrimSpace(c.MyCompany.Name) == "" && len(c.Companies) == 0 {
+		problems = append(problems, "'name' is not set")
+	}
+	for _, alias := range c.CompanyAliases() {
+		if strings.TrimSpace(c.Companies[alias].Name) == "" {
+			problems = append(problems, fmt.Sprintf("companies[%q] has no 'name'", alias))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validatePDFDPI проверяет, что pdf_dpi не задан или лежит в пределах MinPDFDPI..MaxPDFDPI.
+func (c Config) validatePDFDPI() error {
+	if c.PDFDPI != 0 && (c.PDFDPI < MinPDFDPI || c.PDFDPI > MaxPDFDPI) {
+		return fmt.Errorf("must be between %d and %d, got %d", MinPDFDPI, MaxPDFDPI, c.PDFDPI)
+	}
+	return nil
+}
+
+// validateDir проверяет, что путь, если он задан, указывает на существующую директорию.
+func validateDir(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("directory %q does not exist", path)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", path)
+	}
+	return nil
+}
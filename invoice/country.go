@@ -0,0 +1,339 @@
+package invoice
+
+import (
+	"strings"
+	"unicode"
+)
+
+// country — страна с кодами ISO 3166-1 и названиями, в которых она встречается в инвойсах и ответах модели.
+type country struct {
+	alpha2 string
+	alpha3 string
+	names  []string
+}
+
+// countries — страны ISO 3166-1 с английскими названиями стандарта, а для стран, часто встречающихся в инвойсах, —
+// также с русскими, немецкими и местными названиями.
+var countries = []country{
+	{"AD", "AND", []string{"Andorra", "Principality of Andorra"}},
+	{"AE", "ARE", []string{"United Arab Emirates", "UAE", "Объединенные Арабские Эмираты", "ОАЭ", "Vereinigte Arabische Emirate"}},
+	{"AF", "AFG", []string{"Afghanistan", "Islamic Republic of Afghanistan"}},
+	{"AG", "ATG", []string{"Antigua and Barbuda"}},
+	{"AI", "AIA", []string{"Anguilla"}},
+	{"AL", "ALB", []string{"Albania", "Republic of Albania", "Албания", "Albanien", "Shqipëria"}},
+	{"AM", "ARM", []string{"Armenia", "Republic of Armenia", "Армения", "Armenien", "Հայաստան"}},
+	{"AO", "AGO", []string{"Angola", "Republic of Angola"}},
+	{"AQ", "ATA", []string{"Antarctica"}},
+	{"AR", "ARG", []string{"Argentina", "Argentine Republic", "Аргентина", "Argentinien"}},
+	{"AS", "ASM", []string{"American Samoa"}},
+	{"AT", "AUT", []string{"Austria", "Republic of Austria", "Австрия", "Österreich"}},
+	{"AU", "AUS", []string{"Australia", "Австралия", "Australien"}},
+	{"AW", "ABW", []string{"Aruba"}},
+	{"AX", "ALA", []string{"Åland Islands"}},
+	{"AZ", "AZE", []string{"Azerbaijan", "Republic of Azerbaijan", "Азербайджан", "Aserbaidschan", "Azərbaycan"}},
+	{"BA", "BIH", []string{"Bosnia and Herzegovina", "Republic of Bosnia and Herzegovina", "Bosnia", "Босния и Герцеговина", "Bosnien und Herzegowina", "Bosna i Hercegovina"}},
+	{"BB", "BRB", []string{"Barbados"}},
+	{"BD", "BGD", []string{"Bangladesh", "People's Republic of Bangladesh"}},
+	{"BE", "BEL", []string{"Belgium", "Kingdom of Belgium", "Бельгия", "Belgien", "Belgique", "België"}},
+	{"BF", "BFA", []string{"Burkina Faso"}},
+	{"BG", "BGR", []string{"Bulgaria", "Republic of Bulgaria", "Болгария", "Bulgarien", "България"}},
+	{"BH", "BHR", []string{"Bahrain", "Kingdom of Bahrain"}},
+	{"BI", "BDI", []string{"Burundi", "Republic of Burundi"}},
+	{"BJ", "BEN", []string{"Benin", "Republic of Benin"}},
+	{"BL", "BLM", []string{"Saint Barthélemy"}},
+	{"BM", "BMU", []string{"Bermuda"}},
+	{"BN", "BRN", []string{"Brunei Darussalam"}},
+	{"BO", "BOL", []string{"Bolivia, Plurinational State of", "Bolivia", "Plurinational State of Bolivia"}},
+	{"BQ", "BES", []string{"Bonaire, Sint Eustatius and Saba"}},
+	{"BR", "BRA", []string{"Brazil", "Federative Republic of Brazil", "Бразилия", "Brasilien", "Brasil"}},
+	{"BS", "BHS", []string{"Bahamas", "Commonwealth of the Bahamas"}},
+	{"BT", "BTN", []string{"Bhutan", "Kingdom of Bhutan"}},
+	{"BV", "BVT", []string{"Bouvet Island"}},
+	{"BW", "BWA", []string{"Botswana", "Republic of Botswana"}},
+	{"BY", "BLR", []string{"Belarus", "Republic of Belarus", "Беларусь", "Белоруссия", "Республика Беларусь", "Weißrussland", "Belarus'"}},
+	{"BZ", "BLZ", []string{"Belize"}},
+	{"CA", "CAN", []string{"Canada", "Канада", "Kanada"}},
+	{"CC", "CCK", []string{"Cocos (Keeling) Islands"}},
+	{"CD", "COD", []string{"Congo, The Democratic Republic of the"}},
+	{"CF", "CAF", []string{"Central African Republic"}},
+	{"CG", "COG", []string{"Congo", "Republic of the Congo"}},
+	{"CH", "CHE", []string{"Switzerland", "Swiss Confederation", "Швейцария", "Schweiz", "Suisse", "Svizzera"}},
+	{"CI", "CIV", []string{"Côte d'Ivoire", "Republic of Côte d'Ivoire"}},
+	{"CK", "COK", []string{"Cook Islands"}},
+	{"CL", "CHL", []string{"Chile", "Republic of Chile", "Чили"}},
+	{"CM", "CMR", []string{"Cameroon", "Republic of Cameroon"}},
+	{"CN", "CHN", []string{"China", "People's Republic of China", "PRC", "Китай", "КНР", "Volksrepublik China"}},
+	{"CO", "COL", []string{"Colombia", "Republic of Colombia"}},
+	{"CR", "CRI", []string{"Costa Rica", "Republic of Costa Rica"}},
+	{"CU", "CUB", []string{"Cuba", "Republic of Cuba"}},
+	{"CV", "CPV", []string{"Cabo Verde", "Republic of Cabo Verde"}},
+	{"CW", "CUW", []string{"Curaçao"}},
+	{"CX", "CXR", []string{"Christmas Island"}},
+	{"CY", "CYP", []string{"Cyprus", "Republic of Cyprus", "Кипр", "Zypern", "Κύπρος", "Kıbrıs"}},
+	{"CZ", "CZE", []string{"Czechia", "Czech Republic", "Чехия", "Чешская Республика", "Tschechien", "Tschechische Republik", "Česko", "Česká republika"}},
+	{"DE", "DEU", []string{"Germany", "Federal Republic of Germany", "Германия", "Deutschland", "Bundesrepublik Deutschland", "ФРГ"}},
+	{"DJ", "DJI", []string{"Djibouti", "Republic of Djibouti"}},
+	{"DK", "DNK", []string{"Denmark", "Kingdom of Denmark", "Дания", "Dänemark", "Danmark"}},
+	{"DM", "DMA", []string{"Dominica", "Commonwealth of Dominica"}},
+	{"DO", "DOM", []string{"Dominican Republic"}},
+	{"DZ", "DZA", []string{"Algeria", "People's Democratic Republic of Algeria"}},
+	{"EC", "ECU", []string{"Ecuador", "Republic of Ecuador"}},
+	{"EE", "EST", []string{"Estonia", "Republic of Estonia", "Эстония", "Estland", "Eesti"}},
+	{"EG", "EGY", []string{"Egypt", "Arab Republic of Egypt", "Египет", "Ägypten"}},
+	{"EH", "ESH", []string{"Western Sahara"}},
+	{"ER", "ERI", []string{"Eritrea", "the State of Eritrea"}},
+	{"ES", "ESP", []string{"Spain", "Kingdom of Spain", "Испания", "Spanien", "España"}},
+	{"ET", "ETH", []string{"Ethiopia", "Federal Democratic Republic of Ethiopia"}},
+	{"FI", "FIN", []string{"Finland", "Republic of Finland", "Финляндия", "Finnland", "Suomi"}},
+	{"FJ", "FJI", []string{"Fiji", "Republic of Fiji"}},
+	{"FK", "FLK", []string{"Falkland Islands (Malvinas)"}},
+	{"FM", "FSM", []string{"Micronesia, Federated States of", "Federated States of Micronesia", "Micronesia", "Микронезия"}},
+	{"FO", "FRO", []string{"Faroe Islands"}},
+	{"FR", "FRA", []string{"France", "French Republic", "Франция", "Frankreich"}},
+	{"GA", "GAB", []string{"Gabon", "Gabonese Republic"}},
+	{"GB", "GBR", []string{"United Kingdom", "United Kingdom of Great Britain and Northern Ireland", "UK", "Great Britain", "Britain", "England", "Scotland", "Wales", "Northern Ireland", "Великобритания", "Соединенное Королевство", "Англия", "Vereinigtes Königreich", "Großbritannien"}},
+	{"GD", "GRD", []string{"Grenada"}},
+	{"GE", "GEO", []string{"Georgia", "Грузия", "Georgien", "საქართველო", "Sakartvelo"}},
+	{"GF", "GUF", []string{"French Guiana"}},
+	{"GG", "GGY", []string{"Guernsey"}},
+	{"GH", "GHA", []string{"Ghana", "Republic of Ghana"}},
+	{"GI", "GIB", []string{"Gibraltar"}},
+	{"GL", "GRL", []string{"Greenland"}},
+	{"GM", "GMB", []string{"Gambia", "Republic of the Gambia"}},
+	{"GN", "GIN", []string{"Guinea", "Republic of Guinea"}},
+	{"GP", "GLP", []string{"Guadeloupe"}},
+	{"GQ", "GNQ", []string{"Equatorial Guinea", "Republic of Equatorial Guinea"}},
+	{"GR", "GRC", []string{"Greece", "Hellenic Republic", "Греция", "Griechenland", "Ελλάδα", "Hellas"}},
+	{"GS", "SGS", []string{"South Georgia and the South Sandwich Islands"}},
+	{"GT", "GTM", []string{"Guatemala", "Republic of Guatemala"}},
+	{"GU", "GUM", []string{"Guam"}},
+	{"GW", "GNB", []string{"Guinea-Bissau", "Republic of Guinea-Bissau"}},
+	{"GY", "GUY", []string{"Guyana", "Republic of Guyana"}},
+	{"HK", "HKG", []string{"Hong Kong", "Hong Kong Special Administrative Region of China", "Гонконг", "Hongkong"}},
+	{"HM", "HMD", []string{"Heard Island and McDonald Islands"}},
+	{"HN", "HND", []string{"Honduras", "Republic of Honduras"}},
+	{"HR", "HRV", []string{"Croatia", "Republic of Croatia", "Хорватия", "Kroatien", "Hrvatska"}},
+	{"HT", "HTI", []string{"Haiti", "Republic of Haiti"}},
+	{"HU", "HUN", []string{"Hungary", "Венгрия", "Ungarn", "Magyarország"}},
+	{"ID", "IDN", []string{"Indonesia", "Republic of Indonesia", "Индонезия", "Indonesien"}},
+	{"IE", "IRL", []string{"Ireland", "Ирландия", "Irland", "Éire"}},
+	{"IL", "ISR", []string{"Israel", "State of Israel", "Израиль"}},
+	{"IM", "IMN", []string{"Isle of Man"}},
+	{"IN", "IND", []string{"India", "Republic of India", "Индия", "Indien"}},
+	{"IO", "IOT", []string{"British Indian Ocean Territory"}},
+	{"IQ", "IRQ", []string{"Iraq", "Republic of Iraq"}},
+	{"IR", "IRN", []string{"Iran, Islamic Republic of", "Iran", "Islamic Republic of Iran"}},
+	{"IS", "ISL", []string{"Iceland", "Republic of Iceland", "Исландия", "Island", "Ísland"}},
+	{"IT", "ITA", []string{"Italy", "Italian Republic", "Италия", "Italien", "Italia"}},
+	{"JE", "JEY", []string{"Jersey"}},
+	{"JM", "JAM", []string{"Jamaica"}},
+	{"JO", "JOR", []string{"Jordan", "Hashemite Kingdom of Jordan"}},
+	{"JP", "JPN", []string{"Japan", "Япония"}},
+	{"KE", "KEN", []string{"Kenya", "Republic of Kenya"}},
+	{"KG", "KGZ", []string{"Kyrgyzstan", "Kyrgyz Republic", "Киргизия", "Кыргызстан", "Kirgisistan"}},
+	{"KH", "KHM", []string{"Cambodia", "Kingdom of Cambodia"}},
+	{"KI", "KIR", []string{"Kiribati", "Republic of Kiribati"}},
+	{"KM", "COM", []string{"Comoros", "Union of the Comoros"}},
+	{"KN", "KNA", []string{"Saint Kitts and Nevis"}},
+	{"KP", "PRK", []string{"Korea, Democratic People's Republic of", "North Korea", "Democratic People's Republic of Korea"}},
+	{"KR", "KOR", []string{"Korea, Republic of", "South Korea", "Republic of Korea", "Korea", "Южная Корея", "Республика Корея", "Südkorea"}},
+	{"KW", "KWT", []string{"Kuwait", "State of Kuwait"}},
+	{"KY", "CYM", []string{"Cayman Islands"}},
+	{"KZ", "KAZ", []string{"Kazakhstan", "Republic of Kazakhstan", "Казахстан", "Kasachstan", "Қазақстан"}},
+	{"LA", "LAO", []string{"Lao People's Democratic Republic", "Laos"}},
+	{"LB", "LBN", []string{"Lebanon", "Lebanese Republic"}},
+	{"LC", "LCA", []string{"Saint Lucia"}},
+	{"LI", "LIE", []string{"Liechtenstein", "Principality of Liechtenstein", "Лихтенштейн"}},
+	{"LK", "LKA", []string{"Sri Lanka", "Democratic Socialist Republic of Sri Lanka"}},
+	{"LR", "LBR", []string{"Liberia", "Republic of Liberia"}},
+	{"LS", "LSO", []string{"Lesotho", "Kingdom of Lesotho"}},
+	{"LT", "LTU", []string{"Lithuania", "Republic of Lithuania", "Литва", "Litauen", "Lietuva"}},
+	{"LU", "LUX", []string{"Luxembourg", "Grand Duchy of Luxembourg", "Люксембург", "Luxemburg"}},
+	{"LV", "LVA", []string{"Latvia", "Republic of Latvia", "Латвия", "Lettland", "Latvija"}},
+	{"LY", "LBY", []string{"Libya"}},
+	{"MA", "MAR", []string{"Morocco", "Kingdom of Morocco"}},
+	{"MC", "MCO", []string{"Monaco", "Principality of Monaco"}},
+	{"MD", "MDA", []string{"Moldova, Republic of", "Moldova", "Republic of Moldova", "Молдова", "Молдавия", "Moldau", "Moldawien"}},
+	{"ME", "MNE", []string{"Montenegro", "Черногория", "Crna Gora", "Црна Гора"}},
+	{"MF", "MAF", []string{"Saint Martin (French part)"}},
+	{"MG", "MDG", []string{"Madagascar", "Republic of Madagascar"}},
+	{"MH", "MHL", []string{"Marshall Islands", "Republic of the Marshall Islands", "Маршалловы Острова"}},
+	{"MK", "MKD", []string{"North Macedonia", "Republic of North Macedonia", "Macedonia", "Северная Македония", "Македония", "Nordmazedonien", "Северна Македонија"}},
+	{"ML", "MLI", []string{"Mali", "Republic of Mali"}},
+	{"MM", "MMR", []string{"Myanmar", "Republic of Myanmar"}},
+	{"MN", "MNG", []string{"Mongolia", "Монголия", "Mongolei"}},
+	{"MO", "MAC", []string{"Macao", "Macao Special Administrative Region of China"}},
+	{"MP", "MNP", []string{"Northern Mariana Islands", "Commonwealth of the Northern Mariana Islands"}},
+	{"MQ", "MTQ", []string{"Martinique"}},
+	{"MR", "MRT", []string{"Mauritania", "Islamic Republic of Mauritania"}},
+	{"MS", "MSR", []string{"Montserrat"}},
+	{"MT", "MLT", []string{"Malta", "Republic of Malta", "Мальта"}},
+	{"MU", "MUS", []string{"Mauritius", "Republic of Mauritius"}},
+	{"MV", "MDV", []string{"Maldives", "Republic of Maldives"}},
+	{"MW", "MWI", []string{"Malawi", "Republic of Malawi"}},
+	{"MX", "MEX", []string{"Mexico", "United Mexican States", "Мексика", "Mexiko", "México"}},
+	{"MY", "MYS", []string{"Malaysia", "Малайзия"}},
+	{"MZ", "MOZ", []string{"Mozambique", "Republic of Mozambique"}},
+	{"NA", "NAM", []string{"Namibia", "Republic of Namibia"}},
+	{"NC", "NCL", []string{"New Caledonia"}},
+	{"NE", "NER", []string{"Niger", "Republic of the Niger"}},
+	{"NF", "NFK", []string{"Norfolk Island"}},
+	{"NG", "NGA", []string{"Nigeria", "Federal Republic of Nigeria"}},
+	{"NI", "NIC", []string{"Nicaragua", "Republic of Nicaragua"}},
+	{"NL", "NLD", []string{"Netherlands", "Kingdom of the Netherlands", "The Netherlands", "Holland", "Нидерланды", "Голландия", "Niederlande", "Nederland"}},
+	{"NO", "NOR", []string{"Norway", "Kingdom of Norway", "Норвегия", "Norwegen", "Norge"}},
+	{"NP", "NPL", []string{"Nepal", "Federal Democratic Republic of Nepal"}},
+	{"NR", "NRU", []string{"Nauru", "Republic of Nauru"}},
+	{"NU", "NIU", []string{"Niue"}},
+	{"NZ", "NZL", []string{"New Zealand", "Новая Зеландия", "Neuseeland"}},
+	{"OM", "OMN", []string{"Oman", "Sultanate of Oman"}},
+	{"PA", "PAN", []string{"Panama", "Republic of Panama"}},
+	{"PE", "PER", []string{"Peru", "Republic of Peru"}},
+	{"PF", "PYF", []string{"French Polynesia"}},
+	{"PG", "PNG", []string{"Papua New Guinea", "Independent State of Papua New Guinea"}},
+	{"PH", "PHL", []string{"Philippines", "Republic of the Philippines"}},
+	{"PK", "PAK", []string{"Pakistan", "Islamic Republic of Pakistan"}},
+	{"PL", "POL", []string{"Poland", "Republic of Poland", "Польша", "Polen", "Polska"}},
+	{"PM", "SPM", []string{"Saint Pierre and Miquelon"}},
+	{"PN", "PCN", []string{"Pitcairn"}},
+	{"PR", "PRI", []string{"Puerto Rico"}},
+	{"PS", "PSE", []string{"Palestine, State of", "the State of Palestine"}},
+	{"PT", "PRT", []string{"Portugal", "Portuguese Republic", "Португалия"}},
+	{"PW", "PLW", []string{"Palau", "Republic of Palau", "Палау"}},
+	{"PY", "PRY", []string{"Paraguay", "Republic of Paraguay"}},
+	{"QA", "QAT", []string{"Qatar", "State of Qatar"}},
+	{"RE", "REU", []string{"Réunion"}},
+	{"RO", "ROU", []string{"Romania", "Румыния", "Rumänien", "România"}},
+	{"RS", "SRB", []string{"Serbia", "Republic of Serbia", "Сербия", "Serbien", "Србија", "Srbija", "Republika Srbija", "Република Србија"}},
+	{"RU", "RUS", []string{"Russian Federation", "Russia", "Россия", "Российская Федерация", "РФ", "Russland", "Russische Föderation"}},
+	{"RW", "RWA", []string{"Rwanda", "Rwandese Republic"}},
+	{"SA", "SAU", []string{"Saudi Arabia", "Kingdom of Saudi Arabia", "Саудовская Аравия", "Saudi-Arabien"}},
+	{"SB", "SLB", []string{"Solomon Islands"}},
+	{"SC", "SYC", []string{"Seychelles", "Republic of Seychelles"}},
+	{"SD", "SDN", []string{"Sudan", "Republic of the Sudan"}},
+	{"SE", "SWE", []string{"Sweden", "Kingdom of Sweden", "Швеция", "Schweden", "Sverige"}},
+	{"SG", "SGP", []string{"Singapore", "Republic of Singapore", "Сингапур", "Singapur"}},
+	{"SH", "SHN", []string{"Saint Helena, Ascension and Tristan da Cunha"}},
+	{"SI", "SVN", []string{"Slovenia", "Republic of Slovenia", "Словения", "Slowenien", "Slovenija"}},
+	{"SJ", "SJM", []string{"Svalbard and Jan Mayen"}},
+	{"SK", "SVK", []string{"Slovakia", "Slovak Republic", "Словакия", "Slowakei", "Slovensko"}},
+	{"SL", "SLE", []string{"Sierra Leone", "Republic of Sierra Leone"}},
+	{"SM", "SMR", []string{"San Marino", "Republic of San Marino"}},
+	{"SN", "SEN", []string{"Senegal", "Republic of Senegal"}},
+	{"SO", "SOM", []string{"Somalia", "Federal Republic of Somalia"}},
+	{"SR", "SUR", []string{"Suriname", "Republic of Suriname"}},
+	{"SS", "SSD", []string{"South Sudan", "Republic of South Sudan"}},
+	{"ST", "STP", []string{"Sao Tome and Principe", "Democratic Republic of Sao Tome and Principe"}},
+	{"SV", "SLV", []string{"El Salvador", "Republic of El Salvador"}},
+	{"SX", "SXM", []string{"Sint Maarten (Dutch part)"}},
+	{"SY", "SYR", []string{"Syrian Arab Republic", "Syria"}},
+	{"SZ", "SWZ", []string{"Eswatini", "Kingdom of Eswatini"}},
+	{"TC", "TCA", []string{"Turks and Caicos Islands"}},
+	{"TD", "TCD", []string{"Chad", "Republic of Chad"}},
+	{"TF", "ATF", []string{"French Southern Territories"}},
+	{"TG", "TGO", []string{"Togo", "Togolese Republic"}},
+	{"TH", "THA", []string{"Thailand", "Kingdom of Thailand", "Таиланд", "Тайланд"}},
+	{"TJ", "TJK", []string{"Tajikistan", "Republic of Tajikistan", "Таджикистан", "Tadschikistan"}},
+	{"TK", "TKL", []string{"Tokelau"}},
+	{"TL", "TLS", []string{"Timor-Leste", "Democratic Republic of Timor-Leste"}},
+	{"TM", "TKM", []string{"Turkmenistan", "Туркменистан", "Туркмения"}},
+	{"TN", "TUN", []string{"Tunisia", "Republic of Tunisia"}},
+	{"TO", "TON", []string{"Tonga", "Kingdom of Tonga"}},
+	{"TR", "TUR", []string{"Türkiye", "Republic of Türkiye", "Turkey", "Турция", "Türkei"}},
+	{"TT", "TTO", []string{"Trinidad and Tobago", "Republic of Trinidad and Tobago"}},
+	{"TV", "TUV", []string{"Tuvalu"}},
+	{"TW", "TWN", []string{"Taiwan, Province of China", "Taiwan", "Тайвань"}},
+	{"TZ", "TZA", []string{"Tanzania, United Republic of", "Tanzania", "United Republic of Tanzania"}},
+	{"UA", "UKR", []string{"Ukraine", "Украина", "Україна"}},
+	{"UG", "UGA", []string{"Uganda", "Republic of Uganda"}},
+	{"UM", "UMI", []string{"United States Minor Outlying Islands"}},
+	{"US", "USA", []string{"United States", "United States of America", "USA", "U.S.A.", "US", "America", "США", "Соединенные Штаты Америки", "Соединенные Штаты", "Vereinigte Staaten", "Vereinigte Staaten von Amerika"}},
+	{"UY", "URY", []string{"Uruguay", "Eastern Republic of Uruguay"}},
+	{"UZ", "UZB", []string{"Uzbekistan", "Republic of Uzbekistan", "Узбекистан", "Usbekistan", "Oʻzbekiston"}},
+	{"VA", "VAT", []string{"Holy See (Vatican City State)"}},
+	{"VC", "VCT", []string{"Saint Vincent and the Grenadines"}},
+	{"VE", "VEN", []string{"Venezuela, Bolivarian Republic of", "Venezuela", "Bolivarian Republic of Venezuela"}},
+	{"VG", "VGB", []string{"Virgin Islands, British", "British Virgin Islands"}},
+	{"VI", "VIR", []string{"Virgin Islands, U.S.", "Virgin Islands of the United States"}},
+	{"VN", "VNM", []string{"Viet Nam", "Vietnam", "Socialist Republic of Viet Nam", "Вьетнам"}},
+	{"VU", "VUT", []string{"Vanuatu", "Republic of Vanuatu"}},
+	{"WF", "WLF", []string{"Wallis and Futuna"}},
+	{"WS", "WSM", []string{"Samoa", "Independent State of Samoa"}},
+	{"YE", "YEM", []string{"Yemen", "Republic of Yemen"}},
+	{"YT", "MYT", []string{"Mayotte"}},
+	{"ZA", "ZAF", []string{"South Africa", "Republic of South Africa", "Южная Африка", "ЮАР", "Südafrika"}},
+	{"ZM", "ZMB", []string{"Zambia", "Republic of Zambia"}},
+	{"ZW", "ZWE", []string{"Zimbabwe", "Republic of Zimbabwe"}},
+}
+
+// countryIndex сопоставляет коды и названия стран (в виде countryKey) кодам ISO 3166-1 alpha-2.
+var countryIndex = func() map[string]string {
+	index := make(map[string]string)
+	for _, c := range countries {
+		index[countryKey(c.alpha2)] = c.alpha2
+		index[countryKey(c.alpha3)] = c.alpha2
+		for _, name := range c.names {
+			index[countryKey(name)] = c.alpha2
+		}
+	}
+	index["el"] = "GR" // Префикс VAT-номеров Греции
+	return index
+}()
+
+// countryKey приводит код или название страны к виду для поиска: нижний регистр, без точек и лишних пробелов,
+// "ё" как "е".
+func countryKey(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r == '.':
+			return -1
+		case r == 'ё' || r == 'Ё':
+			return 'е'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return unicode.ToLower(r)
+	}, value)
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.TrimPrefix(value, "the ")
+}
+
+// NormalizeCountry возвращает код ISO 3166-1 alpha-2 страны по коду alpha-2, alpha-3 или названию
+// (английскому, русскому, немецкому или местному). Для неизвестной страны возвращает false.
+func NormalizeCountry(value string) (string, bool) {
+	code, ok := countryIndex[countryKey(value)]
+	return code, ok
+}
+
+// NormalizeCountry заполняет CountryCode кодом alpha-2 по коду, который вернула модель (в том числе alpha-3),
+// а если он не распознан — по названию страны. Country не меняется. Страна, не распознанная ни по коду,
+// ни по названию, остается как есть: ее отмечает Validate.
+func (c *Counterparty) NormalizeCountry() {
+	if code, ok := NormalizeCountry(c.CountryCode); ok {
+		c.CountryCode = code
+	} else if code, ok := NormalizeCountry(c.Country); ok {
+		c.CountryCode = code
+	}
+}
+
+// ReportCountry возвращает страну контрагента для отчетов: код ISO 3166-1 alpha-2, а если страна
+// не распознана — ее написание из инвойса.
+func (c Counterparty) ReportCountry() string {
+	if code, ok := NormalizeCountry(c.CountryCode); ok {
+		return code
+	}
+	return c.Country
+}
+
+// countryCode приводит код страны к alpha-2, а неизвестный код — к верхнему регистру.
+func countryCode(value string) string {
+	if code, ok := NormalizeCountry(value); ok {
+		return code
+	}
+	return strings.ToUpper(strings.TrimSpace(value))
+}
+
+// sameCountry сообщает, что коды стран обозначают одну страну (alpha-2 и alpha-3 считаются одинаковыми).
+func sameCountry(a, b string) bool {
+	return countryCode(a) == countryCode(b)
+}
@@ -0,0 +1,81 @@
+package invoice
+
+import (
+	"math"
+	"strings"
+)
+
+// CreditLink связывает кредит-ноту пакета с исходным инвойсом.
+type CreditLink struct {
+	SourceFile    string  `json:"source_file"`
+	Number        string  `json:"number"`
+	Counterparty  string  `json:"counterparty"`
+	Currency      string  `json:"currency"`
+	Amount        float64 `json:"amount"`                   // Сумма кредит-ноты (отрицательная)
+	InvoiceFile   string  `json:"invoice_file,omitempty"`   // Файл связанного инвойса; пусто, если связь не найдена
+	InvoiceNumber string  `json:"invoice_number,omitempty"` // Номер связанного инвойса
+}
+
+// Linked сообщает, найден ли исходный инвойс.
+func (c CreditLink) Linked() bool {
+	return c.InvoiceNumber != "" || c.InvoiceFile != ""
+}
+
+// LinkCreditNotes находит для каждой кредит-ноты исходный инвойс того же контрагента:
+// сначала по номеру из Reference, затем по совпадению суммы и валюты.
+func LinkCreditNotes(results []Result) []CreditLink {
+	var invoices []Result
+	for _, res := range results {
+		if res.Invoice != nil && !res.Invoice.IsCreditNote() {
+			invoices = append(invoices, res)
+		}
+	}
+
+	var links []CreditLink
+	for _, res := range results {
+		if res.Invoice == nil || !res.Invoice.IsCreditNote() {
+			continue
+		}
+		credit := *res.Invoice
+		link := CreditLink{
+			SourceFile:   res.SourceFile,
+			Number:       credit.Number,
+			Counterparty: credit.Counterparty.Name,
+			Currency:     strings.ToUpper(credit.Currency),
+			Amount:       credit.SignedTotal(),
+		}
+		if original := findCreditedInvoice(credit, invoices); original != nil {
+			link.InvoiceFile = original.SourceFile
+			link.InvoiceNumber = original.Invoice.Number
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+func findCreditedInvoice(credit Invoice, invoices []Result) *Result {
+	counterparty := counterpartyKey(credit.Counterparty)
+	if credit.Reference != "" {
+		for i, res := range invoices {
+			if counterpartyKey(res.Invoice.Counterparty) == counterparty && normalizeName(res.Invoice.Number) == normalizeName(credit.Reference) {
+				return &invoices[i]
+			}
+		}
+	}
+	for i, res := range invoices {
+		if counterpartyKey(res.Invoice.Counterparty) == counterparty &&
+			strings.EqualFold(res.Invoice.Currency, credit.Currency) &&
+			ToMinor(res.Invoice.TotalAmount, credit.Currency, RoundHalfUp) == ToMinor(math.Abs(credit.TotalAmount), credit.Currency, RoundHalfUp) {
+			return &invoices[i]
+		}
+	}
+	return nil
+}
+
+// counterpartyKey идентифицирует контрагента по VAT, а при его отсутствии — по наименованию.
+func counterpartyKey(cp Counterparty) string {
+	if cp.VAT != "" {
+		return strings.ToLower(strings.TrimSpace(cp.VAT))
+	}
+	return normalizeName(cp.Name)
+}
@@ -0,0 +1,64 @@
+package invoice
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// utf8BOM позволяет Excel определить кодировку CSV и корректно показать кириллицу.
+const utf8BOM = "\uFEFF"
+
+// ParseCSVDelimiter разбирает csv_delimiter из конфига.
+// Пустая строка означает запятую; для локалей с десятичной запятой обычно используют ";".
+func ParseCSVDelimiter(value string) (rune, error) {
+	if value == "" {
+		return ',', nil
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("invalid csv delimiter %q (expected a single character)", value)
+	}
+	return r, nil
+}
+
+// WriteCSVTable записывает таблицу в CSV в кодировке UTF-8 с BOM.
+// Значения строк форматируются так же, как их показывает Excel-отчет.
+func WriteCSVTable(w io.Writer, delimiter rune, header []string, rows [][]any) error {
+	if _, err := io.WriteString(w, utf8BOM); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, value := range row {
+			if i < len(record) {
+				record[i] = csvValue(value)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,135 @@
+package invoice
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// CurrencyCount — число инвойсов контрагента в одной валюте.
+type CurrencyCount struct {
+	Currency string `json:"currency"`
+	Invoices int    `json:"invoices"`
+}
+
+// minDefaultCurrencyInvoices — сколько инвойсов нужно, чтобы у контрагента появилась валюта по умолчанию.
+const minDefaultCurrencyInvoices = 2
+
+// RecordCurrency учитывает валюту очередного инвойса контрагента и пересчитывает DefaultCurrency:
+// ею становится валюта больше чем половины инвойсов, если их не меньше minDefaultCurrencyInvoices.
+func (c *Counterparty) RecordCurrency(currency string) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return
+	}
+	// Копия, чтобы не изменить историю контрагента, с которым c делит срез
+	counts := append([]CurrencyCount(nil), c.Currencies...)
+	found := false
+	for i := range counts {
+		if counts[i].Currency == currency {
+			counts[i].Invoices++
+			found = true
+			break
+		}
+	}
+	if !found {
+		counts = append(counts, CurrencyCount{Currency: currency, Invoices: 1})
+	}
+	c.Currencies = counts
+	c.updateDefaultCurrency()
+}
+
+// updateDefaultCurrency пересчитывает DefaultCurrency по Currencies.
+func (c *Counterparty) updateDefaultCurrency() {
+	total, best := 0, CurrencyCount{}
+	for _, count := range c.Currencies {
+		total += count.Invoices
+		if count.Invoices > best.Invoices {
+			best = count
+		}
+	}
+	c.DefaultCurrency = ""
+	if total >= minDefaultCurrencyInvoices && best.Invoices*2 > total {
+		c.DefaultCurrency = best.Currency
+	}
+}
+
+// mergeCurrencies добавляет к истории валют контрагента историю другой записи того же контрагента.
+func (c *Counterparty) mergeCurrencies(other Counterparty) {
+	for _, count := range other.Currencies {
+		for range count.Invoices {
+			c.RecordCurrency(count.Currency)
+		}
+	}
+}
+
+// currencyInvoices возвращает число инвойсов контрагента в валюте currency и всего.
+func (c Counterparty) currencyInvoices(currency string) (count, total int) {
+	for _, cc := range c.Currencies {
+		total += cc.Invoices
+		if cc.Currency == currency {
+			count = cc.Invoices
+		}
+	}
+	return count, total
+}
+
+// amountDecimals возвращает число знаков после запятой в сумме (не больше 4).
+func amountDecimals(amount float64) int {
+	for d := range 4 {
+		scaled := amount * math.Pow10(d)
+		if math.Abs(scaled-math.Round(scaled)) < 1e-6 {
+			return d
+		}
+	}
+	return 4
+}
+
+// roundAmounts запоминает точность сумм документа (Invoice.AmountDecimals) и округляет их до точности
+// валюты. Суммы с большим числом знаков, чем допускает валюта (1234.50 JPY), не округляются: скорее всего,
+// ошибочна валюта, и CheckCurrency может ее исправить без потери копеек.
+func (p *Processor) roundAmounts(inv *Invoice) {
+	inv.AmountDecimals = max(amountDecimals(inv.TotalAmount), amountDecimals(inv.TaxAmount))
+	if p.roundingPolicy != "" && inv.AmountDecimals <= MinorUnits(inv.Currency) {
+		NormalizeAmounts(inv, p.roundingPolicy)
+	}
+}
+
+// suggestsCurrency сообщает, что запись сумм в документе явно указывает на валюту currency, а не на
+// извлеченную: валюта не извлечена, или у сумм больше знаков после запятой, чем допускает извлеченная
+// валюта (1234.50 JPY), но не больше, чем допускает currency.
+func (inv Invoice) suggestsCurrency(currency string) bool {
+	if inv.Currency == "" {
+		return true
+	}
+	return inv.AmountDecimals > MinorUnits(inv.Currency) && inv.AmountDecimals <= MinorUnits(currency)
+}
+
+// CheckCurrency сравнивает валюту инвойса с валютой по умолчанию контрагента cp и возвращает предупреждение,
+// если она отличается. Для контрагента без истории (DefaultCurrency пуста) предупреждения нет.
+// При autoCorrect валюта исправляется на валюту по умолчанию, если на нее явно указывает запись сумм.
+func CheckCurrency(inv *Invoice, cp Counterparty, autoCorrect bool) *ValidationIssue {
+	expected := cp.DefaultCurrency
+	current := strings.ToUpper(strings.TrimSpace(inv.Currency))
+	if expected == "" || current == expected {
+		return nil
+	}
+	count, total := cp.currencyInvoices(expected)
+	corrected := autoCorrect && inv.suggestsCurrency(expected)
+	var message string
+	switch {
+	case corrected && current == "":
+		message = fmt.Sprintf("missing currency set to %s, the counterparty's usual currency (%d of %d invoices)", expected, count, total)
+	case corrected:
+		message = fmt.Sprintf("currency %s corrected to %s: amounts have %d decimal places, and %s is the counterparty's usual currency (%d of %d invoices)",
+			current, expected, inv.AmountDecimals, expected, count, total)
+	case current == "":
+		message = fmt.Sprintf("currency is missing, the counterparty usually invoices in %s (%d of %d invoices)", expected, count, total)
+	default:
+		message = fmt.Sprintf("currency %s differs from the counterparty's usual currency %s (%d of %d invoices), check the extraction", current, expected, count, total)
+	}
+	if corrected {
+		inv.Currency = expected
+	}
+	return &ValidationIssue{Field: "currency", Severity: SeverityWarning, Message: message}
+}
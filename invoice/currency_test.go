@@ -0,0 +1,86 @@
+package invoice
+
+import (
+	"strings"
+	"testing"
+)
+
+// counterpartyWithHistory возвращает контрагента, у которого уже учтены инвойсы в валютах currencies.
+func counterpartyWithHistory(currencies ...string) Counterparty {
+	cp := Counterparty{Name: "ACME GmbH"}
+	for _, currency := range currencies {
+		cp.RecordCurrency(currency)
+	}
+	return cp
+}
+
+func TestDefaultCurrency(t *testing.T) {
+	tests := []struct {
+		history []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{"EUR"}, ""}, // Одного инвойса мало
+		{[]string{"eur ", "EUR"}, "EUR"},
+		{[]string{"EUR", "USD"}, ""}, // Нет большинства
+		{[]string{"EUR", "USD", "EUR"}, "EUR"},
+		{[]string{"EUR", "", "EUR"}, "EUR"}, // Инвойсы без валюты не учитываются
+	}
+	for _, tt := range tests {
+		if got := counterpartyWithHistory(tt.history...).DefaultCurrency; got != tt.want {
+			t.Errorf("history %q: DefaultCurrency %q, want %q", tt.history, got, tt.want)
+		}
+	}
+}
+
+// TestCheckCurrencyFirstSeen проверяет, что инвойс нового контрагента (или контрагента с одним инвойсом)
+// не получает предупреждения в любой валюте.
+func TestCheckCurrencyFirstSeen(t *testing.T) {
+	for _, cp := range []Counterparty{{Name: "ACME GmbH"}, counterpartyWithHistory("EUR")} {
+		for _, currency := range []string{"USD", "", "JPY"} {
+			inv := Invoice{Currency: currency, TotalAmount: 1234.5, AmountDecimals: 1}
+			if issue := CheckCurrency(&inv, cp, true); issue != nil {
+				t.Errorf("history %v, currency %q: unexpected warning %q", cp.Currencies, currency, issue.Message)
+			}
+			if inv.Currency != currency {
+				t.Errorf("history %v: currency %q changed to %q", cp.Currencies, currency, inv.Currency)
+			}
+		}
+	}
+}
+
+func TestCheckCurrencyDeviation(t *testing.T) {
+	cp := counterpartyWithHistory("EUR", "EUR", "EUR", "USD")
+	tests := []struct {
+		name         string
+		inv          Invoice
+		autoCorrect  bool
+		wantCurrency string
+		wantMessage  string // Подстрока предупреждения; пусто — предупреждения нет
+	}{
+		{"usual currency", Invoice{Currency: "eur"}, true, "eur", ""},
+		{"other currency", Invoice{Currency: "USD", AmountDecimals: 2}, true, "USD", "currency USD differs from the counterparty's usual currency EUR (3 of 4 invoices)"},
+		{"missing", Invoice{}, false, "", "currency is missing, the counterparty usually invoices in EUR"},
+		{"missing corrected", Invoice{}, true, "EUR", "missing currency set to EUR"},
+		{"decimals of the usual currency", Invoice{Currency: "JPY", AmountDecimals: 2}, true, "EUR", "currency JPY corrected to EUR: amounts have 2 decimal places"},
+		{"decimals without correction", Invoice{Currency: "JPY", AmountDecimals: 2}, false, "JPY", "currency JPY differs"},
+		{"decimals fit the extracted currency", Invoice{Currency: "JPY", AmountDecimals: 0}, true, "JPY", "currency JPY differs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := tt.inv
+			issue := CheckCurrency(&inv, cp, tt.autoCorrect)
+			switch {
+			case tt.wantMessage == "" && issue != nil:
+				t.Errorf("unexpected warning %q", issue.Message)
+			case tt.wantMessage != "" && issue == nil:
+				t.Errorf("no warning, want %q", tt.wantMessage)
+			case issue != nil && (!strings.Contains(issue.Message, tt.wantMessage) || issue.Field != "currency" || issue.Severity != SeverityWarning):
+				t.Errorf("warning %+v, want a currency warning with %q", issue, tt.wantMessage)
+			}
+			if inv.Currency != tt.wantCurrency {
+				t.Errorf("currency %q, want %q", inv.Currency, tt.wantCurrency)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// ExtractionLocal — значение Invoice.Extraction для инвойсов, извлеченных локальными эвристиками
+// без OpenAI (деградированный режим, см. WithDegradedMode).
+const ExtractionLocal = "local"
+
+// ExtractionSource возвращает способ извлечения инвойса для отчетов: "OpenAI", "OpenAI (text layer)",
+// "local (degraded)" или "embedded XML", с пометкой " + payment QR", если платежные данные взяты из QR-кода.
+func (inv Invoice) ExtractionSource() string {
+	source := "OpenAI"
+	switch inv.Extraction {
+	case ExtractionLocal:
+		source = "local (degraded)"
+	case ExtractionEmbeddedXML:
+		source = "embedded XML"
+	case ExtractionText:
+		source = "OpenAI (text layer)"
+	}
+	if inv.SourceMethod == SourceMethodQR {
+		source += " + payment QR"
+	}
+	return source
+}
+
+// TextExtractor возвращает текстовый слой PDF-файла по страницам.
+type TextExtractor func(ctx context.Context, pdfPath string) ([]string, error)
+
+// PopplerTextExtractor возвращает TextExtractor на основе утилиты pdftotext (см. пакет pdfimg).
+// popplerBinPath может быть пустым, тогда pdftotext ищется в PATH.
+func PopplerTextExtractor(popplerBinPath string) TextExtractor {
+	return PDFTextExtractor(pdfimg.Options{PopplerPath: popplerBinPath})
+}
+
+// PDFTextExtractor возвращает TextExtractor на основе pdfimg с произвольными настройками (пароли, таймаут).
+func PDFTextExtractor(opts pdfimg.Options) TextExtractor {
+	return func(ctx context.Context, pdfPath string) ([]string, error) {
+		return pdfimg.Text(ctx, pdfPath, opts)
+	}
+}
+
+// IsUnavailableError сообщает, что OpenAI недоступен: ошибка сервера (HTTP 5xx) или сетевая ошибка.
+// Ошибки 429 сюда не относятся — их обрабатывает адаптивный параллелизм.
+func IsUnavailableError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode >= http.StatusInternalServerError
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) && reqErr.HTTPStatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// Degraded сообщает, что процессор работает в деградированном режиме: режим включен в настройках
+// или OpenAI оказался недоступен. Файлы обрабатываются локально, контрагенты сопоставляются без модели.
+func (p *Processor) Degraded() bool {
+	return p.degradedForced || p.degradedActive.Load()
+}
+
+// apiFailed учитывает ошибку обработки файла и сообщает, что пора переходить в деградированный режим.
+// Счетчик считает только идущие подряд ошибки недоступности OpenAI; успешный файл сбрасывает его.
+func (p *Processor) apiFailed(ctx context.Context, err error) bool {
+	if err == nil {
+		p.apiFailures.Store(0)
+		return false
+	}
+	if p.degradedAfter <= 0 || ctx.Err() != nil || !IsUnavailableError(err) {
+		return false
+	}
+	if p.apiFailures.Add(1) < int32(p.degradedAfter) {
+		return false
+	}
+	if p.degradedActive.CompareAndSwap(false, true) {
+		p.log(ctx).Warn("OpenAI is unavailable, switching to degraded local extraction", LogKeyStage, PhaseLocal, "failures", p.degradedAfter, "error", err)
+	}
+	return true
+}
+
+// processLocally извлекает инвойс из текстового слоя PDF эвристиками, без обращения к OpenAI.
+// Результат частичный: каждый PDF считается одним инвойсом, контрагент заполняется по мере возможности,
+// а Invoice.Extraction = ExtractionLocal. Сканы без текстового слоя и изображения не поддерживаются.
+func (p *Processor) processLocally(ctx context.Context, src *source) ([]Invoice, error) {
+	if src.ext != ".pdf" {
+		return nil, fmt.Errorf("local extraction supports only PDF files with a text layer, got %s", src.ext)
+	}
+	p.log(ctx).Info("Extracting locally from the PDF text layer (degraded mode)", LogKeyStage, PhaseLocal)
+	filePath, err := src.pdfPath()
+	if err != nil {
+		return nil, err
+	}
+	pages, err := p.textExtractor(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract PDF text: %w", err)
+	}
+	inv, err := extractFromText(pages, p.myCompany)
+	if err != nil {
+		return nil, err
+	}
+	p.roundAmounts(inv)
+	return []Invoice{*inv}, nil
+}
+
+var (
+	// datePattern — числовые даты и даты с названием месяца.
+	datePattern = regexp.MustCompile(`\b\d{1,4}[./-]\d{1,2}[./-]\d{2,4}\b|\b\d{1,2}\.?\s+\p{L}{3,}\.?\s+\d{4}\b|\b\p{L}{3,}\.?\s+\d{1,2},?\s+\d{4}\b`)
+	// amountPattern — суммы с десятичной частью ("1 234,56", "1,234.56", "-12.00").
+	amountPattern = regexp.MustCompile(`-?\d{1,3}(?:[ '.,]\d{3})*[.,]\d{2}\b|-?\d+[.,]\d{2}\b`)
+	// numberPattern — номер документа после слов "Invoice No", "Rechnung Nr", "Счет №" и т. п.
+	numberPattern = regexp.MustCompile(`(?i)(?:invoice|rechnung|facture|factura|fattura|сч[её]т|inv)\s*(?:no\.?|nr\.?|number|nummer|num[eé]ro|#|№)?\s*[:.]?\s*([A-Z0-9][A-Z0-9/_-]*\d[A-Z0-9/_-]*)`)
+	// ibanPattern — IBAN, в том числе разбитый пробелами на группы по 4 символа.
+	ibanPattern = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`)
+	// swiftPattern — SWIFT/BIC после ключевого слова.
+	swiftPattern = regexp.MustCompile(`(?i)(?:swift|bic)[^A-Z0-9]*([A-Z]{6}[A-Z0-9]{2}(?:[A-Z0-9]{3})?)\b`)
+	// vatPattern — VAT-номер после ключевого слова: EU-формат с кодом страны или ИНН.
+	vatPattern = regexp.MustCompile(`(?i)(?:vat|ust[.-]?id(?:nr)?|tva|iva|btw|mwst|инн)[^A-Z0-9]{0,20}([A-Z]{2} ?[0-9A-Z]{8,12}|\d{10}|\d{12})\b`)
+)
+
+// Ключевые слова строк с датой, итоговой суммой и налогом (в нижнем регистре).
+var (
+	dateKeywords  = []string{"date", "datum", "дата", "fecha", "data"}
+	totalKeywords = []string{"total", "amount due", "balance due", "gesamt", "summe", "endbetrag", "итого", "к оплате", "всего"}
+	taxKeywords   = []string{"vat", "tax", "mwst", "ust", "tva", "iva", "ндс"}
+)
+
+// currencySymbols — символы валют и соответствующие коды.
+var currencySymbols = []struct{ symbol, code string }{
+	{"€", "EUR"}, {"£", "GBP"}, {"₽", "RUB"}, {"руб", "RUB"}, {"$", "USD"}, {"CHF", "CHF"}, {"Fr.", "CHF"},
+}
+
+// extractFromText собирает инвойс из текста страниц. Возвращает ошибку, если не найдены ни дата, ни сумма.
+func extractFromText(pages []string, myCompany Counterparty) (*Invoice, error) {
+	text := strings.Join(pages, "\n")
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("PDF has no text layer (scanned document), local extraction is not possible")
+	}
+	lines := strings.Split(text, "\n")
+	inv := &Invoice{Type: TypePaymentOrder, Extraction: ExtractionLocal}
+	for i := range pages {
+		inv.Pages = append(inv.Pages, i+1)
+	}
+
+	if raw := findDate(lines); raw != "" {
+		inv.Date, inv.DateAmbiguous, _ = NormalizeDate(raw, true)
+		if inv.Date != raw {
+			inv.RawDate = raw
+		}
+	}
+	inv.TotalAmount, inv.TaxAmount = findTotals(lines)
+	if inv.Date == "" && inv.TotalAmount == 0 {
+		return nil, errors.New("local extraction found neither an invoice date nor a total amount")
+	}
+	if m := numberPattern.FindStringSubmatch(text); m != nil {
+		inv.Number = m[1]
+	}
+	inv.Currency = findCurrency(text)
+	inv.Counterparty = findCounterparty(lines, text, myCompany)
+	return inv, nil
+}
+
+// containsAny сообщает, что line (в нижнем регистре) содержит одно из слов. Длинные слова ищутся
+// и внутри составных ("Rechnungsdatum", "Gesamtbetrag"), короткие — только целиком ("ust" не в "august").
+func containsAny(line string, words []string) bool {
+	for _, word := range words {
+		for offset := 0; ; {
+			i := strings.Index(line[offset:], word)
+			if i < 0 {
+				break
+			}
+			i += offset
+			before, _ := utf8.DecodeLastRuneInString(line[:i])
+			after, _ := utf8.DecodeRuneInString(line[i+len(word):])
+			if utf8.RuneCountInString(word) > 3 || !unicode.IsLetter(before) && !unicode.IsLetter(after) {
+				return true
+			}
+			offset = i + len(word)
+		}
+	}
+	return false
+}
+
+// findDate ищет дату в строке с ключевым словом ("Invoice date"), а если такой нет — первую дату в тексте.
+// Возвращает дату в исходной записи.
+func findDate(lines []string) string {
+	var first string
+	for _, line := range lines {
+		for _, candidate := range datePattern.FindAllString(line, -1) {
+			if _, _, err := NormalizeDate(candidate, true); err != nil {
+				continue
+			}
+			if containsAny(strings.ToLower(line), dateKeywords) {
+				return candidate
+			}
+			if first == "" {
+				first = candidate
+			}
+		}
+	}
+	return first
+}
+
+// keywordAmounts возвращает последнюю сумму каждой строки с одним из keywords в порядке строк.
+func keywordAmounts(lines []string, keywords []string) []float64 {
+	var amounts []float64
+	for _, line := range lines {
+		if !containsAny(strings.ToLower(line), keywords) {
+			continue
+		}
+		found := amountPattern.FindAllString(line, -1)
+		if len(found) == 0 {
+			continue
+		}
+		if amount, err := ParseAmount(found[len(found)-1]); err == nil {
+			amounts = append(amounts, amount)
+		}
+	}
+	return amounts
+}
+
+// findTotals возвращает итоговую сумму и сумму налога. Итог — наибольшая из сумм в строках
+// "Total"/"Итого" (промежуточный итог и итог налога меньше итога с налогом), налог — последняя
+// меньшая итога сумма в строках с "VAT"/"НДС".
+func findTotals(lines []string) (total, tax float64) {
+	for _, amount := range keywordAmounts(lines, totalKeywords) {
+		total = max(total, amount)
+	}
+	for _, amount := range keywordAmounts(lines, taxKeywords) {
+		if amount < total {
+			tax = amount
+		}
+	}
+	return total, tax
+}
+
+// findCurrency возвращает самый частый трехбуквенный код валюты или валюту по символу.
+func findCurrency(text string) string {
+	counts := map[string]int{}
+	best := ""
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return r < 'A' || r > 'Z' }) {
+		if !knownCurrency(word) {
+			continue
+		}
+		counts[word]++
+		if counts[word] > counts[best] {
+			best = word
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for _, s := range currencySymbols {
+		if strings.Contains(text, s.symbol) {
+			return s.code
+		}
+	}
+	return ""
+}
+
+// knownCurrency ограничивает поиск кодов валют распространенными валютами, чтобы не принимать
+// за код любое слово из трех заглавных букв.
+func knownCurrency(code string) bool {
+	switch code {
+	case "EUR", "USD", "GBP", "CHF", "RUB", "PLN", "CZK", "SEK", "NOK", "DKK", "HUF", "RON", "BGN", "TRY", "JPY", "CNY", "AED", "KZT", "UAH", "CAD", "AUD":
+		return true
+	}
+	return false
+}
+
+// findCounterparty заполняет известные эвристикам реквизиты контрагента: наименование (первая строка
+// документа, не относящаяся к моей компании), VAT и банковские счета. Реквизиты моей компании пропускаются.
+func findCounterparty(lines []string, text string, myCompany Counterparty) Counterparty {
+	var cp Counterparty
+	myName := strings.ToLower(strings.TrimSpace(myCompany.Name))
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" || !strings.ContainsFunc(line, func(r rune) bool { return r >= 'A' && r <= 'Z' || r >= 'А' && r <= 'Я' }) {
+			continue
+		}
+		if myName != "" && strings.Contains(strings.ToLower(line), myName) {
+			continue
+		}
+		cp.Name = line
+		break
+	}
+	for _, m := range vatPattern.FindAllStringSubmatch(text, -1) {
+		vat := strings.ReplaceAll(strings.ToUpper(m[1]), " ", "")
+		if !strings.EqualFold(vat, strings.ReplaceAll(myCompany.VAT, " ", "")) {
+			cp.VAT = vat
+			break
+		}
+	}
+	var swift string
+	if m := swiftPattern.FindStringSubmatch(text); m != nil {
+		swift = strings.ToUpper(m[1])
+	}
+	for _, candidate := range ibanPattern.FindAllString(text, -1) {
+		iban := normalizeAccount(candidate)
+		if ValidateIBAN(iban) != nil || normalizeAccount(myCompany.IBAN) == iban {
+			continue
+		}
+		account := BankAccount{IBAN: iban}
+		if len(cp.BankAccounts) == 0 {
+			account.SWIFT = swift
+		}
+		cp.AddBankAccount(account)
+	}
+	if len(cp.BankAccounts) == 0 && swift != "" {
+		cp.AddBankAccount(BankAccount{SWIFT: swift})
+	}
+	return cp
+}
@@ -0,0 +1,67 @@
+package invoice
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MarkDuplicates отмечает повторы инвойсов в results: поставщики часто присылают один инвойс дважды
+// (по почте и через портал). Повтор — инвойс того же типа с тем же контрагентом (ID, VAT или наименование),
+// номером, датой, суммой и валютой, что и один из предыдущих; у него заполняется Result.DuplicateOf.
+// Номера сравниваются без префиксов и форматирования: "INV-001" и "001" совпадают. Возвращает число повторов.
+func MarkDuplicates(results []Result) int {
+	first := make(map[string]int) // Ключ инвойса -> индекс первого вхождения в results
+	duplicates := 0
+	for i := range results {
+		res := &results[i]
+		res.DuplicateOf = ""
+		if res.ErrorMessage != "" || res.Invoice == nil {
+			continue
+		}
+		key := duplicateKey(*res.Invoice)
+		if j, ok := first[key]; ok {
+			res.DuplicateOf = results[j].SourceFile
+			duplicates++
+			continue
+		}
+		first[key] = i
+	}
+	return duplicates
+}
+
+// duplicateKey идентифицирует инвойс для поиска повторов.
+func duplicateKey(inv Invoice) string {
+	counterparty := counterpartyKey(inv.Counterparty)
+	if inv.Counterparty.ID != 0 {
+		counterparty = fmt.Sprintf("#%d", inv.Counterparty.ID)
+	}
+	currency := strings.ToUpper(strings.TrimSpace(inv.Currency))
+	return strings.Join([]string{
+		fmt.Sprint(inv.Type), counterparty, invoiceNumberKey(inv.Number), strings.TrimSpace(inv.Date),
+		currency, fmt.Sprint(ToMinor(inv.TotalAmount, currency, RoundHalfUp)),
+	}, "\x00")
+}
+
+// invoiceNumberKey нормализует номер инвойса: оставляет цифры без ведущих нулей ("INV-001" -> "1"),
+// а номер без цифр приводит к буквам в верхнем регистре.
+func invoiceNumberKey(number string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+	if digits == "" {
+		return simplifyIdentifier(number)
+	}
+	if trimmed := strings.TrimLeft(digits, "0"); trimmed != "" {
+		return trimmed
+	}
+	return "0"
+}
+
+// IsDuplicate сообщает, что результат — повтор другого инвойса пакета (см. MarkDuplicates).
+// Повторы показываются в отчетах, но не входят в итоги.
+func (r Result) IsDuplicate() bool {
+	return r.DuplicateOf != ""
+}
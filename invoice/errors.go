@@ -0,0 +1,87 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// Ошибки обработки файла. ProcessFile оборачивает их через %w, поэтому причину можно проверить
+// через errors.Is, а ErrorCode сводит ее к коду для отчетов и API.
+var (
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrPDFConversion   = errors.New("failed to convert PDF to images")
+	ErrOpenAIRequest   = errors.New("OpenAI request failed")
+	ErrResponseParse   = errors.New("failed to parse the model response")
+	ErrNoInvoiceFound  = errors.New("no invoices found in file")
+	ErrTimeout         = errors.New("timed out") // Запрос к модели или обработка файла не уложились в WithRequestTimeout/WithFileTimeout
+	ErrEncryptedPDF    = pdfimg.ErrEncrypted     // PDF защищен паролем, и ни один из паролей (pdf_passwords, пароль загрузки) не подошел
+)
+
+// Коды ошибок обработки файла (Result.ErrorCode).
+const (
+	ErrorCodeUnsupportedType = "unsupported_type"
+	ErrorCodePDFConversion   = "pdf_conversion"
+	ErrorCodeEncryptedPDF    = "encrypted_pdf"
+	ErrorCodeOpenAIRequest   = "openai_request"
+	ErrorCodeResponseParse   = "response_parse"
+	ErrorCodeNoInvoiceFound  = "no_invoice_found"
+	ErrorCodeTimeout         = "timeout"   // Модель не ответила за request_timeout или файл не обработан за file_timeout
+	ErrorCodeCancelled       = "cancelled" // Обработка прервана отменой задания или таймаутом
+	ErrorCodeOther           = "other"     // Прочие ошибки: чтение файла, поврежденное изображение и т.п.
+)
+
+// ErrorCodes — все коды ошибок в порядке вывода в отчетах.
+var ErrorCodes = []string{
+	ErrorCodeUnsupportedType, ErrorCodePDFConversion, ErrorCodeEncryptedPDF, ErrorCodeOpenAIRequest, ErrorCodeResponseParse,
+	ErrorCodeNoInvoiceFound, ErrorCodeTimeout, ErrorCodeCancelled, ErrorCodeOther,
+}
+
+// ErrorCode возвращает код ошибки обработки файла; для nil — пустую строку.
+func ErrorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTimeout):
+		return ErrorCodeTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrorCodeCancelled
+	case errors.Is(err, ErrUnsupportedType):
+		return ErrorCodeUnsupportedType
+	case errors.Is(err, ErrEncryptedPDF):
+		return ErrorCodeEncryptedPDF
+	case errors.Is(err, ErrPDFConversion):
+		return ErrorCodePDFConversion
+	case errors.Is(err, ErrResponseParse):
+		return ErrorCodeResponseParse
+	case errors.Is(err, ErrOpenAIRequest), errors.Is(err, ErrNetworkDisabled):
+		return ErrorCodeOpenAIRequest
+	case errors.Is(err, ErrNoInvoiceFound):
+		return ErrorCodeNoInvoiceFound
+	}
+	return ErrorCodeOther
+}
+
+// ErrorAction возвращает рекомендацию по устранению ошибки с кодом code для отчетов.
+func ErrorAction(code string) string {
+	switch code {
+	case ErrorCodeUnsupportedType:
+		return "Convert the file to PDF, PNG or JPEG and process it again."
+	case ErrorCodePDFConversion:
+		return "Check that Poppler is installed and the PDF opens; re-export or re-scan it."
+	case ErrorCodeEncryptedPDF:
+		return "Add the PDF password to pdf_passwords in config.json or enter it when uploading, or remove the protection, then process the file again."
+	case ErrorCodeOpenAIRequest:
+		return "Check the API key, network and OpenAI limits, then process the file again."
+	case ErrorCodeResponseParse:
+		return "Process the file again; if it keeps failing, try another model or raise json_repair_attempts."
+	case ErrorCodeNoInvoiceFound:
+		return "Check that the file is an invoice and is legible; re-scan it at a higher resolution."
+	case ErrorCodeTimeout:
+		return "The model or the file took too long; process the file again, or raise request_timeout or file_timeout if large files keep timing out."
+	case ErrorCodeCancelled:
+		return "Process the file again."
+	}
+	return "Check the file and the error message, then process the file again."
+}
@@ -0,0 +1,40 @@
+package invoice
+
+// Приблизительные размеры запросов для оценки стоимости без обращения к OpenAI.
+// Изображение страницы в детальном режиме занимает порядка тысячи токенов, поэтому
+// оценка определяется в основном числом страниц.
+const (
+	estimatedPromptTokensPerPage        = 1100 // Изображение страницы
+	estimatedPromptTokensPerRequest     = 900  // Текст промпта
+	estimatedCompletionTokensPerRequest = 400  // Ответ модели
+)
+
+// EstimateUsage оценивает использование OpenAI при обработке файла из pages страниц без вызова API.
+// Считается, что файл содержит один инвойс: группировка отправляет все страницы, детальный анализ —
+// страницы, выбранные по настройке выбора страниц. Кэш результатов не учитывается.
+func (p *Processor) EstimateUsage(pages int) Usage {
+	if pages <= 0 {
+		return Usage{Model: p.model}
+	}
+	indices := make([]int, pages)
+	for i := range indices {
+		indices[i] = i
+	}
+	selected, err := p.pageSelection.selectPages(indices, p.maxAllPages)
+	if err != nil {
+		// Такой файл завершится ошибкой до детального анализа
+		selected = nil
+	}
+	usage := Usage{Model: p.model}
+	for _, images := range []int{pages, len(selected)} {
+		if images == 0 {
+			continue
+		}
+		usage.Add(Usage{
+			PromptTokens:     estimatedPromptTokensPerRequest + images*estimatedPromptTokensPerPage,
+			CompletionTokens: estimatedCompletionTokensPerRequest,
+			Requests:         1,
+		})
+	}
+	return usage
+}
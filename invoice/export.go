@@ -0,0 +1,143 @@
+package invoice
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ExportSchemaVersion — версия схемы ExportRecord. Поля записи не переименовываются и не удаляются;
+// новые поля добавляются без смены версии, несовместимые изменения ее увеличивают.
+const ExportSchemaVersion = 1
+
+// Статусы инвойса в ExportRecord.Status.
+const (
+	ExportStatusOK        = "ok"
+	ExportStatusDuplicate = "duplicate"
+)
+
+// ExportRecord — один инвойс в выгрузке JSON Lines для загрузки в хранилища данных. Схема не зависит от
+// внутренней структуры Invoice: суммы — числа в валюте инвойса, даты — строки YYYY-MM-DD, пустые
+// значения не опускаются.
+type ExportRecord struct {
+	SchemaVersion     int                `json:"schema_version"`
+	SourceFile        string             `json:"source_file"`
+	InvoiceIndex      int                `json:"invoice_index"` // Порядковый номер инвойса в файле (с 1)
+	InvoiceCount      int                `json:"invoice_count"` // Количество инвойсов в файле
+	Status            string             `json:"status"`        // ExportStatusOK или ExportStatusDuplicate
+	DuplicateOf       string             `json:"duplicate_of"`  // Файл первого вхождения повтора
+	Type              int                `json:"type"`          // Invoice.Type: от TypePaymentOrder до TypeAdvanceReceipt
+	TypeName          string             `json:"type_name"`     // Invoice.TypeName
+	Number            string             `json:"number"`
+	Reference         string             `json:"reference"` // Номер исходного инвойса кредит-ноты
+	OrderReference    string             `json:"order_reference"`
+	ContractReference string             `json:"contract_reference"`
+	PaymentReference  string             `json:"payment_reference"` // Ссылка платежа из платежного QR-кода
+	Date              string             `json:"date"`
+	Direction         string             `json:"direction"`
+	Currency          string             `json:"currency"`
+	TotalAmount       float64            `json:"total_amount"`
+	TaxAmount         float64            `json:"tax_amount"`
+	TaxBreakdown      []TaxLine          `json:"tax_breakdown"`
+	Purpose           string             `json:"purpose"`
+	Category          string             `json:"category"` // Категория расходов (пусто без настроенных категорий)
+	Pages             []int              `json:"pages"`
+	Extraction        string             `json:"extraction"` // Invoice.ExtractionSource
+	Counterparty      ExportCounterparty `json:"counterparty"`
+	Warnings          []ValidationIssue  `json:"warnings"`
+}
+
+// ExportCounterparty — контрагент инвойса в ExportRecord. ID — идентификатор из базы контрагентов
+// после сопоставления (0, если база не ведет ID).
+type ExportCounterparty struct {
+	ID                 uint64        `json:"id"`
+	Name               string        `json:"name"`
+	VAT                string        `json:"vat"`
+	TaxCode2           string        `json:"tax_code2"`
+	RegistrationNumber string        `json:"registration_number"`
+	Country            string        `json:"country"`
+	CountryCode        string        `json:"country_code"`
+	Address            string        `json:"address"`
+	BankAccounts       []BankAccount `json:"bank_accounts"`
+}
+
+// NewExportRecord преобразует результат в запись выгрузки. Для результата без инвойса (ошибка обработки
+// файла) возвращает false.
+func NewExportRecord(res Result) (ExportRecord, bool) {
+	if res.Invoice == nil {
+		return ExportRecord{}, false
+	}
+	inv := res.Invoice
+	cp := inv.Counterparty
+	record := ExportRecord{
+		SchemaVersion:     ExportSchemaVersion,
+		SourceFile:        res.SourceFile,
+		InvoiceIndex:      res.InvoiceIndex,
+		InvoiceCount:      res.InvoiceCount,
+		Status:            ExportStatusOK,
+		DuplicateOf:       res.DuplicateOf,
+		Type:              inv.Type,
+		TypeName:          inv.TypeName(),
+		Number:            inv.Number,
+		Reference:         inv.Reference,
+		OrderReference:    inv.OrderReference,
+		ContractReference: inv.ContractReference,
+		PaymentReference:  inv.PaymentReference,
+		Date:              inv.Date,
+		Direction:         inv.Direction,
+		Currency:          inv.Currency,
+		TotalAmount:       inv.TotalAmount,
+		TaxAmount:         inv.TaxAmount,
+		TaxBreakdown:      inv.TaxBreakdown,
+		Purpose:           inv.Purpose,
+		Category:          inv.Category,
+		Pages:             inv.Pages,
+		Extraction:        inv.ExtractionSource(),
+		Counterparty: ExportCounterparty{
+			ID:                 cp.ID,
+			Name:               cp.Name,
+			VAT:                cp.VAT,
+			TaxCode2:           cp.TaxCode2,
+			RegistrationNumber: cp.RegistrationNumber,
+			Country:            cp.Country,
+			CountryCode:        cp.CountryCode,
+			Address:            cp.Address,
+			BankAccounts:       cp.Accounts(),
+		},
+		Warnings: res.Warnings,
+	}
+	if res.IsDuplicate() {
+		record.Status = ExportStatusDuplicate
+	}
+	// Пустые списки выгружаются как [], а не null
+	if record.TaxBreakdown == nil {
+		record.TaxBreakdown = []TaxLine{}
+	}
+	if record.Pages == nil {
+		record.Pages = []int{}
+	}
+	if record.Counterparty.BankAccounts == nil {
+		record.Counterparty.BankAccounts = []BankAccount{}
+	}
+	if record.Warnings == nil {
+		record.Warnings = []ValidationIssue{}
+	}
+	return record, true
+}
+
+// WriteJSONL записывает инвойсы результатов в формате JSON Lines: по одному ExportRecord на строку.
+// Результаты без инвойса (ошибки обработки файлов) пропускаются. Записи пишутся в w по мере
+// кодирования, без накопления всей выгрузки в памяти.
+func WriteJSONL(w io.Writer, results []Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	for _, res := range results {
+		record, ok := NewExportRecord(res)
+		if !ok {
+			continue
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package invoice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// exportSchemaV1 — ключи записи ExportRecord версии 1. Переименование или удаление ключа ломает загрузку
+// в хранилища данных и требует увеличить ExportSchemaVersion.
+var exportSchemaV1 = map[string][]string{
+	"": {"schema_version", "source_file", "invoice_index", "invoice_count", "status", "duplicate_of", "type", "type_name",
+		"number", "reference", "order_reference", "contract_reference", "payment_reference", "date", "direction", "currency",
+		"total_amount", "tax_amount", "tax_breakdown", "purpose", "category", "pages", "extraction", "counterparty", "warnings"},
+	"counterparty": {"id", "name", "vat", "tax_code2", "registration_number", "country", "country_code", "address", "bank_accounts"},
+}
+
+// exportBatch возвращает инвойс с заполненными полями, его повтор, инвойс без списков и файл с ошибкой.
+func exportBatch() []Result {
+	full := Invoice{
+		Type: TypeCreditNote, Number: "CN-7", Reference: "INV-7", OrderReference: "PO-1", ContractReference: "C-2",
+		PaymentReference: "RF18539007547034", Date: "2024-03-01", Direction: DirectionIncoming, Currency: "EUR",
+		TotalAmount: -119, TaxAmount: -19, TaxBreakdown: []TaxLine{{Rate: 19, Base: -100, Amount: -19}},
+		Purpose: "Refund <consulting> & travel", Category: "Services", Pages: []int{1, 2},
+		Counterparty: Counterparty{
+			ID: 42, Name: "Müller & Söhne GmbH", VAT: "DE123456789", TaxCode2: "12/345/67890", RegistrationNumber: "HRB 1234",
+			Country: "Germany", CountryCode: "DE", Address: "Hauptstraße 1, Berlin",
+			BankAccounts: []BankAccount{{Currency: "EUR", IBAN: "DE89370400440532013000", SWIFT: "COBADEFFXXX"}},
+		},
+	}
+	bare := Invoice{Type: TypePaymentOrder, Number: "INV-1", Currency: "USD", TotalAmount: 10}
+	var results []Result
+	results = append(results, FileResults("credit.pdf", []Invoice{full}, Usage{}, nil)...)
+	results = append(results, FileResults("copy.pdf", []Invoice{full}, Usage{}, nil)...)
+	results = append(results, FileResults("bare.pdf", []Invoice{bare}, Usage{}, nil)...)
+	results = append(results, FileResults("broken.pdf", nil, Usage{}, errors.New("could not render pages"))...)
+	MarkDuplicates(results)
+	return results
+}
+
+// TestWriteJSONLRoundTrip записывает выгрузку, читает ее обратно в ExportRecord без неизвестных полей
+// и сравнивает с исходными записями.
+func TestWriteJSONLRoundTrip(t *testing.T) {
+	results := exportBatch()
+	var buf bytes.Buffer
+	if err := WriteJSONL(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []ExportRecord
+	for _, res := range results {
+		if record, ok := NewExportRecord(res); ok {
+			want = append(want, record)
+		}
+	}
+	var got []ExportRecord
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		var record ExportRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("line %d: %v", len(got)+1, err)
+		}
+		got = append(got, record)
+	}
+	if len(got) != 3 {
+		t.Fatalf("%d lines, want 3 (the error row is not exported)", len(got))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records after the round trip differ:\n got %+v\nwant %+v", got, want)
+	}
+	if got[1].Status != ExportStatusDuplicate || got[1].DuplicateOf != "credit.pdf" || got[0].Status != ExportStatusOK {
+		t.Errorf("statuses %q and %q (duplicate of %q), want ok and a duplicate of credit.pdf", got[0].Status, got[1].Status, got[1].DuplicateOf)
+	}
+	if got[0].SchemaVersion != ExportSchemaVersion || got[0].Counterparty.ID != 42 || got[0].TypeName == "" {
+		t.Errorf("first record %+v", got[0])
+	}
+}
+
+// TestWriteJSONLSchema проверяет ключи каждой записи: все ключи схемы присутствуют (пустые списки — [],
+// а не null), лишних нет, а HTML-символы не экранируются.
+func TestWriteJSONLSchema(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSONL(&buf, exportBatch()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), `\u003c`) || !strings.Contains(buf.String(), "Refund <consulting> & travel") {
+		t.Error("HTML characters are escaped in the export")
+	}
+	for i, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		var counterparty map[string]json.RawMessage
+		if err := json.Unmarshal(record["counterparty"], &counterparty); err != nil {
+			t.Fatal(err)
+		}
+		for object, fields := range map[string]map[string]json.RawMessage{"": record, "counterparty": counterparty} {
+			keys := make([]string, 0, len(fields))
+			for key := range fields {
+				keys = append(keys, key)
+			}
+			want := slices.Clone(exportSchemaV1[object])
+			slices.Sort(keys)
+			slices.Sort(want)
+			if !slices.Equal(keys, want) {
+				t.Errorf("line %d %s keys %v, want %v", i+1, object, keys, want)
+			}
+			for key, value := range fields {
+				if string(value) == "null" {
+					t.Errorf("line %d: %s %s is null", i+1, object, key)
+				}
+			}
+		}
+	}
+}
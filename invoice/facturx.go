@@ -0,0 +1,336 @@
+package invoice
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// ExtractionEmbeddedXML — значение Invoice.Extraction для инвойсов, прочитанных из XML электронного
+// инвойса ZUGFeRD/Factur-X, вложенного в PDF. Такие данные точны и не требуют запросов к OpenAI.
+const ExtractionEmbeddedXML = "embedded_xml"
+
+// AttachmentExtractor возвращает файлы, вложенные в PDF.
+type AttachmentExtractor func(ctx context.Context, pdfPath string) ([]pdfimg.Attachment, error)
+
+// PopplerAttachmentExtractor возвращает AttachmentExtractor на основе утилиты pdfdetach (см. пакет pdfimg).
+// popplerBinPath может быть пустым, тогда pdfdetach ищется в PATH.
+func PopplerAttachmentExtractor(popplerBinPath string) AttachmentExtractor {
+	return PDFAttachmentExtractor(pdfimg.Options{PopplerPath: popplerBinPath})
+}
+
+// PDFAttachmentExtractor возвращает AttachmentExtractor на основе pdfimg с произвольными настройками (пароли, таймаут).
+func PDFAttachmentExtractor(opts pdfimg.Options) AttachmentExtractor {
+	return func(ctx context.Context, pdfPath string) ([]pdfimg.Attachment, error) {
+		return pdfimg.Attachments(ctx, pdfPath, opts)
+	}
+}
+
+// processEmbeddedXML ищет во вложениях PDF XML электронного инвойса (CrossIndustryInvoice ZUGFeRD 2.x/Factur-X)
+// и разбирает его. ok = false, если такого вложения нет или его не удалось разобрать: тогда файл
+// обрабатывается по изображениям страниц.
+func (p *Processor) processEmbeddedXML(ctx context.Context, src *source) (invoices []Invoice, ok bool) {
+	if p.attachmentExtractor == nil || src.ext != ".pdf" {
+		return nil, false
+	}
+	started := time.Now()
+	filePath, err := src.pdfPath()
+	if err != nil {
+		p.log(ctx).Warn("Could not read PDF attachments", LogKeyStage, PhaseEmbedded, "error", err)
+		return nil, false
+	}
+	attachments, err := p.attachmentExtractor(ctx, filePath)
+	if err != nil {
+		// Недоступный poppler и пароль сообщит конвертация страниц
+		if !errors.Is(err, pdfimg.ErrPopplerNotFound) && !errors.Is(err, ErrEncryptedPDF) && ctx.Err() == nil {
+			p.log(ctx).Warn("Could not read PDF attachments", LogKeyStage, PhaseEmbedded, "error", err)
+		}
+		return nil, false
+	}
+	for _, attachment := range attachments {
+		if !strings.EqualFold(filepath.Ext(attachment.Name), ".xml") {
+			continue
+		}
+		inv, err := ParseCrossIndustryInvoice(attachment.Data, p.myCompany)
+		if err != nil {
+			p.log(ctx).Warn("Embedded XML is not a usable ZUGFeRD/Factur-X invoice, falling back to the page images", LogKeyStage, PhaseEmbedded, "attachment", attachment.Name, "error", err)
+			continue
+		}
+		TraceFrom(ctx).Record(PhaseEmbedded, started, nil)
+		p.log(ctx).Info("Read the invoice from the embedded XML, no OpenAI requests needed", LogKeyStage, PhaseEmbedded, "attachment", attachment.Name)
+		p.roundAmounts(inv)
+		return []Invoice{*inv}, true
+	}
+	return nil, false
+}
+
+// Коды типов документа UNTDID 1001, означающие кредит-ноту.
+var ciiCreditNoteTypes = map[string]bool{"381": true, "396": true, "532": true}
+
+// ciiDocumentTypes сопоставляет другие коды UNTDID 1001 типам документа; остальные коды — TypePaymentOrder.
+var ciiDocumentTypes = map[string]int{"325": TypeProforma, "386": TypeAdvanceReceipt}
+
+// ciiParty — сторона сделки (SellerTradeParty, BuyerTradeParty).
+type ciiParty struct {
+	Name              string `xml:"Name"`
+	LegalOrganization struct {
+		ID string `xml:"ID"`
+	} `xml:"SpecifiedLegalOrganization"`
+	Address struct {
+		Postcode  string `xml:"PostcodeCode"`
+		LineOne   string `xml:"LineOne"`
+		LineTwo   string `xml:"LineTwo"`
+		LineThree string `xml:"LineThree"`
+		City      string `xml:"CityName"`
+		CountryID string `xml:"CountryID"`
+	} `xml:"PostalTradeAddress"`
+	TaxRegistrations []struct {
+		ID struct {
+			SchemeID string `xml:"schemeID,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"ID"`
+	} `xml:"SpecifiedTaxRegistration"`
+	Contact struct {
+		Phone string `xml:"TelephoneUniversalCommunication>CompleteNumber"`
+		Fax   string `xml:"FaxUniversalCommunication>CompleteNumber"`
+		Email string `xml:"EmailURIUniversalCommunication>URIID"`
+	} `xml:"DefinedTradeContact"`
+}
+
+// ciiAmount — сумма с необязательной валютой (currencyID).
+type ciiAmount struct {
+	Currency string `xml:"currencyID,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// crossIndustryInvoice — поля CrossIndustryInvoice (EN 16931), которые переносятся в Invoice.
+// Пространства имен не учитываются: имена элементов совпадают во всех профилях ZUGFeRD 2.x и Factur-X.
+type crossIndustryInvoice struct {
+	XMLName  xml.Name `xml:"CrossIndustryInvoice"`
+	Document struct {
+		ID       string `xml:"ID"`
+		TypeCode string `xml:"TypeCode"`
+		Issued   string `xml:"IssueDateTime>DateTimeString"`
+		Notes    []struct {
+			Content string `xml:"Content"`
+		} `xml:"IncludedNote"`
+	} `xml:"ExchangedDocument"`
+	Transaction struct {
+		Lines []struct {
+			Product string `xml:"SpecifiedTradeProduct>Name"`
+		} `xml:"IncludedSupplyChainTradeLineItem"`
+		Agreement struct {
+			Seller   ciiParty `xml:"SellerTradeParty"`
+			Buyer    ciiParty `xml:"BuyerTradeParty"`
+			Order    string   `xml:"BuyerOrderReferencedDocument>IssuerAssignedID"`
+			Contract string   `xml:"ContractReferencedDocument>IssuerAssignedID"`
+		} `xml:"ApplicableHeaderTradeAgreement"`
+		Settlement struct {
+			Currency     string `xml:"InvoiceCurrencyCode"`
+			PaymentMeans []struct {
+				IBAN          string `xml:"PayeePartyCreditorFinancialAccount>IBANID"`
+				AccountNumber string `xml:"PayeePartyCreditorFinancialAccount>ProprietaryID"`
+				BIC           string `xml:"PayeeSpecifiedCreditorFinancialInstitution>BICID"`
+				BankName      string `xml:"PayeeSpecifiedCreditorFinancialInstitution>Name"`
+			} `xml:"SpecifiedTradeSettlementPaymentMeans"`
+			Taxes []struct {
+				Amount string `xml:"CalculatedAmount"`
+				Base   string `xml:"BasisAmount"`
+				Rate   string `xml:"RateApplicablePercent"`
+			} `xml:"ApplicableTradeTax"`
+			Summation struct {
+				TaxTotals  []ciiAmount `xml:"TaxTotalAmount"`
+				GrandTotal []ciiAmount `xml:"GrandTotalAmount"`
+			} `xml:"SpecifiedTradeSettlementHeaderMonetarySummation"`
+			Reference string `xml:"InvoiceReferencedDocument>IssuerAssignedID"`
+		} `xml:"ApplicableHeaderTradeSettlement"`
+	} `xml:"SupplyChainTradeTransaction"`
+}
+
+// ParseCrossIndustryInvoice разбирает XML электронного инвойса ZUGFeRD 2.x/Factur-X (CrossIndustryInvoice).
+// Направление и контрагент определяются по myCompany: если своя компания — покупатель, инвойс входящий
+// и контрагент — продавец, если продавец — исходящий и контрагент — покупатель. Если своя компания
+// не найдена, контрагентом считается продавец, а направление остается неопределенным.
+func ParseCrossIndustryInvoice(data []byte, myCompany Counterparty) (*Invoice, error) {
+	var doc crossIndustryInvoice
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("not a CrossIndustryInvoice document: %w", err)
+	}
+	settlement := doc.Transaction.Settlement
+	currency := strings.ToUpper(strings.TrimSpace(settlement.Currency))
+	total, err := ciiTotal(settlement.Summation.GrandTotal, currency)
+	if err != nil {
+		return nil, fmt.Errorf("grand total: %w", err)
+	}
+	var taxAmount float64 // Без TaxTotalAmount налог берется из разбивки по ставкам
+	if len(settlement.Summation.TaxTotals) > 0 {
+		if taxAmount, err = ciiTotal(settlement.Summation.TaxTotals, currency); err != nil {
+			return nil, fmt.Errorf("tax total: %w", err)
+		}
+	}
+
+	inv := &Invoice{
+		Type:        TypePaymentOrder,
+		Number:      strings.TrimSpace(doc.Document.ID),
+		TotalAmount: total,
+		TaxAmount:   taxAmount,
+		Currency:    currency,
+		Extraction:  ExtractionEmbeddedXML,
+	}
+	inv.OrderReference, inv.ContractReference = doc.Transaction.Agreement.Order, doc.Transaction.Agreement.Contract
+	inv.normalizeReferences()
+	if inv.Number == "" {
+		return nil, errors.New("invoice number is missing")
+	}
+	typeCode := strings.TrimSpace(doc.Document.TypeCode)
+	if ciiCreditNoteTypes[typeCode] {
+		inv.Type = TypeCreditNote
+		inv.Reference = strings.TrimSpace(settlement.Reference)
+	} else if docType, ok := ciiDocumentTypes[typeCode]; ok {
+		inv.Type = docType
+	}
+	issued := strings.TrimSpace(doc.Document.Issued)
+	if date, err := time.Parse("20060102", issued); err == nil {
+		inv.Date = date.Format("2006-01-02")
+	} else {
+		inv.Date = issued // Validate отметит нераспознанную дату
+	}
+	for _, tax := range settlement.Taxes {
+		line := TaxLine{Rate: ciiNumber(tax.Rate), Base: ciiNumber(tax.Base), Amount: ciiNumber(tax.Amount)}
+		inv.TaxBreakdown = append(inv.TaxBreakdown, line)
+	}
+	inv.normalizeTaxBreakdown()
+	inv.Purpose = ciiPurpose(doc)
+
+	seller, buyer := doc.Transaction.Agreement.Seller.counterparty(), doc.Transaction.Agreement.Buyer.counterparty()
+	for _, means := range settlement.PaymentMeans {
+		account := BankAccount{
+			Currency:      currency,
+			IBAN:          strings.TrimSpace(means.IBAN),
+			SWIFT:         strings.TrimSpace(means.BIC),
+			AccountNumber: strings.TrimSpace(means.AccountNumber),
+			BankName:      strings.TrimSpace(means.BankName),
+		}
+		if account.IBAN != "" || account.AccountNumber != "" {
+			seller.BankAccounts = append(seller.BankAccounts, account)
+		}
+	}
+	seller.NormalizeBankAccounts()
+	switch {
+	case isCompany(buyer, myCompany):
+		inv.Direction, inv.Counterparty = DirectionIncoming, seller
+	case isCompany(seller, myCompany):
+		inv.Direction, inv.Counterparty = DirectionOutgoing, buyer
+	default:
+		inv.Counterparty = seller
+	}
+	if inv.Counterparty.Name == "" {
+		return nil, errors.New("counterparty name is missing")
+	}
+	return inv, nil
+}
+
+// counterparty переносит реквизиты стороны сделки в Counterparty. XML содержит только код страны ISO alpha-2:
+// он записывается и в Country, и в CountryCode.
+func (party ciiParty) counterparty() Counterparty {
+	cp := Counterparty{
+		Name:               strings.TrimSpace(party.Name),
+		RegistrationNumber: strings.TrimSpace(party.LegalOrganization.ID),
+		Country:            strings.ToUpper(strings.TrimSpace(party.Address.CountryID)),
+		CountryCode:        strings.ToUpper(strings.TrimSpace(party.Address.CountryID)),
+		Phone:              strings.TrimSpace(party.Contact.Phone),
+		Fax:                strings.TrimSpace(party.Contact.Fax),
+		Email:              strings.TrimSpace(party.Contact.Email),
+	}
+	for _, registration := range party.TaxRegistrations {
+		id := strings.TrimSpace(registration.ID.Value)
+		switch strings.ToUpper(registration.ID.SchemeID) {
+		case "VA": // VAT-номер
+			cp.VAT = id
+		case "FC": // Местный налоговый номер (Steuernummer)
+			cp.TaxCode2 = id
+		}
+	}
+	if cp.VAT == "" {
+		cp.VAT, cp.TaxCode2 = cp.TaxCode2, ""
+	}
+	address := party.Address
+	city := strings.TrimSpace(strings.Join(strings.Fields(address.Postcode+" "+address.City), " "))
+	var parts []string
+	for _, part := range []string{address.LineOne, address.LineTwo, address.LineThree, city} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	cp.Address = strings.Join(parts, ", ")
+	return cp
+}
+
+// isCompany сообщает, что сторона сделки — компания company: совпадает VAT, а если у одной из них
+// VAT не указан — наименование.
+func isCompany(party, company Counterparty) bool {
+	if party.VAT != "" && company.VAT != "" {
+		return sameVAT(party.VAT, company.VAT) || sameVAT(stripVATPrefix(party.VAT), stripVATPrefix(company.VAT))
+	}
+	return company.Name != "" && normalizeName(party.Name) == normalizeName(company.Name)
+}
+
+// stripVATPrefix убирает из VAT-номера двухбуквенный префикс страны ("DE123456789" -> "123456789").
+func stripVATPrefix(vat string) string {
+	vat = simplifyIdentifier(vat)
+	if len(vat) > 2 && isUpperLetter(vat[0]) && isUpperLetter(vat[1]) {
+		return vat[2:]
+	}
+	return vat
+}
+
+// ciiTotal возвращает сумму в валюте инвойса: TaxTotalAmount может повторяться в валюте учета продавца.
+func ciiTotal(amounts []ciiAmount, currency string) (float64, error) {
+	if len(amounts) == 0 {
+		return 0, errors.New("amount is missing")
+	}
+	amount := amounts[0]
+	for _, candidate := range amounts {
+		if strings.EqualFold(strings.TrimSpace(candidate.Currency), currency) {
+			amount = candidate
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(amount.Value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", amount.Value)
+	}
+	return value, nil
+}
+
+// ciiNumber разбирает десятичное число CII; пустое или некорректное значение дает 0.
+func ciiNumber(value string) float64 {
+	number, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return number
+}
+
+// ciiPurpose составляет назначение платежа из наименований первых позиций, а без них — из первого примечания.
+func ciiPurpose(doc crossIndustryInvoice) string {
+	var products []string
+	for _, line := range doc.Transaction.Lines {
+		if name := strings.TrimSpace(line.Product); name != "" && len(products) < 3 {
+			products = append(products, name)
+		}
+	}
+	if len(products) > 0 {
+		return strings.Join(products, "; ")
+	}
+	for _, note := range doc.Document.Notes {
+		if content := strings.Join(strings.Fields(note.Content), " "); content != "" {
+			return content
+		}
+	}
+	return ""
+}
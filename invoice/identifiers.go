@@ -0,0 +1,172 @@
+package invoice
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// ibanLengths — длина IBAN по коду страны (реестр SWIFT). IBAN страны, которой нет в таблице,
+// проверяется только по общей длине и контрольной сумме.
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22, "BH": 22, "BR": 29,
+	"BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29,
+	"ES": 24, "FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28,
+	"HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22, "MK": 19,
+	"MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29,
+	"RO": 24, "RS": 22, "RU": 33, "SA": 24, "SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25,
+	"SV": 28, "TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+// ValidateIBAN проверяет IBAN: код страны, длину для страны и контрольную сумму (mod 97).
+// Пробелы допускаются и не учитываются.
+func ValidateIBAN(iban string) error {
+	iban = normalizeAccount(iban)
+	if len(iban) < 15 || len(iban) > 34 {
+		return fmt.Errorf("IBAN %q has %d characters, expected 15 to 34", iban, len(iban))
+	}
+	if !isUpperLetter(iban[0]) || !isUpperLetter(iban[1]) || !isDigit(iban[2]) || !isDigit(iban[3]) {
+		return fmt.Errorf("IBAN %q must start with a country code and two check digits", iban)
+	}
+	if length, ok := ibanLengths[iban[:2]]; ok && len(iban) != length {
+		return fmt.Errorf("IBAN %q has %d characters, %s IBANs have %d", iban, len(iban), iban[:2], length)
+	}
+	var digits strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			fmt.Fprintf(&digits, "%d", r-'A'+10)
+		default:
+			return fmt.Errorf("IBAN %q contains an invalid character %q", iban, r)
+		}
+	}
+	n, _ := new(big.Int).SetString(digits.String(), 10)
+	if new(big.Int).Mod(n, big.NewInt(97)).Int64() != 1 {
+		return fmt.Errorf("IBAN %q has an invalid checksum", iban)
+	}
+	return nil
+}
+
+// vatFormats — форматы VAT-номеров без префикса страны по префиксу (EL — Греция, XI — Северная Ирландия).
+var vatFormats = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^U\d{8}$`),
+	"BE": regexp.MustCompile(`^[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^\d{9,10}$`),
+	"CY": regexp.MustCompile(`^\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^\d{8,10}$`),
+	"DE": regexp.MustCompile(`^\d{9}$`),
+	"DK": regexp.MustCompile(`^\d{8}$`),
+	"EE": regexp.MustCompile(`^\d{9}$`),
+	"EL": regexp.MustCompile(`^\d{9}$`),
+	"ES": regexp.MustCompile(`^[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^\d{8}$`),
+	"FR": regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"GB": regexp.MustCompile(`^(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`),
+	"HR": regexp.MustCompile(`^\d{11}$`),
+	"HU": regexp.MustCompile(`^\d{8}$`),
+	"IE": regexp.MustCompile(`^(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^\d{11}$`),
+	"LT": regexp.MustCompile(`^(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^\d{8}$`),
+	"LV": regexp.MustCompile(`^\d{11}$`),
+	"MT": regexp.MustCompile(`^\d{8}$`),
+	"NL": regexp.MustCompile(`^\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^\d{10}$`),
+	"PT": regexp.MustCompile(`^\d{9}$`),
+	"RO": regexp.MustCompile(`^\d{2,10}$`),
+	"SE": regexp.MustCompile(`^\d{10}01$`),
+	"SI": regexp.MustCompile(`^\d{8}$`),
+	"SK": regexp.MustCompile(`^\d{10}$`),
+	"XI": regexp.MustCompile(`^(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`),
+}
+
+// ValidateVAT проверяет формат налогового номера: VAT-номеров стран ЕС и Великобритании (с префиксом
+// страны или без него), российского ИНН и сербского ПИБ с контрольными цифрами. Страна берется из префикса
+// номера, а без него — из countryCode (alpha-3 или alpha-2). Номера других стран не проверяются.
+func ValidateVAT(vat, countryCode string) error {
+	number := simplifyIdentifier(vat)
+	if number == "" {
+		return errors.New("VAT is empty")
+	}
+	country, _ := NormalizeCountry(countryCode)
+	if country == "GR" {
+		country = "EL" // Префикс VAT-номеров Греции отличается от кода страны
+	}
+	if len(number) > 2 && isUpperLetter(number[0]) && isUpperLetter(number[1]) {
+		if prefix := number[:2]; vatFormats[prefix] != nil || prefix == "RU" || prefix == "RS" {
+			country, number = prefix, number[2:]
+		}
+	}
+	switch country {
+	case "RU":
+		return validateINN(number)
+	case "RS":
+		return validatePIB(number)
+	}
+	format := vatFormats[country]
+	if format == nil {
+		return nil
+	}
+	if !format.MatchString(number) {
+		return fmt.Errorf("VAT %q does not match the %s format", vat, country)
+	}
+	return nil
+}
+
+// validateINN проверяет контрольные цифры ИНН организации (10 цифр) или физического лица (12 цифр).
+func validateINN(inn string) error {
+	if !allDigits(inn) || (len(inn) != 10 && len(inn) != 12) {
+		return fmt.Errorf("INN %q must have 10 or 12 digits", inn)
+	}
+	check := func(n int, weights []int) bool {
+		sum := 0
+		for i, w := range weights {
+			sum += int(inn[i]-'0') * w
+		}
+		return sum%11%10 == int(inn[n]-'0')
+	}
+	valid := check(9, []int{2, 4, 10, 3, 5, 9, 4, 6, 8})
+	if len(inn) == 12 {
+		valid = check(10, []int{7, 2, 4, 10, 3, 5, 9, 4, 6, 8}) && check(11, []int{3, 7, 2, 4, 10, 3, 5, 9, 4, 6, 8})
+	}
+	if !valid {
+		return fmt.Errorf("INN %q has invalid check digits", inn)
+	}
+	return nil
+}
+
+// validatePIB проверяет контрольную цифру сербского ПИБ (9 цифр, ISO 7064 MOD 11,10).
+func validatePIB(pib string) error {
+	if !allDigits(pib) || len(pib) != 9 {
+		return fmt.Errorf("PIB %q must have 9 digits", pib)
+	}
+	p := 10
+	for i := 0; i < 8; i++ {
+		s := (int(pib[i]-'0') + p) % 10
+		if s == 0 {
+			s = 10
+		}
+		p = 2 * s % 11
+	}
+	if (11-p)%10 != int(pib[8]-'0') {
+		return fmt.Errorf("PIB %q has an invalid check digit", pib)
+	}
+	return nil
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isDigit(c byte) bool       { return c >= '0' && c <= '9' }
+func isUpperLetter(c byte) bool { return c >= 'A' && c <= 'Z' }
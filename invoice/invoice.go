@@ -1,37 +1,598 @@
 package invoice
 
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
 // Invoice представляет данные, извлеченные из одного счета.
 type Invoice struct {
-	Type         int          `json:"type"`               // Тип документа: 1 для "Платежное поручение", 2 для "Кассовый чек"
-	Number       string       `json:"number"`             // Номер инвоиса
-	Date         string       `json:"date"`               // Дата инвоиса (YYYY-MM-DD)
-	TotalAmount  float64      `json:"total_amount"`       // Общая сумма
-	TaxAmount    float64      `json:"tax_amount"`         // Сумма налога
-	Currency     string       `json:"currency,omitempty"` // 3-х буквенный код валюты
-	Purpose      string       `json:"purpose"`            // Краткое назначение платежа
-	Counterparty Counterparty `json:"counterparty"`       // Данные контрагента
+	Type              int                `json:"type"`                        // Тип документа: TypePaymentOrder, TypeReceipt, TypeCreditNote, TypeProforma, TypeAdvanceReceipt или TypeNotInvoice
+	Number            string             `json:"number"`                      // Номер инвоиса
+	Reference         string             `json:"reference,omitempty"`         // Номер исходного инвойса, на который ссылается кредит-нота
+	OrderReference    string             `json:"order_reference"`             // Номер заказа покупателя (PO), пусто, если не указан
+	ContractReference string             `json:"contract_reference"`          // Номер договора, пусто, если не указан
+	Date              string             `json:"date"`                        // Дата инвоиса (YYYY-MM-DD)
+	RawDate           string             `json:"raw_date,omitempty"`          // Дата в виде, в котором ее вернула модель, если она была преобразована
+	DateAmbiguous     bool               `json:"date_ambiguous,omitempty"`    // Дата допускает два прочтения (01/02/2023), выбран порядок по стране контрагента
+	TotalAmount       float64            `json:"total_amount"`                // Общая сумма
+	TaxAmount         float64            `json:"tax_amount"`                  // Сумма налога
+	TaxBreakdown      []TaxLine          `json:"tax_breakdown,omitempty"`     // Разбивка налога по ставкам
+	Currency          string             `json:"currency,omitempty"`          // 3-х буквенный код валюты
+	Purpose           string             `json:"purpose"`                     // Краткое назначение платежа
+	Category          string             `json:"category,omitempty"`          // Категория расходов из Config.Categories или CategoryOther (только с WithCategories)
+	Direction         string             `json:"direction,omitempty"`         // Направление относительно своей компании: DirectionIncoming, DirectionOutgoing или пусто, если не определено
+	Counterparty      Counterparty       `json:"counterparty"`                // Данные контрагента
+	Pages             []int              `json:"pages,omitempty"`             // Номера страниц файла (с 1), относящихся к инвойсу
+	RotatedPages      []int              `json:"rotated_pages,omitempty"`     // Страницы, повернутые на 180° перед анализом (дуплексный скан, WithDuplexRotation)
+	Sources           *FieldSources      `json:"sources,omitempty"`           // Страницы, с которых прочитаны ключевые поля
+	Confidences       map[string]float64 `json:"confidences,omitempty"`       // Уверенность модели в значениях полей (0–1), ключи — ConfidenceFields
+	SourceMethod      string             `json:"source_method,omitempty"`     // SourceMethodQR — сумма, валюта и реквизиты получателя взяты из платежного QR-кода
+	PaymentReference  string             `json:"payment_reference,omitempty"` // Ссылка платежа из QR-кода (RF-ссылка, QR-ссылка)
+	Extraction        string             `json:"extraction,omitempty"`        // Способ извлечения: пусто — OpenAI по изображениям, ExtractionText — OpenAI по текстовому слою PDF, ExtractionLocal — эвристики деградированного режима, ExtractionEmbeddedXML — вложенный XML ZUGFeRD/Factur-X
+	AmountDecimals    int                `json:"amount_decimals,omitempty"`   // Число знаков после запятой в суммах документа до округления
+	Preview           []byte             `json:"-"`                           // Миниатюра первой страницы в JPEG (только при WithThumbnails)
+	Err               error              `json:"-"`                           // Ошибка группы страниц, из которой инвойс не извлечен: заполнены только Pages (см. FileResults)
+}
+
+// Типы документов (Invoice.Type).
+const (
+	TypeNotInvoice     = 0 // Не платежный документ (накладная, банковская выписка, договор): пропускается без ошибки
+	TypePaymentOrder   = 1 // Платежное поручение (инвойс, счет)
+	TypeReceipt        = 2 // Кассовый чек
+	TypeCreditNote     = 3 // Кредит-нота: уменьшает сумму ранее выставленного инвойса
+	TypeProforma       = 4 // Проформа-инвойс: предварительный счет перед поставкой или оплатой
+	TypeAdvanceReceipt = 5 // Документ о получении авансового платежа
+)
+
+// typeNames — названия типов документов для отчетов (Invoice.TypeName).
+var typeNames = map[int]string{
+	TypeNotInvoice:     "not an invoice",
+	TypePaymentOrder:   "invoice",
+	TypeReceipt:        "receipt",
+	TypeCreditNote:     "credit note",
+	TypeProforma:       "proforma",
+	TypeAdvanceReceipt: "advance payment receipt",
+}
+
+// TypeName возвращает название типа документа для отчетов, например "credit note".
+func (inv Invoice) TypeName() string {
+	if name, ok := typeNames[inv.Type]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown type %d", inv.Type)
+}
+
+// ParseType возвращает тип документа по названию TypeName без учета регистра. Для других значений ok = false.
+func ParseType(name string) (docType int, ok bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for docType, typeName := range typeNames {
+		if typeName == name {
+			return docType, true
+		}
+	}
+	return 0, false
+}
+
+// IsInvoice сообщает, что модель распознала платежный документ, а не TypeNotInvoice.
+func (inv Invoice) IsInvoice() bool {
+	return inv.Type != TypeNotInvoice
+}
+
+// Направления документа (Invoice.Direction) относительно своей компании (my_company).
+const (
+	DirectionIncoming = "incoming" // Полученный документ: своя компания — покупатель
+	DirectionOutgoing = "outgoing" // Выставленный документ: своя компания — продавец
+)
+
+// ParseDirection приводит направление документа к DirectionIncoming или DirectionOutgoing
+// без учета регистра. Для других значений ok = false.
+func ParseDirection(value string) (direction string, ok bool) {
+	switch direction = strings.ToLower(strings.TrimSpace(value)); direction {
+	case DirectionIncoming, DirectionOutgoing:
+		return direction, true
+	}
+	return "", false
+}
+
+// monthFirstCountries — страны, в которых числовые даты пишутся с месяцем впереди (MM/DD/YYYY).
+var monthFirstCountries = map[string]bool{"US": true, "FM": true, "PW": true, "MH": true}
+
+// normalizeDate приводит Date к виду YYYY-MM-DD. Неоднозначная дата читается как DD/MM/YYYY,
+// кроме контрагентов из стран с форматом MM/DD/YYYY. Нераспознанная дата остается как есть
+// (ее отмечает Validate).
+func (inv *Invoice) normalizeDate() {
+	dayFirst := !monthFirstCountries[countryCode(inv.Counterparty.CountryCode)]
+	date, ambiguous, err := NormalizeDate(inv.Date, dayFirst)
+	if err != nil || date == inv.Date {
+		return
+	}
+	inv.RawDate, inv.Date, inv.DateAmbiguous = inv.Date, date, ambiguous
+}
+
+// IsCreditNote сообщает, является ли документ кредит-нотой.
+func (inv Invoice) IsCreditNote() bool {
+	return inv.Type == TypeCreditNote
+}
+
+// SignedTotal возвращает сумму документа со знаком: для кредит-нот она отрицательная.
+func (inv Invoice) SignedTotal() float64 {
+	if inv.IsCreditNote() {
+		return -math.Abs(inv.TotalAmount)
+	}
+	return inv.TotalAmount
+}
+
+// ConfidenceFields — поля, для которых модель оценивает уверенность в значении (ключи Invoice.Confidences).
+var ConfidenceFields = []string{"number", "date", "total_amount", "tax_amount", "counterparty.name", "counterparty.vat"}
+
+// DefaultUploadMaxBytes ограничивает размер архива, загружаемого в веб-сервер.
+const DefaultUploadMaxBytes = 200 << 20
+
+// DefaultConfidenceThreshold — порог уверенности по умолчанию, ниже которого значение считается сомнительным.
+const DefaultConfidenceThreshold = 0.7
+
+// LowConfidence сообщает, что модель не уверена в значении поля field (уверенность ниже threshold).
+// Если модель не оценила поле, оно не считается сомнительным.
+func (inv Invoice) LowConfidence(field string, threshold float64) bool {
+	confidence, ok := inv.Confidences[field]
+	return ok && confidence < threshold
+}
+
+// normalizeConfidences оставляет только известные поля с уверенностью в диапазоне [0, 1].
+func normalizeConfidences(confidences map[string]float64) map[string]float64 {
+	normalized := make(map[string]float64, len(ConfidenceFields))
+	for _, field := range ConfidenceFields {
+		if confidence, ok := confidences[field]; ok && confidence >= 0 && confidence <= 1 {
+			normalized[field] = confidence
+		}
+	}
+	if len(normalized) == 0 {
+		return nil
+	}
+	return normalized
+}
+
+// FieldSources хранит номера страниц файла (с 1), с которых модель прочитала ключевые поля.
+// 0 — страница неизвестна (модель не указала ее или указала страницу вне инвойса).
+type FieldSources struct {
+	Number       int `json:"number"`
+	Date         int `json:"date"`
+	TotalAmount  int `json:"total_amount"`
+	TaxAmount    int `json:"tax_amount"`
+	Counterparty int `json:"counterparty"`
+}
+
+// String возвращает краткое описание источников, например "number p.1, total p.3".
+func (s FieldSources) String() string {
+	var parts []string
+	for _, field := range []struct {
+		name string
+		page int
+	}{
+		{"number", s.Number}, {"date", s.Date}, {"total", s.TotalAmount}, {"tax", s.TaxAmount}, {"counterparty", s.Counterparty},
+	} {
+		if field.page > 0 {
+			parts = append(parts, fmt.Sprintf("%s p.%d", field.name, field.page))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// restrictTo обнуляет страницы, не входящие в pages. Возвращает false, если не осталось ни одной страницы.
+func (s *FieldSources) restrictTo(pages []int) bool {
+	known := false
+	for _, page := range []*int{&s.Number, &s.Date, &s.TotalAmount, &s.TaxAmount, &s.Counterparty} {
+		if !slices.Contains(pages, *page) {
+			*page = 0
+		}
+		known = known || *page > 0
+	}
+	return known
+}
+
+// TaxLine представляет одну строку налоговой разбивки инвойса.
+type TaxLine struct {
+	Rate   float64 `json:"rate"`   // Ставка налога в процентах (например, 20)
+	Base   float64 `json:"base"`   // Налоговая база
+	Amount float64 `json:"amount"` // Сумма налога
+}
+
+// TaxBreakdownTotal возвращает сумму налога по всем строкам разбивки.
+func (inv Invoice) TaxBreakdownTotal() float64 {
+	var total float64
+	for _, line := range inv.TaxBreakdown {
+		total += line.Amount
+	}
+	return total
+}
+
+// FormatTaxBreakdown возвращает разбивку налога для отчетов, например "20%: 100.00; 10%: 5.50".
+func (inv Invoice) FormatTaxBreakdown() string {
+	parts := make([]string, len(inv.TaxBreakdown))
+	for i, line := range inv.TaxBreakdown {
+		parts[i] = fmt.Sprintf("%g%%: %s", line.Rate, FormatAmount(line.Amount, inv.Currency))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// normalizeDirection приводит Direction к одному из направлений; неизвестное значение очищается.
+func (inv *Invoice) normalizeDirection() {
+	inv.Direction, _ = ParseDirection(inv.Direction)
+}
+
+// normalizeReferences убирает пробелы вокруг номеров заказа и договора.
+func (inv *Invoice) normalizeReferences() {
+	inv.OrderReference = strings.TrimSpace(inv.OrderReference)
+	inv.ContractReference = strings.TrimSpace(inv.ContractReference)
+}
+
+// normalizeTaxBreakdown убирает пустые строки разбивки. Если модель не вернула общую сумму налога,
+// TaxAmount заполняется суммой разбивки, чтобы отчеты без разбивки видели тот же налог.
+func (inv *Invoice) normalizeTaxBreakdown() {
+	lines := inv.TaxBreakdown[:0]
+	for _, line := range inv.TaxBreakdown {
+		if line.Rate != 0 || line.Base != 0 || line.Amount != 0 {
+			lines = append(lines, line)
+		}
+	}
+	inv.TaxBreakdown = lines
+	if len(inv.TaxBreakdown) == 0 {
+		inv.TaxBreakdown = nil
+		return
+	}
+	if inv.TaxAmount == 0 {
+		inv.TaxAmount = inv.TaxBreakdownTotal()
+	}
 }
 
 // Counterparty представляет данные о контрагенте.
 type Counterparty struct {
-	ID          uint64 `json:"id,omitempty"`           // ID из внешней системы (базы данных)
-	Name        string `json:"name"`                   // Наименование компании
-	VAT         string `json:"vat"`                    // VAT номер
-	Country     string `json:"country"`                // Страна
-	CountryCode string `json:"country_code,omitempty"` // 3-х буквенный ISO код страны
-	Address     string `json:"address"`                // Адрес
-	SWIFT       string `json:"swift,omitempty"`        // SWIFT/BIC (необязательно)
-	IBAN        string `json:"iban,omitempty"`         // IBAN (необязательно)
-	Phone       string `json:"phone,omitempty"`        // Телефон (необязательно)
-	Fax         string `json:"fax,omitempty"`          // Факс (необязательно)
-	Email       string `json:"email,omitempty"`        // Email (необязательно)
-	Website     string `json:"website,omitempty"`      // Веб-сайт (необязательно)
+	ID                 uint64          `json:"id,omitempty"`                  // ID из внешней системы (базы данных)
+	Name               string          `json:"name"`                          // Наименование компании
+	VAT                string          `json:"vat"`                           // VAT номер
+	TaxCode2           string          `json:"tax_code2,omitempty"`           // Второй налоговый код, например КПП (необязательно)
+	RegistrationNumber string          `json:"registration_number,omitempty"` // Регистрационный номер компании: ОГРН, матични број, Company No. (необязательно)
+	Country            string          `json:"country"`                       // Страна
+	CountryCode        string          `json:"country_code,omitempty"`        // Код страны ISO 3166-1 alpha-2 (Country остается в написании инвойса)
+	Address            string          `json:"address"`                       // Адрес
+	SWIFT              string          `json:"swift,omitempty"`               // SWIFT/BIC основного счета (необязательно, для совместимости)
+	IBAN               string          `json:"iban,omitempty"`                // IBAN основного счета (необязательно, для совместимости)
+	BankAccounts       []BankAccount   `json:"bank_accounts,omitempty"`       // Все банковские счета, первый — основной
+	Phone              string          `json:"phone,omitempty"`               // Телефон (необязательно)
+	Fax                string          `json:"fax,omitempty"`                 // Факс (необязательно)
+	Email              string          `json:"email,omitempty"`               // Email (необязательно)
+	Website            string          `json:"website,omitempty"`             // Веб-сайт (необязательно)
+	Aliases            []string        `json:"aliases,omitempty"`             // Альтернативные наименования
+	DefaultCurrency    string          `json:"default_currency,omitempty"`    // Преобладающая валюта инвойсов (ведется программой, см. RecordCurrency)
+	Currencies         []CurrencyCount `json:"currencies,omitempty"`          // Число инвойсов контрагента по валютам
 }
 
 // Config структура для загрузки конфигурации
 type Config struct {
-	OpenAPIKey         string       `json:"openai_api_key"`
-	MyCompany          Counterparty `json:"my_company"`
-	PopplerPathWindows string       `json:"poppler_path_windows,omitempty"`
-	PopplerPathMac     string       `json:"poppler_path_mac,omitempty"`
+	OpenAPIKey          string                  `json:"openai_api_key"`
+	BaseURL             string                  `json:"base_url,omitempty"`    // Базовый URL API (для Azure — endpoint ресурса)
+	APIType             string                  `json:"api_type,omitempty"`    // openai (по умолчанию) или azure
+	APIVersion          string                  `json:"api_version,omitempty"` // Версия API Azure
+	Deployment          string                  `json:"deployment,omitempty"`  // Имя развертывания модели в Azure
+	Model               string                  `json:"model,omitempty"`       // Модель (по умолчанию gpt-4o); для api_type compatible — модель сервера, например llama3.2-vision
+	MyCompany           Counterparty            `json:"my_company"`
+	Companies           map[string]Counterparty `json:"companies,omitempty"` // Свои юрлица по псевдонимам для выбора в задании (-company, поле company формы)
+	PopplerPathWindows  string                  `json:"poppler_path_windows,omitempty"`
+	PopplerPathMac      string                  `json:"poppler_path_mac,omitempty"`
+	ModelPrices         map[string]ModelPrice   `json:"model_prices,omitempty"`            // Цены моделей для оценки стоимости
+	CounterpartiesDB    string                  `json:"counterparties_db,omitempty"`       // Путь к базе контрагентов (JSON или CSV)
+	CounterpartyAliases []CounterpartyAlias     `json:"counterparty_aliases,omitempty"`    // Контрагенты с фиксированным ID, к которым имена и VAT приводятся без модели
+	RoundingPolicy      string                  `json:"rounding_policy,omitempty"`         // Политика округления сумм: half-up (по умолчанию) или half-even
+	CSVDelimiter        string                  `json:"csv_delimiter,omitempty"`           // Разделитель CSV-выгрузок (по умолчанию запятая)
+	OneCFormat          string                  `json:"onec_format,omitempty"`             // Формат файла обмена с 1С: client_bank (по умолчанию) или commerceml
+	ThumbnailSize       int                     `json:"thumbnail_size,omitempty"`          // Размер миниатюр страниц в Excel в пикселях (0 — без миниатюр)
+	ThumbnailsMaxMB     int                     `json:"thumbnails_max_mb,omitempty"`       // Лимит суммарного размера миниатюр в отчете (по умолчанию 20 МБ)
+	UploadMaxMB         int                     `json:"upload_max_mb,omitempty"`           // Лимит размера архива, загружаемого в веб-сервер (по умолчанию 200 МБ)
+	PageSelection       string                  `json:"page_selection,omitempty"`          // Страницы для анализа: first_last (по умолчанию), all или first_N:last_M
+	MaxAllPages         int                     `json:"max_all_pages,omitempty"`           // Лимит страниц инвойса при page_selection = all (по умолчанию 12)
+	PDFDPI              int                     `json:"pdf_dpi,omitempty"`                 // Разрешение конвертации страниц PDF (0 — по умолчанию pdftoppm, 150)
+	PDFImageFormat      string                  `json:"pdf_image_format,omitempty"`        // Формат изображений страниц PDF: png (по умолчанию) или jpeg
+	PDFMaxPages         int                     `json:"pdf_max_pages,omitempty"`           // Лимит страниц PDF-файла; длинные файлы завершаются ошибкой (0 — без лимита)
+	PDFPasswords        []string                `json:"pdf_passwords,omitempty"`           // Пароли защищенных PDF, пробуются по порядку
+	ResultCache         bool                    `json:"result_cache,omitempty"`            // Кэшировать результаты извлечения по хэшу файла
+	ResultCachePath     string                  `json:"result_cache_path,omitempty"`       // Директория кэша (по умолчанию invpa-cache)
+	Concurrency         int                     `json:"concurrency,omitempty"`             // Число одновременно обрабатываемых файлов (0 — все сразу, в адаптивном режиме — max_concurrency)
+	AdaptiveConcurrency bool                    `json:"adaptive_concurrency,omitempty"`    // Подстраивать параллелизм под лимиты OpenAI (ошибки 429)
+	MinConcurrency      int                     `json:"min_concurrency,omitempty"`         // Нижняя граница адаптивного параллелизма (по умолчанию 1)
+	MaxConcurrency      int                     `json:"max_concurrency,omitempty"`         // Верхняя граница адаптивного параллелизма (по умолчанию 8)
+	RequestsPerMinute   int                     `json:"requests_per_minute,omitempty"`     // Общий для процесса лимит запросов к OpenAI в минуту (0 — без лимита)
+	RequestTimeout      string                  `json:"request_timeout,omitempty"`         // Ограничение времени одного запроса к OpenAI, например 120s (по умолчанию 120s, 0 — без ограничения)
+	FileTimeout         string                  `json:"file_timeout,omitempty"`            // Ограничение времени обработки одного файла, например 10m (по умолчанию 10m, 0 — без ограничения)
+	ExtractResponse     string                  `json:"extract_response,omitempty"`        // Ответ /api/v1/extract веб-сервера: auto (по умолчанию), sync или async (см. ExtractResponseAuto)
+	ExtractAsyncAfter   string                  `json:"extract_async_after,omitempty"`     // В режиме auto: оценка времени обработки, после которой создается задание, например 30s (по умолчанию 30s)
+	ConcurrentRequests  int                     `json:"max_concurrent_requests,omitempty"` // Общий для процесса лимит одновременных запросов к OpenAI (0 — без лимита)
+	ArchivePath         string                  `json:"archive_path,omitempty"`            // Директория архива исходных файлов и результатов (пусто — архив отключен)
+	ConfidenceThreshold float64                 `json:"confidence_threshold,omitempty"`    // Порог уверенности модели, ниже которого значения подсвечиваются в Excel (по умолчанию 0.7)
+	DuplexRotation      bool                    `json:"duplex_rotation,omitempty"`         // Поворачивать каждую вторую страницу дуплексных сканов, перевернутую на 180°
+	Categories          []Category              `json:"categories,omitempty"`              // Категории расходов, из которых модель выбирает Invoice.Category (пусто — без категорий)
+	ExtractionMode      string                  `json:"extraction_mode,omitempty"`         // Анализ PDF: vision (по изображениям, по умолчанию), text (по текстовому слою) или auto
+	GroupingTemplate    string                  `json:"grouping_prompt,omitempty"`         // Файл шаблона промпта группировки страниц (пусто — встроенный промпт)
+	DetailedTemplate    string                  `json:"detailed_prompt,omitempty"`         // Файл шаблона промпта детального анализа (пусто — встроенный промпт)
+	MatchingTemplate    string                  `json:"matching_prompt,omitempty"`         // Файл шаблона промпта сопоставления контрагентов (пусто — встроенный промпт)
+	WebUsername         string                  `json:"web_username,omitempty"`            // Пользователь basic auth веб-сервера (вместе с web_password)
+	WebPassword         string                  `json:"web_password,omitempty"`
+	WebAPIKey           string                  `json:"web_api_key,omitempty"`             // Ключ API веб-сервера (Bearer или X-API-Key)
+	DegradedMode        bool                    `json:"degraded_mode,omitempty"`           // Извлекать данные локально, без OpenAI (частичный результат)
+	CurrencyAutoCorrect bool                    `json:"currency_auto_correct,omitempty"`   // Исправлять валюту, отличающуюся от обычной валюты контрагента, если на нее явно указывает запись сумм
+	DegradedAfter       int                     `json:"degraded_after_failures,omitempty"` // Переходить в деградированный режим после стольких ошибок недоступности OpenAI подряд (0 — не переходить)
+	Trace               bool                    `json:"trace,omitempty"`                   // Записывать длительности этапов обработки каждого файла
+	JSONRepairAttempts  int                     `json:"json_repair_attempts,omitempty"`    // Попытки исправить неразбираемый JSON-ответ модели (по умолчанию 1, -1 — не исправлять)
+	AllowNetwork        *bool                   `json:"allow_network,omitempty"`           // false — запретить исходящие запросы (только с degraded_mode), по умолчанию true
+	WebhookURL          string                  `json:"webhook_url,omitempty"`             // Вебхук веб-сервера о завершении каждого задания (callback_url формы загрузки имеет приоритет)
+	WebhookSecret       string                  `json:"webhook_secret,omitempty"`          // Ключ HMAC-подписи вебхуков
+	WebhookResults      bool                    `json:"webhook_include_results,omitempty"` // Передавать в вебхуке результаты по инвойсам
+	WebhookAllowedHosts []string                `json:"webhook_allowed_hosts,omitempty"`   // Хосты callback_url во внутренней сети (loopback, частные и link-local адреса), на которые разрешены вебхуки
+	PublicURL           string                  `json:"public_url,omitempty"`              // Внешний адрес веб-сервера для ссылок на отчеты в вебхуках (по умолчанию — локальный адрес, на который пришел запрос загрузки)
+	CSVReport           bool                    `json:"csv_report,omitempty"`              // Собирать в веб-сервере zip с CSV-отчетом для каждого задания (по умолчанию только Excel; поле csv_report формы загрузки задает это для одного задания)
+	RetainSources       bool                    `json:"retain_sources,omitempty"`          // Сохранять исходные файлы заданий веб-сервера для просмотра из результатов
+	SourceRetention     string                  `json:"source_retention,omitempty"`        // Срок хранения исходных файлов, например 72h (пусто — пока хранится задание)
+	AutoReprocess       bool                    `json:"auto_reprocess,omitempty"`          // Повторно обрабатывать в фоне файлы заданий веб-сервера, не обработанные из-за лимитов или недоступности OpenAI (нужен retain_sources)
+	ReprocessMaxAge     string                  `json:"reprocess_max_age,omitempty"`       // Файлы заданий старше этого срока повторно не обрабатываются, например 24h (по умолчанию 24h)
+	ReprocessBudget     float64                 `json:"reprocess_daily_budget,omitempty"`  // Предел оценки расходов на автоматические повторы за сутки (UTC) в долларах (по умолчанию 1)
+	TelegramToken       string                  `json:"telegram_bot_token,omitempty"`      // Токен Telegram-бота cmd/tgbot от @BotFather
+	TelegramUsers       []int64                 `json:"telegram_allowed_users,omitempty"`  // ID пользователей Telegram, которым бот отвечает
+	TelegramStore       string                  `json:"telegram_store,omitempty"`          // JSONL-файл, в который бот дописывает инвойсы (по умолчанию invpa-telegram.jsonl)
+}
+
+// ClientConfig возвращает настройки подключения к OpenAI из конфигурации.
+func (c Config) ClientConfig() ClientConfig {
+	return ClientConfig{
+		APIKey:     c.OpenAPIKey,
+		BaseURL:    c.BaseURL,
+		APIType:    c.APIType,
+		APIVersion: c.APIVersion,
+		Deployment: c.Deployment,
+		Offline:    !c.NetworkAllowed(),
+	}
+}
+
+// ThumbnailsMaxBytes возвращает лимит суммарного размера миниатюр в байтах.
+func (c Config) ThumbnailsMaxBytes() int {
+	if c.ThumbnailsMaxMB <= 0 {
+		return DefaultThumbnailsMaxBytes
+	}
+	return c.ThumbnailsMaxMB << 20
+}
+
+// UploadMaxBytes возвращает лимит размера архива, загружаемого в веб-сервер, в байтах.
+func (c Config) UploadMaxBytes() int64 {
+	if c.UploadMaxMB <= 0 {
+		return DefaultUploadMaxBytes
+	}
+	return int64(c.UploadMaxMB) << 20
+}
+
+// Company возвращает свою компанию по псевдониму из companies. Пустой псевдоним выбирает my_company.
+func (c Config) Company(alias string) (Counterparty, error) {
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return c.MyCompany, nil
+	}
+	company, ok := c.Companies[alias]
+	if !ok {
+		if len(c.Companies) == 0 {
+			return Counterparty{}, fmt.Errorf("unknown company %q: no companies are defined in config.json", alias)
+		}
+		return Counterparty{}, fmt.Errorf("unknown company %q, valid companies: %s", alias, strings.Join(c.CompanyAliases(), ", "))
+	}
+	return company, nil
+}
+
+// CompanyAliases возвращает отсортированные псевдонимы companies.
+func (c Config) CompanyAliases() []string {
+	return slices.Sorted(maps.Keys(c.Companies))
+}
+
+// LowConfidenceThreshold возвращает порог уверенности, ниже которого значения подсвечиваются в отчете.
+func (c Config) LowConfidenceThreshold() float64 {
+	if c.ConfidenceThreshold <= 0 {
+		return DefaultConfidenceThreshold
+	}
+	return c.ConfidenceThreshold
+}
+
+// ConcurrencyBounds возвращает границы адаптивного параллелизма.
+func (c Config) ConcurrencyBounds() (int, int) {
+	low := max(c.MinConcurrency, 1)
+	high := c.MaxConcurrency
+	if high <= 0 {
+		high = DefaultMaxConcurrency
+	}
+	return low, max(high, low)
+}
+
+// RepairAttempts возвращает число попыток исправить неразбираемый JSON-ответ модели.
+func (c Config) RepairAttempts() int {
+	switch {
+	case c.JSONRepairAttempts < 0:
+		return 0
+	case c.JSONRepairAttempts == 0:
+		return DefaultJSONRepairAttempts
+	}
+	return c.JSONRepairAttempts
+}
+
+// CounterpartyStore возвращает базу контрагентов из counterparties_db или nil, если она не задана.
+func (c Config) CounterpartyStore() CounterpartyStore {
+	if c.CounterpartiesDB == "" {
+		return nil
+	}
+	return FileCounterpartyStore{Path: c.CounterpartiesDB}
+}
+
+// ModelName возвращает модель для извлечения и сопоставления контрагентов.
+func (c Config) ModelName() string {
+	if c.Model == "" {
+		return DefaultModel
+	}
+	return c.Model
+}
+
+// RequestTimeoutLimit возвращает ограничение времени запроса к OpenAI из request_timeout для WithRequestTimeout.
+func (c Config) RequestTimeoutLimit() (time.Duration, error) {
+	return parseTimeout(c.RequestTimeout, DefaultRequestTimeout)
+}
+
+// FileTimeoutLimit возвращает ограничение времени обработки файла из file_timeout для WithFileTimeout.
+func (c Config) FileTimeoutLimit() (time.Duration, error) {
+	return parseTimeout(c.FileTimeout, DefaultFileTimeout)
+}
+
+// parseTimeout разбирает длительность таймаута; пустая строка — defaultTimeout, "0" — без ограничения.
+func parseTimeout(value string, defaultTimeout time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected e.g. 90s or 5m", value)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", value)
+	}
+	return timeout, nil
+}
+
+// Режимы ответа /api/v1/extract веб-сервера (extract_response).
+const (
+	ExtractResponseAuto  = "auto"  // Синхронно, если оценка времени обработки не больше extract_async_after, иначе задание (по умолчанию)
+	ExtractResponseSync  = "sync"  // Всегда синхронно, заголовок Prefer: respond-async не учитывается
+	ExtractResponseAsync = "async" // Всегда задание с ответом 202
+)
+
+// DefaultExtractAsyncAfter — порог оценки времени обработки для ответа 202 в режиме auto.
+const DefaultExtractAsyncAfter = 30 * time.Second
+
+// ExtractResponseMode возвращает режим ответа /api/v1/extract из extract_response. Пустая строка означает auto.
+func (c Config) ExtractResponseMode() (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(c.ExtractResponse)); mode {
+	case "":
+		return ExtractResponseAuto, nil
+	case ExtractResponseAuto, ExtractResponseSync, ExtractResponseAsync:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown extract response %q (expected %q, %q or %q)", c.ExtractResponse, ExtractResponseAuto, ExtractResponseSync, ExtractResponseAsync)
+}
+
+// ExtractAsyncThreshold возвращает порог extract_async_after для режима auto.
+func (c Config) ExtractAsyncThreshold() (time.Duration, error) {
+	if c.ExtractAsyncAfter == "" {
+		return DefaultExtractAsyncAfter, nil
+	}
+	threshold, err := time.ParseDuration(c.ExtractAsyncAfter)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected e.g. 30s", c.ExtractAsyncAfter)
+	}
+	if threshold <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", c.ExtractAsyncAfter)
+	}
+	return threshold, nil
+}
+
+// SourceRetentionPeriod возвращает срок хранения исходных файлов из source_retention; 0 — пока хранится задание.
+func (c Config) SourceRetentionPeriod() (time.Duration, error) {
+	if c.SourceRetention == "" {
+		return 0, nil
+	}
+	period, err := time.ParseDuration(c.SourceRetention)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected e.g. 72h", c.SourceRetention)
+	}
+	if period <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", c.SourceRetention)
+	}
+	return period, nil
+}
+
+// Значения по умолчанию для автоматической повторной обработки (auto_reprocess).
+const (
+	DefaultReprocessMaxAge = 24 * time.Hour
+	DefaultReprocessBudget = 1.0 // Долларов в сутки
+)
+
+// ReprocessMaxAgeLimit возвращает из reprocess_max_age возраст заданий, файлы которых еще обрабатываются повторно.
+func (c Config) ReprocessMaxAgeLimit() (time.Duration, error) {
+	if c.ReprocessMaxAge == "" {
+		return DefaultReprocessMaxAge, nil
+	}
+	age, err := time.ParseDuration(c.ReprocessMaxAge)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected e.g. 24h", c.ReprocessMaxAge)
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", c.ReprocessMaxAge)
+	}
+	return age, nil
+}
+
+// ReprocessDailyBudget возвращает предел расходов на автоматические повторы за сутки из reprocess_daily_budget.
+func (c Config) ReprocessDailyBudget() float64 {
+	if c.ReprocessBudget <= 0 {
+		return DefaultReprocessBudget
+	}
+	return c.ReprocessBudget
+}
+
+// DefaultTelegramStore — файл инвойсов Telegram-бота, если telegram_store не задан.
+const DefaultTelegramStore = "invpa-telegram.jsonl"
+
+// TelegramStorePath возвращает путь к JSONL-файлу, в который Telegram-бот дописывает инвойсы.
+func (c Config) TelegramStorePath() string {
+	if c.TelegramStore == "" {
+		return DefaultTelegramStore
+	}
+	return c.TelegramStore
+}
+
+// PDF DPI, допустимые в pdf_dpi: ниже модель плохо читает текст, выше изображения становятся огромными.
+const (
+	MinPDFDPI = 72
+	MaxPDFDPI = 600
+)
+
+// RenderOptions возвращает настройки конвертации PDF в изображения (pdf_dpi, pdf_image_format, pdf_max_pages)
+// и пароли защищенных PDF (pdf_passwords) для PDFRenderer, PDFTextExtractor и PDFAttachmentExtractor.
+func (c Config) RenderOptions() (pdfimg.Options, error) {
+	format, err := pdfimg.ParseFormat(c.PDFImageFormat)
+	if err != nil {
+		return pdfimg.Options{}, fmt.Errorf("'pdf_image_format': %w", err)
+	}
+	if err := c.validatePDFDPI(); err != nil {
+		return pdfimg.Options{}, fmt.Errorf("'pdf_dpi': %w", err)
+	}
+	if c.PDFMaxPages < 0 {
+		return pdfimg.Options{}, fmt.Errorf("'pdf_max_pages': must not be negative, got %d", c.PDFMaxPages)
+	}
+	return pdfimg.Options{PopplerPath: c.PopplerPath(), DPI: c.PDFDPI, Format: format, MaxPages: c.PDFMaxPages, Passwords: c.PDFPasswords}, nil
+}
+
+// PromptTemplates загружает шаблоны промптов из grouping_prompt, detailed_prompt
+// и matching_prompt для WithPromptTemplates; nil — встроенные промпты.
+func (c Config) PromptTemplates() (*PromptTemplates, error) {
+	return LoadPromptTemplates(c.GroupingTemplate, c.DetailedTemplate, c.MatchingTemplate)
+}
+
+// AliasOverrides возвращает проверенные правила counterparty_aliases; без правил — nil.
+func (c Config) AliasOverrides() (*AliasOverrides, error) {
+	return NewAliasOverrides(c.CounterpartyAliases)
+}
+
+// MaxAllPagesLimit возвращает лимит страниц инвойса при page_selection = all.
+func (c Config) MaxAllPagesLimit() int {
+	if c.MaxAllPages <= 0 {
+		return DefaultMaxAllPages
+	}
+	return c.MaxAllPages
 }
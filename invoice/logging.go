@@ -0,0 +1,49 @@
+package invoice
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+// Ключи атрибутов записей журнала процессора (см. WithLogger).
+const (
+	LogKeyFile      = "file"       // Имя обрабатываемого файла
+	LogKeyJobID     = "job_id"     // Идентификатор задания вызывающего кода (см. WithJobID)
+	LogKeyInvoiceID = "invoice_id" // Идентификатор инвойса внутри файла из группировки страниц
+	LogKeyStage     = "stage"      // Этап обработки: фаза трассировки (Phase*)
+)
+
+// WithLogger задает логгер для сообщений о ходе обработки (по умолчанию slog.Default()). Ход
+// обработки пишется на уровне Debug, решения и результаты — на Info, проблемы, не прерывающие
+// обработку, — на Warn. Записи получают атрибуты LogKey*, по которым их можно отфильтровать
+// или разложить по заданиям.
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *Processor) { p.logger = logger }
+}
+
+type logAttrsKey struct{}
+
+// WithJobID возвращает контекст, записи журнала процессора в котором получают атрибут job_id.
+// Так сервер, обрабатывающий несколько заданий одним логгером, может разложить записи по заданиям.
+func WithJobID(ctx context.Context, jobID string) context.Context {
+	return withLogAttrs(ctx, slog.String(LogKeyJobID, jobID))
+}
+
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	parent, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, append(slices.Clip(parent), attrs...))
+}
+
+// log возвращает логгер процессора с атрибутами контекста (задание, файл).
+func (p *Processor) log(ctx context.Context) *slog.Logger {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	if len(attrs) == 0 {
+		return p.logger
+	}
+	args := make([]any, len(attrs))
+	for i, attr := range attrs {
+		args[i] = attr
+	}
+	return p.logger.With(args...)
+}
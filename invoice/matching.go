@@ -0,0 +1,261 @@
+package invoice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// CounterpartyMatch — результат пакетного сопоставления одного нового контрагента.
+type CounterpartyMatch struct {
+	ExistingIndex int    // Индекс совпавшего контрагента в existing или -1, если контрагент новый
+	NewIndex      int    // Для новых: индекс первой записи в newEntries, описывающей того же контрагента (себя, если она первая)
+	Reason        string // Причина совпадения с существующим контрагентом, названная моделью; пусто при локальном совпадении
+}
+
+// IsNew сообщает, что контрагент не найден среди существующих.
+func (m CounterpartyMatch) IsNew() bool {
+	return m.ExistingIndex < 0
+}
+
+// batchMatchResponse — ответ модели при пакетном сопоставлении контрагентов.
+type batchMatchResponse struct {
+	Matches []batchMatchItem `json:"matches"`
+}
+
+type batchMatchItem struct {
+	NewIndex      int    `json:"new_index"`
+	ExistingIndex int    `json:"existing_index"` // -1, если совпадения в existing_list нет
+	SameAsIndex   int    `json:"same_as_new_index"`
+	Reason        string `json:"reason"` // Почему запись совпадает с existing_index
+}
+
+// FindCounterpartiesBatch сопоставляет всех новых контрагентов с существующими одним запросом к OpenAI.
+// Результат содержит по одному CounterpartyMatch на каждую запись newEntries. Записи, описывающие
+// одного и того же нового контрагента (например, поставщик встречается в пакете дважды),
+// получают одинаковый NewIndex.
+// При ошибке запроса возвращаются результаты локального сопоставления по именам и алиасам.
+func FindCounterpartiesBatch(client ChatClient, existing []Counterparty, newEntries []Counterparty) ([]CounterpartyMatch, Usage, error) {
+	return matchCounterpartiesBatch(context.Background(), client, openai.GPT4o, DefaultJSONRepairAttempts, promptSet{}, existing, newEntries)
+}
+
+// MatchCounterparties аналогичен функции FindCounterpartiesBatch, но использует модель процессора и контекст.
+func (p *Processor) MatchCounterparties(ctx context.Context, existing []Counterparty, newEntries []Counterparty) ([]CounterpartyMatch, Usage, error) {
+	return matchCounterpartiesBatch(ctx, p.client, p.model, p.repairAttempts, p.prompts(), existing, newEntries)
+}
+
+func matchCounterpartiesBatch(ctx context.Context, client ChatClient, model string, repairAttempts int, prompts promptSet, existing []Counterparty, newEntries []Counterparty) ([]CounterpartyMatch, Usage, error) {
+	var usage Usage
+	groups := newMatchGroups(len(newEntries))
+
+	// 0. Локальный предфильтр: совпадение по регистрационному номеру, имени и алиасам с существующими и между новыми записями
+	var pending []int // Записи, которые нужно отправить модели
+	for i, cp := range newEntries {
+		if index := matchLocally(existing, cp); index >= 0 {
+			groups.setExisting(i, index, "")
+			continue
+		}
+		if j := matchLocally(newEntries[:i], cp); j >= 0 {
+			groups.union(i, j)
+			continue
+		}
+		pending = append(pending, i)
+	}
+	// Без клиента (деградированный режим) остается только локальное сопоставление
+	if noClient(client) || len(pending) == 0 || (len(pending) == 1 && len(existing) == 0) {
+		return groups.matches(), usage, nil
+	}
+
+	// 1. Подготовить данные для промпта
+	existingList := make([]promptCounterparty, len(existing))
+	for i, cp := range existing {
+		existingList[i] = newPromptCounterparty(i, cp)
+	}
+	newList := make([]promptCounterparty, len(pending))
+	for i, index := range pending {
+		newList[i] = newPromptCounterparty(index, newEntries[index])
+	}
+	existingJSON, err := json.Marshal(existingList)
+	if err != nil {
+		return groups.matches(), usage, fmt.Errorf("failed to marshal existing counterparties for prompt: %w", err)
+	}
+	newJSON, err := json.Marshal(newList)
+	if err != nil {
+		return groups.matches(), usage, fmt.Errorf("failed to marshal new counterparties for prompt: %w", err)
+	}
+
+	prompt, err := prompts.matching(string(existingJSON), string(newJSON), true)
+	if err != nil {
+		return groups.matches(), usage, err
+	}
+
+	// 2. Отправить запрос в OpenAI
+	request := openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+		ResponseFormat: responseFormat(model, "counterparty_batch_match", batchMatchSchema),
+	}
+	started := time.Now()
+	resp, err := client.CreateChatCompletion(ctx, request)
+	TraceFrom(ctx).Record(PhaseMatching, started, err)
+	if err != nil {
+		return groups.matches(), usage, fmt.Errorf("batch matching request to OpenAI failed: %w", err)
+	}
+	usage.record(model, resp.Usage)
+	if len(resp.Choices) == 0 {
+		return groups.matches(), usage, fmt.Errorf("OpenAI returned no choices for batch matching")
+	}
+
+	// 3. Распарсить ответ и применить совпадения. Некорректные элементы пропускаются:
+	// такие записи остаются новыми, а ошибки возвращаются для логирования.
+	var response batchMatchResponse
+	if err := decodeResponse(ctx, client, request, resp.Choices[0].Message.Content, &response, repairAttempts, &usage); err != nil {
+		return groups.matches(), usage, fmt.Errorf("failed to unmarshal batch matching response: %w", err)
+	}
+	isPending := make(map[int]bool, len(pending))
+	for _, index := range pending {
+		isPending[index] = true
+	}
+	var errs []error
+	for _, item := range response.Matches {
+		if !isPending[item.NewIndex] {
+			errs = append(errs, fmt.Errorf("AI returned a match for unknown new index '%d'", item.NewIndex))
+			continue
+		}
+		switch {
+		case item.ExistingIndex >= len(existing):
+			errs = append(errs, fmt.Errorf("AI matched new index '%d' to existing index '%d' but this index is out of bounds", item.NewIndex, item.ExistingIndex))
+		case item.ExistingIndex >= 0:
+			groups.setExisting(item.NewIndex, item.ExistingIndex, item.Reason)
+		}
+		if item.SameAsIndex >= 0 && item.SameAsIndex != item.NewIndex {
+			if !isPending[item.SameAsIndex] {
+				errs = append(errs, fmt.Errorf("AI matched new index '%d' to unknown new index '%d'", item.NewIndex, item.SameAsIndex))
+				continue
+			}
+			groups.union(item.NewIndex, item.SameAsIndex)
+		}
+	}
+	return groups.matches(), usage, errors.Join(errs...)
+}
+
+// matchLocally возвращает индекс контрагента с тем же регистрационным номером, а если такого нет — совпадающего
+// с cp по имени или алиасу, затем контрагента с общим банковским счетом, или -1.
+func matchLocally(counterparties []Counterparty, cp Counterparty) int {
+	for i, candidate := range counterparties {
+		if candidate.SameRegistrationNumber(cp) {
+			return i
+		}
+	}
+	for i, candidate := range counterparties {
+		if candidate.MatchesName(cp.Name) {
+			return i
+		}
+	}
+	for i, candidate := range counterparties {
+		if candidate.SharesBankAccount(cp) {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchGroups объединяет новые записи, описывающие одного контрагента (система непересекающихся множеств).
+// Корень группы — запись с наименьшим индексом.
+type matchGroups struct {
+	parent   []int
+	existing []int    // Совпавший существующий контрагент для корня группы или -1
+	reason   []string // Причина совпадения для корня группы
+}
+
+func newMatchGroups(n int) *matchGroups {
+	g := &matchGroups{parent: make([]int, n), existing: make([]int, n), reason: make([]string, n)}
+	for i := range g.parent {
+		g.parent[i] = i
+		g.existing[i] = -1
+	}
+	return g
+}
+
+func (g *matchGroups) find(i int) int {
+	for g.parent[i] != i {
+		g.parent[i] = g.parent[g.parent[i]]
+		i = g.parent[i]
+	}
+	return i
+}
+
+func (g *matchGroups) union(i, j int) {
+	ri, rj := g.find(i), g.find(j)
+	if ri == rj {
+		return
+	}
+	if rj < ri {
+		ri, rj = rj, ri
+	}
+	g.parent[rj] = ri
+	if g.existing[ri] < 0 {
+		g.existing[ri], g.reason[ri] = g.existing[rj], g.reason[rj]
+	}
+}
+
+func (g *matchGroups) setExisting(i, index int, reason string) {
+	if root := g.find(i); g.existing[root] < 0 {
+		g.existing[root], g.reason[root] = index, reason
+	}
+}
+
+func (g *matchGroups) matches() []CounterpartyMatch {
+	matches := make([]CounterpartyMatch, len(g.parent))
+	for i := range matches {
+		root := g.find(i)
+		matches[i] = CounterpartyMatch{ExistingIndex: g.existing[root], NewIndex: root, Reason: g.reason[root]}
+		if matches[i].ExistingIndex >= 0 {
+			matches[i].NewIndex = -1
+		}
+	}
+	return matches
+}
+
+func buildBatchMatchingPrompt(existingJSON, newJSON string) string {
+	return fmt.Sprintf(`
+You are a data deduplication system. Your task is to match every entry of a list of new counterparties ('new_entries') against a list of existing counterparties ('existing_list') and against each other.
+
+**Matching Rules:**
+1.  **High-confidence identifiers:** A match in 'vat', 'registration_number', any IBAN or bank account number in 'accounts', 'website', or 'phone' is a very strong signal that it's the same entity. 'tax_code2' (e.g. Russian КПП) is shared by many companies and only confirms a match found by other fields.
+2.  **Name field:** The 'name' field is also important, but be aware of abbreviations, missing legal forms (like LLC, Inc.), or minor variations. The 'aliases' field lists other names already known for the same counterparty.
+    Compare countries by 'country_code' (ISO 3166-1 alpha-2), not by the 'country' spelling, which depends on the invoice language: different country codes are a strong signal against a match.
+3.  **Index is key:** The 'index' field is the unique temporary identifier of an entry within its list.
+4.  **Duplicates within the batch:** The same new supplier may appear several times in 'new_entries'. Link such entries to each other even when none of them is in 'existing_list'.
+
+**Your Task:**
+For every item of 'new_entries' return one object:
+- "new_index": the 'index' of the new entry.
+- "existing_index": the 'index' of the confidently matching item of 'existing_list', or -1 if there is none.
+- "same_as_new_index": the smallest 'index' of another item of 'new_entries' describing the same counterparty, or -1 if there is none.
+- "reason": a few words on why the entry matches the existing item (e.g. "VAT equal", "same IBAN, similar name"), or an empty string if "existing_index" is -1.
+
+**Input Data:**
+- existing_list: %s
+- new_entries: %s
+
+**Output Format:**
+Respond ONLY with a single, valid JSON object with the following structure:
+{
+  "matches": [
+    {"new_index": 0, "existing_index": 3, "same_as_new_index": -1, "reason": "VAT equal"},
+    {"new_index": 4, "existing_index": -1, "same_as_new_index": -1, "reason": ""},
+    {"new_index": 7, "existing_index": -1, "same_as_new_index": 4, "reason": ""}
+  ]
+}
+`, existingJSON, newJSON)
+}
@@ -0,0 +1,83 @@
+package invoice
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RoundingPolicy определяет правило округления при переводе сумм в минимальные единицы валюты.
+type RoundingPolicy string
+
+const (
+	RoundHalfUp   RoundingPolicy = "half-up"   // 0.5 округляется от нуля
+	RoundHalfEven RoundingPolicy = "half-even" // 0.5 округляется к четному (банковское округление)
+)
+
+// defaultMinorUnits — количество знаков после запятой для валют, не указанных в currencyMinorUnits.
+const defaultMinorUnits = 2
+
+// currencyMinorUnits содержит валюты ISO 4217, у которых число знаков после запятой отличается от 2.
+var currencyMinorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// ParseRoundingPolicy разбирает значение rounding_policy из конфига.
+// Пустая строка означает политику по умолчанию (half-up).
+func ParseRoundingPolicy(value string) (RoundingPolicy, error) {
+	switch RoundingPolicy(strings.ToLower(strings.TrimSpace(value))) {
+	case "", RoundHalfUp:
+		return RoundHalfUp, nil
+	case RoundHalfEven:
+		return RoundHalfEven, nil
+	default:
+		return "", fmt.Errorf("unknown rounding policy %q (expected %q or %q)", value, RoundHalfUp, RoundHalfEven)
+	}
+}
+
+// MinorUnits возвращает количество знаков после запятой для валюты.
+func MinorUnits(currency string) int {
+	if units, ok := currencyMinorUnits[strings.ToUpper(strings.TrimSpace(currency))]; ok {
+		return units
+	}
+	return defaultMinorUnits
+}
+
+// ToMinor переводит сумму в целое число минимальных единиц валюты (центы, филсы и т.п.).
+func ToMinor(amount float64, currency string, policy RoundingPolicy) int64 {
+	scaled := amount * math.Pow10(MinorUnits(currency))
+	// Убираем погрешность двоичного представления (1.005*100 = 100.49999...)
+	scaled = math.Round(scaled*1e6) / 1e6
+	if policy == RoundHalfEven {
+		return int64(math.RoundToEven(scaled))
+	}
+	return int64(math.Round(scaled))
+}
+
+// FromMinor переводит минимальные единицы валюты обратно в сумму.
+func FromMinor(minor int64, currency string) float64 {
+	return float64(minor) / math.Pow10(MinorUnits(currency))
+}
+
+// RoundAmount округляет сумму до точности валюты.
+func RoundAmount(amount float64, currency string, policy RoundingPolicy) float64 {
+	return FromMinor(ToMinor(amount, currency, policy), currency)
+}
+
+// FormatAmount форматирует сумму с числом знаков, принятым для валюты.
+func FormatAmount(amount float64, currency string) string {
+	return strconv.FormatFloat(amount, 'f', MinorUnits(currency), 64)
+}
+
+// NormalizeAmounts округляет все суммы инвойса до точности его валюты.
+func NormalizeAmounts(inv *Invoice, policy RoundingPolicy) {
+	inv.TotalAmount = RoundAmount(inv.TotalAmount, inv.Currency, policy)
+	inv.TaxAmount = RoundAmount(inv.TaxAmount, inv.Currency, policy)
+	for i := range inv.TaxBreakdown {
+		inv.TaxBreakdown[i].Base = RoundAmount(inv.TaxBreakdown[i].Base, inv.Currency, policy)
+		inv.TaxBreakdown[i].Amount = RoundAmount(inv.TaxBreakdown[i].Amount, inv.Currency, policy)
+	}
+}
@@ -0,0 +1,121 @@
+package invoice
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMinorUnits(t *testing.T) {
+	tests := map[string]int{"EUR": 2, "usd": 2, "JPY": 0, " krw ": 0, "KWD": 3, "BHD": 3, "": 2, "XXX": 2}
+	for currency, want := range tests {
+		if got := MinorUnits(currency); got != want {
+			t.Errorf("MinorUnits(%q) = %d, want %d", currency, got, want)
+		}
+	}
+}
+
+func TestToMinor(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		policy   RoundingPolicy
+		want     int64
+	}{
+		{1.005, "EUR", RoundHalfUp, 101}, // 1.005*100 = 100.49999... в двоичном представлении
+		{1.005, "EUR", RoundHalfEven, 100},
+		{1.015, "EUR", RoundHalfEven, 102},
+		{2.5, "JPY", RoundHalfUp, 3},
+		{2.5, "JPY", RoundHalfEven, 2},
+		{3.5, "JPY", RoundHalfEven, 4},
+		{-2.5, "JPY", RoundHalfUp, -3},
+		{1.2345, "KWD", RoundHalfUp, 1235},
+		{1.2345, "KWD", RoundHalfEven, 1234},
+		{0.1 + 0.2, "USD", RoundHalfUp, 30},
+	}
+	for _, tt := range tests {
+		if got := ToMinor(tt.amount, tt.currency, tt.policy); got != tt.want {
+			t.Errorf("ToMinor(%v, %s, %s) = %d, want %d", tt.amount, tt.currency, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{1234.5, "EUR", "1234.50"},
+		{1234.5, "JPY", "1234"},
+		{1.2345, "KWD", "1.234"},
+		{-0.1, "USD", "-0.10"},
+	}
+	for _, tt := range tests {
+		if got := FormatAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatAmount(%v, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestParseRoundingPolicy(t *testing.T) {
+	tests := map[string]RoundingPolicy{"": RoundHalfUp, "half-up": RoundHalfUp, " Half-Even ": RoundHalfEven}
+	for value, want := range tests {
+		got, err := ParseRoundingPolicy(value)
+		if err != nil || got != want {
+			t.Errorf("ParseRoundingPolicy(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseRoundingPolicy("bankers"); err == nil {
+		t.Error("ParseRoundingPolicy accepted an unknown policy")
+	}
+}
+
+func TestNormalizeAmounts(t *testing.T) {
+	inv := Invoice{Currency: "JPY", TotalAmount: 1100.4, TaxAmount: 100.5, TaxBreakdown: []TaxLine{{Rate: 10, Base: 999.9, Amount: 100.5}}}
+	NormalizeAmounts(&inv, RoundHalfEven)
+	if inv.TotalAmount != 1100 || inv.TaxAmount != 100 || inv.TaxBreakdown[0].Base != 1000 || inv.TaxBreakdown[0].Amount != 100 {
+		t.Errorf("NormalizeAmounts = %v %v %+v", inv.TotalAmount, inv.TaxAmount, inv.TaxBreakdown)
+	}
+}
+
+// TestVATSummaryDoesNotDrift складывает 10 000 случайных сумм и проверяет, что сводка НДС
+// совпадает с точной суммой в минимальных единицах: сложение float64 дало бы расхождение в копейках.
+func TestVATSummaryDoesNotDrift(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, currency := range []string{"EUR", "JPY", "KWD"} {
+		t.Run(currency, func(t *testing.T) {
+			scale := int64(1)
+			for range MinorUnits(currency) {
+				scale *= 10
+			}
+			var invoices []Invoice
+			var baseMinor, taxMinor int64
+			for i := range 10000 {
+				base, tax := rng.Int63n(1000*scale), rng.Int63n(200*scale)
+				baseMinor += base
+				taxMinor += tax
+				inv := Invoice{
+					Number:       fmt.Sprintf("INV-%d", i),
+					Currency:     currency,
+					TotalAmount:  FromMinor(base+tax, currency),
+					TaxAmount:    FromMinor(tax, currency),
+					TaxBreakdown: []TaxLine{{Rate: 20, Base: FromMinor(base, currency), Amount: FromMinor(tax, currency)}},
+					Counterparty: Counterparty{Name: "Supplier", CountryCode: "DE"},
+				}
+				invoices = append(invoices, inv)
+			}
+
+			summary := SummarizeVAT(invoices, Counterparty{CountryCode: "DE"}, time.Time{}, time.Time{}, RoundHalfUp)
+			if len(summary.Rows) != 1 {
+				t.Fatalf("SummarizeVAT rows = %+v, want one row", summary.Rows)
+			}
+			row := summary.Rows[0]
+			if ToMinor(row.Base, currency, RoundHalfUp) != baseMinor || ToMinor(row.Tax, currency, RoundHalfUp) != taxMinor {
+				t.Errorf("VAT base %s tax %s, want %s and %s", FormatAmount(row.Base, currency), FormatAmount(row.Tax, currency),
+					FormatAmount(FromMinor(baseMinor, currency), currency), FormatAmount(FromMinor(taxMinor, currency), currency))
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package invoice
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNetworkDisabled — ошибка исходящего запроса при запрещенной сети (allow_network: false).
+var ErrNetworkDisabled = errors.New("network disabled by configuration")
+
+// OfflineTransport — HTTP-транспорт, отклоняющий любой исходящий запрос с ErrNetworkDisabled.
+// Клиент OpenAI с этим транспортом гарантирует, что данные не покидают машину, даже если
+// какой-то путь обработки попытается обратиться к API.
+type OfflineTransport struct{}
+
+// RoundTrip отклоняет запрос, не открывая соединения.
+func (OfflineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, ErrNetworkDisabled // http.Client добавит к ошибке метод и URL
+}
+
+// NetworkAllowed сообщает, разрешены ли исходящие запросы (allow_network, по умолчанию true).
+func (c Config) NetworkAllowed() bool {
+	return c.AllowNetwork == nil || *c.AllowNetwork
+}
+
+// ValidateNetwork проверяет, что при запрещенной сети извлечение и сопоставление контрагентов
+// настроены локально: без сети работает только деградированный режим.
+func (c Config) ValidateNetwork() error {
+	if !c.NetworkAllowed() && !c.DegradedMode {
+		return errors.New("allow_network: false requires degraded_mode: true, extraction and matching through OpenAI need the network")
+	}
+	return nil
+}
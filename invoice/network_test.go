@@ -0,0 +1,111 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// countingTransport считает исходящие запросы и отклоняет каждый из них.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return OfflineTransport{}.RoundTrip(req)
+}
+
+// countingClient возвращает клиента OpenAI, все запросы которого проходят через transport.
+func countingClient(transport http.RoundTripper) *openai.Client {
+	config := openai.DefaultConfig("test-key")
+	config.HTTPClient = &http.Client{Transport: transport}
+	return openai.NewClientWithConfig(config)
+}
+
+func TestOfflineClientRejectsRequests(t *testing.T) {
+	disabled := false
+	config := Config{AllowNetwork: &disabled, DegradedMode: true}
+	if err := config.ValidateNetwork(); err != nil {
+		t.Fatalf("ValidateNetwork: %v", err)
+	}
+	client, err := NewClient(config.ClientConfig())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	_, err = client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: openai.GPT4o})
+	if !errors.Is(err, ErrNetworkDisabled) {
+		t.Errorf("CreateChatCompletion error = %v, want %v", err, ErrNetworkDisabled)
+	}
+}
+
+func TestValidateNetworkRequiresDegradedMode(t *testing.T) {
+	disabled := false
+	if err := (Config{AllowNetwork: &disabled}).ValidateNetwork(); err == nil {
+		t.Error("allow_network: false without degraded_mode passed validation")
+	}
+	if err := (Config{}).ValidateNetwork(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+}
+
+// TestDegradedPipelineMakesNoRequests прогоняет весь путь обработки пакета в деградированном режиме —
+// извлечение, дедупликацию и сопоставление контрагентов — и проверяет, что клиент не отправил ни одного запроса.
+func TestDegradedPipelineMakesNoRequests(t *testing.T) {
+	dir := t.TempDir()
+	texts := map[string]string{
+		"acme.pdf":  "ACME GmbH\nRechnung Nr. RE-2024-17\nDatum: 12.03.2024\nNetto 100,00 EUR\nMwSt 19,00 EUR\nGesamtbetrag 119,00 EUR\nIBAN DE89 3704 0044 0532 0130 00",
+		"acme2.pdf": "ACME GmbH\nRechnung Nr. RE-2024-18\nDatum: 14.03.2024\nGesamtbetrag 238,00 EUR\nIBAN DE89 3704 0044 0532 0130 00",
+		"other.pdf": "Globex Ltd\nInvoice No INV-5\nDate: 2024-03-20\nTotal 50.00 GBP",
+	}
+	var paths []string
+	for name := range texts {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("%PDF-1.4"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	transport := &countingTransport{}
+	processor := NewProcessor(countingClient(transport),
+		WithDegradedMode(true, 0),
+		WithTextExtractor(func(_ context.Context, pdfPath string) ([]string, error) {
+			return []string{texts[filepath.Base(pdfPath)]}, nil
+		}),
+		WithPageRenderer(func(context.Context, string) ([][]byte, error) {
+			return nil, errors.New("pages must not be rendered in degraded mode")
+		}),
+	)
+
+	var results []Result
+	for fr := range processor.ProcessBatch(context.Background(), paths) {
+		if fr.Err != nil {
+			t.Fatalf("%s: %v", fr.Path, fr.Err)
+		}
+		for _, inv := range fr.Invoices {
+			if inv.Extraction != ExtractionLocal {
+				t.Errorf("%s: Extraction = %q, want %q", fr.Path, inv.Extraction, ExtractionLocal)
+			}
+		}
+		results = append(results, FileResults(filepath.Base(fr.Path), fr.Invoices, fr.Usage, fr.Err)...)
+	}
+	registry := NewCounterpartyRegistry([]Counterparty{{Name: "Globex Ltd"}}, true)
+	dedup := processor.Deduplicate(context.Background(), results, registry)
+
+	if n := transport.requests.Load(); n != 0 {
+		t.Errorf("degraded pipeline sent %d requests, want none", n)
+	}
+	if dedup.Successful != len(texts) || dedup.Failed != 0 {
+		t.Errorf("Deduplicate: %d successful, %d failed, want %d and 0", dedup.Successful, dedup.Failed, len(texts))
+	}
+	if len(dedup.Warnings) > 0 {
+		t.Errorf("Deduplicate warnings: %v", dedup.Warnings)
+	}
+}
@@ -0,0 +1,239 @@
+package invoice
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// orientation — ориентация страницы по локальной оценке.
+type orientation int
+
+const (
+	orientationUnknown orientation = iota // Оценка неоднозначна (мало текста, таблицы, изображения)
+	orientationUpright
+	orientationFlipped // Страница перевернута на 180°
+)
+
+// orientationThreshold — минимальный перевес выносных элементов над или под строками
+// (доля от их суммы), при котором ориентация считается определенной.
+const orientationThreshold = 0.15
+
+// orientationResponse — ответ модели при проверке ориентации страницы.
+type orientationResponse struct {
+	UpsideDown bool `json:"upside_down"`
+}
+
+// detectOrientation локально оценивает, перевернута ли страница на 180°, по строкам текста.
+// В латинице и кириллице верхних выносных элементов (заглавные, b, d, f, h, k, l, t, й) больше,
+// чем нижних (g, p, q, y, у), поэтому у нормальной строки над основной полосой (высотой
+// строчных букв) больше «чернил», чем под ней; у перевернутой — наоборот.
+func detectOrientation(imageData []byte) (orientation, error) {
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return orientationUnknown, fmt.Errorf("failed to decode page image: %w", err)
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return orientationUnknown, nil
+	}
+
+	// 1. Горизонтальная проекция: число темных пикселей в строке (каждый второй столбец)
+	sampled := (width + 1) / 2
+	rowInk := make([]int, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x += 2 {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			if (299*r+587*g+114*b)/1000 < 0x8000 {
+				rowInk[y]++
+			}
+		}
+		// Линии таблиц и рамки не относятся к тексту
+		if rowInk[y] > sampled/2 {
+			rowInk[y] = 0
+		}
+	}
+
+	// 2. Строки текста — непрерывные полосы с «чернилами»
+	minInk := max(1, sampled/200)
+	var above, below int
+	for y := 0; y < height; {
+		if rowInk[y] < minInk {
+			y++
+			continue
+		}
+		top := y
+		for y < height && rowInk[y] >= minInk {
+			y++
+		}
+		lineAbove, lineBelow := lineAscenders(rowInk[top:y])
+		above += lineAbove
+		below += lineBelow
+	}
+
+	// 3. Перевес выносных элементов над или под основной полосой
+	total := above + below
+	if total == 0 {
+		return orientationUnknown, nil
+	}
+	score := float64(above-below) / float64(total)
+	switch {
+	case score > orientationThreshold:
+		return orientationUpright, nil
+	case score < -orientationThreshold:
+		return orientationFlipped, nil
+	}
+	return orientationUnknown, nil
+}
+
+// lineAscenders возвращает «чернила» над и под основной полосой строки текста.
+// Основная полоса — ряды с плотностью не меньше половины максимальной. Слишком низкие
+// и слишком высокие полосы (шум, логотипы, изображения) не учитываются.
+func lineAscenders(rows []int) (int, int) {
+	if len(rows) < 6 || len(rows) > 120 {
+		return 0, 0
+	}
+	peak := 0
+	for _, ink := range rows {
+		peak = max(peak, ink)
+	}
+	coreTop, coreBottom := -1, -1
+	for i, ink := range rows {
+		if ink*2 >= peak {
+			if coreTop < 0 {
+				coreTop = i
+			}
+			coreBottom = i
+		}
+	}
+	var above, below int
+	for i, ink := range rows {
+		switch {
+		case i < coreTop:
+			above += ink
+		case i > coreBottom:
+			below += ink
+		}
+	}
+	return above, below
+}
+
+// fixDuplexRotation находит дуплексный скан без автоповорота, в котором каждая вторая страница
+// (2, 4, 6...) перевернута, и поворачивает эти страницы на 180° целиком, без проверки каждой страницы моделью.
+// Сначала используется локальная оценка; модель проверяет одну страницу, только если оценка
+// неоднозначна. Возвращает изображения и номера повернутых страниц (с 1).
+func (p *Processor) fixDuplexRotation(ctx context.Context, images [][]byte, usage *Usage) ([][]byte, []int) {
+	if len(images) < 2 {
+		return images, nil
+	}
+	var flipped, unknown []int // Индексы четных страниц
+	for i, img := range images {
+		o, err := detectOrientation(img)
+		if err != nil {
+			p.log(ctx).Warn("Could not detect page orientation", LogKeyStage, PhaseOrientation, "page", i+1, "error", err)
+		}
+		even := i%2 == 1
+		switch {
+		case even && o == orientationFlipped:
+			flipped = append(flipped, i)
+		case even && o == orientationUnknown:
+			unknown = append(unknown, i)
+		case o != orientationUnknown && (even || o == orientationFlipped):
+			// Нормальная четная или перевернутая нечетная страница: это не дуплексный скан
+			return images, nil
+		}
+	}
+	evenPages := len(images) / 2
+	switch {
+	case len(flipped) == 0:
+		return images, nil
+	case len(flipped) < 2 || len(flipped) < evenPages:
+		// Перевернута единственная четная страница или часть страниц не распознана: спрашиваем модель
+		check := flipped[0]
+		if len(unknown) > 0 {
+			check = unknown[0]
+		}
+		upsideDown, err := p.isUpsideDown(ctx, images[check], usage)
+		if err != nil {
+			p.log(ctx).Warn("Could not check page orientation", LogKeyStage, PhaseOrientation, "page", check+1, "error", err)
+			return images, nil
+		}
+		if !upsideDown {
+			return images, nil
+		}
+	}
+
+	rotated := make([][]byte, len(images))
+	copy(rotated, images)
+	var pages []int
+	for i := 1; i < len(images); i += 2 {
+		data, err := rotate180(images[i])
+		if err != nil {
+			p.log(ctx).Warn("Could not rotate page", LogKeyStage, PhaseOrientation, "page", i+1, "error", err)
+			return images, nil
+		}
+		rotated[i] = data
+		pages = append(pages, i+1)
+	}
+	p.log(ctx).Info("Duplex scan detected: every second page is upside down", LogKeyStage, PhaseOrientation, "rotated_pages", pages)
+	return rotated, pages
+}
+
+// isUpsideDown спрашивает модель, перевернута ли страница на 180°.
+func (p *Processor) isUpsideDown(ctx context.Context, imageData []byte, usage *Usage) (bool, error) {
+	imageURL := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(imageData), base64.StdEncoding.EncodeToString(imageData))
+	resp, err := p.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: p.model,
+		Messages: []openai.ChatCompletionMessage{{
+			Role: openai.ChatMessageRoleUser,
+			MultiContent: []openai.ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeText, Text: `Is the text on this scanned page upside down (rotated by 180 degrees)? Respond ONLY with JSON: {"upside_down": true} or {"upside_down": false}.`},
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: imageURL, Detail: openai.ImageURLDetailLow}},
+			},
+		}},
+		ResponseFormat: responseFormat(p.model, "orientation", orientationSchema),
+	})
+	if err != nil {
+		return false, fmt.Errorf("orientation request to OpenAI failed: %w", err)
+	}
+	usage.record(p.model, resp.Usage)
+	if len(resp.Choices) == 0 {
+		return false, fmt.Errorf("OpenAI returned no choices for orientation check")
+	}
+	var result orientationResponse
+	if err := json.Unmarshal([]byte(resp.Choices[0].Message.Content), &result); err != nil {
+		return false, fmt.Errorf("failed to unmarshal orientation response: %w", err)
+	}
+	return result.UpsideDown, nil
+}
+
+// rotate180 поворачивает изображение страницы на 180°, сохраняя формат (PNG или JPEG).
+func rotate180(imageData []byte) ([]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode page image: %w", err)
+	}
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			dst.Set(bounds.Max.X-1-x, bounds.Max.Y-1-y, src.At(x, y))
+		}
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,110 @@
+package invoice
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// duplexPages возвращает страницы testdata/duplex-6-pages.tiff: дуплексный скан счета без автоповорота,
+// в котором страницы 2, 4 и 6 перевернуты на 180°.
+func duplexPages(t *testing.T) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "duplex-6-pages.tiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, err := tiffToImages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 6 {
+		t.Fatalf("the fixture has %d pages, want 6", len(pages))
+	}
+	return pages
+}
+
+// noModel — ChatClient, который проваливает тест: локальной оценки должно хватить.
+func noModel(t *testing.T) chatFunc {
+	return func(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		t.Error("the model was asked although the local estimate is unambiguous")
+		return chatResponse(`{"upside_down": false}`), nil
+	}
+}
+
+func TestDetectOrientation(t *testing.T) {
+	for i, page := range duplexPages(t) {
+		want := orientationUpright
+		if i%2 == 1 {
+			want = orientationFlipped
+		}
+		if got, err := detectOrientation(page); err != nil || got != want {
+			t.Errorf("page %d: orientation %d, %v, want %d", i+1, got, err, want)
+		}
+	}
+
+	var blank bytes.Buffer
+	png.Encode(&blank, image.NewGray(image.Rect(0, 0, 100, 140))) // Черная страница без строк текста
+	if got, err := detectOrientation(blank.Bytes()); err != nil || got != orientationUnknown {
+		t.Errorf("blank page: orientation %d, %v, want unknown", got, err)
+	}
+	if _, err := detectOrientation([]byte("not an image")); err == nil {
+		t.Error("detectOrientation accepted data that is not an image")
+	}
+}
+
+func TestFixDuplexRotation(t *testing.T) {
+	pages := duplexPages(t)
+	p := NewProcessor(noModel(t), quiet())
+
+	fixed, rotated := p.fixDuplexRotation(context.Background(), pages, &Usage{})
+	if !slices.Equal(rotated, []int{2, 4, 6}) {
+		t.Fatalf("rotated pages %v, want [2 4 6]", rotated)
+	}
+	for i, page := range fixed {
+		if o, _ := detectOrientation(page); o != orientationUpright {
+			t.Errorf("page %d after the fix: orientation %d, want upright", i+1, o)
+		}
+	}
+
+	// Исправленный скан больше не поворачивается
+	if _, again := p.fixDuplexRotation(context.Background(), fixed, &Usage{}); again != nil {
+		t.Errorf("upright pages rotated again: %v", again)
+	}
+	// Перевернутая нечетная страница: это не дуплексный скан
+	odd := slices.Clone(pages)
+	odd[0] = pages[1]
+	if _, got := p.fixDuplexRotation(context.Background(), odd, &Usage{}); got != nil {
+		t.Errorf("a scan with a flipped odd page rotated pages %v", got)
+	}
+}
+
+// TestFixDuplexRotationAsksModel проверяет, что при единственной перевернутой четной странице решение
+// принимает модель.
+func TestFixDuplexRotationAsksModel(t *testing.T) {
+	pages := duplexPages(t)[:3]
+	for _, upsideDown := range []bool{true, false} {
+		asked := 0
+		client := chatFunc(func(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+			asked++
+			if upsideDown {
+				return chatResponse(`{"upside_down": true}`), nil
+			}
+			return chatResponse(`{"upside_down": false}`), nil
+		})
+		_, rotated := NewProcessor(client, quiet()).fixDuplexRotation(context.Background(), pages, &Usage{})
+		if asked != 1 {
+			t.Errorf("model asked %d times, want once", asked)
+		}
+		if (rotated != nil) != upsideDown {
+			t.Errorf("model answered upside_down %v: rotated pages %v", upsideDown, rotated)
+		}
+	}
+}
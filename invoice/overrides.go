@@ -0,0 +1,139 @@
+package invoice
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CounterpartyAlias — правило counterparty_aliases: контрагент с фиксированным ID, к которому
+// контрагент инвойса приводится по наименованию или VAT без запроса к модели. Достаточно одного
+// совпадения: VAT целиком, подстроки наименования или регулярного выражения (все без учета регистра).
+type CounterpartyAlias struct {
+	ID       uint64   `json:"id"`
+	Name     string   `json:"name"`               // Каноническое наименование в отчетах и базе контрагентов
+	VAT      []string `json:"vat,omitempty"`      // Налоговые номера; пробелы и знаки препинания не учитываются
+	Names    []string `json:"names,omitempty"`    // Подстроки наименования
+	Patterns []string `json:"patterns,omitempty"` // Регулярные выражения RE2 по наименованию
+}
+
+// AliasOverrides — проверенные правила counterparty_aliases (см. NewAliasOverrides, WithAliasOverrides).
+type AliasOverrides struct {
+	rules []aliasRule
+}
+
+type aliasRule struct {
+	CounterpartyAlias
+	patterns []*regexp.Regexp
+}
+
+// NewAliasOverrides проверяет правила и компилирует их регулярные выражения. У каждого правила должны
+// быть ненулевой уникальный ID, наименование и хотя бы одно условие. Без правил возвращает nil.
+func NewAliasOverrides(aliases []CounterpartyAlias) (*AliasOverrides, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	overrides := &AliasOverrides{}
+	seen := make(map[uint64]bool, len(aliases))
+	for i, alias := range aliases {
+		switch {
+		case alias.ID == 0:
+			return nil, fmt.Errorf("alias %d has no id", i+1)
+		case seen[alias.ID]:
+			return nil, fmt.Errorf("duplicate alias id %d", alias.ID)
+		case strings.TrimSpace(alias.Name) == "":
+			return nil, fmt.Errorf("alias %d has no name", alias.ID)
+		case len(alias.VAT) == 0 && len(alias.Names) == 0 && len(alias.Patterns) == 0:
+			return nil, fmt.Errorf("alias %d (%s) has no vat, names or patterns", alias.ID, alias.Name)
+		}
+		seen[alias.ID] = true
+		rule := aliasRule{CounterpartyAlias: alias}
+		for _, vat := range alias.VAT {
+			if simplifyIdentifier(vat) == "" {
+				return nil, fmt.Errorf("alias %d (%s) has an empty vat", alias.ID, alias.Name)
+			}
+		}
+		for _, name := range alias.Names {
+			if strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("alias %d (%s) has an empty name pattern", alias.ID, alias.Name)
+			}
+		}
+		for _, pattern := range alias.Patterns {
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return nil, fmt.Errorf("alias %d (%s) has an invalid pattern %q: %w", alias.ID, alias.Name, pattern, err)
+			}
+			rule.patterns = append(rule.patterns, re)
+		}
+		overrides.rules = append(overrides.rules, rule)
+	}
+	return overrides, nil
+}
+
+// match возвращает первое правило, под которое подходит контрагент, и описание совпадения
+// для объяснения сопоставления ("alias: VAT RS100002803").
+func (o *AliasOverrides) match(cp Counterparty) (*CounterpartyAlias, string, bool) {
+	if o == nil {
+		return nil, "", false
+	}
+	name := normalizeName(cp.Name)
+	for i := range o.rules {
+		rule := &o.rules[i]
+		for _, vat := range rule.VAT {
+			if cp.HasVAT(vat) {
+				return &rule.CounterpartyAlias, "alias: VAT " + vat, true
+			}
+		}
+		if name == "" {
+			continue
+		}
+		for _, part := range rule.Names {
+			if strings.Contains(name, normalizeName(part)) {
+				return &rule.CounterpartyAlias, fmt.Sprintf("alias: name contains %q", part), true
+			}
+		}
+		for j, re := range rule.patterns {
+			if re.MatchString(cp.Name) {
+				return &rule.CounterpartyAlias, fmt.Sprintf("alias: name matches %q", rule.Patterns[j]), true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// Counterparty возвращает контрагента правила для реестра.
+func (a CounterpartyAlias) Counterparty() Counterparty {
+	return Counterparty{ID: a.ID, Name: strings.TrimSpace(a.Name)}
+}
+
+// WithAliasOverrides задает правила counterparty_aliases: Deduplicate приводит подходящих под них
+// контрагентов к контрагенту правила до сопоставления моделью и не отправляет их в OpenAI.
+func WithAliasOverrides(overrides *AliasOverrides) Option {
+	return func(p *Processor) { p.aliasOverrides = overrides }
+}
+
+// reserveAliasIDs сдвигает следующий ID реестра за ID правил, чтобы новый контрагент не получил ID правила,
+// под которое в этом пакете еще никто не подошел.
+func (r *CounterpartyRegistry) reserveAliasIDs(overrides *AliasOverrides) {
+	if overrides == nil {
+		return
+	}
+	for _, rule := range overrides.rules {
+		if rule.ID >= r.nextID {
+			r.nextID = rule.ID + 1
+		}
+	}
+}
+
+// resolveAlias приводит cp к контрагенту правила alias: дополняет контрагента реестра с ID правила
+// или добавляет его. Возвращает индекс в реестре и true, если контрагент добавлен.
+func (r *CounterpartyRegistry) resolveAlias(alias *CounterpartyAlias, cp Counterparty) (int, bool) {
+	for i, existing := range r.Counterparties {
+		if existing.ID == alias.ID {
+			r.Counterparties[i] = MergeCounterparties(existing, cp)
+			return i, false
+		}
+	}
+	r.Counterparties = append(r.Counterparties, MergeCounterparties(alias.Counterparty(), cp))
+	return len(r.Counterparties) - 1, true
+}
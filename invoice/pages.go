@@ -0,0 +1,73 @@
+package invoice
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxAllPages — лимит страниц одного инвойса при стратегии "all".
+const DefaultMaxAllPages = 12
+
+// PageSelection определяет, какие страницы инвойса отправляются на детальный анализ.
+// Каждая страница отправляется модели изображением, поэтому больше страниц — больше токенов.
+type PageSelection struct {
+	All   bool // Все страницы (с ограничением MaxAllPages)
+	First int  // Количество первых страниц
+	Last  int  // Количество последних страниц
+}
+
+// DefaultPageSelection — две первые и две последние страницы.
+var DefaultPageSelection = PageSelection{First: 2, Last: 2}
+
+// ParsePageSelection разбирает page_selection из конфига: "all", "first_last" или "first_N:last_M".
+// Пустая строка означает first_last.
+func ParsePageSelection(value string) (PageSelection, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", "first_last":
+		return DefaultPageSelection, nil
+	case "all":
+		return PageSelection{All: true}, nil
+	}
+
+	first, last, ok := strings.Cut(value, ":")
+	if ok && strings.HasPrefix(first, "first_") && strings.HasPrefix(last, "last_") {
+		n, errN := strconv.Atoi(strings.TrimPrefix(first, "first_"))
+		m, errM := strconv.Atoi(strings.TrimPrefix(last, "last_"))
+		if errN == nil && errM == nil && n >= 0 && m >= 0 && n+m > 0 {
+			return PageSelection{First: n, Last: m}, nil
+		}
+	}
+	return PageSelection{}, fmt.Errorf("unknown page selection %q (expected all, first_last or first_N:last_M)", value)
+}
+
+// String возвращает стратегию в формате конфига.
+func (s PageSelection) String() string {
+	if s.All {
+		return "all"
+	}
+	return fmt.Sprintf("first_%d:last_%d", s.First, s.Last)
+}
+
+// selectPages выбирает номера страниц группы для анализа.
+// При стратегии "all" группа длиннее maxAllPages страниц — ошибка, чтобы не обрезать инвойс молча;
+// maxAllPages <= 0 лимита не задает (Processor всегда получает положительный лимит, см. WithMaxAllPages).
+func (s PageSelection) selectPages(pageIndices []int, maxAllPages int) ([]int, error) {
+	sort.Ints(pageIndices)
+	if s.All {
+		if maxAllPages > 0 && len(pageIndices) > maxAllPages {
+			return nil, fmt.Errorf("invoice has %d pages, more than max_all_pages (%d) allowed for page selection \"all\"; "+
+				"every page is sent to the model as an image, so raise the limit only if the token cost is acceptable, or use first_N:last_M",
+				len(pageIndices), maxAllPages)
+		}
+		return pageIndices, nil
+	}
+	if len(pageIndices) <= s.First+s.Last {
+		return pageIndices, nil
+	}
+
+	result := append([]int{}, pageIndices[:s.First]...)
+	return append(result, pageIndices[len(pageIndices)-s.Last:]...), nil
+}
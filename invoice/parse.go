@@ -0,0 +1,184 @@
+package invoice
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// monthPrefixes — начала названий месяцев (английские, немецкие, русские в любом падеже).
+var monthPrefixes = []struct {
+	prefix string
+	month  time.Month
+}{
+	{"jan", time.January}, {"jän", time.January}, {"янв", time.January},
+	{"feb", time.February}, {"фев", time.February},
+	{"mar", time.March}, {"mär", time.March}, {"mae", time.March}, {"мар", time.March},
+	{"apr", time.April}, {"апр", time.April},
+	{"may", time.May}, {"mai", time.May}, {"май", time.May}, {"мая", time.May},
+	{"jun", time.June}, {"июн", time.June},
+	{"jul", time.July}, {"июл", time.July},
+	{"aug", time.August}, {"авг", time.August},
+	{"sep", time.September}, {"сен", time.September},
+	{"oct", time.October}, {"okt", time.October}, {"окт", time.October},
+	{"nov", time.November}, {"ноя", time.November},
+	{"dec", time.December}, {"dez", time.December}, {"дек", time.December},
+}
+
+// parseMonth возвращает месяц по названию или 0, если слово не название месяца.
+func parseMonth(word string) time.Month {
+	if utf8.RuneCountInString(word) < 3 {
+		return 0
+	}
+	for _, m := range monthPrefixes {
+		if strings.HasPrefix(word, m.prefix) {
+			return m.month
+		}
+	}
+	return 0
+}
+
+// dateTimeSuffix — время после даты ("2023-10-27T10:00:00Z", "27.10.2023 10:00").
+var dateTimeSuffix = regexp.MustCompile(`(?i)(t|\s)\d{1,2}:\d{2}.*$`)
+
+// NormalizeDate разбирает дату в одном из распространенных форматов ("27.10.2023", "10/27/23",
+// "27 октября 2023 г.", "Oct 27, 2023", "27. Oktober 2023", "20231027") и возвращает ее в виде YYYY-MM-DD.
+// Двузначный год относится к 2000-м (от 70 — к 1900-м). Для числовых дат, в которых и день, и месяц
+// не больше 12 (01/02/2023), dayFirst задает порядок, а ambiguous = true.
+func NormalizeDate(value string, dayFirst bool) (date string, ambiguous bool, err error) {
+	text := dateTimeSuffix.ReplaceAllString(strings.ToLower(strings.TrimSpace(value)), "")
+
+	// Разбиваем на числа и слова; "27th" дает "27" и "th"
+	var numbers []string
+	var month time.Month
+	fields := strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	for _, field := range fields {
+		for _, token := range splitDigits(field) {
+			if unicode.IsDigit([]rune(token)[0]) {
+				numbers = append(numbers, token)
+			} else if m := parseMonth(token); m != 0 && month == 0 {
+				month = m
+			}
+		}
+	}
+
+	var year, monthNum, day int
+	switch {
+	case month != 0 && len(numbers) == 2:
+		// "27 октября 2023", "October 27, 2023", "2023 Oct 27"
+		monthNum = int(month)
+		if len(numbers[0]) == 4 {
+			year, day = atoi(numbers[0]), atoi(numbers[1])
+		} else if len(numbers[1]) == 4 || len(numbers[1]) == 2 {
+			day, year = atoi(numbers[0]), atoi(numbers[1])
+		}
+	case month == 0 && len(numbers) == 1 && len(numbers[0]) == 8:
+		// 20231027
+		year, monthNum, day = atoi(numbers[0][:4]), atoi(numbers[0][4:6]), atoi(numbers[0][6:])
+	case month == 0 && len(numbers) == 3 && len(numbers[0]) == 4:
+		// 2023-10-27, 2023/10/27
+		year, monthNum, day = atoi(numbers[0]), atoi(numbers[1]), atoi(numbers[2])
+	case month == 0 && len(numbers) == 3 && (len(numbers[2]) == 4 || len(numbers[2]) == 2):
+		a, b := atoi(numbers[0]), atoi(numbers[1])
+		year = atoi(numbers[2])
+		switch {
+		case a > 12:
+			day, monthNum = a, b
+		case b > 12:
+			monthNum, day = a, b
+		default:
+			ambiguous = a != b
+			if dayFirst {
+				day, monthNum = a, b
+			} else {
+				monthNum, day = a, b
+			}
+		}
+	}
+	if year > 0 && year < 100 {
+		if year < 70 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	}
+
+	t := time.Date(year, time.Month(monthNum), day, 0, 0, 0, 0, time.UTC)
+	if year < 1900 || t.Day() != day || int(t.Month()) != monthNum {
+		return "", false, fmt.Errorf("unrecognized date %q", value)
+	}
+	return t.Format("2006-01-02"), ambiguous, nil
+}
+
+// splitDigits разбивает слово на последовательности цифр и букв.
+func splitDigits(field string) []string {
+	var tokens []string
+	start := 0
+	runes := []rune(field)
+	for i := 1; i <= len(runes); i++ {
+		if i == len(runes) || unicode.IsDigit(runes[i]) != unicode.IsDigit(runes[i-1]) {
+			tokens = append(tokens, string(runes[start:i]))
+			start = i
+		}
+	}
+	return tokens
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// ParseDate разбирает дату в одном из распространенных форматов и возвращает ее в виде YYYY-MM-DD.
+// Неоднозначная числовая дата (01/02/2023) трактуется как DD/MM/YYYY.
+func ParseDate(value string) (string, error) {
+	date, _, err := NormalizeDate(value, true)
+	return date, err
+}
+
+// ParseAmount разбирает сумму, допуская пробелы и апострофы между разрядами, символы валют
+// и запятую как десятичный разделитель ("1 234,56", "1,234.56", "€1.234,56").
+func ParseAmount(value string) (float64, error) {
+	var b strings.Builder
+	for _, r := range value {
+		switch {
+		case unicode.IsDigit(r), r == '.', r == ',', r == '-':
+			b.WriteRune(r)
+		case unicode.IsSpace(r), r == '\'', unicode.Is(unicode.Sc, r), unicode.IsLetter(r):
+			// Разделители разрядов, символы и коды валют
+		default:
+			return 0, fmt.Errorf("unrecognized amount %q", value)
+		}
+	}
+	s := b.String()
+	if s == "" {
+		return 0, fmt.Errorf("empty amount %q", value)
+	}
+
+	// Если есть и точки, и запятые, десятичный разделитель — последний из них. Повторяющийся символ —
+	// разделитель разрядов. Единственная запятая с тремя цифрами после нее ("1,234") — тоже.
+	dots, commas := strings.Count(s, "."), strings.Count(s, ",")
+	switch {
+	case dots > 0 && commas > 0:
+		if strings.LastIndex(s, ",") > strings.LastIndex(s, ".") {
+			s = strings.ReplaceAll(strings.ReplaceAll(s, ".", ""), ",", ".")
+		} else {
+			s = strings.ReplaceAll(s, ",", "")
+		}
+	case commas > 1 || (commas == 1 && len(s)-strings.Index(s, ",")-1 == 3):
+		s = strings.ReplaceAll(s, ",", "")
+	case commas == 1:
+		s = strings.Replace(s, ",", ".", 1)
+	case dots > 1:
+		s = strings.ReplaceAll(s, ".", "")
+	}
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unrecognized amount %q", value)
+	}
+	return amount, nil
+}
@@ -0,0 +1,45 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	_ "github.com/jdeng/goheif" // Регистрируем декодер HEIC/HEIF для image.Decode
+	_ "golang.org/x/image/webp" // Регистрируем декодер WebP для image.Decode
+)
+
+// SupportedExtensions — расширения файлов, которые принимает ProcessFile.
+var SupportedExtensions = []string{".pdf", ".png", ".jpg", ".jpeg", ".heic", ".heif", ".webp", ".tif", ".tiff"}
+
+// photoExtensions — форматы фотографий, которые OpenAI не принимает напрямую; перед отправкой
+// они перекодируются в JPEG.
+var photoExtensions = []string{".heic", ".heif", ".webp"}
+
+// IsSupportedFile сообщает, может ли ProcessFile обработать файл с таким расширением.
+func IsSupportedFile(path string) bool {
+	return slices.Contains(SupportedExtensions, strings.ToLower(filepath.Ext(path)))
+}
+
+// photoToJPEG декодирует фотографию HEIC/HEIF или WebP и перекодирует ее в JPEG.
+func photoToJPEG(content []byte) (data []byte, err error) {
+	// Сторонние декодеры могут паниковать на поврежденных файлах: это ошибка файла, а не всего пакета
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("failed to decode photo: %v", r)
+		}
+	}()
+	img, format, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode photo: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, fmt.Errorf("failed to encode %s photo as JPEG: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,606 @@
+package invoice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// PageRenderer конвертирует PDF-файл в изображения страниц (по одному на страницу).
+type PageRenderer func(ctx context.Context, pdfPath string) ([][]byte, error)
+
+// PopplerRenderer возвращает PageRenderer на основе утилиты pdftoppm (см. пакет pdfimg).
+// popplerBinPath может быть пустым, тогда pdftoppm ищется в PATH.
+func PopplerRenderer(popplerBinPath string) PageRenderer {
+	return PDFRenderer(pdfimg.Options{PopplerPath: popplerBinPath})
+}
+
+// PDFRenderer возвращает PageRenderer на основе pdfimg с произвольными настройками (DPI, формат, таймаут).
+func PDFRenderer(opts pdfimg.Options) PageRenderer {
+	return func(ctx context.Context, pdfPath string) ([][]byte, error) {
+		return pdfimg.Render(ctx, pdfPath, opts)
+	}
+}
+
+// Processor выполняет анализ инвойсов с заданными настройками.
+// Создается через NewProcessor; безопасен для одновременного использования из нескольких горутин.
+type Processor struct {
+	client              ChatClient
+	model               string
+	pageSelection       PageSelection
+	maxAllPages         int
+	concurrency         int
+	adaptive            bool // Адаптивный параллелизм в границах minConcurrency..maxConcurrency
+	minConcurrency      int
+	maxConcurrency      int
+	renderer            PageRenderer
+	logger              *slog.Logger
+	myCompany           Counterparty
+	roundingPolicy      RoundingPolicy
+	thumbnailSize       int
+	cache               *ResultCache
+	duplexRotation      bool
+	textExtractor       TextExtractor
+	extractionMode      ExtractionMode      // Анализ PDF по изображениям страниц или по текстовому слою
+	categories          []Category          // Категории расходов для Invoice.Category; пусто — без категорий
+	attachmentExtractor AttachmentExtractor // Поиск XML ZUGFeRD/Factur-X во вложениях PDF; nil — не искать
+	degradedForced      bool                // Все файлы обрабатываются локально (WithDegradedMode)
+	degradedAfter       int                 // Число ошибок недоступности OpenAI подряд до перехода в деградированный режим; 0 — не переходить
+	degradedActive      atomic.Bool
+	throttled           throttleStats // Запросы, придержанные ограничителем
+	apiFailures         atomic.Int32
+	currencyAutoCorrect bool
+	tracing             bool
+	repairAttempts      int              // Попытки исправить неразбираемый JSON-ответ модели
+	promptTemplates     *PromptTemplates // Внешние шаблоны промптов; nil — встроенные промпты
+	aliasOverrides      *AliasOverrides  // Правила counterparty_aliases; nil — без правил
+	limiter             RequestLimiter   // Ограничитель запросов к модели; nil — без ограничения
+	requestTimeout      time.Duration    // Ограничение времени одного запроса к модели; 0 — без ограничения
+	fileTimeout         time.Duration    // Ограничение времени обработки файла; 0 — без ограничения
+
+	invoiceSchema func() (*jsonschema.Definition, error) // Схема ответа детального анализа (с category при WithCategories)
+}
+
+// Option настраивает Processor.
+type Option func(*Processor)
+
+// WithModel задает модель OpenAI (по умолчанию gpt-4o).
+func WithModel(model string) Option {
+	return func(p *Processor) { p.model = model }
+}
+
+// WithMaxPages задает максимальное число страниц одного инвойса для детального анализа
+// (по умолчанию 4: две первые и две последние). 0 — все страницы, но не больше лимита
+// WithMaxAllPages (по умолчанию 12), а не без ограничения.
+func WithMaxPages(n int) Option {
+	return func(p *Processor) {
+		if n <= 0 {
+			p.pageSelection = PageSelection{All: true}
+		} else {
+			p.pageSelection = PageSelection{First: (n + 1) / 2, Last: n / 2}
+		}
+	}
+}
+
+// WithPageSelection задает стратегию выбора страниц инвойса для детального анализа.
+func WithPageSelection(selection PageSelection) Option {
+	return func(p *Processor) { p.pageSelection = selection }
+}
+
+// WithMaxAllPages ограничивает число страниц инвойса при стратегии "all" (по умолчанию 12).
+// Инвойс с большим числом страниц не обрезается молча, а попадает в результат ошибкой (Invoice.Err);
+// остальные инвойсы файла извлекаются. 0 — лимит по умолчанию (DefaultMaxAllPages), а не отсутствие лимита.
+func WithMaxAllPages(n int) Option {
+	return func(p *Processor) {
+		if n <= 0 {
+			n = DefaultMaxAllPages
+		}
+		p.maxAllPages = n
+	}
+}
+
+// WithConcurrency ограничивает количество одновременно обрабатываемых файлов в ProcessBatch.
+// 0 — все файлы обрабатываются параллельно.
+func WithConcurrency(n int) Option {
+	return func(p *Processor) { p.concurrency = n }
+}
+
+// WithRateLimiter ограничивает частоту запросов процессора к модели: извлечения, проверки ориентации,
+// исправления JSON и сопоставления контрагентов (см. RateLimitedClient). Один ограничитель можно
+// передать нескольким процессорам, чтобы у них был общий лимит.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	if limiter == nil {
+		return func(*Processor) {}
+	}
+	return WithRequestLimiter(limiter)
+}
+
+// WithRequestLimiter — WithRateLimiter с произвольной реализацией ограничителя. Запросы, которые
+// ограничитель придержал, учитываются в Processor.Throttled.
+func WithRequestLimiter(limiter RequestLimiter) Option {
+	return func(p *Processor) { p.limiter = limiter }
+}
+
+// WithAdaptiveConcurrency включает адаптивный параллелизм в ProcessBatch: обработка начинается
+// с WithConcurrency (или maxConcurrency, если он не задан), при ошибках 429 параллелизм уменьшается вдвое,
+// а при устойчивой успешной работе растет на единицу, не выходя за [minConcurrency, maxConcurrency].
+// Файлы, получившие 429, обрабатываются повторно после паузы.
+func WithAdaptiveConcurrency(minConcurrency, maxConcurrency int) Option {
+	return func(p *Processor) {
+		p.adaptive = true
+		p.minConcurrency = minConcurrency
+		p.maxConcurrency = maxConcurrency
+	}
+}
+
+// WithPageRenderer задает способ конвертации PDF в изображения.
+func WithPageRenderer(renderer PageRenderer) Option {
+	return func(p *Processor) { p.renderer = renderer }
+}
+
+// WithMyCompany задает данные моей компании, чтобы AI не спутал ее с контрагентом.
+func WithMyCompany(myCompany Counterparty) Option {
+	return func(p *Processor) { p.myCompany = myCompany }
+}
+
+// WithRoundingPolicy включает округление сумм извлеченных инвойсов до точности валюты.
+func WithRoundingPolicy(policy RoundingPolicy) Option {
+	return func(p *Processor) { p.roundingPolicy = policy }
+}
+
+// WithThumbnails сохраняет в Invoice.Preview миниатюру первой страницы инвойса
+// с большей стороной не более maxDim пикселей. 0 — миниатюры не создаются.
+func WithThumbnails(maxDim int) Option {
+	return func(p *Processor) { p.thumbnailSize = maxDim }
+}
+
+// WithCache включает кэш результатов: повторная обработка того же файла
+// с теми же настройками не обращается к OpenAI.
+func WithCache(cache *ResultCache) Option {
+	return func(p *Processor) { p.cache = cache }
+}
+
+// WithDuplexRotation включает исправление дуплексных сканов, в которых каждая вторая страница
+// PDF перевернута на 180°: такие страницы поворачиваются до анализа (см. Invoice.RotatedPages).
+func WithDuplexRotation(enabled bool) Option {
+	return func(p *Processor) { p.duplexRotation = enabled }
+}
+
+// WithTextExtractor задает способ извлечения текстового слоя PDF для деградированного режима и режимов
+// извлечения text и auto.
+func WithTextExtractor(extractor TextExtractor) Option {
+	return func(p *Processor) { p.textExtractor = extractor }
+}
+
+// WithExtractionMode задает, как PDF передаются модели для анализа: изображениями страниц (vision, по умолчанию),
+// текстовым слоем (text) или текстовым слоем, если он пригоден на всех страницах, а иначе изображениями (auto).
+// Текст дешевле и точнее для сгенерированных PDF; инвойсы, извлеченные по тексту, отмечены
+// Invoice.Extraction = ExtractionText. Изображения и сканы всегда анализируются по изображениям.
+func WithExtractionMode(mode ExtractionMode) Option {
+	return func(p *Processor) { p.extractionMode = mode }
+}
+
+// WithCategories задает категории расходов: модель выбирает для каждого инвойса ближайшую категорию
+// (Invoice.Category), а если ни одна не подходит — CategoryOther. Назначение платежа (Purpose) заполняется
+// как обычно. Без категорий Category не заполняется.
+func WithCategories(categories []Category) Option {
+	return func(p *Processor) { p.categories = categories }
+}
+
+// WithAttachmentExtractor задает способ извлечения вложений PDF, в которых ищется XML электронного инвойса
+// ZUGFeRD/Factur-X (по умолчанию pdfdetach из PATH). nil отключает поиск: все PDF анализируются по изображениям.
+func WithAttachmentExtractor(extractor AttachmentExtractor) Option {
+	return func(p *Processor) { p.attachmentExtractor = extractor }
+}
+
+// WithDegradedMode настраивает деградированный режим: файлы обрабатываются локально, эвристиками
+// по текстовому слою PDF, без OpenAI. Результат частичный и отмечен Invoice.Extraction = ExtractionLocal.
+// forced включает режим сразу; иначе процессор переходит в него после afterFailures ошибок
+// недоступности OpenAI подряд (0 — не переходит) и остается в нем до конца своей работы.
+func WithDegradedMode(forced bool, afterFailures int) Option {
+	return func(p *Processor) {
+		p.degradedForced = forced
+		p.degradedAfter = afterFailures
+	}
+}
+
+// WithCurrencyAutoCorrect разрешает Deduplicate исправлять валюту инвойса на валюту по умолчанию
+// контрагента, если на нее явно указывает запись сумм (см. CheckCurrency). Без этой опции
+// расхождение валют только отмечается предупреждением.
+func WithCurrencyAutoCorrect(enabled bool) Option {
+	return func(p *Processor) { p.currencyAutoCorrect = enabled }
+}
+
+// WithTracing включает трассировку: ProcessBatch записывает в FileResult.Trace длительности ожидания
+// в очереди, конвертации PDF и каждого запроса к OpenAI. Без нее трассы не создаются.
+func WithTracing(enabled bool) Option {
+	return func(p *Processor) { p.tracing = enabled }
+}
+
+// WithJSONRepair задает, сколько раз просить модель исправить ответ, который не разбирается как JSON
+// (по умолчанию DefaultJSONRepairAttempts). 0 — не исправлять.
+func WithJSONRepair(attempts int) Option {
+	return func(p *Processor) { p.repairAttempts = max(attempts, 0) }
+}
+
+// WithPromptTemplates задает внешние шаблоны промптов (см. LoadPromptTemplates). nil — встроенные промпты.
+// Хэш шаблонов входит в ключ кэша результатов, поэтому правка шаблона не дает устаревших результатов из кэша.
+func WithPromptTemplates(templates *PromptTemplates) Option {
+	return func(p *Processor) { p.promptTemplates = templates }
+}
+
+// NewProcessor создает Processor с клиентом OpenAI и опциями.
+func NewProcessor(client ChatClient, opts ...Option) *Processor {
+	p := &Processor{
+		client:              client,
+		model:               DefaultModel,
+		pageSelection:       DefaultPageSelection,
+		maxAllPages:         DefaultMaxAllPages,
+		repairAttempts:      DefaultJSONRepairAttempts,
+		renderer:            PopplerRenderer(""),
+		textExtractor:       PopplerTextExtractor(""),
+		extractionMode:      ExtractionModeVision,
+		attachmentExtractor: PopplerAttachmentExtractor(""),
+		logger:              slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if !noClient(p.client) {
+		// Таймаут запроса отсчитывается после ожидания ограничителя
+		if p.requestTimeout > 0 {
+			p.client = timeoutClient{ChatClient: p.client, timeout: p.requestTimeout}
+		}
+		if p.limiter != nil {
+			p.client = rateLimitedClient{ChatClient: p.client, limiter: p.limiter, throttled: &p.throttled}
+		}
+	}
+	p.invoiceSchema = invoiceSchema
+	if categories := p.categories; len(categories) > 0 {
+		p.invoiceSchema = sync.OnceValues(func() (*jsonschema.Definition, error) { return categorizedInvoiceSchema(categories) })
+	}
+	return p
+}
+
+// FileResult — результат обработки одного файла в ProcessBatch.
+type FileResult struct {
+	Path     string
+	Invoices []Invoice
+	Usage    Usage
+	Err      error
+	// Concurrency — действующий лимит параллелизма после обработки файла (только в адаптивном режиме).
+	Concurrency int
+	Trace       *Trace        // Трасса обработки файла (только с WithTracing)
+	Duration    time.Duration // Время обработки файла без ожидания в очереди, с повторами после ошибок 429
+}
+
+// Results возвращает результаты файла для отчетов (FileResults) с временем обработки у первого результата.
+func (fr FileResult) Results(sourceFile string) []Result {
+	results := FileResults(sourceFile, fr.Invoices, fr.Usage, fr.Err)
+	results[0].DurationMS = fr.Duration.Milliseconds()
+	return results
+}
+
+// ProcessBatch обрабатывает файлы параллельно и отправляет результаты в канал по мере готовности.
+// Канал закрывается после обработки всех файлов. При отмене ctx новые файлы не запускаются,
+// а их результаты содержат ошибку контекста.
+func (p *Processor) ProcessBatch(ctx context.Context, paths []string) <-chan FileResult {
+	results := make(chan FileResult, len(paths))
+	enqueued := time.Now()
+	workers := p.concurrency
+	var controller *concurrencyController
+	if p.adaptive {
+		start := p.concurrency
+		if start <= 0 {
+			start = p.maxConcurrency
+		}
+		controller = newConcurrencyController(start, p.minConcurrency, p.maxConcurrency)
+		workers = controller.high
+		p.log(ctx).Debug("Adaptive concurrency: starting", "parallel_files", controller.limit, "min", controller.low, "max", controller.high)
+	}
+	if workers <= 0 || workers > len(paths) {
+		workers = len(paths)
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range queue {
+				fileCtx, trace := p.startTrace(ctx, path, enqueued)
+				if err := ctx.Err(); err != nil {
+					results <- FileResult{Path: path, Err: err, Trace: trace}
+					continue
+				}
+				if controller == nil {
+					started := time.Now()
+					invoices, usage, err := p.processFileSafe(fileCtx, path)
+					results <- FileResult{Path: path, Invoices: invoices, Usage: usage, Err: err, Trace: trace, Duration: time.Since(started)}
+					continue
+				}
+				result := p.processAdaptive(fileCtx, controller, path)
+				result.Trace = trace
+				results <- result
+			}
+		}()
+	}
+
+	go func() {
+		for _, path := range paths {
+			queue <- path
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// PanicError — паника при обработке файла в ProcessBatch, превращенная в ошибку файла.
+type PanicError struct {
+	Value any    // Значение, переданное в panic
+	Stack []byte // Стек вызовов в момент паники
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic while processing the file: %v", e.Value)
+}
+
+// processFileSafe вызывает ProcessFile и превращает панику в ошибку *PanicError, чтобы один файл
+// с неожиданным ответом не завершал весь пакет. Стек вызовов пишется в журнал процессора.
+func (p *Processor) processFileSafe(ctx context.Context, path string) (invoices []Invoice, usage Usage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			p.log(ctx).Error("Panic while processing the file", LogKeyFile, path, "panic", r, "stack", string(panicErr.Stack))
+			invoices, err = nil, panicErr
+		}
+	}()
+	return p.ProcessFile(ctx, path)
+}
+
+// startTrace создает трассу файла, если включена трассировка, и записывает в нее ожидание в очереди
+// с момента enqueued. Без трассировки возвращает ctx и nil.
+func (p *Processor) startTrace(ctx context.Context, path string, enqueued time.Time) (context.Context, *Trace) {
+	if !p.tracing {
+		return ctx, nil
+	}
+	trace := &Trace{Path: path}
+	trace.Record(PhaseQueue, enqueued, nil)
+	return WithTrace(ctx, trace), trace
+}
+
+// processAdaptive обрабатывает файл под управлением controller, повторяя его после ошибок 429.
+func (p *Processor) processAdaptive(ctx context.Context, controller *concurrencyController, path string) FileResult {
+	result := FileResult{Path: path}
+	trace := TraceFrom(ctx)
+	for attempt := 0; ; attempt++ {
+		waiting := time.Now()
+		err := controller.acquire(ctx)
+		trace.Record(PhaseQueue, waiting, err)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		started := time.Now()
+		invoices, usage, err := p.processFileSafe(ctx, path)
+		result.Duration += time.Since(started)
+		result.Invoices, result.Err = invoices, err
+		result.Usage.Add(usage)
+		limit, changed := controller.release(err)
+		result.Concurrency = limit
+		if changed {
+			p.log(ctx).Debug("Adaptive concurrency: limit changed", "parallel_files", limit)
+		}
+		if !IsRateLimitError(err) || attempt >= maxRateLimitRetries || ctx.Err() != nil {
+			return result
+		}
+		trace.retried()
+		p.log(ctx).Warn("Rate limited by OpenAI, retrying the file", LogKeyFile, path, "attempt", attempt+1, "max_attempts", maxRateLimitRetries)
+	}
+}
+
+// Result — результат обработки одного инвойса (или ошибка файла) для отчетов.
+// Файл с несколькими инвойсами дает несколько Result.
+type Result struct {
+	SourceFile   string
+	Invoice      *Invoice
+	InvoiceIndex int // Порядковый номер инвойса в файле (с 1)
+	InvoiceCount int // Количество инвойсов в файле
+	ErrorMessage string
+	ErrorCode    string            // Код причины ошибки (см. ErrorCode), если ErrorMessage не пуст
+	Warnings     []ValidationIssue // Проблемы, найденные Invoice.Validate
+	Usage        Usage             // Использование OpenAI API при обработке файла (только у первого инвойса файла)
+	DurationMS   int64             // Время обработки файла в миллисекундах (только у первого инвойса файла, см. FileResult.Duration)
+	Match        *MatchExplanation // Объяснение сопоставления контрагента с базой (после Deduplicate)
+	DuplicateOf  string            // Исходный файл первого вхождения, если инвойс — повтор (после Deduplicate, см. MarkDuplicates)
+	Skipped      string            // Причина пропуска документа без ошибки (SkippedNotInvoice); Invoice при этом nil
+}
+
+// SkippedNotInvoice — Result.Skipped документа, который модель отнесла к TypeNotInvoice.
+const SkippedNotInvoice = "not an invoice"
+
+// IsSkipped сообщает, что документ пропущен без ошибки, например потому что это не инвойс.
+func (r Result) IsSkipped() bool {
+	return r.Skipped != ""
+}
+
+// UniqueCounterparty — уникальный контрагент в отчете.
+type UniqueCounterparty struct {
+	SourceFile   string // Файл, где контрагент был впервые обнаружен
+	Counterparty Counterparty
+	AliasRule    string // Совпадение с правилом counterparty_aliases ("alias: VAT ..."); пусто — контрагент сопоставлен обычным путем
+}
+
+// SourceName возвращает имя исходного файла path для отчетов: путь относительно root с разделителями "/",
+// чтобы одноименные файлы из разных папок архива различались. Если path вне root, возвращается имя файла.
+func SourceName(root, path string) string {
+	name, err := filepath.Rel(root, path)
+	if err != nil || !filepath.IsLocal(name) {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(name)
+}
+
+// FileResults превращает результат обработки файла в список Result: по одному на документ.
+// Документы TypeNotInvoice дают Result без инвойса с Skipped = SkippedNotInvoice, а инвойсы с Err
+// (группа страниц не разобрана) — Result с ошибкой и номером инвойса в файле.
+func FileResults(sourceFile string, invoices []Invoice, usage Usage, err error) []Result {
+	if err != nil {
+		return []Result{{SourceFile: sourceFile, ErrorMessage: err.Error(), ErrorCode: ErrorCode(err), Usage: usage}}
+	}
+	if len(invoices) == 0 {
+		return []Result{{SourceFile: sourceFile, ErrorMessage: "No invoices found in file", ErrorCode: ErrorCodeNoInvoiceFound, Usage: usage}}
+	}
+	results := make([]Result, len(invoices))
+	for i := range invoices {
+		results[i] = Result{SourceFile: sourceFile, InvoiceIndex: i + 1, InvoiceCount: len(invoices)}
+		if err := invoices[i].Err; err != nil {
+			results[i].ErrorMessage, results[i].ErrorCode = err.Error(), ErrorCode(err)
+			continue
+		}
+		if !invoices[i].IsInvoice() {
+			results[i].Skipped = SkippedNotInvoice
+			continue
+		}
+		results[i].Invoice = &invoices[i]
+		results[i].Warnings = invoices[i].Validate()
+	}
+	results[0].Usage = usage
+	return results
+}
+
+// Deduplication — итог дедупликации контрагентов по результатам пакета.
+type Deduplication struct {
+	UniqueCounterparties  []UniqueCounterparty
+	MatchingUsage         Usage
+	MatchingDuration      time.Duration // Время сопоставления контрагентов: один запрос на весь пакет, по файлам не делится
+	Successful            int           // Успешно извлеченные инвойсы
+	Failed                int           // Результаты с ошибками
+	NewCounterparties     int           // Уникальные контрагенты, которых не было в реестре
+	MatchedCounterparties int           // Уникальные контрагенты, сопоставленные с записями реестра
+	Duplicates            int           // Повторы инвойсов в пакете (Result.DuplicateOf)
+	Warnings              []string      // Ошибки сопоставления (контрагент при этом считается новым)
+}
+
+// Deduplicate сопоставляет контрагентов успешных результатов с реестром одним запросом к OpenAI.
+// Контрагенты, подходящие под правила WithAliasOverrides, приводятся к контрагенту правила без модели.
+// Контрагенты в results заменяются дополненными данными из реестра (ID, алиасы), а валюта каждого инвойса
+// сверяется с валютой по умолчанию контрагента (предупреждение добавляется в Result.Warnings) и учитывается в ней.
+// После сопоставления повторы инвойсов отмечаются в Result.DuplicateOf (MarkDuplicates).
+func (p *Processor) Deduplicate(ctx context.Context, results []Result, registry *CounterpartyRegistry) Deduplication {
+	var dedup Deduplication
+	var successful []int // Индексы успешных результатов в results
+	var counterparties []Counterparty
+	for i, res := range results {
+		if res.ErrorMessage != "" || res.Invoice == nil {
+			if !res.IsSkipped() {
+				dedup.Failed++
+			}
+			continue
+		}
+		successful = append(successful, i)
+		counterparties = append(counterparties, res.Invoice.Counterparty)
+	}
+	dedup.Successful = len(successful)
+	if len(successful) == 0 {
+		return dedup
+	}
+
+	// Правила counterparty_aliases проверяются первыми: совпавшие контрагенты не отправляются в модель
+	registry.reserveAliasIDs(p.aliasOverrides)
+	indices := make([]int, len(counterparties))
+	isNew := make([]bool, len(counterparties))
+	explanations := make([]MatchExplanation, len(counterparties))
+	aliasRules := make([]string, len(counterparties))
+	var matched []int // Позиции в counterparties, которые сопоставляются с реестром обычным путем
+	var toMatch []Counterparty
+	for i, cp := range counterparties {
+		alias, rule, ok := p.aliasOverrides.match(cp)
+		if !ok {
+			matched = append(matched, i)
+			toMatch = append(toMatch, cp)
+			continue
+		}
+		indices[i], isNew[i] = registry.resolveAlias(alias, cp)
+		explanations[i] = MatchExplanation{Matched: &MatchCandidate{ID: alias.ID, Name: registry.Counterparties[indices[i]].Name, Score: 1, Reason: rule}}
+		aliasRules[i] = rule
+	}
+	if len(toMatch) > 0 {
+		client := p.client
+		if p.Degraded() {
+			client = nil // OpenAI недоступен: сопоставляем только локально
+		}
+		matchingStarted := time.Now()
+		batchIndices, batchNew, batchExplanations, usage, err := registry.resolveBatch(ctx, client, p.model, p.repairAttempts, p.prompts(), toMatch)
+		dedup.MatchingDuration = time.Since(matchingStarted)
+		dedup.MatchingUsage.Add(usage)
+		if err != nil {
+			dedup.Warnings = append(dedup.Warnings, fmt.Sprintf("Could not match counterparties: %v", err))
+		}
+		for j, i := range matched {
+			indices[i], isNew[i], explanations[i] = batchIndices[j], batchNew[j], batchExplanations[j]
+		}
+	}
+
+	uniqueIndex := make(map[int]int) // индекс в реестре -> индекс в UniqueCounterparties
+	for i, position := range successful {
+		res := &results[position]
+		index := indices[i]
+		res.Match = &explanations[i]
+		if issue := CheckCurrency(res.Invoice, registry.Counterparties[index], p.currencyAutoCorrect); issue != nil {
+			res.Warnings = append(res.Warnings, *issue)
+		}
+		registry.Counterparties[index].RecordCurrency(res.Invoice.Currency)
+		res.Invoice.Counterparty = registry.Counterparties[index]
+		if position, ok := uniqueIndex[index]; ok {
+			if unique := &dedup.UniqueCounterparties[position]; unique.AliasRule == "" {
+				unique.AliasRule = aliasRules[i]
+			}
+			continue
+		}
+		uniqueIndex[index] = len(dedup.UniqueCounterparties)
+		if isNew[i] {
+			dedup.NewCounterparties++
+		} else {
+			dedup.MatchedCounterparties++
+		}
+		dedup.UniqueCounterparties = append(dedup.UniqueCounterparties, UniqueCounterparty{
+			SourceFile:   res.SourceFile,
+			Counterparty: registry.Counterparties[index],
+			AliasRule:    aliasRules[i],
+		})
+	}
+	// Валюты следующих инвойсов пакета учтены в реестре уже после того, как контрагент попал в список
+	for index, position := range uniqueIndex {
+		dedup.UniqueCounterparties[position].Counterparty = registry.Counterparties[index]
+	}
+	dedup.Duplicates = MarkDuplicates(results)
+	return dedup
+}
+
+// prompts возвращает построитель промптов процессора.
+func (p *Processor) prompts() promptSet {
+	return promptSet{templates: p.promptTemplates, myCompany: p.myCompany, categories: p.categories}
+}
+
+// cacheVersion описывает настройки, влияющие на результат извлечения, для ключа кэша.
+func (p *Processor) cacheVersion() string {
+	version := fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%s\x00%d\x00%t\x00%s\x00%d",
+		p.model, buildGroupingPrompt(), buildDetailedPrompt(p.myCompany, false, p.categories), buildDetailedPrompt(p.myCompany, true, p.categories),
+		p.pageSelection, p.maxAllPages, p.roundingPolicy, p.thumbnailSize, p.duplexRotation, p.extractionMode, paymentQRVersion)
+	if hash := p.promptTemplates.Hash(); hash != "" {
+		version += "\x00" + hash // Без шаблонов ключи прежних версий остаются действительными
+	}
+	return version
+}
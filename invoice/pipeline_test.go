@@ -0,0 +1,172 @@
+package invoice
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/veryevilzed/invpa/pdfimg"
+)
+
+// chatFunc — ChatClient из функции для тестов без OpenAI.
+type chatFunc func(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+
+func (f chatFunc) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return f(ctx, request)
+}
+
+func chatResponse(content string) openai.ChatCompletionResponse {
+	return openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: content}}}}
+}
+
+// fakeAnalysis отвечает на запросы группировки одной группой из всех страниц, а на запросы анализа —
+// инвойсом с номером number.
+func fakeAnalysis(request openai.ChatCompletionRequest, number string) openai.ChatCompletionResponse {
+	if request.ResponseFormat != nil && request.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject {
+		return chatResponse(`{"invoice_1": [0]}`)
+	}
+	inv, _ := json.Marshal(Invoice{Type: TypePaymentOrder, Number: number, Date: "2024-03-01", Currency: "EUR", TotalAmount: 100})
+	return chatResponse(string(inv))
+}
+
+// requestMentions сообщает, что в изображениях страниц запроса есть данные data.
+func requestMentions(request openai.ChatCompletionRequest, data string) bool {
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+	for _, message := range request.Messages {
+		for _, part := range message.MultiContent {
+			if part.ImageURL != nil && strings.Contains(part.ImageURL.URL, encoded) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// quiet отключает журнал процессора.
+func quiet() Option {
+	return WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// writeFiles создает пустые файлы names во временной директории и возвращает их пути.
+func writeFiles(t *testing.T, names ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+		if err := os.WriteFile(paths[i], []byte("%PDF-1.4"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// TestProcessBatchRecoversPanics проверяет, что паника в отрисовке страниц одного файла и в анализе
+// другого превращается в строки ошибок этих файлов, а остальные файлы пакета обрабатываются.
+func TestProcessBatchRecoversPanics(t *testing.T) {
+	paths := writeFiles(t, "good.pdf", "render-panic.pdf", "analysis-panic.pdf", "other.pdf")
+	renderer := func(ctx context.Context, pdfPath string) ([][]byte, error) {
+		if strings.HasPrefix(filepath.Base(pdfPath), "render-panic") {
+			var pages [][]byte
+			return [][]byte{pages[1]}, nil // Выход за границы среза
+		}
+		return [][]byte{[]byte(filepath.Base(pdfPath))}, nil
+	}
+	client := chatFunc(func(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		if requestMentions(request, "analysis-panic.pdf") {
+			panic("unexpected response")
+		}
+		return fakeAnalysis(request, "INV-1"), nil
+	})
+
+	for _, adaptive := range []bool{false, true} {
+		var options []Option
+		if adaptive {
+			options = append(options, WithAdaptiveConcurrency(1, 2))
+		}
+		p := NewProcessor(client, append(options,
+			WithPageRenderer(renderer),
+			WithAttachmentExtractor(func(context.Context, string) ([]pdfimg.Attachment, error) { return nil, nil }),
+			quiet(),
+		)...)
+
+		results := make(map[string]Result)
+		for fr := range p.ProcessBatch(context.Background(), paths) {
+			for _, res := range fr.Results(filepath.Base(fr.Path)) {
+				results[res.SourceFile] = res
+			}
+			var panicErr *PanicError
+			if strings.Contains(fr.Path, "panic") && (!errors.As(fr.Err, &panicErr) || len(panicErr.Stack) == 0) {
+				t.Errorf("adaptive %v: %s error = %v, want *PanicError with the stack", adaptive, filepath.Base(fr.Path), fr.Err)
+			}
+		}
+		if len(results) != len(paths) {
+			t.Fatalf("adaptive %v: %d results, want %d", adaptive, len(results), len(paths))
+		}
+		for _, name := range []string{"good.pdf", "other.pdf"} {
+			if res := results[name]; res.Invoice == nil || res.Invoice.Number != "INV-1" {
+				t.Errorf("adaptive %v: %s = %+v, want INV-1", adaptive, name, res)
+			}
+		}
+		for _, name := range []string{"render-panic.pdf", "analysis-panic.pdf"} {
+			if res := results[name]; res.ErrorMessage == "" || !strings.Contains(res.ErrorMessage, "panic") {
+				t.Errorf("adaptive %v: %s = %+v, want an error row", adaptive, name, res)
+			}
+		}
+	}
+}
+
+// TestTooLongInvoiceDoesNotFailFile проверяет, что группа страниц длиннее max_all_pages дает строку
+// ошибки этого инвойса, а остальные инвойсы файла извлекаются.
+func TestTooLongInvoiceDoesNotFailFile(t *testing.T) {
+	paths := writeFiles(t, "two-invoices.pdf")
+	renderer := func(context.Context, string) ([][]byte, error) {
+		return [][]byte{[]byte("page 1"), []byte("page 2"), []byte("page 3"), []byte("page 4")}, nil
+	}
+	client := chatFunc(func(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		if request.ResponseFormat != nil && request.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject {
+			return chatResponse(`{"invoice_1": [0], "invoice_2": [1, 2, 3]}`), nil
+		}
+		return fakeAnalysis(request, "INV-1"), nil
+	})
+	p := NewProcessor(client,
+		WithPageRenderer(renderer),
+		WithAttachmentExtractor(func(context.Context, string) ([]pdfimg.Attachment, error) { return nil, nil }),
+		WithMaxPages(0),
+		WithMaxAllPages(2),
+		quiet(),
+	)
+
+	invoices, usage, err := p.ProcessFile(context.Background(), paths[0])
+	if err != nil {
+		t.Fatalf("ProcessFile: %v", err)
+	}
+	results := FileResults("two-invoices.pdf", invoices, usage, nil)
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	if res := results[0]; res.Invoice == nil || res.Invoice.Number != "INV-1" {
+		t.Errorf("first result = %+v, want INV-1", res)
+	}
+	if res := results[1]; res.Invoice != nil || res.InvoiceIndex != 2 || !strings.Contains(res.ErrorMessage, "max_all_pages (2)") {
+		t.Errorf("second result = %+v, want an error row for invoice 2 of 2", res)
+	}
+	if pages := invoices[1].Pages; !slices.Equal(pages, []int{2, 3, 4}) {
+		t.Errorf("pages of the skipped invoice = %v, want [2 3 4]", pages)
+	}
+
+	summary := NewRunSummary(1, results, Deduplication{}, nil, 0)
+	if summary.FilesProcessed != 1 || summary.FilesFailed != 0 || summary.InvoicesExtracted != 1 || summary.Errors[ErrorCodeOther] != 1 {
+		t.Errorf("summary: %d processed, %d failed, %d invoices, errors %v, want 1, 0, 1 and one %s",
+			summary.FilesProcessed, summary.FilesFailed, summary.InvoicesExtracted, summary.Errors, ErrorCodeOther)
+	}
+}
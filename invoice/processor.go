@@ -2,90 +2,340 @@ package invoice
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
 
 // ProcessFile анализирует файл инвойса (PDF, PNG, JPG) и извлекает данные.
 // Реализует двухэтапный анализ: сначала группировка страниц, затем детальный анализ.
-func ProcessFile(filePath, apiKey, popplerPath string, myCompany Counterparty) ([]Invoice, error) {
+// Вместе с инвойсами возвращает статистику использования OpenAI API.
+// Это обертка над Processor с настройками по умолчанию.
+func ProcessFile(filePath, apiKey, popplerPath string, myCompany Counterparty) ([]Invoice, Usage, error) {
+	return ProcessFileContext(context.Background(), filePath, apiKey, popplerPath, myCompany)
+}
+
+// ProcessFileContext аналогичен ProcessFile, но позволяет отменить обработку через контекст.
+// Отмена прерывает выполняющиеся запросы к OpenAI и конвертацию PDF.
+func ProcessFileContext(ctx context.Context, filePath, apiKey, popplerPath string, myCompany Counterparty) ([]Invoice, Usage, error) {
+	return ProcessFileWithConfig(ctx, filePath, ClientConfig{APIKey: apiKey}, popplerPath, myCompany)
+}
+
+// ProcessFileWithConfig аналогичен ProcessFileContext, но подключается к API по clientConfig
+// (OpenAI с произвольным base URL или Azure OpenAI).
+func ProcessFileWithConfig(ctx context.Context, filePath string, clientConfig ClientConfig, popplerPath string, myCompany Counterparty) ([]Invoice, Usage, error) {
+	client, err := NewClient(clientConfig)
+	if err != nil {
+		return nil, Usage{}, fmt.Errorf("invalid OpenAI client config: %w", err)
+	}
+	return ProcessFileWithClient(ctx, client, filePath, popplerPath, myCompany)
+}
+
+// ProcessFileWithClient аналогичен ProcessFileContext, но использует готового клиента OpenAI.
+// Один клиент можно передавать во все вызовы (и в FindCounterparty), чтобы переиспользовать
+// соединения, собственный HTTP-транспорт, прокси или общий ограничитель запросов.
+func ProcessFileWithClient(ctx context.Context, client ChatClient, filePath, popplerPath string, myCompany Counterparty) ([]Invoice, Usage, error) {
+	processor := NewProcessor(client,
+		WithPageRenderer(PopplerRenderer(popplerPath)),
+		WithMyCompany(myCompany),
+	)
+	return processor.ProcessFile(ctx, filePath)
+}
+
+// ProcessFile анализирует один файл инвойса с настройками процессора. PDF с вложенным XML
+// ZUGFeRD/Factur-X читается из XML без OpenAI (см. WithAttachmentExtractor), остальные файлы — по изображениям.
+// В деградированном режиме (WithDegradedMode) файл обрабатывается локально, без OpenAI.
+// Файл читается в память, дальше обработка идет так же, как в ProcessBytes.
+func (p *Processor) ProcessFile(ctx context.Context, filePath string) ([]Invoice, Usage, error) {
 	ext := strings.ToLower(filepath.Ext(filePath))
+	if !IsSupportedFile(filePath) {
+		return nil, Usage{}, fmt.Errorf("%w: %s", ErrUnsupportedType, ext)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, Usage{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	return p.process(ctx, &source{name: filepath.Base(filePath), ext: ext, data: data, path: filePath})
+}
+
+// process анализирует входной файл: из встроенного XML, локально в деградированном режиме
+// или с помощью OpenAI с переходом на локальное извлечение, если OpenAI недоступен.
+func (p *Processor) process(ctx context.Context, src *source) ([]Invoice, Usage, error) {
+	ctx = withLogAttrs(ctx, slog.String(LogKeyFile, src.name))
+	return p.withFileTimeout(ctx, func(ctx context.Context) ([]Invoice, Usage, error) {
+		return p.processSource(ctx, src)
+	})
+}
+
+func (p *Processor) processSource(ctx context.Context, src *source) ([]Invoice, Usage, error) {
+	if invoices, ok := p.processEmbeddedXML(ctx, src); ok {
+		return invoices, Usage{}, nil
+	}
+	if p.Degraded() {
+		invoices, err := p.processLocallyTraced(ctx, src)
+		return invoices, Usage{}, err
+	}
+	invoices, usage, err := p.processFile(ctx, src)
+	if !p.apiFailed(ctx, err) {
+		return invoices, usage, err
+	}
+	local, localErr := p.processLocallyTraced(ctx, src)
+	if localErr != nil {
+		return nil, usage, fmt.Errorf("%w; local extraction failed: %v", err, localErr)
+	}
+	return local, usage, nil
+}
+
+// processLocallyTraced выполняет локальное извлечение, записывая его в трассу контекста.
+func (p *Processor) processLocallyTraced(ctx context.Context, src *source) ([]Invoice, error) {
+	started := time.Now()
+	invoices, err := p.processLocally(ctx, src)
+	TraceFrom(ctx).Record(PhaseLocal, started, err)
+	return invoices, err
+}
+
+// processFile анализирует файл с помощью OpenAI.
+func (p *Processor) processFile(ctx context.Context, src *source) ([]Invoice, Usage, error) {
+	var usage Usage
+	if err := ctx.Err(); err != nil {
+		return nil, usage, err
+	}
+
+	trace := TraceFrom(ctx)
+	logger := p.log(ctx)
 
 	var imageContents [][]byte
+	var pageTexts []string // Текстовый слой страниц, если PDF анализируется по тексту (WithExtractionMode)
+	var rotatedPages []int // Страницы, повернутые на 180° (дуплексный скан)
 	var err error
 
+	// 0. Проверяем кэш результатов
+	var key string
+	if p.cache != nil {
+		key = cacheKey(src.data, p.cacheVersion())
+		if invoices, ok := p.cache.get(key); ok {
+			logger.Info("Cache hit: reusing the previous extraction result without OpenAI calls")
+			return invoices, usage, nil
+		}
+	}
+
 	// 1. Получаем изображения страниц
-	switch ext {
+	switch src.ext {
 	case ".pdf":
-		fmt.Println("Converting PDF to images...")
-		imageContents, err = convertPDFToImages(filePath, popplerPath)
+		filePath, err := src.pdfPath()
+		if err != nil {
+			return nil, usage, err
+		}
+		if p.extractionMode != ExtractionModeVision {
+			started := time.Now()
+			pageTexts, err = p.textLayer(ctx, filePath)
+			trace.Record(PhaseText, started, err)
+			if err != nil {
+				if p.extractionMode == ExtractionModeText {
+					return nil, usage, fmt.Errorf("text extraction mode: %w", err)
+				}
+				logger.Info("No usable text layer, analyzing page images instead", LogKeyStage, PhaseText, "error", err)
+			} else {
+				logger.Info("Using the PDF text layer instead of page images", LogKeyStage, PhaseText, "pages", len(pageTexts))
+				break
+			}
+		}
+		logger.Debug("Converting PDF to images", LogKeyStage, PhaseRender)
+		started := time.Now()
+		imageContents, err = p.renderer(ctx, filePath)
+		trace.Record(PhaseRender, started, err)
+		if errors.Is(err, ErrEncryptedPDF) {
+			return nil, usage, err // "password required" без вывода pdftoppm
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert PDF to images: %w", err)
+			return nil, usage, fmt.Errorf("%w: %w", ErrPDFConversion, err)
+		}
+		if p.duplexRotation {
+			started := time.Now()
+			imageContents, rotatedPages = p.fixDuplexRotation(ctx, imageContents, &usage)
+			trace.Record(PhaseOrientation, started, nil)
 		}
 	case ".png", ".jpg", ".jpeg":
-		content, err := os.ReadFile(filePath)
+		imageContents = append(imageContents, src.data)
+	case ".tif", ".tiff":
+		started := time.Now()
+		imageContents, err = tiffToImages(src.data)
+		trace.Record(PhaseRender, started, err)
+		if err != nil {
+			return nil, usage, err
+		}
+		logger.Debug("Decoded TIFF pages", LogKeyStage, PhaseRender, "pages", len(imageContents))
+		if p.duplexRotation {
+			started := time.Now()
+			imageContents, rotatedPages = p.fixDuplexRotation(ctx, imageContents, &usage)
+			trace.Record(PhaseOrientation, started, nil)
+		}
+	case ".heic", ".heif", ".webp":
+		content, err := photoToJPEG(src.data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read image file: %w", err)
+			return nil, usage, err
 		}
 		imageContents = append(imageContents, content)
 	default:
-		return nil, fmt.Errorf("unsupported file type: %s", ext)
+		return nil, usage, fmt.Errorf("%w: %s", ErrUnsupportedType, src.ext)
 	}
 
-	if len(imageContents) == 0 {
-		return nil, fmt.Errorf("no images found to process")
+	pages := pageInputs(imageContents, pageTexts)
+	if len(pages) == 0 {
+		return nil, usage, fmt.Errorf("%w: no pages to process", ErrNoInvoiceFound)
 	}
 
-	client := openai.NewClient(apiKey)
 	var finalInvoices []Invoice
+	complete := true // Все группы страниц проанализированы успешно
+	var lastErr error
 
 	// 2. Группируем страницы по инвойсам
-	fmt.Printf("Grouping %d pages by invoice...\n", len(imageContents))
-	pageGroups, err := groupPagesByInvoice(client, imageContents)
+	logger.Debug("Grouping pages by invoice", LogKeyStage, PhaseGrouping, "pages", len(pages))
+	pageGroups, err := p.groupPagesByInvoice(ctx, pages, &usage)
+	if ctx.Err() != nil {
+		return nil, usage, ctx.Err()
+	}
 	if err != nil {
 		// Если группировка не удалась, пробуем обработать как один большой инвойс
-		fmt.Printf("Page grouping failed (%v), treating all pages as a single invoice.\n", err)
+		logger.Warn("Page grouping failed, treating all pages as a single invoice", LogKeyStage, PhaseGrouping, "error", err)
 		pageGroups = map[string][]int{"single_invoice": {}}
-		for i := range imageContents {
+		for i := range pages {
 			pageGroups["single_invoice"] = append(pageGroups["single_invoice"], i)
 		}
 	}
 
-	// 3. Детально анализируем каждую группу
-	for invoiceID, pageIndices := range pageGroups {
-		fmt.Printf("Analyzing invoice '%s' with %d pages...\n", invoiceID, len(pageIndices))
+	// 3. Детально анализируем каждую группу в порядке следования страниц
+	for _, invoiceID := range sortedGroupIDs(pageGroups) {
+		pageIndices := pageGroups[invoiceID]
+		logger := logger.With(LogKeyInvoiceID, invoiceID)
+		logger.Debug("Analyzing invoice", LogKeyStage, PhaseExtraction, "pages", len(pageIndices))
 
-		// Оптимизация: берем первые 2 и последние 2 страницы
-		pagesToAnalyze := selectPagesForAnalysis(pageIndices)
-		imagesToAnalyze := make([][]byte, 0, len(pagesToAnalyze))
+		// Оптимизация: по умолчанию берем только первые и последние страницы
+		pagesToAnalyze, err := p.pageSelection.selectPages(pageIndices, p.maxAllPages)
+		if err != nil {
+			// Слишком длинная группа не мешает извлечь остальные инвойсы файла: она попадает в результат ошибкой
+			logger.Error("Invoice skipped", LogKeyStage, PhaseExtraction, "error", err)
+			complete = false
+			lastErr = fmt.Errorf("invoice '%s': %w", invoiceID, err)
+			failed := Invoice{Err: lastErr}
+			for _, pageIndex := range pageIndices {
+				failed.Pages = append(failed.Pages, pageIndex+1)
+			}
+			finalInvoices = append(finalInvoices, failed)
+			continue
+		}
+		selected := make([]pageInput, 0, len(pagesToAnalyze))
 		for _, pageIndex := range pagesToAnalyze {
-			imagesToAnalyze = append(imagesToAnalyze, imageContents[pageIndex])
+			selected = append(selected, pages[pageIndex])
 		}
 
-		fmt.Printf("-> Selected %d pages for detailed analysis.\n", len(imagesToAnalyze))
-		invoice, err := analyzeInvoicePages(client, imagesToAnalyze, myCompany)
+		if len(pagesToAnalyze) < len(pageIndices) {
+			logger.Debug("Selected part of the pages for detailed analysis (every extra page adds to the token cost)",
+				LogKeyStage, PhaseExtraction, "selected", len(pagesToAnalyze), "pages", len(pageIndices), "page_selection", p.pageSelection)
+		} else {
+			logger.Debug("Selected all pages for detailed analysis", LogKeyStage, PhaseExtraction, "selected", len(selected))
+		}
+		pageNumbers := make([]int, len(pagesToAnalyze))
+		for i, pageIndex := range pagesToAnalyze {
+			pageNumbers[i] = pageIndex + 1
+		}
+		invoice, err := p.analyzeInvoicePages(ctx, pageNumbers, selected, &usage)
+		if ctx.Err() != nil {
+			return finalInvoices, usage, ctx.Err()
+		}
 		if err != nil {
-			fmt.Printf("Error analyzing invoice '%s': %v\n", invoiceID, err)
+			logger.Error("Invoice analysis failed", LogKeyStage, PhaseExtraction, "error", err)
+			complete = false
+			lastErr = err
 			continue
 		}
+		for _, pageIndex := range pageIndices {
+			invoice.Pages = append(invoice.Pages, pageIndex+1)
+		}
+		sort.Ints(invoice.Pages)
+		for _, page := range rotatedPages {
+			if slices.Contains(invoice.Pages, page) {
+				invoice.RotatedPages = append(invoice.RotatedPages, page)
+			}
+		}
+		if pageTexts != nil {
+			invoice.Extraction = ExtractionText
+		}
+		// Платежный QR-код ищется на всех страницах инвойса; при анализе по тексту изображений страниц нет
+		if imageContents != nil {
+			started := time.Now()
+			images := make(map[int][]byte, len(pageIndices))
+			for _, pageIndex := range pageIndices {
+				images[pageIndex+1] = imageContents[pageIndex]
+			}
+			if qr, page, ok := findPaymentQR(images, invoice.Pages); ok {
+				changes := invoice.applyPaymentQR(qr, p.myCompany)
+				logger.Info("Payment QR code found, payment data taken from it", LogKeyStage, PhaseQR, "format", qr.Format, "page", page)
+				if len(changes) > 0 {
+					logger.Info("QR code corrected the extracted data", LogKeyStage, PhaseQR, "changes", strings.Join(changes, ", "))
+				}
+			}
+			trace.Record(PhaseQR, started, nil)
+		}
+		if p.thumbnailSize > 0 {
+			// При анализе по тексту страницы конвертируются в изображения только для миниатюр, один раз на файл
+			if imageContents == nil {
+				started := time.Now()
+				imageContents, err = p.renderer(ctx, src.path) // PDF уже на диске: текстовый слой читался по пути
+				trace.Record(PhaseRender, started, err)
+				if err != nil {
+					imageContents = [][]byte{}
+				}
+			}
+			// Ошибка миниатюры не должна мешать извлечению данных
+			if page := invoice.Pages[0] - 1; page < len(imageContents) {
+				invoice.Preview, err = Thumbnail(imageContents[page], p.thumbnailSize)
+			} else if err == nil {
+				err = fmt.Errorf("page %d was not rendered", page+1)
+			}
+			if err != nil {
+				logger.Warn("Could not create preview", "error", err)
+			}
+		}
+		p.roundAmounts(invoice)
 		finalInvoices = append(finalInvoices, *invoice)
 	}
 
-	return finalInvoices, nil
+	extracted := slices.ContainsFunc(finalInvoices, func(inv Invoice) bool { return inv.Err == nil })
+	// Если OpenAI недоступен и ни один инвойс не получен, сообщаем об этом, а не о пустом файле
+	if !extracted && IsUnavailableError(lastErr) {
+		return nil, usage, fmt.Errorf("OpenAI is unavailable: %w", lastErr)
+	}
+	// Ни одна группа страниц не разобрана: причина важнее, чем «инвойсы не найдены»
+	if !extracted && lastErr != nil {
+		return nil, usage, lastErr
+	}
+
+	// Кэшируем только полностью успешный результат
+	if key != "" && complete && len(finalInvoices) > 0 {
+		if err := p.cache.put(key, finalInvoices); err != nil {
+			logger.Warn("Could not store the result in cache", "error", err)
+		}
+	}
+
+	return finalInvoices, usage, nil
 }
 
 // groupPagesByInvoice отправляет все страницы в OpenAI для определения, к какому инвойсу они относятся.
-func groupPagesByInvoice(client *openai.Client, imageContents [][]byte) (map[string][]int, error) {
-	prompt := buildGroupingPrompt()
+func (p *Processor) groupPagesByInvoice(ctx context.Context, pages []pageInput, usage *Usage) (map[string][]int, error) {
+	prompt, err := p.prompts().grouping()
+	if err != nil {
+		return nil, err
+	}
 
 	parts := []openai.ChatMessagePart{
 		{
@@ -94,61 +344,55 @@ func groupPagesByInvoice(client *openai.Client, imageContents [][]byte) (map[str
 		},
 	}
 
-	for i, content := range imageContents {
-		encodedImage := base64.StdEncoding.EncodeToString(content)
-		imageURL := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(content), encodedImage)
-
+	for i, page := range pages {
 		// Добавляем текстовый маркер для страницы
 		parts = append(parts, openai.ChatMessagePart{
 			Type: openai.ChatMessagePartTypeText,
 			Text: fmt.Sprintf("This is Page %d.", i),
 		})
 
-		// Добавляем саму страницу
-		parts = append(parts, openai.ChatMessagePart{
-			Type: openai.ChatMessagePartTypeImageURL,
-			ImageURL: &openai.ChatMessageImageURL{
-				URL:    imageURL,
-				Detail: openai.ImageURLDetailLow, // Используем низкое разрешение для скорости
-			},
-		})
+		// Добавляем саму страницу; изображения — в низком разрешении для скорости
+		parts = append(parts, page.part(openai.ImageURLDetailLow))
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT4o,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:         openai.ChatMessageRoleUser,
-					MultiContent: parts,
-				},
-			},
-			ResponseFormat: &openai.ChatCompletionResponseFormat{
-				Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+	request := openai.ChatCompletionRequest{
+		Model: p.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:         openai.ChatMessageRoleUser,
+				MultiContent: parts,
 			},
 		},
-	)
-
+		ResponseFormat: &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+		},
+	}
+	started := time.Now()
+	resp, err := p.client.CreateChatCompletion(ctx, request)
+	TraceFrom(ctx).Record(PhaseGrouping, started, err)
 	if err != nil {
 		return nil, fmt.Errorf("grouping request to OpenAI failed: %w", err)
 	}
+	usage.record(p.model, resp.Usage)
 	if len(resp.Choices) == 0 {
 		return nil, fmt.Errorf("OpenAI returned no choices for grouping")
 	}
 
 	var groups map[string][]int
-	err = json.Unmarshal([]byte(resp.Choices[0].Message.Content), &groups)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal grouping response: %w. Response: %s", err, resp.Choices[0].Message.Content)
+	if err := decodeResponse(ctx, p.client, request, resp.Choices[0].Message.Content, &groups, p.repairAttempts, usage); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal grouping response: %w", err)
 	}
 
 	return groups, nil
 }
 
 // analyzeInvoicePages отправляет выбранные страницы инвойса для детального анализа.
-func analyzeInvoicePages(client *openai.Client, imageContents [][]byte, myCompany Counterparty) (*Invoice, error) {
-	prompt := buildDetailedPrompt(myCompany)
+// pageNumbers — номера страниц файла (с 1) для imageContents; по ним модель указывает источники полей.
+func (p *Processor) analyzeInvoicePages(ctx context.Context, pageNumbers []int, pages []pageInput, usage *Usage) (*Invoice, error) {
+	prompt, err := p.prompts().detailed(pages[0].image == nil)
+	if err != nil {
+		return nil, err
+	}
 
 	parts := []openai.ChatMessagePart{
 		{
@@ -157,77 +401,77 @@ func analyzeInvoicePages(client *openai.Client, imageContents [][]byte, myCompan
 		},
 	}
 
-	for _, content := range imageContents {
-		encodedImage := base64.StdEncoding.EncodeToString(content)
-		imageURL := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(content), encodedImage)
-		parts = append(parts, openai.ChatMessagePart{
-			Type: openai.ChatMessagePartTypeImageURL,
-			ImageURL: &openai.ChatMessageImageURL{
-				URL: imageURL,
+	for i, page := range pages {
+		parts = append(parts,
+			openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeText,
+				Text: fmt.Sprintf("This is Page %d.", pageNumbers[i]),
 			},
-		})
+			page.part(""),
+		)
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT4o,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:         openai.ChatMessageRoleUser,
-					MultiContent: parts,
-				},
-			},
-			ResponseFormat: &openai.ChatCompletionResponseFormat{
-				Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+	request := openai.ChatCompletionRequest{
+		Model: p.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:         openai.ChatMessageRoleUser,
+				MultiContent: parts,
 			},
 		},
-	)
+		ResponseFormat: responseFormat(p.model, "invoice", p.invoiceSchema),
+	}
+	started := time.Now()
+	resp, err := p.client.CreateChatCompletion(ctx, request)
+	TraceFrom(ctx).Record(PhaseExtraction, started, err)
 
 	if err != nil {
-		return nil, fmt.Errorf("detailed analysis request to OpenAI failed: %w", err)
+		return nil, fmt.Errorf("detailed analysis %w: %w", ErrOpenAIRequest, err)
 	}
+	usage.record(p.model, resp.Usage)
 	if len(resp.Choices) == 0 {
-		return nil, fmt.Errorf("OpenAI returned no choices for detailed analysis")
+		return nil, fmt.Errorf("%w: no choices returned for detailed analysis", ErrOpenAIRequest)
 	}
 
 	var invoice Invoice
-	err = json.Unmarshal([]byte(resp.Choices[0].Message.Content), &invoice)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal detailed analysis response: %w. Response: %s", err, resp.Choices[0].Message.Content)
-	}
+	if err := decodeResponse(ctx, p.client, request, resp.Choices[0].Message.Content, &invoice, p.repairAttempts, usage); err != nil {
+		return nil, fmt.Errorf("detailed analysis: %w: %w", ErrResponseParse, err)
+	}
+	// Источники полей необязательны: модели могут их не вернуть или указать несуществующие страницы
+	if invoice.Sources != nil && !invoice.Sources.restrictTo(pageNumbers) {
+		invoice.Sources = nil
+	}
+	invoice.Confidences = normalizeConfidences(invoice.Confidences)
+	invoice.Counterparty.NormalizeCountry() // До даты: порядок дня и месяца зависит от страны
+	invoice.normalizeDate()
+	invoice.normalizeTaxBreakdown()
+	invoice.normalizeDirection()
+	invoice.normalizeReferences()
+	invoice.normalizeCategory(p.categories)
+	invoice.Counterparty.NormalizeBankAccounts()
 
 	return &invoice, nil
 }
 
-// selectPagesForAnalysis выбирает до 4 страниц для анализа: 2 первые и 2 последние.
-func selectPagesForAnalysis(pageIndices []int) []int {
-	if len(pageIndices) <= 4 {
-		return pageIndices
-	}
-
-	sort.Ints(pageIndices)
-
-	selected := make(map[int]bool)
-	result := []int{}
-
-	// Добавляем первые 2
-	for _, idx := range pageIndices[:2] {
-		if !selected[idx] {
-			selected[idx] = true
-			result = append(result, idx)
+// sortedGroupIDs возвращает идентификаторы групп, упорядоченные по первой странице группы.
+func sortedGroupIDs(pageGroups map[string][]int) []string {
+	firstPage := func(pages []int) int {
+		min := -1
+		for _, p := range pages {
+			if min == -1 || p < min {
+				min = p
+			}
 		}
+		return min
 	}
-	// Добавляем последние 2
-	for _, idx := range pageIndices[len(pageIndices)-2:] {
-		if !selected[idx] {
-			selected[idx] = true
-			result = append(result, idx)
-		}
+	ids := make([]string, 0, len(pageGroups))
+	for id := range pageGroups {
+		ids = append(ids, id)
 	}
-
-	sort.Ints(result)
-	return result
+	sort.Slice(ids, func(i, j int) bool {
+		return firstPage(pageGroups[ids[i]]) < firstPage(pageGroups[ids[j]])
+	})
+	return ids
 }
 
 // --- Функции для создания промптов ---
@@ -245,24 +489,46 @@ Example response for 5 pages belonging to 2 invoices:
 }`
 }
 
-func buildDetailedPrompt(myCompany Counterparty) string {
+// buildDetailedPrompt строит промпт детального анализа; textLayer — страницы переданы текстовым слоем PDF,
+// а не изображениями. С категориями расходов модель дополнительно выбирает категорию инвойса.
+func buildDetailedPrompt(myCompany Counterparty, textLayer bool, categories []Category) string {
+	pages := "The following images are pages"
+	if textLayer {
+		pages = "The following texts are the extracted text layers of pages"
+	}
 	return fmt.Sprintf(`
-You are an expert accountant. The following images are pages from a SINGLE invoice. Analyze them together to extract information into a single JSON object.
+You are an expert accountant. %s from a SINGLE invoice. Analyze them together to extract information into a single JSON object.
 
 **Important Rules:**
 1.  **Find the overall total:** Look for the final, grand total amount across all pages. This is the most important value.
 2.  **Summarize the purpose:** For the 'purpose' field, provide a very short, 2-3 word summary (e.g., "продукты питания", "услуги сотовой связи", "мебель").
-3.  **Extract invoice details:**
-    *   "type": Use '1' for "Платежное поручение" (Invoice/Bill) or '2' for "Кассовый чек" (Receipt). This is an integer.
+%s3.  **Extract invoice details:**
+    *   "type": The document type as an integer:
+        *   1: "Платежное поручение" (Invoice/Bill): a final invoice asking to pay for goods or services, e.g. "Invoice", "Rechnung", "Счет", "Račun".
+        *   2: "Кассовый чек" (Receipt): a cash register or card payment receipt for a purchase that is already paid, e.g. a shop or fiscal receipt ("Fiskalni račun").
+        *   3: A credit note: a document that refunds or reduces a previous invoice, e.g. "Credit Note", "Gutschrift", "Корректировочный счет", "Knjižno odobrenje".
+        *   4: A proforma invoice: a preliminary invoice issued before delivery or payment, e.g. "Proforma Invoice", "Predračun", "Счет на предоплату".
+        *   5: A receipt for an advance payment: confirms a prepayment received before delivery, e.g. "Advance Payment Invoice", "Anzahlungsrechnung", "Avansni račun", "Счет-фактура на аванс".
+        *   0: Not an invoice at all: delivery notes, bank statements, contracts, price lists, cover letters. For type 0 only "type" matters; use empty strings and zeros for the other fields.
     *   "number": The invoice or receipt number.
-    *   "date": The invoice date, always formatted as **DD.MM.YYYY**.
-    *   "total_amount": The final, total amount as a float.
+    *   "reference": For credit notes, the number of the original invoice it refers to, if stated. Otherwise an empty string.
+    *   "order_reference": The buyer's purchase order number, if stated (labels like "PO", "PO #", "Purchase Order", "Order No.", "Bestellnummer", "Ihre Bestellung", "Заказ", "Номер заказа"). Only the number, without the label. Otherwise an empty string.
+    *   "contract_reference": The number of the contract or agreement the invoice is issued under, if stated (labels like "Contract", "Agreement", "Vertrag", "Vertragsnummer", "Договор", "по договору №"). Only the number, without the label or date. Otherwise an empty string.
+    *   "date": The invoice date, always formatted as **YYYY-MM-DD**.
+    *   "total_amount": The final, total amount as a float. For credit notes use the refunded amount as a positive number.
     *   "tax_amount": The total tax amount (e.g., VAT, НДС). If not present, use 0.
+    *   "tax_breakdown": If the invoice has a tax summary table, list one entry per tax rate with "rate" (percent, e.g. 20), "base" (taxable amount) and "amount" (tax). Omit if there is no such table.
     *   "currency": The 3-letter currency code (e.g., EUR, USD, RUB). If not explicitly stated, infer it from the counterparty's country.
-4.  **Identify the Counterparty (the *other* company, not ours):**
+    *   "direction": "incoming" if my company (see below) is the buyer or recipient of the document, "outgoing" if my company is the seller or issuer. Use an empty string if my company's details are empty or my company is neither party.
+    *   "sources": Each page is preceded by a marker like "This is Page X.". For "number", "date", "total_amount", "tax_amount" and "counterparty" give the page number X where you read that value. Use 0 if you are not sure.
+    *   "confidences": How sure you are about each value, from 0 (a guess) to 1 (clearly printed and unambiguous), for "number", "date", "total_amount", "tax_amount", "counterparty.name" and "counterparty.vat". Use a low score for values that are blurry, handwritten, inferred or chosen among several candidates.
+4.  **Identify the Counterparty (the *other* company, not ours):** for an outgoing invoice this is the buyer, otherwise the seller.
     *   **Required fields:** "name", "vat", "country", "address".
-    *   "country_code": The 3-letter ISO 3166-1 alpha-3 country code. If the country is not obvious, infer it from clues like the IBAN (first 2 letters), phone prefix, or website TLD.
+    *   "country": The country as printed on the invoice.
+    *   "country_code": The 2-letter ISO 3166-1 alpha-2 country code (e.g. DE, RU, RS, US). If the country is not obvious, infer it from clues like the IBAN (first 2 letters), phone prefix, or website TLD.
     *   **Optional fields:** If present, also extract "swift", "iban", "phone", "fax", "email", "website".
+    *   "vat", "tax_code2" and "registration_number" are different identifiers: never copy one into another and use an empty string for those not printed. "vat" is the tax or VAT number (RU: ИНН; RS: ПИБ/PIB; EU: VAT ID with the country prefix). "tax_code2" is a second tax code where the jurisdiction has one (RU: КПП), otherwise empty. "registration_number" is the company registration number (RU: ОГРН or ОГРНИП; RS: матични број/MB; UK: Company No.; DE: Handelsregister number).
+    *   "bank_accounts": List EVERY bank account of the counterparty printed on the invoice (suppliers often list several, e.g. EUR and USD accounts), each with "currency" (3-letter code, empty if not stated), "iban", "swift", "account_number" (only for accounts without an IBAN) and "bank_name". Put the account the invoice asks to pay to first. "iban" and "swift" above must repeat the first account.
 5.  **My company's details are for context only.** Do NOT extract them. My company is:
     *   Name: %s, VAT: %s, Country: %s, Address: %s
 6.  **Output format:** Respond ONLY with a single, valid JSON object.
@@ -271,156 +537,142 @@ Example JSON:
 {
   "type": 1,
   "number": "INV-12345",
-  "date": "27.10.2023",
+  "date": "2023-10-27",
   "total_amount": 1500.75,
   "tax_amount": 75.25,
+  "tax_breakdown": [
+    {"rate": 5, "base": 1425.50, "amount": 75.25}
+  ],
   "currency": "EUR",
+  "direction": "incoming",
   "purpose": "Лицензия на ПО",
+  "order_reference": "PO-4512",
+  "contract_reference": "15/2023",
+  "sources": {"number": 1, "date": 1, "total_amount": 3, "tax_amount": 3, "counterparty": 1},
+  "confidences": {"number": 0.98, "date": 0.95, "total_amount": 0.97, "tax_amount": 0.9, "counterparty.name": 0.95, "counterparty.vat": 0.6},
   "counterparty": {
     "name": "ООО 'ТехноСофт'",
-    "vat": "7701234567",
+    "vat": "7707083893",
+    "tax_code2": "773601001",
+    "registration_number": "1027700132195",
     "country": "Россия",
-    "country_code": "RUS",
+    "country_code": "RU",
     "address": "г. Москва, ул. Программистов, д. 1",
     "swift": "SABRRUMM",
     "iban": "RU40802810100000000001",
+    "bank_accounts": [
+      {"currency": "RUB", "iban": "RU40802810100000000001", "swift": "SABRRUMM", "account_number": "", "bank_name": "Сбербанк"},
+      {"currency": "USD", "iban": "", "swift": "SABRRUMM", "account_number": "40702840100000000002", "bank_name": "Сбербанк"}
+    ],
     "email": "contact@technosoft.com"
   }
 }
-`, myCompany.Name, myCompany.VAT, myCompany.Country, myCompany.Address)
+`, pages, buildCategoryPrompt(categories), myCompany.Name, myCompany.VAT, myCompany.Country, myCompany.Address)
 }
 
-// convertPDFToImages использует утилиту `pdftoppm` (из пакета poppler) для конвертации PDF в изображения.
-// **Требование:** Утилита `poppler` должна быть установлена в системе или указана в конфиге.
-func convertPDFToImages(pdfPath, popplerBinPath string) ([][]byte, error) {
-	// 1. Создаем временную директорию для изображений
-	tempDir, err := os.MkdirTemp("", "invpa-pages-")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp dir: %w", err)
-	}
-	defer os.RemoveAll(tempDir)
-
-	// 2. Определяем путь к pdftoppm
-	cmdName := "pdftoppm"
-	if popplerBinPath != "" {
-		// Если в конфиге указан путь, используем его.
-		// Это позволяет пользователю указать любое расположение poppler.
-		cmdName = filepath.Join(popplerBinPath, cmdName)
-	}
+// --- Новые функции для сопоставления контрагентов ---
 
-	// 3. Выполняем команду `pdftoppm`
-	cmd := exec.Command(cmdName, "-png", pdfPath, filepath.Join(tempDir, "page"))
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("pdftoppm command failed. Is poppler installed and in PATH, or configured in config.json? Error: %w. Output: %s", err, string(output))
-	}
+// FindCounterparty находит существующего контрагента, соответствующего новому,
+// используя OpenAI для "умного" сопоставления.
+// Возвращает обновленного контрагента или nil, если совпадение не найдено,
+// а также статистику использования OpenAI API.
+func FindCounterparty(client ChatClient, existingCounterparties []Counterparty, newCounterparty Counterparty) (*Counterparty, Usage, error) {
+	result, err := FindCounterpartyExplained(client, existingCounterparties, newCounterparty)
+	return result.Counterparty, result.Usage, err
+}
 
-	// 4. Читаем созданные файлы
-	files, err := os.ReadDir(tempDir)
+// FindCounterpartyExplained аналогичен FindCounterparty, но дополнительно объясняет результат:
+// почему выбран совпавший контрагент и какие еще контрагенты были похожи (см. MatchExplanation).
+func FindCounterpartyExplained(client ChatClient, existingCounterparties []Counterparty, newCounterparty Counterparty) (MatchResult, error) {
+	index, reason, usage, err := matchCounterparty(context.Background(), client, openai.GPT4o, promptSet{}, existingCounterparties, newCounterparty)
+	result := MatchResult{Index: index, Usage: usage}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read temp dir: %w", err)
-	}
-
-	var imageContents [][]byte
-	// Сортируем файлы, чтобы страницы шли по порядку
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() < files[j].Name()
-	})
-
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".png") {
-			content, err := os.ReadFile(filepath.Join(tempDir, file.Name()))
-			if err != nil {
-				return nil, fmt.Errorf("failed to read generated image %s: %w", file.Name(), err)
-			}
-			imageContents = append(imageContents, content)
-		}
+		result.Index = -1
+		return result, err
 	}
-
-	if len(imageContents) == 0 {
-		return nil, fmt.Errorf("pdftoppm did not generate any images")
+	result.Explanation = explainMatch(existingCounterparties, newCounterparty, index, reason)
+	if index >= 0 {
+		updatedCounterparty := MergeCounterparties(existingCounterparties[index], newCounterparty)
+		result.Counterparty = &updatedCounterparty
 	}
+	return result, nil
+}
 
-	return imageContents, nil
+// MatchCounterparty возвращает индекс контрагента из existingCounterparties,
+// соответствующего новому, или -1, если совпадение не найдено.
+// Сначала проверяется точное совпадение по имени или алиасу (без запроса к API),
+// затем используется OpenAI.
+func MatchCounterparty(client ChatClient, existingCounterparties []Counterparty, newCounterparty Counterparty) (int, Usage, error) {
+	index, _, usage, err := matchCounterparty(context.Background(), client, openai.GPT4o, promptSet{}, existingCounterparties, newCounterparty)
+	return index, usage, err
 }
 
-// --- Новые функции для сопоставления контрагентов ---
+// MatchCounterparty аналогичен функции MatchCounterparty, но использует модель процессора и контекст.
+func (p *Processor) MatchCounterparty(ctx context.Context, existingCounterparties []Counterparty, newCounterparty Counterparty) (int, Usage, error) {
+	index, _, usage, err := matchCounterparty(ctx, p.client, p.model, p.prompts(), existingCounterparties, newCounterparty)
+	return index, usage, err
+}
 
-// FindCounterparty находит существующего контрагента, соответствующего новому,
-// используя OpenAI для "умного" сопоставления.
-// Возвращает обновленного контрагента или nil, если совпадение не найдено.
-func FindCounterparty(client *openai.Client, existingCounterparties []Counterparty, newCounterparty Counterparty) (*Counterparty, error) {
+func matchCounterparty(ctx context.Context, client ChatClient, model string, prompts promptSet, existingCounterparties []Counterparty, newCounterparty Counterparty) (int, string, Usage, error) {
+	var usage Usage
 	if len(existingCounterparties) == 0 {
-		return nil, nil
+		return -1, "", usage, nil
+	}
+
+	// 0. Локальный предфильтр по имени, алиасам и общему банковскому счету
+	if index := matchLocally(existingCounterparties, newCounterparty); index >= 0 {
+		return index, "", usage, nil
+	}
+	// Без клиента (деградированный режим) остается только локальное сопоставление
+	if noClient(client) {
+		return -1, "", usage, nil
 	}
 
 	// 1. Подготовить данные для промпта. Используем индекс среза как временный ID.
-	type PromptCounterparty struct {
-		Index   int    `json:"index"`
-		Name    string `json:"name"`
-		VAT     string `json:"vat"`
-		Country string `json:"country"`
-		Address string `json:"address"`
-		IBAN    string `json:"iban,omitempty"`
-		Website string `json:"website,omitempty"`
-		Phone   string `json:"phone,omitempty"`
-	}
-
-	promptList := make([]PromptCounterparty, len(existingCounterparties))
+	promptList := make([]promptCounterparty, len(existingCounterparties))
 	for i, cp := range existingCounterparties {
-		promptList[i] = PromptCounterparty{
-			Index:   i,
-			Name:    cp.Name,
-			VAT:     cp.VAT,
-			Country: cp.Country,
-			Address: cp.Address,
-			IBAN:    cp.IBAN,
-			Website: cp.Website,
-			Phone:   cp.Phone,
-		}
+		promptList[i] = newPromptCounterparty(i, cp)
 	}
 
 	existingJSON, err := json.Marshal(promptList)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal existing counterparties for prompt: %w", err)
+		return -1, "", usage, fmt.Errorf("failed to marshal existing counterparties for prompt: %w", err)
 	}
 	newJSON, err := json.Marshal(newCounterparty)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal new counterparty: %w", err)
+		return -1, "", usage, fmt.Errorf("failed to marshal new counterparty: %w", err)
 	}
 
 	// 2. Создать промпт
-	prompt := buildMatchingPrompt(string(existingJSON), string(newJSON))
+	prompt, err := prompts.matching(string(existingJSON), string(newJSON), false)
+	if err != nil {
+		return -1, "", usage, err
+	}
 
 	// 3. Отправить запрос в OpenAI
 	resp, err := client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
-			Model: openai.GPT4o,
+			Model: model,
 			Messages: []openai.ChatCompletionMessage{
 				{
 					Role:    openai.ChatMessageRoleUser,
 					Content: prompt,
 				},
 			},
-			ResponseFormat: &openai.ChatCompletionResponseFormat{
-				Type: openai.ChatCompletionResponseFormatTypeJSONObject,
-			},
+			ResponseFormat: responseFormat(model, "counterparty_match", matchSchema),
 		},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("matching request to OpenAI failed: %w", err)
+		return -1, "", usage, fmt.Errorf("matching request to OpenAI failed: %w", err)
 	}
+	usage.record(model, resp.Usage)
 	if len(resp.Choices) == 0 {
-		return nil, fmt.Errorf("OpenAI returned no choices for matching")
+		return -1, "", usage, fmt.Errorf("OpenAI returned no choices for matching")
 	}
 
 	// 4. Распарсить ответ
-	type MatchResponse struct {
-		MatchFound   bool `json:"match_found"`
-		MatchedIndex int  `json:"matched_index"` // Получаем индекс, а не ID
-	}
-	var match MatchResponse
+	var match matchResponse
 	err = json.Unmarshal([]byte(resp.Choices[0].Message.Content), &match)
 	if err != nil {
 		// Если не удалось распарсить, проверяем на старый формат ответа для обратной совместимости
@@ -431,24 +683,21 @@ func FindCounterparty(client *openai.Client, existingCounterparties []Counterpar
 		var oldMatch OldMatchResponse
 		if json.Unmarshal([]byte(resp.Choices[0].Message.Content), &oldMatch) == nil && oldMatch.MatchFound {
 			// Это старый ответ, мы не можем его обработать с uint64. Считаем, что совпадений нет.
-			return nil, nil
+			return -1, "", usage, nil
 		}
-		return nil, fmt.Errorf("failed to unmarshal matching response: %w. Response: %s", err, resp.Choices[0].Message.Content)
+		return -1, "", usage, fmt.Errorf("failed to unmarshal matching response: %w. Response: %s", err, resp.Choices[0].Message.Content)
 	}
 
 	// 5. Если совпадение найдено
 	if match.MatchFound {
 		if match.MatchedIndex >= 0 && match.MatchedIndex < len(existingCounterparties) {
-			// a. Нашли контрагента по индексу, дополняем его данные
-			existing := existingCounterparties[match.MatchedIndex]
-			updatedCounterparty := mergeCounterparties(existing, newCounterparty)
-			return &updatedCounterparty, nil
+			return match.MatchedIndex, match.Reason, usage, nil
 		}
-		return nil, fmt.Errorf("AI found a match with index '%d' but this index is out of bounds", match.MatchedIndex)
+		return -1, "", usage, fmt.Errorf("AI found a match with index '%d' but this index is out of bounds", match.MatchedIndex)
 	}
 
 	// 6. Если совпадение не найдено
-	return nil, nil
+	return -1, "", usage, nil
 }
 
 func buildMatchingPrompt(existingJSON, newJSON string) string {
@@ -456,8 +705,9 @@ func buildMatchingPrompt(existingJSON, newJSON string) string {
 You are a data deduplication system. Your task is to find the most likely candidate from a list of existing counterparties ('existing_list') that matches a new counterparty entry ('new_entry').
 
 **Matching Rules:**
-1.  **High-confidence identifiers:** A match in 'vat', 'iban', 'website', or 'phone' is a very strong signal that it's the same entity.
-2.  **Name field:** The 'name' field is also important, but be aware of abbreviations, missing legal forms (like LLC, Inc.), or minor variations.
+1.  **High-confidence identifiers:** A match in 'vat', 'registration_number', any IBAN or bank account number ('accounts' in 'existing_list'; 'iban' and 'bank_accounts' in 'new_entry'), 'website', or 'phone' is a very strong signal that it's the same entity. 'tax_code2' (e.g. Russian КПП) is shared by many companies and only confirms a match found by other fields.
+2.  **Name field:** The 'name' field is also important, but be aware of abbreviations, missing legal forms (like LLC, Inc.), or minor variations. The 'aliases' field lists other names already known for the same counterparty.
+    Compare countries by 'country_code' (ISO 3166-1 alpha-2), not by the 'country' spelling, which depends on the invoice language: different country codes are a strong signal against a match.
 3.  **Index is key:** The 'index' field in the 'existing_list' is the unique temporary identifier for this operation.
 
 **Your Task:**
@@ -473,14 +723,48 @@ If no confident match is found, indicate that.
 Respond ONLY with a single, valid JSON object with the following structure:
 {
   "match_found": true,  // boolean: true if a match was found, otherwise false
-  "matched_index": 1    // integer: the 'index' of the matched counterparty from 'existing_list'. Use -1 if no match.
+  "matched_index": 1,   // integer: the 'index' of the matched counterparty from 'existing_list'. Use -1 if no match.
+  "reason": "VAT equal" // string: a few words on why they match (e.g. "VAT equal", "same IBAN, similar name"). Empty if no match.
 }
 `, existingJSON, newJSON)
 }
 
-// mergeCounterparties объединяет данные двух контрагентов.
+// promptCounterparty — данные контрагента, передаваемые модели при сопоставлении.
+type promptCounterparty struct {
+	Index              int      `json:"index"`
+	Name               string   `json:"name"`
+	VAT                string   `json:"vat"`
+	TaxCode2           string   `json:"tax_code2,omitempty"`
+	RegistrationNumber string   `json:"registration_number,omitempty"`
+	Country            string   `json:"country"`
+	CountryCode        string   `json:"country_code,omitempty"`
+	Address            string   `json:"address"`
+	Accounts           []string `json:"accounts,omitempty"` // IBAN или номера всех счетов
+	Website            string   `json:"website,omitempty"`
+	Phone              string   `json:"phone,omitempty"`
+	Aliases            []string `json:"aliases,omitempty"`
+}
+
+func newPromptCounterparty(index int, cp Counterparty) promptCounterparty {
+	return promptCounterparty{
+		Index:              index,
+		Name:               cp.Name,
+		VAT:                cp.VAT,
+		TaxCode2:           cp.TaxCode2,
+		RegistrationNumber: cp.RegistrationNumber,
+		Country:            cp.Country,
+		CountryCode:        cp.CountryCode,
+		Address:            cp.Address,
+		Accounts:           accountNumbers(cp),
+		Website:            cp.Website,
+		Phone:              cp.Phone,
+		Aliases:            cp.Aliases,
+	}
+}
+
+// MergeCounterparties объединяет данные двух контрагентов.
 // Данные из 'newData' имеют приоритет, если поле в 'existing' пустое.
-func mergeCounterparties(existing, newData Counterparty) Counterparty {
+func MergeCounterparties(existing, newData Counterparty) Counterparty {
 	merged := existing
 
 	// Мы не обновляем Name, Country, Address, так как они могут быть более точными в базе
@@ -488,11 +772,16 @@ func mergeCounterparties(existing, newData Counterparty) Counterparty {
 	if merged.VAT == "" && newData.VAT != "" {
 		merged.VAT = newData.VAT
 	}
-	if merged.SWIFT == "" && newData.SWIFT != "" {
-		merged.SWIFT = newData.SWIFT
+	if merged.TaxCode2 == "" && newData.TaxCode2 != "" {
+		merged.TaxCode2 = newData.TaxCode2
 	}
-	if merged.IBAN == "" && newData.IBAN != "" {
-		merged.IBAN = newData.IBAN
+	if merged.RegistrationNumber == "" && newData.RegistrationNumber != "" {
+		merged.RegistrationNumber = newData.RegistrationNumber
+	}
+	// Счета объединяются по IBAN или номеру, основным остается счет из 'existing'
+	merged.BankAccounts = existing.Accounts()
+	for _, account := range newData.Accounts() {
+		merged.AddBankAccount(account)
 	}
 	if merged.Phone == "" && newData.Phone != "" {
 		merged.Phone = newData.Phone
@@ -506,6 +795,13 @@ func mergeCounterparties(existing, newData Counterparty) Counterparty {
 	if merged.Website == "" && newData.Website != "" {
 		merged.Website = newData.Website
 	}
+	merged.mergeCurrencies(newData)
+	// Запоминаем альтернативное наименование, чтобы в следующий раз найти его без запроса к API
+	merged.Aliases = append([]string(nil), existing.Aliases...)
+	merged.AddAlias(newData.Name)
+	for _, alias := range newData.Aliases {
+		merged.AddAlias(alias)
+	}
 
 	return merged
 }
@@ -0,0 +1,145 @@
+package invoice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+// PromptData — данные, доступные шаблонам промптов (см. PromptTemplates).
+type PromptData struct {
+	MyCompany    Counterparty
+	Categories   []Category // Категории расходов; пусто — без категорий
+	TextLayer    bool       // Детальный анализ: страницы переданы текстовым слоем PDF, а не изображениями
+	Batch        bool       // Сопоставление: пакетный промпт (new_entries) вместо одного контрагента (new_entry)
+	ExistingJSON string     // Сопоставление: существующие контрагенты в JSON
+	NewJSON      string     // Сопоставление: новый контрагент или список новых контрагентов в JSON
+	Default      string     // Встроенный промпт для тех же данных, чтобы шаблон мог дополнить его, а не переписывать
+}
+
+// PromptTemplates — промпты группировки страниц, детального анализа и сопоставления контрагентов
+// из внешних шаблонов text/template. Незаданный шаблон заменяется встроенным промптом. Ответ модели
+// по-прежнему проверяется JSON Schema, поэтому шаблон должен сохранять формат ответа встроенного промпта;
+// проще всего дописать к {{.Default}} свои правила и примеры.
+type PromptTemplates struct {
+	grouping *template.Template
+	detailed *template.Template
+	matching *template.Template
+	hash     string // Хэш исходных текстов шаблонов для ключа кэша результатов
+}
+
+// LoadPromptTemplates читает и проверяет шаблоны промптов из файлов; пустой путь — встроенный промпт.
+// Каждый шаблон пробно выполняется, чтобы ошибки в именах полей обнаруживались при запуске, а не
+// на первом файле. Если ни один путь не задан, возвращает nil (встроенные промпты).
+func LoadPromptTemplates(groupingPath, detailedPath, matchingPath string) (*PromptTemplates, error) {
+	if groupingPath == "" && detailedPath == "" && matchingPath == "" {
+		return nil, nil
+	}
+	t := &PromptTemplates{}
+	sum := sha256.New()
+	for _, source := range []struct {
+		name string
+		path string
+		dst  **template.Template
+	}{
+		{"grouping", groupingPath, &t.grouping},
+		{"detailed", detailedPath, &t.detailed},
+		{"matching", matchingPath, &t.matching},
+	} {
+		if source.path == "" {
+			continue
+		}
+		text, err := os.ReadFile(source.path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the %s prompt template: %w", source.name, err)
+		}
+		tmpl, err := template.New(source.name).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s prompt template %s: %w", source.name, source.path, err)
+		}
+		if _, err := executePrompt(tmpl, samplePromptData); err != nil {
+			return nil, fmt.Errorf("invalid %s prompt template %s: %w", source.name, source.path, err)
+		}
+		*source.dst = tmpl
+		fmt.Fprintf(sum, "%s\x00%s\x00", source.name, text)
+	}
+	t.hash = hex.EncodeToString(sum.Sum(nil))
+	return t, nil
+}
+
+// Hash возвращает хэш шаблонов; для встроенных промптов — пустую строку.
+func (t *PromptTemplates) Hash() string {
+	if t == nil {
+		return ""
+	}
+	return t.hash
+}
+
+// samplePromptData — данные для пробного выполнения шаблонов в LoadPromptTemplates.
+var samplePromptData = PromptData{
+	MyCompany:    Counterparty{Name: "My Company"},
+	Categories:   []Category{{ID: "other", Label: "Other"}},
+	ExistingJSON: "[]",
+	NewJSON:      "{}",
+}
+
+func executePrompt(tmpl *template.Template, data PromptData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// promptSet строит промпты процессора: встроенные или из шаблонов. Нулевое значение дает встроенные промпты.
+type promptSet struct {
+	templates  *PromptTemplates
+	myCompany  Counterparty
+	categories []Category
+}
+
+func (s promptSet) render(tmpl *template.Template, data PromptData) (string, error) {
+	if tmpl == nil {
+		return data.Default, nil
+	}
+	data.MyCompany, data.Categories = s.myCompany, s.categories
+	prompt, err := executePrompt(tmpl, data)
+	if err != nil {
+		return "", fmt.Errorf("%s prompt template: %w", tmpl.Name(), err)
+	}
+	return prompt, nil
+}
+
+func (s promptSet) grouping() (string, error) {
+	var tmpl *template.Template
+	if s.templates != nil {
+		tmpl = s.templates.grouping
+	}
+	return s.render(tmpl, PromptData{Default: buildGroupingPrompt()})
+}
+
+func (s promptSet) detailed(textLayer bool) (string, error) {
+	var tmpl *template.Template
+	if s.templates != nil {
+		tmpl = s.templates.detailed
+	}
+	return s.render(tmpl, PromptData{TextLayer: textLayer, Default: buildDetailedPrompt(s.myCompany, textLayer, s.categories)})
+}
+
+// matching строит промпт сопоставления одного контрагента или, при batch, пакета контрагентов.
+func (s promptSet) matching(existingJSON, newJSON string, batch bool) (string, error) {
+	var tmpl *template.Template
+	if s.templates != nil {
+		tmpl = s.templates.matching
+	}
+	data := PromptData{Batch: batch, ExistingJSON: existingJSON, NewJSON: newJSON}
+	if batch {
+		data.Default = buildBatchMatchingPrompt(existingJSON, newJSON)
+	} else {
+		data.Default = buildMatchingPrompt(existingJSON, newJSON)
+	}
+	return s.render(tmpl, data)
+}
@@ -0,0 +1,227 @@
+package invoice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/makiuchi-d/gozxing"
+	multiqr "github.com/makiuchi-d/gozxing/multi/qrcode"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// Форматы платежных QR-кодов (PaymentQR.Format).
+const (
+	PaymentQREPC   = "epc"   // SEPA Credit Transfer, EPC069-12 ("GiroCode")
+	PaymentQRSwiss = "swiss" // Swiss QR-bill (Swiss Payment Standards)
+)
+
+// SourceMethodQR — значение Invoice.SourceMethod: сумма, валюта и реквизиты получателя взяты из платежного QR-кода.
+const SourceMethodQR = "qr"
+
+// paymentQRVersion входит в ключ кэша результатов, чтобы результаты, извлеченные без поиска
+// платежных QR-кодов, не переиспользовались.
+const paymentQRVersion = 1
+
+// qrMaxDim — большая сторона изображения, до которой уменьшается страница перед поиском QR-кода.
+// Страницы PDF (150 DPI) уже меньше; уменьшаются в основном фотографии, чтобы поиск не замедлял обработку.
+const qrMaxDim = 2000
+
+// PaymentQR — платежные данные из QR-кода на странице инвойса. В отличие от распознавания модели
+// они точны, поэтому заменяют извлеченные сумму, валюту, IBAN и наименование получателя.
+type PaymentQR struct {
+	Format    string  // PaymentQREPC или PaymentQRSwiss
+	IBAN      string  // IBAN получателя
+	BIC       string  // BIC банка получателя (только EPC, необязателен)
+	Creditor  string  // Наименование получателя
+	Country   string  // Код страны получателя ISO 3166-1 alpha-2 (только Swiss QR-bill)
+	Amount    float64 // Сумма; 0 — не указана (плательщик вводит ее сам)
+	Currency  string  // EUR для EPC; CHF или EUR для Swiss QR-bill
+	Reference string  // Структурированная ссылка платежа (RF-ссылка или QR-ссылка)
+	Message   string  // Неструктурированное сообщение плательщику
+}
+
+// ParsePaymentQR разбирает содержимое платежного QR-кода EPC069-12 или Swiss QR-bill.
+func ParsePaymentQR(payload string) (PaymentQR, error) {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimPrefix(payload, "\ufeff"), "\r\n", "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	switch lines[0] {
+	case "BCD":
+		return parseEPCQR(lines)
+	case "SPC":
+		return parseSwissQR(lines)
+	}
+	return PaymentQR{}, errors.New("not a payment QR code")
+}
+
+// parseEPCQR разбирает строки QR-кода EPC069-12: BCD, версия, кодировка, SCT, BIC, получатель, IBAN,
+// сумма (EUR12.30), назначение, структурированная ссылка, текст.
+func parseEPCQR(lines []string) (PaymentQR, error) {
+	field := func(i int) string {
+		if i < len(lines) {
+			return lines[i]
+		}
+		return ""
+	}
+	if field(1) != "001" && field(1) != "002" {
+		return PaymentQR{}, fmt.Errorf("unsupported EPC QR version %q", field(1))
+	}
+	if field(3) != "SCT" {
+		return PaymentQR{}, fmt.Errorf("unsupported EPC QR identification %q", field(3))
+	}
+	qr := PaymentQR{
+		Format:    PaymentQREPC,
+		BIC:       field(4),
+		Creditor:  field(5),
+		IBAN:      normalizeAccount(field(6)),
+		Currency:  "EUR",
+		Reference: field(9),
+		Message:   field(10),
+	}
+	if amount := field(7); amount != "" {
+		if len(amount) < 4 || !strings.EqualFold(amount[:3], "EUR") {
+			return PaymentQR{}, fmt.Errorf("invalid EPC QR amount %q", amount)
+		}
+		value, err := strconv.ParseFloat(amount[3:], 64)
+		if err != nil || value < 0 {
+			return PaymentQR{}, fmt.Errorf("invalid EPC QR amount %q", amount)
+		}
+		qr.Amount = value
+	}
+	return qr, qr.validate()
+}
+
+// parseSwissQR разбирает строки Swiss QR-bill: SPC, версия, кодировка, IBAN, получатель (7 строк),
+// конечный получатель (7 строк), сумма, валюта, плательщик (7 строк), тип ссылки, ссылка, сообщение, EPD.
+func parseSwissQR(lines []string) (PaymentQR, error) {
+	if len(lines) < 31 {
+		return PaymentQR{}, fmt.Errorf("Swiss QR-bill has %d lines, expected at least 31", len(lines))
+	}
+	if !strings.HasPrefix(lines[1], "02") {
+		return PaymentQR{}, fmt.Errorf("unsupported Swiss QR-bill version %q", lines[1])
+	}
+	if lines[30] != "EPD" {
+		return PaymentQR{}, errors.New("Swiss QR-bill trailer EPD is missing")
+	}
+	qr := PaymentQR{
+		Format:    PaymentQRSwiss,
+		IBAN:      normalizeAccount(lines[3]),
+		Creditor:  lines[5],
+		Country:   strings.ToUpper(lines[10]),
+		Currency:  strings.ToUpper(lines[19]),
+		Reference: lines[28],
+		Message:   lines[29],
+	}
+	if qr.Currency != "CHF" && qr.Currency != "EUR" {
+		return PaymentQR{}, fmt.Errorf("invalid Swiss QR-bill currency %q", lines[19])
+	}
+	if lines[18] != "" {
+		value, err := strconv.ParseFloat(lines[18], 64)
+		if err != nil || value < 0 {
+			return PaymentQR{}, fmt.Errorf("invalid Swiss QR-bill amount %q", lines[18])
+		}
+		qr.Amount = value
+	}
+	return qr, qr.validate()
+}
+
+func (qr PaymentQR) validate() error {
+	if qr.Creditor == "" {
+		return errors.New("payment QR code has no creditor name")
+	}
+	return ValidateIBAN(qr.IBAN)
+}
+
+// findPaymentQR ищет платежный QR-код на изображениях страниц по порядку и возвращает первый
+// разобранный код и номер его страницы (с 1). Остальные QR-коды (ссылки, коды посылок) пропускаются.
+func findPaymentQR(images map[int][]byte, pages []int) (PaymentQR, int, bool) {
+	for _, page := range pages {
+		for _, payload := range decodeQRCodes(images[page]) {
+			if qr, err := ParsePaymentQR(payload); err == nil {
+				return qr, page, true
+			}
+		}
+	}
+	return PaymentQR{}, 0, false
+}
+
+// decodeQRCodes возвращает содержимое всех QR-кодов на изображении. Ошибка декодирования
+// (нет кодов, поврежденный код или изображение) означает пустой результат.
+func decodeQRCodes(imageData []byte) []string {
+	if len(imageData) == 0 {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil
+	}
+	if bounds := img.Bounds(); max(bounds.Dx(), bounds.Dy()) > qrMaxDim {
+		img = downscale(img, qrMaxDim)
+	}
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return nil
+	}
+	// Без TRY_HARDER поиск нескольких кодов пропускает часть кодов, которые находит поиск одного
+	hints := map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_TRY_HARDER: true}
+	results, err := multiqr.NewQRCodeMultiReader().DecodeMultiple(bitmap, hints)
+	if err != nil || len(results) == 0 {
+		result, err := qrcode.NewQRCodeReader().Decode(bitmap, hints)
+		if err != nil {
+			return nil
+		}
+		results = []*gozxing.Result{result}
+	}
+	payloads := make([]string, len(results))
+	for i, result := range results {
+		payloads[i] = result.GetText()
+	}
+	return payloads
+}
+
+// applyPaymentQR заменяет сумму и валюту инвойса данными QR-кода, а если получатель платежа —
+// контрагент, то и его наименование и основной счет. Если получатель — своя компания (исходящий
+// инвойс), контрагент не меняется. Кредит-ноты не меняются: QR-код на них не относится к сумме документа.
+// Возвращает описание расхождений с извлеченными значениями.
+func (inv *Invoice) applyPaymentQR(qr PaymentQR, myCompany Counterparty) []string {
+	if inv.Type == TypeCreditNote {
+		return nil
+	}
+	var changes []string
+	if qr.Amount > 0 {
+		if inv.TotalAmount != qr.Amount {
+			changes = append(changes, fmt.Sprintf("total %v -> %v", inv.TotalAmount, qr.Amount))
+		}
+		inv.TotalAmount = qr.Amount
+	}
+	if !strings.EqualFold(inv.Currency, qr.Currency) {
+		changes = append(changes, fmt.Sprintf("currency %q -> %q", inv.Currency, qr.Currency))
+	}
+	inv.Currency = qr.Currency
+	ownAccount := false
+	for _, number := range accountNumbers(myCompany) {
+		ownAccount = ownAccount || normalizeAccount(number) == qr.IBAN
+	}
+	if !ownAccount && inv.Direction != DirectionOutgoing {
+		cp := &inv.Counterparty
+		if cp.Name != qr.Creditor {
+			changes = append(changes, fmt.Sprintf("counterparty %q -> %q", cp.Name, qr.Creditor))
+		}
+		cp.Name = qr.Creditor
+		if normalizeAccount(cp.IBAN) != qr.IBAN {
+			changes = append(changes, fmt.Sprintf("IBAN %q -> %q", cp.IBAN, qr.IBAN))
+		}
+		cp.setPrimaryAccount(BankAccount{Currency: qr.Currency, IBAN: qr.IBAN, SWIFT: qr.BIC})
+		if cp.CountryCode == "" && qr.Country != "" {
+			cp.CountryCode = qr.Country
+		}
+	}
+	inv.PaymentReference = qr.Reference
+	inv.SourceMethod = SourceMethodQR
+	return changes
+}
@@ -0,0 +1,162 @@
+package invoice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// throttleThreshold — ожидание ограничителя, начиная с которого запрос считается придержанным (Processor.Throttled).
+const throttleThreshold = 500 * time.Millisecond
+
+// RequestLimiter ограничивает запросы к модели. Реализацию можно подменить (WithRequestLimiter),
+// например, чтобы проверять ограничение без реального ожидания.
+type RequestLimiter interface {
+	// Acquire ждет разрешения на запрос или отмены ctx и возвращает функцию, которую нужно вызвать
+	// по завершении запроса, и время ожидания.
+	Acquire(ctx context.Context) (release func(), waited time.Duration, err error)
+}
+
+// RateLimiter ограничивает частоту запросов к модели (token bucket) и, если задано, число запросов,
+// выполняемых одновременно. Один ограничитель разделяется всеми воркерами пакета и сопоставлением
+// контрагентов, поэтому лимит общий; веб-сервер передает один ограничитель всем заданиям процесса.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // Время пополнения одного токена; 0 — частота не ограничена
+	burst    float64       // Емкость корзины
+	tokens   float64
+	last     time.Time
+	slots    chan struct{} // Свободные места для одновременных запросов; nil — без ограничения
+}
+
+// NewRateLimiter создает ограничитель на perMinute запросов в минуту, из которых до burst можно
+// отправить подряд (burst < 1 — по одному). perMinute <= 0 — без ограничения (nil).
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return newRateLimiter(perMinute, burst, 0)
+}
+
+// NewRequestLimiter создает ограничитель на perMinute запросов в минуту (по одному подряд) и не более
+// maxConcurrent одновременных запросов. Нулевое или отрицательное значение снимает соответствующее
+// ограничение; если сняты оба, возвращает nil.
+func NewRequestLimiter(perMinute, maxConcurrent int) *RateLimiter {
+	if perMinute <= 0 && maxConcurrent <= 0 {
+		return nil
+	}
+	return newRateLimiter(perMinute, 1, maxConcurrent)
+}
+
+func newRateLimiter(perMinute, burst, maxConcurrent int) *RateLimiter {
+	burst = max(burst, 1)
+	l := &RateLimiter{
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+	if perMinute > 0 {
+		l.interval = time.Minute / time.Duration(perMinute)
+	}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// Wait ждет свободного токена или отмены ctx. Ограничение одновременных запросов Wait не учитывает,
+// для него нужен Acquire.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.burst, l.tokens+float64(now.Sub(l.last))/float64(l.interval))
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) * float64(l.interval))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Acquire ждет свободного места для одновременного запроса, затем токена частоты.
+func (l *RateLimiter) Acquire(ctx context.Context) (func(), time.Duration, error) {
+	started := time.Now()
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		case <-ctx.Done():
+			return nil, time.Since(started), ctx.Err()
+		}
+	}
+	if err := l.Wait(ctx); err != nil {
+		release()
+		return nil, time.Since(started), err
+	}
+	return release, time.Since(started), nil
+}
+
+// throttleStats накапливает запросы, придержанные ограничителем.
+type throttleStats struct {
+	requests atomic.Int64
+	wait     atomic.Int64 // Суммарное ожидание в наносекундах
+}
+
+func (s *throttleStats) record(waited time.Duration) {
+	if s == nil || waited < throttleThreshold {
+		return
+	}
+	s.requests.Add(1)
+	s.wait.Add(int64(waited))
+}
+
+// rateLimitedClient ждет разрешения ограничителя перед каждым запросом.
+type rateLimitedClient struct {
+	ChatClient
+	limiter   RequestLimiter
+	throttled *throttleStats // nil — ожидание не учитывается
+}
+
+func (c rateLimitedClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	release, waited, err := c.limiter.Acquire(ctx)
+	c.throttled.record(waited)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer release()
+	return c.ChatClient.CreateChatCompletion(ctx, request)
+}
+
+// RateLimitedClient возвращает клиента, который отправляет запросы client не чаще, чем разрешает limiter.
+// Без клиента или ограничителя client возвращается как есть.
+func RateLimitedClient(client ChatClient, limiter *RateLimiter) ChatClient {
+	if noClient(client) || limiter == nil {
+		return client
+	}
+	return rateLimitedClient{ChatClient: client, limiter: limiter}
+}
+
+// Throttled возвращает число запросов процессора, которые ограничитель (WithRateLimiter, WithRequestLimiter)
+// придержал заметное время, и суммарное время их ожидания.
+func (p *Processor) Throttled() (int, time.Duration) {
+	return int(p.throttled.requests.Load()), time.Duration(p.throttled.wait.Load())
+}
@@ -0,0 +1,97 @@
+package invoice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// DefaultJSONRepairAttempts — число попыток исправить неразбираемый JSON-ответ модели по умолчанию.
+const DefaultJSONRepairAttempts = 1
+
+// responseParseError — ответ модели, который не удалось разобрать даже после попыток исправления.
+// Текст ошибки содержит исходный ответ и все исправленные варианты.
+type responseParseError struct {
+	err      error
+	original string
+	repaired []string
+}
+
+func (e *responseParseError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v. Response: %s", e.err, e.original)
+	for i, content := range e.repaired {
+		fmt.Fprintf(&b, ". Repaired response %d: %s", i+1, content)
+	}
+	return b.String()
+}
+
+func (e *responseParseError) Unwrap() error {
+	return e.err
+}
+
+// stripJSONWrappers убирает типичные обертки вокруг JSON в ответе модели: блок ```json ... ```
+// и текст до первой и после последней фигурной скобки.
+func stripJSONWrappers(content string) string {
+	content = strings.TrimSpace(content)
+	if rest, ok := strings.CutPrefix(content, "```"); ok {
+		// Первая строка блока — язык (json), ее пропускаем
+		if newline := strings.IndexByte(rest, '\n'); newline >= 0 {
+			rest = rest[newline+1:]
+		}
+		content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "```"))
+	}
+	start, end := strings.IndexByte(content, '{'), strings.LastIndexByte(content, '}')
+	if start > 0 && end > start {
+		content = content[start : end+1]
+	}
+	return content
+}
+
+// decodeResponse разбирает JSON-ответ модели content на запрос request в v. Если ответ не разбирается,
+// модели до attempts раз отправляется продолжение диалога с ее ответом и ошибкой разбора с просьбой
+// вернуть исправленный JSON. Использование API на исправление учитывается в usage.
+func decodeResponse(ctx context.Context, client ChatClient, request openai.ChatCompletionRequest, content string, v any, attempts int, usage *Usage) error {
+	err := json.Unmarshal([]byte(stripJSONWrappers(content)), v)
+	if err == nil {
+		return nil
+	}
+	parseErr := &responseParseError{err: err, original: content}
+	for attempt := 0; attempt < attempts && !noClient(client) && ctx.Err() == nil; attempt++ {
+		repair := request
+		repair.Messages = append(slices.Clone(request.Messages),
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: buildRepairPrompt(err)},
+		)
+		started := time.Now()
+		resp, reqErr := client.CreateChatCompletion(ctx, repair)
+		TraceFrom(ctx).Record(PhaseRepair, started, reqErr)
+		if reqErr != nil {
+			return fmt.Errorf("%w; repair request to OpenAI failed: %v", parseErr, reqErr)
+		}
+		usage.record(request.Model, resp.Usage)
+		if len(resp.Choices) == 0 {
+			break
+		}
+		content = resp.Choices[0].Message.Content
+		parseErr.repaired = append(parseErr.repaired, content)
+		// Неудачный разбор мог частично заполнить v
+		reflect.ValueOf(v).Elem().SetZero()
+		if err = json.Unmarshal([]byte(stripJSONWrappers(content)), v); err == nil {
+			return nil
+		}
+		parseErr.err = err
+	}
+	return parseErr
+}
+
+func buildRepairPrompt(err error) string {
+	return fmt.Sprintf(`Your previous response is not valid JSON: %v.
+Return the corrected JSON object only: the same data in the required structure, complete, without comments, Markdown code fences or any other text.`, err)
+}
@@ -0,0 +1,135 @@
+package invoice
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// matchResponse — ответ модели при сопоставлении контрагентов.
+type matchResponse struct {
+	MatchFound   bool   `json:"match_found"`
+	MatchedIndex int    `json:"matched_index"` // Получаем индекс, а не ID
+	Reason       string `json:"reason"`        // Почему контрагенты совпадают
+}
+
+// schemaExcludedFields — поля, которые заполняет программа, а не модель, и category, которая добавляется
+// в схему только при настроенных категориях (см. categorizedInvoiceSchema).
+var schemaExcludedFields = map[string]bool{
+	"pages": true, "id": true, "aliases": true, "rotated_pages": true, "raw_date": true, "date_ambiguous": true,
+	"extraction": true, "amount_decimals": true, "default_currency": true, "currencies": true, "category": true,
+	"source_method": true, "payment_reference": true,
+}
+
+var (
+	invoiceSchema     = sync.OnceValues(buildInvoiceSchema)
+	matchSchema       = sync.OnceValues(func() (*jsonschema.Definition, error) { return strictSchema(matchResponse{}) })
+	batchMatchSchema  = sync.OnceValues(func() (*jsonschema.Definition, error) { return strictSchema(batchMatchResponse{}) })
+	orientationSchema = sync.OnceValues(func() (*jsonschema.Definition, error) { return strictSchema(orientationResponse{}) })
+)
+
+// strictSchema строит JSON-схему типа для structured outputs: в строгом режиме OpenAI
+// все поля объектов должны быть обязательными, поэтому omitempty здесь не учитывается.
+func strictSchema(v any) (*jsonschema.Definition, error) {
+	schema, err := jsonschema.GenerateSchemaForType(v)
+	if err != nil {
+		return nil, err
+	}
+	makeStrict(schema)
+	for name, def := range schema.Defs {
+		makeStrict(&def)
+		schema.Defs[name] = def
+	}
+	return schema, nil
+}
+
+func makeStrict(def *jsonschema.Definition) {
+	if def.Items != nil {
+		makeStrict(def.Items)
+	}
+	if def.Type != jsonschema.Object {
+		return
+	}
+	def.Required = def.Required[:0]
+	for name, prop := range def.Properties {
+		if schemaExcludedFields[name] {
+			delete(def.Properties, name)
+			continue
+		}
+		makeStrict(&prop)
+		def.Properties[name] = prop
+		def.Required = append(def.Required, name)
+	}
+	sort.Strings(def.Required)
+	def.AdditionalProperties = false
+}
+
+// buildInvoiceSchema строит схему ответа детального анализа. go-openai не строит схемы для словарей,
+// поэтому Invoice.Confidences описывается отдельно — объектом с полями ConfidenceFields.
+func buildInvoiceSchema() (*jsonschema.Definition, error) {
+	schema, err := strictSchema(withoutMapFields(Invoice{}))
+	if err != nil {
+		return nil, err
+	}
+	confidences := jsonschema.Definition{
+		Type:                 jsonschema.Object,
+		Properties:           make(map[string]jsonschema.Definition, len(ConfidenceFields)),
+		Required:             append([]string(nil), ConfidenceFields...),
+		AdditionalProperties: false,
+	}
+	for _, field := range ConfidenceFields {
+		confidences.Properties[field] = jsonschema.Definition{Type: jsonschema.Number}
+	}
+	schema.Properties["confidences"] = confidences
+	schema.Required = append(schema.Required, "confidences")
+	sort.Strings(schema.Required)
+	return schema, nil
+}
+
+// withoutMapFields возвращает значение безымянной структуры с экспортируемыми полями v, кроме словарей.
+func withoutMapFields(v any) any {
+	t := reflect.TypeOf(v)
+	var fields []reflect.StructField
+	for i := range t.NumField() {
+		if field := t.Field(i); field.IsExported() && field.Type.Kind() != reflect.Map {
+			fields = append(fields, field)
+		}
+	}
+	return reflect.New(reflect.StructOf(fields)).Elem().Interface()
+}
+
+// supportsJSONSchema сообщает, поддерживает ли модель response_format json_schema.
+func supportsJSONSchema(model string) bool {
+	model = strings.ToLower(model)
+	if model == openai.GPT4o20240513 || strings.HasPrefix(model, "o1-mini") || strings.HasPrefix(model, "o1-preview") {
+		return false
+	}
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-5", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseFormat возвращает формат ответа со схемой, если модель ее поддерживает,
+// и обычный json_object в остальных случаях.
+func responseFormat(model, name string, schema func() (*jsonschema.Definition, error)) *openai.ChatCompletionResponseFormat {
+	if supportsJSONSchema(model) {
+		if def, err := schema(); err == nil {
+			return &openai.ChatCompletionResponseFormat{
+				Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+				JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+					Name:   name,
+					Schema: def,
+					Strict: true,
+				},
+			}
+		}
+	}
+	return &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+}
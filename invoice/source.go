@@ -0,0 +1,129 @@
+package invoice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contentTypes — MIME-типы поддерживаемых файлов по расширениям (см. SupportedExtensions).
+var contentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".webp": "image/webp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+}
+
+// ContentType возвращает MIME-тип поддерживаемого файла по его имени или пустую строку,
+// если расширение не поддерживается. Результат можно передать в ProcessBytes и ProcessReader.
+func ContentType(name string) string {
+	return contentTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// extensionFor возвращает расширение файла для MIME-типа contentType (параметры типа игнорируются).
+// Пустой contentType определяется по содержимому data.
+func extensionFor(contentType string, data []byte) (string, error) {
+	if contentType == "" {
+		contentType = sniffContentType(data)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid content type %q", ErrUnsupportedType, contentType)
+	}
+	for _, ext := range SupportedExtensions {
+		if contentTypes[ext] == mediaType {
+			return ext, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedType, mediaType)
+}
+
+// sniffContentType определяет MIME-тип по сигнатуре. http.DetectContentType не знает HEIC/HEIF и TIFF,
+// поэтому HEIC/HEIF распознаются по бренду ftyp-бокса контейнера ISO BMFF, а TIFF — по заголовку.
+func sniffContentType(data []byte) string {
+	if len(data) >= 4 && (string(data[:4]) == "II*\x00" || string(data[:4]) == "MM\x00*") {
+		return "image/tiff"
+	}
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		switch string(data[8:12]) {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx":
+			return "image/heic"
+		case "mif1", "msf1":
+			return "image/heif"
+		}
+	}
+	return http.DetectContentType(data)
+}
+
+// source — входной файл обработки: содержимое в памяти и путь на диске, если файл там есть.
+// Утилитам poppler нужен путь, поэтому для PDF из памяти временный файл создается только
+// при первом обращении к pdfPath.
+type source struct {
+	name string // Имя для журнала
+	ext  string // Расширение в нижнем регистре, определяет тип файла
+	data []byte
+	path string // Путь к файлу; пусто, пока для данных из памяти не понадобился PDF на диске
+	temp bool   // path — временный файл, который удаляет cleanup
+}
+
+// pdfPath возвращает путь к PDF на диске, при необходимости записывая данные во временный файл.
+func (s *source) pdfPath() (string, error) {
+	if s.path != "" {
+		return s.path, nil
+	}
+	file, err := os.CreateTemp("", "invpa-*.pdf")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for PDF: %w", err)
+	}
+	_, err = file.Write(s.data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write temp file for PDF: %w", err)
+	}
+	s.path, s.temp = file.Name(), true
+	return s.path, nil
+}
+
+// cleanup удаляет временный файл, созданный pdfPath.
+func (s *source) cleanup() {
+	if s.temp {
+		os.Remove(s.path)
+	}
+}
+
+// ProcessBytes анализирует инвойс, уже загруженный в память, без промежуточного файла: изображения
+// отправляются в OpenAI напрямую, а PDF записывается во временный файл только для утилит poppler.
+// contentType — MIME-тип данных ("application/pdf", "image/png", см. ContentType); пустой тип
+// определяется по содержимому. Неподдерживаемый тип — ошибка ErrUnsupportedType.
+func (p *Processor) ProcessBytes(ctx context.Context, data []byte, contentType string) ([]Invoice, Usage, error) {
+	ext, err := extensionFor(contentType, data)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	src := &source{name: "in-memory " + strings.TrimPrefix(ext, "."), ext: ext, data: data}
+	defer src.cleanup()
+	return p.process(ctx, src)
+}
+
+// ProcessReader аналогичен ProcessBytes, но читает данные из r целиком.
+func (p *Processor) ProcessReader(ctx context.Context, r io.Reader, contentType string) ([]Invoice, Usage, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, Usage{}, fmt.Errorf("failed to read input: %w", err)
+	}
+	return p.ProcessBytes(ctx, buf.Bytes(), contentType)
+}
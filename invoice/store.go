@@ -0,0 +1,338 @@
+package invoice
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// csvCounterpartyHeader — порядок колонок CSV-файла базы контрагентов.
+var csvCounterpartyHeader = []string{
+	"id", "name", "vat", "tax_code2", "registration_number", "country", "country_code", "address",
+	"swift", "iban", "phone", "fax", "email", "website", "aliases", "bank_accounts",
+	"default_currency", "currencies",
+}
+
+// CounterpartyStore — постоянная база контрагентов, которую пополняют запуски обработки.
+// Контрагенты базы сохраняют свои ID: новые данные только дополняют их (MergeCounterparties),
+// а ID получают лишь новые контрагенты — следующие за максимальным (см. LoadCounterpartyRegistry).
+type CounterpartyStore interface {
+	Load() ([]Counterparty, error)
+	Save(counterparties []Counterparty) error
+}
+
+// FileCounterpartyStore — база контрагентов в JSON или CSV файле (по расширению).
+type FileCounterpartyStore struct {
+	Path string
+}
+
+// Load загружает базу; отсутствующий файл — пустая база.
+func (s FileCounterpartyStore) Load() ([]Counterparty, error) {
+	return LoadCounterparties(s.Path)
+}
+
+// Save сохраняет базу через временный файл.
+func (s FileCounterpartyStore) Save(counterparties []Counterparty) error {
+	return SaveCounterparties(s.Path, counterparties)
+}
+
+// LoadCounterpartyRegistry создает реестр из базы store, присваивающий ID новым контрагентам.
+// Без базы (store = nil) реестр пуст и ID не присваиваются.
+func LoadCounterpartyRegistry(store CounterpartyStore) (*CounterpartyRegistry, error) {
+	if store == nil {
+		return NewCounterpartyRegistry(nil, false), nil
+	}
+	existing, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	return NewCounterpartyRegistry(existing, true), nil
+}
+
+// LoadCounterparties загружает базу контрагентов из JSON или CSV файла (по расширению).
+// Отсутствующий файл не является ошибкой: возвращается пустая база.
+func LoadCounterparties(path string) ([]Counterparty, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open counterparties db: %w", err)
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return readCounterpartiesCSV(file)
+	}
+
+	var counterparties []Counterparty
+	if err := json.NewDecoder(file).Decode(&counterparties); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode counterparties db: %w", err)
+	}
+	// База, сохраненная до появления bank_accounts, содержит только iban и swift, а до кодов alpha-2 — коды alpha-3
+	for i := range counterparties {
+		counterparties[i].NormalizeBankAccounts()
+		counterparties[i].NormalizeCountry()
+	}
+	return counterparties, nil
+}
+
+// SaveCounterparties сохраняет базу контрагентов в JSON или CSV файл (по расширению).
+// Запись выполняется через временный файл, чтобы не повредить базу при сбое.
+func SaveCounterparties(path string, counterparties []Counterparty) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".counterparties-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for counterparties db: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writeCounterpartiesCSV(tmp, counterparties)
+	} else {
+		encoder := json.NewEncoder(tmp)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(counterparties)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write counterparties db: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readCounterpartiesCSV(r io.Reader) ([]Counterparty, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counterparties csv: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	// Колонки ищем по заголовку, чтобы порядок в файле был произвольным
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	get := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var counterparties []Counterparty
+	for line, record := range records[1:] {
+		cp := Counterparty{
+			Name:               get(record, "name"),
+			VAT:                get(record, "vat"),
+			TaxCode2:           get(record, "tax_code2"),
+			RegistrationNumber: get(record, "registration_number"),
+			Country:            get(record, "country"),
+			CountryCode:        get(record, "country_code"),
+			Address:            get(record, "address"),
+			SWIFT:              get(record, "swift"),
+			IBAN:               get(record, "iban"),
+			Phone:              get(record, "phone"),
+			Fax:                get(record, "fax"),
+			Email:              get(record, "email"),
+			Website:            get(record, "website"),
+		}
+		if id := get(record, "id"); id != "" {
+			cp.ID, err = strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id on line %d of counterparties csv: %w", line+2, err)
+			}
+		}
+		for _, alias := range strings.Split(get(record, "aliases"), ";") {
+			cp.AddAlias(alias)
+		}
+		// Счета хранятся в одной колонке в виде JSON-массива
+		if accounts := get(record, "bank_accounts"); accounts != "" {
+			if err := json.Unmarshal([]byte(accounts), &cp.BankAccounts); err != nil {
+				return nil, fmt.Errorf("invalid bank_accounts on line %d of counterparties csv: %w", line+2, err)
+			}
+		}
+		cp.NormalizeBankAccounts()
+		cp.NormalizeCountry()
+		// История валют хранится как "EUR:12; USD:1"
+		for _, part := range strings.Split(get(record, "currencies"), ";") {
+			currency, count, ok := strings.Cut(strings.TrimSpace(part), ":")
+			invoices, err := strconv.Atoi(strings.TrimSpace(count))
+			if !ok || err != nil || invoices <= 0 {
+				continue
+			}
+			cp.Currencies = append(cp.Currencies, CurrencyCount{Currency: strings.ToUpper(strings.TrimSpace(currency)), Invoices: invoices})
+		}
+		cp.updateDefaultCurrency()
+		counterparties = append(counterparties, cp)
+	}
+	return counterparties, nil
+}
+
+func writeCounterpartiesCSV(w io.Writer, counterparties []Counterparty) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvCounterpartyHeader); err != nil {
+		return err
+	}
+	for _, cp := range counterparties {
+		accounts := ""
+		if len(cp.BankAccounts) > 0 {
+			data, err := json.Marshal(cp.BankAccounts)
+			if err != nil {
+				return err
+			}
+			accounts = string(data)
+		}
+		currencies := make([]string, len(cp.Currencies))
+		for i, count := range cp.Currencies {
+			currencies[i] = fmt.Sprintf("%s:%d", count.Currency, count.Invoices)
+		}
+		record := []string{
+			strconv.FormatUint(cp.ID, 10), cp.Name, cp.VAT, cp.TaxCode2, cp.RegistrationNumber, cp.Country, cp.CountryCode, cp.Address,
+			cp.SWIFT, cp.IBAN, cp.Phone, cp.Fax, cp.Email, cp.Website, strings.Join(cp.Aliases, "; "), accounts,
+			cp.DefaultCurrency, strings.Join(currencies, "; "),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// CounterpartyRegistry хранит известных контрагентов в рамках одного запуска
+// и дедуплицирует новых относительно них.
+type CounterpartyRegistry struct {
+	Counterparties []Counterparty
+	assignIDs      bool
+	nextID         uint64
+}
+
+// NewCounterpartyRegistry создает реестр, заполненный существующими контрагентами.
+// Если assignIDs = true, новым контрагентам присваиваются ID, следующие за максимальным.
+func NewCounterpartyRegistry(existing []Counterparty, assignIDs bool) *CounterpartyRegistry {
+	r := &CounterpartyRegistry{
+		Counterparties: append([]Counterparty(nil), existing...),
+		assignIDs:      assignIDs,
+		nextID:         1,
+	}
+	for _, cp := range existing {
+		if cp.ID >= r.nextID {
+			r.nextID = cp.ID + 1
+		}
+	}
+	return r
+}
+
+// Import добавляет контрагента из внешнего источника (например, старого отчета), сохраняя его ID.
+// Контрагент с тем же ID (а если ID не задан — с тем же наименованием или алиасом) дополняется
+// данными cp, поэтому повторный импорт не создает дубликатов. Возвращает true, если контрагент новый.
+func (r *CounterpartyRegistry) Import(cp Counterparty) bool {
+	for i, existing := range r.Counterparties {
+		if (cp.ID != 0 && existing.ID == cp.ID) || (cp.ID == 0 && existing.MatchesName(cp.Name)) {
+			r.Counterparties[i] = MergeCounterparties(existing, cp)
+			return false
+		}
+	}
+	if r.assignIDs && cp.ID == 0 {
+		cp.ID = r.nextID
+	}
+	if cp.ID >= r.nextID {
+		r.nextID = cp.ID + 1
+	}
+	r.Counterparties = append(r.Counterparties, cp)
+	return true
+}
+
+// Lookup находит контрагента по ID, а если ID не задан или не найден — по наименованию или алиасу.
+func (r *CounterpartyRegistry) Lookup(id uint64, name string) (Counterparty, bool) {
+	if id != 0 {
+		for _, cp := range r.Counterparties {
+			if cp.ID == id {
+				return cp, true
+			}
+		}
+	}
+	for _, cp := range r.Counterparties {
+		if cp.MatchesName(name) {
+			return cp, true
+		}
+	}
+	return Counterparty{}, false
+}
+
+// Resolve находит контрагента в реестре или добавляет его как нового.
+// Возвращает индекс контрагента в Counterparties и признак того, что он новый.
+// При ошибке сопоставления контрагент добавляется как новый, а ошибка возвращается для логирования.
+func (r *CounterpartyRegistry) Resolve(client ChatClient, cp Counterparty) (int, bool, Usage, error) {
+	return r.resolve(context.Background(), client, openai.GPT4o, promptSet{}, cp)
+}
+
+// ResolveBatch сопоставляет всех контрагентов одним запросом к OpenAI и добавляет новых в реестр.
+// Возвращает индекс в Counterparties для каждого контрагента и признак того, что он новый.
+// Одинаковые новые контрагенты получают один индекс (признак новизны — только у первого).
+// При ошибке сопоставления несопоставленные контрагенты добавляются как новые, а ошибка возвращается для логирования.
+func (r *CounterpartyRegistry) ResolveBatch(client ChatClient, cps []Counterparty) ([]int, []bool, Usage, error) {
+	indices, isNew, _, usage, err := r.resolveBatch(context.Background(), client, openai.GPT4o, DefaultJSONRepairAttempts, promptSet{}, cps)
+	return indices, isNew, usage, err
+}
+
+// resolveBatch — ResolveBatch, который дополнительно объясняет сопоставление каждого контрагента
+// с контрагентами, бывшими в реестре до вызова.
+func (r *CounterpartyRegistry) resolveBatch(ctx context.Context, client ChatClient, model string, repairAttempts int, prompts promptSet, cps []Counterparty) ([]int, []bool, []MatchExplanation, Usage, error) {
+	matches, usage, err := matchCounterpartiesBatch(ctx, client, model, repairAttempts, prompts, r.Counterparties, cps)
+	// Объяснения строятся до того, как реестр дополняется новыми данными
+	explanations := make([]MatchExplanation, len(cps))
+	for i, cp := range cps {
+		explanations[i] = explainMatch(r.Counterparties, cp, matches[i].ExistingIndex, matches[i].Reason)
+	}
+	indices := make([]int, len(cps))
+	isNew := make([]bool, len(cps))
+	for i, cp := range cps {
+		match := matches[i]
+		switch {
+		case !match.IsNew():
+			indices[i] = match.ExistingIndex
+		case match.NewIndex < i:
+			indices[i] = indices[match.NewIndex]
+		default:
+			if r.assignIDs && cp.ID == 0 {
+				cp.ID = r.nextID
+				r.nextID++
+			}
+			r.Counterparties = append(r.Counterparties, cp)
+			indices[i] = len(r.Counterparties) - 1
+			isNew[i] = true
+			continue
+		}
+		r.Counterparties[indices[i]] = MergeCounterparties(r.Counterparties[indices[i]], cp)
+	}
+	return indices, isNew, explanations, usage, err
+}
+
+func (r *CounterpartyRegistry) resolve(ctx context.Context, client ChatClient, model string, prompts promptSet, cp Counterparty) (int, bool, Usage, error) {
+	index, _, usage, err := matchCounterparty(ctx, client, model, prompts, r.Counterparties, cp)
+	if err == nil && index >= 0 {
+		r.Counterparties[index] = MergeCounterparties(r.Counterparties[index], cp)
+		return index, false, usage, nil
+	}
+
+	if r.assignIDs && cp.ID == 0 {
+		cp.ID = r.nextID
+		r.nextID++
+	}
+	r.Counterparties = append(r.Counterparties, cp)
+	return len(r.Counterparties) - 1, true, usage, err
+}
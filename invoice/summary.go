@@ -0,0 +1,184 @@
+package invoice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Типы предупреждений в RunSummary.Warnings.
+const (
+	WarningMatching   = "counterparty_matching" // Ошибка сопоставления контрагента
+	WarningValidation = "validation"            // Префикс проблем Invoice.Validate: "validation:<поле>"
+)
+
+// RunSummary — итог обработки пакета файлов, одинаковый для всех инструментов.
+// Файлы: FilesProcessed + FilesSkipped + FilesFailed = FilesScanned.
+type RunSummary struct {
+	FilesScanned          int                `json:"files_scanned"`
+	FilesProcessed        int                `json:"files_processed"` // Файлы, из которых извлечен хотя бы один документ (в том числе TypeNotInvoice)
+	FilesSkipped          int                `json:"files_skipped"`   // Файлы, не обработанные из-за отмены
+	FilesFailed           int                `json:"files_failed"`    // Файлы с ошибкой, без инвойсов или только с неразобранными инвойсами
+	InvoicesExtracted     int                `json:"invoices_extracted"`
+	NotInvoices           int                `json:"not_invoices"` // Документы TypeNotInvoice, пропущенные без ошибки (Result.Skipped)
+	Duplicates            int                `json:"duplicates"`   // Повторы инвойсов в пакете (Result.DuplicateOf), не входят в NetSpend
+	CounterpartiesNew     int                `json:"counterparties_new"`
+	CounterpartiesMatched int                `json:"counterparties_matched"`
+	Errors                map[string]int     `json:"errors,omitempty"`    // Количество ошибок файлов и отдельных инвойсов по кодам (Result.ErrorCode)
+	Warnings              map[string]int     `json:"warnings,omitempty"`  // Количество предупреждений по типам
+	NetSpend              map[string]float64 `json:"net_spend,omitempty"` // Сумма документов по валютам, кредит-ноты вычитаются
+	Credits               []CreditLink       `json:"credits,omitempty"`
+	Usage                 Usage              `json:"usage"`
+	EstimatedCost         float64            `json:"estimated_cost"`
+	WallTime              time.Duration      `json:"wall_time"`
+}
+
+// NewRunSummary подсчитывает итог обработки по результатам и дедупликации.
+// results должны содержать по одному результату с ошибкой на каждый неудачный файл и на каждый
+// неразобранный инвойс (см. FileResults).
+func NewRunSummary(filesScanned int, results []Result, dedup Deduplication, prices map[string]ModelPrice, wallTime time.Duration) RunSummary {
+	summary := RunSummary{
+		FilesScanned:          filesScanned,
+		CounterpartiesNew:     dedup.NewCounterparties,
+		CounterpartiesMatched: dedup.MatchedCounterparties,
+		Usage:                 dedup.MatchingUsage,
+		WallTime:              wallTime,
+	}
+
+	var counted []Result // Результаты без повторов: по ним считаются суммы
+	spendMinor := make(map[string]int64)
+	extracted := make(map[string]bool) // Файлы с документами: есть ли среди них хотя бы один без ошибки
+	var files []string
+	for _, res := range results {
+		summary.Usage.Add(res.Usage)
+		if res.InvoiceIndex > 0 {
+			if _, ok := extracted[res.SourceFile]; !ok {
+				files = append(files, res.SourceFile)
+			}
+			extracted[res.SourceFile] = extracted[res.SourceFile] || res.ErrorMessage == ""
+		}
+		if res.IsSkipped() {
+			summary.NotInvoices++
+			continue
+		}
+		if res.ErrorMessage != "" || res.Invoice == nil {
+			if res.InvoiceIndex == 0 {
+				summary.FilesFailed++
+			}
+			if summary.Errors == nil {
+				summary.Errors = make(map[string]int)
+			}
+			code := res.ErrorCode
+			if code == "" {
+				code = ErrorCodeOther // Результаты, сохраненные до появления кодов ошибок
+			}
+			summary.Errors[code]++
+			continue
+		}
+		summary.InvoicesExtracted++
+		if res.IsDuplicate() {
+			summary.Duplicates++
+		} else {
+			currency := strings.ToUpper(res.Invoice.Currency)
+			spendMinor[currency] += ToMinor(res.Invoice.SignedTotal(), currency, RoundHalfUp)
+			counted = append(counted, res)
+		}
+
+		for _, issue := range res.Warnings {
+			summary.addWarning(WarningValidation + ":" + issue.Field)
+		}
+	}
+	for range dedup.Warnings {
+		summary.addWarning(WarningMatching)
+	}
+
+	if len(spendMinor) > 0 {
+		summary.NetSpend = make(map[string]float64, len(spendMinor))
+		for currency, minor := range spendMinor {
+			summary.NetSpend[currency] = FromMinor(minor, currency)
+		}
+	}
+	summary.Credits = LinkCreditNotes(counted)
+
+	for _, file := range files {
+		if extracted[file] {
+			summary.FilesProcessed++
+		} else {
+			summary.FilesFailed++
+		}
+	}
+	summary.FilesSkipped = max(0, filesScanned-summary.FilesProcessed-summary.FilesFailed)
+	summary.EstimatedCost = summary.Usage.EstimateCost(prices)
+	return summary
+}
+
+func (s *RunSummary) addWarning(kind string) {
+	if s.Warnings == nil {
+		s.Warnings = make(map[string]int)
+	}
+	s.Warnings[kind]++
+}
+
+// WarningTypes возвращает типы предупреждений в алфавитном порядке.
+func (s RunSummary) WarningTypes() []string {
+	kinds := make([]string, 0, len(s.Warnings))
+	for kind := range s.Warnings {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Currencies возвращает валюты NetSpend в алфавитном порядке.
+func (s RunSummary) Currencies() []string {
+	currencies := make([]string, 0, len(s.NetSpend))
+	for currency := range s.NetSpend {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// Lines возвращает итог в виде строк для вывода в консоль и отчеты.
+func (s RunSummary) Lines() []string {
+	lines := []string{
+		fmt.Sprintf("Files: %d scanned, %d processed, %d skipped, %d failed", s.FilesScanned, s.FilesProcessed, s.FilesSkipped, s.FilesFailed),
+		fmt.Sprintf("Invoices: %d extracted, %d duplicates, %d skipped (not an invoice)", s.InvoicesExtracted, s.Duplicates, s.NotInvoices),
+		fmt.Sprintf("Counterparties: %d new, %d matched", s.CounterpartiesNew, s.CounterpartiesMatched),
+	}
+	for _, currency := range s.Currencies() {
+		lines = append(lines, fmt.Sprintf("Net spend (%s): %s", currency, FormatAmount(s.NetSpend[currency], currency)))
+	}
+	if len(s.Credits) > 0 {
+		linked := 0
+		for _, credit := range s.Credits {
+			if credit.Linked() {
+				linked++
+			}
+		}
+		lines = append(lines, fmt.Sprintf("Credit notes: %d (%d linked to invoices)", len(s.Credits), linked))
+	}
+	for _, code := range ErrorCodes {
+		if n := s.Errors[code]; n > 0 {
+			lines = append(lines, fmt.Sprintf("Errors (%s): %d", code, n))
+		}
+	}
+	for _, kind := range s.WarningTypes() {
+		lines = append(lines, fmt.Sprintf("Warnings (%s): %d", kind, s.Warnings[kind]))
+	}
+	return append(lines,
+		fmt.Sprintf("OpenAI: %d requests, %d prompt / %d completion tokens (~$%.4f)",
+			s.Usage.Requests, s.Usage.PromptTokens, s.Usage.CompletionTokens, s.EstimatedCost),
+		s.wallTimeLine(),
+	)
+}
+
+// wallTimeLine возвращает общее время запуска и среднее время на обработанный файл.
+func (s RunSummary) wallTimeLine() string {
+	line := fmt.Sprintf("Wall time: %s", s.WallTime.Round(time.Second))
+	if files := s.FilesProcessed + s.FilesFailed; files > 0 {
+		line += fmt.Sprintf(" (%s per file)", (s.WallTime / time.Duration(files)).Round(10*time.Millisecond))
+	}
+	return line
+}
@@ -0,0 +1,101 @@
+package invoice
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// summaryBatch возвращает результаты шести файлов: файл с двумя инвойсами, повтор одного из них,
+// кредит-ноту к другому, документ, не являющийся инвойсом, файл с ошибкой и файл без инвойсов.
+func summaryBatch() []Result {
+	acme := Counterparty{Name: "ACME GmbH", VAT: "DE123456789"}
+	invoice := func(number string, total float64, typ int) Invoice {
+		return Invoice{Type: typ, Number: number, Date: "2024-03-01", Currency: "EUR", TotalAmount: total, Counterparty: acme}
+	}
+	credit := invoice("CN-1", 30, TypeCreditNote)
+	credit.Reference = "INV-2"
+
+	var results []Result
+	results = append(results, FileResults("two.pdf", []Invoice{invoice("INV-1", 100, TypePaymentOrder), invoice("INV-2", 30, TypePaymentOrder)}, Usage{}, nil)...)
+	results = append(results, FileResults("copy.pdf", []Invoice{invoice("INV-1", 100, TypePaymentOrder)}, Usage{}, nil)...)
+	results = append(results, FileResults("credit.pdf", []Invoice{credit}, Usage{}, nil)...)
+	results = append(results, FileResults("contract.pdf", []Invoice{{Type: TypeNotInvoice}}, Usage{}, nil)...)
+	results = append(results, FileResults("broken.pdf", nil, Usage{}, errors.New("could not render pages"))...)
+	results = append(results, FileResults("empty.pdf", nil, Usage{}, nil)...)
+	MarkDuplicates(results)
+	return results
+}
+
+func TestRunSummaryFileCounts(t *testing.T) {
+	const scanned = 8 // Еще два файла не обработаны из-за отмены
+	summary := NewRunSummary(scanned, summaryBatch(), Deduplication{}, nil, 0)
+
+	if got := summary.FilesProcessed + summary.FilesSkipped + summary.FilesFailed; got != summary.FilesScanned {
+		t.Errorf("processed %d + skipped %d + failed %d = %d, want scanned %d",
+			summary.FilesProcessed, summary.FilesSkipped, summary.FilesFailed, got, summary.FilesScanned)
+	}
+	if summary.FilesProcessed != 4 || summary.FilesFailed != 2 || summary.FilesSkipped != 2 {
+		t.Errorf("files: %d processed, %d failed, %d skipped, want 4, 2 and 2", summary.FilesProcessed, summary.FilesFailed, summary.FilesSkipped)
+	}
+	if summary.InvoicesExtracted != 4 || summary.NotInvoices != 1 {
+		t.Errorf("documents: %d invoices, %d not invoices, want 4 and 1", summary.InvoicesExtracted, summary.NotInvoices)
+	}
+	if summary.Errors[ErrorCodeNoInvoiceFound] != 1 {
+		t.Errorf("errors = %v, want one %s", summary.Errors, ErrorCodeNoInvoiceFound)
+	}
+}
+
+// TestRunSummarySpendAndCredits проверяет, что повтор не входит в NetSpend, а кредит-нота вычитается
+// из него и связывается с исходным инвойсом.
+func TestRunSummarySpendAndCredits(t *testing.T) {
+	results := summaryBatch()
+	summary := NewRunSummary(len(results), results, Deduplication{}, nil, 0)
+
+	if summary.Duplicates != 1 {
+		t.Errorf("Duplicates = %d, want 1", summary.Duplicates)
+	}
+	for _, res := range results {
+		if res.IsDuplicate() && (res.SourceFile != "copy.pdf" || res.DuplicateOf != "two.pdf") {
+			t.Errorf("%s marked as a duplicate of %s", res.SourceFile, res.DuplicateOf)
+		}
+	}
+	if len(summary.NetSpend) != 1 || summary.NetSpend["EUR"] != 100 {
+		t.Errorf("NetSpend = %v, want EUR 100 (100 + 30 - 30, the duplicate is not counted)", summary.NetSpend)
+	}
+	if len(summary.Credits) != 1 {
+		t.Fatalf("Credits = %+v, want one credit note", summary.Credits)
+	}
+	if credit := summary.Credits[0]; credit.Amount != -30 || credit.InvoiceNumber != "INV-2" || credit.InvoiceFile != "two.pdf" {
+		t.Errorf("credit note = %+v, want -30 linked to INV-2 in two.pdf", credit)
+	}
+}
+
+// TestNetSpendDoesNotDrift складывает 10 000 случайных сумм и проверяет, что NetSpend совпадает
+// с точной суммой в минимальных единицах: сложение float64 дало бы расхождение в копейках.
+func TestNetSpendDoesNotDrift(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, currency := range []string{"EUR", "JPY", "KWD"} {
+		t.Run(currency, func(t *testing.T) {
+			scale := int64(1)
+			for range MinorUnits(currency) {
+				scale *= 10
+			}
+			var results []Result
+			var totalMinor int64
+			for i := range 10000 {
+				total := rng.Int63n(1200 * scale)
+				totalMinor += total
+				inv := Invoice{Type: TypePaymentOrder, Number: fmt.Sprintf("INV-%d", i), Currency: currency, TotalAmount: FromMinor(total, currency)}
+				results = append(results, Result{SourceFile: fmt.Sprintf("%d.pdf", i), InvoiceIndex: 1, Invoice: &inv})
+			}
+
+			summary := NewRunSummary(len(results), results, Deduplication{}, nil, 0)
+			if got := ToMinor(summary.NetSpend[currency], currency, RoundHalfUp); got != totalMinor {
+				t.Errorf("NetSpend = %s, want %s", FormatAmount(summary.NetSpend[currency], currency),
+					FormatAmount(FromMinor(totalMinor, currency), currency))
+			}
+		})
+	}
+}
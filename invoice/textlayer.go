@@ -0,0 +1,121 @@
+package invoice
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ExtractionMode — способ передачи страниц PDF модели при детальном анализе.
+type ExtractionMode string
+
+const (
+	ExtractionModeVision ExtractionMode = "vision" // Изображения страниц (по умолчанию)
+	ExtractionModeText   ExtractionMode = "text"   // Только текстовый слой; PDF без него не обрабатываются
+	ExtractionModeAuto   ExtractionMode = "auto"   // Текстовый слой, если он есть на всех страницах, иначе изображения
+)
+
+// ExtractionText — значение Invoice.Extraction для инвойсов, извлеченных моделью по текстовому слою PDF,
+// а не по изображениям страниц.
+const ExtractionText = "text"
+
+// minPageText — минимальное число букв и цифр на странице, при котором текстовый слой считается пригодным.
+const minPageText = 40
+
+// ParseExtractionMode разбирает extraction_mode из конфига. Пустая строка означает vision.
+func ParseExtractionMode(value string) (ExtractionMode, error) {
+	switch mode := ExtractionMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case "":
+		return ExtractionModeVision, nil
+	case ExtractionModeVision, ExtractionModeText, ExtractionModeAuto:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown extraction mode %q (expected %q, %q or %q)", value, ExtractionModeAuto, ExtractionModeVision, ExtractionModeText)
+}
+
+// textLayer возвращает текстовый слой PDF по страницам для анализа без изображений.
+// Ошибка означает, что слоя нет или он непригоден (скан, текст с битой кодировкой шрифтов).
+func (p *Processor) textLayer(ctx context.Context, filePath string) ([]string, error) {
+	pages, err := p.textExtractor(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract PDF text: %w", err)
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("PDF has no pages with text")
+	}
+	for i, page := range pages {
+		if err := checkPageText(page); err != nil {
+			return nil, fmt.Errorf("page %d: %w", i+1, err)
+		}
+	}
+	return pages, nil
+}
+
+// checkPageText проверяет, что на странице достаточно осмысленного текста: у сканов текста нет,
+// а при битой кодировке шрифтов pdftotext выдает символы замены и служебные символы.
+func checkPageText(page string) error {
+	var meaningful, other int
+	for _, r := range page {
+		switch {
+		case unicode.IsSpace(r):
+		case r == unicode.ReplacementChar:
+			other++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			meaningful++
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			// Знаки препинания и валют не влияют на оценку
+		default:
+			other++ // Управляющие символы и символы частного использования
+		}
+	}
+	if meaningful < minPageText {
+		return fmt.Errorf("text layer has only %d letters and digits (scanned page?)", meaningful)
+	}
+	if other*10 > meaningful {
+		return errors.New("text layer is garbled (broken font encoding?)")
+	}
+	return nil
+}
+
+// pageInput — страница файла для запроса к модели: изображение или текстовый слой.
+type pageInput struct {
+	image []byte
+	text  string
+}
+
+// pageInputs собирает страницы из изображений или, если он задан, текстового слоя.
+func pageInputs(images [][]byte, texts []string) []pageInput {
+	if texts != nil {
+		pages := make([]pageInput, len(texts))
+		for i, text := range texts {
+			pages[i] = pageInput{text: text}
+		}
+		return pages
+	}
+	pages := make([]pageInput, len(images))
+	for i, image := range images {
+		pages[i] = pageInput{image: image}
+	}
+	return pages
+}
+
+// part возвращает содержимое страницы для сообщения модели; detail задает разрешение изображения.
+func (page pageInput) part(detail openai.ImageURLDetail) openai.ChatMessagePart {
+	if page.image == nil {
+		return openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: page.text}
+	}
+	encodedImage := base64.StdEncoding.EncodeToString(page.image)
+	return openai.ChatMessagePart{
+		Type: openai.ChatMessagePartTypeImageURL,
+		ImageURL: &openai.ChatMessageImageURL{
+			URL:    fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(page.image), encodedImage),
+			Detail: detail,
+		},
+	}
+}
@@ -0,0 +1,65 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // Регистрируем декодер PNG для image.Decode
+)
+
+// DefaultThumbnailsMaxBytes ограничивает суммарный размер миниатюр в одном Excel-отчете.
+const DefaultThumbnailsMaxBytes = 20 << 20
+
+// Thumbnail уменьшает изображение страницы так, чтобы большая сторона не превышала maxDim пикселей,
+// и кодирует его в JPEG.
+func Thumbnail(imageData []byte, maxDim int) ([]byte, error) {
+	if maxDim <= 0 {
+		return nil, fmt.Errorf("invalid thumbnail size %d", maxDim)
+	}
+	src, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode page image: %w", err)
+	}
+	if bounds := src.Bounds(); bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, fmt.Errorf("page image is empty")
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, downscale(src, maxDim), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// downscale уменьшает изображение так, чтобы большая сторона не превышала maxDim пикселей.
+func downscale(src image.Image, maxDim int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := float64(maxDim) / float64(max(width, height))
+	if scale > 1 {
+		scale = 1
+	}
+	dstWidth, dstHeight := max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale))
+
+	// Усреднение по областям исходного изображения (box filter): достаточно для превью страницы
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := bounds.Min.Y + y*height/dstHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/dstHeight)
+		for x := 0; x < dstWidth; x++ {
+			x0 := bounds.Min.X + x*width/dstWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/dstWidth)
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r, g, b, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: 0xffff})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,158 @@
+package invoice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"slices"
+
+	"golang.org/x/image/tiff"
+)
+
+// maxTIFFPages ограничивает число страниц TIFF, чтобы зацикленная или поврежденная цепочка
+// каталогов не обрабатывалась бесконечно.
+const maxTIFFPages = 1000
+
+// tiffCompressions — названия схем сжатия TIFF (тег Compression) для сообщений об ошибках.
+var tiffCompressions = map[uint16]string{
+	1:     "no",
+	2:     "CCITT modified Huffman RLE",
+	3:     "CCITT Group 3 fax",
+	4:     "CCITT Group 4 fax",
+	5:     "LZW",
+	6:     "old-style JPEG",
+	7:     "JPEG",
+	8:     "Deflate",
+	32773: "PackBits",
+	32946: "Deflate",
+	34712: "JPEG 2000",
+}
+
+// tiffDecodable — схемы сжатия, которые декодирует golang.org/x/image/tiff.
+var tiffDecodable = []uint16{1, 3, 4, 5, 8, 32773, 32946}
+
+// tiffDirectory — страница TIFF: смещение ее каталога (IFD) и схема сжатия.
+type tiffDirectory struct {
+	offset      uint32
+	compression uint16
+}
+
+// tiffToImages декодирует все страницы многостраничного TIFF (с полосами или тайлами) и кодирует
+// каждую в PNG, а цветные страницы — в JPEG, чтобы они шли в анализ так же, как страницы PDF.
+// Страница со схемой сжатия, которую нельзя декодировать, — ошибка ErrUnsupportedType с названием схемы.
+func tiffToImages(content []byte) (images [][]byte, err error) {
+	// Декодер может паниковать на поврежденных файлах: это ошибка файла, а не всего пакета
+	defer func() {
+		if r := recover(); r != nil {
+			images, err = nil, fmt.Errorf("failed to decode TIFF: %v", r)
+		}
+	}()
+	order, dirs, err := tiffDirectories(content)
+	if err != nil {
+		return nil, err
+	}
+	for i, dir := range dirs {
+		if !slices.Contains(tiffDecodable, dir.compression) {
+			name, ok := tiffCompressions[dir.compression]
+			if !ok {
+				name = fmt.Sprintf("unknown (%d)", dir.compression)
+			}
+			return nil, fmt.Errorf("%w: page %d of the TIFF uses %s compression, which cannot be decoded; re-save it with LZW, Deflate, CCITT fax or no compression",
+				ErrUnsupportedType, i+1, name)
+		}
+	}
+	// golang.org/x/image/tiff читает только первый каталог, поэтому для каждой страницы заголовок
+	// копии файла указывает на ее каталог
+	page := slices.Clone(content)
+	for i, dir := range dirs {
+		order.PutUint32(page[4:8], dir.offset)
+		img, err := tiff.Decode(bytes.NewReader(page))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode TIFF page %d: %w", i+1, err)
+		}
+		data, err := encodeTIFFPage(img)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode TIFF page %d: %w", i+1, err)
+		}
+		images = append(images, data)
+	}
+	return images, nil
+}
+
+// tiffDirectories разбирает заголовок TIFF и цепочку каталогов страниц.
+func tiffDirectories(data []byte) (binary.ByteOrder, []tiffDirectory, error) {
+	if len(data) < 8 {
+		return nil, nil, fmt.Errorf("failed to decode TIFF: the file is too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("failed to decode TIFF: malformed header")
+	}
+	switch order.Uint16(data[2:4]) {
+	case 42:
+	case 43:
+		return nil, nil, fmt.Errorf("%w: BigTIFF files are not supported; re-save the file as a classic TIFF or PDF", ErrUnsupportedType)
+	default:
+		return nil, nil, fmt.Errorf("failed to decode TIFF: malformed header")
+	}
+	var dirs []tiffDirectory
+	seen := map[uint32]bool{}
+	for offset := order.Uint32(data[4:8]); offset != 0; {
+		if seen[offset] || len(dirs) == maxTIFFPages {
+			return nil, nil, fmt.Errorf("failed to decode TIFF: the page directory chain is broken or longer than %d pages", maxTIFFPages)
+		}
+		seen[offset] = true
+		start := int(offset)
+		if start+2 > len(data) {
+			return nil, nil, fmt.Errorf("failed to decode TIFF: page %d directory is out of range", len(dirs)+1)
+		}
+		count := int(order.Uint16(data[start : start+2]))
+		end := start + 2 + 12*count
+		if end+4 > len(data) {
+			return nil, nil, fmt.Errorf("failed to decode TIFF: page %d directory is truncated", len(dirs)+1)
+		}
+		dir := tiffDirectory{offset: offset, compression: 1} // Без тега Compression данные не сжаты
+		for entry := start + 2; entry < end; entry += 12 {
+			if order.Uint16(data[entry:entry+2]) != 259 {
+				continue
+			}
+			// Значение обычно типа SHORT, но встречается и LONG
+			if order.Uint16(data[entry+2:entry+4]) == 4 {
+				dir.compression = uint16(order.Uint32(data[entry+8 : entry+12]))
+			} else {
+				dir.compression = order.Uint16(data[entry+8 : entry+10])
+			}
+		}
+		dirs = append(dirs, dir)
+		offset = order.Uint32(data[end : end+4])
+	}
+	if len(dirs) == 0 {
+		return nil, nil, fmt.Errorf("failed to decode TIFF: the file has no pages")
+	}
+	return order, dirs, nil
+}
+
+// encodeTIFFPage кодирует черно-белые, серые и палитровые страницы в PNG без потерь, а цветные — в JPEG,
+// чтобы цветной скан не превращался в многомегабайтный PNG.
+func encodeTIFFPage(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	switch img.(type) {
+	case *image.Gray, *image.Gray16, *image.Paletted:
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	default:
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,63 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Ограничения времени по умолчанию для request_timeout и file_timeout в config.json.
+const (
+	DefaultRequestTimeout = 120 * time.Second
+	DefaultFileTimeout    = 10 * time.Minute
+)
+
+// WithRequestTimeout ограничивает время ответа модели на один запрос: извлечение, группировку страниц,
+// проверку ориентации, исправление JSON и сопоставление контрагентов. Ожидание ограничителя запросов
+// (WithRateLimiter) в это время не входит. Не дождавшийся ответа запрос завершается ошибкой ErrTimeout.
+// 0 — без ограничения (по умолчанию).
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(p *Processor) { p.requestTimeout = timeout }
+}
+
+// WithFileTimeout ограничивает время обработки одного файла целиком (ProcessFile, ProcessBytes,
+// ProcessReader и файлы ProcessBatch). Файл, не обработанный за это время, завершается ошибкой ErrTimeout.
+// 0 — без ограничения (по умолчанию).
+func WithFileTimeout(timeout time.Duration) Option {
+	return func(p *Processor) { p.fileTimeout = timeout }
+}
+
+// timeoutClient ограничивает время каждого запроса к модели.
+type timeoutClient struct {
+	ChatClient
+	timeout time.Duration
+}
+
+func (c timeoutClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	requestCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := c.ChatClient.CreateChatCompletion(requestCtx, request)
+	if err != nil && ctx.Err() == nil && errors.Is(requestCtx.Err(), context.DeadlineExceeded) {
+		// Исходная ошибка сохраняется: по ней зависший запрос считается недоступностью OpenAI (IsUnavailableError)
+		return resp, fmt.Errorf("%w: the model did not respond within %s: %w", ErrTimeout, c.timeout, err)
+	}
+	return resp, err
+}
+
+// withFileTimeout выполняет process с ограничением WithFileTimeout. Если время вышло, а ctx вызывающего
+// еще действует, ошибка обработки заменяется на ErrTimeout.
+func (p *Processor) withFileTimeout(ctx context.Context, process func(ctx context.Context) ([]Invoice, Usage, error)) ([]Invoice, Usage, error) {
+	if p.fileTimeout <= 0 {
+		return process(ctx)
+	}
+	fileCtx, cancel := context.WithTimeout(ctx, p.fileTimeout)
+	defer cancel()
+	invoices, usage, err := process(fileCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+		return nil, usage, fmt.Errorf("%w: the file was not processed within %s", ErrTimeout, p.fileTimeout)
+	}
+	return invoices, usage, err
+}
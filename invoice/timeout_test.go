@@ -0,0 +1,77 @@
+package invoice
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// sleepingChat — ChatClient, который отвечает только через delay или при отмене запроса.
+func sleepingChat(delay time.Duration) chatFunc {
+	return func(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		select {
+		case <-time.After(delay):
+			return fakeAnalysis(request, "INV-1"), nil
+		case <-ctx.Done():
+			return openai.ChatCompletionResponse{}, ctx.Err()
+		}
+	}
+}
+
+// imageFile создает изображение страницы, которое обрабатывается без poppler.
+func imageFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "scan.png")
+	if err := os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		option Option
+	}{
+		{"request timeout", WithRequestTimeout(20 * time.Millisecond)},
+		{"file timeout", WithFileTimeout(50 * time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(sleepingChat(time.Minute), tt.option, quiet())
+			started := time.Now()
+			_, _, err := p.ProcessFile(context.Background(), imageFile(t))
+			if !errors.Is(err, ErrTimeout) || ErrorCode(err) != ErrorCodeTimeout {
+				t.Errorf("ProcessFile = %v, want ErrTimeout", err)
+			}
+			if elapsed := time.Since(started); elapsed > 10*time.Second {
+				t.Errorf("ProcessFile returned after %s", elapsed)
+			}
+		})
+	}
+}
+
+// TestTimeoutsLeaveFastRequests проверяет, что ответ в пределах ограничений обрабатывается как обычно.
+func TestTimeoutsLeaveFastRequests(t *testing.T) {
+	p := NewProcessor(sleepingChat(time.Millisecond), WithRequestTimeout(time.Second), WithFileTimeout(5*time.Second), quiet())
+	invoices, _, err := p.ProcessFile(context.Background(), imageFile(t))
+	if err != nil || len(invoices) != 1 || invoices[0].Number != "INV-1" {
+		t.Errorf("ProcessFile = %+v, %v, want INV-1", invoices, err)
+	}
+}
+
+// TestCancellationIsNotTimeout проверяет, что отмена вызывающим не выдается за ErrTimeout.
+func TestCancellationIsNotTimeout(t *testing.T) {
+	p := NewProcessor(sleepingChat(time.Minute), WithRequestTimeout(time.Minute), WithFileTimeout(time.Minute), quiet())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, _, err := p.ProcessFile(ctx, imageFile(t))
+	if errors.Is(err, ErrTimeout) || !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessFile = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,205 @@
+package invoice
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Фазы трассировки (Span.Phase).
+const (
+	PhaseQueue       = "queue"       // Ожидание файла в очереди ProcessBatch (и слота адаптивного параллелизма)
+	PhaseEmbedded    = "embedded"    // Чтение XML ZUGFeRD/Factur-X, вложенного в PDF
+	PhaseText        = "text"        // Извлечение текстового слоя PDF для анализа по тексту
+	PhaseRender      = "render"      // Конвертация PDF или страниц TIFF в изображения
+	PhaseOrientation = "orientation" // Поиск перевернутых страниц дуплексного скана
+	PhaseGrouping    = "grouping"    // Запрос группировки страниц к OpenAI
+	PhaseExtraction  = "extraction"  // Запрос детального анализа инвойса к OpenAI
+	PhaseRepair      = "repair"      // Запрос исправления неразбираемого JSON-ответа
+	PhaseQR          = "qr"          // Поиск платежного QR-кода на изображениях страниц
+	PhaseLocal       = "local"       // Локальное извлечение в деградированном режиме
+	PhaseMatching    = "matching"    // Запрос сопоставления контрагентов к OpenAI
+	PhaseReport      = "report"      // Запись отчетов
+)
+
+// TracePhases — фазы в порядке обработки, в котором они выводятся в сводке.
+var TracePhases = []string{PhaseQueue, PhaseEmbedded, PhaseText, PhaseRender, PhaseOrientation, PhaseGrouping, PhaseExtraction, PhaseRepair, PhaseQR, PhaseLocal, PhaseMatching, PhaseReport}
+
+// Span — одна измеренная операция.
+type Span struct {
+	Phase    string        `json:"phase"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Trace собирает длительности операций обработки одного файла (или этапов пакета: сопоставления
+// и записи отчетов). Методы nil-трассы ничего не делают, поэтому без WithTracing трассировка
+// стоит одного сравнения с nil на операцию.
+type Trace struct {
+	Path    string `json:"path,omitempty"`
+	Spans   []Span `json:"spans"`
+	Retries int    `json:"retries"` // Повторы файла после ошибок 429 (адаптивный параллелизм)
+
+	mu sync.Mutex
+}
+
+// Record добавляет операцию фазы phase, начатую в start и завершенную сейчас.
+func (t *Trace) Record(phase string, start time.Time, err error) {
+	if t == nil {
+		return
+	}
+	span := Span{Phase: phase, Start: start, Duration: time.Since(start)}
+	if err != nil {
+		span.Error = err.Error()
+	}
+	t.mu.Lock()
+	t.Spans = append(t.Spans, span)
+	t.mu.Unlock()
+}
+
+func (t *Trace) retried() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.Retries++
+	t.mu.Unlock()
+}
+
+type traceKey struct{}
+
+// WithTrace возвращает контекст, операции в котором записываются в trace.
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// TraceFrom возвращает трассу контекста или nil, если трассировка выключена.
+func TraceFrom(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// PhaseStats — сводка длительностей одной фазы.
+type PhaseStats struct {
+	Phase  string        `json:"phase"`
+	Count  int           `json:"count"`
+	Errors int           `json:"errors"`
+	Total  time.Duration `json:"total_ns"`
+	P50    time.Duration `json:"p50_ns"`
+	P95    time.Duration `json:"p95_ns"`
+	Max    time.Duration `json:"max_ns"`
+}
+
+// SummarizeTraces сводит операции трасс по фазам в порядке TracePhases. Фазы без операций пропускаются.
+func SummarizeTraces(traces []*Trace) []PhaseStats {
+	durations := make(map[string][]time.Duration)
+	errors := make(map[string]int)
+	for _, trace := range traces {
+		if trace == nil {
+			continue
+		}
+		trace.mu.Lock()
+		for _, span := range trace.Spans {
+			durations[span.Phase] = append(durations[span.Phase], span.Duration)
+			if span.Error != "" {
+				errors[span.Phase]++
+			}
+		}
+		trace.mu.Unlock()
+	}
+	var stats []PhaseStats
+	for _, phase := range TracePhases {
+		values := durations[phase]
+		if len(values) == 0 {
+			continue
+		}
+		slices.Sort(values)
+		s := PhaseStats{Phase: phase, Count: len(values), Errors: errors[phase], Max: values[len(values)-1]}
+		for _, d := range values {
+			s.Total += d
+		}
+		s.P50, s.P95 = Percentile(values, 0.5), Percentile(values, 0.95)
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Percentile возвращает перцентиль q (0–1) отсортированных длительностей методом ближайшего ранга.
+func Percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[clamp(rank, 0, len(sorted)-1)]
+}
+
+// TraceTable возвращает сводку по фазам в виде строк таблицы для журнала.
+func TraceTable(stats []PhaseStats) []string {
+	lines := []string{fmt.Sprintf("%-12s %6s %6s %10s %10s %10s %10s", "phase", "count", "errors", "total", "p50", "p95", "max")}
+	for _, s := range stats {
+		lines = append(lines, fmt.Sprintf("%-12s %6d %6d %10s %10s %10s %10s", s.Phase, s.Count, s.Errors,
+			roundDuration(s.Total), roundDuration(s.P50), roundDuration(s.P95), roundDuration(s.Max)))
+	}
+	return lines
+}
+
+// FileDuration — время обработки одного файла (Result.DurationMS).
+type FileDuration struct {
+	SourceFile string
+	Duration   time.Duration
+}
+
+func (f FileDuration) String() string {
+	return fmt.Sprintf("%s (%s)", f.SourceFile, roundDuration(f.Duration))
+}
+
+// FileTimings — сводка времени обработки файлов пакета. В отличие от трасс она собирается всегда:
+// время обработки каждого файла есть в Result.DurationMS.
+type FileTimings struct {
+	Files         []FileDuration // Файлы от самого долгого к самому быстрому
+	P50, P95, Max time.Duration
+}
+
+// SummarizeFileTimings сводит время обработки файлов results. Результаты без времени (не первые инвойсы
+// файлов и строки прошлых отчетов без колонки "Duration (ms)") пропускаются.
+func SummarizeFileTimings(results []Result) FileTimings {
+	var timings FileTimings
+	for _, res := range results {
+		if res.DurationMS > 0 {
+			timings.Files = append(timings.Files, FileDuration{SourceFile: res.SourceFile, Duration: time.Duration(res.DurationMS) * time.Millisecond})
+		}
+	}
+	if len(timings.Files) == 0 {
+		return timings
+	}
+	slices.SortStableFunc(timings.Files, func(a, b FileDuration) int { return cmp.Compare(b.Duration, a.Duration) })
+	sorted := make([]time.Duration, len(timings.Files))
+	for i, f := range timings.Files {
+		sorted[len(sorted)-1-i] = f.Duration
+	}
+	timings.P50, timings.P95, timings.Max = Percentile(sorted, 0.5), Percentile(sorted, 0.95), sorted[len(sorted)-1]
+	return timings
+}
+
+// Slowest возвращает не больше n самых долгих файлов.
+func (t FileTimings) Slowest(n int) []FileDuration {
+	return t.Files[:min(n, len(t.Files))]
+}
+
+// Line возвращает сводку одной строкой: "p50 1.2s, p95 4.5s, max 6.1s".
+func (t FileTimings) Line() string {
+	return fmt.Sprintf("p50 %s, p95 %s, max %s", roundDuration(t.P50), roundDuration(t.P95), roundDuration(t.Max))
+}
+
+// roundDuration округляет длительность для таблиц: до миллисекунд, а после секунды — до десятых секунды.
+func roundDuration(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond)
+	}
+	return d.Round(time.Millisecond)
+}
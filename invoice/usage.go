@@ -0,0 +1,54 @@
+package invoice
+
+import "github.com/sashabaranov/go-openai"
+
+// Usage содержит статистику использования OpenAI API.
+type Usage struct {
+	Model            string `json:"model,omitempty"`   // Модель, к которой относились запросы
+	PromptTokens     int    `json:"prompt_tokens"`     // Токены запроса
+	CompletionTokens int    `json:"completion_tokens"` // Токены ответа
+	Requests         int    `json:"requests"`          // Количество запросов
+}
+
+// ModelPrice задает стоимость модели в долларах за миллион токенов.
+type ModelPrice struct {
+	PromptPerMillion     float64 `json:"prompt_per_million"`
+	CompletionPerMillion float64 `json:"completion_per_million"`
+}
+
+// DefaultModelPrices — цены по умолчанию, если в конфиге не указано иное.
+var DefaultModelPrices = map[string]ModelPrice{
+	openai.GPT4o:     {PromptPerMillion: 2.50, CompletionPerMillion: 10.00},
+	openai.GPT4oMini: {PromptPerMillion: 0.15, CompletionPerMillion: 0.60},
+}
+
+// Add прибавляет к статистике данные другой статистики.
+func (u *Usage) Add(other Usage) {
+	if u.Model == "" {
+		u.Model = other.Model
+	}
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.Requests += other.Requests
+}
+
+// record учитывает один ответ OpenAI.
+func (u *Usage) record(model string, resp openai.Usage) {
+	u.Add(Usage{
+		Model:            model,
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+		Requests:         1,
+	})
+}
+
+// EstimateCost оценивает стоимость в долларах по таблице цен.
+// Если модели нет в prices, используется DefaultModelPrices.
+func (u Usage) EstimateCost(prices map[string]ModelPrice) float64 {
+	price, ok := prices[u.Model]
+	if !ok {
+		price = DefaultModelPrices[u.Model]
+	}
+	return float64(u.PromptTokens)/1e6*price.PromptPerMillion +
+		float64(u.CompletionTokens)/1e6*price.CompletionPerMillion
+}
@@ -0,0 +1,93 @@
+package invoice
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Уровни важности проблем валидации.
+const (
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// ValidationIssue описывает проблему в извлеченных данных инвойса.
+type ValidationIssue struct {
+	Field    string `json:"field"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// String возвращает проблему в виде "field: message".
+func (v ValidationIssue) String() string {
+	return fmt.Sprintf("%s: %s", v.Field, v.Message)
+}
+
+// taxBreakdownTolerance — допустимое расхождение суммы разбивки налога с TaxAmount (округление по строкам).
+const taxBreakdownTolerance = 0.05
+
+// Validate проверяет инвойс на типичные ошибки распознавания.
+// Инвойс с проблемами не отбрасывается: проблемы показываются пользователю для проверки.
+func (inv Invoice) Validate() []ValidationIssue {
+	var issues []ValidationIssue
+	add := func(field, severity, format string, args ...any) {
+		issues = append(issues, ValidationIssue{Field: field, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if inv.Extraction == ExtractionLocal {
+		add("extraction", SeverityWarning, "degraded extraction: data was read by local heuristics without OpenAI and may be incomplete, re-run the file when OpenAI is available")
+	}
+	if _, ok := typeNames[inv.Type]; !ok || inv.Type == TypeNotInvoice {
+		add("type", SeverityError, "unknown document type %d (expected 1 to 5)", inv.Type)
+	}
+	if _, err := time.Parse("2006-01-02", inv.Date); err != nil {
+		add("date", SeverityWarning, "date %q is not recognized", inv.Date)
+	} else if inv.DateAmbiguous {
+		add("date", SeverityWarning, "date %q is ambiguous, read as %s", inv.RawDate, inv.Date)
+	}
+	if inv.TotalAmount == 0 || (inv.TotalAmount < 0 && !inv.IsCreditNote()) {
+		add("total_amount", SeverityError, "total amount must be greater than 0, got %g", inv.TotalAmount)
+	}
+	if math.Abs(inv.TaxAmount) > math.Abs(inv.TotalAmount) {
+		add("tax_amount", SeverityError, "tax amount %g exceeds total amount %g", inv.TaxAmount, inv.TotalAmount)
+	}
+	if len(inv.TaxBreakdown) > 0 {
+		if sum := inv.TaxBreakdownTotal(); math.Abs(sum-inv.TaxAmount) > taxBreakdownTolerance {
+			add("tax_breakdown", SeverityWarning, "tax breakdown sums to %g, but tax amount is %g", sum, inv.TaxAmount)
+		}
+	}
+	if strings.TrimSpace(inv.Counterparty.Name) == "" {
+		add("counterparty.name", SeverityError, "counterparty name is empty")
+	}
+	if strings.TrimSpace(inv.Counterparty.VAT) == "" {
+		add("counterparty.vat", SeverityWarning, "counterparty VAT is empty")
+	} else if err := ValidateVAT(inv.Counterparty.VAT, inv.Counterparty.CountryCode); err != nil {
+		add("counterparty.vat", SeverityWarning, "%v", err)
+	}
+	// Ошибка в IBAN опаснее всего: деньги уйдут не туда, поэтому каждый счет проверяется по контрольной сумме
+	for _, account := range inv.Counterparty.Accounts() {
+		if account.IBAN == "" {
+			continue
+		}
+		if err := ValidateIBAN(account.IBAN); err != nil {
+			add("counterparty.iban", SeverityError, "%v", err)
+		}
+	}
+	if strings.TrimSpace(inv.Counterparty.Country) == "" && strings.TrimSpace(inv.Counterparty.CountryCode) == "" {
+		add("counterparty.country", SeverityWarning, "counterparty country is empty")
+	} else if _, ok := NormalizeCountry(inv.Counterparty.CountryCode); !ok {
+		add("counterparty.country", SeverityWarning, "country %q is not recognized as an ISO 3166 country", strings.TrimSpace(inv.Counterparty.Country+" "+inv.Counterparty.CountryCode))
+	}
+	return issues
+}
+
+// FormatIssues объединяет проблемы в одну строку для отчетов.
+func FormatIssues(issues []ValidationIssue) string {
+	parts := make([]string, len(issues))
+	for i, issue := range issues {
+		parts[i] = issue.String()
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,197 @@
+package invoice
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Регионы контрагента для сводки по НДС.
+const (
+	RegionDomestic = "domestic"
+	RegionEU       = "eu"
+	RegionNonEU    = "non_eu"
+	RegionUnknown  = "unknown"
+)
+
+// euCountryCodes содержит ISO 3166-1 alpha-2 коды стран Евросоюза.
+var euCountryCodes = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "HR": true, "CY": true, "CZ": true, "DK": true,
+	"EE": true, "FI": true, "FR": true, "DE": true, "GR": true, "HU": true, "IE": true,
+	"IT": true, "LV": true, "LT": true, "LU": true, "MT": true, "NL": true, "PL": true,
+	"PT": true, "RO": true, "SK": true, "SI": true, "ES": true, "SE": true,
+}
+
+// VATSummaryRow — агрегат входящего НДС по региону, валюте и ставке.
+type VATSummaryRow struct {
+	Region   string  `json:"region"`
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+	Base     float64 `json:"base"`
+	Tax      float64 `json:"tax"`
+	Invoices int     `json:"invoices"`
+}
+
+// VATSummary содержит сводку НДС за период.
+// Инвойсы без разбивки по ставкам попадают в Unclassified, чтобы ничего не терялось.
+type VATSummary struct {
+	From         time.Time       `json:"from,omitempty"`
+	To           time.Time       `json:"to,omitempty"`
+	Rows         []VATSummaryRow `json:"rows"`
+	Unclassified []VATSummaryRow `json:"unclassified"`
+	Undated      int             `json:"undated"` // Инвойсы с нераспознанной датой (исключены при заданном периоде)
+}
+
+// ParseInvoiceDate разбирает дату инвойса в форматах DD.MM.YYYY и YYYY-MM-DD.
+func ParseInvoiceDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"02.01.2006", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized invoice date: %q", s)
+}
+
+// CounterpartyRegion определяет регион контрагента относительно моей компании. Коды стран
+// могут быть alpha-2 или alpha-3 (например, в my_company конфига или в базе контрагентов).
+func CounterpartyRegion(cp, myCompany Counterparty) string {
+	code, myCode := countryCode(cp.CountryCode), countryCode(myCompany.CountryCode)
+	switch {
+	case code != "" && myCode != "" && code == myCode:
+		return RegionDomestic
+	case code == "" && cp.Country != "" && strings.EqualFold(strings.TrimSpace(cp.Country), strings.TrimSpace(myCompany.Country)):
+		return RegionDomestic
+	case code == "":
+		return RegionUnknown
+	case euCountryCodes[code]:
+		return RegionEU
+	default:
+		return RegionNonEU
+	}
+}
+
+// vatAccumulator суммирует строку сводки в минимальных единицах валюты, чтобы избежать накопления погрешности.
+type vatAccumulator struct {
+	row       VATSummaryRow
+	baseMinor int64
+	taxMinor  int64
+}
+
+// SummarizeVAT агрегирует налог по ставкам и регионам контрагентов за период [from, to].
+// Нулевые from/to означают открытую границу периода. Суммы складываются в минимальных
+// единицах валюты и округляются по политике policy.
+func SummarizeVAT(invoices []Invoice, myCompany Counterparty, from, to time.Time, policy RoundingPolicy) VATSummary {
+	summary := VATSummary{From: from, To: to}
+	rows := make(map[string]*vatAccumulator)
+	unclassified := make(map[string]*vatAccumulator)
+
+	for _, inv := range invoices {
+		if !from.IsZero() || !to.IsZero() {
+			date, err := ParseInvoiceDate(inv.Date)
+			if err != nil {
+				summary.Undated++
+				continue
+			}
+			if (!from.IsZero() && date.Before(from)) || (!to.IsZero() && date.After(to)) {
+				continue
+			}
+		}
+
+		region := CounterpartyRegion(inv.Counterparty, myCompany)
+		currency := strings.ToUpper(inv.Currency)
+		signed := func(amount float64) int64 { return ToMinor(amount, currency, policy) }
+		if inv.IsCreditNote() {
+			// Кредит-ноты уменьшают налог и базу, а не увеличивают их
+			signed = func(amount float64) int64 { return -ToMinor(math.Abs(amount), currency, policy) }
+		}
+
+		if len(inv.TaxBreakdown) == 0 {
+			key := region + "|" + currency
+			acc, ok := unclassified[key]
+			if !ok {
+				acc = &vatAccumulator{row: VATSummaryRow{Region: region, Currency: currency}}
+				unclassified[key] = acc
+			}
+			acc.baseMinor += signed(inv.TotalAmount) - signed(inv.TaxAmount)
+			acc.taxMinor += signed(inv.TaxAmount)
+			acc.row.Invoices++
+			continue
+		}
+
+		for _, line := range inv.TaxBreakdown {
+			key := fmt.Sprintf("%s|%s|%g", region, currency, line.Rate)
+			acc, ok := rows[key]
+			if !ok {
+				acc = &vatAccumulator{row: VATSummaryRow{Region: region, Currency: currency, Rate: line.Rate}}
+				rows[key] = acc
+			}
+			acc.baseMinor += signed(line.Base)
+			acc.taxMinor += signed(line.Amount)
+			acc.row.Invoices++
+		}
+	}
+
+	summary.Rows = sortedVATRows(rows)
+	summary.Unclassified = sortedVATRows(unclassified)
+	return summary
+}
+
+func sortedVATRows(m map[string]*vatAccumulator) []VATSummaryRow {
+	result := make([]VATSummaryRow, 0, len(m))
+	for _, acc := range m {
+		row := acc.row
+		row.Base = FromMinor(acc.baseMinor, row.Currency)
+		row.Tax = FromMinor(acc.taxMinor, row.Currency)
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Region != result[j].Region {
+			return result[i].Region < result[j].Region
+		}
+		if result[i].Currency != result[j].Currency {
+			return result[i].Currency < result[j].Currency
+		}
+		return result[i].Rate < result[j].Rate
+	})
+	return result
+}
+
+// WriteVATSummaryCSV записывает сводку НДС в формате CSV.
+func WriteVATSummaryCSV(w io.Writer, summary VATSummary) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"Bucket", "Region", "Currency", "Rate", "Base", "Tax", "Invoices"}); err != nil {
+		return err
+	}
+	write := func(bucket string, rows []VATSummaryRow) error {
+		for _, row := range rows {
+			rate := strconv.FormatFloat(row.Rate, 'f', -1, 64)
+			if bucket == "unclassified" {
+				rate = ""
+			}
+			record := []string{
+				bucket, row.Region, row.Currency, rate,
+				FormatAmount(row.Base, row.Currency),
+				FormatAmount(row.Tax, row.Currency),
+				strconv.Itoa(row.Invoices),
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write("classified", summary.Rows); err != nil {
+		return err
+	}
+	if err := write("unclassified", summary.Unclassified); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
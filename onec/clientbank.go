@@ -0,0 +1,113 @@
+package onec
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// clientBankVersion — версия формата обмена с клиентом банка.
+const clientBankVersion = "1.03"
+
+// clientBankDate — формат дат файла обмена: ДД.ММ.ГГГГ.
+const clientBankDate = "02.01.2006"
+
+// writeClientBank записывает платежные поручения в формате 1CClientBankExchange в кодировке Windows-1251.
+// Номер платежного поручения — порядковый номер документа в файле: номер инвойса есть в назначении платежа.
+// Документ без даты инвойса датируется днем формирования файла.
+func writeClientBank(w io.Writer, docs []Document, company Party, created time.Time) error {
+	var out strings.Builder
+	line := func(key, value string) {
+		if key == "" {
+			fmt.Fprintf(&out, "%s\r\n", value)
+			return
+		}
+		fmt.Fprintf(&out, "%s=%s\r\n", key, value)
+	}
+
+	start, end := created, created
+	for i, doc := range docs {
+		date := documentDate(doc, created)
+		if i == 0 || date.Before(start) {
+			start = date
+		}
+		if i == 0 || date.After(end) {
+			end = date
+		}
+	}
+
+	line("", "1CClientBankExchange")
+	line("ВерсияФормата", clientBankVersion)
+	line("Кодировка", "Windows")
+	line("Отправитель", "invpa")
+	line("Получатель", "")
+	line("ДатаСоздания", created.Format(clientBankDate))
+	line("ВремяСоздания", created.Format(time.TimeOnly))
+	line("ДатаНачала", start.Format(clientBankDate))
+	line("ДатаКонца", end.Format(clientBankDate))
+	line("РасчСчет", company.Account)
+	line("Документ", "Платежное поручение")
+
+	for i, doc := range docs {
+		line("СекцияДокумент", "Платежное поручение")
+		line("Номер", strconv.Itoa(i+1))
+		line("Дата", documentDate(doc, created).Format(clientBankDate))
+		line("Сумма", formatAmount(doc.Amount))
+		writeClientBankParty(line, "Плательщик", doc.Payer)
+		writeClientBankParty(line, "Получатель", doc.Payee)
+		line("ВидОплаты", "01")
+		line("Очередность", "5")
+		line("НазначениеПлатежа", doc.Purpose)
+		line("", "КонецДокумента")
+	}
+	line("", "КонецФайла")
+
+	data, err := charmap.Windows1251.NewEncoder().String(toWindows1251(out.String()))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, data)
+	return err
+}
+
+// toWindows1251 заменяет символы, которых нет в Windows-1251, чтобы они не прерывали выгрузку: латиница
+// с диакритикой («ę», «ő») теряет диакритические знаки, остальные символы («ł», иероглифы) становятся «?».
+func toWindows1251(s string) string {
+	return strings.Map(func(r rune) rune {
+		if _, ok := charmap.Windows1251.EncodeRune(r); ok {
+			return r
+		}
+		if base := []rune(norm.NFD.String(string(r))); len(base) > 1 && unicode.Is(unicode.Mn, base[1]) {
+			if _, ok := charmap.Windows1251.EncodeRune(base[0]); ok {
+				return base[0]
+			}
+		}
+		return '?'
+	}, s)
+}
+
+// writeClientBankParty записывает реквизиты плательщика или получателя (prefix — «Плательщик» или «Получатель»).
+func writeClientBankParty(line func(key, value string), prefix string, party Party) {
+	line(prefix+"Счет", party.Account)
+	line(prefix, party.Name)
+	line(prefix+"ИНН", party.INN)
+	line(prefix+"КПП", party.KPP)
+	line(prefix+"1", party.Name)
+	line(prefix+"РасчСчет", party.Account)
+	line(prefix+"Банк1", party.Bank)
+	line(prefix+"БИК", party.BIK)
+}
+
+// documentDate возвращает дату документа или fallback, если дата инвойса не извлечена.
+func documentDate(doc Document, fallback time.Time) time.Time {
+	if doc.Date.IsZero() {
+		return fallback
+	}
+	return doc.Date
+}
@@ -0,0 +1,142 @@
+package onec
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"time"
+)
+
+// commerceMLVersion — версия схемы CommerceML.
+const commerceMLVersion = "2.10"
+
+// Роли сторон документа CommerceML.
+const (
+	roleBuyer  = "Покупатель"
+	roleSeller = "Продавец"
+)
+
+type cmlRoot struct {
+	XMLName   xml.Name      `xml:"КоммерческаяИнформация"`
+	Version   string        `xml:"ВерсияСхемы,attr"`
+	Created   string        `xml:"ДатаФормирования,attr"`
+	Documents []cmlDocument `xml:"Документ"`
+}
+
+type cmlDocument struct {
+	ID           string           `xml:"Ид"`
+	Number       string           `xml:"Номер"`
+	Date         string           `xml:"Дата,omitempty"`
+	Operation    string           `xml:"ХозОперация"`
+	Role         string           `xml:"Роль"`
+	Currency     string           `xml:"Валюта,omitempty"`
+	Amount       string           `xml:"Сумма"`
+	Counterparts []cmlCounterpart `xml:"Контрагенты>Контрагент"`
+	Taxes        *cmlTaxes        `xml:"Налоги,omitempty"`
+	Comment      string           `xml:"Комментарий,omitempty"`
+}
+
+type cmlCounterpart struct {
+	ID       string       `xml:"Ид"`
+	Name     string       `xml:"Наименование"`
+	Role     string       `xml:"Роль"`
+	FullName string       `xml:"ПолноеНаименование,omitempty"`
+	INN      string       `xml:"ИНН,omitempty"`
+	KPP      string       `xml:"КПП,omitempty"`
+	Accounts *cmlAccounts `xml:"РасчетныеСчета,omitempty"`
+}
+
+// cmlAccounts и cmlTaxes — указатели в документе, чтобы пустые списки не выводились пустыми элементами.
+type cmlAccounts struct {
+	Items []cmlAccount `xml:"РасчетныйСчет"`
+}
+
+type cmlAccount struct {
+	Number string   `xml:"НомерСчета"`
+	Bank   *cmlBank `xml:"Банк,omitempty"`
+}
+
+type cmlBank struct {
+	Name string `xml:"Наименование,omitempty"`
+	BIK  string `xml:"БИК,omitempty"`
+}
+
+type cmlTaxes struct {
+	Items []cmlTax `xml:"Налог"`
+}
+
+type cmlTax struct {
+	Name     string `xml:"Наименование"`
+	Included bool   `xml:"УчтеноВСумме"`
+	Amount   string `xml:"Сумма"`
+}
+
+// writeCommerceML записывает инвойсы документами «Счет на оплату» CommerceML 2 в UTF-8.
+// Роль документа — роль своей компании: покупатель для входящих инвойсов, продавец для исходящих.
+func writeCommerceML(w io.Writer, docs []Document, created time.Time) error {
+	root := cmlRoot{
+		Version:   commerceMLVersion,
+		Created:   created.Format("2006-01-02T15:04:05"),
+		Documents: make([]cmlDocument, 0, len(docs)),
+	}
+	for _, doc := range docs {
+		companyRole, contractorRole := roleBuyer, roleSeller
+		if doc.Outgoing {
+			companyRole, contractorRole = roleSeller, roleBuyer
+		}
+		item := cmlDocument{
+			ID:           doc.ID,
+			Number:       doc.Number,
+			Operation:    "Счет на оплату",
+			Role:         companyRole,
+			Currency:     doc.Currency,
+			Amount:       formatAmount(doc.Amount),
+			Counterparts: []cmlCounterpart{newCounterpart(doc.Contractor, contractorRole)},
+			Comment:      doc.Purpose,
+		}
+		if !doc.Date.IsZero() {
+			item.Date = doc.Date.Format(time.DateOnly)
+		}
+		if doc.VAT != 0 {
+			item.Taxes = &cmlTaxes{Items: []cmlTax{{Name: "НДС", Included: true, Amount: formatAmount(doc.VAT)}}}
+		}
+		root.Documents = append(root.Documents, item)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// newCounterpart строит контрагента CommerceML. Ид — ID из базы контрагентов, иначе ИНН или наименование.
+func newCounterpart(party Party, role string) cmlCounterpart {
+	cp := cmlCounterpart{
+		ID:       party.INN,
+		Name:     party.Name,
+		Role:     role,
+		FullName: party.Name,
+		INN:      party.INN,
+		KPP:      party.KPP,
+	}
+	switch {
+	case party.ID != 0:
+		cp.ID = strconv.FormatUint(party.ID, 10)
+	case cp.ID == "":
+		cp.ID = party.Name
+	}
+	if party.Account != "" {
+		account := cmlAccount{Number: party.Account}
+		if party.Bank != "" || party.BIK != "" {
+			account.Bank = &cmlBank{Name: party.Bank, BIK: party.BIK}
+		}
+		cp.Accounts = &cmlAccounts{Items: []cmlAccount{account}}
+	}
+	return cp
+}
@@ -0,0 +1,200 @@
+// Package onec выгружает результаты обработки в файлы обмена для 1С:Бухгалтерии: формат обмена
+// с клиентом банка (1CClientBankExchange, платежные поручения) и CommerceML (документы «Счет на оплату»).
+// Сопоставление полей инвойса с реквизитами 1С собрано в Documents, поэтому оба формата выгружают
+// одни и те же значения.
+package onec
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// Format — формат файла обмена.
+type Format string
+
+const (
+	ClientBank Format = "client_bank" // 1CClientBankExchange в кодировке Windows-1251
+	CommerceML Format = "commerceml"  // CommerceML 2 в UTF-8
+)
+
+// ParseFormat разбирает формат файла обмена (onec_format в config.json); пустая строка — ClientBank.
+func ParseFormat(s string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(s))) {
+	case "", ClientBank:
+		return ClientBank, nil
+	case CommerceML:
+		return CommerceML, nil
+	}
+	return "", fmt.Errorf("unknown 1C exchange format %q, expected %s or %s", s, ClientBank, CommerceML)
+}
+
+// Extension возвращает расширение файла обмена: ".txt" для ClientBank, ".xml" для CommerceML.
+func (f Format) Extension() string {
+	if f == CommerceML {
+		return ".xml"
+	}
+	return ".txt"
+}
+
+// ContentType возвращает MIME-тип файла обмена.
+func (f Format) ContentType() string {
+	if f == CommerceML {
+		return "application/xml; charset=utf-8"
+	}
+	return "text/plain; charset=windows-1251"
+}
+
+// Options — параметры выгрузки.
+type Options struct {
+	Format    Format
+	MyCompany invoice.Counterparty // Своя компания: плательщик входящих инвойсов и получатель исходящих
+	Created   time.Time            // Время формирования файла; нулевое — текущее
+}
+
+// Party — реквизиты стороны документа.
+type Party struct {
+	ID      uint64 // ID контрагента в базе; 0 — своя компания или база не ведет ID
+	Name    string
+	INN     string // Налоговый номер (VAT)
+	KPP     string // Второй налоговый код (TaxCode2)
+	Account string // Основной счет: номер счета или IBAN
+	Bank    string
+	BIK     string // БИК банка; SWIFT в это поле не попадает
+}
+
+// Document — инвойс в терминах 1С.
+type Document struct {
+	ID         string    // Идентификатор для CommerceML: исходный файл и номер инвойса в нем
+	Number     string    // Номер инвойса
+	Date       time.Time // Дата инвойса; нулевая, если не извлечена
+	Amount     float64
+	VAT        float64
+	Currency   string
+	Purpose    string // Назначение платежа (НазначениеПлатежа, Комментарий)
+	Outgoing   bool   // Инвойс выставлен своей компанией: платит контрагент
+	Payer      Party
+	Payee      Party
+	Company    Party // Своя компания (Payer или Payee)
+	Contractor Party // Контрагент (Payee или Payer)
+}
+
+// maxPurposeLength — длина поля НазначениеПлатежа платежного поручения.
+const maxPurposeLength = 210
+
+// bikPattern — БИК российского банка: 9 цифр.
+var bikPattern = regexp.MustCompile(`^\d{9}$`)
+
+// Documents сопоставляет инвойсы результатов с документами 1С. Выгружаются только успешно извлеченные
+// инвойсы (TypePaymentOrder), не отмеченные повторами: кассовые чеки уже оплачены, а кредит-ноты
+// не оплачиваются платежным поручением. Инвойс без направления считается входящим.
+func Documents(results []invoice.Result, myCompany invoice.Counterparty) []Document {
+	company := newParty(myCompany)
+	company.ID = 0
+	var docs []Document
+	for _, res := range results {
+		if res.ErrorMessage != "" || res.Invoice == nil || res.IsDuplicate() || res.Invoice.Type != invoice.TypePaymentOrder {
+			continue
+		}
+		inv := res.Invoice
+		doc := Document{
+			ID:         fmt.Sprintf("%s#%d", res.SourceFile, res.InvoiceIndex),
+			Number:     inv.Number,
+			Amount:     inv.TotalAmount,
+			VAT:        inv.TaxAmount,
+			Currency:   inv.Currency,
+			Purpose:    purpose(inv),
+			Outgoing:   inv.Direction == invoice.DirectionOutgoing,
+			Company:    company,
+			Contractor: newParty(inv.Counterparty),
+		}
+		doc.Date, _ = time.Parse(time.DateOnly, inv.Date)
+		if doc.Outgoing {
+			doc.Payer, doc.Payee = doc.Contractor, doc.Company
+		} else {
+			doc.Payer, doc.Payee = doc.Company, doc.Contractor
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// Write записывает инвойсы результатов в w в формате opts.Format.
+func Write(w io.Writer, results []invoice.Result, opts Options) error {
+	created := opts.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	docs := Documents(results, opts.MyCompany)
+	switch opts.Format {
+	case "", ClientBank:
+		return writeClientBank(w, docs, newParty(opts.MyCompany), created)
+	case CommerceML:
+		return writeCommerceML(w, docs, created)
+	}
+	return fmt.Errorf("unknown 1C exchange format %q", opts.Format)
+}
+
+func newParty(cp invoice.Counterparty) Party {
+	party := Party{
+		ID:   cp.ID,
+		Name: clean(cp.Name),
+		INN:  clean(cp.VAT),
+		KPP:  clean(cp.TaxCode2),
+	}
+	if accounts := cp.Accounts(); len(accounts) > 0 {
+		account := accounts[0]
+		party.Account = clean(account.AccountNumber)
+		if party.Account == "" {
+			party.Account = clean(account.IBAN)
+		}
+		party.Bank = clean(account.BankName)
+		if bikPattern.MatchString(account.SWIFT) {
+			party.BIK = account.SWIFT
+		}
+	}
+	return party
+}
+
+// purpose строит назначение платежа: «Оплата по счету № 15 от 02.01.2024. Услуги связи. В т.ч. НДС 20.00».
+// Сумма в другой валюте, чем рубли, отмечается, потому что платежное поручение 1С всегда в рублях.
+func purpose(inv *invoice.Invoice) string {
+	var parts []string
+	head := "Оплата по счету"
+	if inv.Number != "" {
+		head += " № " + inv.Number
+	}
+	if date, err := time.Parse(time.DateOnly, inv.Date); err == nil {
+		head += " от " + date.Format("02.01.2006")
+	}
+	parts = append(parts, head)
+	if text := strings.TrimRight(clean(inv.Purpose), ". "); text != "" {
+		parts = append(parts, text)
+	}
+	if inv.TaxAmount != 0 {
+		parts = append(parts, "В т.ч. НДС "+formatAmount(inv.TaxAmount))
+	} else {
+		parts = append(parts, "Без налога (НДС)")
+	}
+	if currency := strings.ToUpper(inv.Currency); currency != "" && currency != "RUB" && currency != "RUR" {
+		parts = append(parts, "Сумма в "+currency)
+	}
+	text := []rune(strings.Join(parts, ". "))
+	if len(text) > maxPurposeLength {
+		text = text[:maxPurposeLength]
+	}
+	return string(text)
+}
+
+// clean убирает переводы строк и лишние пробелы: в файле обмена значение занимает одну строку.
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("%.2f", amount)
+}
@@ -0,0 +1,85 @@
+package onec
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var myCompany = invoice.Counterparty{
+	Name: "ООО «Ромашка»", VAT: "7701234567", TaxCode2: "770101001",
+	BankAccounts: []invoice.BankAccount{{AccountNumber: "40702810900000000001", BankName: "ПАО Сбербанк", SWIFT: "044525225"}},
+}
+
+// goldenResults возвращает входящий и исходящий инвойсы, инвойс в евро без даты и строки, которые
+// не выгружаются: повтор, кассовый чек и ошибку обработки.
+func goldenResults() []invoice.Result {
+	supplier := invoice.Counterparty{
+		ID: 7, Name: "АО «Связь»\nфилиал", VAT: "7709876543", TaxCode2: "770901001",
+		BankAccounts: []invoice.BankAccount{{AccountNumber: "40702810500000000002", BankName: "АО «Альфа-Банк»", SWIFT: "044525593"}},
+	}
+	customer := invoice.Counterparty{Name: "ИП Иванов И. И.", VAT: "500100732259"}
+	foreign := invoice.Counterparty{
+		Name: "Przedsiębiorstwo Łódź Sp. z o.o.", VAT: "PL5260250274",
+		BankAccounts: []invoice.BankAccount{{IBAN: "PL61109010140000071219812874", SWIFT: "WBKPPLPP"}},
+	}
+	var results []invoice.Result
+	add := func(file string, inv invoice.Invoice) {
+		results = append(results, invoice.FileResults(file, []invoice.Invoice{inv}, invoice.Usage{}, nil)...)
+	}
+	add("связь.pdf", invoice.Invoice{Type: invoice.TypePaymentOrder, Number: "15", Date: "2024-01-02", Currency: "RUB",
+		TotalAmount: 1200, TaxAmount: 200, Purpose: "Услуги связи за декабрь.", Counterparty: supplier})
+	add("выставленный.pdf", invoice.Invoice{Type: invoice.TypePaymentOrder, Number: "А-3", Date: "2024-01-10", Currency: "RUB",
+		TotalAmount: 50000, Direction: invoice.DirectionOutgoing, Purpose: "Консультации", Counterparty: customer})
+	add("faktura.pdf", invoice.Invoice{Type: invoice.TypePaymentOrder, Number: "FV/2024/01", Currency: "EUR",
+		TotalAmount: 990.5, TaxAmount: 185.22, Purpose: "Licencja", Counterparty: foreign})
+	add("копия.pdf", *results[0].Invoice)
+	add("чек.pdf", invoice.Invoice{Type: invoice.TypeReceipt, Number: "0042", Date: "2024-01-03", TotalAmount: 300, Counterparty: supplier})
+	results = append(results, invoice.FileResults("битый.pdf", nil, invoice.Usage{}, os.ErrNotExist)...)
+	invoice.MarkDuplicates(results)
+	return results
+}
+
+func TestWriteGolden(t *testing.T) {
+	created := time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)
+	for _, format := range []Format{ClientBank, CommerceML} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, goldenResults(), Options{Format: format, MyCompany: myCompany, Created: created}); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", string(format)+format.Extension())
+			if format == ClientBank {
+				for _, b := range bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), nil) {
+					if b < 0x20 {
+						t.Fatalf("the exchange file has the control character %#x", b)
+					}
+				}
+			}
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				got := buf.String()
+				if format == ClientBank {
+					got, _ = charmap.Windows1251.NewDecoder().String(got)
+				}
+				t.Errorf("%s differs from %s (go test -update rewrites it):\n%s", format, golden, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+// Package pdfimg конвертирует страницы PDF в изображения с помощью утилиты pdftoppm (poppler),
+// определяет число страниц с помощью pdfinfo, извлекает текстовый слой с помощью pdftotext
+// и вложенные файлы с помощью pdfdetach.
+//
+// Требование: poppler должен быть установлен в системе (pdftoppm, pdfinfo, pdftotext и pdfdetach в PATH) или путь
+// к директории с утилитами должен быть передан в Options.PopplerPath.
+//
+// PDF, защищенный паролем пользователя, открывается с паролями Options.Passwords; если ни один не подошел,
+// функции пакета возвращают ErrEncrypted.
+package pdfimg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format — формат изображений страниц.
+type Format string
+
+const (
+	PNG  Format = "png"
+	JPEG Format = "jpeg"
+)
+
+// ParseFormat разбирает формат изображений страниц; пустая строка — PNG.
+func ParseFormat(s string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(s))) {
+	case "", PNG:
+		return PNG, nil
+	case JPEG, "jpg":
+		return JPEG, nil
+	}
+	return "", fmt.Errorf("unknown image format %q, expected png or jpeg", s)
+}
+
+// Ошибки, которые можно проверить через errors.Is.
+var (
+	ErrPopplerNotFound = errors.New("poppler utility not found: install poppler or set the poppler path")
+	ErrNoPages         = errors.New("pdftoppm did not generate any images")
+	ErrEncrypted       = errors.New("password required") // PDF защищен паролем, и ни один из Options.Passwords не подошел
+)
+
+// CommandError — ошибка выполнения утилиты poppler вместе с ее выводом.
+type CommandError struct {
+	Command string // pdftoppm, pdfinfo, pdftotext или pdfdetach
+	Output  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s command failed: %v. Output: %s", e.Command, e.Err, e.Output)
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// PageLimitError — в PDF больше страниц, чем разрешено Options.MaxPages. Страницы не конвертируются;
+// вызывающий код решает, отклонить файл или обработать его с другим лимитом.
+type PageLimitError struct {
+	Pages int // Число страниц документа по данным pdfinfo
+	Limit int
+}
+
+func (e *PageLimitError) Error() string {
+	return fmt.Sprintf("PDF has %d pages, more than the limit of %d", e.Pages, e.Limit)
+}
+
+// Options настраивает конвертацию.
+type Options struct {
+	PopplerPath string        // Директория с pdftoppm; пусто — поиск в PATH
+	DPI         int           // Разрешение; 0 — значение pdftoppm по умолчанию (150)
+	Format      Format        // Формат изображений; по умолчанию PNG
+	MaxPages    int           // Лимит страниц документа (см. PageLimitError); 0 — без лимита
+	Timeout     time.Duration // Ограничение времени работы pdftoppm; 0 — только ctx
+	Passwords   []string      // Пароли пользователя для защищенных PDF, пробуются по порядку
+}
+
+// Render конвертирует все страницы PDF и возвращает изображения в порядке страниц.
+func Render(ctx context.Context, pdfPath string, opts Options) ([][]byte, error) {
+	var images [][]byte
+	err := RenderEach(ctx, pdfPath, opts, func(page int, image []byte) error {
+		images = append(images, image)
+		return nil
+	})
+	return images, err
+}
+
+// RenderEach конвертирует PDF и вызывает fn для каждой страницы по порядку (page начинается с 1),
+// не держа в памяти все изображения сразу. Ошибка fn прерывает обработку и возвращается как есть.
+// При Options.MaxPages число страниц сначала проверяется через pdfinfo: документ длиннее лимита
+// возвращает *PageLimitError, а pdftoppm получает диапазон -f/-l и не конвертирует лишние страницы.
+func RenderEach(ctx context.Context, pdfPath string, opts Options, fn func(page int, image []byte) error) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	format := opts.Format
+	if format == "" {
+		format = PNG
+	}
+	if format != PNG && format != JPEG {
+		return fmt.Errorf("unsupported image format %q", format)
+	}
+
+	var lastPage int
+	if opts.MaxPages > 0 {
+		pages, err := PageCount(ctx, pdfPath, Options{PopplerPath: opts.PopplerPath, Passwords: opts.Passwords})
+		if err != nil {
+			return err
+		}
+		if pages > opts.MaxPages {
+			return &PageLimitError{Pages: pages, Limit: opts.MaxPages}
+		}
+		lastPage = max(pages, 1)
+	}
+
+	// 1. Создаем временную директорию для изображений
+	tempDir, err := os.MkdirTemp("", "invpa-pages-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 2. Выполняем команду `pdftoppm`
+	args := []string{"-" + string(format)}
+	if opts.DPI > 0 {
+		args = append(args, "-r", strconv.Itoa(opts.DPI))
+	}
+	if lastPage > 0 {
+		args = append(args, "-f", "1", "-l", strconv.Itoa(lastPage))
+	}
+	args = append(args, pdfPath, filepath.Join(tempDir, "page"))
+	if _, err := opts.run(ctx, "pdftoppm", args...); err != nil {
+		return err
+	}
+
+	// 3. Читаем созданные файлы по порядку страниц
+	pages, err := pageFiles(tempDir, format)
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return ErrNoPages
+	}
+	for i, name := range pages {
+		content, err := os.ReadFile(filepath.Join(tempDir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read generated image %s: %w", name, err)
+		}
+		if err := fn(i+1, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PageCount возвращает число страниц PDF по данным pdfinfo, не конвертируя страницы в изображения.
+func PageCount(ctx context.Context, pdfPath string, opts Options) (int, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	output, err := opts.run(ctx, "pdfinfo", pdfPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if value, ok := strings.CutPrefix(line, "Pages:"); ok {
+			pages, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return 0, fmt.Errorf("pdfinfo reported an invalid page count %q", strings.TrimSpace(value))
+			}
+			return pages, nil
+		}
+	}
+	return 0, errors.New("pdfinfo did not report the page count")
+}
+
+// Text возвращает текстовый слой PDF по страницам (pdftotext с сохранением разметки строк).
+// У сканов без текстового слоя страницы пустые.
+func Text(ctx context.Context, pdfPath string, opts Options) ([]string, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	output, err := opts.run(ctx, "pdftotext", "-layout", "-enc", "UTF-8", pdfPath, "-")
+	if err != nil {
+		return nil, err
+	}
+	// Страницы разделены символом перевода формата; после последней страницы он тоже есть
+	pages := strings.Split(string(output), "\f")
+	if len(pages) > 1 && strings.TrimSpace(pages[len(pages)-1]) == "" {
+		pages = pages[:len(pages)-1]
+	}
+	return pages, nil
+}
+
+// Attachment — файл, вложенный в PDF.
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// Attachments возвращает файлы, вложенные в PDF (pdfdetach), например XML электронного инвойса
+// ZUGFeRD/Factur-X. PDF без вложений дает пустой список.
+func Attachments(ctx context.Context, pdfPath string, opts Options) ([]Attachment, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	tempDir, err := os.MkdirTemp("", "invpa-attachments-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if _, err := opts.run(ctx, "pdfdetach", "-saveall", "-enc", "UTF-8", "-o", tempDir, pdfPath); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read temp dir: %w", err)
+	}
+	var attachments []Attachment
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(tempDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment %s: %w", entry.Name(), err)
+		}
+		attachments = append(attachments, Attachment{Name: entry.Name(), Data: content})
+	}
+	return attachments, nil
+}
+
+// run выполняет утилиту poppler и возвращает ее стандартный вывод. Если PDF не открывается без пароля,
+// команда повторяется с каждым паролем из Passwords (-upw); когда ни один не подошел — ErrEncrypted.
+// Пароль владельца (запрет печати и копирования) чтению не мешает, и пароль для такого PDF не нужен.
+func (o Options) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmdName := o.command(name)
+	for _, password := range append([]string{""}, o.Passwords...) {
+		cmdArgs := args
+		if password != "" {
+			cmdArgs = append([]string{"-upw", password}, args...)
+		}
+		cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w (%s)", ErrPopplerNotFound, cmdName)
+		}
+		if err != nil && isPasswordError(stderr.String()) {
+			continue
+		}
+		if err != nil {
+			return nil, &CommandError{Command: name, Output: stderr.String(), Err: err}
+		}
+		return stdout.Bytes(), nil
+	}
+	return nil, ErrEncrypted
+}
+
+// isPasswordError сообщает, что утилита poppler не открыла PDF из-за пароля
+// ("Command Line Error: Incorrect password").
+func isPasswordError(output string) bool {
+	return strings.Contains(strings.ToLower(output), "incorrect password")
+}
+
+// command возвращает путь к утилите poppler с учетом PopplerPath.
+func (o Options) command(name string) string {
+	if o.PopplerPath != "" {
+		return filepath.Join(o.PopplerPath, name)
+	}
+	return name
+}
+
+// pageFiles возвращает имена файлов страниц, отсортированные по номеру страницы.
+// pdftoppm дополняет номера нулями до одинаковой ширины, но сортировка по числу
+// не зависит от этого поведения.
+func pageFiles(dir string, format Format) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read temp dir: %w", err)
+	}
+	ext := ".png"
+	if format == JPEG {
+		ext = ".jpg"
+	}
+
+	type pageFile struct {
+		name string
+		num  int
+	}
+	var pages []pageFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(name, ext), "page-"))
+		if err != nil {
+			continue
+		}
+		pages = append(pages, pageFile{name: name, num: num})
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].num < pages[j].num })
+
+	names := make([]string, len(pages))
+	for i, p := range pages {
+		names[i] = p.name
+	}
+	return names, nil
+}
@@ -0,0 +1,200 @@
+package pdfimg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// requirePoppler пропускает тест, если утилиты poppler не установлены.
+func requirePoppler(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"pdftoppm", "pdfinfo"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed", name)
+		}
+	}
+}
+
+// fakePoppler создает директорию с shell-скриптами вместо утилит poppler и возвращает ее для Options.PopplerPath.
+func fakePoppler(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake poppler utilities are shell scripts")
+	}
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRenderPages(t *testing.T) {
+	requirePoppler(t)
+	for _, format := range []Format{PNG, JPEG} {
+		t.Run(string(format), func(t *testing.T) {
+			images, err := Render(context.Background(), filepath.Join("testdata", "three-pages.pdf"), Options{DPI: 20, Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != 3 {
+				t.Fatalf("Render returned %d images, want 3", len(images))
+			}
+			// Вторая страница альбомная: порядок изображений совпадает с порядком страниц
+			for i, img := range images {
+				cfg, name, err := image.DecodeConfig(bytes.NewReader(img))
+				if err != nil {
+					t.Fatalf("page %d: %v", i+1, err)
+				}
+				if name != string(format) {
+					t.Errorf("page %d is %s, want %s", i+1, name, format)
+				}
+				if landscape := cfg.Width > cfg.Height; landscape != (i == 1) {
+					t.Errorf("page %d is %dx%d", i+1, cfg.Width, cfg.Height)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderEachStopsOnCallbackError(t *testing.T) {
+	requirePoppler(t)
+	stop := errors.New("stop")
+	var pages []int
+	err := RenderEach(context.Background(), filepath.Join("testdata", "three-pages.pdf"), Options{DPI: 20}, func(page int, image []byte) error {
+		pages = append(pages, page)
+		if page == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("RenderEach = %v, want the callback error", err)
+	}
+	if len(pages) != 2 || pages[0] != 1 || pages[1] != 2 {
+		t.Errorf("callback got pages %v, want [1 2]", pages)
+	}
+}
+
+func TestPageCountAndLimit(t *testing.T) {
+	requirePoppler(t)
+	path := filepath.Join("testdata", "three-pages.pdf")
+	if pages, err := PageCount(context.Background(), path, Options{}); err != nil || pages != 3 {
+		t.Errorf("PageCount = %d, %v, want 3", pages, err)
+	}
+
+	err := RenderEach(context.Background(), path, Options{DPI: 20, MaxPages: 2}, func(int, []byte) error {
+		t.Error("pages rendered over the limit")
+		return nil
+	})
+	var limitErr *PageLimitError
+	if !errors.As(err, &limitErr) || limitErr.Pages != 3 || limitErr.Limit != 2 {
+		t.Errorf("RenderEach over the limit = %v, want *PageLimitError{3, 2}", err)
+	}
+	if images, err := Render(context.Background(), path, Options{DPI: 20, MaxPages: 3}); err != nil || len(images) != 3 {
+		t.Errorf("Render at the limit = %d images, %v", len(images), err)
+	}
+}
+
+func TestEncryptedPDF(t *testing.T) {
+	requirePoppler(t)
+	path := filepath.Join("testdata", "encrypted.pdf")
+	if _, err := PageCount(context.Background(), path, Options{Passwords: []string{"wrong"}}); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("PageCount with a wrong password = %v, want ErrEncrypted", err)
+	}
+	images, err := Render(context.Background(), path, Options{DPI: 20, Passwords: []string{"wrong", "secret"}})
+	if err != nil || len(images) != 1 {
+		t.Errorf("Render with the password = %d images, %v", len(images), err)
+	}
+}
+
+func TestBrokenPDF(t *testing.T) {
+	requirePoppler(t)
+	_, err := Render(context.Background(), filepath.Join("testdata", "not-a-pdf.pdf"), Options{})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Command != "pdftoppm" {
+		t.Errorf("Render of a broken file = %v, want *CommandError from pdftoppm", err)
+	}
+}
+
+// Тесты ниже подменяют утилиты poppler скриптами и работают без установленного poppler.
+
+func TestPopplerNotFound(t *testing.T) {
+	_, err := Render(context.Background(), filepath.Join("testdata", "three-pages.pdf"), Options{PopplerPath: t.TempDir()})
+	if !errors.Is(err, ErrPopplerNotFound) {
+		t.Errorf("Render without poppler = %v, want ErrPopplerNotFound", err)
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	dir := fakePoppler(t, map[string]string{
+		"pdfinfo": `case "$*" in
+*"-upw secret"*) echo "Pages:          40" ;;
+*) echo "Command Line Error: Incorrect password" >&2; exit 1 ;;
+esac`,
+		"pdftoppm": `echo "Syntax Error: Couldn't find trailer dictionary" >&2; exit 1`,
+	})
+	ctx := context.Background()
+
+	if _, err := PageCount(ctx, "invoice.pdf", Options{PopplerPath: dir}); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("PageCount without a password = %v, want ErrEncrypted", err)
+	}
+	pages, err := PageCount(ctx, "invoice.pdf", Options{PopplerPath: dir, Passwords: []string{"other", "secret"}})
+	if err != nil || pages != 40 {
+		t.Errorf("PageCount with the password = %d, %v, want 40", pages, err)
+	}
+
+	err = RenderEach(ctx, "invoice.pdf", Options{PopplerPath: dir, Passwords: []string{"secret"}, MaxPages: 12}, nil)
+	var limitErr *PageLimitError
+	if !errors.As(err, &limitErr) || limitErr.Pages != 40 || limitErr.Limit != 12 {
+		t.Errorf("RenderEach over the limit = %v, want *PageLimitError{40, 12}", err)
+	}
+
+	_, err = Render(ctx, "invoice.pdf", Options{PopplerPath: dir})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Command != "pdftoppm" || cmdErr.Output == "" {
+		t.Fatalf("Render = %v, want *CommandError with the pdftoppm output", err)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("CommandError does not unwrap to the exit error: %v", err)
+	}
+
+	// pdftoppm завершился успешно, но не создал изображений
+	dir = fakePoppler(t, map[string]string{"pdftoppm": `exit 0`})
+	if _, err := Render(ctx, "invoice.pdf", Options{PopplerPath: dir}); !errors.Is(err, ErrNoPages) {
+		t.Errorf("Render without output = %v, want ErrNoPages", err)
+	}
+}
+
+func TestPageFilesOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"page-10.png", "page-2.png", "page-1.png", "page-3.jpg", "other.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := pageFiles(dir, PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"page-1.png", "page-2.png", "page-10.png"}
+	if len(names) != len(want) {
+		t.Fatalf("pageFiles = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("pageFiles = %v, want %v", names, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package report
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// InvoiceHeaders — колонки листа "Invoices" и CSV-таблицы инвойсов.
+var InvoiceHeaders = []string{
+	"Source File", "Status", "Type", "Direction", "Counterparty ID", "Counterparty Name", "Counterparty VAT", "Counterparty Country",
+	"Invoice Number", "Date", "Total Amount", "Tax Amount", "Tax Breakdown", "Currency", "Purpose", "Category", "Order Reference", "Contract Reference", "Invoice In File", "Warnings", "Extraction",
+	"Duration (ms)",
+}
+
+// Позиции колонок InvoiceHeaders, которые заполняются и в строках ошибок и пропущенных документов.
+var (
+	invoiceInFileColumn = slices.Index(InvoiceHeaders, "Invoice In File")
+	durationColumn      = slices.Index(InvoiceHeaders, "Duration (ms)")
+)
+
+// CounterpartyHeaders — колонки листа "Counterparties" и CSV-таблицы контрагентов.
+var CounterpartyHeaders = []string{"Source File", "ID", "Name", "VAT", "Tax Code 2", "Registration Number", "Country", "Country Code", "Address", "IBAN", "SWIFT", "Other Bank Accounts", "Default Currency", "Phone", "Email", "Website", "Aliases", "Resolved Via Alias"}
+
+// InvoiceColumns возвращает колонки инвойсов; в подробном режиме добавляется колонка источников полей.
+func InvoiceColumns(verbose bool) []string {
+	if verbose {
+		return append(append([]string(nil), InvoiceHeaders...), "Sources")
+	}
+	return InvoiceHeaders
+}
+
+// InvoiceRow возвращает значения строки инвойса в порядке InvoiceColumns.
+func InvoiceRow(res invoice.Result, verbose bool) []any {
+	if res.ErrorMessage != "" {
+		if res.DurationMS == 0 {
+			return []any{res.SourceFile, res.ErrorMessage}
+		}
+		// Время обработки нужно и для файлов с ошибкой: долгие файлы часто завершаются таймаутом
+		row := shortRow(durationColumn + 1)
+		row[0], row[1], row[durationColumn] = res.SourceFile, res.ErrorMessage, res.DurationMS
+		return row
+	}
+	if res.IsSkipped() {
+		// Номер документа в файле нужен, чтобы строку можно было сопоставить со страницами файла
+		row := shortRow(invoiceInFileColumn + 1)
+		if res.DurationMS != 0 {
+			row = shortRow(durationColumn + 1)
+			row[durationColumn] = res.DurationMS
+		}
+		row[0], row[1], row[invoiceInFileColumn] = res.SourceFile, "Skipped: "+res.Skipped, fmt.Sprintf("%d of %d", res.InvoiceIndex, res.InvoiceCount)
+		return row
+	}
+	cp := res.Invoice.Counterparty
+	row := []any{
+		res.SourceFile, invoiceStatus(res), res.Invoice.TypeName(), res.Invoice.Direction, cp.ID, cp.Name, cp.VAT, cp.ReportCountry(),
+		res.Invoice.Number, res.Invoice.Date, res.Invoice.TotalAmount, res.Invoice.TaxAmount, res.Invoice.FormatTaxBreakdown(), res.Invoice.Currency, res.Invoice.Purpose, res.Invoice.Category, res.Invoice.OrderReference, res.Invoice.ContractReference,
+		fmt.Sprintf("%d of %d", res.InvoiceIndex, res.InvoiceCount), invoice.FormatIssues(res.Warnings),
+		res.Invoice.ExtractionSource(), durationCell(res),
+	}
+	if verbose {
+		sources := ""
+		if res.Invoice.Sources != nil {
+			sources = res.Invoice.Sources.String()
+		}
+		row = append(row, sources)
+	}
+	return row
+}
+
+// shortRow возвращает строку из width пустых значений для строк ошибок и пропущенных документов.
+func shortRow(width int) []any {
+	row := make([]any, width)
+	for i := range row {
+		row[i] = ""
+	}
+	return row
+}
+
+// durationCell возвращает значение колонки "Duration (ms)": время обработки файла есть только
+// у первого инвойса файла, у остальных ячейка пустая.
+func durationCell(res invoice.Result) any {
+	if res.DurationMS == 0 {
+		return ""
+	}
+	return res.DurationMS
+}
+
+// InvoiceRows возвращает строки инвойсов для CSV-таблицы.
+func InvoiceRows(results []invoice.Result, verbose bool) [][]any {
+	rows := make([][]any, len(results))
+	for i, res := range results {
+		rows[i] = InvoiceRow(res, verbose)
+	}
+	return rows
+}
+
+// invoiceStatus возвращает статус успешно извлеченного инвойса: "OK" или "Duplicate of <файл>".
+func invoiceStatus(res invoice.Result) string {
+	if res.IsDuplicate() {
+		return "Duplicate of " + res.DuplicateOf
+	}
+	return "OK"
+}
+
+// CounterpartyRow возвращает значения строки контрагента в порядке CounterpartyHeaders.
+func CounterpartyRow(ucp invoice.UniqueCounterparty) []any {
+	cp := ucp.Counterparty
+	return []any{
+		ucp.SourceFile, cp.ID, cp.Name, cp.VAT, cp.TaxCode2, cp.RegistrationNumber, cp.Country, cp.CountryCode, cp.Address,
+		cp.IBAN, cp.SWIFT, cp.AdditionalBankAccounts(), cp.DefaultCurrency, cp.Phone, cp.Email, cp.Website, strings.Join(cp.Aliases, "; "),
+		ucp.AliasRule,
+	}
+}
+
+// CounterpartyRows возвращает строки контрагентов для CSV-таблицы.
+func CounterpartyRows(counterparties []invoice.UniqueCounterparty) [][]any {
+	rows := make([][]any, len(counterparties))
+	for i, ucp := range counterparties {
+		rows[i] = CounterpartyRow(ucp)
+	}
+	return rows
+}
+
+// Filtered — инвойс, исключенный фильтром отчета, и причина исключения.
+type Filtered struct {
+	invoice.Result
+	Reason string
+}
+
+// FilteredColumns возвращает колонки листа "Filtered out" и CSV-таблицы исключенных инвойсов.
+func FilteredColumns(verbose bool) []string {
+	return append([]string{"Filter"}, InvoiceColumns(verbose)...)
+}
+
+// FilteredRow возвращает значения строки исключенного инвойса в порядке FilteredColumns.
+func FilteredRow(res Filtered, verbose bool) []any {
+	return append([]any{res.Reason}, InvoiceRow(res.Result, verbose)...)
+}
+
+// FilteredRows возвращает строки исключенных инвойсов для CSV-таблицы.
+func FilteredRows(filtered []Filtered, verbose bool) [][]any {
+	rows := make([][]any, len(filtered))
+	for i, res := range filtered {
+		rows[i] = FilteredRow(res, verbose)
+	}
+	return rows
+}
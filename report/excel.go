@@ -0,0 +1,385 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/xuri/excelize/v2"
+)
+
+// Data — содержимое Excel-отчета.
+type Data struct {
+	Results        []invoice.Result // Строки листа "Invoices"
+	All            []invoice.Result // Все результаты для листов "Errors" и "Usage"; nil — Results
+	Filtered       []Filtered       // Строки листа "Filtered out"; без них лист не создается
+	Counterparties []invoice.UniqueCounterparty
+	VATSummary     invoice.VATSummary
+	MatchingUsage  invoice.Usage
+	Summary        invoice.RunSummary
+}
+
+// Options — различия отчетов приложений. Нулевое значение — отчет без дополнительных колонок и строк.
+type Options struct {
+	Verbose       bool              // Колонка "Sources" с источниками значений полей
+	SourceLinks   map[string]string // Ссылки ячеек "Source File" на исходные файлы по Result.SourceFile
+	SummaryRows   [][]any           // Строки листа "Summary" сразу после заголовка, например метки задания
+	CorrelationID string            // Идентификатор трассировки в свойствах документа; пусто — свойства не задаются
+}
+
+// WriteExcel записывает Excel-отчет в w. Раскладка листов и колонок — формат для макросов пользователей,
+// поэтому меняется только добавлением в конец. Возвращает предупреждения о миниатюрах, которые не удалось встроить.
+func WriteExcel(w io.Writer, data Data, config *invoice.Config, opts Options) ([]string, error) {
+	f, warnings := newExcel(data, config, opts)
+	defer f.Close()
+	_, err := f.WriteTo(w)
+	return warnings, err
+}
+
+// SaveExcel аналогичен WriteExcel, но сохраняет отчет в файл path через excelize.File.SaveAs.
+func SaveExcel(path string, data Data, config *invoice.Config, opts Options) ([]string, error) {
+	f, warnings := newExcel(data, config, opts)
+	defer f.Close()
+	return warnings, f.SaveAs(path)
+}
+
+// newExcel создает книгу отчета и возвращает ее вместе с предупреждениями о миниатюрах.
+func newExcel(data Data, config *invoice.Config, opts Options) (*excelize.File, []string) {
+	all := data.All
+	if all == nil {
+		all = data.Results
+	}
+	f := excelize.NewFile()
+
+	// --- Лист "Invoices" ---
+	f.NewSheet("Invoices")
+	f.DeleteSheet("Sheet1") // Удаляем лист по умолчанию
+	headers := InvoiceColumns(opts.Verbose)
+	f.SetSheetRow("Invoices", "A1", &headers)
+	// Желтая заливка выделяет значения, в которых модель не уверена, валюту, отличающуюся от обычной,
+	// и нераспознанные даты
+	styles := newInvoiceStyles(f)
+	for i, res := range data.Results {
+		row := i + 2
+		values := InvoiceRow(res, opts.Verbose)
+		f.SetSheetRow("Invoices", fmt.Sprintf("A%d", row), &values)
+		if link := opts.SourceLinks[res.SourceFile]; link != "" {
+			f.SetCellHyperLink("Invoices", fmt.Sprintf("A%d", row), link, "External")
+		}
+		if res.ErrorMessage != "" {
+			f.SetCellStyle("Invoices", fmt.Sprintf("B%d", row), fmt.Sprintf("B%d", row), styles.error)
+		} else if res.IsDuplicate() {
+			formatInvoiceRow(f, headers, row, res, styles) // Повтор не проверяют: он не входит в итоги
+		} else if res.Invoice != nil {
+			formatInvoiceRow(f, headers, row, res, styles)
+			highlightLowConfidence(f, headers, row, res.Invoice, config.LowConfidenceThreshold(), styles)
+			highlightCurrencyMismatch(f, headers, row, res.Warnings, styles.highlight)
+		}
+	}
+	// Автофильтр позволяет сортировать и фильтровать инвойсы в Excel, например по направлению
+	lastColumn, _ := excelize.ColumnNumberToName(len(headers))
+	f.AutoFilter("Invoices", fmt.Sprintf("A1:%s%d", lastColumn, len(data.Results)+1), nil)
+	warnings := addPreviewImages(f, data.Results, len(headers)+1, config.ThumbnailSize, config.ThumbnailsMaxBytes())
+
+	// --- Лист "Counterparties" ---
+	f.NewSheet("Counterparties")
+	f.SetSheetRow("Counterparties", "A1", &CounterpartyHeaders)
+	// Красная заливка для VAT и IBAN, не прошедших проверку формата и контрольной суммы
+	invalidStyle, _ := f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Color: "9A0511"},
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFC7CE"}},
+	})
+	for i, ucp := range data.Counterparties {
+		values := CounterpartyRow(ucp)
+		f.SetSheetRow("Counterparties", fmt.Sprintf("A%d", i+2), &values)
+		highlightInvalidIdentifiers(f, i+2, ucp.Counterparty, invalidStyle)
+	}
+
+	writeFilteredSheet(f, data.Filtered, opts.Verbose)
+	writeErrorsSheet(f, all)
+	WriteVATSummarySheet(f, data.VATSummary)
+	writeUsageSheet(f, all, data.MatchingUsage, config.ModelPrices)
+	writeSummarySheet(f, data.Summary, opts.SummaryRows)
+	if opts.CorrelationID != "" {
+		f.SetDocProps(&excelize.DocProperties{
+			Title:       "Invoice report",
+			Identifier:  opts.CorrelationID,
+			Description: "Correlation ID: " + opts.CorrelationID,
+		})
+	}
+	return f, warnings
+}
+
+// confidenceColumns сопоставляет ключи Invoice.Confidences колонкам листа "Invoices".
+var confidenceColumns = map[string]string{
+	"number": "Invoice Number", "date": "Date", "total_amount": "Total Amount", "tax_amount": "Tax Amount",
+	"counterparty.name": "Counterparty Name", "counterparty.vat": "Counterparty VAT",
+}
+
+// amountColumns — колонки сумм листа "Invoices".
+var amountColumns = []string{"Total Amount", "Tax Amount"}
+
+// invoiceStyles — стили ячеек листа "Invoices". Даты и суммы записываются значениями с форматом,
+// чтобы с ними работали сортировка, фильтры и сводные таблицы; выделение сохраняет формат ячейки.
+type invoiceStyles struct {
+	error           int // Красный шрифт статуса ошибки
+	date, amount    int // Формат yyyy-mm-dd и #,##0.00 с выравниванием вправо
+	highlight       int // Желтая заливка значений, которые стоит проверить
+	highlightDate   int
+	highlightAmount int
+	duplicate       int // Серая заливка строк повторов
+	duplicateDate   int
+	duplicateAmount int
+}
+
+func newInvoiceStyles(f *excelize.File) invoiceStyles {
+	fill := excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFF2A8"}}
+	right := &excelize.Alignment{Horizontal: "right"}
+	dateFormat, amountFormat := "yyyy-mm-dd", "#,##0.00"
+	var s invoiceStyles
+	s.error, _ = f.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "9A0511"}})
+	s.date, _ = f.NewStyle(&excelize.Style{CustomNumFmt: &dateFormat, Alignment: right})
+	s.amount, _ = f.NewStyle(&excelize.Style{CustomNumFmt: &amountFormat, Alignment: right})
+	s.highlight, _ = f.NewStyle(&excelize.Style{Fill: fill})
+	s.highlightDate, _ = f.NewStyle(&excelize.Style{CustomNumFmt: &dateFormat, Alignment: right, Fill: fill})
+	s.highlightAmount, _ = f.NewStyle(&excelize.Style{CustomNumFmt: &amountFormat, Alignment: right, Fill: fill})
+	grey := excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"D9D9D9"}}
+	s.duplicate, _ = f.NewStyle(&excelize.Style{Fill: grey})
+	s.duplicateDate, _ = f.NewStyle(&excelize.Style{CustomNumFmt: &dateFormat, Alignment: right, Fill: grey})
+	s.duplicateAmount, _ = f.NewStyle(&excelize.Style{CustomNumFmt: &amountFormat, Alignment: right, Fill: grey})
+	return s
+}
+
+// highlighted возвращает стиль выделенной ячейки колонки column с форматом этой колонки.
+func (s invoiceStyles) highlighted(column string) int {
+	switch {
+	case column == "Date":
+		return s.highlightDate
+	case slices.Contains(amountColumns, column):
+		return s.highlightAmount
+	}
+	return s.highlight
+}
+
+// formatInvoiceRow записывает дату строки row значением даты и задает формат дат и сумм.
+// Нераспознанная дата остается строкой и выделяется заливкой, а строка повтора целиком заливается серым.
+func formatInvoiceRow(f *excelize.File, headers []string, row int, res invoice.Result, styles invoiceStyles) {
+	dateStyle, amountStyle, invalidDateStyle := styles.date, styles.amount, styles.highlight
+	if res.IsDuplicate() {
+		first, _ := excelize.CoordinatesToCellName(1, row)
+		last, _ := excelize.CoordinatesToCellName(len(headers), row)
+		f.SetCellStyle("Invoices", first, last, styles.duplicate)
+		dateStyle, amountStyle, invalidDateStyle = styles.duplicateDate, styles.duplicateAmount, styles.duplicate
+	}
+	if col := slices.Index(headers, "Date"); col >= 0 {
+		cell, _ := excelize.CoordinatesToCellName(col+1, row)
+		if date, err := invoice.ParseInvoiceDate(res.Invoice.Date); err == nil {
+			f.SetCellValue("Invoices", cell, date)
+			f.SetCellStyle("Invoices", cell, cell, dateStyle)
+		} else {
+			f.SetCellStyle("Invoices", cell, cell, invalidDateStyle)
+		}
+	}
+	for _, column := range amountColumns {
+		if col := slices.Index(headers, column); col >= 0 {
+			cell, _ := excelize.CoordinatesToCellName(col+1, row)
+			f.SetCellStyle("Invoices", cell, cell, amountStyle)
+		}
+	}
+}
+
+// highlightLowConfidence выделяет ячейки строки row, в значениях которых модель не уверена.
+func highlightLowConfidence(f *excelize.File, headers []string, row int, inv *invoice.Invoice, threshold float64, styles invoiceStyles) {
+	for field, column := range confidenceColumns {
+		col := slices.Index(headers, column)
+		if col < 0 || !inv.LowConfidence(field, threshold) {
+			continue
+		}
+		cell, _ := excelize.CoordinatesToCellName(col+1, row)
+		f.SetCellStyle("Invoices", cell, cell, styles.highlighted(column))
+	}
+}
+
+// highlightCurrencyMismatch выделяет стилем style валюту, отличающуюся от обычной валюты контрагента.
+func highlightCurrencyMismatch(f *excelize.File, headers []string, row int, warnings []invoice.ValidationIssue, style int) {
+	col := slices.Index(headers, "Currency")
+	if col < 0 || !slices.ContainsFunc(warnings, func(issue invoice.ValidationIssue) bool { return issue.Field == "currency" }) {
+		return
+	}
+	cell, _ := excelize.CoordinatesToCellName(col+1, row)
+	f.SetCellStyle("Invoices", cell, cell, style)
+}
+
+// highlightInvalidIdentifiers выделяет стилем style ячейки VAT и IBAN строки row листа "Counterparties",
+// не прошедшие invoice.ValidateVAT и invoice.ValidateIBAN.
+func highlightInvalidIdentifiers(f *excelize.File, row int, cp invoice.Counterparty, style int) {
+	invalid := map[string]bool{
+		"VAT":  cp.VAT != "" && invoice.ValidateVAT(cp.VAT, cp.CountryCode) != nil,
+		"IBAN": cp.IBAN != "" && invoice.ValidateIBAN(cp.IBAN) != nil,
+	}
+	for column, bad := range invalid {
+		if col := slices.Index(CounterpartyHeaders, column); bad && col >= 0 {
+			cell, _ := excelize.CoordinatesToCellName(col+1, row)
+			f.SetCellStyle("Counterparties", cell, cell, style)
+		}
+	}
+}
+
+// addPreviewImages встраивает миниатюры первых страниц в колонку "Preview" (номер column) листа "Invoices".
+// Миниатюры сверх лимита maxBytes пропускаются, ошибки встраивания не прерывают создание отчета.
+func addPreviewImages(f *excelize.File, results []invoice.Result, column, thumbnailSize, maxBytes int) []string {
+	if thumbnailSize <= 0 {
+		return nil
+	}
+	col, _ := excelize.ColumnNumberToName(column)
+	f.SetCellValue("Invoices", col+"1", "Preview")
+	f.SetColWidth("Invoices", col, col, float64(thumbnailSize)/7+1)
+
+	var warnings []string
+	total, skipped := 0, 0
+	for i, res := range results {
+		if res.Invoice == nil || len(res.Invoice.Preview) == 0 {
+			continue
+		}
+		if total+len(res.Invoice.Preview) > maxBytes {
+			skipped++
+			continue
+		}
+		row := i + 2
+		f.SetRowHeight("Invoices", row, float64(thumbnailSize)*0.75+2) // пиксели -> пункты
+		err := f.AddPictureFromBytes("Invoices", fmt.Sprintf("%s%d", col, row), &excelize.Picture{
+			Extension: ".jpg",
+			File:      res.Invoice.Preview,
+			Format:    &excelize.GraphicOptions{AltText: res.SourceFile, Positioning: "oneCell"},
+		})
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Could not embed preview for %s: %v", res.SourceFile, err))
+			continue
+		}
+		total += len(res.Invoice.Preview)
+	}
+	if skipped > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d previews skipped: total size limit of %d MB reached", skipped, maxBytes>>20))
+	}
+	return warnings
+}
+
+// writeFilteredSheet добавляет лист "Filtered out" с инвойсами, исключенными фильтрами.
+func writeFilteredSheet(f *excelize.File, filtered []Filtered, verbose bool) {
+	if len(filtered) == 0 {
+		return
+	}
+	const sheet = "Filtered out"
+	f.NewSheet(sheet)
+	headers := FilteredColumns(verbose)
+	f.SetSheetRow(sheet, "A1", &headers)
+	for i, res := range filtered {
+		values := FilteredRow(res, verbose)
+		f.SetSheetRow(sheet, fmt.Sprintf("A%d", i+2), &values)
+	}
+}
+
+// writeErrorsSheet добавляет лист "Errors" с файлами, которые не удалось обработать, и рекомендациями.
+// Лист создается только при наличии ошибок.
+func writeErrorsSheet(f *excelize.File, results []invoice.Result) {
+	const sheet = "Errors"
+	row := 1
+	for _, res := range results {
+		if res.ErrorMessage == "" {
+			continue
+		}
+		if row == 1 {
+			f.NewSheet(sheet)
+			f.SetSheetRow(sheet, "A1", &[]any{"Source File", "Code", "Message", "Suggested Action"})
+		}
+		row++
+		f.SetSheetRow(sheet, fmt.Sprintf("A%d", row), &[]any{res.SourceFile, res.ErrorCode, res.ErrorMessage, invoice.ErrorAction(res.ErrorCode)})
+	}
+	if row > 1 {
+		f.AutoFilter(sheet, fmt.Sprintf("A1:D%d", row), nil)
+	}
+}
+
+// writeUsageSheet добавляет лист "Usage" с расходом токенов по файлам и итогом.
+func writeUsageSheet(f *excelize.File, results []invoice.Result, matchingUsage invoice.Usage, prices map[string]invoice.ModelPrice) {
+	const sheet = "Usage"
+	f.NewSheet(sheet)
+	for i, h := range []string{"Source File", "Requests", "Prompt Tokens", "Completion Tokens", "Estimated Cost, $"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheet, cell, h)
+	}
+	row := 2
+	writeRow := func(name string, u invoice.Usage) {
+		f.SetCellValue(sheet, fmt.Sprintf("A%d", row), name)
+		f.SetCellValue(sheet, fmt.Sprintf("B%d", row), u.Requests)
+		f.SetCellValue(sheet, fmt.Sprintf("C%d", row), u.PromptTokens)
+		f.SetCellValue(sheet, fmt.Sprintf("D%d", row), u.CompletionTokens)
+		f.SetCellValue(sheet, fmt.Sprintf("E%d", row), u.EstimateCost(prices))
+		row++
+	}
+	total := matchingUsage
+	for _, res := range results {
+		if res.InvoiceIndex > 1 {
+			continue // Использование учтено в первом инвойсе файла
+		}
+		writeRow(res.SourceFile, res.Usage)
+		total.Add(res.Usage)
+	}
+	writeRow("Counterparty matching", matchingUsage)
+	writeRow("TOTAL", total)
+}
+
+// writeSummarySheet добавляет лист "Summary" с итогом обработки; extra выводятся сразу после заголовка.
+func writeSummarySheet(f *excelize.File, summary invoice.RunSummary, extra [][]any) {
+	const sheet = "Summary"
+	f.NewSheet(sheet)
+	rows := append([][]any{{"Metric", "Value"}}, extra...)
+	rows = append(rows, [][]any{
+		{"Files scanned", summary.FilesScanned},
+		{"Files processed", summary.FilesProcessed},
+		{"Files skipped", summary.FilesSkipped},
+		{"Files failed", summary.FilesFailed},
+		{"Invoices extracted", summary.InvoicesExtracted},
+		{"Duplicate invoices", summary.Duplicates},
+		{"Skipped (not an invoice)", summary.NotInvoices},
+		{"New counterparties", summary.CounterpartiesNew},
+		{"Matched counterparties", summary.CounterpartiesMatched},
+	}...)
+	for _, code := range invoice.ErrorCodes {
+		if n := summary.Errors[code]; n > 0 {
+			rows = append(rows, []any{"Errors: " + code, n})
+		}
+	}
+	for _, kind := range summary.WarningTypes() {
+		rows = append(rows, []any{"Warnings: " + kind, summary.Warnings[kind]})
+	}
+	rows = append(rows,
+		[]any{"OpenAI requests", summary.Usage.Requests},
+		[]any{"Prompt tokens", summary.Usage.PromptTokens},
+		[]any{"Completion tokens", summary.Usage.CompletionTokens},
+		[]any{"Estimated cost, $", summary.EstimatedCost},
+		[]any{"Wall time", summary.WallTime.Round(time.Second).String()},
+	)
+	for _, currency := range summary.Currencies() {
+		rows = append(rows, []any{"Net spend, " + currency, summary.NetSpend[currency]})
+	}
+
+	// Кредит-ноты со ссылкой на исходный инвойс; несвязанные остаются отдельными отрицательными строками
+	if len(summary.Credits) > 0 {
+		rows = append(rows, nil, []any{"Credits"}, []any{"Source File", "Number", "Counterparty", "Currency", "Amount", "Linked Invoice"})
+		for _, credit := range summary.Credits {
+			linked := "unlinked"
+			if credit.Linked() {
+				linked = fmt.Sprintf("%s (%s)", credit.InvoiceNumber, credit.InvoiceFile)
+			}
+			rows = append(rows, []any{credit.SourceFile, credit.Number, credit.Counterparty, credit.Currency, credit.Amount, linked})
+		}
+	}
+	for i, values := range rows {
+		if values != nil {
+			f.SetSheetRow(sheet, fmt.Sprintf("A%d", i+1), &values)
+		}
+	}
+}
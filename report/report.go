@@ -0,0 +1,57 @@
+// Package report формирует отчеты по результатам обработки инвойсов: Excel-книгу и строки CSV-таблиц.
+// Пакет используют и cmd/reporter, и cmd/web, поэтому раскладка отчетов у них не расходится;
+// различия приложений задаются параметрами (см. Options и FindOptions).
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/veryevilzed/invpa/invoice"
+)
+
+// LoadConfig читает конфигурацию из JSON-файла path. Проверка значений — invoice.Config.Validate.
+func LoadConfig(path string) (*invoice.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config invoice.Config
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&config)
+	return &config, err
+}
+
+// FindOptions — параметры поиска файлов инвойсов.
+type FindOptions struct {
+	Recursive       bool // Просматривать вложенные директории
+	SkipAppleDouble bool // Пропускать файлы "._*", которые macOS создает в архивах и на чужих файловых системах
+}
+
+// FindInvoiceFiles ищет в root файлы поддерживаемых типов (invoice.IsSupportedFile).
+func FindInvoiceFiles(root string, opts FindOptions) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && !opts.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if opts.SkipAppleDouble && strings.HasPrefix(info.Name(), "._") {
+			return nil
+		}
+		if invoice.IsSupportedFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,63 @@
+package report
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/veryevilzed/invpa/invoice"
+	"github.com/xuri/excelize/v2"
+)
+
+// WriteVATSummarySheet добавляет лист "VAT Summary". В первой строке выводится период сводки,
+// затем блок без разбивки по ставкам (выделяется красным) и блок по ставкам, а после них — число
+// инвойсов, исключенных из-за нераспознанной даты.
+func WriteVATSummarySheet(f *excelize.File, summary invoice.VATSummary) {
+	const sheet = "VAT Summary"
+	f.NewSheet(sheet)
+	warnStyle, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true, Color: "9A0511"}})
+	boldStyle, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+
+	period := "all dates"
+	if !summary.From.IsZero() || !summary.To.IsZero() {
+		period = fmt.Sprintf("%s .. %s", formatPeriodDate(summary.From), formatPeriodDate(summary.To))
+	}
+	f.SetCellValue(sheet, "A1", "Period: "+period)
+
+	row := 3
+	writeRows := func(title string, rows []invoice.VATSummaryRow, style int, withRate bool) {
+		f.SetCellValue(sheet, fmt.Sprintf("A%d", row), title)
+		f.SetCellStyle(sheet, fmt.Sprintf("A%d", row), fmt.Sprintf("A%d", row), style)
+		row++
+		for i, h := range []string{"Region", "Currency", "Rate, %", "Base", "Tax", "Invoices"} {
+			cell, _ := excelize.CoordinatesToCellName(i+1, row)
+			f.SetCellValue(sheet, cell, h)
+		}
+		row++
+		for _, r := range rows {
+			f.SetCellValue(sheet, fmt.Sprintf("A%d", row), r.Region)
+			f.SetCellValue(sheet, fmt.Sprintf("B%d", row), r.Currency)
+			if withRate {
+				f.SetCellValue(sheet, fmt.Sprintf("C%d", row), r.Rate)
+			}
+			f.SetCellValue(sheet, fmt.Sprintf("D%d", row), r.Base)
+			f.SetCellValue(sheet, fmt.Sprintf("E%d", row), r.Tax)
+			f.SetCellValue(sheet, fmt.Sprintf("F%d", row), r.Invoices)
+			row++
+		}
+		row++
+	}
+
+	writeRows("UNCLASSIFIED (no tax breakdown)", summary.Unclassified, warnStyle, false)
+	writeRows("By tax rate", summary.Rows, boldStyle, true)
+	if summary.Undated > 0 {
+		f.SetCellValue(sheet, fmt.Sprintf("A%d", row), fmt.Sprintf("%d invoices excluded: unrecognized date", summary.Undated))
+		f.SetCellStyle(sheet, fmt.Sprintf("A%d", row), fmt.Sprintf("A%d", row), warnStyle)
+	}
+}
+
+func formatPeriodDate(t time.Time) string {
+	if t.IsZero() {
+		return "*"
+	}
+	return t.Format("2006-01-02")
+}